@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/accounting"
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/documents"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// How many documents a connector pushes in a run of the sync job, and how long a push
+// may take.
+const (
+	accountingSyncRunSize = 100
+	accountingPushTimeout = 30 * time.Second
+)
+
+var accountingClient = &http.Client{Timeout: accountingPushTimeout}
+
+// The syncAccounting() method is the accounting sync job. For every active connector
+// it queues the documents which have no sync yet and pushes those which are due.
+func (app *application) syncAccounting() {
+	connectors, err := app.models.AccountingConnectors.GetActive()
+	if err != nil {
+		app.logger.Err(err).Msg("reading the accounting connectors")
+		return
+	}
+
+	for _, connector := range connectors {
+		enabled, err := app.models.FeatureFlags.Enabled(data.FeatureAccounting, connector.OrganisationID)
+		if err != nil {
+			app.logger.Err(err).Int64("organisation_id", connector.OrganisationID).Msg("reading the accounting feature flag")
+			continue
+		}
+		if !enabled {
+			continue
+		}
+
+		app.syncConnector(connector)
+	}
+}
+
+func (app *application) syncConnector(connector *data.AccountingConnector) {
+	log := app.logger.With().Int64("connector_id", connector.ID).Int64("organisation_id", connector.OrganisationID).Logger()
+
+	var pusher accounting.Connector
+	var err error
+
+	if app.sandbox != nil {
+		pusher = app.sandbox.Connector(connector)
+	} else {
+		pusher, err = accounting.New(connector, app.config.accounting.exportDir, accountingClient, app.recordExchangeFile)
+		if err != nil {
+			log.Err(err).Msg("setting up the accounting connector")
+			return
+		}
+	}
+
+	_, err = app.models.AccountingSyncs.Enqueue(connector)
+	if err != nil {
+		log.Err(err).Msg("queueing the documents for the accounting system")
+		return
+	}
+
+	syncs, err := app.models.AccountingSyncs.Due(connector.ID, accountingSyncRunSize)
+	if err != nil {
+		log.Err(err).Msg("reading the documents due for the accounting system")
+		return
+	}
+
+	synced := 0
+	for _, sync := range syncs {
+		externalID, err := app.pushDocument(pusher, connector, sync)
+		if err != nil {
+			log.Err(err).Str("document_type", sync.DocumentType).Int64("document_id", sync.DocumentID).Msg("pushing the document to the accounting system")
+		} else {
+			synced++
+		}
+
+		// The invoice keeps its id in the accounting system under the kind of the
+		// connector, so that it can be found by it.
+		if err == nil && externalID != "" && sync.DocumentType == data.SyncInvoice {
+			_, refErr := app.models.Invoices.SetExternalRef(sync.DocumentID, connector.Kind, externalID)
+			if refErr != nil {
+				log.Err(refErr).Int64("document_id", sync.DocumentID).Msg("recording the external reference of the invoice")
+			}
+		}
+
+		err = app.models.AccountingSyncs.SetResult(sync, externalID, err)
+		if err != nil {
+			log.Err(err).Int64("sync_id", sync.ID).Msg("recording the accounting sync")
+			return
+		}
+	}
+
+	if synced > 0 {
+		log.Info().Int("documents", synced).Msg("documents pushed to the accounting system")
+	}
+}
+
+// pushDocument loads the document of the sync and pushes it. A document deleted after
+// it was queued is rejected.
+func (app *application) pushDocument(pusher accounting.Connector, connector *data.AccountingConnector, sync *data.AccountingSync) (string, error) {
+	document := &accounting.Document{
+		Type:           sync.DocumentType,
+		ID:             sync.DocumentID,
+		OrganisationID: connector.OrganisationID,
+	}
+
+	var err error
+	switch sync.DocumentType {
+	case data.SyncInvoice:
+		document.Invoice, err = app.invoiceDocument(sync.DocumentID)
+	case data.SyncPayment:
+		document.Payment, err = app.paymentDocument(sync.DocumentID)
+	default:
+		err = fmt.Errorf("%w: unknown document type %q", data.ErrSyncRejected, sync.DocumentType)
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return "", fmt.Errorf("%w: the %s was deleted", data.ErrSyncRejected, sync.DocumentType)
+		}
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), accountingPushTimeout)
+	defer cancel()
+
+	return pusher.Push(ctx, document)
+}
+
+// recordExchangeFile keeps an exchange file of a 1C connector as a version of its
+// document, so the files handed to 1C can be looked up later.
+func (app *application) recordExchangeFile(ctx context.Context, document *accounting.Document, name string, content []byte) error {
+	return app.recordDocument(ctx, &data.GeneratedDocument{
+		OrganisationID: document.OrganisationID,
+		DocumentType:   document.Type,
+		DocumentID:     document.ID,
+		Format:         data.DocumentFormatCommerceML,
+		Name:           name,
+		ContentType:    "application/xml",
+	}, content)
+}
+
+// paymentDocument loads the payment with the organisation, the company, the bank
+// account and the invoices it is allocated to.
+func (app *application) paymentDocument(id int64) (*accounting.Payment, error) {
+	payment, err := app.models.Payments.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	organisation, err := app.organisationOn(payment.OrganisationID, payment.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	company, err := app.models.Companies.Get(payment.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &accounting.Payment{
+		ID:          payment.ID,
+		Number:      payment.Number,
+		Date:        payment.Date,
+		Amount:      payment.Amount,
+		Unallocated: payment.Unallocated,
+		Description: payment.Description,
+		Payer:       documents.CompanyParty(company),
+		Payee:       documents.OrganisationParty(organisation),
+		Invoices:    []accounting.PaymentInvoice{},
+	}
+
+	if payment.BankAccountID != nil {
+		bankAccount, err := app.models.BankAccounts.Get(payment.OrganisationID, *payment.BankAccountID)
+		switch {
+		case err == nil:
+			doc.BankAccount = documents.NewBankRequisites(bankAccount)
+		case !errors.Is(err, data.ErrRecordNotFound):
+			return nil, err
+		}
+	}
+
+	allocations, err := app.models.Payments.GetAllocations(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, allocation := range allocations {
+		invoice, err := app.models.Invoices.Get(allocation.InvoiceID)
+		if err != nil {
+			return nil, err
+		}
+
+		doc.Invoices = append(doc.Invoices, accounting.PaymentInvoice{
+			ID:     invoice.ID,
+			Number: invoice.Number,
+			Date:   invoice.Date,
+			Amount: allocation.Amount,
+		})
+	}
+
+	return doc, nil
+}
+
+// AccountingConnectorInput is the body of the requests which create and change
+// connectors. The token is only changed when it's given, an empty one removes it.
+type AccountingConnectorInput struct {
+	Kind      *string `json:"kind"`
+	IsActive  *bool   `json:"is_active"`
+	URL       *string `json:"url"`
+	Token     *string `json:"token"`
+	StartDate *string `json:"start_date"`
+}
+
+// readAccountingConnector applies the input to the connector and validates it.
+func (app *application) readAccountingConnector(v *validator.Validator, connector *data.AccountingConnector, fields *AccountingConnectorInput) {
+	if fields.Kind != nil {
+		connector.Kind = *fields.Kind
+	}
+	if fields.IsActive != nil {
+		connector.IsActive = *fields.IsActive
+	}
+	if fields.URL != nil {
+		connector.URL = *fields.URL
+	}
+	if fields.Token != nil {
+		connector.Token = *fields.Token
+	}
+
+	if fields.StartDate != nil {
+		connector.StartDate = nil
+		if *fields.StartDate != "" {
+			date, _, err := parseDate(*fields.StartDate)
+			if err != nil {
+				v.AddError("start_date", "must be a date in the YYYY-MM-DD or RFC3339 format")
+			} else {
+				connector.StartDate = &date
+			}
+		}
+	}
+
+	data.ValidateAccountingConnector(v, connector)
+
+	v.Check(connector.Kind != data.ConnectorOneC || app.config.accounting.exportDir != "", "kind", "1c exchange files are not enabled on this server")
+}
+
+// readConnector reads the connector of the URL, sending the response itself if there
+// is none.
+func (app *application) readConnector(w http.ResponseWriter, r *http.Request) (*data.AccountingConnector, bool) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	connector, err := app.models.AccountingConnectors.Get(organisationID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return connector, true
+}
+
+// The auditConnector() method records a change of a connector, without the token.
+func (app *application) auditConnector(r *http.Request, action string, connector *data.AccountingConnector) {
+	user := app.contextGetUser(r)
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   action,
+		Entity:   "accounting_connector",
+		EntityID: connector.ID,
+		Details: map[string]interface{}{
+			"organisation_id": connector.OrganisationID,
+			"kind":            connector.Kind,
+			"is_active":       connector.IsActive,
+		},
+	}
+
+	err := app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// Declare a handler which returns the accounting connectors of the organisation with
+// the progress of their syncs.
+func (app *application) listAccountingConnectorsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	connectors, err := app.models.AccountingConnectors.GetAll(organisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": connectors}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which adds an accounting connector to the organisation.
+func (app *application) createAccountingConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if !app.requireFeature(w, r, data.FeatureAccounting, organisationID) {
+		return
+	}
+
+	var input struct {
+		AccountingConnector *AccountingConnectorInput `json:"accounting_connector"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.AccountingConnector == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain an accounting_connector object"))
+		return
+	}
+
+	connector := &data.AccountingConnector{
+		OrganisationID: organisationID,
+		IsActive:       true,
+	}
+
+	v := validator.New()
+
+	if app.readAccountingConnector(v, connector, input.AccountingConnector); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.AccountingConnectors.Insert(connector)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateConnector):
+			v.AddError("kind", "the organisation already has a connector of this kind")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.auditConnector(r, "create", connector)
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organisations/%d/accounting_connectors/%d", organisationID, connector.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": connector}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which returns an accounting connector.
+func (app *application) showAccountingConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	connector, ok := app.readConnector(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": connector}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which changes an accounting connector. The kind can't be changed.
+func (app *application) updateAccountingConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	connector, ok := app.readConnector(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		AccountingConnector *AccountingConnectorInput `json:"accounting_connector"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.AccountingConnector == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain an accounting_connector object"))
+		return
+	}
+
+	v := validator.New()
+
+	fields := input.AccountingConnector
+	v.Check(fields.Kind == nil || *fields.Kind == connector.Kind, "kind", "can't be changed")
+
+	if app.readAccountingConnector(v, connector, fields); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.AccountingConnectors.Update(connector)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.auditConnector(r, "update", connector)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": connector}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which removes an accounting connector with its sync log. The
+// documents already pushed stay in the accounting system.
+func (app *application) deleteAccountingConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	connector, ok := app.readConnector(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.AccountingConnectors.Delete(connector.OrganisationID, connector.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.auditConnector(r, "delete", connector)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "accounting_connector successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which returns the sync log of an accounting connector, the latest
+// syncs first. The status filter shows e.g. only the failed ones.
+func (app *application) listAccountingSyncsHandler(w http.ResponseWriter, r *http.Request) {
+	connector, ok := app.readConnector(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		data.Pagination
+		Status string
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+
+	input.Pagination.Page = app.readInt(qs, "page", 1, v)
+	input.Pagination.Limit, input.Pagination.MaxLimit = app.readPageLimit(qs, "accounting_syncs", v)
+
+	// The log is always ordered from the latest sync.
+	input.Pagination.Sort = "id"
+	input.Pagination.SortSafelist = []string{"id"}
+	input.Pagination.Direction = "desc"
+	input.Pagination.DirectionSafelist = []string{"desc"}
+
+	v.Check(input.Status == "" || validator.In(input.Status, data.SyncStatuses...), "status", "must be pending, synced or failed")
+
+	if data.ValidatePagination(v, input.Pagination); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	syncs, metadata, err := app.models.AccountingSyncs.GetAll(connector.ID, input.Status, input.Pagination)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": syncs, "meta": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which queues a sync again with all its attempts. The document is
+// pushed by the next run of the sync job, also if it was synced already.
+func (app *application) retryAccountingSyncHandler(w http.ResponseWriter, r *http.Request) {
+	connector, ok := app.readConnector(w, r)
+	if !ok {
+		return
+	}
+
+	syncID, err := app.readIDParam("syncID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	sync, err := app.models.AccountingSyncs.Retry(connector.ID, syncID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"data": sync}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The readActPeriod() helper reads the month of ?period= as YYYY-MM, the previous month
+// by default, and returns its first and last day.
+func (app *application) readActPeriod(r *http.Request, v *validator.Validator) (time.Time, time.Time) {
+	start := data.PeriodStart(time.Now()).AddDate(0, -1, 0)
+
+	if s := r.URL.Query().Get("period"); s != "" {
+		month, err := time.Parse("2006-01", s)
+		if err != nil {
+			v.AddError("period", "must be a month in the YYYY-MM format")
+		} else {
+			start = month
+		}
+	}
+
+	return start, start.AddDate(0, 1, -1)
+}
+
+// Declare a handler which closes a month of an agreement: the items of its invoices
+// dated in the month of ?period= become the grouped lines of one act dated the last day
+// of the month. Only the invoices of the organisation of the token, or of
+// ?organisation_id=, are taken. An agreement has one act per month.
+func (app *application) generateActHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("agreementID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Agreements.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	start, end := app.readActPeriod(r, v)
+	organisationID := app.readInt64(r.URL.Query(), "organisation_id", app.contextGetOrganisationID(r), v)
+
+	v.Check(organisationID != 0, "organisation_id", "must be provided")
+	v.Check(app.organisationAllowed(r, organisationID), "organisation_id", "must be the current organisation")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	act := &data.Act{
+		IsActive:       true,
+		Date:           end,
+		OrganisationID: organisationID,
+		AgreementID:    id,
+		PeriodStart:    &start,
+		PeriodEnd:      &end,
+		UserID:         &user.ID,
+	}
+
+	if !app.requireOpenPeriod(w, r, organisationID, end) {
+		return
+	}
+
+	err = app.models.Acts.GenerateForAgreement(act)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrActExists):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		case errors.Is(err, data.ErrNothingToAct):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": act}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -11,12 +11,16 @@ import (
 )
 
 type AgreementInput struct {
-	StartAt   *time.Time `json:"start_at"`
-	EndAt     *time.Time `json:"end_at"`
-	Name      string     `json:"name"`
-	CompanyID int64      `json:"company_id"`
-	UserID    *int64     `json:"user_id"`
-	UpdatedAt time.Time  `json:"updated_at"`
+	StartAt         *time.Time  `json:"start_at"`
+	EndAt           *time.Time  `json:"end_at"`
+	Name            string      `json:"name"`
+	Amount          *data.Money `json:"amount"`
+	WarningPercent  *int        `json:"warning_percent"`
+	BlockOverAmount *bool       `json:"block_over_amount"`
+	PenaltyRate     *float64    `json:"penalty_rate"`
+	CompanyID       int64       `json:"company_id"`
+	UserID          *int64      `json:"user_id"`
+	UpdatedAt       time.Time   `json:"updated_at"`
 }
 
 // Declare a handler which writes a plain-text response with information about the
@@ -37,11 +41,10 @@ func (app *application) listAgreementsHandler(w http.ResponseWriter, r *http.Req
 	qs := r.URL.Query()
 
 	input.AgreementFilters.CompanyID = app.readInt64(qs, "company_id", 0, v)
-	input.AgreementFilters.Start = app.readDate(qs, "start", nil, v)
-	input.AgreementFilters.End = app.readDate(qs, "end", nil, v)
+	input.AgreementFilters.Start, input.AgreementFilters.End = app.readDateRange(qs, nil, nil, v)
 	// Read the page and limit query string values into the embedded struct.
 	input.Pagination.Page = app.readInt(qs, "page", 1, v)
-	input.Pagination.Limit = app.readInt(qs, "limit", 20, v)
+	input.Pagination.Limit, input.Pagination.MaxLimit = app.readPageLimit(qs, "agreements", v)
 
 	// Read the sort query string value into the embedded struct.
 	input.Pagination.Sort = app.readString(qs, "sort", "id")
@@ -68,10 +71,7 @@ func (app *application) listAgreementsHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// Send a JSON response containing the agreement data.
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": agreements, "meta": metadata}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	app.streamJSON(w, r, http.StatusOK, envelope{"data": agreements, "meta": metadata}, app.paginationHeaders(r, metadata))
 }
 
 func (app *application) createAgreementHandler(w http.ResponseWriter, r *http.Request) {
@@ -94,11 +94,22 @@ func (app *application) createAgreementHandler(w http.ResponseWriter, r *http.Re
 	var fields = input.Agreement
 
 	agreement := &data.Agreement{
-		StartAt:   fields.StartAt,
-		EndAt:     fields.EndAt,
-		Name:      fields.Name,
-		CompanyID: fields.CompanyID,
-		UserID:    fields.UserID,
+		StartAt:        fields.StartAt,
+		EndAt:          fields.EndAt,
+		Name:           fields.Name,
+		Amount:         fields.Amount,
+		PenaltyRate:    fields.PenaltyRate,
+		WarningPercent: data.DefaultAgreementWarningPercent,
+		CompanyID:      fields.CompanyID,
+		UserID:         fields.UserID,
+	}
+
+	if fields.WarningPercent != nil {
+		agreement.WarningPercent = *fields.WarningPercent
+	}
+
+	if fields.BlockOverAmount != nil {
+		agreement.BlockOverAmount = *fields.BlockOverAmount
 	}
 
 	// Initialize a new Validator instance.
@@ -198,9 +209,19 @@ func (app *application) updateAgreementHandler(w http.ResponseWriter, r *http.Re
 	agreement.StartAt = fields.StartAt
 	agreement.EndAt = fields.EndAt
 	agreement.Name = fields.Name
+	agreement.Amount = fields.Amount
+	agreement.PenaltyRate = fields.PenaltyRate
 	agreement.CompanyID = fields.CompanyID
 	agreement.UserID = fields.UserID
 
+	if fields.WarningPercent != nil {
+		agreement.WarningPercent = *fields.WarningPercent
+	}
+
+	if fields.BlockOverAmount != nil {
+		agreement.BlockOverAmount = *fields.BlockOverAmount
+	}
+
 	// Validate the updated agreement record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
 	v := validator.New()
@@ -252,3 +273,29 @@ func (app *application) deleteAgreementHandler(w http.ResponseWriter, r *http.Re
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// agreementWarnings returns the warnings about the utilisation of the agreement to
+// add to the response of a changed invoice. A failure to read the agreement is only
+// logged, as the invoice has been saved already.
+func (app *application) agreementWarnings(r *http.Request, agreementID int64) []string {
+	warnings := []string{}
+	if agreementID == 0 {
+		return warnings
+	}
+
+	agreement, err := app.models.Agreements.Get(agreementID)
+	if err != nil {
+		app.logError(r, err)
+		return warnings
+	}
+
+	utilisation := agreement.Utilisation
+	switch {
+	case utilisation.Exceeded:
+		warnings = append(warnings, fmt.Sprintf("invoices exceed the agreement amount of %s by %s", agreement.Amount, -*utilisation.Remaining))
+	case utilisation.Warning:
+		warnings = append(warnings, fmt.Sprintf("invoices have reached %.2f%% of the agreement amount of %s, %s remaining", *utilisation.Percent, agreement.Amount, utilisation.Remaining))
+	}
+
+	return warnings
+}
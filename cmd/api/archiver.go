@@ -0,0 +1,19 @@
+package main
+
+import (
+	"time"
+)
+
+// The archiveInvoices() method moves settled invoices older than the configured number
+// of years to the archive. It is run by the scheduler, errors are logged and the job is
+// retried at the next interval.
+func (app *application) archiveInvoices() {
+	before := time.Now().AddDate(-app.config.archive.years, 0, 0)
+
+	archived, err := app.models.Invoices.Archive(before, 500)
+	if err != nil {
+		app.logger.Err(err).Msg("archiving invoices")
+	} else if archived > 0 {
+		app.logger.Info().Int64("invoices", archived).Time("before", before).Msg("invoices archived")
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/scanner"
+	"github.com/ElOtro/stockup-api/internal/storage"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// Attachments are PDFs and scans of at most 10MB.
+const attachmentMaxBytes = 10 << 20
+
+var attachmentTypes = []string{"application/pdf", "image/png", "image/jpeg"}
+
+// How many unused files the attachment_files job removes at once, and how often it runs.
+const (
+	attachmentCleanupBatch    = 500
+	attachmentCleanupInterval = time.Hour
+)
+
+// How many pending files the attachment_scans job scans at once, and how often it runs.
+// Files are scanned right after the upload, the job catches up on those whose scan
+// failed or was interrupted.
+const (
+	attachmentScanBatch    = 100
+	attachmentScanInterval = time.Minute
+)
+
+// Declare a handler which lists the attachments of an invoice.
+func (app *application) listAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	attachments, err := app.models.Attachments.GetAll(invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": attachments}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which attaches a file, sent base64 encoded, to an invoice. A file
+// with the same content as one attached before, to this or another invoice, isn't
+// stored again.
+func (app *application) createAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Attachment *struct {
+			Name    string `json:"name"`
+			Content []byte `json:"content"`
+		} `json:"attachment"`
+	}
+
+	err := app.readLargeJSON(w, r, &input, attachmentMaxBytes*4/3+1_048_576)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Attachment == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain an attachment object"))
+		return
+	}
+
+	content := input.Attachment.Content
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+
+	attachment := &data.Attachment{
+		OrganisationID: invoice.OrganisationID,
+		InvoiceID:      invoice.ID,
+		Name:           input.Attachment.Name,
+		Size:           int64(len(content)),
+		ContentType:    contentType,
+		UserID:         &user.ID,
+	}
+
+	v := validator.New()
+
+	v.Check(app.storage != nil, "content", "uploads are not enabled on this server")
+	v.Check(len(content) > 0, "content", "must be provided")
+	v.Check(len(content) <= attachmentMaxBytes, "content", "must not be larger than 10MB")
+	v.Check(len(content) == 0 || validator.In(contentType, attachmentTypes...), "content", "must be a PDF, PNG or JPEG file")
+
+	if data.ValidateAttachment(v, attachment); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	sum := sha256.Sum256(content)
+	attachment.SHA256 = hex.EncodeToString(sum[:])
+
+	scanStatus := data.ScanUnscanned
+	if app.scanner != nil {
+		scanStatus = data.ScanPending
+	}
+
+	// The content is only stored if no attachment refers to the file yet; it may be
+	// missing if storing it failed before. Infected content stays in the quarantine.
+	file, created, err := app.models.Attachments.ClaimFile(attachment.SHA256, attachment.Size, contentType, scanStatus)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if (created || file.RefCount == 0) && file.ScanStatus != data.ScanInfected {
+		err = app.storage.Put(r.Context(), file.Key(), bytes.NewReader(content))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	attachment.FileID = file.ID
+	attachment.ContentType = file.ContentType
+	attachment.ScanStatus = file.ScanStatus
+
+	err = app.models.Attachments.Insert(attachment)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if file.ScanStatus == data.ScanPending {
+		go app.scanAttachmentFile(file)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/invoices/%d/attachments/%d", invoice.ID, attachment.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": attachment}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which returns an attachment of an invoice.
+func (app *application) showAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := app.readAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": attachment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which downloads the file of an attachment.
+func (app *application) downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := app.readAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	if app.storage == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Files are only handed out once the scanner has found them clean, or if they were
+	// uploaded without a scanner.
+	switch attachment.ScanStatus {
+	case data.ScanPending:
+		app.errorResponse(w, r, http.StatusConflict, "the file is being scanned for viruses, try again shortly")
+		return
+	case data.ScanInfected:
+		app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("the file is infected (%s) and has been quarantined", *attachment.ScanSignature))
+		return
+	case data.ScanFailed:
+		app.errorResponse(w, r, http.StatusConflict, "the file could not be scanned for viruses, scan it again")
+		return
+	}
+
+	file, err := app.storage.Open(r.Context(), data.AttachmentFileKey(attachment.SHA256))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// Declare a handler which removes an attachment of an invoice. The file is removed
+// from the storage by the attachment_files job once no attachment refers to it.
+func (app *application) deleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Attachments.Delete(invoice.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "attachment successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which scans the file of an attachment again, e.g. after its scan
+// failed. The scan runs in the background, the answer shows the attachment as pending.
+func (app *application) rescanAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := app.readAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(app.scanner != nil, "attachment", "virus scanning is not enabled on this server")
+	v.Check(attachment.ScanStatus != data.ScanInfected, "attachment", "is infected and stays in the quarantine")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Attachments.RescanFile(attachment)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	go app.scanAttachmentFile(&data.AttachmentFile{
+		ID:          attachment.FileID,
+		SHA256:      attachment.SHA256,
+		Size:        attachment.Size,
+		ContentType: attachment.ContentType,
+		ScanStatus:  attachment.ScanStatus,
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"data": attachment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readInvoice() helper returns the invoice of the URL, whose organisation its
+// attachments and links belong to. requireInvoiceAccess has checked the access to it.
+func (app *application) readInvoice(w http.ResponseWriter, r *http.Request) (*data.Invoice, bool) {
+	invoiceID, err := app.readIDParam("invoiceID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	invoice, err := app.models.Invoices.Get(invoiceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return invoice, true
+}
+
+// The readAttachment() helper returns the attachment of the URL.
+func (app *application) readAttachment(w http.ResponseWriter, r *http.Request) (*data.Attachment, bool) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	attachment, err := app.models.Attachments.Get(invoice.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return attachment, true
+}
+
+// The removeUnusedAttachmentFiles() job removes the files which no attachment refers
+// to from the storage.
+func (app *application) removeUnusedAttachmentFiles() {
+	for {
+		removed, err := app.models.Attachments.RemoveUnusedFiles(attachmentCleanupBatch, func(file *data.AttachmentFile) error {
+			err := app.storage.Delete(context.Background(), file.Key())
+			if err == nil {
+				err = app.storage.Delete(context.Background(), file.QuarantineKey())
+			}
+			if err != nil {
+				app.logger.Err(err).Str("sha256", file.SHA256).Msg("removing an attachment file")
+			}
+			return err
+		})
+		if err != nil {
+			app.logger.Err(err).Msg("removing unused attachment files")
+			return
+		}
+
+		if removed > 0 {
+			app.logger.Info().Int("files", removed).Msg("unused attachment files removed")
+		}
+
+		if removed < attachmentCleanupBatch {
+			return
+		}
+	}
+}
+
+// The scanAttachmentFiles() job scans the pending attachment files.
+func (app *application) scanAttachmentFiles() {
+	files, err := app.models.Attachments.PendingFiles(attachmentScanBatch)
+	if err != nil {
+		app.logger.Err(err).Msg("reading the pending attachment files")
+		return
+	}
+
+	for _, file := range files {
+		app.scanAttachmentFile(file)
+	}
+}
+
+// The scanAttachmentFile() method scans a pending file and records the verdict. The
+// content of an infected file is moved to the quarantine, so it can't be handed out
+// even by mistake. A failed scan is tried again by the attachment_scans job.
+func (app *application) scanAttachmentFile(file *data.AttachmentFile) {
+	log := app.logger.With().Int64("file_id", file.ID).Str("sha256", file.SHA256).Logger()
+
+	result, err := app.scanStoredFile(file.Key())
+	if err != nil {
+		log.Err(err).Msg("scanning an attachment file")
+
+		err = app.models.Attachments.FailScan(file)
+		if err != nil {
+			log.Err(err).Msg("recording the failed scan")
+		}
+		return
+	}
+
+	if !result.Infected {
+		_, err = app.models.Attachments.FinishScan(file, data.ScanClean, nil)
+		if err != nil {
+			log.Err(err).Msg("recording the scan")
+		}
+		return
+	}
+
+	updated, err := app.models.Attachments.FinishScan(file, data.ScanInfected, &result.Signature)
+	if err != nil {
+		log.Err(err).Msg("recording the scan")
+		return
+	}
+
+	if !updated {
+		return
+	}
+
+	log.Warn().Str("signature", result.Signature).Msg("infected attachment file quarantined")
+
+	err = app.moveStoredFile(file.Key(), file.QuarantineKey())
+	if err != nil {
+		log.Err(err).Msg("moving an infected attachment file to the quarantine")
+	}
+}
+
+// scanStoredFile scans the file of the key with the scanner.
+func (app *application) scanStoredFile(key string) (scanner.Result, error) {
+	ctx := context.Background()
+
+	content, err := app.storage.Open(ctx, key)
+	if err != nil {
+		return scanner.Result{}, err
+	}
+	defer content.Close()
+
+	return app.scanner.Scan(ctx, content)
+}
+
+// moveStoredFile moves a file of the storage to another key.
+func (app *application) moveStoredFile(from, to string) error {
+	ctx := context.Background()
+
+	content, err := app.storage.Open(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	err = app.storage.Put(ctx, to, content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	return app.storage.Delete(ctx, from)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// How long a backup may run before it's killed, and how many backups are listed.
+const (
+	backupTimeout   = time.Hour
+	backupListLimit = 50
+)
+
+var errBackupRunning = errors.New("a backup is already running")
+
+// beginBackup takes the backup lock, so only one backup runs at a time across all the
+// instances, and records a new running backup. The lock is released by runBackup().
+func (app *application) beginBackup(userID *int64) (*data.Backup, *data.Lock, error) {
+	lock, err := app.models.Locks.TryLock(context.Background(), "backup")
+	if err != nil {
+		return nil, nil, err
+	}
+	if lock == nil {
+		return nil, nil, errBackupRunning
+	}
+
+	// Holding the lock no backup can be running, those recorded as running were
+	// interrupted.
+	err = app.models.Backups.Interrupt()
+	if err == nil {
+		backup := &data.Backup{
+			File:   fmt.Sprintf("stockup-%s.dump", time.Now().UTC().Format("20060102T150405Z")),
+			UserID: userID,
+		}
+
+		err = app.models.Backups.Insert(backup)
+		if err == nil {
+			return backup, lock, nil
+		}
+	}
+
+	if unlockErr := lock.Unlock(); unlockErr != nil {
+		app.logger.Err(unlockErr).Msg("releasing the backup lock")
+	}
+
+	return nil, nil, err
+}
+
+// runBackup dumps the database, records the result and removes the backups expired by
+// the retention policy. It releases the lock taken by beginBackup().
+func (app *application) runBackup(backup *data.Backup, lock *data.Lock) {
+	defer func() {
+		err := lock.Unlock()
+		if err != nil {
+			app.logger.Err(err).Msg("releasing the backup lock")
+		}
+	}()
+
+	path := filepath.Join(app.config.backups.dir, backup.File)
+	start := time.Now()
+
+	backup.Status = data.BackupSucceeded
+	err := app.dumpDatabase(path)
+	if err != nil {
+		message := err.Error()
+		backup.Status = data.BackupFailed
+		backup.Error = &message
+		app.logger.Err(err).Int64("backup_id", backup.ID).Msg("backing up the database")
+	}
+
+	// A backup hook may store the dump elsewhere and leave no file behind.
+	if info, statErr := os.Stat(path); statErr == nil {
+		size := info.Size()
+		backup.Size = &size
+	}
+
+	err = app.models.Backups.Finish(backup)
+	if err != nil {
+		app.logger.Err(err).Int64("backup_id", backup.ID).Msg("recording the backup")
+		return
+	}
+
+	if backup.Status != data.BackupSucceeded {
+		return
+	}
+
+	app.logger.Info().Int64("backup_id", backup.ID).Str("file", backup.File).Dur("duration", time.Since(start)).Msg("database backed up")
+
+	app.removeExpiredBackups()
+}
+
+// dumpDatabase writes a dump of the database to the path with pg_dump, in its custom
+// format which pg_restore reads, or runs the backup command with the path as its last
+// argument instead. The command also gets the path as BACKUP_FILE.
+func (app *application) dumpDatabase(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	env := append(os.Environ(), "BACKUP_FILE="+path)
+
+	if args := strings.Fields(app.config.backups.command); len(args) > 0 {
+		cmd = exec.CommandContext(ctx, args[0], append(args[1:], path)...)
+	} else {
+		// The arguments can be read by anyone on the host, so the password is passed in
+		// the environment.
+		dsn, password, err := withoutPassword(app.config.db.dsn)
+		if err != nil {
+			return err
+		}
+
+		cmd = exec.CommandContext(ctx, "pg_dump", "--format=custom", "--no-owner", "--file="+path, "--dbname="+dsn)
+		if password != "" {
+			env = append(env, "PGPASSWORD="+password)
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd.Env = env
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%w: %s", err, message)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// dsnPasswordRX matches the password of a DSN in the keyword/value format, quoted or not.
+var dsnPasswordRX = regexp.MustCompile(`(^|\s)password\s*=\s*('(\\.|[^'\\])*'|\S+)`)
+
+// withoutPassword returns the DSN, a URL or keyword/value pairs, without its password
+// and the password it had, if any.
+func withoutPassword(dsn string) (string, string, error) {
+	config, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing the database DSN: %w", err)
+	}
+
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return strings.TrimSpace(dsnPasswordRX.ReplaceAllString(dsn, "$1")), config.Password, nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing the database DSN: %w", err)
+	}
+
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+
+	query := u.Query()
+	if query.Has("password") {
+		query.Del("password")
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String(), config.Password, nil
+}
+
+// removeExpiredBackups deletes the files of the backups which the retention policy
+// doesn't keep any more.
+func (app *application) removeExpiredBackups() {
+	var before *time.Time
+	if app.config.backups.maxAge > 0 {
+		t := time.Now().Add(-app.config.backups.maxAge)
+		before = &t
+	}
+
+	backups, err := app.models.Backups.Expired(app.config.backups.keep, before)
+	if err != nil {
+		app.logger.Err(err).Msg("reading the expired backups")
+		return
+	}
+
+	for _, backup := range backups {
+		err := os.Remove(filepath.Join(app.config.backups.dir, backup.File))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			app.logger.Err(err).Int64("backup_id", backup.ID).Msg("removing the backup")
+			continue
+		}
+
+		err = app.models.Backups.SetRemoved(backup.ID)
+		if err != nil {
+			app.logger.Err(err).Int64("backup_id", backup.ID).Msg("recording the removal of the backup")
+		}
+	}
+}
+
+// The backupDatabase() method is the scheduled backup job.
+func (app *application) backupDatabase() {
+	backup, lock, err := app.beginBackup(nil)
+	if err != nil {
+		if errors.Is(err, errBackupRunning) {
+			app.logger.Info().Msg("skipping the scheduled backup, a backup is already running")
+			return
+		}
+		app.logger.Err(err).Msg("starting the scheduled backup")
+		return
+	}
+
+	app.runBackup(backup, lock)
+}
+
+// The createBackupHandler() starts a backup of the database in the background and
+// responds right away with the running backup, its progress can be followed at the
+// Location.
+func (app *application) createBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.config.backupsEnabled() {
+		app.errorResponse(w, r, http.StatusServiceUnavailable, "backups are not enabled on this server")
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	backup, lock, err := app.beginBackup(&user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, errBackupRunning):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The response shows the backup as it was started, runBackup() goes on changing it.
+	started := *backup
+	go app.runBackup(backup, lock)
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "create",
+		Entity:   "backup",
+		EntityID: started.ID,
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/backups/%d", started.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"data": started}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listBackupsHandler() returns the latest backups with their sizes.
+func (app *application) listBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	backups, err := app.models.Backups.GetAll(backupListLimit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": backups}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showBackupHandler() returns a backup.
+func (app *application) showBackupHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	backup, err := app.models.Backups.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": backup}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
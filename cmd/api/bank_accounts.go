@@ -193,7 +193,12 @@ func (app *application) updateBankAccountHandler(w http.ResponseWriter, r *http.
 	// Pass the updated movie record to our new Update() method.
 	err = app.models.BankAccounts.Update(bankAccount)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -206,6 +211,12 @@ func (app *application) updateBankAccountHandler(w http.ResponseWriter, r *http.
 }
 
 func (app *application) deleteBankAccountHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
 	// Extract the movie ID from the URL.
 	id, err := app.readIDParam("ID", r)
 	if err != nil {
@@ -215,7 +226,7 @@ func (app *application) deleteBankAccountHandler(w http.ResponseWriter, r *http.
 
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.BankAccounts.Delete(id)
+	err = app.models.BankAccounts.Delete(organisationID, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -232,3 +243,82 @@ func (app *application) deleteBankAccountHandler(w http.ResponseWriter, r *http.
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The bankAccountActivityHandler() sums up per period the invoices to be paid to a bank
+// account and the payments received on it, e.g. ?period=quarter&start=2024-01-01, to
+// reconcile the accounts of an organisation with the statements of the bank. Every
+// period links to the lists of its invoices and payments.
+func (app *application) bankAccountActivityHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	params := data.BankAccountActivityParams{
+		OrganisationID: organisationID,
+		BankAccountID:  id,
+		Period:         app.readString(qs, "period", data.PeriodMonth),
+	}
+	params.Start, params.End = app.readDateRange(qs, nil, nil, v)
+
+	if data.ValidateBankAccountActivityParams(v, params); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	bankAccount, err := app.models.BankAccounts.Get(organisationID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	organisation, err := app.models.Organisations.Get(organisationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	params.FiscalYearStart = organisation.FiscalYearStart
+
+	activity, err := app.models.BankAccounts.Activity(r.Context(), params)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, period := range activity {
+		query := fmt.Sprintf("organisation_id=%d&bank_account_id=%d&start=%s&end=%s", organisationID, id,
+			period.Start.Format(dateOnlyLayout), period.End.Format(dateOnlyLayout))
+
+		period.Links = &data.BankAccountStatement{
+			Invoices: "/v1/invoices?" + query,
+			Payments: "/v1/payments?" + query,
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"bank_account": bankAccount, "data": activity}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
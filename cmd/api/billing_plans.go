@@ -0,0 +1,605 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The months as printed on the invoice lines of billing plans.
+var monthNames = [...]string{
+	"январь", "февраль", "март", "апрель", "май", "июнь",
+	"июль", "август", "сентябрь", "октябрь", "ноябрь", "декабрь",
+}
+
+func monthName(t time.Time) string {
+	return fmt.Sprintf("%s %d", monthNames[t.Month()-1], t.Year())
+}
+
+// The invoiceBillingPlans() method is the billing plan job. It invoices every plan
+// which is due an invoice for the current month, with the overage of the previous
+// month, see invoiceBillingPlan().
+func (app *application) invoiceBillingPlans() {
+	today := time.Now()
+
+	plans, err := app.models.BillingPlans.Due(today)
+	if err != nil {
+		app.logger.Err(err).Msg("reading the billing plans due an invoice")
+		return
+	}
+
+	invoiced := 0
+	for _, plan := range plans {
+		log := app.logger.With().Int64("billing_plan_id", plan.ID).Int64("company_id", plan.CompanyID).Logger()
+
+		enabled, err := app.models.FeatureFlags.Enabled(data.FeatureBillingPlans, plan.OrganisationID)
+		if err != nil {
+			log.Err(err).Msg("reading the billing plans feature flag")
+			continue
+		}
+		if !enabled {
+			continue
+		}
+
+		invoice, err := app.invoiceBillingPlan(plan, today)
+		switch {
+		case err == nil:
+			invoiced++
+			log.Info().Int64("invoice_id", invoice.ID).Msg("billing plan invoiced")
+		case errors.Is(err, data.ErrPeriodInvoiced):
+		default:
+			log.Err(err).Msg("invoicing the billing plan")
+		}
+	}
+
+	if invoiced > 0 {
+		app.logger.Info().Int("invoices", invoiced).Msg("billing plans invoiced")
+	}
+}
+
+// invoiceBillingPlan creates the invoice of the plan for the month of the day: the
+// amount of the plan for the month and, if the plan charges overage, the quantity used
+// above the included one in the month before. The invoice gets the bank account, the
+// agreement, the payment term and the signer from the company like a new invoice does.
+func (app *application) invoiceBillingPlan(plan *data.BillingPlan, day time.Time) (*data.Invoice, error) {
+	period := data.PeriodStart(day)
+
+	closed, err := app.models.ClosedPeriods.Covering(plan.OrganisationID, day)
+	switch {
+	case err == nil:
+		return nil, fmt.Errorf("the period from %s to %s is closed", closed.StartDate.Format(dateOnlyLayout), closed.EndDate.Format(dateOnlyLayout))
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	company, err := app.models.Companies.Get(plan.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice := &data.Invoice{
+		IsActive:       true,
+		Date:           day,
+		OrganisationID: plan.OrganisationID,
+		CompanyID:      plan.CompanyID,
+		VatMode:        data.VatOnTop,
+	}
+
+	vatRateID := plan.VatRateID
+	if defaults := company.Defaults; defaults != nil {
+		invoice.BankAccountID = defaults.BankAccountID
+		invoice.AgreementID = defaults.AgreementID
+
+		if defaults.PaymentTermDays > 0 {
+			dueDate := day.AddDate(0, 0, defaults.PaymentTermDays)
+			invoice.DueDate = &dueDate
+		}
+
+		if vatRateID == 0 {
+			vatRateID = defaults.VatRateID
+		}
+	}
+
+	// A rate which has been replaced since is invoiced with the rate of its chain which
+	// is valid today.
+	if vatRateID != 0 {
+		vatRate, err := app.models.VatRates.ResolveOn(vatRateID, day)
+		if err != nil {
+			return nil, fmt.Errorf("the VAT rate of the plan: %w", err)
+		}
+		vatRateID = vatRate.ID
+	}
+
+	v := validator.New()
+
+	err = app.resolveSigner(v, invoice, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*data.InvoiceItem{{
+		Position:     1,
+		ProductID:    plan.ProductID,
+		Description:  fmt.Sprintf("%s за %s", plan.Name, monthName(period)),
+		UnitID:       plan.UnitID,
+		Quantity:     1,
+		Price:        plan.Amount,
+		DiscountType: data.DiscountPercent,
+		VatRateID:    vatRateID,
+	}}
+
+	previous := period.AddDate(0, -1, 0)
+	if plan.OveragePrice > 0 && !previous.Before(data.PeriodStart(plan.StartsOn)) {
+		usage, err := app.models.BillingPlans.GetUsage(plan.ID, previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var used float64
+		for _, u := range usage {
+			used += u.Quantity
+		}
+
+		if overage := plan.Period(previous, used).Overage; overage > 0 {
+			items = append(items, &data.InvoiceItem{
+				Position:     2,
+				ProductID:    plan.ProductID,
+				Description:  fmt.Sprintf("%s: сверх включенного объема за %s", plan.Name, monthName(previous)),
+				UnitID:       plan.UnitID,
+				Quantity:     overage,
+				Price:        plan.OveragePrice,
+				DiscountType: data.DiscountPercent,
+				VatRateID:    vatRateID,
+			})
+		}
+	}
+
+	if data.ValidateInvoice(v, invoice); !v.Valid() {
+		return nil, fmt.Errorf("the invoice is not valid: %v", v.Errors)
+	}
+
+	err = app.models.BillingPlans.Invoice(plan.ID, period, invoice, items)
+	if err != nil {
+		return nil, err
+	}
+
+	return invoice, nil
+}
+
+// BillingPlanInput is the body of the requests which create and change billing plans.
+type BillingPlanInput struct {
+	OrganisationID   *int64      `json:"organisation_id"`
+	CompanyID        *int64      `json:"company_id"`
+	Name             *string     `json:"name"`
+	ProductID        *int64      `json:"product_id"`
+	UnitID           *int64      `json:"unit_id"`
+	VatRateID        *int64      `json:"vat_rate_id"`
+	Amount           *data.Money `json:"amount"`
+	IncludedQuantity *float64    `json:"included_quantity"`
+	OveragePrice     *data.Money `json:"overage_price"`
+	InvoiceDay       *int        `json:"invoice_day"`
+	StartsOn         *time.Time  `json:"starts_on"`
+	EndsOn           *time.Time  `json:"ends_on"`
+	IsActive         *bool       `json:"is_active"`
+}
+
+func (input *BillingPlanInput) apply(plan *data.BillingPlan) {
+	if input.CompanyID != nil {
+		plan.CompanyID = *input.CompanyID
+	}
+	if input.Name != nil {
+		plan.Name = *input.Name
+	}
+	if input.ProductID != nil {
+		plan.ProductID = *input.ProductID
+	}
+	if input.UnitID != nil {
+		plan.UnitID = *input.UnitID
+	}
+	if input.VatRateID != nil {
+		plan.VatRateID = *input.VatRateID
+	}
+	if input.Amount != nil {
+		plan.Amount = *input.Amount
+	}
+	if input.IncludedQuantity != nil {
+		plan.IncludedQuantity = *input.IncludedQuantity
+	}
+	if input.OveragePrice != nil {
+		plan.OveragePrice = *input.OveragePrice
+	}
+	if input.InvoiceDay != nil {
+		plan.InvoiceDay = *input.InvoiceDay
+	}
+	if input.StartsOn != nil {
+		plan.StartsOn = *input.StartsOn
+	}
+	if input.EndsOn != nil {
+		plan.EndsOn = input.EndsOn
+	}
+	if input.IsActive != nil {
+		plan.IsActive = *input.IsActive
+	}
+}
+
+// The validateBillingPlanReferences() method checks that the company and the product
+// of the plan exist.
+func (app *application) validateBillingPlanReferences(v *validator.Validator, plan *data.BillingPlan) error {
+	if plan.CompanyID != 0 {
+		_, err := app.models.Companies.Get(plan.CompanyID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("company_id", "company not found")
+		case err != nil:
+			return err
+		}
+	}
+
+	if plan.ProductID != 0 {
+		_, err := app.models.Products.Get(plan.ProductID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("product_id", "product not found")
+		case err != nil:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Declare a handler which returns the billing plans of the current organisation, of
+// one company with ?company_id=.
+func (app *application) listBillingPlansHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := data.BillingPlanFilters{
+		OrganisationID: app.contextGetOrganisationID(r),
+		CompanyID:      app.readInt64(qs, "company_id", 0, v),
+	}
+
+	if !app.requireFeature(w, r, data.FeatureBillingPlans, filters.OrganisationID) {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	plans, err := app.models.BillingPlans.GetAll(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": plans}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which adds a billing plan to a company. The plan starts invoicing
+// on its invoice day of the month of starts_on.
+func (app *application) createBillingPlanHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		BillingPlan *BillingPlanInput `json:"billing_plan"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.BillingPlan == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a billing_plan object"))
+		return
+	}
+
+	plan := &data.BillingPlan{
+		OrganisationID: app.contextGetOrganisationID(r),
+		InvoiceDay:     1,
+		StartsOn:       data.PeriodStart(time.Now()),
+		IsActive:       true,
+	}
+	if input.BillingPlan.OrganisationID != nil {
+		plan.OrganisationID = *input.BillingPlan.OrganisationID
+	}
+	input.BillingPlan.apply(plan)
+
+	v := validator.New()
+
+	v.Check(app.organisationAllowed(r, plan.OrganisationID), "organisation_id", "must be the current organisation")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.requireFeature(w, r, data.FeatureBillingPlans, plan.OrganisationID) {
+		return
+	}
+
+	err = app.validateBillingPlanReferences(v, plan)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateBillingPlan(v, plan); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.BillingPlans.Insert(plan)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/billing_plans/%d", plan.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": plan}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readBillingPlan() helper reads the plan of the URL, sending a 404 Not Found
+// response if it doesn't exist or belongs to another organisation, and a 403 Forbidden
+// one if billing plans are turned off for its organisation.
+func (app *application) readBillingPlan(w http.ResponseWriter, r *http.Request) (*data.BillingPlan, bool) {
+	id, err := app.readIDParam("planID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	plan, err := app.models.BillingPlans.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !app.organisationAllowed(r, plan.OrganisationID) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	if !app.requireFeature(w, r, data.FeatureBillingPlans, plan.OrganisationID) {
+		return nil, false
+	}
+
+	return plan, true
+}
+
+// Declare a handler which returns a billing plan with its current month.
+func (app *application) showBillingPlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.readBillingPlan(w, r)
+	if !ok {
+		return
+	}
+
+	periods, err := app.models.BillingPlans.Periods(plan, time.Now())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"data": plan}
+	if len(periods) > 0 {
+		env["current_period"] = periods[0]
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which changes a billing plan. The months invoiced already keep
+// their invoices, the changes apply from the next invoice on.
+func (app *application) updateBillingPlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.readBillingPlan(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		BillingPlan *BillingPlanInput `json:"billing_plan"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.BillingPlan == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a billing_plan object"))
+		return
+	}
+
+	v := validator.New()
+
+	// A plan stays with its company and organisation, a new plan is created instead.
+	v.Check(input.BillingPlan.OrganisationID == nil || *input.BillingPlan.OrganisationID == plan.OrganisationID, "organisation_id", "can't be changed")
+	v.Check(input.BillingPlan.CompanyID == nil || *input.BillingPlan.CompanyID == plan.CompanyID, "company_id", "can't be changed")
+
+	input.BillingPlan.apply(plan)
+
+	err = app.validateBillingPlanReferences(v, plan)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateBillingPlan(v, plan); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.BillingPlans.Update(plan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": plan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which removes a billing plan and its usage. Its invoices are kept.
+func (app *application) deleteBillingPlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.readBillingPlan(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.BillingPlans.Delete(plan.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "billing_plan successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which returns the months of a billing plan, the latest first, with
+// the quantity used in each against the included one and their invoices.
+func (app *application) listBillingPeriodsHandler(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.readBillingPlan(w, r)
+	if !ok {
+		return
+	}
+
+	periods, err := app.models.BillingPlans.Periods(plan, time.Now())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": periods}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which returns the usage recorded under a billing plan in the month
+// of ?date=, the current one by default, with the summary of the month.
+func (app *application) listBillingPlanUsageHandler(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.readBillingPlan(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+
+	now := time.Now()
+	date := app.readDate(r.URL.Query(), "date", &now, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	start := data.PeriodStart(*date)
+
+	usage, err := app.models.BillingPlans.GetUsage(plan.ID, start)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var used float64
+	for _, u := range usage {
+		used += u.Quantity
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": usage, "period": plan.Period(start, used)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which records hours or items used under a billing plan. They count
+// in the month of their date, by default today.
+func (app *application) createBillingPlanUsageHandler(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.readBillingPlan(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Date        *time.Time `json:"date"`
+		Quantity    float64    `json:"quantity"`
+		Description string     `json:"description"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	usage := &data.BillingPlanUsage{
+		BillingPlanID: plan.ID,
+		Date:          time.Now(),
+		Quantity:      input.Quantity,
+		Description:   input.Description,
+		UserID:        &user.ID,
+	}
+	if input.Date != nil {
+		usage.Date = *input.Date
+	}
+
+	v := validator.New()
+
+	v.Check(!data.PeriodStart(usage.Date).Before(data.PeriodStart(plan.StartsOn)), "date", "must not be before the plan starts")
+	if plan.EndsOn != nil {
+		v.Check(!usage.Date.After(*plan.EndsOn), "date", "must not be after the plan ends")
+	}
+
+	if data.ValidateBillingPlanUsage(v, usage); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.BillingPlans.InsertUsage(usage)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": usage}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+)
+
+// cacheVersions counts the changes of cached reference resources. The version is a part
+// of the ETag, so any mutation invalidates the copies held by clients without reading
+// the database. The counters live in memory; changes made through other instances
+// reach them by the change listener, see runChangeListener(). The boot time makes the
+// ETags of every instance differ, and a restart invalidates everything as well.
+type cacheVersions struct {
+	mu       sync.Mutex
+	boot     int64
+	versions map[string]int64
+}
+
+func newCacheVersions() *cacheVersions {
+	return &cacheVersions{
+		boot:     time.Now().UnixNano(),
+		versions: make(map[string]int64),
+	}
+}
+
+func (c *cacheVersions) version(resource string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.versions[resource]
+}
+
+func (c *cacheVersions) bump(resource string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.versions[resource]++
+}
+
+// The cacheable() middleware adds ETag and Cache-Control headers to the GET responses
+// of a reference resource and answers with 304 Not Modified when the client already
+// has the current version. Any other request to the resource is a mutation, so the
+// version is bumped once it has been handled. It must be used after authenticate(),
+// and only on the routes of the resource itself: the version says nothing about the
+// records nested under it.
+func (app *application) cacheable(resource string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				app.cache.bump(resource)
+				return
+			}
+
+			// Responses depend on the user, whose memberships select the organisations
+			// listed, and on the organisation the token is bound to.
+			etag := fmt.Sprintf(`W/"%s-%x-%d-%d-%d"`, resource, app.cache.boot, app.cache.version(resource),
+				app.contextGetUser(r).ID, app.contextGetOrganisationID(r))
+
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "private, no-cache")
+
+			for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+				if strings.TrimSpace(candidate) == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// userCache keeps the users looked up by authenticate() for a short time, so a burst of
+// requests with the same token reads the user once. Every change of a user drops it
+// from the caches of all instances through the change listener; if the listener misses
+// changes, the whole cache is dropped. A ttl of 0 disables the cache.
+type userCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int64]userCacheEntry
+}
+
+type userCacheEntry struct {
+	user    data.User
+	expires time.Time
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{ttl: ttl, entries: make(map[int64]userCacheEntry)}
+}
+
+// get returns a copy of the cached user, which the request may change.
+func (c *userCache) get(id int64) (*data.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(c.entries, id)
+		return nil, false
+	}
+
+	user := entry.user
+	return &user, true
+}
+
+func (c *userCache) set(user *data.User) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Expired entries are removed now and then, users who stopped calling the API
+	// aren't kept.
+	if len(c.entries) >= 1000 {
+		now := time.Now()
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+	}
+
+	entry := userCacheEntry{user: *user, expires: time.Now().Add(c.ttl)}
+	entry.user.Preferences = nil
+	c.entries[user.ID] = entry
+}
+
+func (c *userCache) drop(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+}
+
+func (c *userCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int64]userCacheEntry)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+)
+
+// cachedTables maps the tables to the cached resources read from them, see cacheable().
+var cachedTables = map[string]string{
+	"organisations": "organisations",
+	"units":         "units",
+	"vat_rates":     "vat_rates",
+}
+
+// The time the listener waits before it connects again after losing the connection.
+const changesRetryInterval = 5 * time.Second
+
+// The runChangeListener() method listens to the changes of the core tables made by all
+// API instances and by anyone else writing to the database. The versions of the cached
+// resources are bumped and the changes are passed on to the event streams. It runs
+// until the process exits, a lost connection is logged and opened again.
+func (app *application) runChangeListener() {
+	for {
+		err := app.models.Changes.Listen(context.Background(), app.changesMissed, app.handleChange)
+		app.logger.Err(err).Msg("listening to changes")
+
+		time.Sleep(changesRetryInterval)
+	}
+}
+
+// changesMissed invalidates everything which may have changed while the listener
+// wasn't connected: every cached resource and every open event stream.
+func (app *application) changesMissed() {
+	for _, resource := range cachedTables {
+		app.cache.bump(resource)
+	}
+
+	app.users.clear()
+	app.changes.closeAll()
+}
+
+func (app *application) handleChange(change data.Change) {
+	// Users only leave the cache of authenticated users, they aren't documents the
+	// event streams show.
+	if change.Table == "users" {
+		app.users.drop(change.ID)
+		return
+	}
+
+	if resource, ok := cachedTables[change.Table]; ok {
+		app.cache.bump(resource)
+	}
+
+	app.changes.publish(change)
+}
+
+// changeBroker passes the changes on to the open event streams. Each stream has a
+// buffer; a stream which can't keep up is closed rather than slowing the others down,
+// its client reconnects and reloads.
+type changeBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan data.Change]struct{}
+}
+
+func newChangeBroker() *changeBroker {
+	return &changeBroker{subscribers: make(map[chan data.Change]struct{})}
+}
+
+func (b *changeBroker) subscribe() chan data.Change {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan data.Change, 64)
+	b.subscribers[ch] = struct{}{}
+
+	return ch
+}
+
+func (b *changeBroker) unsubscribe(ch chan data.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (b *changeBroker) publish(change data.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- change:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *changeBroker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Event streams are closed before the write timeout of the server ends them. Browsers
+// reconnect after the retry interval sent at the start of the stream.
+const (
+	eventStreamDuration = 25 * time.Second
+	eventStreamRetry    = 2 * time.Second
+)
+
+// The eventsHandler() streams the changes of the core tables as server-sent events
+// named "change", with the change as JSON data. Changes of documents are only sent
+// when their organisation may be accessed with the token, changes of the shared
+// reference data are sent to everyone. Changes made while the client wasn't connected
+// are not sent, so the client should reload what it shows whenever it reconnects.
+func (app *application) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("the response can't be streamed"))
+		return
+	}
+
+	changes := app.changes.subscribe()
+	defer app.changes.unsubscribe(changes)
+
+	w.Header().Set("Content-Type", contentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetry.Milliseconds())
+	flusher.Flush()
+
+	timeout := time.NewTimer(eventStreamDuration)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout.C:
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+
+			if change.OrganisationID != nil && !app.organisationAllowed(r, *change.OrganisationID) {
+				continue
+			}
+
+			js, err := json.Marshal(change)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", js)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The permission which allows changing documents dated within a closed period.
+const periodsOverridePermission = "periods:override"
+
+// The periodClosed() method returns the closed period one of the dates of a document of
+// the organisation falls in, or nil if the document may be changed: all the dates are
+// in open periods or the user may override closed periods.
+func (app *application) periodClosed(r *http.Request, organisationID int64, dates ...time.Time) (*data.ClosedPeriod, error) {
+	period, err := app.models.ClosedPeriods.Covering(organisationID, dates...)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if permissions.Include(periodsOverridePermission) {
+		return nil, nil
+	}
+
+	return period, nil
+}
+
+// The requireOpenPeriod() method checks the dates of a document like periodClosed()
+// and sends the response itself if the document can't be changed. It reports whether
+// the handler may go on.
+func (app *application) requireOpenPeriod(w http.ResponseWriter, r *http.Request, organisationID int64, dates ...time.Time) bool {
+	period, err := app.periodClosed(r, organisationID, dates...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if period != nil {
+		app.periodClosedResponse(w, r, period)
+		return false
+	}
+
+	return true
+}
+
+// Declare a handler which returns the closed periods of the organisation.
+func (app *application) listClosedPeriodsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	periods, err := app.models.ClosedPeriods.GetAll(organisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": periods}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which closes the month, quarter or year of the organisation the
+// given date falls in. Quarters and years follow the fiscal year of the organisation.
+func (app *application) closePeriodHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		ClosedPeriod *struct {
+			Kind string `json:"kind"`
+			Date string `json:"date"`
+		} `json:"closed_period"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.ClosedPeriod == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a closed_period object"))
+		return
+	}
+
+	organisation, err := app.models.Organisations.Get(organisationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	period := &data.ClosedPeriod{
+		OrganisationID: organisation.ID,
+		Kind:           input.ClosedPeriod.Kind,
+		UserID:         &user.ID,
+	}
+
+	v := validator.New()
+
+	date, _, err := parseDate(input.ClosedPeriod.Date)
+	if err != nil {
+		v.AddError("date", "must be a date in the YYYY-MM-DD or RFC3339 format")
+	}
+
+	if data.ValidateClosedPeriod(v, period); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	period.StartDate, period.EndDate = data.PeriodBounds(period.Kind, date, organisation.FiscalYearStart)
+
+	err = app.models.ClosedPeriods.Insert(period)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPeriodAlreadyClosed):
+			v.AddError("date", "the period is already closed")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organisations/%d/closed_periods/%d", organisation.ID, period.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": period}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which reopens a closed period of the organisation.
+func (app *application) reopenPeriodHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.ClosedPeriods.Delete(organisationID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "period successfully reopened"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -11,12 +11,16 @@ import (
 )
 
 type CompanyInput struct {
-	Name        string              `json:"name"`
-	FullName    string              `json:"full_name"`
-	CompanyType int                 `json:"company_type"`
-	Details     data.CompanyDetails `json:"details"`
-	Contacts    []data.Contact      `json:"contacts"`
-	UpdatedAt   *time.Time          `json:"updated_at,omitempty"`
+	Name        string                `json:"name"`
+	FullName    string                `json:"full_name"`
+	CompanyType int                   `json:"company_type"`
+	Details     data.CompanyDetails   `json:"details"`
+	GroupID     *int64                `json:"group_id"`
+	Defaults    *data.CompanyDefaults `json:"defaults"`
+	// The contact to email monthly statements to, null opts out.
+	StatementContactID *int64         `json:"statement_contact_id"`
+	Contacts           []data.Contact `json:"contacts"`
+	UpdatedAt          *time.Time     `json:"updated_at,omitempty"`
 }
 
 // Declare a handler which writes a plain-text response with information about the
@@ -34,18 +38,26 @@ func (app *application) listCompaniesHandler(w http.ResponseWriter, r *http.Requ
 	// Call r.URL.Query() to get the url.Values map containing the query string data.
 	qs := r.URL.Query()
 
+	input.CompanyFilters.OrganisationID = app.readInt64(qs, "organisation_id", 0, v)
+	input.CompanyFilters.Name = app.readString(qs, "name", "")
+	input.CompanyFilters.CompanyType = app.readInt(qs, "company_type", 0, v)
+	input.CompanyFilters.INN = app.readString(qs, "inn", "")
+	input.CompanyFilters.IncludeDeleted = app.readString(qs, "include_deleted", "false") == "true"
+
 	// Read the page and limit query string values into the embedded struct.
 	input.Pagination.Page = app.readInt(qs, "page", 1, v)
-	input.Pagination.Limit = app.readInt(qs, "limit", 20, v)
+	input.Pagination.Limit, input.Pagination.MaxLimit = app.readPageLimit(qs, "companies", v)
 
 	// Read the sort query string value into the embedded struct.
 	input.Pagination.Sort = app.readString(qs, "sort", "id")
 	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Pagination.SortSafelist = []string{"id", "number", "created_at"}
+	input.Pagination.SortSafelist = []string{"id", "name", "created_at", "days_to_pay"}
 	// Read the sort query string value into the embedded struct.
 	input.Pagination.Direction = app.readString(qs, "direction", "asc")
 	input.Pagination.DirectionSafelist = []string{"asc", "desc"}
 
+	data.ValidateCompanyFilters(v, input.CompanyFilters)
+
 	// Execute the validation checks on the Pagination struct and send a response
 	// containing the errors if necessary.
 	if data.ValidatePagination(v, input.Pagination); !v.Valid() {
@@ -62,10 +74,7 @@ func (app *application) listCompaniesHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Send a JSON response containing the company data.
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": companies, "meta": metadata}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	app.streamJSON(w, r, http.StatusOK, envelope{"data": companies, "meta": metadata}, app.paginationHeaders(r, metadata))
 }
 
 // Declare a handler which writes a plain-text response with information about the
@@ -121,6 +130,8 @@ func (app *application) createCompanyHandler(w http.ResponseWriter, r *http.Requ
 		FullName:    fields.FullName,
 		CompanyType: fields.CompanyType,
 		Details:     &fields.Details,
+		GroupID:     fields.GroupID,
+		Defaults:    fields.Defaults,
 	}
 
 	// Initialize a new Validator instance.
@@ -207,7 +218,7 @@ func (app *application) showCompanyHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// get all bank accounts
-	contacts, err := app.models.Contacts.GetAll(id)
+	contacts, err := app.models.Contacts.GetAll(id, "")
 	if err != nil {
 		app.logger.Err(err).Msg("errors in getting contacts")
 	}
@@ -259,6 +270,13 @@ func (app *application) updateCompanyHandler(w http.ResponseWriter, r *http.Requ
 	company.FullName = fields.FullName
 	company.CompanyType = fields.CompanyType
 	company.Details = &fields.Details
+	company.GroupID = fields.GroupID
+
+	if fields.Defaults != nil {
+		company.Defaults = fields.Defaults
+	}
+
+	company.StatementContactID = fields.StatementContactID
 
 	// Validate the updated company record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
@@ -269,6 +287,25 @@ func (app *application) updateCompanyHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Statements can only be sent to a contact of the company which has an email.
+	if company.StatementContactID != nil {
+		contact, err := app.models.Contacts.Get(company.ID, *company.StatementContactID)
+		switch {
+		case err == nil:
+			v.Check(contact.Email != "", "statement_contact_id", "contact has no email")
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("statement_contact_id", "contact not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
 	// Pass the updated company record to our new Update() method.
 	err = app.models.Companies.Update(company)
 	if err != nil {
@@ -311,3 +348,100 @@ func (app *application) deleteCompanyHandler(w http.ResponseWriter, r *http.Requ
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The anonymizeCompanyHandler() irreversibly strips personal data from the company's
+// contacts. It has to be called twice: the first call returns a confirmation token,
+// and only the second call carrying that token does the actual work.
+func (app *application) anonymizeCompanyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	company, err := app.models.Companies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		ConfirmationToken string `json:"confirmation_token"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(company.AnonymizedAt == nil, "company", "is already anonymized")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if input.ConfirmationToken == "" {
+		token, expires, err := app.createConfirmationToken("companies:anonymize", company.ID, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		message := "repeat the request with the confirmation token to anonymize the company, this can't be undone"
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message, "confirmation_token": token, "expires": expires}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	confirmed := app.checkConfirmationToken(input.ConfirmationToken, "companies:anonymize", company.ID, user.ID)
+	v.Check(confirmed, "confirmation_token", "invalid or expired confirmation token")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	contacts, err := app.models.Companies.Anonymize(company.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The data is already gone at this point, so a failure to record the event is
+	// logged rather than reported to the client.
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "anonymize",
+		Entity:   "company",
+		EntityID: company.ID,
+		Details: map[string]interface{}{
+			"contacts": contacts,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "company successfully anonymized", "contacts": contacts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// CompanyBranchInput is the body of the branch endpoints, fields which an update
+// doesn't send are kept.
+type CompanyBranchInput struct {
+	Name      *string `json:"name"`
+	KPP       *string `json:"kpp"`
+	Address   *string `json:"address"`
+	IsDefault *bool   `json:"is_default"`
+}
+
+// apply copies the fields the client sent to the branch.
+func (input *CompanyBranchInput) apply(branch *data.CompanyBranch) {
+	if input.Name != nil {
+		branch.Name = *input.Name
+	}
+
+	if input.KPP != nil {
+		branch.KPP = *input.KPP
+	}
+
+	if input.Address != nil {
+		branch.Address = *input.Address
+	}
+
+	if input.IsDefault != nil {
+		branch.IsDefault = *input.IsDefault
+	}
+}
+
+// The listCompanyBranchesHandler() returns the branches of the company, the default
+// one first.
+func (app *application) listCompanyBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	branches, err := app.models.CompanyBranches.GetAll(companyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": branches}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createCompanyBranchHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Branch *CompanyBranchInput `json:"branch"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	_, err = app.models.Companies.Get(companyID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	branch := &data.CompanyBranch{CompanyID: companyID}
+	if input.Branch != nil {
+		input.Branch.apply(branch)
+	}
+
+	v := validator.New()
+
+	if data.ValidateCompanyBranch(v, branch); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.CompanyBranches.Insert(branch)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/companies/%d/branches/%d", companyID, branch.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": branch}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCompanyBranchHandler(w http.ResponseWriter, r *http.Request) {
+	branch, ok := app.readCompanyBranch(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": branch}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCompanyBranchHandler(w http.ResponseWriter, r *http.Request) {
+	branch, ok := app.readCompanyBranch(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Branch *CompanyBranchInput `json:"branch"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Branch != nil {
+		input.Branch.apply(branch)
+	}
+
+	v := validator.New()
+
+	if data.ValidateCompanyBranch(v, branch); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.CompanyBranches.Update(branch)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": branch}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteCompanyBranchHandler() deletes a branch which no invoice is issued to, a
+// branch in use gets a 409 Conflict.
+func (app *application) deleteCompanyBranchHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.CompanyBranches.Delete(companyID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrBranchInUse):
+			app.branchInUseResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "branch successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readCompanyBranch returns the branch of the URL, sending a 404 Not Found if the
+// company has no such branch.
+func (app *application) readCompanyBranch(w http.ResponseWriter, r *http.Request) (*data.CompanyBranch, bool) {
+	companyID, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	branch, err := app.models.CompanyBranches.Get(companyID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return branch, true
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+type CompanyGroupInput struct {
+	Name      string     `json:"name"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// Declare a handler which returns the list of company groups.
+func (app *application) listCompanyGroupsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Call the GetAll() method to retrieve the company groups, passing in the various filter
+	// parameters.
+	groups, err := app.models.CompanyGroups.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Send a JSON response containing the group data.
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": groups}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createCompanyGroupHandler(w http.ResponseWriter, r *http.Request) {
+	// Declare an anonymous struct to hold the information that we expect to be in the
+	// HTTP request body
+	var input struct {
+		CompanyGroup *CompanyGroupInput `json:"company_group"`
+	}
+
+	// Use the new readJSON() helper to decode the request body into the input struct.
+	// If this returns an error we send the client the error message along with a 400
+	// Bad Request status code, just like before.
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		// Use the new badRequestResponse() helper.
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var fields = input.CompanyGroup
+
+	group := &data.CompanyGroup{
+		Name: fields.Name,
+	}
+
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	// Call the validate function and return a response containing the errors if
+	// any of the checks fail.
+	if data.ValidateCompanyGroup(v, group); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Call the Insert() method on our model, passing in a pointer to the
+	// validated struct.
+	err = app.models.CompanyGroups.Insert(group)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// When sending a HTTP response, we want to include a Location header to let the
+	// client know which URL they can find the newly-created resource at.
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/company_groups/%d", group.ID))
+
+	// Write a JSON response with a 201 Created status code, the group data in the
+	// response body, and the Location header.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": group}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+}
+
+func (app *application) showCompanyGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("groupID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Call the Get() method to fetch the data for a specific group. We also need to
+	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
+	// error, in which case we send a 404 Not Found response to the client.
+	group, err := app.models.CompanyGroups.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": group}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+}
+
+func (app *application) updateCompanyGroupHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the group ID from the URL.
+	id, err := app.readIDParam("groupID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Fetch the existing group record from the database, sending a 404 Not Found
+	// response to the client if we couldn't find a matching record.
+	group, err := app.models.CompanyGroups.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Declare an input struct to hold the expected data from the client.
+	var input struct {
+		CompanyGroup *CompanyGroupInput `json:"company_group"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var fields = input.CompanyGroup
+
+	group.Name = fields.Name
+
+	// Validate the updated group record, sending the client a 422 Unprocessable Entity
+	// response if any checks fail.
+	v := validator.New()
+
+	if data.ValidateCompanyGroup(v, group); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Pass the updated group record to our new Update() method.
+	err = app.models.CompanyGroups.Update(group)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Write the updated group record in a JSON response.
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": group}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+}
+
+func (app *application) deleteCompanyGroupHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the group ID from the URL.
+	id, err := app.readIDParam("groupID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Delete the group from the database, sending a 404 Not Found response to the
+	// client if there isn't a matching record.
+	err = app.models.CompanyGroups.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Return a 200 OK status code along with a success message.
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "company group successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The companyGroupStatementHandler() returns the consolidated statement of all
+// companies of the group for the period given by the start and end query parameters.
+// The current month is used when the period isn't given.
+func (app *application) companyGroupStatementHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("groupID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.CompanyGroups.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	now := time.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := monthStart.AddDate(0, 1, 0).Add(-time.Second)
+
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	start, end := app.readDateRange(qs, &monthStart, &monthEnd, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	statement, err := app.models.Reports.GroupStatement(id, *start, *end)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": statement}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
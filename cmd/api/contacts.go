@@ -4,20 +4,27 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/data"
 	"github.com/ElOtro/stockup-api/internal/validator"
 )
 
+// Roles are kept when an update doesn't send them.
 type ContactInput struct {
 	Role    int                  `json:"role"`
+	Roles   []string             `json:"roles"`
 	Title   string               `json:"title"`
 	Name    string               `json:"name"`
 	Phone   string               `json:"phone"`
 	Email   string               `json:"email"`
 	StartAt *time.Time           `json:"start_at"`
+	Sign    *string              `json:"sign"`
 	Details *data.ContactDetails `json:"details,omitempty"`
+	// Unsubscribed is kept when an update doesn't send it.
+	Unsubscribed *bool `json:"unsubscribed"`
 }
 
 // Declare a handler which writes a plain-text response with information about the
@@ -30,9 +37,18 @@ func (app *application) listContactsHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// The directory of a role, e.g. ?role=signer, lists the contacts with that role.
+	role := app.readString(r.URL.Query(), "role", "")
+
+	v := validator.New()
+	if v.Check(role == "" || validator.In(role, data.ContactRoles...), "role", "must be signer, accountant or recipient"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Call the GetAll() method to retrieve the contacts, passing in the various filter
 	// parameters.
-	contacts, err := app.models.Contacts.GetAll(companyID)
+	contacts, err := app.models.Contacts.GetAll(companyID, role)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -70,14 +86,20 @@ func (app *application) createContactHandler(w http.ResponseWriter, r *http.Requ
 
 	contact := &data.Contact{
 		Role:    fields.Role,
+		Roles:   fields.Roles,
 		Title:   fields.Title,
 		Name:    fields.Name,
 		Phone:   fields.Phone,
 		Email:   fields.Email,
 		StartAt: fields.StartAt,
+		Sign:    fields.Sign,
 		Details: fields.Details,
 	}
 
+	if fields.Unsubscribed != nil {
+		contact.Unsubscribed = *fields.Unsubscribed
+	}
+
 	// Initialize a new Validator instance.
 	v := validator.New()
 
@@ -190,7 +212,20 @@ func (app *application) updateContactHandler(w http.ResponseWriter, r *http.Requ
 	contact.Phone = fields.Phone
 	contact.Email = fields.Email
 	contact.StartAt = fields.StartAt
-	contact.Details = fields.Details
+	contact.Sign = fields.Sign
+
+	// The details are kept unless the request replaces them.
+	if fields.Details != nil {
+		contact.Details = fields.Details
+	}
+
+	if fields.Roles != nil {
+		contact.Roles = fields.Roles
+	}
+
+	if fields.Unsubscribed != nil {
+		contact.Unsubscribed = *fields.Unsubscribed
+	}
 
 	// Initialize a new Validator instance.
 	v := validator.New()
@@ -205,7 +240,12 @@ func (app *application) updateContactHandler(w http.ResponseWriter, r *http.Requ
 	// Pass the updated contact record to our new Update() method.
 	err = app.models.Contacts.Update(contact)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -218,6 +258,12 @@ func (app *application) updateContactHandler(w http.ResponseWriter, r *http.Requ
 }
 
 func (app *application) deleteContactHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
 	// Extract the contact ID from the URL.
 	id, err := app.readIDParam("ID", r)
 	if err != nil {
@@ -227,7 +273,7 @@ func (app *application) deleteContactHandler(w http.ResponseWriter, r *http.Requ
 
 	// Delete the contact from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Contacts.Delete(id)
+	err = app.models.Contacts.Delete(companyID, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -244,3 +290,69 @@ func (app *application) deleteContactHandler(w http.ResponseWriter, r *http.Requ
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The exportContactsHandler() sends the contacts of ?company_ids= with the ?role= as a
+// CSV for mail-merge campaigns, of all companies of the organisation of the token
+// without company_ids. Unsubscribed contacts and those without an email or a phone are
+// left out. Exporting personal data is recorded as an audit event.
+func (app *application) exportContactsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := data.ContactExportFilters{
+		OrganisationID: app.contextGetOrganisationID(r),
+		CompanyIDs:     app.readInt64CSV(qs, "company_ids", v),
+		Role:           app.readString(qs, "role", ""),
+	}
+
+	v.Check(filters.Role == "" || validator.In(filters.Role, data.ContactRoles...), "role", "must be signer, accountant or recipient")
+	v.Check(len(filters.CompanyIDs) <= 1000, "company_ids", "must not contain more than 1000 companies")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	contacts, err := app.models.Contacts.Export(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	rows := [][]string{{"company_id", "company", "name", "title", "email", "phone", "roles"}}
+	for _, contact := range contacts {
+		rows = append(rows, []string{
+			strconv.FormatInt(contact.CompanyID, 10),
+			contact.CompanyName,
+			contact.Name,
+			contact.Title,
+			contact.Email,
+			contact.Phone,
+			strings.Join(contact.Roles, ";"),
+		})
+	}
+
+	user := app.contextGetUser(r)
+
+	event := &data.AuditEvent{
+		UserID: &user.ID,
+		Action: "export_contacts",
+		Entity: "contact",
+		Details: map[string]interface{}{
+			"role":        filters.Role,
+			"company_ids": filters.CompanyIDs,
+			"contacts":    len(contacts),
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeCSV(w, http.StatusOK, "contacts.csv", app.contextGetLocale(r), rows)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/locale"
 )
 
 // Define a custom contextKey type, with the underlying type string.
@@ -15,6 +16,21 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// The organisation the authentication token is bound to, see switchOrganisationHandler().
+const organisationContextKey = contextKey("organisation_id")
+
+// The media type of the response chosen by the negotiate() middleware.
+const contentTypeContextKey = contextKey("content_type")
+
+// The locale of exported files chosen by the localize() middleware.
+const localeContextKey = contextKey("locale")
+
+// The integration token of requests to the integration endpoints.
+const integrationTokenContextKey = contextKey("integration_token")
+
+// The invoice in the URL of changes to a single invoice, see requireInvoiceAccess().
+const invoiceContextKey = contextKey("invoice")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -34,3 +50,89 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetOrganisationID() method returns a new copy of the request with the
+// organisation from the authentication token added to the context.
+func (app *application) contextSetOrganisationID(r *http.Request, organisationID int64) *http.Request {
+	ctx := context.WithValue(r.Context(), organisationContextKey, organisationID)
+	return r.WithContext(ctx)
+}
+
+// The contextGetOrganisationID() retrieves the organisation from the request context.
+// Unlike the user it is optional, so 0 is returned when the token isn't bound to an
+// organisation and queries shouldn't be restricted.
+func (app *application) contextGetOrganisationID(r *http.Request) int64 {
+	organisationID, ok := r.Context().Value(organisationContextKey).(int64)
+	if !ok {
+		return 0
+	}
+	return organisationID
+}
+
+// The contextSetContentType() method returns a new copy of the request with the
+// negotiated media type of the response added to the context.
+func (app *application) contextSetContentType(r *http.Request, contentType string) *http.Request {
+	ctx := context.WithValue(r.Context(), contentTypeContextKey, contentType)
+	return r.WithContext(ctx)
+}
+
+// The contextGetContentType() retrieves the negotiated media type of the response,
+// JSON on routes which don't negotiate.
+func (app *application) contextGetContentType(r *http.Request) string {
+	contentType, ok := r.Context().Value(contentTypeContextKey).(string)
+	if !ok {
+		return contentTypeJSON
+	}
+	return contentType
+}
+
+// The contextSetLocale() method returns a new copy of the request with the locale of
+// exported files added to the context.
+func (app *application) contextSetLocale(r *http.Request, loc locale.Locale) *http.Request {
+	ctx := context.WithValue(r.Context(), localeContextKey, loc)
+	return r.WithContext(ctx)
+}
+
+// The contextGetLocale() retrieves the locale of exported files, the default locale on
+// routes which aren't localized.
+func (app *application) contextGetLocale(r *http.Request) locale.Locale {
+	loc, ok := r.Context().Value(localeContextKey).(locale.Locale)
+	if !ok {
+		return locale.Default
+	}
+	return loc
+}
+
+// The contextSetIntegrationToken() method returns a new copy of the request with the
+// integration token the request was authenticated with added to the context.
+func (app *application) contextSetIntegrationToken(r *http.Request, token *data.IntegrationToken) *http.Request {
+	ctx := context.WithValue(r.Context(), integrationTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetIntegrationToken() retrieves the integration token. Like the user it
+// is always set on the routes behind authenticateIntegration().
+func (app *application) contextGetIntegrationToken(r *http.Request) *data.IntegrationToken {
+	token, ok := r.Context().Value(integrationTokenContextKey).(*data.IntegrationToken)
+	if !ok {
+		panic("missing integration token value in request context")
+	}
+	return token
+}
+
+// The contextSetInvoice() method returns a new copy of the request with the invoice
+// looked up by requireInvoiceAccess() added to the context.
+func (app *application) contextSetInvoice(r *http.Request, invoice *data.Invoice) *http.Request {
+	ctx := context.WithValue(r.Context(), invoiceContextKey, invoice)
+	return r.WithContext(ctx)
+}
+
+// The contextGetInvoice() retrieves the invoice from the request context. It's only
+// there for changes, so like the user a missing invoice is an unexpected error.
+func (app *application) contextGetInvoice(r *http.Request) *data.Invoice {
+	invoice, ok := r.Context().Value(invoiceContextKey).(*data.Invoice)
+	if !ok {
+		panic("missing invoice value in request context")
+	}
+	return invoice
+}
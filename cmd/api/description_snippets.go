@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+type DescriptionSnippetInput struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// Declare a handler which returns the description snippets of the organisation, the
+// most used first.
+func (app *application) listDescriptionSnippetsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	snippets, err := app.models.DescriptionSnippets.GetAll(organisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": snippets}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The suggestDescriptionSnippetsHandler() returns the snippets containing the q query
+// parameter, ranked by usage, for completing the description of an invoice item.
+func (app *application) suggestDescriptionSnippetsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	term := app.readString(qs, "q", "")
+	limit, maxLimit := app.readPageLimit(qs, "description_snippets", v)
+	data.ValidateLimit(v, limit, maxLimit)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	snippets, err := app.models.DescriptionSnippets.Suggest(organisationID, term, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": snippets}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createDescriptionSnippetHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		DescriptionSnippet *DescriptionSnippetInput `json:"description_snippet"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.DescriptionSnippet == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a description_snippet object"))
+		return
+	}
+
+	var fields = input.DescriptionSnippet
+
+	snippet := &data.DescriptionSnippet{
+		Name:   fields.Name,
+		Text:   fields.Text,
+		UserID: &app.contextGetUser(r).ID,
+	}
+
+	v := validator.New()
+
+	if data.ValidateDescriptionSnippet(v, snippet); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.DescriptionSnippets.Insert(organisationID, snippet)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateSnippet):
+			v.AddError("text", "a snippet with this text already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organisations/%d/description_snippets/%d", organisationID, snippet.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": snippet}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showDescriptionSnippetHandler(w http.ResponseWriter, r *http.Request) {
+	snippet, ok := app.readDescriptionSnippet(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": snippet}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateDescriptionSnippetHandler(w http.ResponseWriter, r *http.Request) {
+	snippet, ok := app.readDescriptionSnippet(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		DescriptionSnippet *struct {
+			Name *string `json:"name"`
+			Text *string `json:"text"`
+		} `json:"description_snippet"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.DescriptionSnippet == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a description_snippet object"))
+		return
+	}
+
+	var fields = input.DescriptionSnippet
+
+	if fields.Name != nil {
+		snippet.Name = *fields.Name
+	}
+
+	if fields.Text != nil {
+		snippet.Text = *fields.Text
+	}
+
+	v := validator.New()
+
+	if data.ValidateDescriptionSnippet(v, snippet); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.DescriptionSnippets.Update(snippet)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateSnippet):
+			v.AddError("text", "a snippet with this text already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": snippet}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The useDescriptionSnippetHandler() is called by the client when it inserts the
+// snippet into an invoice item, so the suggestions follow what is actually used.
+func (app *application) useDescriptionSnippetHandler(w http.ResponseWriter, r *http.Request) {
+	snippet, ok := app.readDescriptionSnippet(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.DescriptionSnippets.Use(snippet)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": snippet}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteDescriptionSnippetHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.DescriptionSnippets.Delete(organisationID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "description_snippet successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readDescriptionSnippet fetches the snippet of the organisation in the URL. It sends
+// the error response itself and returns false if that fails.
+func (app *application) readDescriptionSnippet(w http.ResponseWriter, r *http.Request) (*data.DescriptionSnippet, bool) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	snippet, err := app.models.DescriptionSnippets.Get(organisationID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return snippet, true
+}
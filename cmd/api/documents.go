@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/documents"
+	"github.com/ElOtro/stockup-api/internal/pdf"
+)
+
+// The stamp and the signatures printed into PDF invoices are loaded from their URLs
+// with a short timeout and up to 2MB, like the uploaded avatars.
+const (
+	pdfImageTimeout  = 5 * time.Second
+	pdfImageMaxBytes = 2 << 20
+)
+
+var pdfImageClient = &http.Client{Timeout: pdfImageTimeout}
+
+// loadPDFFonts reads the TrueType fonts PDF invoices are printed with. The bold font
+// is optional.
+func loadPDFFonts(regular, bold string) (*documents.PDFFonts, error) {
+	load := func(path string) (*pdf.Font, error) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		font, err := pdf.ParseFont(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		return font, nil
+	}
+
+	fonts := &documents.PDFFonts{}
+
+	var err error
+	fonts.Regular, err = load(regular)
+	if err != nil {
+		return nil, err
+	}
+
+	if bold != "" {
+		fonts.Bold, err = load(bold)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fonts, nil
+}
+
+// invoiceDocument loads the invoice with its items, the organisation, the company and
+// its branch, the bank account and the agreement and resolves the data the invoice is
+// printed with. The organisation is printed with its requisites in force on the
+// invoice date. The default bank account of the organisation is used when the invoice
+// has none. A draft invoice, one which hasn't been sent yet, is printed as a draft.
+func (app *application) invoiceDocument(id int64) (*documents.Invoice, error) {
+	invoice, err := app.models.Invoices.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := app.models.InvoiceItems.GetAll(id)
+	if err != nil {
+		return nil, err
+	}
+
+	organisation, err := app.organisationOn(invoice.OrganisationID, invoice.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	company, err := app.models.Companies.Get(invoice.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var branch *data.CompanyBranch
+	if invoice.BranchID != nil {
+		branch, err = app.models.CompanyBranches.Get(invoice.CompanyID, *invoice.BranchID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	bankAccountID := invoice.BankAccountID
+	if bankAccountID == 0 && organisation.DefaultBankAccount != nil {
+		bankAccountID = organisation.DefaultBankAccount.ID
+	}
+
+	var bankAccount *data.BankAccount
+	if bankAccountID > 0 {
+		bankAccount, err = app.models.BankAccounts.Get(invoice.OrganisationID, bankAccountID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	var agreement *data.Agreement
+	if invoice.AgreementID > 0 {
+		agreement, err = app.models.Agreements.Get(invoice.AgreementID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	var signer *data.Contact
+	if invoice.SignerContactID != nil {
+		signer, err = app.models.Contacts.Get(invoice.CompanyID, *invoice.SignerContactID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	document := documents.NewInvoice(invoice, items, organisation, company, branch, bankAccount, agreement, signer)
+
+	if invoice.Status == data.InvoiceStatusDraft {
+		document.MarkDraft(organisation)
+	}
+
+	return document, nil
+}
+
+// The invoiceRenderContextHandler() returns the data the invoice templates are rendered
+// with, so the designers of custom layouts can see every value they can print.
+func (app *application) invoiceRenderContextHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("invoiceID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	document, err := app.invoiceDocument(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": document}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The invoiceHTMLHandler() returns the invoice as a standalone HTML page for printing or
+// previewing in a browser, rendered from the same data as the render context.
+func (app *application) invoiceHTMLHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("invoiceID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	document, err := app.invoiceDocument(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Render into a buffer first, so a failing template still gets an error response.
+	buf := new(bytes.Buffer)
+
+	err = documents.RenderInvoiceHTML(buf, document)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeHTML+"; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// The invoicePDFHandler() returns the invoice as an A4 PDF document with the same
+// content as the HTML page. The stamp and the signatures given as URLs are loaded from
+// there; the invoice is printed without the ones which can't be loaded. Sent invoices
+// are kept as a new version whenever their document changed, so what was issued can
+// be downloaded later even after the requisites have changed.
+func (app *application) invoicePDFHandler(w http.ResponseWriter, r *http.Request) {
+	if app.pdfFonts == nil {
+		app.errorResponse(w, r, http.StatusServiceUnavailable, "PDF printing is not enabled on this server")
+		return
+	}
+
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	document, err := app.invoiceDocument(invoice.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	load := func(url string) ([]byte, error) {
+		content, err := loadPDFImage(r.Context(), url)
+		if err != nil {
+			app.logger.Warn().Err(err).Int64("invoice_id", invoice.ID).Str("url", url).Msg("loading an image of the PDF invoice")
+		}
+		return content, err
+	}
+
+	// Render into a buffer first, so a failing document still gets an error response.
+	buf := new(bytes.Buffer)
+
+	err = documents.RenderInvoicePDF(buf, document, *app.pdfFonts, load)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	name := fmt.Sprintf("invoice-%d.pdf", invoice.ID)
+
+	if !document.Draft {
+		user := app.contextGetUser(r)
+
+		err = app.recordDocument(r.Context(), &data.GeneratedDocument{
+			OrganisationID: invoice.OrganisationID,
+			DocumentType:   data.DocumentInvoice,
+			DocumentID:     invoice.ID,
+			Format:         data.DocumentFormatPDF,
+			Name:           name,
+			ContentType:    contentTypePDF,
+			UserID:         &user.ID,
+		}, buf.Bytes())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentTypePDF)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// loadPDFImage downloads the image of the stamp or a signature of an invoice.
+func loadPDFImage(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := pdfImageClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(res.Body, pdfImageMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > pdfImageMaxBytes {
+		return nil, errors.New("the image is larger than 2MB")
+	}
+
+	return content, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// How long a duplicate report may run.
+const duplicateReportTimeout = 10 * time.Minute
+
+var errDuplicateReportRunning = errors.New("a duplicate report is already running")
+
+// beginDuplicateReport takes the duplicate report lock, so only one report runs at a
+// time across all the instances, and records a new running report. The lock is
+// released by runDuplicateReport().
+func (app *application) beginDuplicateReport(userID *int64) (*data.DuplicateReport, *data.Lock, error) {
+	lock, err := app.models.Locks.TryLock(context.Background(), "duplicate_report")
+	if err != nil {
+		return nil, nil, err
+	}
+	if lock == nil {
+		return nil, nil, errDuplicateReportRunning
+	}
+
+	// Holding the lock no report can be running, those recorded as running were
+	// interrupted.
+	err = app.models.DuplicateReports.Interrupt()
+	if err == nil {
+		report := &data.DuplicateReport{UserID: userID}
+
+		err = app.models.DuplicateReports.Insert(report)
+		if err == nil {
+			return report, lock, nil
+		}
+	}
+
+	if unlockErr := lock.Unlock(); unlockErr != nil {
+		app.logger.Err(unlockErr).Msg("releasing the duplicate report lock")
+	}
+
+	return nil, nil, err
+}
+
+// runDuplicateReport looks for the duplicates and records the result. It releases the
+// lock taken by beginDuplicateReport().
+func (app *application) runDuplicateReport(report *data.DuplicateReport, lock *data.Lock) {
+	defer func() {
+		err := lock.Unlock()
+		if err != nil {
+			app.logger.Err(err).Msg("releasing the duplicate report lock")
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), duplicateReportTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	report.Status = data.DuplicateReportSucceeded
+	groups, err := app.models.DuplicateReports.Find(ctx)
+	if err != nil {
+		message := err.Error()
+		report.Status = data.DuplicateReportFailed
+		report.Error = &message
+		app.logger.Err(err).Int64("duplicate_report_id", report.ID).Msg("looking for duplicates")
+	} else {
+		report.Groups = groups
+	}
+
+	err = app.models.DuplicateReports.Finish(report)
+	if err != nil {
+		app.logger.Err(err).Int64("duplicate_report_id", report.ID).Msg("recording the duplicate report")
+		return
+	}
+
+	if report.Status == data.DuplicateReportSucceeded {
+		app.logger.Info().Int64("duplicate_report_id", report.ID).Int("groups", len(report.Groups)).Dur("duration", time.Since(start)).Msg("duplicates found")
+	}
+}
+
+// addMergeLinks links every group of the report to the endpoint which merges its
+// records into the first, oldest one.
+func addMergeLinks(report *data.DuplicateReport) {
+	for _, group := range report.Groups {
+		if len(group.Records) < 2 {
+			continue
+		}
+
+		ids := make([]int64, 0, len(group.Records)-1)
+		for _, record := range group.Records[1:] {
+			ids = append(ids, record.ID)
+		}
+
+		group.Merge = &data.MergeLink{
+			Method: http.MethodPost,
+			Href:   fmt.Sprintf("/v1/%s/%d/merge", mergeResources[group.Entity], group.Records[0].ID),
+			IDs:    ids,
+		}
+	}
+}
+
+// mergeResources are the resources of the merge endpoints by the entity of a group.
+var mergeResources = map[string]string{
+	"company": "companies",
+	"product": "products",
+}
+
+// The createDuplicateReportHandler() starts looking for duplicate companies and
+// products in the background and responds right away with the running report, its
+// result can be followed at the Location.
+func (app *application) createDuplicateReportHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	report, lock, err := app.beginDuplicateReport(&user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, errDuplicateReportRunning):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The response shows the report as it was started, runDuplicateReport() goes on
+	// changing it.
+	started := *report
+	go app.runDuplicateReport(report, lock)
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/duplicates/%d", started.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"data": started}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The latestDuplicateReportHandler() returns the latest duplicate report with links to
+// the merge endpoints.
+func (app *application) latestDuplicateReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := app.models.DuplicateReports.Latest()
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.errorResponse(w, r, http.StatusNotFound, "no duplicate report has been made yet, start one with POST")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	addMergeLinks(report)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showDuplicateReportHandler() returns a duplicate report with links to the merge
+// endpoints.
+func (app *application) showDuplicateReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	report, err := app.models.DuplicateReports.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	addMergeLinks(report)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readMergeInput() helper reads and validates the IDs of the duplicates to merge
+// into the record, sending the error response when they aren't valid.
+func (app *application) readMergeInput(w http.ResponseWriter, r *http.Request, id int64) ([]int64, bool) {
+	var input struct {
+		IDs []int64 `json:"ids"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.IDs) > 0, "ids", "must be provided")
+	v.Check(len(input.IDs) <= 100, "ids", "must not contain more than 100 records")
+	v.Check(validator.Unique(input.IDs), "ids", "must not contain duplicate values")
+	for _, duplicateID := range input.IDs {
+		v.Check(duplicateID != id, "ids", "must not contain the record merged into")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	return input.IDs, true
+}
+
+// The mergeCompaniesHandler() merges the duplicate companies into the company: their
+// documents, payments, contacts and agreements are moved to it and they are
+// soft-deleted.
+func (app *application) mergeCompaniesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Companies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ids, ok := app.readMergeInput(w, r, id)
+	if !ok {
+		return
+	}
+
+	moved, err := app.models.Companies.Merge(id, ids)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrMergeDuplicates):
+			app.failedValidationResponse(w, r, map[string]string{"ids": "must contain existing companies"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.recordMerge(r, "company", id, ids, moved)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": map[string]interface{}{"id": id, "merged": ids, "moved": moved}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The mergeProductsHandler() merges the duplicate products into the product: their
+// invoice and act items are moved to it and they are soft-deleted.
+func (app *application) mergeProductsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("productID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Products.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ids, ok := app.readMergeInput(w, r, id)
+	if !ok {
+		return
+	}
+
+	moved, err := app.models.Products.Merge(id, ids)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrMergeDuplicates):
+			app.failedValidationResponse(w, r, map[string]string{"ids": "must contain existing products"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.recordMerge(r, "product", id, ids, moved)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": map[string]interface{}{"id": id, "merged": ids, "moved": moved}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordMerge records the merge as an audit event. The records are already merged at
+// this point, so a failure is logged rather than reported to the client.
+func (app *application) recordMerge(r *http.Request, entity string, id int64, ids []int64, moved map[string]int64) {
+	user := app.contextGetUser(r)
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "merge",
+		Entity:   entity,
+		EntityID: id,
+		Details: map[string]interface{}{
+			"merged": ids,
+			"moved":  moved,
+		},
+	}
+
+	err := app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/cors"
+	"github.com/jackc/pgx/v5/tracelog"
+	"github.com/rs/zerolog"
+)
+
+// The environments the application runs in. Development is meant for a single
+// developer's machine: readable logs, every SQL statement logged, seeding and the
+// profiler available. Staging and production behave the same way. Sandbox behaves
+// like staging, except that emails, text messages and accounting pushes are recorded
+// in memory instead of being sent, for integrators testing against the API.
+const (
+	envDevelopment = "development"
+	envStaging     = "staging"
+	envProduction  = "production"
+	envSandbox     = "sandbox"
+)
+
+func (cfg config) isDevelopment() bool {
+	return cfg.env == envDevelopment
+}
+
+func (cfg config) isSandbox() bool {
+	return cfg.env == envSandbox
+}
+
+// emailEnabled reports whether emails can be sent, in the sandbox they always can.
+func (cfg config) emailEnabled() bool {
+	return cfg.smtp.host != "" || cfg.isSandbox()
+}
+
+// invoiceSendingEnabled reports whether the invoices of send batches are emailed.
+func (cfg config) invoiceSendingEnabled() bool {
+	return cfg.emailEnabled() && cfg.invoiceSending.interval > 0
+}
+
+// backupsEnabled reports whether the database can be backed up.
+func (cfg config) backupsEnabled() bool {
+	return cfg.backups.dir != ""
+}
+
+// passwordPolicy returns the rules new passwords have to follow.
+func (cfg config) passwordPolicy() data.PasswordPolicy {
+	return data.PasswordPolicy{MinLength: cfg.password.minLength, MinClasses: cfg.password.minClasses}
+}
+
+// storageEnabled reports whether files can be uploaded.
+func (cfg config) storageEnabled() bool {
+	return cfg.storage.dir != ""
+}
+
+// scanningEnabled reports whether attached files are scanned for viruses.
+func (cfg config) scanningEnabled() bool {
+	return cfg.scanner.clamd != ""
+}
+
+// pdfEnabled reports whether invoices can be printed as PDF.
+func (cfg config) pdfEnabled() bool {
+	return cfg.pdf.font != ""
+}
+
+// newLogger returns a logger which writes coloured lines to the console in development
+// and JSON objects, one per line, for the log collector elsewhere.
+func newLogger(cfg config) zerolog.Logger {
+	if cfg.isDevelopment() {
+		output := zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.Kitchen}
+		return zerolog.New(output).With().Timestamp().Logger()
+	}
+
+	return zerolog.New(os.Stderr).With().Timestamp().Logger().Level(zerolog.InfoLevel)
+}
+
+// writeTimeout returns the write timeout of the server. It leaves the longest route
+// timeout a few seconds to send its 504 response.
+func (cfg config) writeTimeout() time.Duration {
+	timeout := 30 * time.Second
+	for _, t := range cfg.routeTimeouts {
+		if t+5*time.Second > timeout {
+			timeout = t + 5*time.Second
+		}
+	}
+
+	return timeout
+}
+
+// pgxLogLevel logs every SQL statement with its arguments in development. Elsewhere
+// only warnings and errors are logged, the arguments may contain personal data.
+func (cfg config) pgxLogLevel() tracelog.LogLevel {
+	if cfg.isDevelopment() {
+		return tracelog.LogLevelInfo
+	}
+
+	return tracelog.LogLevelWarn
+}
+
+// pgxLogger writes the log entries of pgx with the application's logger.
+type pgxLogger struct {
+	logger zerolog.Logger
+}
+
+func (l pgxLogger) Log(ctx context.Context, level tracelog.LogLevel, msg string, data map[string]interface{}) {
+	var event *zerolog.Event
+
+	switch level {
+	case tracelog.LogLevelTrace, tracelog.LogLevelDebug:
+		event = l.logger.Debug()
+	case tracelog.LogLevelInfo:
+		event = l.logger.Info()
+	case tracelog.LogLevelWarn:
+		event = l.logger.Warn()
+	default:
+		event = l.logger.Error()
+	}
+
+	event.Str("module", "pgx").Fields(data).Msg(msg)
+}
+
+// corsOptions allows any origin in development. Elsewhere only the trusted origins may
+// call the API from a browser, and credentials are only sent to them.
+func (cfg config) corsOptions() cors.Options {
+	options := cors.Options{
+		AllowedOrigins:   cfg.cors.trustedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Requested-With", "X-CSRF-Token"},
+		AllowCredentials: true,
+		MaxAge:           300, // Maximum value not ignored by any of major browsers
+	}
+
+	// The cors package allows every origin when none are given, so without trusted
+	// origins every cross-origin request is refused explicitly.
+	if len(options.AllowedOrigins) == 0 {
+		if cfg.isDevelopment() {
+			options.AllowedOrigins = []string{"*"}
+		} else {
+			options.AllowOriginFunc = func(r *http.Request, origin string) bool { return false }
+		}
+	}
+
+	return options
+}
+
+// logRequest writes a log entry for every request once it has been served, with the
+// request id set by the RequestID middleware.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+
+		defer func() {
+			app.logger.Info().
+				Str("request_id", middleware.GetReqID(r.Context())).
+				Str("method", r.Method).
+				Str("uri", r.URL.RequestURI()).
+				Str("remote_addr", r.RemoteAddr).
+				Int("status", ww.Status()).
+				Int("bytes", ww.BytesWritten()).
+				Dur("duration", time.Since(start)).
+				Msg("request")
+		}()
+
+		next.ServeHTTP(ww, r)
+	})
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/ElOtro/stockup-api/internal/data"
 )
 
 // The logError() method is a generic helper for logging an error message. Later in the
@@ -33,11 +38,26 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 // unexpected problem at runtime. It logs the detailed error message, then uses the // errorResponse() helper to send a 500 Internal Server Error status code and JSON
 // response (containing a generic error message) to the client.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// The queries of a request which ran out of time fail with the deadline of the
+	// route, that's not a problem of the server.
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		app.gatewayTimeoutResponse(w, r)
+		return
+	}
+
 	app.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
+// The gatewayTimeoutResponse() method will be used to send a 504 Gateway Timeout status
+// code when a request takes longer than the timeout of its route.
+func (app *application) gatewayTimeoutResponse(w http.ResponseWriter, r *http.Request) {
+	app.logger.Warn().Str("method", r.Method).Str("uri", r.URL.RequestURI()).Msg("request timed out")
+	message := "the request took too long to process, please narrow it down or try again later"
+	app.errorResponse(w, r, http.StatusGatewayTimeout, message)
+}
+
 // The notFoundResponse() method will be used to send a 404 Not Found status code and
 // JSON response to the client.
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
@@ -72,3 +92,71 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	message := "invalid or missing authentication token"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
+
+// The expiredAuthenticationTokenResponse() tells the client to log in again rather
+// than to drop its credentials.
+func (app *application) expiredAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="the token has expired"`)
+	message := "the authentication token has expired"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to update the record due to an edit conflict, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) archivedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record is archived and can't be changed"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) invoiceHasPaymentsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the invoice has payments or returns allocated and can't be deleted"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) invalidTransitionResponse(w http.ResponseWriter, r *http.Request, from, to string) {
+	message := fmt.Sprintf("the invoice is %s and can't be marked as %s", from, to)
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) cancelledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the invoice is cancelled and can't be changed"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) shippedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the goods of the invoice have been shipped, it can't be changed, they are returned instead"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) branchInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invoices are issued to the branch, it can't be deleted"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) periodClosedResponse(w http.ResponseWriter, r *http.Request, period *data.ClosedPeriod) {
+	message := fmt.Sprintf("the document is dated within the closed period from %s to %s",
+		period.StartDate.Format(dateOnlyLayout), period.EndDate.Format(dateOnlyLayout))
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) agreementAmountExceededResponse(w http.ResponseWriter, r *http.Request) {
+	app.failedValidationResponse(w, r, map[string]string{"agreement_id": "invoices would exceed the agreement amount"})
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the request body must be %s", contentTypeJSON)
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request, offers []string) {
+	message := fmt.Sprintf("the resource is only available as %s", strings.Join(offers, " or "))
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
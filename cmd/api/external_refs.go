@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// Declare a handler which returns the references of an invoice in external systems.
+func (app *application) listExternalRefsHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	refs := invoice.ExternalRefs
+	if refs == nil {
+		refs = map[string]string{}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": refs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which sets the reference of an invoice in the external system of
+// the URL, e.g. the deal in a CRM, replacing the one it had there.
+func (app *application) setExternalRefHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	system := chi.URLParam(r, "system")
+
+	var input struct {
+		Ref string `json:"ref"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateExternalRef(v, system, input.Ref); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	refs, err := app.models.Invoices.SetExternalRef(invoice.ID, system, input.Ref)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": refs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which removes the reference of an invoice in an external system.
+func (app *application) deleteExternalRefHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	system := chi.URLParam(r, "system")
+
+	if _, ok := invoice.ExternalRefs[system]; !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	refs, err := app.models.Invoices.DeleteExternalRef(invoice.ID, system)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": refs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
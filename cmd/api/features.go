@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// The requireFeature() method checks that the feature is on for the organisation and
+// sends a 403 Forbidden response itself if it isn't. It reports whether the handler
+// may go on.
+func (app *application) requireFeature(w http.ResponseWriter, r *http.Request, feature string, organisationID int64) bool {
+	enabled, err := app.models.FeatureFlags.Enabled(feature, organisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !enabled {
+		app.errorResponse(w, r, http.StatusForbidden, fmt.Sprintf("the %s feature is not enabled for this organisation", feature))
+		return false
+	}
+
+	return true
+}
+
+// Declare a handler which returns whether every feature is on for the organisation of
+// the token, so clients can hide what is off.
+func (app *application) listFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	features, err := app.models.FeatureFlags.EnabledFeatures(app.contextGetOrganisationID(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": features}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which returns the defaults of the features and all the flags set
+// globally and for organisations.
+func (app *application) listFeatureFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	flags, err := app.models.FeatureFlags.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": flags, "defaults": data.Features}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which turns a feature on or off for an organisation, or globally
+// without organisation_id.
+func (app *application) setFeatureFlagHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		OrganisationID *int64 `json:"organisation_id"`
+		Enabled        *bool  `json:"enabled"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	flag := &data.FeatureFlag{
+		Feature:        chi.URLParam(r, "feature"),
+		OrganisationID: input.OrganisationID,
+		UserID:         &user.ID,
+	}
+
+	v := validator.New()
+
+	v.Check(input.Enabled != nil, "enabled", "must be provided")
+	if input.Enabled != nil {
+		flag.Enabled = *input.Enabled
+	}
+
+	if flag.OrganisationID != nil {
+		_, err = app.models.Organisations.Get(*flag.OrganisationID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("organisation_id", "organisation not found")
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateFeature(v, flag.Feature); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.FeatureFlags.Set(flag)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordFeatureFlag(r, "set_feature", flag.Feature, flag.OrganisationID, map[string]interface{}{"enabled": flag.Enabled})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": flag}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which removes the flag of a feature for the organisation of
+// ?organisation_id=, or the global one without it, so the feature falls back to the
+// global flag or its default.
+func (app *application) deleteFeatureFlagHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	feature := chi.URLParam(r, "feature")
+	organisationID := app.readInt64(r.URL.Query(), "organisation_id", 0, v)
+
+	if data.ValidateFeature(v, feature); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.FeatureFlags.Delete(feature, organisationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var organisation *int64
+	if organisationID != 0 {
+		organisation = &organisationID
+	}
+	app.recordFeatureFlag(r, "delete_feature", feature, organisation, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "feature flag successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordFeatureFlag records the change of a flag as an audit event of the organisation,
+// or of no organisation for global flags. The flag is already changed at this point,
+// so a failure is logged rather than reported to the client.
+func (app *application) recordFeatureFlag(r *http.Request, action, feature string, organisationID *int64, details map[string]interface{}) {
+	user := app.contextGetUser(r)
+
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["feature"] = feature
+
+	event := &data.AuditEvent{
+		UserID:  &user.ID,
+		Action:  action,
+		Entity:  "organisation",
+		Details: details,
+	}
+	if organisationID != nil {
+		event.EntityID = *organisationID
+	}
+
+	err := app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/storage"
+)
+
+// How many expired versions the generated_documents job removes at once, and how often
+// it runs.
+const (
+	generatedDocumentCleanupBatch    = 500
+	generatedDocumentCleanupInterval = 24 * time.Hour
+)
+
+// The recordDocument() method keeps the content of an issued document as a version of
+// it, unless its latest version has the same content. Versions are kept for the
+// retention period of the configuration. Nothing is kept without a storage.
+func (app *application) recordDocument(ctx context.Context, document *data.GeneratedDocument, content []byte) error {
+	if app.storage == nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(content)
+	document.SHA256 = hex.EncodeToString(sum[:])
+	document.Size = int64(len(content))
+
+	if years := app.config.documents.retentionYears; years > 0 {
+		retainUntil := time.Now().AddDate(years, 0, 0)
+		document.RetainUntil = &retainUntil
+	}
+
+	_, err := app.models.GeneratedDocuments.Record(document, func(document *data.GeneratedDocument) error {
+		return app.storage.Put(ctx, document.Key(), bytes.NewReader(content))
+	})
+
+	return err
+}
+
+// Declare a handler which lists the versions of the documents generated for an
+// invoice, the latest first.
+func (app *application) listInvoiceDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	generated, err := app.models.GeneratedDocuments.GetAll(data.DocumentInvoice, invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": generated}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which downloads a version of a document generated for an invoice,
+// as it was issued.
+func (app *application) downloadInvoiceDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	document, err := app.models.GeneratedDocuments.Get(data.DocumentInvoice, invoice.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.storage == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	file, err := app.storage.Open(r.Context(), document.Key())
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", document.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(document.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": document.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The removeExpiredDocuments() job removes the versions of generated documents whose
+// retention has passed, with their content unless another version has the same.
+func (app *application) removeExpiredDocuments() {
+	for {
+		removed, err := app.models.GeneratedDocuments.RemoveExpired(generatedDocumentCleanupBatch, func(document *data.GeneratedDocument) error {
+			err := app.storage.Delete(context.Background(), document.Key())
+			if err != nil {
+				app.logger.Err(err).Int64("generated_document_id", document.ID).Msg("removing a generated document")
+			}
+			return err
+		})
+		if err != nil {
+			app.logger.Err(err).Msg("removing expired generated documents")
+			return
+		}
+
+		if removed > 0 {
+			app.logger.Info().Int("documents", removed).Msg("expired generated documents removed")
+		}
+
+		if removed < generatedDocumentCleanupBatch {
+			return
+		}
+	}
+}
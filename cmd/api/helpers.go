@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/locale"
 	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/ElOtro/stockup-api/internal/xlsx"
 	"github.com/go-chi/chi/v5"
+	"github.com/pascaldekloe/jwt"
 )
 
 // Retrieve the "id" URL parameter from the current request context, then convert it to
@@ -60,9 +69,121 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data interf
 
 }
 
+// The writeCSV() helper sends the rows as a CSV attachment with the given file name.
+// The first row is the header. The fields are separated the way the locale expects.
+func (app *application) writeCSV(w http.ResponseWriter, status int, filename string, loc locale.Locale, rows [][]string) error {
+	var buf bytes.Buffer
+
+	cw := csv.NewWriter(&buf)
+	cw.Comma = loc.Separator
+	cw.WriteAll(rows)
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", contentTypeCSV+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+
+	return nil
+}
+
+// The writeXLSX() helper sends the sheets as an XLSX attachment with the given file
+// name, with the dates in the format of the locale.
+func (app *application) writeXLSX(w http.ResponseWriter, status int, filename string, loc locale.Locale, sheets ...xlsx.Sheet) error {
+	var buf bytes.Buffer
+
+	err := xlsx.Write(&buf, loc, sheets...)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", contentTypeXLSX)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+
+	return nil
+}
+
+// The streamJSON() helper writes the envelope like writeJSON() does, but slices are
+// encoded item by item straight into the response instead of marshalling the whole
+// body into one buffer first. The records themselves are still read into memory by the
+// models, so it only saves the copy of the encoded body; lists stay bounded by their
+// pagination. The status code is sent before encoding, so an error in the middle can
+// only be logged.
+func (app *application) streamJSON(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) {
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	bw := bufio.NewWriterSize(w, 32*1024)
+	enc := json.NewEncoder(bw)
+
+	// Sort the keys to keep the output stable, like json.Marshal() does for maps.
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	err := func() error {
+		bw.WriteByte('{')
+
+		for i, key := range keys {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+
+			name, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			bw.Write(name)
+			bw.WriteByte(':')
+
+			value := reflect.ValueOf(data[key])
+			if value.Kind() != reflect.Slice || value.Type().Elem().Kind() == reflect.Uint8 {
+				if err := enc.Encode(data[key]); err != nil {
+					return err
+				}
+				continue
+			}
+
+			bw.WriteByte('[')
+			for j := 0; j < value.Len(); j++ {
+				if j > 0 {
+					bw.WriteByte(',')
+				}
+				if err := enc.Encode(value.Index(j).Interface()); err != nil {
+					return err
+				}
+			}
+			bw.WriteByte(']')
+		}
+
+		bw.WriteByte('}')
+
+		return bw.Flush()
+	}()
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	// Use http.MaxBytesReader() to limit the size of the request body to 1MB.
-	maxBytes := 1_048_576
+	// Limit the size of the request body to 1MB.
+	return app.readLargeJSON(w, r, dst, 1_048_576)
+}
+
+// The readLargeJSON() helper reads a body of up to maxBytes, for the few requests which
+// carry whole files.
+func (app *application) readLargeJSON(w http.ResponseWriter, r *http.Request, dst interface{}, maxBytes int) error {
+	// Use http.MaxBytesReader() to limit the size of the request body.
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
 	// Initialize the json.Decoder, and call the DisallowUnknownFields() method on it
@@ -120,7 +241,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 			return fmt.Errorf("body contains unknown key %s", fieldName)
 
-		// If the request body exceeds 1MB in size the decode will now fail with the
+		// If the request body exceeds maxBytes in size the decode will now fail with the
 		// error "http: request body too large". There is an open issue about turning
 		// this into a distinct error type at https://github.com/golang/go/issues/30715.
 		case err.Error() == "http: request body too large":
@@ -153,6 +274,167 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// The paginationHeaders() helper returns a Link header (RFC 5988) with the first, prev,
+// next and last pages of a list. The links keep the path and all query string values of
+// the request, only the page is replaced, so the filters and sorting are preserved.
+func (app *application) paginationHeaders(r *http.Request, metadata data.Metadata) http.Header {
+	headers := make(http.Header)
+
+	link := func(page int, rel string) string {
+		qs := r.URL.Query()
+		qs.Set("page", strconv.Itoa(page))
+
+		u := url.URL{Path: r.URL.Path, RawQuery: qs.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+
+	links := []string{link(metadata.FirstPage, "first")}
+	if metadata.HasPrev {
+		// A page past the end links back to the last page rather than to a page which
+		// is empty as well.
+		prev := metadata.CurrentPage - 1
+		if prev > metadata.LastPage {
+			prev = metadata.LastPage
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if metadata.HasNext {
+		links = append(links, link(metadata.CurrentPage+1, "next"))
+	}
+	links = append(links, link(metadata.LastPage, "last"))
+
+	headers.Set("Link", strings.Join(links, ", "))
+
+	return headers
+}
+
+// The readPageLimit() helper reads the limit query parameter of a list endpoint. It
+// returns the page size, the default of the endpoint if none is given, and the maximum
+// to validate it against.
+func (app *application) readPageLimit(qs url.Values, endpoint string, v *validator.Validator) (int, int) {
+	limits, ok := app.config.pageLimits[endpoint]
+	if !ok {
+		limits = data.DefaultPageLimit
+	}
+
+	return app.readInt(qs, "limit", limits.Default, v), limits.Max
+}
+
+// parsePageLimits parses page sizes given as "endpoint=default:max,..." and returns
+// them merged over the default limits.
+func parsePageLimits(s string) (map[string]data.PageLimits, error) {
+	limits := make(map[string]data.PageLimits, len(data.DefaultPageLimits))
+	for endpoint, l := range data.DefaultPageLimits {
+		limits[endpoint] = l
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		sizes := []string{}
+		if len(parts) == 2 {
+			sizes = strings.SplitN(parts[1], ":", 2)
+		}
+
+		if len(sizes) != 2 {
+			return nil, fmt.Errorf("page limit %q must look like endpoint=default:max", entry)
+		}
+
+		endpoint := parts[0]
+
+		if _, known := data.DefaultPageLimits[endpoint]; !known {
+			return nil, fmt.Errorf("page limit %q: unknown endpoint %q", entry, endpoint)
+		}
+
+		var l data.PageLimits
+		var err error
+
+		l.Default, err = strconv.Atoi(sizes[0])
+		if err != nil {
+			return nil, fmt.Errorf("page limit %q: invalid default", entry)
+		}
+
+		l.Max, err = strconv.Atoi(sizes[1])
+		if err != nil {
+			return nil, fmt.Errorf("page limit %q: invalid maximum", entry)
+		}
+
+		if l.Default < 1 || l.Default > l.Max {
+			return nil, fmt.Errorf("page limit %q: the default must be between 1 and the maximum", entry)
+		}
+
+		limits[endpoint] = l
+	}
+
+	return limits, nil
+}
+
+// defaultRouteTimeouts holds how long the requests of a route, the first segment of
+// the path after /v1, may take; other routes get the "default" timeout. Reports are
+// exported as files and maintenance scans whole tables, while the reference lists are
+// expected at once. The event stream ends by itself and has no timeout (0).
+var defaultRouteTimeouts = map[string]time.Duration{
+	"default":   15 * time.Second,
+	"reports":   2 * time.Minute,
+	"admin":     2 * time.Minute,
+	"imports":   2 * time.Minute,
+	"units":     3 * time.Second,
+	"vat_rates": 3 * time.Second,
+	"events":    0,
+}
+
+// The longest timeout a route may be given.
+const maxRouteTimeout = 10 * time.Minute
+
+// parseRouteTimeouts parses timeouts given as "route=duration,..." and returns them
+// merged over the default timeouts.
+func parseRouteTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(defaultRouteTimeouts))
+	for route, timeout := range defaultRouteTimeouts {
+		timeouts[route] = timeout
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		route, value, ok := strings.Cut(entry, "=")
+		if !ok || route == "" {
+			return nil, fmt.Errorf("route timeout %q must look like route=duration", entry)
+		}
+
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("route timeout %q: invalid duration", entry)
+		}
+
+		if timeout < 0 || timeout > maxRouteTimeout {
+			return nil, fmt.Errorf("route timeout %q: must be between 0 and %s", entry, maxRouteTimeout)
+		}
+
+		timeouts[route] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// The routeTimeout() helper returns the timeout of the route of the request.
+func (app *application) routeTimeout(r *http.Request) time.Duration {
+	route, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+
+	if timeout, ok := app.config.routeTimeouts[route]; ok {
+		return timeout
+	}
+
+	return app.config.routeTimeouts["default"]
+}
+
 // The readString() helper returns a string value from the query string, or the provided
 // default value if no matching key could be found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -229,25 +511,164 @@ func (app *application) readInt64(qs url.Values, key string, defaultValue int64,
 	return i
 }
 
-// The readInt() helper reads a string value from the query string and converts it to an
-// integer before returning. If no matching key could be found it returns the provided
-// default value. If the value couldn't be converted to an integer, then we record an
-// error message in the provided Validator instance.
+// The readInt64CSV() helper reads a comma-separated list of integers, e.g. ?ids=1,2,3,
+// from the query string. It returns nil if no matching key could be found. If a value
+// couldn't be converted, then we record an error message in the provided Validator
+// instance.
+func (app *application) readInt64CSV(qs url.Values, key string, v *validator.Validator) []int64 {
+	values := app.readCSV(qs, key, nil)
+	if values == nil {
+		return nil
+	}
+
+	ints := make([]int64, 0, len(values))
+	for _, s := range values {
+		i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			v.AddError(key, "must be a comma-separated list of integer values")
+			return nil
+		}
+		ints = append(ints, i)
+	}
+
+	return ints
+}
+
+// The readMoney() helper reads a decimal value with at most two decimal places from the
+// query string. It returns nil if no matching key could be found, so a missing value can
+// be told apart from zero. If the value couldn't be converted, then we record an error
+// message in the provided Validator instance.
+func (app *application) readMoney(qs url.Values, key string, v *validator.Validator) *data.Money {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	m, err := data.ParseMoney(s)
+	if err != nil {
+		v.AddError(key, err.Error())
+		return nil
+	}
+
+	return &m
+}
+
+// Date query string values are accepted as RFC3339 timestamps or as plain dates.
+const dateOnlyLayout = "2006-01-02"
+
+// parseDate parses a date query string value. The second result reports whether the
+// value was a plain date without a time.
+func parseDate(s string) (time.Time, bool, error) {
+	d, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return d, false, nil
+	}
+
+	d, err = time.Parse(dateOnlyLayout, s)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return d, true, nil
+}
+
+// The readDate() helper reads a date value from the query string, either in the RFC3339
+// or in the YYYY-MM-DD format. If no matching key could be found it returns the provided
+// default value. If the value couldn't be parsed, then we record an error message in
+// the provided Validator instance.
 func (app *application) readDate(qs url.Values, key string, defaultValue *time.Time, v *validator.Validator) *time.Time {
-	// Extract the value from the query string.
 	s := qs.Get(key)
-	// If no key exists (or the value is empty) then return the default value.
 	if s == "" {
 		return defaultValue
 	}
-	// Try to convert the value to an int. If this fails, add an error message to the
-	// validator instance and return the default value.
-	// fmt.Println(s)
-	d, err := time.Parse(time.RFC3339, s)
+
+	d, _, err := parseDate(s)
 	if err != nil {
-		v.AddError(key, "must be a date value")
+		v.AddError(key, "must be a date in the YYYY-MM-DD or RFC3339 format")
 		return nil
 	}
-	// Otherwise, return the converted integer value.
+
 	return &d
 }
+
+// The readDateRange() helper reads the start and end query string values. A plain date
+// given as the end includes the whole day, so start=2021-01-01&end=2021-01-31 covers
+// all of January. Either end of the range may be omitted; if both are given, an end
+// before the start is recorded as an error in the provided Validator instance.
+func (app *application) readDateRange(qs url.Values, defaultStart, defaultEnd *time.Time, v *validator.Validator) (*time.Time, *time.Time) {
+	start := app.readDate(qs, "start", defaultStart, v)
+
+	end := defaultEnd
+	if s := qs.Get("end"); s != "" {
+		d, dateOnly, err := parseDate(s)
+		switch {
+		case err != nil:
+			v.AddError("end", "must be a date in the YYYY-MM-DD or RFC3339 format")
+			end = nil
+		case dateOnly:
+			d = d.AddDate(0, 0, 1).Add(-time.Microsecond)
+			end = &d
+		default:
+			end = &d
+		}
+	}
+
+	if start != nil && end != nil {
+		v.Check(!end.Before(*start), "end", "must not be before start")
+	}
+
+	return start, end
+}
+
+// The createConfirmationToken() helper issues a short-lived signed token which confirms
+// that the user really wants to run a destructive action on the given record. The
+// action is used as the token audience, so the token can't be used for anything else.
+func (app *application) createConfirmationToken(action string, id, userID int64) (string, time.Time, error) {
+	expires := time.Now().Add(10 * time.Minute)
+
+	var claims jwt.Claims
+	claims.Subject = strconv.FormatInt(id, 10)
+	claims.Issued = jwt.NewNumericTime(time.Now())
+	claims.NotBefore = jwt.NewNumericTime(time.Now())
+	claims.Expires = jwt.NewNumericTime(expires)
+	claims.Issuer = "stockup-api"
+	claims.Audiences = []string{action}
+	claims.Set = map[string]interface{}{"user_id": userID}
+
+	token, err := claims.HMACSign(jwt.HS256, []byte(app.config.jwt.secret))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return string(token), expires, nil
+}
+
+// The checkConfirmationToken() helper reports whether the token was issued by
+// createConfirmationToken() for the same action, record and user and hasn't expired.
+func (app *application) checkConfirmationToken(token, action string, id, userID int64) bool {
+	claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.jwt.secret))
+	if err != nil {
+		return false
+	}
+
+	if !claims.Valid(time.Now()) || claims.Issuer != "stockup-api" || !claims.AcceptAudience(action) {
+		return false
+	}
+
+	if claims.Subject != strconv.FormatInt(id, 10) {
+		return false
+	}
+
+	// Numbers are decoded from the JSON payload as float64.
+	tokenUserID, ok := claims.Set["user_id"].(float64)
+
+	return ok && int64(tokenUserID) == userID
+}
+
+// The organisationAllowed() helper reports whether a record of the given organisation
+// may be accessed in the request. Tokens which aren't bound to an organisation may
+// access all of them.
+func (app *application) organisationAllowed(r *http.Request, organisationID int64) bool {
+	current := app.contextGetOrganisationID(r)
+	return current == 0 || current == organisationID
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/commerceml"
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The largest exchange file which can be imported, the JSON body can be a bit larger.
+const importMaxBytes = 20 << 20
+
+// The importCommerceMLHandler() imports the products, the counterparties and the
+// invoices of a 1C exchange file into the organisation. With dry_run nothing is saved
+// and the response shows what the import would do.
+func (app *application) importCommerceMLHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Import *struct {
+			OrganisationID *int64 `json:"organisation_id"`
+			DryRun         bool   `json:"dry_run"`
+			Content        string `json:"content"`
+		} `json:"import"`
+	}
+
+	err := app.readLargeJSON(w, r, &input, importMaxBytes+1_048_576)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Import == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain an import object"))
+		return
+	}
+
+	fields := input.Import
+	user := app.contextGetUser(r)
+
+	params := data.ImportParams{
+		OrganisationID: app.contextGetOrganisationID(r),
+		UserID:         user.ID,
+		DryRun:         fields.DryRun,
+	}
+
+	if fields.OrganisationID != nil {
+		params.OrganisationID = *fields.OrganisationID
+	}
+
+	v := validator.New()
+
+	v.Check(params.OrganisationID != 0, "organisation_id", "must be provided")
+	v.Check(app.organisationAllowed(r, params.OrganisationID), "organisation_id", "must be the current organisation")
+	v.Check(fields.Content != "", "content", "must be provided")
+	v.Check(len(fields.Content) <= importMaxBytes, "content", "must not be larger than 20MB")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	exchange, err := commerceml.Parse(strings.NewReader(fields.Content))
+	if err != nil {
+		v.AddError("content", "must be a CommerceML exchange file: "+err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The dates which can't be read are reported by the import.
+	var dates []time.Time
+	for _, document := range exchange.Documents {
+		date, err := time.Parse("2006-01-02", strings.SplitN(document.Date, "T", 2)[0])
+		if err == nil {
+			dates = append(dates, date)
+		}
+	}
+
+	if !app.requireOpenPeriod(w, r, params.OrganisationID, dates...) {
+		return
+	}
+
+	result, err := app.models.Imports.CommerceML(exchange, params)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrImportProblems) && params.DryRun:
+			// A dry run reports the problems with the rest of the result.
+		case errors.Is(err, data.ErrImportProblems):
+			env := envelope{"error": "the exchange file can't be imported, see the problems", "data": result}
+			err = app.writeJSON(w, http.StatusUnprocessableEntity, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !params.DryRun {
+		event := &data.AuditEvent{
+			UserID: &user.ID,
+			Action: "import",
+			Entity: "commerceml",
+			Details: map[string]interface{}{
+				"organisation_id": params.OrganisationID,
+				"units":           countCreated(result.Units),
+				"products":        countCreated(result.Products),
+				"companies":       countCreated(result.Companies),
+				"agreements":      countCreated(result.Agreements),
+				"invoices":        countCreated(result.Invoices),
+			},
+		}
+
+		err = app.models.AuditEvents.Insert(event)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// countCreated returns the number of records an import created.
+func countCreated(entries []*data.ImportEntry) int {
+	count := 0
+	for _, entry := range entries {
+		if entry.Action == data.ImportCreated {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The default and the largest number of invoices the latest invoices endpoint returns.
+const (
+	integrationInvoicesLimit    = 25
+	integrationInvoicesMaxLimit = 100
+)
+
+// The listIntegrationTokensHandler() returns the integration tokens of the user, the
+// plaintext is only shown when a token is created.
+func (app *application) listIntegrationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	tokens, err := app.models.IntegrationTokens.GetAll(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": tokens}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createIntegrationTokenHandler() creates an integration token of the user for an
+// organisation the user is a member of.
+func (app *application) createIntegrationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IntegrationToken *struct {
+			OrganisationID *int64     `json:"organisation_id"`
+			Name           string     `json:"name"`
+			Scopes         []string   `json:"scopes"`
+			ExpiresAt      *time.Time `json:"expires_at"`
+		} `json:"integration_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.IntegrationToken == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain an integration_token object"))
+		return
+	}
+
+	fields := input.IntegrationToken
+	user := app.contextGetUser(r)
+
+	token := &data.IntegrationToken{
+		UserID:         user.ID,
+		OrganisationID: app.contextGetOrganisationID(r),
+		Name:           fields.Name,
+		Scopes:         fields.Scopes,
+		ExpiresAt:      fields.ExpiresAt,
+	}
+
+	if fields.OrganisationID != nil {
+		token.OrganisationID = *fields.OrganisationID
+	}
+
+	v := validator.New()
+
+	v.Check(app.organisationAllowed(r, token.OrganisationID), "organisation_id", "must be the current organisation")
+
+	if token.OrganisationID != 0 {
+		member, err := app.models.Organisations.HasUser(token.OrganisationID, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		v.Check(member, "organisation_id", "must be an organisation you are a member of")
+	}
+
+	if data.ValidateIntegrationToken(v, token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.IntegrationTokens.Insert(token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "create",
+		Entity:   "integration_token",
+		EntityID: token.ID,
+		Details: map[string]interface{}{
+			"organisation_id": token.OrganisationID,
+			"name":            token.Name,
+			"scopes":          token.Scopes,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revokeIntegrationTokenHandler() revokes an integration token of the user.
+func (app *application) revokeIntegrationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	token, err := app.models.IntegrationTokens.Revoke(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "revoke",
+		Entity:   "integration_token",
+		EntityID: token.ID,
+		Details:  map[string]interface{}{"organisation_id": token.OrganisationID, "name": token.Name},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The integrationMeHandler() describes the integration token, no-code platforms call it
+// to test the connection.
+func (app *application) integrationMeHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.contextGetIntegrationToken(r)
+	user := app.contextGetUser(r)
+
+	organisation, err := app.models.Organisations.Get(token.OrganisationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	me := map[string]interface{}{
+		"token_id":          token.ID,
+		"token_name":        token.Name,
+		"scopes":            token.Scopes,
+		"organisation_id":   organisation.ID,
+		"organisation_name": organisation.Name,
+		"user_id":           user.ID,
+		"user_email":        user.Email,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, me, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The latestInvoicesIntegrationHandler() returns the latest invoices of the organisation
+// as a plain array of flat objects, the newest first, for the polling triggers of
+// no-code platforms.
+func (app *application) latestInvoicesIntegrationHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	limit := app.readInt(r.URL.Query(), "limit", integrationInvoicesLimit, v)
+	data.ValidateLimit(v, limit, integrationInvoicesMaxLimit)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	invoices, err := app.models.Integrations.LatestInvoices(app.contextGetOrganisationID(r), limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, invoices, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showInvoiceIntegrationHandler() returns an invoice of the organisation as a flat
+// object.
+func (app *application) showInvoiceIntegrationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("invoiceID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	invoice, err := app.models.Integrations.Invoice(app.contextGetOrganisationID(r), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, invoice, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// IntegrationInvoiceInput is the flat body of an invoice created by a no-code platform:
+// the company and the product by ID or by INN and SKU, and one line. Everything else
+// comes from the company defaults and the product.
+type IntegrationInvoiceInput struct {
+	CompanyID   int64       `json:"company_id"`
+	CompanyINN  string      `json:"company_inn"`
+	CompanyKPP  string      `json:"company_kpp"`
+	ProductID   int64       `json:"product_id"`
+	ProductSKU  string      `json:"product_sku"`
+	Description string      `json:"description"`
+	Quantity    *float64    `json:"quantity"`
+	Price       *data.Money `json:"price"`
+	Number      string      `json:"number"`
+	Date        string      `json:"date"`
+	DueDate     string      `json:"due_date"`
+	IsActive    bool        `json:"is_active"`
+}
+
+// The createInvoiceIntegrationHandler() creates an invoice with one line from the flat
+// body and returns it as a flat object.
+func (app *application) createInvoiceIntegrationHandler(w http.ResponseWriter, r *http.Request) {
+	var input IntegrationInvoiceInput
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	organisationID := app.contextGetOrganisationID(r)
+
+	invoice := &data.Invoice{
+		IsActive:       input.IsActive,
+		Date:           time.Now(),
+		Number:         input.Number,
+		OrganisationID: organisationID,
+		CompanyID:      input.CompanyID,
+		VatMode:        data.VatOnTop,
+	}
+
+	v := validator.New()
+
+	if input.Date != "" {
+		date, _, err := parseDate(input.Date)
+		if err != nil {
+			v.AddError("date", "must be a date in the YYYY-MM-DD or RFC3339 format")
+		}
+		invoice.Date = date
+	}
+
+	if input.DueDate != "" {
+		dueDate, _, err := parseDate(input.DueDate)
+		if err != nil {
+			v.AddError("due_date", "must be a date in the YYYY-MM-DD or RFC3339 format")
+		}
+		invoice.DueDate = &dueDate
+	}
+
+	quantity := 1.0
+	if input.Quantity != nil {
+		quantity = *input.Quantity
+	}
+	v.Check(quantity > 0, "quantity", "must be greater than zero")
+
+	if invoice.CompanyID == 0 && input.CompanyINN != "" {
+		invoice.CompanyID, invoice.BranchID, err = app.models.Integrations.CompanyByINN(input.CompanyINN, input.CompanyKPP)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		v.Check(invoice.CompanyID != 0, "company_inn", "no company with this INN")
+	}
+	v.Check(invoice.CompanyID != 0 || input.CompanyINN != "", "company_id", "company_id or company_inn must be provided")
+
+	productID := input.ProductID
+	if productID == 0 && input.ProductSKU != "" {
+		productID, err = app.models.Integrations.ProductBySKU(input.ProductSKU)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		v.Check(productID != 0, "product_sku", "no product with this SKU")
+	}
+	v.Check(productID != 0 || input.ProductSKU != "", "product_id", "product_id or product_sku must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	company, err := app.models.Companies.Get(invoice.CompanyID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("company_id", "company not found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	product, err := app.models.Products.Get(productID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("product_id", "product not found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A company found by the KPP of a branch has the invoice issued to that branch,
+	// otherwise to the default branch of the company.
+	if invoice.BranchID == nil {
+		err = app.resolveBranch(v, invoice, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The company defaults only apply when they are for this organisation, otherwise
+	// the default bank account of the organisation is used.
+	if d := company.Defaults; d != nil && d.OrganisationID == organisationID {
+		invoice.BankAccountID = d.BankAccountID
+		if invoice.DueDate == nil && d.PaymentTermDays > 0 {
+			dueDate := invoice.Date.AddDate(0, 0, d.PaymentTermDays)
+			invoice.DueDate = &dueDate
+		}
+	}
+
+	if invoice.BankAccountID == 0 {
+		organisation, err := app.models.Organisations.Get(organisationID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if organisation.DefaultBankAccount != nil {
+			invoice.BankAccountID = organisation.DefaultBankAccount.ID
+		}
+	}
+	v.Check(invoice.BankAccountID != 0, "company_id", "neither the company defaults nor the organisation have a bank account")
+
+	invoice.AgreementID, err = app.models.Integrations.CompanyAgreement(company.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v.Check(invoice.AgreementID != 0, "company_id", "the company has no agreement")
+
+	item := &data.InvoiceItem{
+		ProductID:    product.ID,
+		Description:  input.Description,
+		Quantity:     quantity,
+		Price:        product.Price,
+		DiscountType: data.DiscountPercent,
+	}
+
+	if item.Description == "" {
+		item.Description = product.Name
+	}
+	if input.Price != nil {
+		item.Price = *input.Price
+	}
+	if product.UnitID != nil {
+		item.UnitID = *product.UnitID
+	}
+
+	// The rate of the product may have been replaced since, the rate of its chain which
+	// is valid on the invoice date is used instead.
+	if product.VatRateID != nil {
+		vatRate, err := app.models.VatRates.ResolveOn(*product.VatRateID, invoice.Date)
+		switch {
+		case err == nil:
+			item.VatRateID = vatRate.ID
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrVatRateNotValid):
+			v.AddError("product_id", fmt.Sprintf("the vat rate of the product is not valid on %s", invoice.Date.Format(dateOnlyLayout)))
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	data.ValidateInvoice(v, invoice)
+	data.ValidateInvoiceItem(v, item)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.requireOpenPeriod(w, r, invoice.OrganisationID, invoice.Date) {
+		return
+	}
+
+	err = app.models.Invoices.InsertWithItems(invoice, []*data.InvoiceItem{item})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAgreementAmountExceeded):
+			app.agreementAmountExceededResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	flat, err := app.models.Integrations.Invoice(organisationID, invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/integrations/invoices/%d", invoice.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, flat, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -10,18 +10,23 @@ import (
 )
 
 type InvoiceItemInput struct {
-	InvoiceID    int64    `json:"invoice_id,omitempty"`
-	Position     *int     `json:"position"`
-	ProductID    *int64   `json:"product_id,omitempty"`
-	Description  *string  `json:"description"`
-	UnitID       *int64   `json:"unit_id,omitempty"`
-	Quantity     *float64 `json:"quantity"`
-	Price        *float64 `json:"price"`
-	Amount       *float64 `json:"amount"`
-	DiscountRate *int     `json:"discount_rate"`
-	Discount     *float64 `json:"discount"`
-	VatRateID    *int64   `json:"vat_rate_id,omitempty"`
-	Vat          *float64 `json:"vat,omitempty"`
+	InvoiceID    int64       `json:"invoice_id,omitempty"`
+	Position     *int        `json:"position"`
+	ProductID    *int64      `json:"product_id,omitempty"`
+	Description  *string     `json:"description"`
+	UnitID       *int64      `json:"unit_id,omitempty"`
+	Quantity     *float64    `json:"quantity"`
+	Price        *data.Money `json:"price"`
+	Amount       *data.Money `json:"amount"`
+	DiscountType *string     `json:"discount_type"`
+	DiscountRate *int        `json:"discount_rate"`
+	Discount     *data.Money `json:"discount"`
+	VatRateID    *int64      `json:"vat_rate_id,omitempty"`
+	Vat          *data.Money `json:"vat,omitempty"`
+	// An empty VAT mode makes the line follow the invoice again.
+	VatMode *string `json:"vat_mode"`
+	// A kit is added as a line per component unless keep_kit is set.
+	KeepKit bool `json:"keep_kit"`
 }
 
 // Declare a handler which writes a plain-text response with information about the
@@ -70,7 +75,7 @@ func (app *application) createInvoiceItemHandler(w http.ResponseWriter, r *http.
 	}
 
 	// Call the Get() method to check if invoice exists.
-	_, err = app.models.Invoices.Get(invoiceID)
+	invoice, err := app.models.Invoices.Get(invoiceID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -115,6 +120,17 @@ func (app *application) createInvoiceItemHandler(w http.ResponseWriter, r *http.
 		Vat:          *fields.Vat,
 	}
 
+	// The amount, discount and VAT sent by the client are recalculated when the item
+	// is stored, only the discount rate or the absolute discount are kept.
+	invoiceItem.DiscountType = data.DiscountPercent
+	if fields.DiscountType != nil {
+		invoiceItem.DiscountType = *fields.DiscountType
+	}
+
+	if fields.VatMode != nil && *fields.VatMode != "" {
+		invoiceItem.VatMode = fields.VatMode
+	}
+
 	// Initialize a new Validator instance.
 	v := validator.New()
 
@@ -125,45 +141,101 @@ func (app *application) createInvoiceItemHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	kits := map[int64][]*data.KitComponent{}
+	if !fields.KeepKit {
+		kits, err = app.models.KitComponents.GetForKits([]int64{invoiceItem.ProductID})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// A kit is replaced with the lines of its components, which get the VAT rates of
+	// their products.
+	lines := app.expandKit(v, "discount", invoiceItem, kits)
+	expanded := lines[0] != invoiceItem
+	for _, line := range lines {
+		err = app.validateVatRateOn(v, "vat_rate_id", line.VatRateID, invoice.Date)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Call the Insert() method on our model, passing in a pointer to the
 	// validated struct.
-	err = app.models.InvoiceItems.Insert(invoiceItem.InvoiceID, invoiceItem)
+	if expanded {
+		err = app.models.InvoiceItems.InsertAll(invoiceItem.InvoiceID, lines)
+	} else {
+		err = app.models.InvoiceItems.Insert(invoiceItem.InvoiceID, invoiceItem)
+	}
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrAgreementAmountExceeded):
+			app.agreementAmountExceededResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// Update totals in the invoice
-	err = app.models.Invoices.UpdateTotals(invoiceItem.InvoiceID)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	// The lines of an expanded kit are returned as a list, the totals the client sent
+	// for the kit can't be compared with them.
+	if expanded {
+		env := envelope{"data": lines}
+		if warnings := app.agreementWarnings(r, invoice.AgreementID); len(warnings) > 0 {
+			env["warnings"] = warnings
+		}
+
+		err = app.writeJSON(w, http.StatusCreated, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
+	app.shadowTotals(r, invoice, invoiceItem, data.ClientTotals{Amount: fields.Amount, Discount: fields.Discount, Vat: fields.Vat})
+
 	// When sending a HTTP response, we want to include a Location header to let the
 	// client know which URL they can find the newly-created resource at.
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/invoice_items/%d", invoiceItem.ID))
 
 	responseInvoiceItem := data.InvoiceItem{
-		ID:           invoiceItem.ID,
-		Position:     invoiceItem.Position,
-		Product:      invoiceItem.Product,
-		Description:  invoiceItem.Description,
-		Unit:         invoiceItem.Unit,
-		Quantity:     invoiceItem.Quantity,
-		Price:        invoiceItem.Price,
-		Amount:       invoiceItem.Amount,
-		DiscountRate: invoiceItem.DiscountRate,
-		Discount:     invoiceItem.Discount,
-		VatRate:      invoiceItem.VatRate,
-		CreatedAt:    invoiceItem.CreatedAt,
-		UpdatedAt:    invoiceItem.UpdatedAt,
+		ID:              invoiceItem.ID,
+		Position:        invoiceItem.Position,
+		Product:         invoiceItem.Product,
+		Description:     invoiceItem.Description,
+		Unit:            invoiceItem.Unit,
+		Quantity:        invoiceItem.Quantity,
+		Price:           invoiceItem.Price,
+		Amount:          invoiceItem.Amount,
+		DiscountType:    invoiceItem.DiscountType,
+		DiscountRate:    invoiceItem.DiscountRate,
+		Discount:        invoiceItem.Discount,
+		InvoiceDiscount: invoiceItem.InvoiceDiscount,
+		VatRate:         invoiceItem.VatRate,
+		VatMode:         invoiceItem.VatMode,
+		Vat:             invoiceItem.Vat,
+		CreatedAt:       invoiceItem.CreatedAt,
+		UpdatedAt:       invoiceItem.UpdatedAt,
 	}
 
 	// Write a JSON response with a 201 Created status code, the invoice_item data in the
 	// response body, and the Location header.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"data": responseInvoiceItem}, headers)
+	env := envelope{"data": responseInvoiceItem}
+	if warnings := app.agreementWarnings(r, invoice.AgreementID); len(warnings) > 0 {
+		env["warnings"] = warnings
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -230,7 +302,7 @@ func (app *application) updateInvoiceItemHandler(w http.ResponseWriter, r *http.
 	}
 
 	// Call the Get() method to check if invoice exists.
-	_, err = app.models.Invoices.Get(invoiceID)
+	invoice, err := app.models.Invoices.Get(invoiceID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -254,6 +326,8 @@ func (app *application) updateInvoiceItemHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	invoiceItem.InvoiceID = invoiceID
+
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
 		InvoiceItem *InvoiceItemInput `json:"invoice_item"`
@@ -295,6 +369,10 @@ func (app *application) updateInvoiceItemHandler(w http.ResponseWriter, r *http.
 		invoiceItem.Amount = *fields.Amount
 	}
 
+	if fields.DiscountType != nil {
+		invoiceItem.DiscountType = *fields.DiscountType
+	}
+
 	if fields.DiscountRate != nil {
 		invoiceItem.DiscountRate = *fields.DiscountRate
 	}
@@ -303,7 +381,11 @@ func (app *application) updateInvoiceItemHandler(w http.ResponseWriter, r *http.
 		invoiceItem.Discount = *fields.Discount
 	}
 
+	// A rate which has expired since is kept as long as it isn't changed, so old
+	// invoices stay as they were issued.
+	vatRateChanged := false
 	if fields.VatRateID != nil {
+		vatRateChanged = *fields.VatRateID != invoiceItem.VatRateID
 		invoiceItem.VatRateID = *fields.VatRateID
 	}
 
@@ -311,6 +393,13 @@ func (app *application) updateInvoiceItemHandler(w http.ResponseWriter, r *http.
 		invoiceItem.Vat = *fields.Vat
 	}
 
+	if fields.VatMode != nil {
+		invoiceItem.VatMode = fields.VatMode
+		if *fields.VatMode == "" {
+			invoiceItem.VatMode = nil
+		}
+	}
+
 	// Initialize a new Validator instance.
 	v := validator.New()
 
@@ -321,38 +410,62 @@ func (app *application) updateInvoiceItemHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	if vatRateChanged {
+		err = app.validateVatRateOn(v, "vat_rate_id", invoiceItem.VatRateID, invoice.Date)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
 	// Pass the updated invoice_item record to our new Update() method.
 	err = app.models.InvoiceItems.Update(invoiceItem)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrAgreementAmountExceeded):
+			app.agreementAmountExceededResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// Update totals in the invoice
-	err = app.models.Invoices.UpdateTotals(invoiceID)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+	app.shadowTotals(r, invoice, invoiceItem, data.ClientTotals{Amount: fields.Amount, Discount: fields.Discount, Vat: fields.Vat})
 
 	responseInvoiceItem := data.InvoiceItem{
-		ID:           invoiceItem.ID,
-		Position:     invoiceItem.Position,
-		Product:      invoiceItem.Product,
-		Description:  invoiceItem.Description,
-		Unit:         invoiceItem.Unit,
-		Quantity:     invoiceItem.Quantity,
-		Price:        invoiceItem.Price,
-		Amount:       invoiceItem.Amount,
-		DiscountRate: invoiceItem.DiscountRate,
-		Discount:     invoiceItem.Discount,
-		VatRate:      invoiceItem.VatRate,
-		CreatedAt:    invoiceItem.CreatedAt,
-		UpdatedAt:    invoiceItem.UpdatedAt,
+		ID:              invoiceItem.ID,
+		Position:        invoiceItem.Position,
+		Product:         invoiceItem.Product,
+		Description:     invoiceItem.Description,
+		Unit:            invoiceItem.Unit,
+		Quantity:        invoiceItem.Quantity,
+		Price:           invoiceItem.Price,
+		Amount:          invoiceItem.Amount,
+		DiscountType:    invoiceItem.DiscountType,
+		DiscountRate:    invoiceItem.DiscountRate,
+		Discount:        invoiceItem.Discount,
+		InvoiceDiscount: invoiceItem.InvoiceDiscount,
+		VatRate:         invoiceItem.VatRate,
+		VatMode:         invoiceItem.VatMode,
+		Vat:             invoiceItem.Vat,
+		CreatedAt:       invoiceItem.CreatedAt,
+		UpdatedAt:       invoiceItem.UpdatedAt,
 	}
 
 	// Write the updated invoice_item record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": responseInvoiceItem}, nil)
+	env := envelope{"data": responseInvoiceItem}
+	if warnings := app.agreementWarnings(r, invoice.AgreementID); len(warnings) > 0 {
+		env["warnings"] = warnings
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -376,7 +489,7 @@ func (app *application) deleteInvoiceItemHandler(w http.ResponseWriter, r *http.
 
 	// Delete the invoice_item from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.InvoiceItems.Delete(id)
+	err = app.models.InvoiceItems.Delete(invoiceID, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -387,15 +500,53 @@ func (app *application) deleteInvoiceItemHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	// Update totals in the invoice
-	err = app.models.Invoices.UpdateTotals(invoiceID)
+	// Return a 200 OK status code along with a success message.
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "invoice_item successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listFrequentItemsHandler() returns the products most frequently invoiced to the
+// company with their last price, so the client can suggest lines for a new invoice.
+func (app *application) listFrequentItemsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
 		return
 	}
 
-	// Return a 200 OK status code along with a success message.
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "invoice_item successfully deleted"}, nil)
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	limit, maxLimit := app.readPageLimit(qs, "frequent_items", v)
+	data.ValidateLimit(v, limit, maxLimit)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Companies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	items, err := app.models.InvoiceItems.GetFrequent(id, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": items}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
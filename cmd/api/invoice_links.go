@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/documents"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// Declare a handler which creates a public link to an invoice. The link expires after
+// 30 days unless expires_at is given.
+func (app *application) createInvoiceLinkHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.requireFeature(w, r, data.FeatureInvoiceLinks, invoice.OrganisationID) {
+		return
+	}
+
+	var input struct {
+		Link *struct {
+			ExpiresAt *time.Time `json:"expires_at"`
+		} `json:"link"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	link := &data.InvoiceLink{
+		OrganisationID: invoice.OrganisationID,
+		InvoiceID:      invoice.ID,
+		UserID:         &user.ID,
+		ExpiresAt:      time.Now().Add(data.DefaultLinkExpiry),
+	}
+
+	if input.Link != nil && input.Link.ExpiresAt != nil {
+		link.ExpiresAt = *input.Link.ExpiresAt
+	}
+
+	v := validator.New()
+
+	if data.ValidateInvoiceLink(v, link); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.InvoiceLinks.Insert(link)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	link.URL = app.invoiceLinkURL(link)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": link}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which lists the public links of an invoice, including the expired
+// and revoked ones.
+func (app *application) listInvoiceLinksHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := app.models.InvoiceLinks.GetAll(invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, link := range links {
+		link.URL = app.invoiceLinkURL(link)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": links}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which revokes a public link of an invoice.
+func (app *application) revokeInvoiceLinkHandler(w http.ResponseWriter, r *http.Request) {
+	invoiceID, err := app.readIDParam("invoiceID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	link, err := app.models.InvoiceLinks.Revoke(invoiceID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	link.URL = app.invoiceLinkURL(link)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": link}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showInvoiceLinkHandler() shows the invoice of a public link as the printable
+// HTML page, without a token. The first view of a link is recorded as a view of the
+// portal in the communications of the company.
+func (app *application) showInvoiceLinkHandler(w http.ResponseWriter, r *http.Request) {
+	link, err := app.models.InvoiceLinks.View(chi.URLParam(r, "slug"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLinkExpired):
+			app.errorResponse(w, r, http.StatusGone, "the link has expired, ask the sender for a new one")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The links of organisations whose links are turned off can't be opened, customers
+	// are shown the page of an unknown link.
+	enabled, err := app.models.FeatureFlags.Enabled(data.FeatureInvoiceLinks, link.OrganisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !enabled {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	document, err := app.invoiceDocument(link.InvoiceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if link.Views == 1 {
+		app.recordInvoiceLinkView(r, link)
+	}
+
+	// Render into a buffer first, so a failing template still gets an error response.
+	buf := new(bytes.Buffer)
+
+	err = documents.RenderInvoiceHTML(buf, document)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The page must neither be cached nor indexed, and the slug mustn't leak to the
+	// sites it links to.
+	w.Header().Set("Content-Type", contentTypeHTML+"; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// The recordInvoiceLinkView() method records the view of the invoice of a link in the
+// communications of its company. Failures are only logged, the page is shown anyway.
+func (app *application) recordInvoiceLinkView(r *http.Request, link *data.InvoiceLink) {
+	invoice, err := app.models.Invoices.Get(link.InvoiceID)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	if invoice.CompanyID == 0 {
+		return
+	}
+
+	communication := &data.Communication{
+		OrganisationID: invoice.OrganisationID,
+		CompanyID:      invoice.CompanyID,
+		InvoiceID:      &invoice.ID,
+		Kind:           data.CommunicationInvoice,
+		Channel:        data.ChannelPortal,
+		Subject:        "Invoice " + invoice.Number,
+		Status:         data.CommunicationViewed,
+		Details:        map[string]interface{}{"link_id": link.ID},
+	}
+
+	err = app.models.Communications.Insert(communication)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The invoiceLinkURL() helper returns the URL of a public link, relative to the API
+// unless -public-url is set.
+func (app *application) invoiceLinkURL(link *data.InvoiceLink) string {
+	return app.config.publicURL + "/l/" + link.Slug
+}
@@ -11,14 +11,24 @@ import (
 )
 
 type InvoiceInput struct {
-	IsActive       *bool              `json:"is_active"`
-	Date           *time.Time         `json:"date"`
-	Number         *string            `json:"number"`
-	OrganisationID *int64             `json:"organisation_id"`
-	BankAccountID  *int64             `json:"bank_account_id"`
-	CompanyID      *int64             `json:"company_id"`
-	AgreementID    *int64             `json:"agreement_id"`
-	InvoiceItems   []data.InvoiceItem `json:"invoice_items,omitempty"`
+	IsActive       *bool      `json:"is_active"`
+	IsAdvance      *bool      `json:"is_advance"`
+	Date           *time.Time `json:"date"`
+	DueDate        *time.Time `json:"due_date"`
+	Number         *string    `json:"number"`
+	OrganisationID *int64     `json:"organisation_id"`
+	BankAccountID  *int64     `json:"bank_account_id"`
+	CompanyID      *int64     `json:"company_id"`
+	AgreementID    *int64     `json:"agreement_id"`
+	// Zero removes the signer, which otherwise defaults to the current signer of the company.
+	SignerContactID *int64             `json:"signer_contact_id"`
+	DiscountType    *string            `json:"discount_type"`
+	DiscountValue   *data.Money        `json:"discount_value"`
+	VatMode         *string            `json:"vat_mode"`
+	InvoiceItems    []data.InvoiceItem `json:"invoice_items,omitempty"`
+	// Zero issues the invoice to the company itself, which otherwise goes to the
+	// default branch of the company if it has one.
+	BranchID *int64 `json:"branch_id"`
 }
 
 // Declare a handler which writes a plain-text response with information about the
@@ -40,11 +50,23 @@ func (app *application) listInvoicesHandler(w http.ResponseWriter, r *http.Reque
 	input.InvoiceFilters.OrganisationID = app.readInt64(qs, "organisation_id", 0, v)
 	input.InvoiceFilters.CompanyID = app.readInt64(qs, "company_id", 0, v)
 	input.InvoiceFilters.AgreementID = app.readInt64(qs, "agreement_id", 0, v)
-	input.InvoiceFilters.Start = app.readDate(qs, "start", nil, v)
-	input.InvoiceFilters.End = app.readDate(qs, "end", nil, v)
+	input.InvoiceFilters.GroupID = app.readInt64(qs, "group_id", 0, v)
+	input.InvoiceFilters.BankAccountID = app.readInt64(qs, "bank_account_id", 0, v)
+	input.InvoiceFilters.Status = app.readString(qs, "status", "")
+	input.InvoiceFilters.MinAmount = app.readMoney(qs, "min_amount", v)
+	input.InvoiceFilters.MaxAmount = app.readMoney(qs, "max_amount", v)
+	input.InvoiceFilters.NumberPrefix = app.readString(qs, "number", "")
+	input.InvoiceFilters.ExternalRef = app.readString(qs, "external_ref", "")
+	input.InvoiceFilters.IncludeDeleted = app.readString(qs, "include_deleted", "false") == "true"
+
+	// A token bound to an organisation only sees the invoices of that organisation.
+	if organisationID := app.contextGetOrganisationID(r); organisationID != 0 {
+		input.InvoiceFilters.OrganisationID = organisationID
+	}
+	input.InvoiceFilters.Start, input.InvoiceFilters.End = app.readDateRange(qs, nil, nil, v)
 	// Read the page and limit query string values into the embedded struct.
 	input.Pagination.Page = app.readInt(qs, "page", 1, v)
-	input.Pagination.Limit = app.readInt(qs, "limit", 20, v)
+	input.Pagination.Limit, input.Pagination.MaxLimit = app.readPageLimit(qs, "invoices", v)
 
 	// Read the sort query string value into the embedded struct.
 	input.Pagination.Sort = app.readString(qs, "sort", "id")
@@ -55,6 +77,8 @@ func (app *application) listInvoicesHandler(w http.ResponseWriter, r *http.Reque
 	input.Pagination.Direction = app.readString(qs, "direction", "asc")
 	input.Pagination.DirectionSafelist = []string{"asc", "desc"}
 
+	data.ValidateInvoiceFilters(v, input.InvoiceFilters)
+
 	// Execute the validation checks on the Pagination struct and send a response
 	// containing the errors if necessary.
 	if data.ValidatePagination(v, input.Pagination); !v.Valid() {
@@ -71,10 +95,7 @@ func (app *application) listInvoicesHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Send a JSON response containing the invoice data.
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": invoices, "meta": metadata}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	app.streamJSON(w, r, http.StatusOK, envelope{"data": invoices, "meta": metadata}, app.paginationHeaders(r, metadata))
 }
 
 func (app *application) showInvoiceHandler(w http.ResponseWriter, r *http.Request) {
@@ -129,21 +150,120 @@ func (app *application) createInvoiceHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if input.Invoice == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain an invoice object"))
+		return
+	}
+
 	var fields = input.Invoice
 
 	invoice := &data.Invoice{
-		IsActive:       *fields.IsActive,
-		Date:           *fields.Date,
-		Number:         *fields.Number,
-		OrganisationID: *fields.OrganisationID,
-		BankAccountID:  *fields.BankAccountID,
-		CompanyID:      *fields.CompanyID,
-		AgreementID:    *fields.AgreementID,
+		Date:    time.Now(),
+		DueDate: fields.DueDate,
+		VatMode: data.VatOnTop,
+	}
+
+	if fields.IsActive != nil {
+		invoice.IsActive = *fields.IsActive
+	}
+
+	if fields.IsAdvance != nil {
+		invoice.IsAdvance = *fields.IsAdvance
+	}
+
+	if fields.Date != nil {
+		invoice.Date = *fields.Date
+	}
+
+	if fields.Number != nil {
+		invoice.Number = *fields.Number
+	}
+
+	if fields.OrganisationID != nil {
+		invoice.OrganisationID = *fields.OrganisationID
+	} else {
+		invoice.OrganisationID = app.contextGetOrganisationID(r)
+	}
+
+	if fields.BankAccountID != nil {
+		invoice.BankAccountID = *fields.BankAccountID
+	}
+
+	if fields.CompanyID != nil {
+		invoice.CompanyID = *fields.CompanyID
+	}
+
+	if fields.AgreementID != nil {
+		invoice.AgreementID = *fields.AgreementID
+	}
+
+	// An empty discount type removes the invoice discount.
+	if fields.DiscountType != nil {
+		invoice.DiscountType = *fields.DiscountType
+	}
+
+	if fields.DiscountValue != nil {
+		invoice.DiscountValue = *fields.DiscountValue
+	}
+
+	if fields.VatMode != nil {
+		invoice.VatMode = *fields.VatMode
 	}
 
 	// Initialize a new Validator instance.
 	v := validator.New()
 
+	// Fill the fields the client didn't send from the company defaults.
+	var defaults *data.CompanyDefaults
+	if invoice.CompanyID != 0 {
+		company, err := app.models.Companies.Get(invoice.CompanyID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("company_id", "company not found")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		defaults = company.Defaults
+	}
+
+	if defaults != nil {
+		if invoice.OrganisationID == 0 {
+			invoice.OrganisationID = defaults.OrganisationID
+		}
+
+		if invoice.BankAccountID == 0 {
+			invoice.BankAccountID = defaults.BankAccountID
+		}
+
+		if invoice.AgreementID == 0 {
+			invoice.AgreementID = defaults.AgreementID
+		}
+
+		if invoice.DueDate == nil && defaults.PaymentTermDays > 0 {
+			dueDate := invoice.Date.AddDate(0, 0, defaults.PaymentTermDays)
+			invoice.DueDate = &dueDate
+		}
+	}
+
+	v.Check(app.organisationAllowed(r, invoice.OrganisationID), "organisation_id", "must be the current organisation")
+
+	err = app.resolveSigner(v, invoice, fields.SignerContactID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.resolveBranch(v, invoice, fields.BranchID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// Call the validate function and return a response containing the errors if
 	// any of the checks fail.
 	if data.ValidateInvoice(v, invoice); !v.Valid() {
@@ -151,17 +271,45 @@ func (app *application) createInvoiceHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Call the Insert() method on our model, passing in a pointer to the
-	// validated struct.
-	err = app.models.Invoices.Insert(invoice)
+	if !app.requireOpenPeriod(w, r, invoice.OrganisationID, invoice.Date) {
+		return
+	}
+
+	// The company default may be a rate which has been replaced since, so the rate of
+	// its chain which is valid on the invoice date is used instead.
+	var defaultVatRateID int64
+	if defaults != nil && defaults.VatRateID != 0 {
+		vatRate, err := app.models.VatRates.ResolveOn(defaults.VatRateID, invoice.Date)
+		switch {
+		case err == nil:
+			defaultVatRateID = vatRate.ID
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrVatRateNotValid):
+			// Items without a rate are reported below.
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	productIDs := []int64{}
+	for _, item := range fields.InvoiceItems {
+		if !item.KeepKit {
+			productIDs = append(productIDs, item.ProductID)
+		}
+	}
+
+	kits, err := app.models.KitComponents.GetForKits(productIDs)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Call the Insert() method on our invoice_items
-	invoiceItems := invoice.InvoiceItems
-	for _, item := range fields.InvoiceItems {
+	// Validate all items before anything is written. Kits are replaced with the lines of
+	// their components, errors still refer to the items as sent.
+	items := []*data.InvoiceItem{}
+	clientTotals := []data.ClientTotals{}
+	expanded := false
+	for i, item := range fields.InvoiceItems {
 
 		invoiceItem := &data.InvoiceItem{
 			ID:           item.ID,
@@ -172,37 +320,101 @@ func (app *application) createInvoiceHandler(w http.ResponseWriter, r *http.Requ
 			Quantity:     item.Quantity,
 			Price:        item.Price,
 			Amount:       item.Amount,
+			DiscountType: item.DiscountType,
 			DiscountRate: item.DiscountRate,
 			Discount:     item.Discount,
 			VatRateID:    item.VatRateID,
+			VatMode:      item.VatMode,
 		}
 
-		if data.ValidateInvoiceItem(v, invoiceItem); !v.Valid() {
-			app.failedValidationResponse(w, r, v.Errors)
-			return
+		if invoiceItem.DiscountType == "" {
+			invoiceItem.DiscountType = data.DiscountPercent
 		}
 
-		err = app.models.InvoiceItems.Insert(invoice.ID, invoiceItem)
-		if err != nil {
+		if invoiceItem.VatRateID == 0 {
+			invoiceItem.VatRateID = defaultVatRateID
+		}
+
+		lines := app.expandKit(v, fmt.Sprintf("invoice_items.%d.discount", i), invoiceItem, kits)
+
+		key := fmt.Sprintf("invoice_items.%d.vat_rate_id", i)
+		for _, line := range lines {
+			if line.VatRateID == 0 && defaults != nil && defaults.VatRateID != 0 {
+				v.AddError(key, fmt.Sprintf("the default vat rate is not valid on %s", invoice.Date.Format(dateOnlyLayout)))
+			} else if line.VatRateID != 0 {
+				err = app.validateVatRateOn(v, key, line.VatRateID, invoice.Date)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+			}
+
+			if data.ValidateInvoiceItem(v, line); !v.Valid() {
+				app.failedValidationResponse(w, r, v.Errors)
+				return
+			}
+		}
+
+		items = append(items, lines...)
+
+		// The totals the client sent for a kit can't be compared with its components.
+		if lines[0] != invoiceItem {
+			expanded = true
+			clientTotals = append(clientTotals, make([]data.ClientTotals, len(lines))...)
+			continue
+		}
+
+		// Items without any totals of the client are left out of the comparison.
+		var client data.ClientTotals
+		if amount, discount, vat := item.Amount, item.Discount, item.Vat; amount != 0 || discount != 0 || vat != 0 {
+			client = data.ClientTotals{Amount: &amount, Discount: &discount, Vat: &vat}
+		}
+		clientTotals = append(clientTotals, client)
+	}
+
+	// The components of kits would share positions with the following items.
+	if expanded {
+		for i, item := range items {
+			item.Position = i + 1
+		}
+	}
+
+	// Insert the invoice with its items and calculate the totals in one transaction.
+	err = app.models.Invoices.InsertWithItems(invoice, items)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAgreementAmountExceeded):
+			app.agreementAmountExceededResponse(w, r)
+		default:
 			app.serverErrorResponse(w, r, err)
-			return
 		}
+		return
+	}
+
+	for i, invoiceItem := range items {
+		app.shadowTotals(r, invoice, invoiceItem, clientTotals[i])
+	}
 
+	invoiceItems := []*data.InvoiceItem{}
+	for _, invoiceItem := range items {
 		responseInvoiceItem := &data.InvoiceItem{
-			ID:           invoiceItem.ID,
-			Position:     invoiceItem.Position,
-			Product:      invoiceItem.Product,
-			Description:  invoiceItem.Description,
-			Unit:         invoiceItem.Unit,
-			Quantity:     invoiceItem.Quantity,
-			Price:        invoiceItem.Price,
-			Amount:       invoiceItem.Amount,
-			DiscountRate: invoiceItem.DiscountRate,
-			Discount:     invoiceItem.Discount,
-			Vat:          invoiceItem.Vat,
-			VatRate:      invoiceItem.VatRate,
-			CreatedAt:    invoiceItem.CreatedAt,
-			UpdatedAt:    invoiceItem.UpdatedAt,
+			ID:              invoiceItem.ID,
+			Position:        invoiceItem.Position,
+			Product:         invoiceItem.Product,
+			Description:     invoiceItem.Description,
+			Unit:            invoiceItem.Unit,
+			Quantity:        invoiceItem.Quantity,
+			Price:           invoiceItem.Price,
+			Amount:          invoiceItem.Amount,
+			DiscountType:    invoiceItem.DiscountType,
+			DiscountRate:    invoiceItem.DiscountRate,
+			Discount:        invoiceItem.Discount,
+			InvoiceDiscount: invoiceItem.InvoiceDiscount,
+			Vat:             invoiceItem.Vat,
+			VatRate:         invoiceItem.VatRate,
+			VatMode:         invoiceItem.VatMode,
+			CreatedAt:       invoiceItem.CreatedAt,
+			UpdatedAt:       invoiceItem.UpdatedAt,
 		}
 
 		invoiceItems = append(invoiceItems, responseInvoiceItem)
@@ -216,22 +428,40 @@ func (app *application) createInvoiceHandler(w http.ResponseWriter, r *http.Requ
 	// responseInvoiceItems := invoice.InvoiceItems
 
 	responseInvoice := data.Invoice{
-		ID:           invoice.ID,
-		IsActive:     invoice.IsActive,
-		Date:         invoice.Date,
-		Number:       invoice.Number,
-		Organisation: invoice.Organisation,
-		BankAccount:  invoice.BankAccount,
-		Company:      invoice.Company,
-		Agreement:    invoice.Agreement,
-		CreatedAt:    invoice.CreatedAt,
-		UpdatedAt:    invoice.UpdatedAt,
-		InvoiceItems: invoiceItems,
+		ID:              invoice.ID,
+		IsActive:        invoice.IsActive,
+		IsAdvance:       invoice.IsAdvance,
+		Date:            invoice.Date,
+		DueDate:         invoice.DueDate,
+		Number:          invoice.Number,
+		Amount:          invoice.Amount,
+		Discount:        invoice.Discount,
+		DiscountType:    invoice.DiscountType,
+		DiscountValue:   invoice.DiscountValue,
+		VatMode:         invoice.VatMode,
+		Vat:             invoice.Vat,
+		Organisation:    invoice.Organisation,
+		BankAccount:     invoice.BankAccount,
+		Company:         invoice.Company,
+		Agreement:       invoice.Agreement,
+		SignerContactID: invoice.SignerContactID,
+		BranchID:        invoice.BranchID,
+		Status:          invoice.Status,
+		Paid:            invoice.Paid,
+		Outstanding:     invoice.Amount + invoice.Vat - invoice.Paid,
+		CreatedAt:       invoice.CreatedAt,
+		UpdatedAt:       invoice.UpdatedAt,
+		InvoiceItems:    invoiceItems,
 	}
 
 	// Write a JSON response with a 201 Created status code, the movie data in the
 	// response body, and the Location header.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"data": responseInvoice}, headers)
+	env := envelope{"data": responseInvoice}
+	if warnings := app.agreementWarnings(r, invoice.AgreementID); len(warnings) > 0 {
+		env["warnings"] = warnings
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -276,10 +506,18 @@ func (app *application) updateInvoiceHandler(w http.ResponseWriter, r *http.Requ
 		invoice.IsActive = *fields.IsActive
 	}
 
+	if fields.IsAdvance != nil {
+		invoice.IsAdvance = *fields.IsAdvance
+	}
+
 	if fields.Date != nil {
 		invoice.Date = *fields.Date
 	}
 
+	if fields.DueDate != nil {
+		invoice.DueDate = fields.DueDate
+	}
+
 	if fields.Number != nil {
 		invoice.Number = *fields.Number
 	}
@@ -300,37 +538,98 @@ func (app *application) updateInvoiceHandler(w http.ResponseWriter, r *http.Requ
 		invoice.AgreementID = *fields.AgreementID
 	}
 
+	// An empty discount type removes the invoice discount.
+	if fields.DiscountType != nil {
+		invoice.DiscountType = *fields.DiscountType
+	}
+
+	if fields.DiscountValue != nil {
+		invoice.DiscountValue = *fields.DiscountValue
+	}
+
+	if fields.VatMode != nil {
+		invoice.VatMode = *fields.VatMode
+	}
+
 	// Validate the updated invoice record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
 	v := validator.New()
 
+	v.Check(app.organisationAllowed(r, invoice.OrganisationID), "organisation_id", "must be the current organisation")
+
+	// The signer and the branch of the previous company don't belong to the new one.
+	if fields.SignerContactID != nil || fields.CompanyID != nil {
+		err = app.resolveSigner(v, invoice, fields.SignerContactID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if fields.BranchID != nil || fields.CompanyID != nil {
+		err = app.resolveBranch(v, invoice, fields.BranchID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	if data.ValidateInvoice(v, invoice); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// The current date was checked by requireInvoiceAccess(), an invoice can't be moved
+	// into a closed period either.
+	if !app.requireOpenPeriod(w, r, invoice.OrganisationID, invoice.Date) {
+		return
+	}
+
 	// Pass the updated invoice record to our new Update() method.
 	err = app.models.Invoices.Update(invoice)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrAgreementAmountExceeded):
+			app.agreementAmountExceededResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
 	responseInvoice := data.Invoice{
-		ID:           invoice.ID,
-		IsActive:     invoice.IsActive,
-		Date:         invoice.Date,
-		Number:       invoice.Number,
-		Organisation: invoice.Organisation,
-		BankAccount:  invoice.BankAccount,
-		Company:      invoice.Company,
-		Agreement:    invoice.Agreement,
-		CreatedAt:    invoice.CreatedAt,
-		UpdatedAt:    invoice.UpdatedAt,
+		ID:              invoice.ID,
+		IsActive:        invoice.IsActive,
+		IsAdvance:       invoice.IsAdvance,
+		Date:            invoice.Date,
+		DueDate:         invoice.DueDate,
+		Number:          invoice.Number,
+		Amount:          invoice.Amount,
+		Discount:        invoice.Discount,
+		DiscountType:    invoice.DiscountType,
+		DiscountValue:   invoice.DiscountValue,
+		VatMode:         invoice.VatMode,
+		Vat:             invoice.Vat,
+		Organisation:    invoice.Organisation,
+		BankAccount:     invoice.BankAccount,
+		Company:         invoice.Company,
+		Agreement:       invoice.Agreement,
+		SignerContactID: invoice.SignerContactID,
+		BranchID:        invoice.BranchID,
+		Status:          invoice.Status,
+		Paid:            invoice.Paid,
+		Outstanding:     invoice.Amount + invoice.Vat - invoice.Paid,
+		CreatedAt:       invoice.CreatedAt,
+		UpdatedAt:       invoice.UpdatedAt,
 	}
 
 	// Write the updated invoice record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": responseInvoice}, nil)
+	env := envelope{"data": responseInvoice}
+	if warnings := app.agreementWarnings(r, invoice.AgreementID); len(warnings) > 0 {
+		env["warnings"] = warnings
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -346,12 +645,17 @@ func (app *application) deleteInvoiceHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Delete the invoice from the database, sending a 404 Not Found response to the
-	// client if there isn't a matching record.
+	// client if there isn't a matching record and a 409 Conflict if it has been paid or
+	// shipped.
 	err = app.models.Invoices.Delete(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrInvoiceHasPayments):
+			app.invoiceHasPaymentsResponse(w, r)
+		case errors.Is(err, data.ErrInvoiceShipped):
+			app.shippedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -364,3 +668,549 @@ func (app *application) deleteInvoiceHandler(w http.ResponseWriter, r *http.Requ
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The restoreInvoiceHandler() brings back a deleted invoice. The rules of deleting it
+// apply: the invoice must be accessible to the token and not dated within a closed
+// period. Archived invoices can't be restored.
+func (app *application) restoreInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("invoiceID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	invoice, err := app.models.Invoices.GetDeleted(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.organisationAllowed(r, invoice.OrganisationID) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if invoice.Archived {
+		app.archivedResponse(w, r)
+		return
+	}
+
+	if !app.requireOpenPeriod(w, r, invoice.OrganisationID, invoice.Date) {
+		return
+	}
+
+	err = app.models.Invoices.Restore(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	invoice, err = app.models.Invoices.Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": invoice}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The writeOffInvoiceHandler() marks an invoice as bad debt. The invoice stays in the
+// database for history, but is excluded from receivables reports. The action requires
+// the "invoices:write_off" permission and is recorded in the audit log.
+func (app *application) writeOffInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("invoiceID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	invoice, err := app.models.Invoices.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Reason != "", "reason", "must be provided")
+	v.Check(len(input.Reason) <= 1024, "reason", "must not be more than 1024 bytes long")
+	v.Check(invoice.WrittenOffAt == nil, "invoice", "is already written off")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Invoices.WriteOff(invoice, input.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The invoice has been written off at this point, so a failure to record the
+	// event is logged rather than reported to the client.
+	user := app.contextGetUser(r)
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "write_off",
+		Entity:   "invoice",
+		EntityID: invoice.ID,
+		Details: map[string]interface{}{
+			"number": invoice.Number,
+			"amount": invoice.Amount,
+			"reason": input.Reason,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": invoice}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare handlers which move an invoice along its workflow: send marks a draft as sent
+// to the company, e.g. by post, pay marks it as paid once the payments allocated to it
+// cover its amount and cancel cancels a draft or a sent invoice without payments.
+func (app *application) sendInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	app.transitionInvoice(w, r, data.InvoiceStatusSent)
+}
+
+func (app *application) payInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	app.transitionInvoice(w, r, data.InvoiceStatusPaid)
+}
+
+func (app *application) cancelInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	app.transitionInvoice(w, r, data.InvoiceStatusCancelled)
+}
+
+// The transitionInvoice() helper moves the invoice of the request to the workflow
+// status and records the change in the audit log.
+func (app *application) transitionInvoice(w http.ResponseWriter, r *http.Request, status string) {
+	invoice := app.contextGetInvoice(r)
+	previous := invoice.Status
+
+	err := app.models.Invoices.Transition(invoice, status)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrInvalidTransition):
+			app.invalidTransitionResponse(w, r, previous, status)
+		case errors.Is(err, data.ErrInvoiceNotPaid):
+			app.failedValidationResponse(w, r, map[string]string{"status": "the payments allocated to the invoice don't cover its total"})
+		case errors.Is(err, data.ErrInvoiceHasPayments):
+			app.errorResponse(w, r, http.StatusConflict, "the invoice has payments or returns allocated and can't be cancelled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The status has been changed at this point, so a failure to record the event is
+	// logged rather than reported to the client.
+	user := app.contextGetUser(r)
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "status",
+		Entity:   "invoice",
+		EntityID: invoice.ID,
+		Details: map[string]interface{}{
+			"number": invoice.Number,
+			"from":   previous,
+			"to":     invoice.Status,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": invoice}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The shipInvoiceHandler() ships the goods of the invoice from a warehouse of its
+// organisation, the default one unless warehouse_id is given, at the date or now. A
+// draft or sent invoice moves to shipped, a paid one stays paid. Services aren't
+// stocked, so an invoice without goods is only marked as shipped.
+func (app *application) shipInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.contextGetInvoice(r)
+	previous := invoice.Status
+
+	var input struct {
+		WarehouseID *int64     `json:"warehouse_id"`
+		Date        *time.Time `json:"date"`
+	}
+
+	// The body is optional, the default warehouse ships now without one.
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	date := time.Now()
+	if input.Date != nil {
+		date = *input.Date
+	}
+
+	v := validator.New()
+
+	var warehouse *data.Warehouse
+	var err error
+
+	if input.WarehouseID != nil {
+		warehouse, err = app.models.Warehouses.Get(*input.WarehouseID)
+	} else {
+		warehouse, err = app.models.Warehouses.GetDefault(invoice.OrganisationID)
+	}
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		v.AddError("warehouse_id", "must be a warehouse of the organisation of the invoice")
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	case warehouse.OrganisationID != invoice.OrganisationID:
+		v.AddError("warehouse_id", "must be a warehouse of the organisation of the invoice")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.requireOpenPeriod(w, r, invoice.OrganisationID, date) {
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	shipments, err := app.models.Invoices.Ship(invoice, warehouse.ID, date, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrInvoiceShipped):
+			app.errorResponse(w, r, http.StatusConflict, "the invoice has been shipped already")
+		case errors.Is(err, data.ErrInvalidTransition):
+			app.invalidTransitionResponse(w, r, previous, data.InvoiceStatusShipped)
+		case errors.Is(err, data.ErrInsufficientStock):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The goods have been shipped at this point, so a failure to record the event is
+	// logged rather than reported to the client.
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "ship",
+		Entity:   "invoice",
+		EntityID: invoice.ID,
+		Details: map[string]interface{}{
+			"number":       invoice.Number,
+			"from":         previous,
+			"to":           invoice.Status,
+			"warehouse_id": warehouse.ID,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": invoice, "shipments": shipments}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resolveSigner sets the contact who signs the invoice for the company. The chosen
+// contact must be a signer of the invoice company, zero removes the signer and
+// without a choice the signer valid on the invoice date is used.
+func (app *application) resolveSigner(v *validator.Validator, invoice *data.Invoice, chosen *int64) error {
+	invoice.SignerContactID = nil
+
+	if chosen != nil {
+		if *chosen == 0 {
+			return nil
+		}
+
+		contact, err := app.models.Contacts.Get(invoice.CompanyID, *chosen)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("signer_contact_id", "contact not found")
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if !contact.HasRole(data.ContactRoleSigner) {
+			v.AddError("signer_contact_id", "must be a signer of the company")
+			return nil
+		}
+
+		invoice.SignerContactID = &contact.ID
+		return nil
+	}
+
+	if invoice.CompanyID == 0 {
+		return nil
+	}
+
+	contact, err := app.models.Contacts.Signer(invoice.CompanyID, invoice.Date)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	invoice.SignerContactID = &contact.ID
+	return nil
+}
+
+// resolveBranch sets the branch of the company the invoice is issued to. The chosen
+// branch must be one of the invoice company, zero issues the invoice to the company
+// itself and without a choice the default branch of the company is used.
+func (app *application) resolveBranch(v *validator.Validator, invoice *data.Invoice, chosen *int64) error {
+	invoice.BranchID = nil
+
+	if chosen != nil && *chosen == 0 || invoice.CompanyID == 0 {
+		return nil
+	}
+
+	var branch *data.CompanyBranch
+	var err error
+
+	if chosen != nil {
+		branch, err = app.models.CompanyBranches.Get(invoice.CompanyID, *chosen)
+	} else {
+		branch, err = app.models.CompanyBranches.Default(invoice.CompanyID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && chosen != nil:
+			v.AddError("branch_id", "must be a branch of the company")
+			return nil
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	invoice.BranchID = &branch.ID
+	return nil
+}
+
+// InvoicePrefill is a new invoice as the company would likely get it, in the shape of
+// the body of POST /v1/invoices. NumberPreview is only how the next number looks, the
+// number is taken when the invoice is created.
+type InvoicePrefill struct {
+	Date            time.Time           `json:"date"`
+	DueDate         *time.Time          `json:"due_date,omitempty"`
+	NumberPreview   string              `json:"number_preview"`
+	OrganisationID  int64               `json:"organisation_id,omitempty"`
+	BankAccountID   int64               `json:"bank_account_id,omitempty"`
+	CompanyID       int64               `json:"company_id"`
+	AgreementID     int64               `json:"agreement_id,omitempty"`
+	SignerContactID *int64              `json:"signer_contact_id,omitempty"`
+	BranchID        *int64              `json:"branch_id,omitempty"`
+	VatMode         string              `json:"vat_mode"`
+	InvoiceItems    []*data.InvoiceItem `json:"invoice_items"`
+}
+
+// The prefillInvoiceHandler() returns a draft of a new invoice to ?company_id= to edit
+// and create: dated today, with the defaults of the company, the default bank account
+// of the organisation if the company has none, the current signer, the default branch
+// and the lines of the latest invoice of the company. The organisation is that of the
+// token, of the company defaults or ?organisation_id=.
+func (app *application) prefillInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	companyID := app.readInt64(qs, "company_id", 0, v)
+	organisationID := app.readInt64(qs, "organisation_id", app.contextGetOrganisationID(r), v)
+
+	v.Check(companyID > 0, "company_id", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	company, err := app.models.Companies.Get(companyID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.failedValidationResponse(w, r, map[string]string{"company_id": "company not found"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	today := time.Now().Truncate(24 * time.Hour)
+
+	prefill := &InvoicePrefill{
+		Date:         today,
+		CompanyID:    company.ID,
+		VatMode:      data.VatOnTop,
+		InvoiceItems: []*data.InvoiceItem{},
+	}
+
+	defaults := company.Defaults
+	if defaults == nil {
+		defaults = &data.CompanyDefaults{}
+	}
+
+	if organisationID == 0 {
+		organisationID = defaults.OrganisationID
+	}
+
+	v.Check(app.organisationAllowed(r, organisationID), "organisation_id", "must be the current organisation")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	prefill.OrganisationID = organisationID
+	prefill.AgreementID = defaults.AgreementID
+
+	if defaults.PaymentTermDays > 0 {
+		dueDate := today.AddDate(0, 0, defaults.PaymentTermDays)
+		prefill.DueDate = &dueDate
+	}
+
+	// The bank account of the company defaults only applies to invoices of the
+	// organisation of the defaults.
+	if defaults.BankAccountID != 0 && defaults.OrganisationID == organisationID {
+		prefill.BankAccountID = defaults.BankAccountID
+	}
+
+	if organisationID != 0 {
+		if prefill.BankAccountID == 0 {
+			bankAccounts, err := app.models.BankAccounts.GetAll(organisationID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			for _, bankAccount := range bankAccounts {
+				if bankAccount.IsDefault {
+					prefill.BankAccountID = bankAccount.ID
+					break
+				}
+			}
+		}
+
+		sequence, err := app.models.DocumentSequences.Get(organisationID, data.DocumentInvoice)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		prefill.NumberPreview = sequence.Preview
+	}
+
+	invoice := &data.Invoice{CompanyID: company.ID, Date: today}
+
+	err = app.resolveSigner(v, invoice, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	prefill.SignerContactID = invoice.SignerContactID
+
+	err = app.resolveBranch(v, invoice, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	prefill.BranchID = invoice.BranchID
+
+	items, err := app.models.InvoiceItems.GetLastUsed(company.ID, organisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Rates which have been replaced since are replaced by the rate of their chain valid
+	// today, the company default is used for lines without a valid one.
+	for i, item := range items {
+		item.Position = i + 1
+
+		if item.VatRateID == 0 {
+			item.VatRateID = defaults.VatRateID
+		}
+
+		if item.VatRateID != 0 {
+			vatRate, err := app.models.VatRates.ResolveOn(item.VatRateID, today)
+			switch {
+			case err == nil:
+				item.VatRateID = vatRate.ID
+			case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrVatRateNotValid):
+				item.VatRateID = 0
+			default:
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+	prefill.InvoiceItems = items
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": prefill}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+type KitComponentInput struct {
+	ProductID int64   `json:"product_id"`
+	Quantity  float64 `json:"quantity"`
+}
+
+// Declare a handler which returns the components of a kit.
+func (app *application) listKitComponentsHandler(w http.ResponseWriter, r *http.Request) {
+	kit, ok := app.readKit(w, r)
+	if !ok {
+		return
+	}
+
+	components, err := app.models.KitComponents.GetAll(kit.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": components}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which replaces the components of a kit with the given list, in its
+// order. Components must be existing products which aren't kits themselves.
+func (app *application) replaceKitComponentsHandler(w http.ResponseWriter, r *http.Request) {
+	kit, ok := app.readKit(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Components []KitComponentInput `json:"components"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	components := make([]*data.KitComponent, 0, len(input.Components))
+	for _, component := range input.Components {
+		components = append(components, &data.KitComponent{ProductID: component.ProductID, Quantity: component.Quantity})
+	}
+
+	v := validator.New()
+
+	if data.ValidateKitComponents(v, kit.ID, components); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	for _, component := range components {
+		product, err := app.models.Products.Get(component.ProductID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("components", "product not found")
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		default:
+			v.Check(product.ProductType != data.ProductTypeKit, "components", "must not contain kits")
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.KitComponents.Replace(kit.ID, components)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	components, err = app.models.KitComponents.GetAll(kit.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": components}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readKit() helper reads the product of the productID URL parameter and sends the
+// error response itself if it doesn't exist or isn't a kit.
+func (app *application) readKit(w http.ResponseWriter, r *http.Request) (*data.Product, bool) {
+	id, err := app.readIDParam("productID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	product, err := app.models.Products.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if product.ProductType != data.ProductTypeKit {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "the product is not a kit")
+		return nil, false
+	}
+
+	return product, true
+}
+
+// The expandKit() helper returns the lines an invoice line of a kit is replaced with,
+// or the line itself if its product isn't a kit or has no components. An absolute
+// discount can't be split between the components, so it is reported under key.
+func (app *application) expandKit(v *validator.Validator, key string, item *data.InvoiceItem, kits map[int64][]*data.KitComponent) []*data.InvoiceItem {
+	components, ok := kits[item.ProductID]
+	if !ok || len(components) == 0 {
+		return []*data.InvoiceItem{item}
+	}
+
+	v.Check(item.DiscountType != data.DiscountAbsolute || item.Discount == 0, key, "an absolute discount of a kit must be kept with keep_kit or given as a percent")
+
+	return data.ExpandKit(item, components)
+}
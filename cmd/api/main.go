@@ -6,11 +6,18 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/data"
-	"github.com/jackc/pgx/v4/log/zerologadapter"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/ElOtro/stockup-api/internal/documents"
+	"github.com/ElOtro/stockup-api/internal/encryption"
+	"github.com/ElOtro/stockup-api/internal/mailer"
+	"github.com/ElOtro/stockup-api/internal/sandbox"
+	"github.com/ElOtro/stockup-api/internal/scanner"
+	"github.com/ElOtro/stockup-api/internal/storage"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/tracelog"
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -21,14 +28,94 @@ import (
 
 // Define a config struct to hold all the configuration settings for our application.
 type config struct {
-	port int
-	env  string
-	seed bool
-	db   struct {
+	port       int
+	env        string
+	seed       bool
+	rotateKeys bool
+	db         struct {
 		dsn string
 	}
+	seeding struct {
+		profile    string
+		scale      float64
+		randomSeed int64
+		reset      bool
+		users      []data.SeedUser
+	}
 	jwt struct {
-		secret string
+		secret    string
+		leeway    time.Duration
+		userCache time.Duration
+	}
+	password struct {
+		minLength  int
+		minClasses int
+	}
+	encryption struct {
+		keys  string
+		keyID string
+	}
+	archive struct {
+		years    int
+		interval time.Duration
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+	statements struct {
+		enabled  bool
+		day      int
+		interval time.Duration
+	}
+	paymentStats struct {
+		interval time.Duration
+	}
+	invoiceSending struct {
+		interval time.Duration
+	}
+	backups struct {
+		dir      string
+		command  string
+		interval time.Duration
+		keep     int
+		maxAge   time.Duration
+	}
+	accounting struct {
+		exportDir    string
+		syncInterval time.Duration
+	}
+	reminders struct {
+		interval time.Duration
+	}
+	billingPlans struct {
+		interval time.Duration
+	}
+	totals struct {
+		shadow bool
+	}
+	storage struct {
+		dir string
+	}
+	scanner struct {
+		clamd   string
+		timeout time.Duration
+	}
+	pdf struct {
+		font     string
+		boldFont string
+	}
+	documents struct {
+		retentionYears int
+	}
+	publicURL     string
+	pageLimits    map[string]data.PageLimits
+	routeTimeouts map[string]time.Duration
+	cors          struct {
+		trustedOrigins []string
 	}
 }
 
@@ -36,20 +123,28 @@ type config struct {
 // and middleware. At the moment this only contains a copy of the config struct and a
 // logger, but it will grow to include a lot more as our build progresses.
 type application struct {
-	config config
-	logger *zerolog.Logger
-	models data.Models
-	seed   data.Seed
+	config  config
+	logger  *zerolog.Logger
+	models  data.Models
+	seed    data.Seed
+	cache   *cacheVersions
+	changes *changeBroker
+	mailer  mailer.Sender
+	storage storage.Storage
+	scanner scanner.Scanner
+	users   *userCache
+	// pdfFonts are the fonts invoices are printed with as PDF, nil if PDF printing
+	// isn't enabled.
+	pdfFonts *documents.PDFFonts
+	// sandbox records what the fakes of the external services have sent, nil outside
+	// the sandbox.
+	sandbox *sandbox.Recorder
 }
 
 func main() {
 	// Declare an instance of the config struct.
 	var cfg config
 
-	// Initialize a new logger which writes messages to the standard out stream,
-	// prefixed with the current date and time.
-	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
-
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error loading .env file")
@@ -59,7 +154,7 @@ func main() {
 	// default to using the port number 4000 and the environment "development" if no
 	// corresponding flags are provided.
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.env, "env", envDevelopment, "Environment (development|staging|production|sandbox)")
 
 	// Read the DSN value from the db-dsn command-line flag into the config struct. We
 	// default to using our development DSN if no flag is provided.
@@ -68,31 +163,231 @@ func main() {
 	// Read the value of the seed and env command-line flags into the config struct. We
 	flag.BoolVar(&cfg.seed, "seed", false, "Seed data")
 
+	// The seed profile sets the size of the generated dataset, the scale multiplies it.
+	// Passing the same random seed generates the same dataset again.
+	flag.StringVar(&cfg.seeding.profile, "seed-profile", "demo", "Seed profile (demo|load-test|minimal)")
+	flag.Float64Var(&cfg.seeding.scale, "seed-scale", 1, "Seed scale factor")
+	flag.Int64Var(&cfg.seeding.randomSeed, "seed-random", 0, "Seed for the random generator (0 = random)")
+	flag.BoolVar(&cfg.seeding.reset, "seed-reset", false, "Remove all business data before seeding")
+
+	// Seeding creates a user for every role. The passwords are generated unless they are
+	// given, either way they are written to the log.
+	cfg.seeding.users = []data.SeedUser{
+		{Role: "admin", Name: "Admin"},
+		{Role: "accountant", Name: "Accountant"},
+		{Role: "viewer", Name: "Viewer"},
+	}
+	for i := range cfg.seeding.users {
+		u := &cfg.seeding.users[i]
+		flag.StringVar(&u.Email, "seed-"+u.Role+"-email", u.Role+"@example.com", "Email of the seeded "+u.Role)
+		flag.StringVar(&u.Password, "seed-"+u.Role+"-password", "", "Password of the seeded "+u.Role+" (generated if empty)")
+	}
+
 	// Parse the JWT signing secret from the command-line-flag. Notice that we leave the
 	// default value as the empty string if no flag is provided.
 	flag.StringVar(&cfg.jwt.secret, "jwt-secret", os.Getenv("JWT_SECRET"), "JWT secret")
+	flag.DurationVar(&cfg.jwt.leeway, "jwt-leeway", 30*time.Second, "Clock skew tolerated when checking the times of tokens")
+	flag.DurationVar(&cfg.jwt.userCache, "auth-user-cache", 10*time.Second, "How long authenticated users are cached (0 = disabled)")
+
+	// New passwords have to be as long as the minimum length and mix the number of
+	// character classes (lower case, upper case, digits, other characters).
+	flag.IntVar(&cfg.password.minLength, "password-min-length", data.DefaultPasswordPolicy.MinLength, "Minimum length of new passwords")
+	flag.IntVar(&cfg.password.minClasses, "password-min-classes", data.DefaultPasswordPolicy.MinClasses, "Character classes new passwords have to mix (1-4)")
+
+	// Read the keys used to encrypt bank accounts and contacts. The keys are given as a
+	// comma separated list of "id:base64 key" pairs, the key id selects the key used for
+	// new values. Old keys have to be kept in the list until -rotate-keys has been run.
+	flag.StringVar(&cfg.encryption.keys, "encryption-keys", os.Getenv("ENCRYPTION_KEYS"), "Encryption keys (id:base64,...)")
+	flag.StringVar(&cfg.encryption.keyID, "encryption-key-id", os.Getenv("ENCRYPTION_KEY_ID"), "Current encryption key id")
+	flag.BoolVar(&cfg.rotateKeys, "rotate-keys", false, "Re-encrypt sensitive data with the current encryption key")
+
+	// Settled invoices older than the given number of years are moved to the archive
+	// tables by a background job. Archiving is disabled by default.
+	flag.IntVar(&cfg.archive.years, "archive-after-years", 0, "Archive settled invoices older than this many years (0 = disabled)")
+	flag.DurationVar(&cfg.archive.interval, "archive-interval", 24*time.Hour, "Interval of the invoice archiver")
+
+	// Read the SMTP server settings used to send emails.
+	flag.StringVar(&cfg.smtp.host, "smtp-host", os.Getenv("SMTP_HOST"), "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("SMTP_USERNAME"), "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", os.Getenv("SMTP_SENDER"), "SMTP sender")
+
+	// Monthly statements are emailed to the companies which opted in from the given day
+	// of the month on. Sending is disabled by default.
+	flag.BoolVar(&cfg.statements.enabled, "statement-emails", false, "Email monthly statements of open invoices")
+	flag.IntVar(&cfg.statements.day, "statement-day", 1, "Day of the month statements are sent from")
+	flag.DurationVar(&cfg.statements.interval, "statement-interval", time.Hour, "Interval of the statement mailer")
+
+	// The payment stats of the companies are recalculated by a background job.
+	flag.DurationVar(&cfg.paymentStats.interval, "payment-stats-interval", 24*time.Hour, "Interval of the company payment stats calculation (0 = disabled)")
+
+	// Invoices queued with send batches are emailed by a background job once the SMTP
+	// server is configured.
+	flag.DurationVar(&cfg.invoiceSending.interval, "invoice-sending-interval", time.Minute, "Interval of the invoice sender (0 = disabled)")
+
+	// Backups of the database are written to the backup directory with pg_dump, or by
+	// the backup command, on request and at the interval. The retention policy keeps
+	// the latest ones and removes those older than the maximum age.
+	flag.StringVar(&cfg.backups.dir, "backup-dir", os.Getenv("BACKUP_DIR"), "Directory of the database backups (empty = disabled)")
+	flag.StringVar(&cfg.backups.command, "backup-command", os.Getenv("BACKUP_COMMAND"), "Command run instead of pg_dump, with the backup file as its last argument")
+	flag.DurationVar(&cfg.backups.interval, "backup-interval", 0, "Interval of the scheduled backups (0 = disabled)")
+	flag.IntVar(&cfg.backups.keep, "backup-keep", 7, "Number of backups kept (0 = no limit)")
+	flag.DurationVar(&cfg.backups.maxAge, "backup-max-age", 0, "Age after which backups are removed (0 = no limit)")
+
+	// Posted invoices and payments are pushed into the accounting systems of the
+	// organisations by a background job. 1C connectors write exchange files to a
+	// directory of the organisation in the export directory.
+	flag.StringVar(&cfg.accounting.exportDir, "accounting-export-dir", os.Getenv("ACCOUNTING_EXPORT_DIR"), "Directory of the 1C exchange files (empty = 1C connectors disabled)")
+	flag.DurationVar(&cfg.accounting.syncInterval, "accounting-sync-interval", 5*time.Minute, "Interval of the accounting sync (0 = disabled)")
+
+	// Payment reminders are sent by the rules of the organisations by a background job,
+	// by email once the SMTP server is configured and by SMS through the provider of
+	// the organisation.
+	flag.DurationVar(&cfg.reminders.interval, "payment-reminder-interval", time.Hour, "Interval of the payment reminder job (0 = disabled)")
+
+	// The invoices of the billing plans are created by a background job on the invoice
+	// day of each plan.
+	flag.DurationVar(&cfg.billingPlans.interval, "billing-plan-interval", time.Hour, "Interval of the billing plan job (0 = disabled)")
+
+	// The totals of invoices are calculated by the server. In shadow mode the totals
+	// sent by clients are compared with them and the differences recorded.
+	flag.BoolVar(&cfg.totals.shadow, "totals-shadow", false, "Record where the totals sent by clients differ from the calculated ones")
+
+	// Uploaded files like the avatars of the users are kept in the storage directory,
+	// which has to be shared by all instances.
+	flag.StringVar(&cfg.storage.dir, "storage-dir", os.Getenv("STORAGE_DIR"), "Directory of the uploaded files (empty = uploads disabled)")
+
+	// Attached files are scanned for viruses by clamd, at tcp://host:port or
+	// unix:///path/to/clamd.ctl.
+	flag.StringVar(&cfg.scanner.clamd, "clamd-address", os.Getenv("CLAMD_ADDRESS"), "Address of clamd scanning the attachments (empty = not scanned)")
+	flag.DurationVar(&cfg.scanner.timeout, "clamd-timeout", time.Minute, "Timeout of a clamd scan")
+
+	// Invoices are printed as PDF with TrueType fonts embedded into the documents, which
+	// have to cover Cyrillic, e.g. DejaVu Sans or PT Sans.
+	flag.StringVar(&cfg.pdf.font, "pdf-font", os.Getenv("PDF_FONT"), "TrueType font file of the PDF invoices (empty = PDF printing disabled)")
+	flag.StringVar(&cfg.pdf.boldFont, "pdf-font-bold", os.Getenv("PDF_FONT_BOLD"), "Bold TrueType font file of the PDF invoices (empty = the regular font)")
+
+	// Issued invoices printed as PDF and the 1C exchange files are kept in the storage
+	// as they were generated, for the retention period required for accounting
+	// documents. The generated_documents job removes them afterwards.
+	flag.IntVar(&cfg.documents.retentionYears, "document-retention-years", 5, "Years generated documents are kept (0 = for good)")
+
+	// Public invoice links are given out as absolute URLs under the public URL of the
+	// API, e.g. https://api.example.com, and as paths without it.
+	flag.StringVar(&cfg.publicURL, "public-url", os.Getenv("PUBLIC_URL"), "Public URL of the API for invoice links (empty = relative links)")
+
+	// The default and maximum page sizes of list endpoints can be changed per endpoint.
+	pageLimits := flag.String("page-limits", os.Getenv("PAGE_LIMITS"), "Page sizes per endpoint (endpoint=default:max,...)")
+
+	// Requests are cancelled after the timeout of their route, e.g. reports=2m.
+	routeTimeouts := flag.String("route-timeouts", os.Getenv("ROUTE_TIMEOUTS"), "Request timeouts per route (route=duration,...)")
+
+	// Browsers may only call the API from the trusted origins, separated by spaces.
+	// Any origin is allowed in development if none are given.
+	cfg.cors.trustedOrigins = strings.Fields(os.Getenv("CORS_TRUSTED_ORIGINS"))
+	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
+		cfg.cors.trustedOrigins = strings.Fields(val)
+		return nil
+	})
 
 	flag.Parse()
 
+	// Initialize a new logger which writes messages to the standard error stream,
+	// prefixed with the current date and time, in the format of the environment.
+	logger := newLogger(cfg)
+	log.Logger = logger
+
+	cfg.pageLimits, err = parsePageLimits(*pageLimits)
+	if err != nil {
+		log.Fatal().Err(err).Msg("page limits")
+	}
+
+	cfg.routeTimeouts, err = parseRouteTimeouts(*routeTimeouts)
+	if err != nil {
+		log.Fatal().Err(err).Msg("route timeouts")
+	}
+
+	// Check the whole configuration before connecting to anything, so a missing
+	// setting stops the application with a clear message.
+	if problems := cfg.validate(); len(problems) > 0 {
+		log.Fatal().Strs("problems", problems).Msg("invalid configuration")
+	}
+
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the
 	// application immediately.
-	db, err := openDB(cfg)
+	db, err := openDB(cfg, logger)
 	if err != nil {
-		log.Error().Err(err).Msg("pgx")
+		log.Fatal().Err(err).Msg("connecting to the database")
 	}
 
 	// Defer a call to db.Close() so that the connection pool is closed before the
 	// main() function exits.
 	defer db.Close()
 
+	// The profile and the scale have been validated with the rest of the config.
+	seedProfile := data.SeedProfiles[cfg.seeding.profile]
+
+	// Sensitive fields are stored as plain text when no encryption keys are given.
+	var keyring *encryption.Keyring
+	if cfg.encryption.keys != "" {
+		keyring, err = encryption.New(cfg.encryption.keys, cfg.encryption.keyID)
+		if err != nil {
+			log.Fatal().Err(err).Msg("encryption")
+		}
+	} else {
+		logger.Warn().Msg("encryption keys are not set, sensitive data is stored unencrypted")
+	}
+
 	// Declare an instance of the application struct, containing the config struct and
 	// the logger.
 	app := &application{
 		config: cfg,
 		logger: &logger,
-		models: data.NewModels(db),
-		seed:   data.Seed{DB: db, Logger: &logger, Models: data.NewModels(db)},
+		models: data.NewModels(db, keyring),
+		seed: data.Seed{
+			DB:         db,
+			Logger:     &logger,
+			Profile:    seedProfile.Scale(cfg.seeding.scale),
+			RandomSeed: cfg.seeding.randomSeed,
+			SeedUsers:  cfg.seeding.users,
+			Models:     data.NewModels(db, keyring),
+		},
+		cache:   newCacheVersions(),
+		changes: newChangeBroker(),
+		users:   newUserCache(cfg.jwt.userCache),
+		mailer:  mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+	}
+
+	if cfg.isSandbox() {
+		app.sandbox = sandbox.New()
+		app.mailer = app.sandbox.Mailer()
+	}
+
+	if cfg.storageEnabled() {
+		app.storage = storage.Dir{Path: cfg.storage.dir}
+	}
+
+	if cfg.scanningEnabled() {
+		app.scanner, err = scanner.NewClamd(cfg.scanner.clamd, cfg.scanner.timeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("virus scanner")
+		}
+	}
+
+	if cfg.pdfEnabled() {
+		app.pdfFonts, err = loadPDFFonts(cfg.pdf.font, cfg.pdf.boldFont)
+		if err != nil {
+			log.Fatal().Err(err).Msg("PDF fonts")
+		}
+	}
+
+	// Make sure the database schema is up to date and the services are reachable
+	// before anything is written or served.
+	err = app.selfCheck()
+	if err != nil {
+		log.Fatal().Err(err).Msg("startup check")
 	}
 
 	// generate a `Certificate` struct
@@ -106,15 +401,30 @@ func main() {
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: cfg.writeTimeout(),
 		// TLSConfig: &tls.Config{
 		// 	Certificates: []tls.Certificate{cert},
 		// },
 	}
 
-	if cfg.seed {
+	if cfg.seed || cfg.seeding.reset {
+		if cfg.seeding.reset {
+			err = app.seed.Reset()
+			if err != nil {
+				log.Fatal().Err(err).Msg("seed reset")
+			}
+		}
 		app.seed.Seed()
+	} else if cfg.rotateKeys {
+		app.rotateKeys()
 	} else {
+		go app.runChangeListener()
+
+		// Only one of the running instances schedules the jobs.
+		if jobs := app.scheduledJobs(); len(jobs) > 0 {
+			go app.runScheduler(jobs)
+		}
+
 		// Start the HTTP
 		logger.Printf("starting %s server on %s", cfg.env, srv.Addr)
 		// err = srv.ListenAndServeTLS("", "")
@@ -129,18 +439,23 @@ func main() {
 }
 
 // The openDB() function returns a sql.DB connection pool.
-func openDB(cfg config) (*pgxpool.Pool, error) {
-	logger := zerologadapter.NewLogger(zerolog.New(os.Stderr).With().Timestamp().Logger())
+func openDB(cfg config, logger zerolog.Logger) (*pgxpool.Pool, error) {
 
 	poolConfig, err := pgxpool.ParseConfig(cfg.db.dsn)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to parse DATABASE_URL")
-		os.Exit(1)
+		return nil, fmt.Errorf("parsing the database DSN: %w", err)
 	}
 
-	poolConfig.ConnConfig.Logger = logger
+	// The connections holding the scheduler's locks and the change listener must not
+	// leave the requests and the jobs without any.
+	poolConfig.MaxConns += schedulerConnections(cfg)
 
-	dbpool, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
+	poolConfig.ConnConfig.Tracer = &tracelog.TraceLog{
+		Logger:   pgxLogger{logger: logger},
+		LogLevel: cfg.pgxLogLevel(),
+	}
+
+	dbpool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -161,3 +476,33 @@ func openDB(cfg config) (*pgxpool.Pool, error) {
 	// Return the pgxpool.Pool connection pool.
 	return dbpool, nil
 }
+
+// The rotateKeys() method re-encrypts all sensitive data with the current encryption
+// key. It is also used to encrypt the data stored before encryption was enabled.
+func (app *application) rotateKeys() {
+	if app.config.encryption.keys == "" {
+		log.Fatal().Msg("encryption keys are not set")
+	}
+
+	bankAccounts, err := app.models.BankAccounts.RotateKeys()
+	if err != nil {
+		log.Fatal().Err(err).Msg("rotating bank accounts keys")
+	}
+
+	contacts, err := app.models.Contacts.RotateKeys()
+	if err != nil {
+		log.Fatal().Err(err).Msg("rotating contacts keys")
+	}
+
+	connectors, err := app.models.AccountingConnectors.RotateKeys()
+	if err != nil {
+		log.Fatal().Err(err).Msg("rotating accounting connectors keys")
+	}
+
+	smsSettings, err := app.models.SMSSettings.RotateKeys()
+	if err != nil {
+		log.Fatal().Err(err).Msg("rotating sms settings keys")
+	}
+
+	app.logger.Info().Int64("bank_accounts", bankAccounts).Int64("contacts", contacts).Int64("accounting_connectors", connectors).Int64("sms_settings", smsSettings).Msg("encryption keys rotated")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The checkConsistencyHandler() reports records which break the rules the application
+// relies on, like invoice totals which don't match their items. It only reads data, so
+// it's safe to run at any time, e.g. after an import.
+func (app *application) checkConsistencyHandler(w http.ResponseWriter, r *http.Request) {
+	inconsistencies, err := app.models.Maintenance.Check()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": inconsistencies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The fixConsistencyHandler() repairs the fixable inconsistencies and responds with the
+// number of fixed records per check and the inconsistencies which are left.
+func (app *application) fixConsistencyHandler(w http.ResponseWriter, r *http.Request) {
+	fixed, err := app.models.Maintenance.Fix()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	details := map[string]interface{}{}
+	for check, count := range fixed {
+		details[check] = count
+	}
+
+	// The data has been changed at this point, so a failure to record the event is
+	// logged rather than reported to the client.
+	user := app.contextGetUser(r)
+	event := &data.AuditEvent{
+		UserID:  &user.ID,
+		Action:  "fix_consistency",
+		Entity:  "database",
+		Details: details,
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	inconsistencies, err := app.models.Maintenance.Check()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"fixed": fixed, "data": inconsistencies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The recalculateInvoiceTotalsHandler() recomputes the totals of the invoices from their
+// items, e.g. after a bulk import or after VAT amounts of items have been corrected.
+// The invoices can be narrowed down with the same query string filters as the list of
+// invoices plus vat_rate_id.
+func (app *application) recalculateInvoiceTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.RecalculateFilters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters.OrganisationID = app.readInt64(qs, "organisation_id", 0, v)
+	filters.CompanyID = app.readInt64(qs, "company_id", 0, v)
+	filters.VatRateID = app.readInt64(qs, "vat_rate_id", 0, v)
+	filters.Start, filters.End = app.readDateRange(qs, nil, nil, v)
+	filters.BatchSize = app.readInt(qs, "batch_size", 500, v)
+
+	if data.ValidateRecalculateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	checked, updated, err := app.models.Maintenance.RecalculateTotals(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	event := &data.AuditEvent{
+		UserID: &user.ID,
+		Action: "recalculate_totals",
+		Entity: "invoice",
+		Details: map[string]interface{}{
+			"filters": qs.Encode(),
+			"checked": checked,
+			"updated": updated,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"checked": checked, "updated": updated}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The databaseStatsHandler() reports the size of the tables, how many rows have been
+// written to them since the statistics were reset and the organisations with the most
+// documents, for capacity planning.
+func (app *application) databaseStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.DatabaseStatsFilters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters.Organisations = app.readInt(qs, "organisations", 10, v)
+	filters.Days = app.readInt(qs, "days", 30, v)
+
+	if data.ValidateDatabaseStatsFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	stats, err := app.models.Maintenance.Stats(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+)
+
+// Declare a handler which returns the values of the fields with a fixed set of values
+// with their labels, so clients build their dropdowns from the server.
+func (app *application) listEnumsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": data.Enums}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,16 +1,38 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/locale"
+	"github.com/ElOtro/stockup-api/internal/pdf"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/ElOtro/stockup-api/internal/xlsx"
+	"github.com/andybalholm/brotli"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/pascaldekloe/jwt"
 )
 
+// The compressor() compresses JSON and HTML responses with brotli, gzip or deflate,
+// whichever the client accepts, preferring brotli. Level 5 keeps brotli about as fast
+// as gzip.
+func (app *application) compressor() *middleware.Compressor {
+	compressor := middleware.NewCompressor(5, "application/json", "text/html")
+	compressor.SetEncoder("br", func(w io.Writer, level int) io.Writer {
+		return brotli.NewWriterLevel(w, level)
+	})
+
+	return compressor
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Authorization" header to the response. This indicates to any
@@ -41,44 +63,180 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
 
-		// Parse the JWT and extract the claims. This will return an error if the JWT
-		// contents doesn't match the signature (i.e. the token has been tampered with)
-		// or the algorithm isn't valid.
-		claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.jwt.secret))
+		claims, err := app.checkAuthenticationToken(token)
 		if err != nil {
-			app.invalidAuthenticationTokenResponse(w, r)
+			switch {
+			case errors.Is(err, errTokenExpired):
+				app.expiredAuthenticationTokenResponse(w, r)
+			default:
+				app.invalidAuthenticationTokenResponse(w, r)
+			}
 			return
 		}
 
-		// Check if the JWT is still valid at this moment in time.
-		if !claims.Valid(time.Now()) {
+		// At this point, we know that the JWT is all OK and we can trust the data in
+		// it. We extract the user ID from the claims subject and convert it from a
+		// string into an int64.
+		userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+		if err != nil || userID < 1 {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		// Check that the issuer is our application.
-		if claims.Issuer != "stockup-api" {
+		// Lookup the user record, a burst of requests reads it from the database once.
+		user, ok := app.users.get(userID)
+		if !ok {
+			user, err = app.models.Users.Get(userID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			app.users.set(user)
+		}
+
+		// Tokens issued before the token version of the user was raised, e.g. by a
+		// password change, are no longer accepted. Tokens of version 0 carry none.
+		version, _ := claims.Set["token_version"].(float64)
+		if int(version) != user.TokenVersion {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		// Check that our application is in the expected audiences for the JWT.
-		if !claims.AcceptAudience("stockup-api") {
+		// Call the contextSetUser() helper to add the user information to the request // context.
+		r = app.contextSetUser(r, user)
+
+		// Tokens issued by switchOrganisationHandler() carry the organisation which all
+		// queries of the request are restricted to. Numbers are decoded as float64.
+		if organisationID, ok := claims.Set["organisation_id"].(float64); ok {
+			r = app.contextSetOrganisationID(r, int64(organisationID))
+		}
+		// Call the next handler in the chain.
+		next.ServeHTTP(w, r)
+
+	})
+}
+
+// The errors of checkAuthenticationToken(). Clients renew expired tokens by logging in
+// again, other tokens are invalid for good.
+var (
+	errTokenExpired = errors.New("token expired")
+	errTokenInvalid = errors.New("token invalid")
+)
+
+// Tokens are far shorter; longer ones are refused before their signature is checked.
+const maxTokenLength = 4096
+
+// The checkAuthenticationToken() method checks the signature and the claims of a JWT
+// issued by createAuthenticationToken(). The times are checked with the configured
+// leeway, as the clocks of the instances may drift apart; the issuer and the audience
+// have to be exactly ours.
+func (app *application) checkAuthenticationToken(token string) (*jwt.Claims, error) {
+	if len(token) > maxTokenLength {
+		return nil, errTokenInvalid
+	}
+
+	// Parse the JWT and extract the claims. This will return an error if the JWT
+	// contents doesn't match the signature (i.e. the token has been tampered with)
+	// or the algorithm isn't valid.
+	claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.jwt.secret))
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+
+	if claims.Issuer != "stockup-api" || len(claims.Audiences) != 1 || claims.Audiences[0] != "stockup-api" {
+		return nil, errTokenInvalid
+	}
+
+	// Our tokens always carry their times.
+	if claims.Issued == nil || claims.NotBefore == nil || claims.Expires == nil {
+		return nil, errTokenInvalid
+	}
+
+	now := time.Now()
+	leeway := app.config.jwt.leeway
+
+	if now.Add(leeway).Before(claims.NotBefore.Time()) || now.Add(leeway).Before(claims.Issued.Time()) {
+		return nil, errTokenInvalid
+	}
+
+	if !now.Add(-leeway).Before(claims.Expires.Time()) {
+		return nil, errTokenExpired
+	}
+
+	return claims, nil
+}
+
+// The requirePermission() middleware checks that the authenticated user has been granted
+// the given permission code. It must be used on routes which already run behind the
+// authenticate() middleware.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Retrieve the user from the request context.
+		user := app.contextGetUser(r)
+
+		// Get the slice of permissions for the user.
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Check if the slice includes the required permission. If it doesn't, then
+		// return a 403 Forbidden response.
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		// Otherwise they have the required permission so we call the next handler in
+		// the chain.
+		next.ServeHTTP(w, r)
+	}
+}
+
+// The authenticateIntegration() middleware authenticates the requests to the
+// integration endpoints with an integration token, sent as a bearer token or in the
+// X-API-Key header which no-code platforms can set more easily. The requests act for
+// the user of the token and are bound to its organisation, as long as the user is still
+// a member of it.
+func (app *application) authenticateIntegration(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+
+		plaintext := r.Header.Get("X-API-Key")
+		if authorizationHeader := r.Header.Get("Authorization"); authorizationHeader != "" {
+			headerParts := strings.Split(authorizationHeader, " ")
+			if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			plaintext = headerParts[1]
+		}
+
+		if !strings.HasPrefix(plaintext, data.IntegrationTokenPrefix) {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		// At this point, we know that the JWT is all OK and we can trust the data in
-		// it. We extract the user ID from the claims subject and convert it from a
-		// string into an int64.
-		userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+		token, err := app.models.IntegrationTokens.GetForPlaintext(plaintext)
 		if err != nil {
-			app.serverErrorResponse(w, r, err)
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
 			return
 		}
 
-		/// Lookup the user record from the database.
-		user, err := app.models.Users.Get(userID)
+		user, err := app.models.Users.Get(token.UserID)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -89,10 +247,322 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		// Call the contextSetUser() helper to add the user information to the request // context.
+		member, err := app.models.Organisations.HasUser(token.OrganisationID, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !member {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
 		r = app.contextSetUser(r, user)
-		// Call the next handler in the chain.
+		r = app.contextSetOrganisationID(r, token.OrganisationID)
+		r = app.contextSetIntegrationToken(r, token)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requireScope() middleware checks that the integration token has been given the
+// scope. It must be used on routes which already run behind authenticateIntegration().
+func (app *application) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.contextGetIntegrationToken(r).HasScope(scope) {
+			app.errorResponse(w, r, http.StatusForbidden, fmt.Sprintf("the integration token doesn't have the %s scope", scope))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// The requireOrganisationAccess() middleware responds with 404 Not Found when the
+// organisation in the URL isn't the one the authentication token is bound to. It must
+// be used on routes which already run behind the authenticate() middleware.
+func (app *application) requireOrganisationAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam("organisationID", r)
+		if err != nil || !app.organisationAllowed(r, id) {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requireInvoiceAccess() middleware does the same for routes of a single invoice,
+// looking up the organisation of the invoice in the URL. The invoice is added to the
+// context of changes for requireInvoiceWritable().
+func (app *application) requireInvoiceAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Skip the lookup for reads when the token isn't bound to an organisation.
+		if app.contextGetOrganisationID(r) == 0 && r.Method == http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := app.readIDParam("invoiceID", r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		invoice, err := app.models.Invoices.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !app.organisationAllowed(r, invoice.OrganisationID) {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, app.contextSetInvoice(r, invoice))
+	})
+}
+
+// The requireInvoiceWritable() middleware rejects changes to archived invoices and to
+// invoices dated within a closed period. Routes which don't change the invoice, like
+// its public links, are left out of it.
+func (app *application) requireInvoiceWritable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		invoice := app.contextGetInvoice(r)
+
+		// Archived invoices and their items are read-only.
+		if invoice.Archived {
+			app.archivedResponse(w, r)
+			return
+		}
+
+		// So are cancelled ones, they are kept as they were cancelled.
+		if invoice.Status == data.InvoiceStatusCancelled {
+			app.cancelledResponse(w, r)
+			return
+		}
+
+		if !app.requireOpenPeriod(w, r, invoice.OrganisationID, invoice.Date) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requireInvoiceUnshipped() middleware keeps the items of a shipped invoice as they
+// were shipped, the stock moved by them would be wrong otherwise.
+func (app *application) requireInvoiceUnshipped(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && app.contextGetInvoice(r).ShippedAt != nil {
+			app.shippedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The media types the API responds with. Reports can be exported as CSV and XLSX, the
+// changes are streamed as server-sent events and documents are printed from HTML and
+// PDF.
+const (
+	contentTypeJSON        = "application/json"
+	contentTypeCSV         = "text/csv"
+	contentTypeXLSX        = xlsx.ContentType
+	contentTypeEventStream = "text/event-stream"
+	contentTypeHTML        = "text/html"
+	contentTypePDF         = pdf.ContentType
+)
+
+// The names of the media types for the format query parameter, which is easier to put
+// into a download link than an Accept header.
+var formatContentTypes = map[string]string{
+	"json": contentTypeJSON,
+	"csv":  contentTypeCSV,
+	"xlsx": contentTypeXLSX,
+	"html": contentTypeHTML,
+	"pdf":  contentTypePDF,
+}
+
+// The timeout() middleware gives the request context the deadline of the route, see
+// routeTimeout(). The queries taking the request context are cancelled when it passes
+// and the handler answers with 504, see serverErrorResponse(); a handler which returns
+// without answering gets the 504 from here.
+func (app *application) timeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := app.routeTimeout(r)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(ww, r)
+
+		if ww.Status() == 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			app.gatewayTimeoutResponse(w, r)
+		}
+	})
+}
+
+// The requireJSON() middleware rejects a request body which isn't UTF-8 JSON with 415
+// Unsupported Media Type before any handler tries to decode it. Requests without a
+// body, e.g. actions like POST /write_off without a reason, pass.
+func (app *application) requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			if r.ContentLength != 0 {
+				mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+				charset := strings.ToLower(params["charset"])
+
+				if err != nil || mediaType != contentTypeJSON || charset != "" && charset != "utf-8" {
+					app.unsupportedMediaTypeResponse(w, r)
+					return
+				}
+			}
+		}
+
 		next.ServeHTTP(w, r)
+	})
+}
+
+// The negotiate() middleware picks the media type of the response from the offers by
+// the Accept header of the request and stores it in the request context, see
+// contextGetContentType(). Without an Accept header the first offer is used. The format
+// query parameter, e.g. ?format=xlsx, overrides the Accept header. A request which
+// accepts none of the offers is answered with 406 Not Acceptable.
+func (app *application) negotiate(offers ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+
+			contentType := negotiateContentType(r.Header.Get("Accept"), offers)
+			if format := r.URL.Query().Get("format"); format != "" {
+				contentType = ""
+				if offer, ok := formatContentTypes[format]; ok && validator.In(offer, offers...) {
+					contentType = offer
+				}
+			}
+
+			if contentType == "" {
+				app.notAcceptableResponse(w, r, offers)
+				return
+			}
+
+			next.ServeHTTP(w, app.contextSetContentType(r, contentType))
+		})
+	}
+}
+
+// The localize() middleware picks the locale the numbers and dates of CSV and XLSX
+// exports are written in and stores it in the request context, see contextGetLocale():
+// the locale query parameter, e.g. ?locale=en, or else the locale of the preferences of
+// the user. It runs after negotiate() and authenticate(); JSON responses aren't
+// localized, so the preferences are only read for exports.
+func (app *application) localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.exportingReport(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if tag := r.URL.Query().Get("locale"); tag != "" {
+			loc, ok := locale.Lookup(tag)
+			if !ok {
+				app.failedValidationResponse(w, r, map[string]string{"locale": "must be one of " + strings.Join(locale.Tags(), ", ")})
+				return
+			}
+
+			next.ServeHTTP(w, app.contextSetLocale(r, loc))
+			return
+		}
 
+		preferences, err := app.models.UserPreferences.Get(app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		loc, ok := locale.Lookup(preferences.Locale)
+		if !ok {
+			loc = locale.Default
+		}
+
+		next.ServeHTTP(w, app.contextSetLocale(r, loc))
 	})
 }
+
+// negotiateContentType returns the offer with the highest quality in the Accept header,
+// the earlier offer if two are equal, or an empty string if none is acceptable. The
+// quality of an offer is taken from the most specific media range matching it.
+func negotiateContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQuality := "", 0.0
+
+	for _, offer := range offers {
+		quality, specificity := 0.0, -1
+
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err != nil {
+				continue
+			}
+
+			// An exact match beats type/* which beats */*.
+			var s int
+			switch {
+			case mediaType == offer:
+				s = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				s = 1
+			case mediaType == "*/*":
+				s = 0
+			default:
+				continue
+			}
+
+			if s <= specificity {
+				continue
+			}
+
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(value, 64)
+				if err != nil {
+					q = 0
+				}
+			}
+
+			quality, specificity = q, s
+		}
+
+		if quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+
+	return best
+}
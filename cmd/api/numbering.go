@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// The listNumberingHandler() returns the numbering of every document type of the
+// organisation with a preview of the next number.
+func (app *application) listNumberingHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	sequences, err := app.models.DocumentSequences.GetAll(organisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": sequences}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showNumberingHandler(w http.ResponseWriter, r *http.Request) {
+	sequence, ok := app.readDocumentSequence(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": sequence}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateNumberingHandler() changes the template, padding, next number or yearly
+// reset of a document type. Documents numbered before keep their numbers.
+func (app *application) updateNumberingHandler(w http.ResponseWriter, r *http.Request) {
+	sequence, ok := app.readDocumentSequence(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Numbering *struct {
+			Template    *string `json:"template"`
+			Padding     *int    `json:"padding"`
+			NextNumber  *int64  `json:"next_number"`
+			ResetYearly *bool   `json:"reset_yearly"`
+		} `json:"numbering"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Numbering == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a numbering object"))
+		return
+	}
+
+	var fields = input.Numbering
+
+	if fields.Template != nil {
+		sequence.Template = *fields.Template
+	}
+
+	if fields.Padding != nil {
+		sequence.Padding = *fields.Padding
+	}
+
+	if fields.NextNumber != nil {
+		sequence.NextNumber = *fields.NextNumber
+	}
+
+	if fields.ResetYearly != nil {
+		sequence.ResetYearly = *fields.ResetYearly
+	}
+
+	user := app.contextGetUser(r)
+	sequence.UserID = &user.ID
+
+	v := validator.New()
+
+	if data.ValidateDocumentSequence(v, sequence); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.DocumentSequences.Save(sequence)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "change_numbering",
+		Entity:   "organisation",
+		EntityID: sequence.OrganisationID,
+		Details: map[string]interface{}{
+			"document_type": sequence.DocumentType,
+			"template":      sequence.Template,
+			"padding":       sequence.Padding,
+			"next_number":   sequence.NextNumber,
+			"reset_yearly":  sequence.ResetYearly,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": sequence}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readDocumentSequence fetches the numbering of the document type in the URL. It sends
+// the error response itself and returns false if that fails.
+func (app *application) readDocumentSequence(w http.ResponseWriter, r *http.Request) (*data.DocumentSequence, bool) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	sequence, err := app.models.DocumentSequences.Get(organisationID, chi.URLParam(r, "documentType"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return sequence, true
+}
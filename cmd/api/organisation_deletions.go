@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The number of records a deletion soft-deletes in one statement, and how often the
+// scheduler continues deletions which were interrupted.
+const (
+	organisationDeletionBatchSize = 500
+	organisationDeletionInterval  = 5 * time.Minute
+)
+
+// The deletionPreviewHandler() lists how many records deleting the organisation would
+// affect, so the user knows what to confirm, with the confirmation token the deletion
+// has to be requested with.
+func (app *application) deletionPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	organisation, ok := app.readOrganisation(w, r)
+	if !ok {
+		return
+	}
+
+	preview, err := app.models.OrganisationDeletions.Preview(organisation.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, expires, err := app.createConfirmationToken("organisations:delete", organisation.ID, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": preview, "confirmation_token": token, "expires": expires}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteOrganisationHandler() starts deleting the organisation in the background
+// and responds right away with the deletion, its progress can be followed at the
+// Location. It takes the confirmation token of the deletion preview, so the user has
+// seen what is deleted.
+func (app *application) deleteOrganisationHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	organisation, ok := app.readOrganisation(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		ConfirmationToken string `json:"confirmation_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	confirmed := app.checkConfirmationToken(input.ConfirmationToken, "organisations:delete", organisation.ID, user.ID)
+	v.Check(input.ConfirmationToken != "", "confirmation_token", "must be provided, it is returned by the deletion preview")
+	v.Check(input.ConfirmationToken == "" || confirmed, "confirmation_token", "invalid or expired confirmation token")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	preview, err := app.models.OrganisationDeletions.Preview(organisation.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	deletion := &data.OrganisationDeletion{
+		OrganisationID: organisation.ID,
+		UserID:         &user.ID,
+		Total:          preview.Total,
+	}
+
+	err = app.models.OrganisationDeletions.Insert(deletion)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDeletionRunning):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	go app.deleteOrganisations()
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "delete",
+		Entity:   "organisation",
+		EntityID: organisation.ID,
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organisations/%d/deletion", organisation.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"data": deletion}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showDeletionHandler() returns the latest deletion of the organisation with its
+// progress. It's still found once the organisation is deleted.
+func (app *application) showDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	deletion, err := app.models.OrganisationDeletions.Latest(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": deletion}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readOrganisation() helper reads the organisation in the URL, sending a 404 Not
+// Found response when it doesn't exist or is deleted.
+func (app *application) readOrganisation(w http.ResponseWriter, r *http.Request) (*data.Organisation, bool) {
+	id, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	organisation, err := app.models.Organisations.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return organisation, true
+}
+
+// The deleteOrganisations() method runs the deletions which aren't finished, one after
+// the other. It's started for every new deletion and by the scheduler, which continues
+// deletions interrupted by a restart; the lock lets only one instance run them.
+func (app *application) deleteOrganisations() {
+	lock, err := app.models.Locks.TryLock(context.Background(), "organisation_deletions")
+	if err != nil {
+		app.logger.Err(err).Msg("taking the organisation deletion lock")
+		return
+	}
+	if lock == nil {
+		return
+	}
+	defer func() {
+		err := lock.Unlock()
+		if err != nil {
+			app.logger.Err(err).Msg("releasing the organisation deletion lock")
+		}
+	}()
+
+	for {
+		deletion, err := app.models.OrganisationDeletions.Next()
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.Err(err).Msg("reading the organisation deletions")
+			}
+			return
+		}
+
+		app.runOrganisationDeletion(deletion)
+	}
+}
+
+// runOrganisationDeletion soft-deletes the records of the organisation step by step, a
+// batch at a time so the progress is recorded as it goes, then the organisation itself.
+func (app *application) runOrganisationDeletion(deletion *data.OrganisationDeletion) {
+	start := time.Now()
+
+	for _, step := range data.DeletionSteps {
+		for {
+			deleted, err := app.models.OrganisationDeletions.DeleteBatch(deletion, step, organisationDeletionBatchSize)
+			if err != nil {
+				app.failOrganisationDeletion(deletion, fmt.Errorf("deleting %s: %w", step, err))
+				return
+			}
+			if deleted < organisationDeletionBatchSize {
+				break
+			}
+		}
+	}
+
+	err := app.models.OrganisationDeletions.Finish(deletion)
+	if err != nil {
+		app.failOrganisationDeletion(deletion, err)
+		return
+	}
+
+	app.logger.Info().Int64("organisation_id", deletion.OrganisationID).Int("records", deletion.Done).Dur("duration", time.Since(start)).Msg("organisation deleted")
+}
+
+// failOrganisationDeletion logs the error and records it with the deletion.
+func (app *application) failOrganisationDeletion(deletion *data.OrganisationDeletion, err error) {
+	app.logger.Err(err).Int64("organisation_id", deletion.OrganisationID).Msg("deleting the organisation")
+
+	err = app.models.OrganisationDeletions.Fail(deletion, err.Error())
+	if err != nil {
+		app.logger.Err(err).Int64("organisation_id", deletion.OrganisationID).Msg("recording the failed organisation deletion")
+	}
+}
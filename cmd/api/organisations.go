@@ -4,24 +4,32 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/ElOtro/stockup-api/internal/data"
 	"github.com/ElOtro/stockup-api/internal/validator"
 )
 
 type OrganisationInput struct {
-	Name         *string                  `json:"name"`
-	FullName     *string                  `json:"full_name"`
-	CEO          *string                  `json:"ceo"`
-	CEOTitle     *string                  `json:"ceo_title"`
-	CFO          *string                  `json:"cfo"`
-	CFOTitle     *string                  `json:"cfo_title"`
-	Stamp        *string                  `json:"stamp"`
-	CEOSign      *string                  `json:"ceo_sign"`
-	CFOSign      *string                  `json:"cfo_sign"`
-	IsVatPayer   *bool                    `json:"is_vat_payer"`
-	Details      data.OrganisationDetails `json:"details"`
-	BankAccounts []data.BankAccount       `json:"bank_accounts"`
+	Name         *string `json:"name"`
+	FullName     *string `json:"full_name"`
+	CEO          *string `json:"ceo"`
+	CEOTitle     *string `json:"ceo_title"`
+	CFO          *string `json:"cfo"`
+	CFOTitle     *string `json:"cfo_title"`
+	Stamp        *string `json:"stamp"`
+	CEOSign      *string `json:"ceo_sign"`
+	CFOSign      *string `json:"cfo_sign"`
+	IsVatPayer   *bool   `json:"is_vat_payer"`
+	VatRounding  *string `json:"vat_rounding"`
+	RoundingMode *string `json:"rounding_mode"`
+	// The month the fiscal year starts with, quarters and years are closed by it.
+	FiscalYearStart *int                     `json:"fiscal_year_start"`
+	Details         data.OrganisationDetails `json:"details"`
+	BankAccounts    []data.BankAccount       `json:"bank_accounts"`
+	// How the invoices which haven't been sent yet are printed.
+	DraftWatermark       *string `json:"draft_watermark"`
+	DraftHidesRequisites *bool   `json:"draft_hides_requisites"`
 }
 
 // Declare a handler which writes a plain-text response with information about the
@@ -65,17 +73,42 @@ func (app *application) createOrganisationHandler(w http.ResponseWriter, r *http
 	var fields = input.Organisation
 
 	organisation := &data.Organisation{
-		Name:       *fields.Name,
-		FullName:   *fields.FullName,
-		CEO:        *fields.CEO,
-		CEOTitle:   *fields.CEOTitle,
-		CFO:        *fields.CFO,
-		CFOTitle:   *fields.CFOTitle,
-		Stamp:      fields.Stamp,
-		CEOSign:    fields.CEOSign,
-		CFOSign:    fields.CFOSign,
-		IsVatPayer: *fields.IsVatPayer,
-		Details:    &fields.Details,
+		Name:                 *fields.Name,
+		FullName:             *fields.FullName,
+		CEO:                  *fields.CEO,
+		CEOTitle:             *fields.CEOTitle,
+		CFO:                  *fields.CFO,
+		CFOTitle:             *fields.CFOTitle,
+		Stamp:                fields.Stamp,
+		CEOSign:              fields.CEOSign,
+		CFOSign:              fields.CFOSign,
+		IsVatPayer:           *fields.IsVatPayer,
+		VatRounding:          data.DefaultRoundingPolicy.VatRounding,
+		RoundingMode:         data.DefaultRoundingPolicy.Mode,
+		Details:              &fields.Details,
+		FiscalYearStart:      1,
+		DraftWatermark:       data.DefaultDraftWatermark,
+		DraftHidesRequisites: true,
+	}
+
+	if fields.FiscalYearStart != nil {
+		organisation.FiscalYearStart = *fields.FiscalYearStart
+	}
+
+	if fields.DraftWatermark != nil {
+		organisation.DraftWatermark = *fields.DraftWatermark
+	}
+
+	if fields.DraftHidesRequisites != nil {
+		organisation.DraftHidesRequisites = *fields.DraftHidesRequisites
+	}
+
+	if fields.VatRounding != nil {
+		organisation.VatRounding = *fields.VatRounding
+	}
+
+	if fields.RoundingMode != nil {
+		organisation.RoundingMode = *fields.RoundingMode
 	}
 
 	// Initialize a new Validator instance.
@@ -123,6 +156,14 @@ func (app *application) createOrganisationHandler(w http.ResponseWriter, r *http
 	}
 	organisation.BankAccounts = bankAccounts
 
+	// The user who created the organisation becomes its member, so they can switch to it.
+	user := app.contextGetUser(r)
+	err = app.models.Organisations.AddUser(organisation.ID, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// When sending a HTTP response, we want to include a Location header to let the
 	// client know which URL they can find the newly-created resource at.
 	headers := make(http.Header)
@@ -207,6 +248,8 @@ func (app *application) updateOrganisationHandler(w http.ResponseWriter, r *http
 
 	var fields = input.Organisation
 
+	previous := organisation.Requisites()
+
 	if fields.Name != nil {
 		organisation.Name = *fields.Name
 	}
@@ -234,9 +277,33 @@ func (app *application) updateOrganisationHandler(w http.ResponseWriter, r *http
 	organisation.Stamp = fields.Stamp
 	organisation.CEOSign = fields.CEOSign
 	organisation.CFOSign = fields.CFOSign
+	wasVatPayer := organisation.IsVatPayer
 	organisation.IsVatPayer = *fields.IsVatPayer
 	organisation.Details = &fields.Details
 
+	// A changed rounding policy applies to the totals recalculated from now on, stored
+	// invoices keep their amounts until they or their items change.
+	if fields.VatRounding != nil {
+		organisation.VatRounding = *fields.VatRounding
+	}
+
+	if fields.RoundingMode != nil {
+		organisation.RoundingMode = *fields.RoundingMode
+	}
+
+	// Periods closed before keep their dates when the fiscal year is moved.
+	if fields.FiscalYearStart != nil {
+		organisation.FiscalYearStart = *fields.FiscalYearStart
+	}
+
+	if fields.DraftWatermark != nil {
+		organisation.DraftWatermark = *fields.DraftWatermark
+	}
+
+	if fields.DraftHidesRequisites != nil {
+		organisation.DraftHidesRequisites = *fields.DraftHidesRequisites
+	}
+
 	// Validate the updated organisation record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
 	v := validator.New()
@@ -253,6 +320,45 @@ func (app *application) updateOrganisationHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	// Switching is_vat_payer changes the taxation system from today on, invoices issued
+	// before keep the system they were issued under.
+	if organisation.IsVatPayer != wasVatPayer {
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		period := &data.TaxationPeriod{
+			OrganisationID: organisation.ID,
+			TaxationSystem: data.TaxationUSN,
+			ValidFrom:      &today,
+			UserID:         &app.contextGetUser(r).ID,
+		}
+		if organisation.IsVatPayer {
+			period.TaxationSystem = data.TaxationOSNO
+		}
+
+		err = app.models.Taxation.Insert(period)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		organisation.TaxationSystem = period.TaxationSystem
+	}
+
+	// Changed requisites apply from today on, documents dated before keep the ones they
+	// were issued with.
+	if requisites := organisation.Requisites(); !requisites.SameAs(previous) {
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		requisites.ValidFrom = &today
+		requisites.UserID = &app.contextGetUser(r).ID
+
+		err = app.models.Requisites.Insert(requisites, previous)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.recordRequisites(r, requisites)
+	}
+
 	// get all bank accounts
 	bankAccounts, err := app.models.BankAccounts.GetAll(id)
 	if err != nil {
@@ -268,31 +374,3 @@ func (app *application) updateOrganisationHandler(w http.ResponseWriter, r *http
 	}
 
 }
-
-func (app *application) deleteOrganisationHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract the organisation ID from the URL.
-	id, err := app.readIDParam("organisationID", r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
-	}
-
-	// Delete the organisation from the database, sending a 404 Not Found response to the
-	// client if there isn't a matching record.
-	err = app.models.Organisations.Delete(id)
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
-		return
-	}
-
-	// Return a 200 OK status code along with a success message.
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "organisation successfully deleted"}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
-}
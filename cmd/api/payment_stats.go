@@ -0,0 +1,29 @@
+package main
+
+import "net/http"
+
+// The calculatePaymentStats() method recalculates the payment stats of the companies.
+// It is run by the scheduler, nightly by default, errors are logged and the job is
+// retried at the next interval.
+func (app *application) calculatePaymentStats() {
+	updated, err := app.models.Companies.CalculatePaymentStats()
+	if err != nil {
+		app.logger.Err(err).Msg("calculating payment stats")
+	} else {
+		app.logger.Info().Int64("companies", updated).Msg("payment stats calculated")
+	}
+}
+
+// The recalculateCompanyPaymentStats() method refreshes the payment stats of a company
+// once a payment or a return has settled its invoices, so that they don't wait for the
+// scheduler. The change has been made at this point, so errors are only logged.
+func (app *application) recalculateCompanyPaymentStats(r *http.Request, companyID int64) {
+	if companyID == 0 {
+		return
+	}
+
+	err := app.models.Companies.RecalculatePaymentStats(companyID)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+type PaymentInput struct {
+	Date           time.Time  `json:"date"`
+	Number         string     `json:"number"`
+	OrganisationID int64      `json:"organisation_id"`
+	BankAccountID  *int64     `json:"bank_account_id"`
+	CompanyID      int64      `json:"company_id"`
+	Amount         data.Money `json:"amount"`
+	Description    string     `json:"description"`
+	InvoiceID      *int64     `json:"invoice_id"`
+}
+
+// Declare a handler which returns the list of received payments. Passing
+// unallocated=true returns only advances which still can be applied to invoices.
+func (app *application) listPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Pagination
+		data.PaymentFilters
+	}
+
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	// Call r.URL.Query() to get the url.Values map containing the query string data.
+	qs := r.URL.Query()
+
+	input.PaymentFilters.OrganisationID = app.readInt64(qs, "organisation_id", 0, v)
+	input.PaymentFilters.CompanyID = app.readInt64(qs, "company_id", 0, v)
+	input.PaymentFilters.BankAccountID = app.readInt64(qs, "bank_account_id", 0, v)
+	input.PaymentFilters.Start, input.PaymentFilters.End = app.readDateRange(qs, nil, nil, v)
+	input.PaymentFilters.Unallocated = app.readString(qs, "unallocated", "false") == "true"
+
+	// A token bound to an organisation only sees the payments of that organisation.
+	if organisationID := app.contextGetOrganisationID(r); organisationID != 0 {
+		input.PaymentFilters.OrganisationID = organisationID
+	}
+
+	// Read the page and limit query string values into the embedded struct.
+	input.Pagination.Page = app.readInt(qs, "page", 1, v)
+	input.Pagination.Limit, input.Pagination.MaxLimit = app.readPageLimit(qs, "payments", v)
+
+	input.Pagination.Sort = app.readString(qs, "sort", "id")
+	input.Pagination.SortSafelist = []string{"id", "date", "amount", "created_at"}
+
+	input.Pagination.Direction = app.readString(qs, "direction", "asc")
+	input.Pagination.DirectionSafelist = []string{"asc", "desc"}
+
+	// Execute the validation checks on the Pagination struct and send a response
+	// containing the errors if necessary.
+	if data.ValidatePagination(v, input.Pagination); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	payments, metadata, err := app.models.Payments.GetAll(input.PaymentFilters, input.Pagination)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.streamJSON(w, r, http.StatusOK, envelope{"data": payments, "meta": metadata}, app.paginationHeaders(r, metadata))
+}
+
+// The createPaymentHandler() records a received payment. If invoice_id is given the
+// payment is applied to that invoice straight away, otherwise it is kept as an
+// advance until it is applied with applyInvoicePaymentsHandler().
+func (app *application) createPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Payment *PaymentInput `json:"payment"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Payment == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a payment object"))
+		return
+	}
+
+	var fields = input.Payment
+
+	user := app.contextGetUser(r)
+
+	payment := &data.Payment{
+		Date:           fields.Date,
+		Number:         fields.Number,
+		OrganisationID: fields.OrganisationID,
+		BankAccountID:  fields.BankAccountID,
+		CompanyID:      fields.CompanyID,
+		Amount:         fields.Amount,
+		Description:    fields.Description,
+		UserID:         &user.ID,
+	}
+
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	if payment.OrganisationID == 0 {
+		payment.OrganisationID = app.contextGetOrganisationID(r)
+	}
+
+	v.Check(app.organisationAllowed(r, payment.OrganisationID), "organisation_id", "must be the current organisation")
+
+	if data.ValidatePayment(v, payment); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.requireOpenPeriod(w, r, payment.OrganisationID, payment.Date) {
+		return
+	}
+
+	// The invoice has to belong to the same counterparty as the payment.
+	var invoice *data.Invoice
+	if fields.InvoiceID != nil {
+		invoice, err = app.models.Invoices.Get(*fields.InvoiceID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("invoice_id", "invoice not found")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		v.Check(invoice.CompanyID == payment.CompanyID, "invoice_id", "must belong to the same company")
+		v.Check(invoice.OrganisationID == payment.OrganisationID, "invoice_id", "must belong to the same organisation")
+		v.Check(invoice.Status != data.InvoiceStatusCancelled, "invoice_id", "must not be cancelled")
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Payments.Insert(payment)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	allocations := []*data.PaymentAllocation{}
+	if invoice != nil {
+		allocations, err = app.models.Payments.Apply(invoice, []int64{payment.ID})
+		if err != nil && !errors.Is(err, data.ErrInvoiceSettled) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for _, a := range allocations {
+			payment.Unallocated -= a.Amount
+		}
+
+		app.recalculateCompanyPaymentStats(r, invoice.CompanyID)
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": payment, "allocations": allocations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which returns the payment with its allocations to invoices.
+func (app *application) showPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	payment, ok := app.readPayment(w, r)
+	if !ok {
+		return
+	}
+
+	allocations, err := app.models.Payments.GetAllocations(payment.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": payment, "allocations": allocations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updatePaymentHandler() changes the date, the number, the bank account, the
+// amount and the description of a payment. The organisation and the company can't be
+// changed, as the payment may be allocated to their invoices; delete the payment and
+// record it again instead.
+func (app *application) updatePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	payment, ok := app.readPayment(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Payment *PaymentInput `json:"payment"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Payment == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a payment object"))
+		return
+	}
+
+	var fields = input.Payment
+
+	v := validator.New()
+
+	v.Check(fields.OrganisationID == 0 || fields.OrganisationID == payment.OrganisationID, "organisation_id", "can't be changed")
+	v.Check(fields.CompanyID == 0 || fields.CompanyID == payment.CompanyID, "company_id", "can't be changed")
+	v.Check(fields.InvoiceID == nil, "invoice_id", "apply the payment with POST /v1/invoices/{id}/apply_payments")
+
+	previousDate := payment.Date
+
+	payment.Date = fields.Date
+	payment.Number = fields.Number
+	payment.BankAccountID = fields.BankAccountID
+	payment.Amount = fields.Amount
+	payment.Description = fields.Description
+
+	if data.ValidatePayment(v, payment); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The payment may neither be changed in a closed period nor moved into one.
+	if !app.requireOpenPeriod(w, r, payment.OrganisationID, previousDate, payment.Date) {
+		return
+	}
+
+	err = app.models.Payments.Update(payment)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrPaymentOverAllocated):
+			v.AddError("amount", "must not be less than the amount allocated to invoices")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": payment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deletePaymentHandler() deletes a payment which was recorded by mistake. Its
+// allocations are removed, so the invoices it paid are outstanding again.
+func (app *application) deletePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	payment, ok := app.readPayment(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.requireOpenPeriod(w, r, payment.OrganisationID, payment.Date) {
+		return
+	}
+
+	invoiceIDs, err := app.models.Payments.Delete(payment.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrPaymentArchived):
+			app.errorResponse(w, r, http.StatusConflict, "the payment is allocated to archived invoices and can't be deleted")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.recalculateCompanyPaymentStats(r, payment.CompanyID)
+
+	// The payment has been deleted at this point, so a failure to record the event is
+	// logged rather than reported to the client.
+	user := app.contextGetUser(r)
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "delete",
+		Entity:   "payment",
+		EntityID: payment.ID,
+		Details: map[string]interface{}{
+			"number":      payment.Number,
+			"amount":      payment.Amount,
+			"invoice_ids": invoiceIDs,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "payment successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readPayment() helper returns the payment of the paymentID URL parameter. It
+// sends a 404 Not Found response and returns false if there's no such payment or it
+// belongs to an organisation the token may not access.
+func (app *application) readPayment(w http.ResponseWriter, r *http.Request) (*data.Payment, bool) {
+	id, err := app.readIDParam("paymentID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	payment, err := app.models.Payments.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !app.organisationAllowed(r, payment.OrganisationID) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return payment, true
+}
+
+// The applyInvoicePaymentsHandler() offsets unallocated payments (advances) of the
+// invoice's company against the invoice. The client may pass payment_ids to pick the
+// payments explicitly, otherwise the oldest payments are applied first.
+func (app *application) applyInvoicePaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("invoiceID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	invoice, err := app.models.Invoices.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		PaymentIDs []int64 `json:"payment_ids"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	allocations, err := app.models.Payments.Apply(invoice, input.PaymentIDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrInvoiceSettled):
+			v.AddError("invoice", "is already fully paid")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrNoUnallocatedPayments):
+			v.AddError("payment_ids", "no unallocated payments available for this company")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var applied data.Money
+	for _, a := range allocations {
+		applied += a.Amount
+	}
+
+	app.recalculateCompanyPaymentStats(r, invoice.CompanyID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": allocations, "applied": applied}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/go-chi/chi/v5"
+)
+
+// Declare a handler which calculates the late-payment penalty of an invoice as of a
+// day, today by default, for the days no penalty invoice has charged yet. The rate
+// query parameter selects the basis, see readPenaltyRate().
+func (app *application) invoicePenaltyHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	penalty, ok := app.calculatePenalty(w, r, invoice)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": penalty}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which charges the penalty of an invoice, calculated like
+// invoicePenaltyHandler(), with an invoice of its own dated today. The penalty is
+// invoiced as a line of the product given, which has to have a unit and a VAT rate.
+// The invoice gets the bank account and the agreement of the overdue invoice and the
+// payment term and the signer from the company like a new invoice does.
+func (app *application) createPenaltyInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	source, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Penalty struct {
+			ProductID int64 `json:"product_id"`
+		} `json:"penalty"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	penalty, ok := app.calculatePenalty(w, r, source)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	v.Check(penalty.Amount > 0, "penalty", "there is no penalty to charge")
+	v.Check(input.Penalty.ProductID > 0, "product_id", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	product, err := app.models.Products.Get(input.Penalty.ProductID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("product_id", "product not found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v.Check(product.UnitID != nil, "product_id", "must have a unit")
+	v.Check(product.VatRateID != nil, "product_id", "must have a VAT rate")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	today := time.Now()
+
+	if !app.requireOpenPeriod(w, r, source.OrganisationID, today) {
+		return
+	}
+
+	company, err := app.models.Companies.Get(source.CompanyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	invoice := &data.Invoice{
+		IsActive:       true,
+		Date:           today,
+		OrganisationID: source.OrganisationID,
+		CompanyID:      source.CompanyID,
+		BranchID:       source.BranchID,
+		BankAccountID:  source.BankAccountID,
+		AgreementID:    source.AgreementID,
+		VatMode:        data.VatOnTop,
+	}
+
+	if defaults := company.Defaults; defaults != nil && defaults.PaymentTermDays > 0 {
+		dueDate := today.AddDate(0, 0, defaults.PaymentTermDays)
+		invoice.DueDate = &dueDate
+	}
+
+	// A rate which has been replaced since is invoiced with the rate of its chain which
+	// is valid today.
+	vatRate, err := app.models.VatRates.ResolveOn(*product.VatRateID, today)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrVatRateNotValid):
+			v.AddError("product_id", "the VAT rate of the product is not valid today")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.resolveSigner(v, invoice, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	first, last := penalty.Periods[0].Start, penalty.Periods[len(penalty.Periods)-1].End
+
+	items := []*data.InvoiceItem{{
+		Position:  1,
+		ProductID: product.ID,
+		Description: fmt.Sprintf("Пени за просрочку оплаты счета № %s от %s за период с %s по %s",
+			source.Number, source.Date.Format("02.01.2006"), first.Format("02.01.2006"), last.Format("02.01.2006")),
+		UnitID:       *product.UnitID,
+		Quantity:     1,
+		Price:        penalty.Amount,
+		DiscountType: data.DiscountPercent,
+		VatRateID:    vatRate.ID,
+	}}
+
+	if data.ValidateInvoice(v, invoice); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Penalties.Invoice(penalty, user.ID, invoice, items)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPenaltyCharged):
+			app.errorResponse(w, r, http.StatusConflict, "the penalty has been charged by another invoice meanwhile, calculate it again")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	invoice, err = app.models.Invoices.Get(invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/invoices/%d", invoice.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": invoice, "penalty": penalty}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The calculatePenalty() helper calculates the penalty of the invoice with the rate
+// and as_of query parameters. It sends the error response and returns false if the
+// penalty can't be calculated.
+func (app *application) calculatePenalty(w http.ResponseWriter, r *http.Request, invoice *data.Invoice) (*data.Penalty, bool) {
+	qs := r.URL.Query()
+	v := validator.New()
+
+	today := time.Now()
+	asOf := app.readDate(qs, "as_of", &today, v)
+
+	dailyRate, err := app.readPenaltyRate(qs, invoice, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	v.Check(invoice.DueDate != nil, "due_date", "the invoice has no due date")
+	v.Check(invoice.Status != data.InvoiceStatusCancelled, "status", "the invoice is cancelled")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	input := data.PenaltyInput{
+		Amount:       invoice.Amount + invoice.Vat,
+		DueDate:      *invoice.DueDate,
+		WrittenOffAt: invoice.WrittenOffAt,
+		AsOf:         *asOf,
+		DailyRate:    dailyRate,
+	}
+
+	input.Settlements, err = app.models.Penalties.Settlements(invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	input.ChargedUntil, err = app.models.Penalties.ChargedUntil(invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if dailyRate == nil {
+		input.KeyRates, err = app.models.Penalties.KeyRates()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil, false
+		}
+	}
+
+	penalty, err := data.CalculatePenalty(input)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoKeyRate):
+			v.AddError("rate", err.Error())
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	penalty.InvoiceID = invoice.ID
+
+	return penalty, true
+}
+
+// The readPenaltyRate() helper reads the basis of the penalty from the rate query
+// parameter and returns the contractual rate in percent per day, nil for the key rate:
+// "contract" takes the penalty rate of the agreement of the invoice, "key_rate" the
+// key rate and a number is taken as the contractual rate. Without it the rate of the
+// agreement is used if it has one, the key rate otherwise.
+func (app *application) readPenaltyRate(qs url.Values, invoice *data.Invoice, v *validator.Validator) (*float64, error) {
+	s := app.readString(qs, "rate", "")
+
+	if s == data.PenaltyKeyRate {
+		return nil, nil
+	}
+
+	if s == "" || s == data.PenaltyContract {
+		var agreed *float64
+
+		if invoice.AgreementID > 0 {
+			agreement, err := app.models.Agreements.Get(invoice.AgreementID)
+			if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+				return nil, err
+			}
+			if agreement != nil {
+				agreed = agreement.PenaltyRate
+			}
+		}
+
+		if s == data.PenaltyContract && agreed == nil {
+			v.AddError("rate", "the agreement of the invoice has no penalty rate")
+		}
+
+		return agreed, nil
+	}
+
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate <= 0 || rate > 100 {
+		v.AddError("rate", "must be key_rate, contract or a percent per day greater than 0 and at most 100")
+		return nil, nil
+	}
+
+	return &rate, nil
+}
+
+// Declare a handler which lists the key rates of the Bank of Russia, the oldest first.
+func (app *application) listKeyRatesHandler(w http.ResponseWriter, r *http.Request) {
+	rates, err := app.models.Penalties.KeyRates()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": rates}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which sets the key rate in effect from the day of the URL.
+func (app *application) setKeyRateHandler(w http.ResponseWriter, r *http.Request) {
+	effectiveFrom, ok := app.readKeyRateDate(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		KeyRate struct {
+			Rate *float64 `json:"rate"`
+		} `json:"key_rate"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.KeyRate.Rate != nil, "rate", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	rate := &data.KeyRate{EffectiveFrom: effectiveFrom, Rate: *input.KeyRate.Rate}
+
+	if data.ValidateKeyRate(v, rate); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Penalties.SetKeyRate(rate)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": rate}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which removes the key rate in effect from the day of the URL.
+func (app *application) deleteKeyRateHandler(w http.ResponseWriter, r *http.Request) {
+	effectiveFrom, ok := app.readKeyRateDate(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Penalties.DeleteKeyRate(effectiveFrom)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "key rate successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readKeyRateDate() helper returns the day of the URL, YYYY-MM-DD, a key rate is in
+// effect from.
+func (app *application) readKeyRateDate(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	effectiveFrom, err := time.Parse(dateOnlyLayout, chi.URLParam(r, "date"))
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return time.Time{}, false
+	}
+
+	return effectiveFrom, true
+}
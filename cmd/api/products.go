@@ -10,25 +10,28 @@ import (
 )
 
 type ProductInput struct {
-	ID          *int64  `json:"id"`
-	IsActive    bool    `json:"is_active"`
-	ProductType int     `json:"product_type"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	SKU         string  `json:"sku"`
-	Price       float64 `json:"price"`
-	VatRateID   *int64  `json:"vat_rate_id"`
-	UnitID      *int64  `json:"unit_id"`
-	UserID      *int64  `json:"user_id"`
+	ID          *int64     `json:"id"`
+	IsActive    bool       `json:"is_active"`
+	ProductType int        `json:"product_type"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	SKU         string     `json:"sku"`
+	Price       data.Money `json:"price"`
+	VatRateID   *int64     `json:"vat_rate_id"`
+	UnitID      *int64     `json:"unit_id"`
+	UserID      *int64     `json:"user_id"`
 }
 
 // Declare a handler which writes a plain-text response with information about the
 // application status, operating environment and version.
 func (app *application) listProductsHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.ProductFilters
+
+	filters.IncludeDeleted = app.readString(r.URL.Query(), "include_deleted", "false") == "true"
 
 	// Call the GetAll() method to retrieve the products, passing in the various filter
 	// parameters.
-	products, err := app.models.Products.GetAll()
+	products, err := app.models.Products.GetAll(filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -125,6 +128,14 @@ func (app *application) showProductHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if product.ProductType == data.ProductTypeKit {
+		product.Components, err = app.models.KitComponents.GetAll(product.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"data": product}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -167,7 +167,12 @@ func (app *application) updateProjectHandler(w http.ResponseWriter, r *http.Requ
 	// Pass the updated project record to our new Update() method.
 	err = app.models.Projects.Update(project)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The reassignHandler() moves invoices in bulk from one agreement to another of the same
+// company, or from one bank account to another of the same organisation, instead of
+// changing them in the database by hand. With dry_run it only reports the invoices
+// which would be moved and those which would be skipped.
+func (app *application) reassignHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Reassign struct {
+			Field          string     `json:"field"`
+			FromID         int64      `json:"from_id"`
+			ToID           int64      `json:"to_id"`
+			OrganisationID int64      `json:"organisation_id"`
+			Start          *time.Time `json:"start"`
+			End            *time.Time `json:"end"`
+			DryRun         bool       `json:"dry_run"`
+		} `json:"reassign"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	re := &data.Reassignment{
+		Field:          input.Reassign.Field,
+		FromID:         input.Reassign.FromID,
+		ToID:           input.Reassign.ToID,
+		OrganisationID: input.Reassign.OrganisationID,
+		Start:          input.Reassign.Start,
+		End:            input.Reassign.End,
+		DryRun:         input.Reassign.DryRun,
+	}
+
+	// A token bound to an organisation only moves the invoices of that organisation.
+	if organisationID := app.contextGetOrganisationID(r); organisationID != 0 {
+		re.OrganisationID = organisationID
+	}
+
+	v := validator.New()
+
+	if data.ValidateReassignment(v, re); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	switch re.Field {
+	case data.ReassignAgreement:
+		err = app.checkReassignedAgreements(v, re.FromID, re.ToID)
+	case data.ReassignBankAccount:
+		err = app.checkReassignedBankAccounts(v, re.OrganisationID, re.FromID, re.ToID)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Invoices.Reassign(re)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAgreementAmountExceeded):
+			app.agreementAmountExceededResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !re.DryRun && len(re.Invoices) > 0 {
+		ids := make([]int64, 0, len(re.Invoices))
+		for _, invoice := range re.Invoices {
+			ids = append(ids, invoice.ID)
+		}
+
+		// The invoices have been moved at this point, so a failure to record the event
+		// is logged rather than reported to the client.
+		user := app.contextGetUser(r)
+		event := &data.AuditEvent{
+			UserID: &user.ID,
+			Action: "reassign",
+			Entity: "invoice",
+			Details: map[string]interface{}{
+				"field":       re.Field,
+				"from_id":     re.FromID,
+				"to_id":       re.ToID,
+				"invoice_ids": ids,
+				"amount":      re.Amount,
+			},
+		}
+
+		err = app.models.AuditEvents.Insert(event)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": re}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkReassignedAgreements checks that both agreements exist and belong to the same
+// company.
+func (app *application) checkReassignedAgreements(v *validator.Validator, fromID, toID int64) error {
+	from, err := app.models.Agreements.Get(fromID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		v.AddError("from_id", "agreement not found")
+		return nil
+	case err != nil:
+		return err
+	}
+
+	to, err := app.models.Agreements.Get(toID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		v.AddError("to_id", "agreement not found")
+		return nil
+	case err != nil:
+		return err
+	}
+
+	v.Check(from.CompanyID == to.CompanyID, "to_id", "must be an agreement of the same company")
+	return nil
+}
+
+// checkReassignedBankAccounts checks that both bank accounts belong to the organisation,
+// which has to be given as bank accounts of different organisations can't be swapped.
+func (app *application) checkReassignedBankAccounts(v *validator.Validator, organisationID, fromID, toID int64) error {
+	if organisationID == 0 {
+		v.AddError("organisation_id", "must be provided to move invoices between bank accounts")
+		return nil
+	}
+
+	for key, id := range map[string]int64{"from_id": fromID, "to_id": toID} {
+		_, err := app.models.BankAccounts.Get(organisationID, id)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError(key, "must be a bank account of the organisation")
+		case err != nil:
+			return err
+		}
+	}
+
+	return nil
+}
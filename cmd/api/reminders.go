@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/sms"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// How long sending a text message may take.
+const smsSendTimeout = 30 * time.Second
+
+var smsClient = &http.Client{Timeout: smsSendTimeout}
+
+// The sendPaymentReminders() method is the payment reminder job. For every active rule
+// it reminds the companies of their unpaid invoices which are due a reminder, and
+// records every attempt in the communications log. Email rules wait for the SMTP server
+// and SMS rules for the SMS settings of their organisation.
+func (app *application) sendPaymentReminders() {
+	rules, err := app.models.PaymentReminderRules.GetActive()
+	if err != nil {
+		app.logger.Err(err).Msg("reading the payment reminder rules")
+		return
+	}
+
+	today := time.Now()
+	providers := map[int64]sms.Provider{}
+
+	sent := 0
+	for _, rule := range rules {
+		log := app.logger.With().Int64("rule_id", rule.ID).Int64("organisation_id", rule.OrganisationID).Logger()
+
+		var provider sms.Provider
+
+		switch rule.Channel {
+		case data.ChannelEmail:
+			if !app.config.emailEnabled() {
+				continue
+			}
+		case data.ChannelSMS:
+			provider = providers[rule.OrganisationID]
+			if provider == nil {
+				provider, err = app.smsProvider(rule.OrganisationID)
+				if err != nil {
+					if errors.Is(err, data.ErrRecordNotFound) {
+						log.Warn().Msg("the organisation has no SMS settings, SMS reminders are not sent")
+					} else {
+						log.Err(err).Msg("setting up the SMS provider")
+					}
+					continue
+				}
+				providers[rule.OrganisationID] = provider
+			}
+		}
+
+		reminders, err := app.models.PaymentReminderRules.Due(rule, today)
+		if err != nil {
+			log.Err(err).Msg("reading the invoices due a payment reminder")
+			continue
+		}
+
+		for _, reminder := range reminders {
+			communication, err := app.sendPaymentReminder(rule, reminder, provider)
+
+			communication.Status = data.CommunicationSent
+			if err != nil {
+				message := err.Error()
+				communication.Status = data.CommunicationFailed
+				communication.Error = &message
+				log.Err(err).Int64("invoice_id", reminder.InvoiceID).Msg("sending payment reminder")
+			} else {
+				sent++
+			}
+
+			err = app.models.Communications.Insert(communication)
+			if err != nil {
+				log.Err(err).Int64("invoice_id", reminder.InvoiceID).Msg("logging the payment reminder")
+				return
+			}
+		}
+	}
+
+	if sent > 0 {
+		app.logger.Info().Int("reminders", sent).Msg("payment reminders sent")
+	}
+}
+
+// smsProvider returns the SMS provider of the organisation, in the sandbox the fake
+// one whatever its settings are.
+func (app *application) smsProvider(organisationID int64) (sms.Provider, error) {
+	if app.sandbox != nil {
+		return app.sandbox.SMSProvider(organisationID), nil
+	}
+
+	settings, err := app.models.SMSSettings.Get(organisationID)
+	if err != nil {
+		return nil, err
+	}
+
+	return sms.New(settings, smsClient)
+}
+
+// sendPaymentReminder reminds the company of the invoice through the channel of the
+// rule: an email to the first recipient or accountant contact with an email address,
+// or a text message to the first one with a phone. The returned communication is
+// filled as far as the reminder got.
+func (app *application) sendPaymentReminder(rule *data.PaymentReminderRule, reminder *data.DueReminder, provider sms.Provider) (*data.Communication, error) {
+	communication := &data.Communication{
+		OrganisationID: rule.OrganisationID,
+		CompanyID:      reminder.CompanyID,
+		InvoiceID:      &reminder.InvoiceID,
+		Kind:           data.CommunicationReminder,
+		Channel:        rule.Channel,
+		Details:        map[string]interface{}{"rule_id": rule.ID, "days": rule.Days},
+	}
+
+	organisation, err := app.models.Organisations.Get(rule.OrganisationID)
+	if err != nil {
+		return communication, err
+	}
+
+	company, err := app.models.Companies.Get(reminder.CompanyID)
+	if err != nil {
+		return communication, err
+	}
+
+	contact, err := app.reminderContact(reminder.CompanyID, rule.Channel)
+	if err != nil {
+		return communication, err
+	}
+
+	communication.ContactID = &contact.ID
+
+	if rule.Channel == data.ChannelSMS {
+		phone, err := sms.NormalizePhone(contact.Phone)
+		if err != nil {
+			return communication, fmt.Errorf("the phone of the contact: %w", err)
+		}
+
+		text := fmt.Sprintf("%s: напоминаем об оплате счета № %s от %s, остаток %s руб., срок оплаты %s.",
+			organisation.Name, reminder.Number, reminder.Date.Format("02.01.2006"),
+			reminder.Outstanding, reminder.DueDate.Format("02.01.2006"))
+		communication.Subject = text
+
+		ctx, cancel := context.WithTimeout(context.Background(), smsSendTimeout)
+		defer cancel()
+
+		id, err := provider.Send(ctx, phone, text)
+		if id != "" {
+			communication.Details["message_id"] = id
+		}
+
+		return communication, err
+	}
+
+	subject, err := app.mailer.Send(contact.Email, "reminder.tmpl", map[string]interface{}{
+		"Organisation": organisation.Name,
+		"Company":      company.Name,
+		"Contact":      contact.Name,
+		"Number":       reminder.Number,
+		"Date":         reminder.Date,
+		"DueDate":      reminder.DueDate,
+		"Outstanding":  reminder.Outstanding,
+		"Overdue":      rule.Days > 0,
+	})
+	communication.Subject = subject
+
+	return communication, err
+}
+
+// reminderContact returns the contact of the company reminders are sent to through the
+// channel: the first recipient with an address for it, else the first accountant.
+func (app *application) reminderContact(companyID int64, channel string) (*data.Contact, error) {
+	for _, role := range []string{data.ContactRoleRecipient, data.ContactRoleAccountant} {
+		contacts, err := app.models.Contacts.GetAll(companyID, role)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, contact := range contacts {
+			if (channel == data.ChannelSMS && contact.Phone != "") || (channel == data.ChannelEmail && contact.Email != "") {
+				return contact, nil
+			}
+		}
+	}
+
+	if channel == data.ChannelSMS {
+		return nil, errors.New("the company has no recipient or accountant contact with a phone")
+	}
+	return nil, errors.New("the company has no recipient or accountant contact with an email")
+}
+
+// Declare a handler which returns the SMS settings of the organisation, without the
+// password.
+func (app *application) showSMSSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	settings, err := app.models.SMSSettings.Get(organisationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": settings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which sets the SMS provider of the organisation and its
+// credentials. The password is kept when it isn't given and the provider stays the
+// same.
+func (app *application) updateSMSSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		SMSSettings *struct {
+			Provider *string `json:"provider"`
+			Login    *string `json:"login"`
+			Password *string `json:"password"`
+			Sender   *string `json:"sender"`
+		} `json:"sms_settings"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.SMSSettings == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a sms_settings object"))
+		return
+	}
+
+	settings, err := app.models.SMSSettings.Get(organisationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			settings = &data.SMSSettings{OrganisationID: organisationID}
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	fields := input.SMSSettings
+
+	if fields.Provider != nil && *fields.Provider != settings.Provider {
+		settings.Provider = *fields.Provider
+		settings.Password = ""
+	}
+	if fields.Login != nil {
+		settings.Login = *fields.Login
+	}
+	if fields.Password != nil {
+		settings.Password = *fields.Password
+	}
+	if fields.Sender != nil {
+		settings.Sender = *fields.Sender
+	}
+
+	v := validator.New()
+
+	if data.ValidateSMSSettings(v, settings); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.SMSSettings.Save(settings)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.auditSMSSettings(r, "update", settings)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": settings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which removes the SMS settings of the organisation. Its SMS
+// reminder rules stop sending until new settings are saved.
+func (app *application) deleteSMSSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.SMSSettings.Delete(organisationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.auditSMSSettings(r, "delete", &data.SMSSettings{OrganisationID: organisationID})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "sms_settings successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which sends a test message with the SMS settings of the
+// organisation, so the credentials can be checked before reminders go out.
+func (app *application) testSMSSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Phone string `json:"phone"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	phone, err := sms.NormalizePhone(input.Phone)
+
+	v := validator.New()
+	if v.Check(err == nil, "phone", "must be a phone number with the country code"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	provider, err := app.smsProvider(organisationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), smsSendTimeout)
+	defer cancel()
+
+	id, err := provider.Send(ctx, phone, "Тестовое сообщение: настройки SMS работают")
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": map[string]string{"phone": phone, "message_id": id}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The auditSMSSettings() method records a change of the SMS settings, without the
+// credentials.
+func (app *application) auditSMSSettings(r *http.Request, action string, settings *data.SMSSettings) {
+	user := app.contextGetUser(r)
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   action,
+		Entity:   "sms_settings",
+		EntityID: settings.OrganisationID,
+		Details:  map[string]interface{}{"provider": settings.Provider},
+	}
+
+	err := app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// PaymentReminderRuleInput is the body of the requests which create and change
+// reminder rules.
+type PaymentReminderRuleInput struct {
+	Days     *int    `json:"days"`
+	Channel  *string `json:"channel"`
+	IsActive *bool   `json:"is_active"`
+}
+
+func (input *PaymentReminderRuleInput) apply(rule *data.PaymentReminderRule) {
+	if input.Days != nil {
+		rule.Days = *input.Days
+	}
+	if input.Channel != nil {
+		rule.Channel = *input.Channel
+	}
+	if input.IsActive != nil {
+		rule.IsActive = *input.IsActive
+	}
+}
+
+// Declare a handler which returns the payment reminder rules of the organisation.
+func (app *application) listPaymentReminderRulesHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	rules, err := app.models.PaymentReminderRules.GetAll(organisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": rules}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which adds a payment reminder rule to the organisation.
+func (app *application) createPaymentReminderRuleHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		PaymentReminderRule *PaymentReminderRuleInput `json:"payment_reminder_rule"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.PaymentReminderRule == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a payment_reminder_rule object"))
+		return
+	}
+
+	rule := &data.PaymentReminderRule{
+		OrganisationID: organisationID,
+		Channel:        data.ChannelEmail,
+		IsActive:       true,
+	}
+	input.PaymentReminderRule.apply(rule)
+
+	v := validator.New()
+
+	if data.ValidatePaymentReminderRule(v, rule); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.PaymentReminderRules.Insert(rule)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateReminderRule):
+			v.AddError("days", "the organisation already has a rule for this day and channel")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organisations/%d/payment_reminder_rules/%d", organisationID, rule.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": rule}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which changes a payment reminder rule. Invoices the rule already
+// reminded of aren't reminded again.
+func (app *application) updatePaymentReminderRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := app.readPaymentReminderRule(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		PaymentReminderRule *PaymentReminderRuleInput `json:"payment_reminder_rule"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.PaymentReminderRule == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a payment_reminder_rule object"))
+		return
+	}
+
+	input.PaymentReminderRule.apply(rule)
+
+	v := validator.New()
+
+	if data.ValidatePaymentReminderRule(v, rule); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.PaymentReminderRules.Update(rule)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateReminderRule):
+			v.AddError("days", "the organisation already has a rule for this day and channel")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": rule}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which removes a payment reminder rule.
+func (app *application) deletePaymentReminderRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := app.readPaymentReminderRule(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.PaymentReminderRules.Delete(rule.OrganisationID, rule.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "payment_reminder_rule successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readPaymentReminderRule reads the reminder rule of the URL, sending the response
+// itself if there is none.
+func (app *application) readPaymentReminderRule(w http.ResponseWriter, r *http.Request) (*data.PaymentReminderRule, bool) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	rule, err := app.models.PaymentReminderRules.Get(organisationID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return rule, true
+}
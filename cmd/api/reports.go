@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/ElOtro/stockup-api/internal/xlsx"
+)
+
+// The receivablesReportHandler() returns outstanding balances per company.
+func (app *application) receivablesReportHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.ReportFilters
+
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters.OrganisationID = app.readInt64(qs, "organisation_id", app.contextGetOrganisationID(r), v)
+	filters.CompanyID = app.readInt64(qs, "company_id", 0, v)
+	filters.GroupID = app.readInt64(qs, "group_id", 0, v)
+
+	v.Check(app.organisationAllowed(r, filters.OrganisationID), "organisation_id", "must be the current organisation")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	receivables, err := app.models.Reports.Receivables(r.Context(), filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.exportingReport(r) {
+		sheet := xlsx.Sheet{Name: "receivables", Columns: balanceColumns("company_id", "company")}
+		var totals balanceTotals
+		for _, row := range receivables {
+			var id, name interface{}
+			if row.Company != nil {
+				id, name = row.Company.ID, row.Company.Name
+			}
+			sheet.Rows = append(sheet.Rows, []interface{}{id, name, row.InvoicesCount, row.Amount, row.Paid, row.Outstanding})
+			totals.add(row.InvoicesCount, row.Amount, row.Paid, row.Outstanding)
+		}
+		sheet.Totals = totals.row()
+
+		err = app.writeReport(w, r, "receivables", sheet)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": receivables}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The groupBalancesReportHandler() returns outstanding balances consolidated per
+// company group.
+func (app *application) groupBalancesReportHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.ReportFilters
+
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters.OrganisationID = app.readInt64(qs, "organisation_id", app.contextGetOrganisationID(r), v)
+	filters.GroupID = app.readInt64(qs, "group_id", 0, v)
+
+	v.Check(app.organisationAllowed(r, filters.OrganisationID), "organisation_id", "must be the current organisation")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	balances, err := app.models.Reports.GroupBalances(r.Context(), filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.exportingReport(r) {
+		sheet := xlsx.Sheet{Name: "group_balances", Columns: balanceColumns("group_id", "group")}
+		var totals balanceTotals
+		for _, row := range balances {
+			var id, name interface{}
+			if row.Group != nil {
+				id, name = row.Group.ID, row.Group.Name
+			}
+			sheet.Rows = append(sheet.Rows, []interface{}{id, name, row.InvoicesCount, row.Amount, row.Paid, row.Outstanding})
+			totals.add(row.InvoicesCount, row.Amount, row.Paid, row.Outstanding)
+		}
+		sheet.Totals = totals.row()
+
+		err = app.writeReport(w, r, "group_balances", sheet)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": balances}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The numberGapsReportHandler() returns missing and duplicate invoice numbers of an
+// organisation for a year.
+func (app *application) numberGapsReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	organisationID := app.readInt64(qs, "organisation_id", app.contextGetOrganisationID(r), v)
+	year := app.readInt(qs, "year", time.Now().Year(), v)
+
+	v.Check(organisationID > 0, "organisation_id", "must be provided")
+	v.Check(app.organisationAllowed(r, organisationID), "organisation_id", "must be the current organisation")
+	v.Check(year >= 2000 && year <= 9999, "year", "must be a valid year")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	report, err := app.models.Reports.NumberGaps(r.Context(), organisationID, year)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.exportingReport(r) {
+		gaps := xlsx.Sheet{
+			Name:    "gaps",
+			Columns: []xlsx.Column{{Title: "from", Kind: xlsx.Integer}, {Title: "to", Kind: xlsx.Integer}, {Title: "missing", Kind: xlsx.Integer}},
+		}
+		var missing int64
+		for _, gap := range report.Gaps {
+			gaps.Rows = append(gaps.Rows, []interface{}{gap.From, gap.To, gap.Missing})
+			missing += gap.Missing
+		}
+		gaps.Totals = []interface{}{"total", nil, missing}
+
+		duplicates := xlsx.Sheet{Name: "duplicates", Columns: []xlsx.Column{{Title: "number"}, {Title: "invoice_ids", Width: 30}}}
+		for _, duplicate := range report.Duplicates {
+			ids := make([]string, len(duplicate.InvoiceIDs))
+			for i, id := range duplicate.InvoiceIDs {
+				ids[i] = strconv.FormatInt(id, 10)
+			}
+			duplicates.Rows = append(duplicates.Rows, []interface{}{duplicate.Number, strings.Join(ids, " ")})
+		}
+
+		nonNumeric := xlsx.Sheet{Name: "non_numeric", Columns: []xlsx.Column{{Title: "number", Width: 30}}}
+		for _, number := range report.NonNumeric {
+			nonNumeric.Rows = append(nonNumeric.Rows, []interface{}{number})
+		}
+
+		err = app.writeReport(w, r, fmt.Sprintf("number_gaps_%d", year), gaps, duplicates, nonNumeric)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The invoiceReportHandler() groups the invoices of a period by the dimensions in
+// group_by and sums up the metrics, e.g. ?group_by=company,month&metrics=amount,count.
+func (app *application) invoiceReportHandler(w http.ResponseWriter, r *http.Request) {
+	var params data.InvoiceReportParams
+
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	params.OrganisationID = app.readInt64(qs, "organisation_id", app.contextGetOrganisationID(r), v)
+	params.CompanyID = app.readInt64(qs, "company_id", 0, v)
+	params.Start, params.End = app.readDateRange(qs, nil, nil, v)
+	params.GroupBy = app.readCSV(qs, "group_by", nil)
+	params.Metrics = app.readCSV(qs, "metrics", []string{"amount", "vat", "count"})
+
+	v.Check(app.organisationAllowed(r, params.OrganisationID), "organisation_id", "must be the current organisation")
+
+	if data.ValidateInvoiceReportParams(v, params); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	report, err := app.models.Reports.Invoices(r.Context(), params)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.exportingReport(r) {
+		sheet := xlsx.Sheet{Name: "invoices"}
+		for _, dimension := range params.GroupBy {
+			column := xlsx.Column{Title: dimension, Width: 30}
+			if dimension == "month" {
+				column.Kind, column.Width = xlsx.Month, 12
+			}
+			sheet.Columns = append(sheet.Columns, column)
+		}
+		for _, metric := range params.Metrics {
+			kind := xlsx.Money
+			if metric == "count" {
+				kind = xlsx.Integer
+			}
+			sheet.Columns = append(sheet.Columns, xlsx.Column{Title: metric, Kind: kind, Width: 16})
+		}
+
+		for _, row := range report.Rows {
+			values := make([]interface{}, 0, len(sheet.Columns))
+			for _, dimension := range params.GroupBy {
+				values = append(values, reportValue(row[dimension]))
+			}
+			for _, metric := range params.Metrics {
+				values = append(values, row[metric])
+			}
+			sheet.Rows = append(sheet.Rows, values)
+		}
+
+		sheet.Totals = make([]interface{}, len(params.GroupBy), len(sheet.Columns))
+		sheet.Totals[0] = "total"
+		for _, metric := range params.Metrics {
+			sheet.Totals = append(sheet.Totals, report.Totals[metric])
+		}
+
+		err = app.writeReport(w, r, "invoices", sheet)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": report.Rows, "totals": report.Totals}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// reportValue returns the value of a dimension of a report row as it is exported.
+// Records like a company are exported as their name and months as dates, so they are
+// written in the format of the locale.
+func reportValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return value["name"]
+	case string:
+		if month, err := time.Parse("2006-01", value); err == nil {
+			return month
+		}
+	}
+	return value
+}
+
+// exportingReport reports whether the report is downloaded as a file rather than
+// returned as JSON.
+func (app *application) exportingReport(r *http.Request) bool {
+	contentType := app.contextGetContentType(r)
+	return contentType == contentTypeCSV || contentType == contentTypeXLSX
+}
+
+// The writeReport() helper sends the sheets of a report as a CSV or XLSX file, as it
+// was negotiated, named after the report, with the numbers and dates in the locale of
+// the request. A CSV file only has the rows of the first sheet, without the totals.
+func (app *application) writeReport(w http.ResponseWriter, r *http.Request, name string, sheets ...xlsx.Sheet) error {
+	loc := app.contextGetLocale(r)
+
+	if app.contextGetContentType(r) == contentTypeXLSX {
+		return app.writeXLSX(w, http.StatusOK, name+".xlsx", loc, sheets...)
+	}
+
+	sheet := sheets[0]
+
+	rows := make([][]string, 0, len(sheet.Rows)+1)
+
+	header := make([]string, len(sheet.Columns))
+	for i, column := range sheet.Columns {
+		header[i] = column.Title
+	}
+	rows = append(rows, header)
+
+	for _, row := range sheet.Rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			if month, ok := value.(time.Time); ok && i < len(sheet.Columns) && sheet.Columns[i].Kind == xlsx.Month {
+				record[i] = loc.Month(month)
+				continue
+			}
+			record[i] = loc.Format(value)
+		}
+		rows = append(rows, record)
+	}
+
+	return app.writeCSV(w, http.StatusOK, name+".csv", loc, rows)
+}
+
+// balanceColumns returns the columns of the balance reports, which start with the id
+// and the name of what the balances are summed up by.
+func balanceColumns(id, name string) []xlsx.Column {
+	return []xlsx.Column{
+		{Title: id, Kind: xlsx.Integer},
+		{Title: name, Width: 40},
+		{Title: "invoices_count", Kind: xlsx.Integer},
+		{Title: "amount", Kind: xlsx.Money, Width: 16},
+		{Title: "paid", Kind: xlsx.Money, Width: 16},
+		{Title: "outstanding", Kind: xlsx.Money, Width: 16},
+	}
+}
+
+// balanceTotals sums up the rows of a balance report.
+type balanceTotals struct {
+	invoicesCount int64
+	amount        data.Money
+	paid          data.Money
+	outstanding   data.Money
+}
+
+func (t *balanceTotals) add(invoicesCount int64, amount, paid, outstanding data.Money) {
+	t.invoicesCount += invoicesCount
+	t.amount += amount
+	t.paid += paid
+	t.outstanding += outstanding
+}
+
+// row returns the totals row, labelled in the name column.
+func (t *balanceTotals) row() []interface{} {
+	return []interface{}{nil, "total", t.invoicesCount, t.amount, t.paid, t.outstanding}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+type RequisitesInput struct {
+	ValidFrom *time.Time                `json:"valid_from"`
+	FullName  *string                   `json:"full_name"`
+	CEO       *string                   `json:"ceo"`
+	CEOTitle  *string                   `json:"ceo_title"`
+	CFO       *string                   `json:"cfo"`
+	CFOTitle  *string                   `json:"cfo_title"`
+	Details   *data.OrganisationDetails `json:"details"`
+}
+
+// The listRequisitesHandler() returns the requisites history of the organisation, which
+// tells for any date what its documents are printed with.
+func (app *application) listRequisitesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	requisites, err := app.models.Requisites.GetAll(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": requisites}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createRequisitesHandler() changes the requisites of the organisation from the
+// given date, which may be in the past or in the future. Fields which aren't sent keep
+// the current values. Documents dated before keep the requisites they were issued with.
+func (app *application) createRequisitesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	organisation, err := app.models.Organisations.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Requisites *RequisitesInput `json:"requisites"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Requisites == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a requisites object"))
+		return
+	}
+
+	fields := input.Requisites
+	user := app.contextGetUser(r)
+
+	previous := organisation.Requisites()
+	requisites := organisation.Requisites()
+	requisites.ValidFrom = fields.ValidFrom
+	requisites.UserID = &user.ID
+
+	if fields.FullName != nil {
+		requisites.FullName = *fields.FullName
+	}
+
+	if fields.CEO != nil {
+		requisites.CEO = *fields.CEO
+	}
+
+	if fields.CEOTitle != nil {
+		requisites.CEOTitle = *fields.CEOTitle
+	}
+
+	if fields.CFO != nil {
+		requisites.CFO = *fields.CFO
+	}
+
+	if fields.CFOTitle != nil {
+		requisites.CFOTitle = *fields.CFOTitle
+	}
+
+	if fields.Details != nil {
+		requisites.Details = fields.Details
+	}
+
+	v := validator.New()
+
+	if data.ValidateOrganisationRequisites(v, requisites); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Requisites.Insert(requisites, previous)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordRequisites(r, requisites)
+
+	history, err := app.models.Requisites.GetAll(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": requisites, "history": history}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordRequisites records the change of the requisites as an audit event. The change is
+// already stored at this point, so a failure is logged rather than reported.
+func (app *application) recordRequisites(r *http.Request, requisites *data.OrganisationRequisites) {
+	event := &data.AuditEvent{
+		UserID:   requisites.UserID,
+		Action:   "change_requisites",
+		Entity:   "organisation",
+		EntityID: requisites.OrganisationID,
+		Details: map[string]interface{}{
+			"valid_from": requisites.ValidFrom.Format(dateOnlyLayout),
+			"full_name":  requisites.FullName,
+			"ceo":        requisites.CEO,
+			"cfo":        requisites.CFO,
+		},
+	}
+
+	err := app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The organisationOn() helper returns the organisation with the requisites in force on
+// the date, which its documents of that date are printed with.
+func (app *application) organisationOn(id int64, date time.Time) (*data.Organisation, error) {
+	organisation, err := app.models.Organisations.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	requisites, err := app.models.Requisites.GetOn(id, date)
+	switch {
+	case err == nil:
+		organisation.ApplyRequisites(requisites)
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	return organisation, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+type ReturnItemInput struct {
+	InvoiceItemID int64   `json:"invoice_item_id"`
+	Quantity      float64 `json:"quantity"`
+}
+
+// Declare a handler which returns the returns of an invoice together with the items
+// which can still be returned.
+func (app *application) listReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	returns, err := app.models.Returns.GetAll(invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	returnable, err := app.models.Returns.Returnable(invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	items := make([]*data.ReturnableItem, 0, len(returnable))
+	for _, item := range returnable {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].InvoiceItemID < items[j].InvoiceItemID })
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": returns, "returnable": items}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which records goods returned against an invoice. The return gets
+// the next credit note number and its amount settles the invoice like a payment. The
+// return is dated today by default and its date must be in an open period; the invoice
+// itself may be in a closed one.
+func (app *application) createReturnHandler(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := app.readInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	if invoice.Archived {
+		app.archivedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Return struct {
+			Date   *time.Time        `json:"date"`
+			Reason string            `json:"reason"`
+			Items  []ReturnItemInput `json:"return_items"`
+		} `json:"return"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if invoice.IsAdvance {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "goods can't be returned against an advance invoice")
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	ret := &data.Return{
+		Date:           time.Now(),
+		OrganisationID: invoice.OrganisationID,
+		CompanyID:      invoice.CompanyID,
+		InvoiceID:      invoice.ID,
+		Reason:         input.Return.Reason,
+		UserID:         &user.ID,
+		Items:          make([]*data.ReturnItem, 0, len(input.Return.Items)),
+	}
+
+	if input.Return.Date != nil {
+		ret.Date = *input.Return.Date
+	}
+
+	for _, item := range input.Return.Items {
+		ret.Items = append(ret.Items, &data.ReturnItem{InvoiceItemID: item.InvoiceItemID, Quantity: item.Quantity})
+	}
+
+	returnable, err := app.models.Returns.Returnable(invoice.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateReturn(v, ret, returnable); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.requireOpenPeriod(w, r, ret.OrganisationID, ret.Date) {
+		return
+	}
+
+	err = app.models.Returns.Insert(ret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrReturnExceedsShipped):
+			v.AddError("return_items", "must not return more than was shipped and not returned yet")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The return has been recorded at this point, so a failure to record the event is
+	// logged rather than reported to the client.
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "return",
+		Entity:   "invoice",
+		EntityID: invoice.ID,
+		Details: map[string]interface{}{
+			"return_id": ret.ID,
+			"number":    ret.Number,
+			"amount":    ret.Amount,
+			"vat":       ret.Vat,
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	app.recalculateCompanyPaymentStats(r, invoice.CompanyID)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": ret}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
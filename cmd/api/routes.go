@@ -8,51 +8,159 @@ import (
 
 func (app *application) routes() *chi.Mux {
 	r := chi.NewRouter()
-	cors := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Requested-With", "X-CSRF-Token"},
-		AllowCredentials: true,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
-	})
+	cors := cors.New(app.config.corsOptions())
 	r.Use(cors.Handler)
 	// A good base middleware stack
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(app.logRequest)
 	r.Use(middleware.Recoverer)
+	r.Use(app.compressor().Handler)
 	// r.Use(app.getQueryParams)
 
+	// pprof and expvar are only served on a developer's machine.
+	if app.config.isDevelopment() {
+		r.Mount("/debug", middleware.Profiler())
+	}
+
+	// Public invoice links are short and outside of the versioned API, they are opened
+	// by the customers in their browsers.
+	r.Get("/l/{slug}", app.showInvoiceLinkHandler)
+
 	// RESTy routes for "invoices" resource
 	r.Route("/v1", func(r chi.Router) {
+		// Request bodies have to be JSON; every group of routes declares the media types
+		// it responds with.
+		r.Use(app.requireJSON)
+		r.Use(app.timeout)
+
 		r.Group(func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Post("/users", app.registerUserHandler)
 			r.Post("/auth", app.loginHandler)
 		})
 
+		// Avatars are images shown by the browser without the token.
+		r.Get("/avatars/{name}", app.showAvatarHandler)
+
 		r.Group(func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Use(app.authenticate)
 			r.Get("/auth/user", app.showUserHandler)
+			r.Get("/auth/organisations", app.listUserOrganisationsHandler)
+			r.Post("/auth/switch_organisation", app.switchOrganisationHandler)
+			r.Get("/auth/features", app.listFeaturesHandler)
+			r.Patch("/users/me", app.updateProfileHandler)
+			r.Put("/users/me/password", app.changePasswordHandler)
+			r.Put("/users/me/avatar", app.updateAvatarHandler)
+			r.Delete("/users/me/avatar", app.deleteAvatarHandler)
+			r.Get("/users/me/preferences", app.showUserPreferencesHandler)
+			r.Patch("/users/me/preferences", app.updateUserPreferencesHandler)
+		})
+
+		r.Route("/integration_tokens", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticate)
+			{
+				r.Get("/", app.listIntegrationTokensHandler)
+				r.Post("/", app.requirePermission("integrations:manage", app.createIntegrationTokenHandler))
+				r.Delete("/{ID}", app.revokeIntegrationTokenHandler)
+			}
+		})
+
+		// The endpoints for no-code platforms take integration tokens and flat JSON,
+		// see docs/integrations.md.
+		r.Route("/integrations", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticateIntegration)
+			{
+				r.Get("/me", app.integrationMeHandler)
+				r.Get("/invoices", app.requireScope("invoices:read", app.latestInvoicesIntegrationHandler))
+				r.Get("/invoices/{invoiceID}", app.requireScope("invoices:read", app.showInvoiceIntegrationHandler))
+				r.Post("/invoices", app.requireScope("invoices:write", app.createInvoiceIntegrationHandler))
+			}
 		})
 
 		r.Route("/organisations", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Use(app.authenticate)
 			{
-				r.Get("/", app.listOrganisationsHandler)
-				r.Get("/{organisationID}", app.showOrganisationHandler)
-				r.Post("/", app.createOrganisationHandler)
-				r.Patch("/{organisationID}", app.updateOrganisationHandler)
-				r.Delete("/{organisationID}", app.deleteOrganisationHandler)
+				// Only the organisations themselves are versioned by the cache, not the
+				// records nested under them.
+				r.With(app.cacheable("organisations")).Get("/", app.listOrganisationsHandler)
+				r.With(app.cacheable("organisations")).Post("/", app.createOrganisationHandler)
+
+				r.Route("/{organisationID}", func(r chi.Router) {
+					r.Use(app.requireOrganisationAccess)
+
+					r.With(app.cacheable("organisations")).Get("/", app.showOrganisationHandler)
+					r.With(app.cacheable("organisations")).Patch("/", app.updateOrganisationHandler)
+					r.With(app.cacheable("organisations")).Delete("/", app.requirePermission("organisations:delete", app.deleteOrganisationHandler))
+					r.Get("/deletion_preview", app.requirePermission("organisations:delete", app.deletionPreviewHandler))
+					r.Get("/deletion", app.showDeletionHandler)
+
+					r.Get("/taxation", app.listTaxationHandler)
+					r.Post("/taxation", app.createTaxationHandler)
+
+					r.Get("/requisites", app.listRequisitesHandler)
+					r.Post("/requisites", app.createRequisitesHandler)
+
+					r.Get("/closed_periods", app.listClosedPeriodsHandler)
+					r.Post("/closed_periods", app.requirePermission("periods:close", app.closePeriodHandler))
+					r.Delete("/closed_periods/{ID}", app.requirePermission("periods:close", app.reopenPeriodHandler))
+
+					r.Get("/accounting_connectors", app.requirePermission("accounting:manage", app.listAccountingConnectorsHandler))
+					r.Post("/accounting_connectors", app.requirePermission("accounting:manage", app.createAccountingConnectorHandler))
+					r.Get("/accounting_connectors/{ID}", app.requirePermission("accounting:manage", app.showAccountingConnectorHandler))
+					r.Patch("/accounting_connectors/{ID}", app.requirePermission("accounting:manage", app.updateAccountingConnectorHandler))
+					r.Delete("/accounting_connectors/{ID}", app.requirePermission("accounting:manage", app.deleteAccountingConnectorHandler))
+					r.Get("/accounting_connectors/{ID}/syncs", app.requirePermission("accounting:manage", app.listAccountingSyncsHandler))
+					r.Post("/accounting_connectors/{ID}/syncs/{syncID}/retry", app.requirePermission("accounting:manage", app.retryAccountingSyncHandler))
+
+					r.Get("/payment_reminder_rules", app.requirePermission("reminders:manage", app.listPaymentReminderRulesHandler))
+					r.Post("/payment_reminder_rules", app.requirePermission("reminders:manage", app.createPaymentReminderRuleHandler))
+					r.Patch("/payment_reminder_rules/{ID}", app.requirePermission("reminders:manage", app.updatePaymentReminderRuleHandler))
+					r.Delete("/payment_reminder_rules/{ID}", app.requirePermission("reminders:manage", app.deletePaymentReminderRuleHandler))
+
+					r.Get("/settings/sms", app.requirePermission("reminders:manage", app.showSMSSettingsHandler))
+					r.Patch("/settings/sms", app.requirePermission("reminders:manage", app.updateSMSSettingsHandler))
+					r.Delete("/settings/sms", app.requirePermission("reminders:manage", app.deleteSMSSettingsHandler))
+					r.Post("/settings/sms/test", app.requirePermission("reminders:manage", app.testSMSSettingsHandler))
+
+					r.Get("/settings/numbering", app.listNumberingHandler)
+					r.Get("/settings/numbering/{documentType}", app.showNumberingHandler)
+					r.Patch("/settings/numbering/{documentType}", app.updateNumberingHandler)
+
+					r.Get("/bank_accounts", app.listBankAccountsHandler)
+					r.Get("/bank_accounts/{ID}", app.showBankAccountHandler)
+					r.Get("/bank_accounts/{ID}/activity", app.bankAccountActivityHandler)
+					r.Post("/bank_accounts", app.createBankAccountHandler)
+					r.Patch("/bank_accounts/{ID}", app.updateBankAccountHandler)
+					r.Delete("/bank_accounts/{ID}", app.deleteBankAccountHandler)
 
-				r.Get("/{organisationID}/bank_accounts", app.listBankAccountsHandler)
-				r.Get("/{organisationID}/bank_accounts/{ID}", app.showBankAccountHandler)
-				r.Post("/{organisationID}/bank_accounts", app.createBankAccountHandler)
-				r.Patch("/{organisationID}/bank_accounts/{ID}", app.updateBankAccountHandler)
-				r.Delete("/{organisationID}/bank_accounts/{ID}", app.deleteBankAccountHandler)
+					r.Get("/warehouses", app.listWarehousesHandler)
+					r.Get("/warehouses/{ID}", app.showWarehouseHandler)
+					r.Post("/warehouses", app.createWarehouseHandler)
+					r.Patch("/warehouses/{ID}", app.updateWarehouseHandler)
+					r.Delete("/warehouses/{ID}", app.deleteWarehouseHandler)
+					r.Get("/warehouses/{ID}/movements", app.listStockMovementsHandler)
+					r.Post("/warehouses/{ID}/receipts", app.createReceiptHandler)
+					r.Post("/warehouses/{ID}/write_offs", app.requirePermission("stock:write_off", app.createWriteOffHandler))
+					r.Get("/stock", app.stockHandler)
+
+					r.Get("/description_snippets", app.listDescriptionSnippetsHandler)
+					r.Get("/description_snippets/suggestions", app.suggestDescriptionSnippetsHandler)
+					r.Get("/description_snippets/{ID}", app.showDescriptionSnippetHandler)
+					r.Post("/description_snippets", app.createDescriptionSnippetHandler)
+					r.Patch("/description_snippets/{ID}", app.updateDescriptionSnippetHandler)
+					r.Post("/description_snippets/{ID}/use", app.useDescriptionSnippetHandler)
+					r.Delete("/description_snippets/{ID}", app.deleteDescriptionSnippetHandler)
+				})
 			}
 		})
 
 		r.Route("/companies", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Use(app.authenticate)
 			{
 				r.Get("/", app.listCompaniesHandler)
@@ -61,16 +169,50 @@ func (app *application) routes() *chi.Mux {
 				r.Post("/", app.createCompanyHandler)
 				r.Patch("/{companyID}", app.updateCompanyHandler)
 				r.Delete("/{companyID}", app.deleteCompanyHandler)
+				r.Get("/{companyID}/frequent_items", app.listFrequentItemsHandler)
+				r.Get("/{companyID}/communications", app.listCommunicationsHandler)
+				r.Post("/{companyID}/communications", app.createCommunicationHandler)
+				r.Post("/{companyID}/anonymize", app.requirePermission("companies:anonymize", app.anonymizeCompanyHandler))
+				r.Post("/{companyID}/merge", app.requirePermission("companies:merge", app.mergeCompaniesHandler))
 
 				r.Get("/{companyID}/contacts", app.listContactsHandler)
 				r.Get("/{companyID}/contacts/{ID}", app.showContactHandler)
 				r.Post("/{companyID}/contacts", app.createContactHandler)
 				r.Patch("/{companyID}/contacts/{ID}", app.updateContactHandler)
 				r.Delete("/{companyID}/contacts/{ID}", app.deleteContactHandler)
+
+				r.Get("/{companyID}/branches", app.listCompanyBranchesHandler)
+				r.Get("/{companyID}/branches/{ID}", app.showCompanyBranchHandler)
+				r.Post("/{companyID}/branches", app.createCompanyBranchHandler)
+				r.Patch("/{companyID}/branches/{ID}", app.updateCompanyBranchHandler)
+				r.Delete("/{companyID}/branches/{ID}", app.deleteCompanyBranchHandler)
+			}
+		})
+
+		r.Route("/contacts", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeCSV))
+			r.Use(app.authenticate)
+			r.Use(app.localize)
+			{
+				r.Get("/export", app.requirePermission("contacts:export", app.exportContactsHandler))
+			}
+		})
+
+		r.Route("/company_groups", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticate)
+			{
+				r.Get("/", app.listCompanyGroupsHandler)
+				r.Get("/{groupID}", app.showCompanyGroupHandler)
+				r.Get("/{groupID}/statement", app.companyGroupStatementHandler)
+				r.Post("/", app.createCompanyGroupHandler)
+				r.Patch("/{groupID}", app.updateCompanyGroupHandler)
+				r.Delete("/{groupID}", app.deleteCompanyGroupHandler)
 			}
 		})
 
 		r.Route("/agreements", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Use(app.authenticate)
 			{
 				r.Get("/", app.listAgreementsHandler)
@@ -78,10 +220,27 @@ func (app *application) routes() *chi.Mux {
 				r.Post("/", app.createAgreementHandler)
 				r.Patch("/{agreementID}", app.updateAgreementHandler)
 				r.Delete("/{agreementID}", app.deleteAgreementHandler)
+				r.Post("/{agreementID}/generate_act", app.generateActHandler)
+			}
+		})
+
+		r.Route("/billing_plans", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticate)
+			{
+				r.Get("/", app.listBillingPlansHandler)
+				r.Post("/", app.requirePermission("billing_plans:manage", app.createBillingPlanHandler))
+				r.Get("/{planID}", app.showBillingPlanHandler)
+				r.Patch("/{planID}", app.requirePermission("billing_plans:manage", app.updateBillingPlanHandler))
+				r.Delete("/{planID}", app.requirePermission("billing_plans:manage", app.deleteBillingPlanHandler))
+				r.Get("/{planID}/periods", app.listBillingPeriodsHandler)
+				r.Get("/{planID}/usage", app.listBillingPlanUsageHandler)
+				r.Post("/{planID}/usage", app.createBillingPlanUsageHandler)
 			}
 		})
 
 		r.Route("/projects", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Use(app.authenticate)
 			{
 				r.Get("/", app.listProjectsHandler)
@@ -93,6 +252,7 @@ func (app *application) routes() *chi.Mux {
 		})
 
 		r.Route("/products", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Use(app.authenticate)
 			{
 				r.Get("/", app.listProductsHandler)
@@ -100,11 +260,26 @@ func (app *application) routes() *chi.Mux {
 				r.Post("/", app.createProductHandler)
 				r.Patch("/{productID}", app.updateProductHandler)
 				r.Delete("/{productID}", app.deleteProductHandler)
+				r.Post("/{productID}/merge", app.requirePermission("products:merge", app.mergeProductsHandler))
+				r.Get("/{productID}/components", app.listKitComponentsHandler)
+				r.Put("/{productID}/components", app.replaceKitComponentsHandler)
+			}
+		})
+
+		// The enums only change with a deploy, which the ETag of cacheable() covers.
+		r.Route("/meta", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticate)
+			r.Use(app.cacheable("meta"))
+			{
+				r.Get("/enums", app.listEnumsHandler)
 			}
 		})
 
 		r.Route("/units", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Use(app.authenticate)
+			r.Use(app.cacheable("units"))
 			{
 				r.Get("/", app.listUnitsHandler)
 				r.Get("/{unitID}", app.showUnitHandler)
@@ -115,7 +290,9 @@ func (app *application) routes() *chi.Mux {
 		})
 
 		r.Route("/vat_rates", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
 			r.Use(app.authenticate)
+			r.Use(app.cacheable("vat_rates"))
 			{
 				r.Get("/", app.listVatRatesHandler)
 				r.Get("/{vatRateID}", app.showVatRateHandler)
@@ -125,23 +302,187 @@ func (app *application) routes() *chi.Mux {
 			}
 		})
 
+		// The key rates the statutory late-payment penalties are calculated with.
+		r.Route("/key_rates", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticate)
+			{
+				r.Get("/", app.listKeyRatesHandler)
+				r.Put("/{date}", app.requirePermission("admin:maintenance", app.setKeyRateHandler))
+				r.Delete("/{date}", app.requirePermission("admin:maintenance", app.deleteKeyRateHandler))
+			}
+		})
+
 		r.Route("/invoices", func(r chi.Router) {
 			r.Use(app.authenticate)
 			{
-				r.Get("/", app.listInvoicesHandler)
-				r.Get("/{invoiceID}", app.showInvoiceHandler)
-				r.Post("/", app.createInvoiceHandler)
-				r.Patch("/{invoiceID}", app.updateInvoiceHandler)
-				r.Delete("/{invoiceID}", app.deleteInvoiceHandler)
+				r.With(app.negotiate(contentTypeJSON)).Get("/", app.listInvoicesHandler)
+				r.With(app.negotiate(contentTypeJSON)).Post("/", app.createInvoiceHandler)
+				r.With(app.negotiate(contentTypeJSON)).Get("/prefill", app.prefillInvoiceHandler)
+				r.With(app.negotiate(contentTypeJSON)).Post("/send_batch", app.createSendBatchHandler)
+				r.With(app.negotiate(contentTypeJSON)).Get("/send_batch/{batchID}", app.showSendBatchHandler)
+
+				// Deleted invoices aren't found by the routes below, restoring checks the
+				// access itself.
+				r.With(app.negotiate(contentTypeJSON)).Post("/{invoiceID}/restore", app.restoreInvoiceHandler)
+
+				r.Route("/{invoiceID}", func(r chi.Router) {
+					r.Use(app.requireInvoiceAccess)
+
+					// The printable invoice is the only one which isn't JSON.
+					r.With(app.negotiate(contentTypeHTML)).Get("/html", app.invoiceHTMLHandler)
+					r.With(app.negotiate(contentTypePDF)).Get("/pdf", app.invoicePDFHandler)
+
+					// Attached files are sent as they were uploaded, generated documents as
+					// they were issued.
+					r.Get("/attachments/{ID}/content", app.downloadAttachmentHandler)
+					r.Get("/documents/{ID}/content", app.downloadInvoiceDocumentHandler)
+
+					r.Group(func(r chi.Router) {
+						r.Use(app.negotiate(contentTypeJSON))
+						r.Use(app.requireInvoiceWritable)
+
+						r.Get("/", app.showInvoiceHandler)
+						r.Patch("/", app.updateInvoiceHandler)
+						r.Delete("/", app.deleteInvoiceHandler)
+						r.Get("/render_context", app.invoiceRenderContextHandler)
+
+						r.Get("/invoice_items", app.listInvoiceItemsHandler)
+						r.Get("/invoice_items/{ID}", app.showInvoiceItemHandler)
+						r.With(app.requireInvoiceUnshipped).Post("/invoice_items", app.createInvoiceItemHandler)
+						r.With(app.requireInvoiceUnshipped).Patch("/invoice_items/{ID}", app.updateInvoiceItemHandler)
+						r.With(app.requireInvoiceUnshipped).Delete("/invoice_items/{ID}", app.deleteInvoiceItemHandler)
+
+						r.Get("/attachments", app.listAttachmentsHandler)
+						r.Get("/attachments/{ID}", app.showAttachmentHandler)
+						r.Post("/attachments", app.createAttachmentHandler)
+						r.Post("/attachments/{ID}/scan", app.rescanAttachmentHandler)
+
+						r.Delete("/attachments/{ID}", app.deleteAttachmentHandler)
 
-				r.Get("/{invoiceID}/invoice_items", app.listInvoiceItemsHandler)
-				r.Get("/{invoiceID}/invoice_items/{ID}", app.showInvoiceItemHandler)
-				r.Post("/{invoiceID}/invoice_items", app.createInvoiceItemHandler)
-				r.Patch("/{invoiceID}/invoice_items/{ID}", app.updateInvoiceItemHandler)
-				r.Delete("/{invoiceID}/invoice_items/{ID}", app.deleteInvoiceItemHandler)
+						r.Get("/documents", app.listInvoiceDocumentsHandler)
+
+						r.Post("/apply_payments", app.applyInvoicePaymentsHandler)
+						r.Post("/write_off", app.requirePermission("invoices:write_off", app.writeOffInvoiceHandler))
+
+						r.Post("/send", app.sendInvoiceHandler)
+						r.Post("/pay", app.payInvoiceHandler)
+						r.Post("/cancel", app.cancelInvoiceHandler)
+						r.Post("/ship", app.shipInvoiceHandler)
+					})
+
+					// Sharing doesn't change the invoice, so archived invoices and those of
+					// closed periods can be shared too. The same goes for the references
+					// in external systems.
+					r.Group(func(r chi.Router) {
+						r.Use(app.negotiate(contentTypeJSON))
+
+						r.Get("/links", app.listInvoiceLinksHandler)
+						r.Post("/links", app.createInvoiceLinkHandler)
+						r.Delete("/links/{ID}", app.revokeInvoiceLinkHandler)
+
+						r.Get("/external_refs", app.listExternalRefsHandler)
+						r.Put("/external_refs/{system}", app.setExternalRefHandler)
+						r.Delete("/external_refs/{system}", app.deleteExternalRefHandler)
+					})
+
+					// Returns are dated on their own, so they can be recorded against
+					// invoices of closed periods too.
+					r.Group(func(r chi.Router) {
+						r.Use(app.negotiate(contentTypeJSON))
+
+						r.Get("/returns", app.listReturnsHandler)
+						r.Post("/returns", app.createReturnHandler)
+					})
+
+					// Penalties are charged with invoices of their own, so they can be
+					// calculated and charged for archived invoices too.
+					r.Group(func(r chi.Router) {
+						r.Use(app.negotiate(contentTypeJSON))
+
+						r.Get("/penalty", app.invoicePenaltyHandler)
+						r.Post("/penalty", app.createPenaltyInvoiceHandler)
+					})
+				})
 			}
 		})
 
+		r.Route("/reports", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON, contentTypeCSV, contentTypeXLSX))
+			r.Use(app.authenticate)
+			r.Use(app.localize)
+			{
+				r.Get("/receivables", app.receivablesReportHandler)
+				r.Get("/group_balances", app.groupBalancesReportHandler)
+				r.Get("/number_gaps", app.numberGapsReportHandler)
+				r.Get("/invoices", app.invoiceReportHandler)
+			}
+		})
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticate)
+			{
+				r.Get("/stats", app.requirePermission("admin:maintenance", app.databaseStatsHandler))
+				r.Get("/consistency", app.requirePermission("admin:maintenance", app.checkConsistencyHandler))
+				r.Post("/consistency/fix", app.requirePermission("admin:maintenance", app.fixConsistencyHandler))
+				r.Post("/invoices/recalculate_totals", app.requirePermission("admin:maintenance", app.recalculateInvoiceTotalsHandler))
+				r.Post("/reassign", app.requirePermission("admin:maintenance", app.reassignHandler))
+				r.Get("/totals_mismatches", app.requirePermission("admin:maintenance", app.totalsMismatchReportHandler))
+				r.Get("/backups", app.requirePermission("admin:maintenance", app.listBackupsHandler))
+				r.Post("/backups", app.requirePermission("admin:maintenance", app.createBackupHandler))
+				r.Get("/backups/{ID}", app.requirePermission("admin:maintenance", app.showBackupHandler))
+				r.Get("/duplicates", app.requirePermission("admin:maintenance", app.latestDuplicateReportHandler))
+				r.Post("/duplicates", app.requirePermission("admin:maintenance", app.createDuplicateReportHandler))
+				r.Get("/duplicates/{ID}", app.requirePermission("admin:maintenance", app.showDuplicateReportHandler))
+				r.Get("/features", app.requirePermission("admin:features", app.listFeatureFlagsHandler))
+				r.Put("/features/{feature}", app.requirePermission("admin:features", app.setFeatureFlagHandler))
+				r.Delete("/features/{feature}", app.requirePermission("admin:features", app.deleteFeatureFlagHandler))
+			}
+		})
+
+		r.Route("/imports", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticate)
+			{
+				r.Post("/commerceml", app.importCommerceMLHandler)
+			}
+		})
+
+		r.Route("/events", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeEventStream))
+			r.Use(app.authenticate)
+			{
+				r.Get("/", app.eventsHandler)
+			}
+		})
+
+		r.Route("/payments", func(r chi.Router) {
+			r.Use(app.negotiate(contentTypeJSON))
+			r.Use(app.authenticate)
+			{
+				r.Get("/", app.listPaymentsHandler)
+				r.Post("/", app.createPaymentHandler)
+				r.Get("/{paymentID}", app.showPaymentHandler)
+				r.Patch("/{paymentID}", app.updatePaymentHandler)
+				r.Delete("/{paymentID}", app.deletePaymentHandler)
+			}
+		})
+
+		// What the fakes of the external services have sent, only in the sandbox.
+		if app.sandbox != nil {
+			r.Route("/sandbox", func(r chi.Router) {
+				r.Use(app.negotiate(contentTypeJSON))
+				r.Use(app.authenticate)
+				{
+					r.Get("/emails", app.listSandboxEmailsHandler)
+					r.Get("/sms", app.listSandboxTextMessagesHandler)
+					r.Get("/accounting", app.listSandboxPushesHandler)
+					r.Delete("/", app.resetSandboxHandler)
+				}
+			})
+		}
+
 	})
 
 	// Return the router instance.
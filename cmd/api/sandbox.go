@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The listSandboxEmailsHandler() returns the emails the sandbox would have sent,
+// oldest first, only those to ?recipient= if it's given.
+func (app *application) listSandboxEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	recipient := app.readString(r.URL.Query(), "recipient", "")
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": app.sandbox.Emails(recipient)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listSandboxTextMessagesHandler() returns the text messages the sandbox would
+// have sent, oldest first, only those of ?organisation_id= if it's given.
+func (app *application) listSandboxTextMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	organisationID := app.readInt64(r.URL.Query(), "organisation_id", 0, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": app.sandbox.TextMessages(organisationID)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listSandboxPushesHandler() returns the documents the accounting connectors
+// would have pushed, oldest first, only those of ?organisation_id= if it's given.
+func (app *application) listSandboxPushesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	organisationID := app.readInt64(r.URL.Query(), "organisation_id", 0, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": app.sandbox.Pushes(organisationID)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The resetSandboxHandler() forgets everything the sandbox has recorded, e.g. between
+// the runs of a test suite.
+func (app *application) resetSandboxHandler(w http.ResponseWriter, r *http.Request) {
+	app.sandbox.Reset()
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "sandbox successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
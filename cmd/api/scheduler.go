@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+)
+
+// scheduledJob is a background job which is run once the scheduler starts and then at
+// every interval.
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	run      func()
+}
+
+// scheduledJobs returns the jobs enabled in the configuration.
+func (app *application) scheduledJobs() []scheduledJob {
+	// Organisation deletions are started right away, the job continues interrupted ones.
+	jobs := []scheduledJob{
+		{name: "organisation_deletions", interval: organisationDeletionInterval, run: app.deleteOrganisations},
+	}
+
+	if app.config.archive.years > 0 {
+		jobs = append(jobs, scheduledJob{name: "archiver", interval: app.config.archive.interval, run: app.archiveInvoices})
+	}
+	if app.config.statements.enabled {
+		jobs = append(jobs, scheduledJob{name: "statements", interval: app.config.statements.interval, run: app.mailStatements})
+	}
+	if app.config.paymentStats.interval > 0 {
+		jobs = append(jobs, scheduledJob{name: "payment_stats", interval: app.config.paymentStats.interval, run: app.calculatePaymentStats})
+	}
+	if app.config.invoiceSendingEnabled() {
+		jobs = append(jobs, scheduledJob{name: "invoice_sending", interval: app.config.invoiceSending.interval, run: app.sendInvoices})
+	}
+	if app.config.backups.interval > 0 {
+		jobs = append(jobs, scheduledJob{name: "backup", interval: app.config.backups.interval, run: app.backupDatabase})
+	}
+	if app.config.accounting.syncInterval > 0 {
+		jobs = append(jobs, scheduledJob{name: "accounting_sync", interval: app.config.accounting.syncInterval, run: app.syncAccounting})
+	}
+	if app.config.reminders.interval > 0 {
+		jobs = append(jobs, scheduledJob{name: "payment_reminders", interval: app.config.reminders.interval, run: app.sendPaymentReminders})
+	}
+	if app.config.billingPlans.interval > 0 {
+		jobs = append(jobs, scheduledJob{name: "billing_plans", interval: app.config.billingPlans.interval, run: app.invoiceBillingPlans})
+	}
+	if app.config.storageEnabled() {
+		jobs = append(jobs, scheduledJob{name: "attachment_files", interval: attachmentCleanupInterval, run: app.removeUnusedAttachmentFiles})
+		jobs = append(jobs, scheduledJob{name: "generated_documents", interval: generatedDocumentCleanupInterval, run: app.removeExpiredDocuments})
+	}
+	if app.config.scanningEnabled() {
+		jobs = append(jobs, scheduledJob{name: "attachment_scans", interval: attachmentScanInterval, run: app.scanAttachmentFiles})
+	}
+
+	return jobs
+}
+
+// How often an instance tries to become the leader, and how often the leader checks
+// that it still holds the lock.
+const (
+	leaderRetryInterval = 30 * time.Second
+	leaderCheckInterval = 10 * time.Second
+)
+
+// schedulerConnections returns how many connections are held besides those of the
+// requests and the queries of the jobs, which are added to the size of the connection
+// pool: the leader holds one for its lock and one for the lock of every job which is
+// running, and the change listener holds one while it listens. The jobs only depend
+// on the configuration, so they are counted before the application is set up.
+func schedulerConnections(cfg config) int32 {
+	app := &application{config: cfg}
+
+	return int32(len(app.scheduledJobs())) + 2
+}
+
+// The runScheduler() method runs the scheduled jobs on one instance only, however many
+// are started. The instances compete for an advisory lock; the one holding it is the
+// leader and schedules the jobs, the others try again every leaderRetryInterval. When
+// the leader loses its connection to the database, PostgreSQL releases the lock, the
+// leader stops scheduling and another instance takes over. It runs until the process
+// exits.
+func (app *application) runScheduler(jobs []scheduledJob) {
+	for {
+		lock, err := app.models.Locks.TryLock(context.Background(), "scheduler")
+		if err != nil {
+			app.logger.Err(err).Msg("electing the scheduler leader")
+		} else if lock != nil {
+			app.logger.Info().Msg("leading the scheduled jobs")
+			app.lead(lock, jobs)
+			app.logger.Warn().Msg("lost the lead of the scheduled jobs")
+		}
+
+		time.Sleep(leaderRetryInterval)
+	}
+}
+
+// lead schedules the jobs as long as the lock is held. Runs which have started are
+// finished before the lock is released.
+func (app *application) lead(lock *data.Lock, jobs []scheduledJob) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job scheduledJob) {
+			defer wg.Done()
+			app.schedule(ctx, job)
+		}(job)
+	}
+
+	ticker := time.NewTicker(leaderCheckInterval)
+	defer ticker.Stop()
+
+	for lock.Held() {
+		<-ticker.C
+	}
+
+	cancel()
+	wg.Wait()
+
+	err := lock.Unlock()
+	if err != nil {
+		app.logger.Err(err).Msg("releasing the scheduler lock")
+	}
+}
+
+// schedule runs the job at every interval until the context is cancelled.
+func (app *application) schedule(ctx context.Context, job scheduledJob) {
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+
+	for {
+		app.claim(job)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim runs the job while holding a lock of its own. A former leader which hasn't
+// noticed that it lost the lead may still be running the job, in that case the run is
+// skipped.
+func (app *application) claim(job scheduledJob) {
+	lock, err := app.models.Locks.TryLock(context.Background(), "job:"+job.name)
+	if err != nil {
+		app.logger.Err(err).Str("job", job.name).Msg("claiming the job")
+		return
+	}
+	if lock == nil {
+		app.logger.Info().Str("job", job.name).Msg("the job is running on another instance")
+		return
+	}
+
+	job.run()
+
+	err = lock.Unlock()
+	if err != nil {
+		app.logger.Err(err).Str("job", job.name).Msg("releasing the job")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The number of invoices the sender emails in one run, the rest are left for the
+// following runs.
+const sendBatchRunSize = 100
+
+// The sendInvoices() method emails the invoices of the send batches which are due. It
+// is run by the scheduler. Every attempt is recorded with the invoice of its batch and
+// in the communications log.
+func (app *application) sendInvoices() {
+	sendings, err := app.models.SendBatches.Due(sendBatchRunSize)
+	if err != nil {
+		app.logger.Err(err).Msg("reading the invoices due for sending")
+		return
+	}
+
+	sent := 0
+	for _, sending := range sendings {
+		communication, err := app.sendInvoice(sending)
+
+		sending.Status = data.SendingSent
+		if err != nil {
+			message := err.Error()
+			sending.Status = data.SendingFailed
+			sending.Error = &message
+			app.logger.Err(err).Int64("invoice_id", sending.InvoiceID).Msg("sending invoice")
+		} else {
+			sent++
+		}
+
+		err = app.models.SendBatches.SetResult(sending)
+		if err != nil {
+			app.logger.Err(err).Int64("invoice_id", sending.InvoiceID).Msg("recording the sending of the invoice")
+			return
+		}
+
+		// The invoice may have been deleted after it was queued, then there's no company
+		// to log the communication with.
+		if communication.CompanyID == 0 {
+			continue
+		}
+
+		if sending.Subject != nil {
+			communication.Subject = *sending.Subject
+		}
+		communication.Status = data.CommunicationSent
+		if sending.Status == data.SendingFailed {
+			communication.Status = data.CommunicationFailed
+			communication.Error = sending.Error
+		}
+
+		err = app.models.Communications.Insert(communication)
+		if err != nil {
+			app.logger.Err(err).Int64("invoice_id", sending.InvoiceID).Msg("logging the sending of the invoice")
+		}
+	}
+
+	if sent > 0 {
+		app.logger.Info().Int("invoices", sent).Msg("invoices sent")
+	}
+}
+
+// sendInvoice emails the invoice to the first recipient contact of its company with an
+// email address. The contact and the subject are set on the sending, the returned
+// communication is filled as far as the invoice could be read.
+func (app *application) sendInvoice(sending *data.InvoiceSending) (*data.Communication, error) {
+	communication := &data.Communication{
+		OrganisationID: sending.OrganisationID,
+		InvoiceID:      &sending.InvoiceID,
+		Kind:           data.CommunicationInvoice,
+		Channel:        data.ChannelEmail,
+		Details:        map[string]interface{}{"send_batch_id": sending.SendBatchID},
+	}
+
+	invoice, err := app.invoiceDocument(sending.InvoiceID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return communication, errors.New("invoice not found")
+		}
+		return communication, err
+	}
+
+	communication.CompanyID = invoice.Buyer.ID
+
+	contacts, err := app.models.Contacts.GetAll(invoice.Buyer.ID, data.ContactRoleRecipient)
+	if err != nil {
+		return communication, err
+	}
+
+	var contact *data.Contact
+	for _, c := range contacts {
+		if c.Email != "" {
+			contact = c
+			break
+		}
+	}
+
+	if contact == nil {
+		return communication, errors.New("the company has no recipient contact with an email")
+	}
+
+	sending.ContactID = &contact.ID
+	communication.ContactID = &contact.ID
+
+	subject, err := app.mailer.Send(contact.Email, "invoice.tmpl", map[string]interface{}{
+		"Invoice": invoice,
+		"Contact": contact.Name,
+	})
+	if subject != "" {
+		sending.Subject = &subject
+	}
+
+	return communication, err
+}
+
+// Declare a handler which queues invoices of the organisation for emailing at the
+// scheduled time, right away unless a time is given.
+func (app *application) createSendBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		SendBatch *struct {
+			OrganisationID *int64     `json:"organisation_id"`
+			InvoiceIDs     []int64    `json:"invoice_ids"`
+			ScheduledAt    *time.Time `json:"scheduled_at"`
+		} `json:"send_batch"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.SendBatch == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a send_batch object"))
+		return
+	}
+
+	if !app.config.invoiceSendingEnabled() {
+		app.errorResponse(w, r, http.StatusServiceUnavailable, "invoice emails are not enabled on this server")
+		return
+	}
+
+	fields := input.SendBatch
+	user := app.contextGetUser(r)
+
+	batch := &data.SendBatch{
+		OrganisationID: app.contextGetOrganisationID(r),
+		UserID:         &user.ID,
+		ScheduledAt:    time.Now(),
+	}
+
+	if fields.OrganisationID != nil {
+		batch.OrganisationID = *fields.OrganisationID
+	}
+
+	if fields.ScheduledAt != nil {
+		batch.ScheduledAt = *fields.ScheduledAt
+	}
+
+	v := validator.New()
+
+	v.Check(app.organisationAllowed(r, batch.OrganisationID), "organisation_id", "must be the current organisation")
+
+	if data.ValidateSendBatch(v, batch, fields.InvoiceIDs); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	missing, err := app.models.SendBatches.MissingInvoices(batch.OrganisationID, fields.InvoiceIDs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(missing) > 0 {
+		ids := make([]string, len(missing))
+		for i, id := range missing {
+			ids[i] = fmt.Sprint(id)
+		}
+		v.AddError("invoice_ids", "invoices not found: "+strings.Join(ids, ", "))
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.SendBatches.Insert(batch, fields.InvoiceIDs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/invoices/send_batch/%d", batch.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"data": batch}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which returns the progress of a send batch and the result of every
+// invoice.
+func (app *application) showSendBatchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("batchID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	batch, err := app.models.SendBatches.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.organisationAllowed(r, batch.OrganisationID) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": batch}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -62,19 +62,7 @@ func (app *application) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create a JWT claims struct containing the user ID as the subject, with an issued
-	// time of now and validity window of the next 24 hours. We also set the issuer and
-	// audience to a unique identifier for our application.
-	var claims jwt.Claims
-	claims.Subject = strconv.FormatInt(user.ID, 10)
-	claims.Issued = jwt.NewNumericTime(time.Now())
-	claims.NotBefore = jwt.NewNumericTime(time.Now())
-	claims.Expires = jwt.NewNumericTime(time.Now().Add(24 * time.Hour))
-	claims.Issuer = "stockup-api"
-	claims.Audiences = []string{"stockup-api"}
-
-	// Sign the JWT claims using the HMAC-SHA256 algorithm and the secret key from the // application config. This returns a []byte slice containing the JWT as a base64- // encoded string.
-	jwtBytes, err := claims.HMACSign(jwt.HS256, []byte(app.config.jwt.secret))
+	jwtBytes, err := app.createAuthenticationToken(user, 0)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -106,9 +94,109 @@ func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request)
 	// 	return
 	// }
 
-	err := app.writeJSON(w, http.StatusOK, envelope{"data": user}, nil)
+	// The preferences come with the user, so the frontend can apply them right away.
+	preferences, err := app.models.UserPreferences.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user.Preferences = preferences
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+}
+
+// The createAuthenticationToken() helper issues a JWT for the user. When organisationID
+// is not 0 the token is bound to that organisation and all queries made with it are
+// restricted to the organisation. The token carries the token version of the user, it
+// is no longer accepted once the version is raised.
+func (app *application) createAuthenticationToken(user *data.User, organisationID int64) ([]byte, error) {
+	// Create a JWT claims struct containing the user ID as the subject, with an issued
+	// time of now and validity window of the next 24 hours. We also set the issuer and
+	// audience to a unique identifier for our application.
+	var claims jwt.Claims
+	claims.Subject = strconv.FormatInt(user.ID, 10)
+	claims.Issued = jwt.NewNumericTime(time.Now())
+	claims.NotBefore = jwt.NewNumericTime(time.Now())
+	claims.Expires = jwt.NewNumericTime(time.Now().Add(24 * time.Hour))
+	claims.Issuer = "stockup-api"
+	claims.Audiences = []string{"stockup-api"}
+
+	claims.Set = map[string]interface{}{}
+	if organisationID != 0 {
+		claims.Set["organisation_id"] = organisationID
+	}
+	if user.TokenVersion != 0 {
+		claims.Set["token_version"] = user.TokenVersion
+	}
+
+	// Sign the JWT claims using the HMAC-SHA256 algorithm and the secret key from the
+	// application config. This returns a []byte slice containing the JWT as a base64-
+	// encoded string.
+	return claims.HMACSign(jwt.HS256, []byte(app.config.jwt.secret))
+}
+
+// The listUserOrganisationsHandler() returns the organisations the user can switch to.
+func (app *application) listUserOrganisationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	organisations, err := app.models.Organisations.GetAllForUser(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": organisations, "current": app.contextGetOrganisationID(r)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The switchOrganisationHandler() re-issues the authentication token bound to one of
+// the organisations the user is a member of.
+func (app *application) switchOrganisationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		OrganisationID int64 `json:"organisation_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.OrganisationID > 0, "organisation_id", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	member, err := app.models.Organisations.HasUser(input.OrganisationID, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !member {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	jwtBytes, err := app.createAuthenticationToken(user, input.OrganisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
 	}
 
+	err = app.writeJSON(w, http.StatusCreated, envelope{"token": string(jwtBytes), "organisation_id": input.OrganisationID}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/migrations"
+)
+
+// The mode the process runs in, only serving requests needs the whole configuration.
+const (
+	modeServe      = "serve"
+	modeSeed       = "seed"
+	modeRotateKeys = "rotate-keys"
+)
+
+func (cfg config) mode() string {
+	switch {
+	case cfg.seed || cfg.seeding.reset:
+		return modeSeed
+	case cfg.rotateKeys:
+		return modeRotateKeys
+	default:
+		return modeServe
+	}
+}
+
+// validate checks the configuration before anything is started and returns all the
+// problems found, so they can be fixed in one go.
+func (cfg config) validate() []string {
+	var problems []string
+
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(cfg.db.dsn != "", "the database DSN is not set (-db-dsn or DB_DSN)")
+	check(cfg.env == envDevelopment || cfg.env == envStaging || cfg.env == envProduction || cfg.env == envSandbox, "-env must be development, staging, production or sandbox")
+	check(cfg.port > 0 && cfg.port < 65536, "-port must be between 1 and 65535")
+
+	_, ok := data.SeedProfiles[cfg.seeding.profile]
+	check(ok, fmt.Sprintf("unknown seed profile %q", cfg.seeding.profile))
+	check(cfg.seeding.scale > 0, "-seed-scale must be greater than zero")
+
+	// Seeding empties tables with -seed-reset and creates users with known emails. A
+	// sandbox holds nothing but test data, so it may be seeded too.
+	check(cfg.mode() != modeSeed || cfg.isDevelopment() || cfg.isSandbox(), "-seed and -seed-reset are only allowed with -env=development or -env=sandbox")
+
+	check(cfg.mode() != modeRotateKeys || cfg.encryption.keys != "", "-rotate-keys needs the encryption keys (-encryption-keys or ENCRYPTION_KEYS)")
+
+	if cfg.mode() != modeServe {
+		return problems
+	}
+
+	// Tokens signed with an empty secret can be forged by anyone.
+	check(cfg.jwt.secret != "", "the JWT secret is not set (-jwt-secret or JWT_SECRET)")
+	check(cfg.jwt.leeway >= 0 && cfg.jwt.leeway <= 5*time.Minute, "-jwt-leeway must be between 0 and 5m")
+	check(cfg.jwt.userCache >= 0 && cfg.jwt.userCache <= time.Minute, "-auth-user-cache must be between 0 and 1m")
+	check(!cfg.scanningEnabled() || cfg.storageEnabled(), "-clamd-address needs -storage-dir, there is nothing to scan without uploads")
+	check(cfg.scanner.timeout > 0, "-clamd-timeout must be positive")
+	check(cfg.pdf.boldFont == "" || cfg.pdfEnabled(), "-pdf-font-bold needs -pdf-font")
+	check(cfg.publicURL == "" || (strings.HasPrefix(cfg.publicURL, "https://") || strings.HasPrefix(cfg.publicURL, "http://")) && !strings.HasSuffix(cfg.publicURL, "/"), "-public-url must be an http(s) URL without a trailing slash")
+	check(cfg.password.minLength >= 8 && cfg.password.minLength <= 72, "-password-min-length must be between 8 and 72")
+	check(cfg.password.minClasses >= 1 && cfg.password.minClasses <= 4, "-password-min-classes must be between 1 and 4")
+	check(cfg.archive.years >= 0, "-archive-after-years must not be negative")
+	check(cfg.archive.years == 0 || cfg.archive.interval > 0, "-archive-interval must be greater than zero")
+	check(cfg.paymentStats.interval >= 0, "-payment-stats-interval must not be negative")
+	check(cfg.invoiceSending.interval >= 0, "-invoice-sending-interval must not be negative")
+	check(cfg.backups.interval >= 0, "-backup-interval must not be negative")
+	check(cfg.backups.interval == 0 || cfg.backupsEnabled(), "scheduled backups need the backup directory (-backup-dir or BACKUP_DIR)")
+	check(cfg.backups.keep >= 0, "-backup-keep must not be negative")
+	check(cfg.backups.maxAge >= 0, "-backup-max-age must not be negative")
+	check(cfg.accounting.syncInterval >= 0, "-accounting-sync-interval must not be negative")
+	check(cfg.reminders.interval >= 0, "-payment-reminder-interval must not be negative")
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		check(origin != "*" || cfg.isDevelopment(), "-cors-trusted-origins must list the origins instead of * outside development")
+	}
+
+	if cfg.statements.enabled {
+		check(cfg.emailEnabled(), "statement emails need the SMTP host (-smtp-host or SMTP_HOST)")
+		check(cfg.statements.day >= 1 && cfg.statements.day <= 28, "-statement-day must be between 1 and 28")
+		check(cfg.statements.interval > 0, "-statement-interval must be greater than zero")
+	}
+
+	return problems
+}
+
+// latestMigration returns the version of the newest migration embedded in the binary.
+func latestMigration() (int64, error) {
+	names, err := fs.Glob(migrations.FS, "*.up.sql")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+
+	for _, name := range names {
+		version, err := strconv.ParseInt(strings.SplitN(name, "_", 2)[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("migration %s: %w", name, err)
+		}
+
+		if version > latest {
+			latest = version
+		}
+	}
+
+	return latest, nil
+}
+
+// selfCheck makes sure that the services the application depends on are usable before
+// it starts: the database has all migrations applied and the SMTP server, when it's
+// configured, answers. The directories of the backups, the 1C exchange files and the
+// uploads have to exist. Problems which only affect an optional feature are logged as
+// warnings.
+func (app *application) selfCheck() error {
+	latest, err := latestMigration()
+	if err != nil {
+		return err
+	}
+
+	version, dirty, err := app.models.Maintenance.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("reading the schema version: %w", err)
+	}
+
+	switch {
+	case dirty:
+		return fmt.Errorf("migration %d failed half-way, repair the database and force its version with migrate", version)
+	case version < latest:
+		return fmt.Errorf("the database is at migration %d but %d is required, run make migrations/up", version, latest)
+	case version > latest:
+		app.logger.Warn().Int64("schema_version", version).Int64("latest_migration", latest).Msg("the database is newer than this build")
+	}
+
+	if app.config.smtp.host != "" && !app.config.isSandbox() {
+		err = app.mailer.Ping(5 * time.Second)
+		if err != nil {
+			if app.config.statements.enabled && app.config.mode() == modeServe {
+				return fmt.Errorf("the SMTP server is not reachable: %w", err)
+			}
+			app.logger.Warn().Err(err).Msg("the SMTP server is not reachable, emails can't be sent")
+		}
+	}
+
+	if app.config.backupsEnabled() {
+		info, err := os.Stat(app.config.backups.dir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", app.config.backups.dir)
+		}
+		if err != nil {
+			app.logger.Warn().Err(err).Msg("the backup directory is not usable, backups will fail")
+		}
+	}
+
+	if app.config.storageEnabled() {
+		info, err := os.Stat(app.config.storage.dir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", app.config.storage.dir)
+		}
+		if err != nil {
+			app.logger.Warn().Err(err).Msg("the storage directory is not usable, uploads will fail")
+		}
+	}
+
+	if app.scanner != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := app.scanner.Ping(ctx)
+		cancel()
+		if err != nil {
+			app.logger.Warn().Err(err).Msg("clamd is not reachable, attachments stay pending until it is")
+		}
+	}
+
+	if app.config.accounting.exportDir != "" {
+		info, err := os.Stat(app.config.accounting.exportDir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", app.config.accounting.exportDir)
+		}
+		if err != nil {
+			app.logger.Warn().Err(err).Msg("the accounting export directory is not usable, 1C exchange files will fail")
+		}
+	}
+
+	var jobs []string
+	for _, job := range app.scheduledJobs() {
+		jobs = append(jobs, job.name)
+	}
+
+	if app.config.mode() == modeServe && len(app.config.jwt.secret) < 32 {
+		app.logger.Warn().Msg("the JWT secret is shorter than 32 bytes")
+	}
+
+	app.logger.Info().
+		Str("env", app.config.env).
+		Str("mode", app.config.mode()).
+		Int("port", app.config.port).
+		Int64("schema_version", version).
+		Bool("encryption", app.config.encryption.keys != "").
+		Bool("smtp", app.config.smtp.host != "" && !app.config.isSandbox()).
+		Strs("jobs", jobs).
+		Msg("startup checks passed")
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The mailStatements() method emails the monthly statements of open invoices to the
+// companies which opted in. It is run by the scheduler, which checks at every interval
+// whether the statements of the current month are due, and sends the ones which haven't
+// been sent yet, so a failed email is retried at the next interval.
+func (app *application) mailStatements() {
+	now := time.Now()
+
+	if now.Day() < app.config.statements.day {
+		return
+	}
+
+	periodStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	sent, err := app.sendStatements(periodStart)
+	if err != nil {
+		app.logger.Err(err).Msg("sending statements")
+	} else if sent > 0 {
+		app.logger.Info().Int("statements", sent).Time("period", periodStart).Msg("statements sent")
+	}
+}
+
+// sendStatements sends the statements due for the period and records every attempt in
+// the communications log. It returns the number of statements sent.
+func (app *application) sendStatements(periodStart time.Time) (int, error) {
+	recipients, err := app.models.Communications.DueStatements(periodStart)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, recipient := range recipients {
+		communication := &data.Communication{
+			OrganisationID: recipient.OrganisationID,
+			CompanyID:      recipient.CompanyID,
+			ContactID:      &recipient.ContactID,
+			Kind:           data.CommunicationStatement,
+			Channel:        data.ChannelEmail,
+			PeriodStart:    &periodStart,
+			Status:         data.CommunicationSent,
+		}
+
+		subject, err := app.sendStatement(recipient)
+		communication.Subject = subject
+		if err != nil {
+			message := err.Error()
+			communication.Status = data.CommunicationFailed
+			communication.Error = &message
+			app.logger.Err(err).Int64("company_id", recipient.CompanyID).Msg("sending statement")
+		} else {
+			sent++
+		}
+
+		err = app.models.Communications.Insert(communication)
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// sendStatement emails the open invoices of the company with the organisation to the
+// contact of the company and returns the subject of the email.
+func (app *application) sendStatement(recipient *data.StatementRecipient) (string, error) {
+	organisation, err := app.models.Organisations.Get(recipient.OrganisationID)
+	if err != nil {
+		return "", err
+	}
+
+	company, err := app.models.Companies.Get(recipient.CompanyID)
+	if err != nil {
+		return "", err
+	}
+
+	contact, err := app.models.Contacts.Get(recipient.CompanyID, recipient.ContactID)
+	if err != nil {
+		return "", err
+	}
+
+	if contact.Email == "" {
+		return "", errors.New("contact has no email")
+	}
+
+	open, err := app.models.Reports.OpenInvoices(recipient.OrganisationID, recipient.CompanyID)
+	if err != nil {
+		return "", err
+	}
+
+	statement := map[string]interface{}{
+		"Organisation": organisation.Name,
+		"Company":      company.Name,
+		"Date":         time.Now(),
+		"Open":         open,
+	}
+
+	return app.mailer.Send(contact.Email, "statement.tmpl", statement)
+}
+
+// Declare a handler which returns the timeline of communications with the company and
+// its invoices, newest first unless sorted otherwise.
+func (app *application) listCommunicationsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		data.Pagination
+		data.CommunicationFilters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.CommunicationFilters.CompanyID = id
+	input.CommunicationFilters.InvoiceID = app.readInt64(qs, "invoice_id", 0, v)
+	input.CommunicationFilters.Channel = app.readString(qs, "channel", "")
+	input.CommunicationFilters.Kind = app.readString(qs, "kind", "")
+	input.CommunicationFilters.Start, input.CommunicationFilters.End = app.readDateRange(qs, nil, nil, v)
+
+	input.Pagination.Page = app.readInt(qs, "page", 1, v)
+	input.Pagination.Limit, input.Pagination.MaxLimit = app.readPageLimit(qs, "communications", v)
+
+	input.Pagination.Sort = app.readString(qs, "sort", "created_at")
+	input.Pagination.SortSafelist = []string{"created_at", "kind", "channel", "status"}
+
+	input.Pagination.Direction = app.readString(qs, "direction", "desc")
+	input.Pagination.DirectionSafelist = []string{"asc", "desc"}
+
+	data.ValidateCommunicationFilters(v, input.CommunicationFilters)
+
+	if data.ValidatePagination(v, input.Pagination); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Companies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	communications, metadata, err := app.models.Communications.GetAll(input.CommunicationFilters, input.Pagination)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.streamJSON(w, r, http.StatusOK, envelope{"data": communications, "meta": metadata}, app.paginationHeaders(r, metadata))
+}
+
+// The createCommunicationHandler() records a communication which happened outside of
+// the API, e.g. an invoice emailed from a mail client, a webhook delivered by another
+// service or a view of the customer portal.
+func (app *application) createCommunicationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("companyID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Communication *struct {
+			InvoiceID *int64                 `json:"invoice_id"`
+			ContactID *int64                 `json:"contact_id"`
+			Kind      string                 `json:"kind"`
+			Channel   string                 `json:"channel"`
+			Subject   string                 `json:"subject"`
+			Status    string                 `json:"status"`
+			Error     *string                `json:"error"`
+			Details   map[string]interface{} `json:"details"`
+		} `json:"communication"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Communication == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a communication object"))
+		return
+	}
+
+	var fields = input.Communication
+
+	communication := &data.Communication{
+		CompanyID: id,
+		InvoiceID: fields.InvoiceID,
+		ContactID: fields.ContactID,
+		UserID:    &app.contextGetUser(r).ID,
+		Kind:      fields.Kind,
+		Channel:   fields.Channel,
+		Subject:   fields.Subject,
+		Status:    fields.Status,
+		Error:     fields.Error,
+		Details:   fields.Details,
+	}
+
+	if communication.Status == "" {
+		communication.Status = data.CommunicationSent
+	}
+
+	v := validator.New()
+
+	if data.ValidateCommunication(v, communication); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Companies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The invoice and the contact have to belong to the company. The organisation is
+	// taken from the invoice.
+	if communication.InvoiceID != nil {
+		invoice, err := app.models.Invoices.Get(*communication.InvoiceID)
+		switch {
+		case err == nil:
+			v.Check(invoice.CompanyID == id, "invoice_id", "must be an invoice of the company")
+			v.Check(app.organisationAllowed(r, invoice.OrganisationID), "invoice_id", "must be an invoice of the current organisation")
+			communication.OrganisationID = invoice.OrganisationID
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("invoice_id", "invoice not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		communication.OrganisationID = app.contextGetOrganisationID(r)
+	}
+
+	if communication.ContactID != nil {
+		_, err := app.models.Contacts.Get(id, *communication.ContactID)
+		switch {
+		case err == nil:
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("contact_id", "contact not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Communications.Insert(communication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": communication}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+type TaxationInput struct {
+	TaxationSystem string     `json:"taxation_system"`
+	ValidFrom      *time.Time `json:"valid_from"`
+}
+
+// The listTaxationHandler() returns the taxation history of the organisation, which
+// tells for any date whether its documents show VAT.
+func (app *application) listTaxationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	periods, err := app.models.Taxation.GetAll(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": periods}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createTaxationHandler() switches the organisation to another taxation system from
+// the given date. Invoices dated before keep the system they were issued under.
+func (app *application) createTaxationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Organisations.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Taxation *TaxationInput `json:"taxation"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Taxation == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a taxation object"))
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	period := &data.TaxationPeriod{
+		OrganisationID: id,
+		TaxationSystem: input.Taxation.TaxationSystem,
+		ValidFrom:      input.Taxation.ValidFrom,
+		UserID:         &user.ID,
+	}
+
+	v := validator.New()
+
+	if data.ValidateTaxationPeriod(v, period); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Taxation.Insert(period)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "change_taxation",
+		Entity:   "organisation",
+		EntityID: id,
+		Details: map[string]interface{}{
+			"taxation_system": period.TaxationSystem,
+			"valid_from":      period.ValidFrom.Format(dateOnlyLayout),
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	periods, err := app.models.Taxation.GetAll(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": period, "history": periods}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
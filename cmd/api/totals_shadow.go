@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The shadowTotals() method compares the amount, discount and VAT which the client
+// sent for an item with those the server calculated when it was stored, in the totals
+// shadow mode. The server values are stored either way; mismatches are only logged and
+// recorded for the mismatch report, so clients can be checked before they stop sending
+// their own totals.
+func (app *application) shadowTotals(r *http.Request, invoice *data.Invoice, item *data.InvoiceItem, client data.ClientTotals) {
+	if !app.config.totals.shadow {
+		return
+	}
+
+	mismatches := client.Mismatches(invoice, item)
+	if len(mismatches) == 0 {
+		return
+	}
+
+	for _, mismatch := range mismatches {
+		app.logger.Warn().
+			Int64("invoice_id", mismatch.InvoiceID).
+			Int64("invoice_item_id", mismatch.InvoiceItemID).
+			Str("field", mismatch.Field).
+			Str("client_value", mismatch.ClientValue.String()).
+			Str("server_value", mismatch.ServerValue.String()).
+			Msg("the client calculated the totals differently")
+	}
+
+	err := app.models.TotalsMismatches.Insert(mismatches)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// Declare a handler which summarizes the mismatches recorded in the totals shadow mode
+// by field and lists the latest of them. It takes organisation_id, start and end.
+func (app *application) totalsMismatchReportHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	organisationID := app.readInt64(qs, "organisation_id", 0, v)
+	start, end := app.readDateRange(qs, nil, nil, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	report, err := app.models.TotalsMismatches.Report(organisationID, start, end)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": report, "shadow": app.config.totals.shadow}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
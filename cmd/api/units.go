@@ -21,7 +21,7 @@ func (app *application) listUnitsHandler(w http.ResponseWriter, r *http.Request)
 
 	// Call the GetAll() method to retrieve the units, passing in the various filter
 	// parameters.
-	units, err := app.models.Units.GetAll()
+	units, err := app.models.Units.GetAll(r.Context())
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -165,7 +165,12 @@ func (app *application) updateUnitHandler(w http.ResponseWriter, r *http.Request
 	// Pass the updated unit record to our new Update() method.
 	err = app.models.Units.Update(unit)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/storage"
 	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/go-chi/chi/v5"
 )
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -44,7 +53,9 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	v := validator.New()
 
 	// Validate the user struct and return the error messages to the client if any of
-	// the checks fail.
+	// the checks fail. New passwords also have to follow the password policy.
+	data.ValidatePasswordPolicy(v, "password", input.Password, input.Email, app.config.passwordPolicy())
+
 	if data.ValidateUser(v, user); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -72,3 +83,432 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// Declare a handler which returns the preferences of the authenticated user.
+func (app *application) showUserPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	preferences, err := app.models.UserPreferences.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": preferences}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which changes the preferences of the authenticated user. The maps
+// of notifications and page sizes replace the stored ones when given; a null
+// default_organisation_id removes it.
+func (app *application) updateUserPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Preferences *struct {
+			Locale                *string          `json:"locale"`
+			Timezone              *string          `json:"timezone"`
+			DefaultOrganisationID *json.RawMessage `json:"default_organisation_id"`
+			Notifications         map[string]bool  `json:"notifications"`
+			PageSizes             map[string]int   `json:"page_sizes"`
+		} `json:"preferences"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Preferences == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a preferences object"))
+		return
+	}
+
+	preferences, err := app.models.UserPreferences.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	fields := input.Preferences
+	v := validator.New()
+
+	if fields.Locale != nil {
+		preferences.Locale = *fields.Locale
+	}
+	if fields.Timezone != nil {
+		preferences.Timezone = *fields.Timezone
+	}
+	if fields.Notifications != nil {
+		preferences.Notifications = fields.Notifications
+	}
+	if fields.PageSizes != nil {
+		preferences.PageSizes = fields.PageSizes
+	}
+
+	if fields.DefaultOrganisationID != nil {
+		var id *int64
+
+		err = json.Unmarshal(*fields.DefaultOrganisationID, &id)
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New("body contains incorrect JSON type for field \"default_organisation_id\""))
+			return
+		}
+
+		if id != nil {
+			member, err := app.models.Organisations.HasUser(*id, user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			v.Check(member, "default_organisation_id", "must be an organisation of the user")
+		}
+
+		preferences.DefaultOrganisationID = id
+	}
+
+	if data.ValidateUserPreferences(v, preferences, app.config.pageLimits); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.UserPreferences.Save(user.ID, preferences)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": preferences}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The largest avatar which can be uploaded, and the image types accepted with the
+// extensions of their files.
+const avatarMaxBytes = 2 << 20
+
+var avatarTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// avatarNameRX matches the file names of avatars in their URLs.
+var avatarNameRX = regexp.MustCompile(`^[0-9a-f]{32}\.(png|jpg|gif|webp)$`)
+
+// Declare a handler which changes the profile of the authenticated user: the name, the
+// phone and the locale, which is kept with the preferences.
+func (app *application) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		User *struct {
+			Name   *string `json:"name"`
+			Phone  *string `json:"phone"`
+			Locale *string `json:"locale"`
+		} `json:"user"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.User == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain a user object"))
+		return
+	}
+
+	preferences, err := app.models.UserPreferences.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	fields := input.User
+
+	if fields.Name != nil {
+		user.Name = strings.TrimSpace(*fields.Name)
+	}
+	if fields.Phone != nil {
+		user.Phone = strings.TrimSpace(*fields.Phone)
+	}
+	if fields.Locale != nil {
+		preferences.Locale = *fields.Locale
+	}
+
+	v := validator.New()
+
+	data.ValidateProfile(v, user)
+	data.ValidateUserPreferences(v, preferences, app.config.pageLimits)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.UpdateProfile(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.users.drop(user.ID)
+
+	if fields.Locale != nil {
+		err = app.models.UserPreferences.Save(user.ID, preferences)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	user.Preferences = preferences
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which uploads the avatar of the authenticated user as base64 in
+// JSON, like the other uploads. Every avatar gets a new random key, so its URL can be
+// cached for good; the file of the previous one is deleted.
+func (app *application) updateAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Avatar *struct {
+			Content []byte `json:"content"`
+		} `json:"avatar"`
+	}
+
+	err := app.readLargeJSON(w, r, &input, avatarMaxBytes*4/3+1_048_576)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Avatar == nil {
+		app.badRequestResponse(w, r, errors.New("body must contain an avatar object"))
+		return
+	}
+
+	content := input.Avatar.Content
+	ext, ok := avatarTypes[http.DetectContentType(content)]
+
+	v := validator.New()
+
+	v.Check(app.storage != nil, "content", "uploads are not enabled on this server")
+	v.Check(len(content) > 0, "content", "must be provided")
+	v.Check(len(content) <= avatarMaxBytes, "content", "must not be larger than 2MB")
+	v.Check(len(content) == 0 || ok, "content", "must be a PNG, JPEG, GIF or WebP image")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	name := make([]byte, 16)
+	_, err = rand.Read(name)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key := "avatars/" + hex.EncodeToString(name) + ext
+
+	err = app.storage.Put(r.Context(), key, bytes.NewReader(content))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	previous, err := app.models.Users.SetAvatar(user, key)
+	if err != nil {
+		app.deleteStoredFile(r, key)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.users.drop(user.ID)
+
+	app.deleteStoredFile(r, previous)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Declare a handler which removes the avatar of the authenticated user.
+func (app *application) deleteAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if user.Avatar == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	previous, err := app.models.Users.SetAvatar(user, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.users.drop(user.ID)
+
+	app.deleteStoredFile(r, previous)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteStoredFile() method removes a file from the storage. A file which can't be
+// removed is only logged, it's no longer referenced.
+func (app *application) deleteStoredFile(r *http.Request, key string) {
+	if key == "" || app.storage == nil {
+		return
+	}
+
+	err := app.storage.Delete(r.Context(), key)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// Declare a handler which serves an avatar. Avatars are shown in img tags, which can't
+// send the token, so they are public; their keys are random and change with every
+// upload.
+func (app *application) showAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	if app.storage == nil || !avatarNameRX.MatchString(name) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	key := "avatars/" + name
+
+	exists, err := app.models.Users.AvatarExists(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !exists {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	file, err := app.storage.Open(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	for contentType, ext := range avatarTypes {
+		if strings.HasSuffix(name, ext) {
+			w.Header().Set("Content-Type", contentType)
+		}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// Declare a handler which changes the password of the authenticated user. The current
+// password has to be given and the new one has to follow the password policy. All
+// tokens of the user stop working, the answer carries a new one for this session.
+func (app *application) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	v.Check(input.NewPassword != "", "new_password", "must be provided")
+	v.Check(input.NewPassword != input.CurrentPassword, "new_password", "must differ from the current password")
+	data.ValidatePasswordPolicy(v, "new_password", input.NewPassword, user.Email, app.config.passwordPolicy())
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.ChangePassword(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The trigger of the users table drops the user from the caches of the other
+	// instances, this one stops accepting the old tokens right away.
+	app.users.drop(user.ID)
+
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   "change_password",
+		Entity:   "user",
+		EntityID: user.ID,
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	// The new token keeps the organisation the session was bound to.
+	jwtBytes, err := app.createAuthenticationToken(user, app.contextGetOrganisationID(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"token": string(jwtBytes)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
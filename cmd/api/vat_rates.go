@@ -4,30 +4,52 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/ElOtro/stockup-api/internal/data"
 	"github.com/ElOtro/stockup-api/internal/validator"
 )
 
 type VatRateInput struct {
-	IsActive  bool    `json:"is_active"`
-	IsDefault bool    `json:"is_default"`
-	Rate      float64 `json:"rate"`
-	Name      string  `json:"name"`
+	IsActive     bool       `json:"is_active"`
+	IsDefault    bool       `json:"is_default"`
+	Rate         float64    `json:"rate"`
+	Name         string     `json:"name"`
+	ValidFrom    *time.Time `json:"valid_from"`
+	ValidTo      *time.Time `json:"valid_to"`
+	ReplacedByID *int64     `json:"replaced_by_id"`
 }
 
 // Declare a handler which writes a plain-text response with information about the
 // application status, operating environment and version.
+// Passing date returns only the rates which may be used on a document of that date.
 func (app *application) listVatRatesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	date := app.readDate(r.URL.Query(), "date", nil, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
 	// Call the GetAll() method to retrieve the vatRates, passing in the various filter
 	// parameters.
-	vatRates, err := app.models.VatRates.GetAll()
+	vatRates, err := app.models.VatRates.GetAll(r.Context())
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if date != nil {
+		valid := []*data.VatRate{}
+		for _, vatRate := range vatRates {
+			if vatRate.ValidOn(*date) {
+				valid = append(valid, vatRate)
+			}
+		}
+		vatRates = valid
+	}
+
 	// Send a JSON response containing the vatRate data.
 	err = app.writeJSON(w, http.StatusOK, envelope{"data": vatRates}, nil)
 	if err != nil {
@@ -55,10 +77,13 @@ func (app *application) createVatRateHandler(w http.ResponseWriter, r *http.Requ
 	var fields = input.VatRate
 
 	vatRate := &data.VatRate{
-		IsActive:  fields.IsActive,
-		IsDefault: fields.IsDefault,
-		Rate:      fields.Rate,
-		Name:      fields.Name,
+		IsActive:     fields.IsActive,
+		IsDefault:    fields.IsDefault,
+		Rate:         fields.Rate,
+		Name:         fields.Name,
+		ValidFrom:    fields.ValidFrom,
+		ValidTo:      fields.ValidTo,
+		ReplacedByID: fields.ReplacedByID,
 	}
 
 	// Initialize a new Validator instance.
@@ -71,6 +96,10 @@ func (app *application) createVatRateHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if !app.checkVatRateReplacement(w, r, v, vatRate) {
+		return
+	}
+
 	// Call the Insert() method on our model, passing in a pointer to the
 	// validated struct.
 	err = app.models.VatRates.Insert(vatRate)
@@ -159,6 +188,9 @@ func (app *application) updateVatRateHandler(w http.ResponseWriter, r *http.Requ
 	vatRate.IsDefault = fields.IsDefault
 	vatRate.Rate = fields.Rate
 	vatRate.Name = fields.Name
+	vatRate.ValidFrom = fields.ValidFrom
+	vatRate.ValidTo = fields.ValidTo
+	vatRate.ReplacedByID = fields.ReplacedByID
 
 	// Validate the updated vatRate record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
@@ -169,6 +201,10 @@ func (app *application) updateVatRateHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if !app.checkVatRateReplacement(w, r, v, vatRate) {
+		return
+	}
+
 	// Pass the updated vatRate record to our new Update() method.
 	err = app.models.VatRates.Update(vatRate)
 	if err != nil {
@@ -211,3 +247,51 @@ func (app *application) deleteVatRateHandler(w http.ResponseWriter, r *http.Requ
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The checkVatRateReplacement() helper checks that the rate replacing the given one
+// exists and starts right after the given one ends. It sends the error response itself
+// and reports whether the handler may go on.
+func (app *application) checkVatRateReplacement(w http.ResponseWriter, r *http.Request, v *validator.Validator, vatRate *data.VatRate) bool {
+	if vatRate.ReplacedByID == nil {
+		return true
+	}
+
+	replacement, err := app.models.VatRates.Get(*vatRate.ReplacedByID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("replaced_by_id", "vat rate not found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	nextDay := vatRate.ValidTo.AddDate(0, 0, 1).Format(dateOnlyLayout)
+	v.Check(replacement.ValidFrom != nil && replacement.ValidFrom.Format(dateOnlyLayout) == nextDay,
+		"replaced_by_id", "must be valid from the day after valid_to")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+// The validateVatRateOn() helper records an error in the validator if the rate doesn't
+// exist or may not be used on a document of the given date.
+func (app *application) validateVatRateOn(v *validator.Validator, key string, id int64, date time.Time) error {
+	vatRate, err := app.models.VatRates.Get(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			v.AddError(key, "vat rate not found")
+			return nil
+		}
+		return err
+	}
+
+	v.Check(vatRate.ValidOn(date), key, fmt.Sprintf("is not valid on %s", date.Format(dateOnlyLayout)))
+
+	return nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+type WarehouseInput struct {
+	Name      *string `json:"name"`
+	Address   *string `json:"address"`
+	IsDefault *bool   `json:"is_default"`
+}
+
+// StockItemInput is a product and its quantity received into or written off from a
+// warehouse.
+type StockItemInput struct {
+	ProductID int64   `json:"product_id"`
+	Quantity  float64 `json:"quantity"`
+}
+
+func (app *application) listWarehousesHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	warehouses, err := app.models.Warehouses.GetAll(organisationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": warehouses}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createWarehouseHandler() adds a warehouse. The first warehouse of an organisation
+// becomes its default one, invoices are shipped from it unless another is chosen.
+func (app *application) createWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Warehouse WarehouseInput `json:"warehouse"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	warehouse := &data.Warehouse{OrganisationID: organisationID, Address: input.Warehouse.Address}
+
+	if input.Warehouse.Name != nil {
+		warehouse.Name = *input.Warehouse.Name
+	}
+
+	if input.Warehouse.IsDefault != nil {
+		warehouse.IsDefault = *input.Warehouse.IsDefault
+	} else {
+		_, err = app.models.Warehouses.GetDefault(organisationID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			warehouse.IsDefault = true
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+
+	if data.ValidateWarehouse(v, warehouse); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Warehouses.Insert(warehouse)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organisations/%d/warehouses/%d", organisationID, warehouse.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": warehouse}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	warehouse, ok := app.readWarehouse(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"data": warehouse}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	warehouse, ok := app.readWarehouse(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Warehouse WarehouseInput `json:"warehouse"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Warehouse.Name != nil {
+		warehouse.Name = *input.Warehouse.Name
+	}
+
+	if input.Warehouse.Address != nil {
+		warehouse.Address = input.Warehouse.Address
+	}
+
+	if input.Warehouse.IsDefault != nil {
+		warehouse.IsDefault = *input.Warehouse.IsDefault
+	}
+
+	v := validator.New()
+
+	if data.ValidateWarehouse(v, warehouse); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Warehouses.Update(warehouse)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": warehouse}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteWarehouseHandler() deletes an empty warehouse, the goods left in it have to
+// be written off first.
+func (app *application) deleteWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	warehouse, ok := app.readWarehouse(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Warehouses.Delete(warehouse.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrWarehouseNotEmpty):
+			app.errorResponse(w, r, http.StatusConflict, "the warehouse holds goods, they have to be written off before it is deleted")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "warehouse successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createReceiptHandler() receives goods into the warehouse, e.g. a delivery of a
+// supplier.
+func (app *application) createReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	app.recordStock(w, r, data.StockReceipt)
+}
+
+// The createWriteOffHandler() writes goods off from the warehouse, e.g. damaged or lost
+// ones. It takes the stock:write_off permission.
+func (app *application) createWriteOffHandler(w http.ResponseWriter, r *http.Request) {
+	app.recordStock(w, r, data.StockWriteOff)
+}
+
+// The recordStock() helper records the movements of the goods of the request into or
+// out of the warehouse, by the kind, and records them in the audit log. The date
+// defaults to now and must not be within a closed period.
+func (app *application) recordStock(w http.ResponseWriter, r *http.Request, kind string) {
+	warehouse, ok := app.readWarehouse(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Movement struct {
+			Date        *time.Time       `json:"date"`
+			Description *string          `json:"description"`
+			Items       []StockItemInput `json:"items"`
+		} `json:"movement"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	movement := &data.StockMovement{
+		WarehouseID: warehouse.ID,
+		Kind:        kind,
+		Date:        time.Now(),
+		Description: input.Movement.Description,
+		UserID:      &user.ID,
+	}
+
+	if input.Movement.Date != nil {
+		movement.Date = *input.Movement.Date
+	}
+
+	items := make([]*data.StockMovement, 0, len(input.Movement.Items))
+	for _, item := range input.Movement.Items {
+		items = append(items, &data.StockMovement{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+
+	v := validator.New()
+
+	v.Check(movement.Description == nil || len(*movement.Description) <= 1024, "description", "must not be more than 1024 bytes long")
+
+	if data.ValidateStockItems(v, items); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.requireOpenPeriod(w, r, warehouse.OrganisationID, movement.Date) {
+		return
+	}
+
+	err = app.models.Stock.Record(kind, movement, items)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrNotGoods):
+			v.AddError("items", "must only contain goods")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrInsufficientStock):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The goods have been moved at this point, so a failure to record the event is
+	// logged rather than reported to the client.
+	event := &data.AuditEvent{
+		UserID:   &user.ID,
+		Action:   kind,
+		Entity:   "warehouse",
+		EntityID: warehouse.ID,
+		Details: map[string]interface{}{
+			"date":     movement.Date,
+			"products": len(items),
+		},
+	}
+
+	err = app.models.AuditEvents.Insert(event)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"data": items}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listStockMovementsHandler() returns the movements of goods in the warehouse, the
+// receipts, write-offs, shipments and returns, filtered by product_id, kind, start and
+// end.
+func (app *application) listStockMovementsHandler(w http.ResponseWriter, r *http.Request) {
+	warehouse, ok := app.readWarehouse(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		data.Pagination
+		data.StockMovementFilters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.StockMovementFilters.WarehouseID = warehouse.ID
+	input.StockMovementFilters.ProductID = app.readInt64(qs, "product_id", 0, v)
+	input.StockMovementFilters.Kind = app.readString(qs, "kind", "")
+	input.StockMovementFilters.Start, input.StockMovementFilters.End = app.readDateRange(qs, nil, nil, v)
+
+	v.Check(input.StockMovementFilters.Kind == "" || validator.In(input.StockMovementFilters.Kind,
+		data.StockReceipt, data.StockWriteOff, data.StockShipment, data.StockReturn), "kind", "must be receipt, write_off, shipment or return")
+
+	input.Pagination.Page = app.readInt(qs, "page", 1, v)
+	input.Pagination.Limit, input.Pagination.MaxLimit = app.readPageLimit(qs, "stock_movements", v)
+
+	input.Pagination.Sort = app.readString(qs, "sort", "date")
+	input.Pagination.SortSafelist = []string{"id", "date", "quantity", "created_at"}
+
+	input.Pagination.Direction = app.readString(qs, "direction", "desc")
+	input.Pagination.DirectionSafelist = []string{"asc", "desc"}
+
+	if data.ValidatePagination(v, input.Pagination); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movements, metadata, err := app.models.Stock.GetAll(input.StockMovementFilters, input.Pagination)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.streamJSON(w, r, http.StatusOK, envelope{"data": movements, "meta": metadata}, app.paginationHeaders(r, metadata))
+}
+
+// The stockHandler() returns the goods on hand in the warehouses of the organisation,
+// in total and per warehouse, filtered by warehouse_id and product_id.
+func (app *application) stockHandler(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters := data.StockFilters{
+		OrganisationID: organisationID,
+		WarehouseID:    app.readInt64(qs, "warehouse_id", 0, v),
+		ProductID:      app.readInt64(qs, "product_id", 0, v),
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	levels, err := app.models.Stock.OnHand(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": levels}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readWarehouse() helper fetches the warehouse of the URL, sending a 404 Not Found
+// response if it doesn't exist or belongs to another organisation than the one of the
+// URL. It reports whether the handler can go on.
+func (app *application) readWarehouse(w http.ResponseWriter, r *http.Request) (*data.Warehouse, bool) {
+	organisationID, err := app.readIDParam("organisationID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	id, err := app.readIDParam("ID", r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	warehouse, err := app.models.Warehouses.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if warehouse.OrganisationID != organisationID {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return warehouse, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/faker"
+)
+
+// anonymize replaces the personal data and the requisites of a database restored from a
+// production dump, see data.Anonymizer. As it can't be undone, the name of the database
+// has to be given with -confirm.
+func anonymize(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("stockupctl anonymize", flag.ContinueOnError)
+	confirm := flags.String("confirm", "", "Name of the database, to confirm it's the restored copy")
+	seed := flags.Int64("seed", 0, "Seed for the fake data (0 = random), the same seed gives the same data")
+	password := flags.String("password", "", "The password of every user (empty = generated and printed)")
+
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *confirm == "" {
+		return usageError(flags, "-confirm is required")
+	}
+
+	models, err := ctl.models()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var database string
+
+	err = ctl.db.QueryRow(ctx, "SELECT current_database()").Scan(&database)
+	if err != nil {
+		return err
+	}
+
+	if database != *confirm {
+		return fmt.Errorf("connected to the database %q, not %q", database, *confirm)
+	}
+
+	plaintext := *password
+	if plaintext == "" {
+		plaintext, err = generatePassword("", data.DefaultPasswordPolicy)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	anonymizer := &data.Anonymizer{
+		DB:       ctl.db,
+		Keyring:  ctl.keyring,
+		Faker:    faker.New(*seed),
+		Password: plaintext,
+	}
+
+	counts, err := anonymizer.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = models.AuditEvents.Insert(&data.AuditEvent{
+		Action:  "anonymize",
+		Entity:  "database",
+		Details: map[string]interface{}{"via": "stockupctl", "seed": *seed},
+	})
+	if err != nil {
+		return err
+	}
+
+	tables := make([]string, 0, len(counts))
+	for table := range counts {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	tw := ctl.table()
+	fmt.Fprintln(tw, "TABLE\tRECORDS")
+
+	for _, table := range tables {
+		fmt.Fprintf(tw, "%s\t%d\n", table, counts[table])
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ctl.out, "\nThe database %s is anonymized (seed %d). Users sign in as user<id>@example.com", database, *seed)
+	if *password == "" {
+		fmt.Fprintf(ctl.out, " with the password: %s\n", plaintext)
+	} else {
+		fmt.Fprintln(ctl.out, " with the password given.")
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// listFailures prints the records the background jobs have given up on, the latest
+// first.
+func listFailures(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("stockupctl failures", flag.ContinueOnError)
+	limit := flags.Int("limit", 50, "Number of failures listed")
+
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	models, err := ctl.models()
+	if err != nil {
+		return err
+	}
+
+	failures, err := models.JobFailures.GetAll(*limit)
+	if err != nil {
+		return err
+	}
+
+	tw := ctl.table()
+	fmt.Fprintln(tw, "JOB\tID\tSUBJECT\tCREATED\tERROR")
+
+	for _, failure := range failures {
+		message := ""
+		if failure.Error != nil {
+			message = *failure.Error
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", failure.Job, failure.ID, failure.Subject, failure.CreatedAt.Format("2006-01-02 15:04"), message)
+	}
+
+	return tw.Flush()
+}
+
+// retry hands a failed record back to its job, which picks it up on its next run on
+// the server.
+func retry(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("stockupctl retry", flag.ContinueOnError)
+	job := flags.String("job", "", "Job of the failure: "+strings.Join(data.RetryableJobs, ", "))
+	id := flags.Int64("id", 0, "ID of the failure, as listed by failures")
+
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if !validator.In(*job, data.RetryableJobs...) {
+		return usageError(flags, "-job must be one of "+strings.Join(data.RetryableJobs, ", "))
+	}
+	if *id < 1 {
+		return usageError(flags, "-id is required")
+	}
+
+	models, err := ctl.models()
+	if err != nil {
+		return err
+	}
+
+	err = models.JobFailures.Retry(*job, *id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return fmt.Errorf("no failed %s with the id %d", *job, *id)
+		default:
+			return err
+		}
+	}
+
+	fmt.Fprintf(ctl.out, "%s %d is pending again, the next run of the job picks it up.\n", *job, *id)
+
+	return nil
+}
+
+// export queues the documents of an accounting connector which haven't been exported
+// yet, and with -resend those which were, for the accounting_sync job of the server.
+func export(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("stockupctl export", flag.ContinueOnError)
+	connectorID := flags.Int64("connector", 0, "ID of the accounting connector")
+	resend := flags.String("resend", "", "Also send again the documents which are failed or all of them (failed|all)")
+
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *connectorID < 1 {
+		return usageError(flags, "-connector is required")
+	}
+	if !validator.In(*resend, "", "failed", "all") {
+		return usageError(flags, "-resend must be failed or all")
+	}
+
+	models, err := ctl.models()
+	if err != nil {
+		return err
+	}
+
+	// Only active connectors are synced.
+	connectors, err := models.AccountingConnectors.GetActive()
+	if err != nil {
+		return err
+	}
+
+	var connector *data.AccountingConnector
+	for _, c := range connectors {
+		if c.ID == *connectorID {
+			connector = c
+		}
+	}
+
+	if connector == nil {
+		return fmt.Errorf("no active accounting connector with the id %d", *connectorID)
+	}
+
+	queued, err := models.AccountingSyncs.Enqueue(connector)
+	if err != nil {
+		return err
+	}
+
+	var resent int64
+
+	switch *resend {
+	case "failed":
+		resent, err = models.AccountingSyncs.RetryAll(connector.ID, data.SyncFailed)
+	case "all":
+		resent, err = models.AccountingSyncs.RetryAll(connector.ID, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ctl.out, "Queued %d new and %d earlier documents for the %s connector of organisation %d.\n", queued, resent, connector.Kind, connector.OrganisationID)
+
+	enabled, err := models.FeatureFlags.Enabled(data.FeatureAccounting, connector.OrganisationID)
+	if err != nil {
+		return err
+	}
+
+	if !enabled {
+		fmt.Fprintln(ctl.out, "The accounting feature is disabled for the organisation, they are exported once it's enabled.")
+	}
+
+	return nil
+}
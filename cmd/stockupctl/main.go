@@ -0,0 +1,215 @@
+// stockupctl runs the administrative tasks of the API from the command line, against
+// the same database and with the same data layer as the server. It reads DB_DSN and
+// the encryption keys from the environment or .env like the server.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/encryption"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+)
+
+// command is a task of stockupctl. Its arguments are parsed by the flag set run
+// creates, named after the command.
+type command struct {
+	name    string
+	summary string
+	run     func(ctl *ctl, args []string) error
+}
+
+var commands = []command{
+	{name: "users", summary: "list the users and their permissions", run: listUsers},
+	{name: "reset-password", summary: "set a new password for a user, signing them out everywhere", run: resetPassword},
+	{name: "grant", summary: "grant a role or permissions to a user", run: grant},
+	{name: "failures", summary: "list the records the background jobs have given up on", run: listFailures},
+	{name: "retry", summary: "hand a failed record back to its job", run: retry},
+	{name: "export", summary: "queue the documents of an accounting connector for export", run: export},
+	{name: "anonymize", summary: "replace the personal data and requisites of a restored production dump", run: anonymize},
+}
+
+// ctl holds what the commands share. The database is connected to once a command has
+// parsed its flags, so wrong usage and -h don't need it.
+type ctl struct {
+	dsn     string
+	keyring *encryption.Keyring
+	db      *pgxpool.Pool
+	out     io.Writer
+}
+
+// models connects to the database on the first call and returns the models.
+func (ctl *ctl) models() (data.Models, error) {
+	if ctl.db == nil {
+		if ctl.dsn == "" {
+			return data.Models{}, errors.New("the database DSN is not set (-db-dsn or DB_DSN)")
+		}
+
+		db, err := openDB(ctl.dsn)
+		if err != nil {
+			return data.Models{}, fmt.Errorf("connecting to the database: %w", err)
+		}
+		ctl.db = db
+	}
+
+	return data.NewModels(ctl.db, ctl.keyring), nil
+}
+
+// table returns a writer which aligns tab-separated columns, it has to be flushed.
+func (ctl *ctl) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(ctl.out, 0, 4, 2, ' ', 0)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run executes the command of the arguments and returns the exit code: 2 for wrong
+// usage, 1 if the command failed.
+func run(args []string) int {
+	// The environment may be set without a .env file, e.g. in a container.
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "stockupctl: loading .env:", err)
+		return 1
+	}
+
+	flags := flag.NewFlagSet("stockupctl", flag.ContinueOnError)
+	dsn := flags.String("db-dsn", os.Getenv("DB_DSN"), "PostgreSQL DSN")
+	keys := flags.String("encryption-keys", os.Getenv("ENCRYPTION_KEYS"), "Encryption keys (id:base64,...)")
+	keyID := flags.String("encryption-key-id", os.Getenv("ENCRYPTION_KEY_ID"), "Current encryption key id")
+	flags.Usage = func() { usage(flags) }
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		usage(flags)
+		return 2
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flags.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "stockupctl: unknown command %q\n\n", flags.Arg(0))
+		usage(flags)
+		return 2
+	}
+
+	// Sensitive fields are stored as plain text when no encryption keys are given.
+	var keyring *encryption.Keyring
+	if *keys != "" {
+		keyring, err = encryption.New(*keys, *keyID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "stockupctl: encryption:", err)
+			return 1
+		}
+	}
+
+	c := &ctl{dsn: *dsn, keyring: keyring, out: os.Stdout}
+	defer func() {
+		if c.db != nil {
+			c.db.Close()
+		}
+	}()
+
+	err = cmd.run(c, flags.Args()[1:])
+	switch {
+	case errors.Is(err, errUsage):
+		return 2
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "stockupctl %s: %v\n", cmd.name, err)
+		return 1
+	}
+
+	return 0
+}
+
+// errUsage is returned by commands whose arguments are wrong or which were asked for
+// help, after their usage has been printed.
+var errUsage = errors.New("usage")
+
+// usage prints the global flags and the commands.
+func usage(flags *flag.FlagSet) {
+	w := flags.Output()
+
+	fmt.Fprintln(w, "Usage: stockupctl [flags] <command> [command flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "stockupctl <command> -h" for the flags of a command.`)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags:")
+	flags.PrintDefaults()
+}
+
+// parseFlags parses the arguments of a command. The flag set prints the usage of the
+// command for wrong flags and -h, errUsage is returned then.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return errUsage
+	}
+
+	if flags.NArg() > 0 {
+		return usageError(flags, fmt.Sprintf("unexpected arguments: %v", flags.Args()))
+	}
+
+	return nil
+}
+
+// usageError prints the problem with the arguments and the usage of the command.
+func usageError(flags *flag.FlagSet, problem string) error {
+	fmt.Fprintln(flags.Output(), problem)
+	flags.Usage()
+	return errUsage
+}
+
+// openDB connects to the database. The commands run one after the other, so a few
+// connections are enough.
+func openDB(dsn string) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the database DSN: %w", err)
+	}
+
+	poolConfig.MaxConns = 2
+
+	db, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = db.Ping(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// listUsers prints the users with their permissions.
+func listUsers(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("stockupctl users", flag.ContinueOnError)
+	search := flags.String("search", "", "Only users whose email or name contain it")
+
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	models, err := ctl.models()
+	if err != nil {
+		return err
+	}
+
+	users, err := models.Users.GetAll(*search)
+	if err != nil {
+		return err
+	}
+
+	tw := ctl.table()
+	fmt.Fprintln(tw, "ID\tEMAIL\tNAME\tACTIVE\tPERMISSIONS")
+
+	for _, user := range users {
+		permissions, err := models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\t%s\n", user.ID, user.Email, user.Name, user.IsActive, strings.Join(permissions, ","))
+	}
+
+	return tw.Flush()
+}
+
+// resetPassword sets a new password for the user, generated unless one is given. The
+// tokens of the user stop working, like after changing the password in the API.
+func resetPassword(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("stockupctl reset-password", flag.ContinueOnError)
+	email := flags.String("email", "", "Email of the user")
+	password := flags.String("password", "", "The new password (empty = generated and printed)")
+	minLength := flags.Int("password-min-length", data.DefaultPasswordPolicy.MinLength, "Minimum length of the password")
+	minClasses := flags.Int("password-min-classes", data.DefaultPasswordPolicy.MinClasses, "Character classes the password has to mix (1-4)")
+
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *email == "" {
+		return usageError(flags, "-email is required")
+	}
+
+	if *minLength < 8 || *minLength > 72 || *minClasses < 1 || *minClasses > 4 {
+		return usageError(flags, "-password-min-length must be between 8 and 72, -password-min-classes between 1 and 4")
+	}
+
+	policy := data.PasswordPolicy{MinLength: *minLength, MinClasses: *minClasses}
+
+	plaintext := *password
+	if plaintext == "" {
+		var err error
+		plaintext, err = generatePassword(*email, policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	v := validator.New()
+	if data.ValidatePasswordPolicy(v, "password", plaintext, *email, policy); !v.Valid() {
+		return fmt.Errorf("the password %s", v.Errors["password"])
+	}
+
+	models, err := ctl.models()
+	if err != nil {
+		return err
+	}
+
+	user, err := findUser(models, *email)
+	if err != nil {
+		return err
+	}
+
+	err = user.Password.Set(plaintext)
+	if err != nil {
+		return err
+	}
+
+	// The trigger of the users table drops the user from the caches of the API.
+	err = models.Users.ChangePassword(user)
+	if err != nil {
+		return err
+	}
+
+	err = models.AuditEvents.Insert(&data.AuditEvent{
+		Action:   "reset_password",
+		Entity:   "user",
+		EntityID: user.ID,
+		Details:  map[string]interface{}{"via": "stockupctl"},
+	})
+	if err != nil {
+		return err
+	}
+
+	if *password == "" {
+		fmt.Fprintf(ctl.out, "The password of %s is now: %s\n", user.Email, plaintext)
+	} else {
+		fmt.Fprintf(ctl.out, "The password of %s has been changed.\n", user.Email)
+	}
+
+	return nil
+}
+
+// grant adds the permissions of a role, or the permissions given, to the user.
+func grant(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("stockupctl grant", flag.ContinueOnError)
+	email := flags.String("email", "", "Email of the user")
+	role := flags.String("role", "", "Role whose permissions are granted: admin, accountant or viewer")
+	codes := flags.String("permissions", "", "Permissions granted, e.g. invoices:write_off,companies:merge")
+
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *email == "" {
+		return usageError(flags, "-email is required")
+	}
+	if (*role == "") == (*codes == "") {
+		return usageError(flags, "either -role or -permissions is required")
+	}
+
+	models, err := ctl.models()
+	if err != nil {
+		return err
+	}
+
+	user, err := findUser(models, *email)
+	if err != nil {
+		return err
+	}
+
+	var granted data.Permissions
+
+	if *role != "" {
+		granted, err = models.Permissions.GrantRole(user.ID, *role)
+		if err != nil {
+			return err
+		}
+	} else {
+		known, err := models.Permissions.GetAll()
+		if err != nil {
+			return err
+		}
+
+		for _, code := range strings.Split(*codes, ",") {
+			code = strings.TrimSpace(code)
+			if !known.Include(code) {
+				return fmt.Errorf("unknown permission %q", code)
+			}
+			granted = append(granted, code)
+		}
+
+		err = models.Permissions.AddForUser(user.ID, granted...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = models.AuditEvents.Insert(&data.AuditEvent{
+		Action:   "grant_permissions",
+		Entity:   "user",
+		EntityID: user.ID,
+		Details:  map[string]interface{}{"via": "stockupctl", "role": *role, "permissions": granted},
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ctl.out, "Granted %d permissions to %s: %s\n", len(granted), user.Email, strings.Join(granted, ","))
+
+	return nil
+}
+
+// findUser returns the user with the email.
+func findUser(models data.Models, email string) (*data.User, error) {
+	user, err := models.Users.GetByEmail(email)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil, fmt.Errorf("no user with the email %s", email)
+	}
+
+	return user, err
+}
+
+// The characters of generated passwords, without those which are easily confused.
+const passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789-_.!?"
+
+// generatePassword returns a random password of 16 characters, or of the minimum length
+// of the policy if it's longer, which follows the policy.
+func generatePassword(email string, policy data.PasswordPolicy) (string, error) {
+	length := 16
+	if policy.MinLength > length {
+		length = policy.MinLength
+	}
+
+	// Bytes beyond the largest multiple of the alphabet are skipped, so every character
+	// is equally likely.
+	limit := 256 - 256%len(passwordAlphabet)
+	random := make([]byte, length*2)
+
+	for {
+		password := make([]byte, 0, length)
+
+		for len(password) < length {
+			_, err := rand.Read(random)
+			if err != nil {
+				return "", err
+			}
+
+			for _, b := range random {
+				if int(b) < limit && len(password) < length {
+					password = append(password, passwordAlphabet[int(b)%len(passwordAlphabet)])
+				}
+			}
+		}
+
+		v := validator.New()
+		if data.ValidatePasswordPolicy(v, "password", string(password), email, policy); v.Valid() {
+			return string(password), nil
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Package accounting pushes the posted invoices and the payments of an organisation
+// into an accounting system: as CommerceML exchange files which 1C loads from a
+// directory, or as JSON posted to the API of the system or of a middleware.
+package accounting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ElOtro/stockup-api/internal/commerceml"
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/documents"
+)
+
+// ErrExportDirNotSet is returned for a 1C connector when the server has no directory
+// for the exchange files.
+var ErrExportDirNotSet = errors.New("the export directory is not set")
+
+// The currency the documents are in.
+const currency = "RUB"
+
+// Payment is a payment of a company to the organisation with the invoices it pays.
+type Payment struct {
+	ID          int64                     `json:"id"`
+	Number      string                    `json:"number"`
+	Date        time.Time                 `json:"date"`
+	Amount      data.Money                `json:"amount"`
+	Unallocated data.Money                `json:"unallocated"`
+	Description string                    `json:"description"`
+	Payer       documents.Party           `json:"payer"`
+	Payee       documents.Party           `json:"payee"`
+	BankAccount *documents.BankRequisites `json:"bank_account"`
+	Invoices    []PaymentInvoice          `json:"invoices"`
+}
+
+// PaymentInvoice is the part of a payment allocated to an invoice.
+type PaymentInvoice struct {
+	ID     int64      `json:"id"`
+	Number string     `json:"number"`
+	Date   time.Time  `json:"date"`
+	Amount data.Money `json:"amount"`
+}
+
+// Document is an invoice or a payment which is pushed. It is also the body posted by
+// the http connector.
+type Document struct {
+	Type           string             `json:"type"`
+	ID             int64              `json:"id"`
+	OrganisationID int64              `json:"organisation_id"`
+	Invoice        *documents.Invoice `json:"invoice,omitempty"`
+	Payment        *Payment           `json:"payment,omitempty"`
+}
+
+// Connector pushes documents into an accounting system. Push returns the ID the system
+// gave the document, if any. Errors wrapping data.ErrSyncRejected aren't tried again.
+type Connector interface {
+	Push(ctx context.Context, document *Document) (string, error)
+}
+
+// Recorder keeps the content of an exchange file before it's handed to the accounting
+// system. The file isn't written if it fails.
+type Recorder func(ctx context.Context, document *Document, name string, content []byte) error
+
+// New returns the connector for the settings of an organisation. The exchange files
+// of 1C connectors are written to a directory of the organisation in exportDir, after
+// record has kept them if it's given.
+func New(connector *data.AccountingConnector, exportDir string, client *http.Client, record Recorder) (Connector, error) {
+	switch connector.Kind {
+	case data.ConnectorOneC:
+		if exportDir == "" {
+			return nil, ErrExportDirNotSet
+		}
+		return fileConnector{dir: filepath.Join(exportDir, strconv.FormatInt(connector.OrganisationID, 10)), record: record}, nil
+	case data.ConnectorHTTP:
+		return httpConnector{url: connector.URL, token: connector.Token, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown connector kind %q", connector.Kind)
+	}
+}
+
+// The longest part of a response body which is kept in an error.
+const maxErrorBody = 500
+
+// httpConnector posts the document as JSON with the token as a bearer token. The
+// Idempotency-Key is the same for every attempt of a document, so the receiver can
+// tell a retry from a new document.
+type httpConnector struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (c httpConnector) Push(ctx context.Context, document *Document) (string, error) {
+	body, err := json.Marshal(document)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("stockup-%s-%d", document.Type, document.ID))
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("the server answered %s: %s", resp.Status, truncate(string(respBody), maxErrorBody))
+
+		// Client errors won't go away by sending the same document again, except
+		// timeouts and rate limits.
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			err = fmt.Errorf("%w: %v", data.ErrSyncRejected, err)
+		}
+
+		return "", err
+	}
+
+	// The ID of the document in the system is optional, a body which isn't JSON is
+	// ignored.
+	var result struct {
+		ID json.RawMessage `json:"id"`
+	}
+
+	if json.Unmarshal(respBody, &result) != nil || len(result.ID) == 0 || string(result.ID) == "null" {
+		return "", nil
+	}
+
+	return strings.Trim(string(result.ID), `"`), nil
+}
+
+// fileConnector writes every document into a CommerceML file of its own named after
+// the document, which is also its ID. A document written again replaces its file.
+type fileConnector struct {
+	dir    string
+	record Recorder
+}
+
+func (c fileConnector) Push(ctx context.Context, document *Document) (string, error) {
+	var doc commerceml.Document
+
+	switch {
+	case document.Invoice != nil:
+		doc = invoiceDocument(document.Invoice)
+	case document.Payment != nil:
+		doc = paymentDocument(document.Payment)
+	default:
+		return "", fmt.Errorf("%w: the %s has no content", data.ErrSyncRejected, document.Type)
+	}
+
+	err := os.MkdirAll(c.dir, 0o750)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%d.xml", document.Type, document.ID)
+	path := filepath.Join(c.dir, name)
+
+	buf := new(bytes.Buffer)
+
+	err = commerceml.Write(buf, time.Now(), []commerceml.Document{doc})
+	if err != nil {
+		return "", err
+	}
+
+	if c.record != nil {
+		err = c.record(ctx, document, name, buf.Bytes())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// 1C may pick the file up any time, so it's written under another name first.
+	tmp, err := os.CreateTemp(c.dir, "."+name+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf.Bytes())
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// invoiceDocument converts an invoice into a CommerceML document. The sums of the lines
+// are without VAT, which is given separately.
+func invoiceDocument(invoice *documents.Invoice) commerceml.Document {
+	doc := commerceml.Document{
+		ID:        fmt.Sprintf("stockup-invoice-%d", invoice.ID),
+		Number:    invoice.Number,
+		Date:      invoice.Date.Format("2006-01-02"),
+		Operation: commerceml.OperationInvoice,
+		Currency:  currency,
+		Sum:       invoice.Totals.Total.String(),
+		Comment:   invoice.Agreement,
+		Counterparties: []commerceml.Counterparty{
+			organisationCounterparty(invoice.Seller, commerceml.RoleSeller),
+			companyCounterparty(invoice.Buyer, commerceml.RoleBuyer),
+		},
+	}
+
+	for _, line := range invoice.Lines {
+		item := commerceml.DocumentItem{
+			Product: commerceml.Product{
+				Name: line.Description,
+				Unit: line.Unit,
+			},
+			Price:    line.Price.String(),
+			Quantity: strconv.FormatFloat(line.Quantity, 'f', -1, 64),
+			Sum:      line.Amount.String(),
+			Vat:      line.Vat.String(),
+		}
+
+		if rate, ok := commerceml.ParseVatRate(line.VatRate); ok && invoice.ChargesVat {
+			item.VatRate = &rate
+		}
+
+		doc.Items = append(doc.Items, item)
+	}
+
+	return doc
+}
+
+// paymentDocument converts a payment into a CommerceML document, the invoices it pays
+// are listed in the comment.
+func paymentDocument(payment *Payment) commerceml.Document {
+	doc := commerceml.Document{
+		ID:        fmt.Sprintf("stockup-payment-%d", payment.ID),
+		Number:    payment.Number,
+		Date:      payment.Date.Format("2006-01-02"),
+		Operation: commerceml.OperationPayment,
+		Currency:  currency,
+		Sum:       payment.Amount.String(),
+		Comment:   payment.Description,
+		Counterparties: []commerceml.Counterparty{
+			companyCounterparty(payment.Payer, commerceml.RolePayer),
+			organisationCounterparty(payment.Payee, commerceml.RolePayee),
+		},
+	}
+
+	var invoices []string
+	for _, invoice := range payment.Invoices {
+		invoices = append(invoices, fmt.Sprintf("№ %s от %s на %s", invoice.Number, invoice.Date.Format("02.01.2006"), invoice.Amount))
+	}
+
+	if len(invoices) > 0 {
+		paid := "Оплата по счетам " + strings.Join(invoices, ", ")
+		if doc.Comment != "" {
+			paid = doc.Comment + ". " + paid
+		}
+		doc.Comment = paid
+	}
+
+	return doc
+}
+
+func organisationCounterparty(party documents.Party, role string) commerceml.Counterparty {
+	return counterparty(fmt.Sprintf("stockup-organisation-%d", party.ID), party, role)
+}
+
+func companyCounterparty(party documents.Party, role string) commerceml.Counterparty {
+	return counterparty(fmt.Sprintf("stockup-company-%d", party.ID), party, role)
+}
+
+func counterparty(id string, party documents.Party, role string) commerceml.Counterparty {
+	return commerceml.Counterparty{
+		ID:       id,
+		Name:     party.Name,
+		FullName: party.FullName,
+		INN:      party.INN,
+		KPP:      party.KPP,
+		Address:  party.Address,
+		Role:     role,
+	}
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n] + "…"
+}
@@ -0,0 +1,422 @@
+// Package commerceml reads the exchange files of 1C:Предприятие in the CommerceML 2
+// format: the catalogue of products (import.xml), the counterparties and the documents
+// like invoices and orders (orders.xml). Only the elements the API imports are read.
+// Documents are written in the same format for 1C to load.
+package commerceml
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The operations of the documents which are invoices, and of payments.
+const (
+	OperationInvoice = "Счет на оплату"
+	OperationOrder   = "Заказ товара"
+	OperationPayment = "Выплата безналичных денег"
+)
+
+// The roles of the counterparties of a document.
+const (
+	RoleBuyer  = "Покупатель"
+	RoleSeller = "Продавец"
+	RolePayer  = "Плательщик"
+	RolePayee  = "Получатель"
+)
+
+// The version of the schema of the files which are written.
+const SchemaVersion = "2.05"
+
+// Exchange is the content of an exchange file.
+type Exchange struct {
+	Products       []Product
+	Counterparties []Counterparty
+	Documents      []Document
+}
+
+// Product is a product of the catalogue. VatRate is nil if the file gives no rate and
+// 0 for products without VAT.
+type Product struct {
+	ID          string
+	SKU         string
+	Name        string
+	Description string
+	Unit        string
+	VatRate     *float64
+}
+
+// Counterparty is a company the documents are made out to.
+type Counterparty struct {
+	ID       string
+	Name     string
+	FullName string
+	INN      string
+	KPP      string
+	Address  string
+	Role     string
+}
+
+// Document is an invoice or another document with its lines. Price, Quantity and Sum
+// are left as they are written in the file.
+type Document struct {
+	ID             string
+	Number         string
+	Date           string
+	Operation      string
+	Currency       string
+	Sum            string
+	Comment        string
+	Counterparties []Counterparty
+	Items          []DocumentItem
+}
+
+// Buyer returns the counterparty which pays for the document, the only one if the file
+// gives no roles.
+func (d Document) Buyer() *Counterparty {
+	for i := range d.Counterparties {
+		if d.Counterparties[i].Role == RoleBuyer {
+			return &d.Counterparties[i]
+		}
+	}
+
+	if len(d.Counterparties) == 1 {
+		return &d.Counterparties[0]
+	}
+
+	return nil
+}
+
+// DocumentItem is a line of a document. VatIncluded tells whether the price and the sum
+// include the VAT.
+type DocumentItem struct {
+	Product
+	Price       string
+	Quantity    string
+	Sum         string
+	Vat         string
+	VatIncluded bool
+}
+
+// Parse reads an exchange file. The text has to be UTF-8 whatever the encoding in the
+// XML declaration says, files saved in windows-1251 have to be converted first.
+func Parse(r io.Reader) (*Exchange, error) {
+	var file exchangeFile
+
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	err := dec.Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+
+	exchange := &Exchange{}
+
+	for _, p := range file.Catalog.Products {
+		exchange.Products = append(exchange.Products, p.product())
+	}
+
+	for _, c := range file.Counterparties {
+		exchange.Counterparties = append(exchange.Counterparties, c.counterparty())
+	}
+
+	for _, d := range file.Documents {
+		document := Document{
+			ID:        strings.TrimSpace(d.ID),
+			Number:    strings.TrimSpace(d.Number),
+			Date:      strings.TrimSpace(d.Date),
+			Operation: strings.TrimSpace(d.Operation),
+			Currency:  strings.TrimSpace(d.Currency),
+			Sum:       strings.TrimSpace(d.Sum),
+			Comment:   strings.TrimSpace(d.Comment),
+		}
+
+		for _, c := range d.Counterparties {
+			document.Counterparties = append(document.Counterparties, c.counterparty())
+		}
+
+		for _, item := range d.Items {
+			documentItem := DocumentItem{
+				Product:  item.product(),
+				Price:    strings.TrimSpace(item.Price),
+				Quantity: strings.TrimSpace(item.Quantity),
+				Sum:      strings.TrimSpace(item.Sum),
+			}
+
+			for _, tax := range item.Taxes {
+				if !isVat(tax.Name) {
+					continue
+				}
+				documentItem.Vat = strings.TrimSpace(tax.Sum)
+				documentItem.VatIncluded = tax.Included == "true"
+			}
+
+			document.Items = append(document.Items, documentItem)
+		}
+
+		exchange.Documents = append(exchange.Documents, document)
+	}
+
+	return exchange, nil
+}
+
+// Write writes the documents as an exchange file in UTF-8 which 1C can load. The
+// fields are written as they are, the amounts should have a dot as the decimal
+// separator.
+func Write(w io.Writer, created time.Time, documents []Document) error {
+	file := writtenFile{
+		Version: SchemaVersion,
+		Created: created.Format("2006-01-02T15:04:05"),
+	}
+
+	for _, d := range documents {
+		file.Documents = append(file.Documents, documentToElement(d))
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+
+	err = enc.Encode(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// FormatVatRate writes a VAT rate the way ParseVatRate() reads it, 0 is "Без налога".
+func FormatVatRate(rate float64) string {
+	if rate == 0 {
+		return "Без налога"
+	}
+
+	return strconv.FormatFloat(rate, 'f', -1, 64)
+}
+
+// ParseVatRate reads a VAT rate like "20", "10%" or "Без налога", which is 0.
+func ParseVatRate(s string) (float64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if strings.HasPrefix(s, "без") {
+		return 0, true
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || rate < 0 {
+		return 0, false
+	}
+
+	return rate, true
+}
+
+func isVat(name string) bool {
+	return strings.EqualFold(strings.TrimSpace(name), "НДС")
+}
+
+// The elements of the file, named as in the CommerceML schema. The files which are read
+// may have any root element, those which are written have the one of the schema.
+type writtenFile struct {
+	XMLName   xml.Name          `xml:"КоммерческаяИнформация"`
+	Version   string            `xml:"ВерсияСхемы,attr"`
+	Created   string            `xml:"ДатаФормирования,attr"`
+	Documents []documentElement `xml:"Документ"`
+}
+
+type exchangeFile struct {
+	Catalog struct {
+		Products []productElement `xml:"Товары>Товар,omitempty"`
+	} `xml:"Каталог"`
+	Counterparties []counterpartyElement `xml:"Контрагенты>Контрагент,omitempty"`
+	Documents      []documentElement     `xml:"Документ,omitempty"`
+}
+
+type productElement struct {
+	ID          string `xml:"Ид,omitempty"`
+	SKU         string `xml:"Артикул,omitempty"`
+	Name        string `xml:"Наименование,omitempty"`
+	Description string `xml:"Описание,omitempty"`
+	Unit        struct {
+		Name     string `xml:",chardata"`
+		FullName string `xml:"НаименованиеПолное,attr,omitempty"`
+	} `xml:"БазоваяЕдиница,omitempty"`
+	VatRates []vatRateElement `xml:"СтавкиНалогов>СтавкаНалога,omitempty"`
+}
+
+type vatRateElement struct {
+	Name string `xml:"Наименование,omitempty"`
+	Rate string `xml:"Ставка,omitempty"`
+}
+
+func (p productElement) product() Product {
+	product := Product{
+		ID:          strings.TrimSpace(p.ID),
+		SKU:         strings.TrimSpace(p.SKU),
+		Name:        strings.TrimSpace(p.Name),
+		Description: strings.TrimSpace(p.Description),
+		Unit:        strings.TrimSpace(p.Unit.Name),
+	}
+
+	if product.Unit == "" {
+		product.Unit = strings.TrimSpace(p.Unit.FullName)
+	}
+
+	for _, vat := range p.VatRates {
+		if !isVat(vat.Name) {
+			continue
+		}
+		if rate, ok := ParseVatRate(vat.Rate); ok {
+			product.VatRate = &rate
+		}
+	}
+
+	return product
+}
+
+type counterpartyElement struct {
+	ID           string          `xml:"Ид,omitempty"`
+	Name         string          `xml:"Наименование,omitempty"`
+	FullName     string          `xml:"ПолноеНаименование,omitempty"`
+	OfficialName string          `xml:"ОфициальноеНаименование,omitempty"`
+	INN          string          `xml:"ИНН,omitempty"`
+	KPP          string          `xml:"КПП,omitempty"`
+	Address      *addressElement `xml:"ЮридическийАдрес,omitempty"`
+	Registration *addressElement `xml:"АдресРегистрации,omitempty"`
+	Role         string          `xml:"Роль,omitempty"`
+}
+
+type addressElement struct {
+	Presentation string `xml:"Представление"`
+}
+
+// String returns the address, empty for a missing element.
+func (a *addressElement) String() string {
+	if a == nil {
+		return ""
+	}
+	return strings.TrimSpace(a.Presentation)
+}
+
+func (c counterpartyElement) counterparty() Counterparty {
+	counterparty := Counterparty{
+		ID:       strings.TrimSpace(c.ID),
+		Name:     strings.TrimSpace(c.Name),
+		FullName: strings.TrimSpace(c.FullName),
+		INN:      strings.TrimSpace(c.INN),
+		KPP:      strings.TrimSpace(c.KPP),
+		Address:  c.Address.String(),
+		Role:     strings.TrimSpace(c.Role),
+	}
+
+	if counterparty.FullName == "" {
+		counterparty.FullName = strings.TrimSpace(c.OfficialName)
+	}
+
+	if counterparty.Address == "" {
+		counterparty.Address = c.Registration.String()
+	}
+
+	return counterparty
+}
+
+type documentElement struct {
+	ID             string                `xml:"Ид,omitempty"`
+	Number         string                `xml:"Номер,omitempty"`
+	Date           string                `xml:"Дата,omitempty"`
+	Operation      string                `xml:"ХозОперация,omitempty"`
+	Currency       string                `xml:"Валюта,omitempty"`
+	Sum            string                `xml:"Сумма,omitempty"`
+	Comment        string                `xml:"Комментарий,omitempty"`
+	Counterparties []counterpartyElement `xml:"Контрагенты>Контрагент,omitempty"`
+	Items          []documentItemElement `xml:"Товары>Товар,omitempty"`
+}
+
+type documentItemElement struct {
+	productElement
+	Price    string       `xml:"ЦенаЗаЕдиницу,omitempty"`
+	Quantity string       `xml:"Количество,omitempty"`
+	Sum      string       `xml:"Сумма,omitempty"`
+	Taxes    []taxElement `xml:"Налоги>Налог,omitempty"`
+}
+
+type taxElement struct {
+	Name     string `xml:"Наименование,omitempty"`
+	Included string `xml:"УчтеноВСумме,omitempty"`
+	Sum      string `xml:"Сумма,omitempty"`
+}
+
+func productToElement(p Product) productElement {
+	element := productElement{
+		ID:          p.ID,
+		SKU:         p.SKU,
+		Name:        p.Name,
+		Description: p.Description,
+	}
+	element.Unit.Name = p.Unit
+
+	if p.VatRate != nil {
+		element.VatRates = []vatRateElement{{Name: "НДС", Rate: FormatVatRate(*p.VatRate)}}
+	}
+
+	return element
+}
+
+func counterpartyToElement(c Counterparty) counterpartyElement {
+	element := counterpartyElement{
+		ID:       c.ID,
+		Name:     c.Name,
+		FullName: c.FullName,
+		INN:      c.INN,
+		KPP:      c.KPP,
+		Role:     c.Role,
+	}
+
+	if c.Address != "" {
+		element.Address = &addressElement{Presentation: c.Address}
+	}
+
+	return element
+}
+
+func documentToElement(d Document) documentElement {
+	element := documentElement{
+		ID:        d.ID,
+		Number:    d.Number,
+		Date:      d.Date,
+		Operation: d.Operation,
+		Currency:  d.Currency,
+		Sum:       d.Sum,
+		Comment:   d.Comment,
+	}
+
+	for _, c := range d.Counterparties {
+		element.Counterparties = append(element.Counterparties, counterpartyToElement(c))
+	}
+
+	for _, item := range d.Items {
+		itemElement := documentItemElement{
+			productElement: productToElement(item.Product),
+			Price:          item.Price,
+			Quantity:       item.Quantity,
+			Sum:            item.Sum,
+		}
+
+		if item.VatRate != nil {
+			itemElement.Taxes = []taxElement{{Name: "НДС", Included: strconv.FormatBool(item.VatIncluded), Sum: item.Vat}}
+		}
+
+		element.Items = append(element.Items, itemElement)
+	}
+
+	return element
+}
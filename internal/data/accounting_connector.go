@@ -0,0 +1,639 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/encryption"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrDuplicateConnector is returned when an organisation gets a second connector of a
+// kind.
+var ErrDuplicateConnector = errors.New("duplicate connector")
+
+// ErrSyncRejected marks the errors of a sync which trying again won't fix, e.g. the
+// document was deleted or the accounting system refused it.
+var ErrSyncRejected = errors.New("rejected")
+
+// The kinds of accounting connectors: exchange files for 1C and JSON posted to a URL.
+const (
+	ConnectorOneC = "1c"
+	ConnectorHTTP = "http"
+)
+
+var ConnectorKinds = []string{ConnectorOneC, ConnectorHTTP}
+
+// The types of the documents which are synced.
+const (
+	SyncInvoice = "invoice"
+	SyncPayment = "payment"
+)
+
+// The states of a document sync. A pending sync which failed is tried again later,
+// after MaxSyncAttempts it fails for good until it's retried by hand.
+const (
+	SyncPending = "pending"
+	SyncSynced  = "synced"
+	SyncFailed  = "failed"
+)
+
+var SyncStatuses = []string{SyncPending, SyncSynced, SyncFailed}
+
+const MaxSyncAttempts = 8
+
+// AccountingConnector pushes the documents of an organisation dated from StartDate on
+// into an accounting system. The token is never returned, HasToken tells whether it's
+// set.
+type AccountingConnector struct {
+	ID             int64         `json:"id"`
+	OrganisationID int64         `json:"organisation_id"`
+	Kind           string        `json:"kind"`
+	IsActive       bool          `json:"is_active"`
+	URL            string        `json:"url,omitempty"`
+	Token          string        `json:"-"`
+	HasToken       bool          `json:"has_token"`
+	StartDate      *time.Time    `json:"start_date,omitempty"`
+	Progress       *SyncProgress `json:"progress,omitempty"`
+	CreatedAt      *time.Time    `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time    `json:"updated_at,omitempty"`
+}
+
+// SyncProgress counts the documents of a connector by the state of their sync.
+type SyncProgress struct {
+	Pending int `json:"pending"`
+	Synced  int `json:"synced"`
+	Failed  int `json:"failed"`
+}
+
+// AccountingSync is the sync of a document by a connector.
+type AccountingSync struct {
+	ID            int64      `json:"id"`
+	ConnectorID   int64      `json:"connector_id"`
+	DocumentType  string     `json:"document_type"`
+	DocumentID    int64      `json:"document_id"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	Error         *string    `json:"error,omitempty"`
+	ExternalID    *string    `json:"external_id,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	SyncedAt      *time.Time `json:"synced_at,omitempty"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+}
+
+func ValidateAccountingConnector(v *validator.Validator, connector *AccountingConnector) {
+	v.Check(connector.OrganisationID != 0, "organisation_id", "must be provided")
+	v.Check(validator.In(connector.Kind, ConnectorKinds...), "kind", "must be 1c or http")
+
+	if connector.Kind == ConnectorHTTP {
+		u, err := url.Parse(connector.URL)
+		v.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "url", "must be an http or https URL")
+	}
+}
+
+// Define a AccountingConnectorModel struct type which wraps a pgx.Conn connection
+// pool. Tokens are stored encrypted with the Keyring.
+type AccountingConnectorModel struct {
+	DB      *pgxpool.Pool
+	Keyring *encryption.Keyring
+}
+
+const accountingConnectorColumns = `id, organisation_id, kind, is_active, COALESCE(url, ''), COALESCE(token, ''),
+	start_date, created_at, updated_at`
+
+func (m AccountingConnectorModel) scan(row pgx.Row) (*AccountingConnector, error) {
+	var connector AccountingConnector
+
+	err := row.Scan(
+		&connector.ID,
+		&connector.OrganisationID,
+		&connector.Kind,
+		&connector.IsActive,
+		&connector.URL,
+		&connector.Token,
+		&connector.StartDate,
+		&connector.CreatedAt,
+		&connector.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	connector.Token, err = m.Keyring.Decrypt(connector.Token)
+	if err != nil {
+		return nil, err
+	}
+	connector.HasToken = connector.Token != ""
+
+	return &connector, nil
+}
+
+func (m AccountingConnectorModel) all(query string, args ...interface{}) ([]*AccountingConnector, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	connectors := []*AccountingConnector{}
+
+	for rows.Next() {
+		connector, err := m.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		connectors = append(connectors, connector)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return connectors, nil
+}
+
+// GetAll returns the connectors of the organisation with the progress of their syncs.
+func (m AccountingConnectorModel) GetAll(organisationID int64) ([]*AccountingConnector, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM accounting_connectors
+		WHERE organisation_id = $1
+		ORDER BY id`, accountingConnectorColumns)
+
+	connectors, err := m.all(query, organisationID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, connector := range connectors {
+		err = m.setProgress(connector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return connectors, nil
+}
+
+// GetActive returns the active connectors of all organisations.
+func (m AccountingConnectorModel) GetActive() ([]*AccountingConnector, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM accounting_connectors
+		WHERE is_active = true
+		ORDER BY id`, accountingConnectorColumns)
+
+	return m.all(query)
+}
+
+// Get returns the connector of the organisation with the progress of its syncs.
+func (m AccountingConnectorModel) Get(organisationID, id int64) (*AccountingConnector, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM accounting_connectors
+		WHERE organisation_id = $1 AND id = $2`, accountingConnectorColumns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	connector, err := m.scan(m.DB.QueryRow(ctx, query, organisationID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = m.setProgress(connector)
+	if err != nil {
+		return nil, err
+	}
+
+	return connector, nil
+}
+
+func (m AccountingConnectorModel) setProgress(connector *AccountingConnector) error {
+	query := `
+		SELECT COUNT(*) FILTER (WHERE status = 'pending'), COUNT(*) FILTER (WHERE status = 'synced'),
+			COUNT(*) FILTER (WHERE status = 'failed')
+		FROM accounting_syncs
+		WHERE connector_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	connector.Progress = &SyncProgress{}
+
+	return m.DB.QueryRow(ctx, query, connector.ID).Scan(
+		&connector.Progress.Pending,
+		&connector.Progress.Synced,
+		&connector.Progress.Failed,
+	)
+}
+
+// Insert adds the connector, an organisation can have one of each kind.
+func (m AccountingConnectorModel) Insert(connector *AccountingConnector) error {
+	token, err := m.Keyring.Encrypt(connector.Token)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO accounting_connectors (organisation_id, kind, is_active, url, token, start_date)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6)
+		RETURNING id, created_at, updated_at`
+
+	args := []interface{}{
+		connector.OrganisationID,
+		connector.Kind,
+		connector.IsActive,
+		connector.URL,
+		token,
+		connector.StartDate,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRow(ctx, query, args...).Scan(&connector.ID, &connector.CreatedAt, &connector.UpdatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrDuplicateConnector
+		}
+		return err
+	}
+
+	connector.HasToken = connector.Token != ""
+
+	return nil
+}
+
+// Update saves the connector.
+func (m AccountingConnectorModel) Update(connector *AccountingConnector) error {
+	token, err := m.Keyring.Encrypt(connector.Token)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE accounting_connectors
+		SET is_active = $1, url = NULLIF($2, ''), token = NULLIF($3, ''), start_date = $4, updated_at = NOW()
+		WHERE organisation_id = $5 AND id = $6
+		RETURNING updated_at`
+
+	args := []interface{}{
+		connector.IsActive,
+		connector.URL,
+		token,
+		connector.StartDate,
+		connector.OrganisationID,
+		connector.ID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRow(ctx, query, args...).Scan(&connector.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	connector.HasToken = connector.Token != ""
+
+	return nil
+}
+
+// Delete removes the connector with its sync log.
+func (m AccountingConnectorModel) Delete(organisationID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, "DELETE FROM accounting_connectors WHERE organisation_id = $1 AND id = $2", organisationID, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RotateKeys re-encrypts the tokens with the current key and returns the number of
+// connectors updated.
+func (m AccountingConnectorModel) RotateKeys() (int64, error) {
+	type row struct {
+		id    int64
+		token *string
+	}
+
+	rows, err := m.DB.Query(context.Background(), "SELECT id, token FROM accounting_connectors WHERE token IS NOT NULL ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+
+	// Read all rows first, the connection can't be used for updates while the
+	// resultset is open.
+	connectors := []*row{}
+	for rows.Next() {
+		var r row
+
+		err := rows.Scan(&r.id, &r.token)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		connectors = append(connectors, &r)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var updated int64
+	for _, r := range connectors {
+		changed, err := rotateFields(m.Keyring, []*string{r.token})
+		if err != nil {
+			return updated, fmt.Errorf("accounting connector %d: %w", r.id, err)
+		}
+
+		if !changed {
+			continue
+		}
+
+		_, err = m.DB.Exec(context.Background(), "UPDATE accounting_connectors SET token = $1 WHERE id = $2", r.token, r.id)
+		if err != nil {
+			return updated, err
+		}
+
+		updated++
+	}
+
+	return updated, nil
+}
+
+// Define a AccountingSyncModel struct type which wraps a pgx.Conn connection pool.
+type AccountingSyncModel struct {
+	DB *pgxpool.Pool
+}
+
+// Enqueue adds a pending sync for every posted invoice and every payment of the
+// organisation of the connector which has none yet. Documents dated before the start
+// date of the connector are left out.
+func (m AccountingSyncModel) Enqueue(connector *AccountingConnector) (int64, error) {
+	query := `
+		INSERT INTO accounting_syncs (connector_id, document_type, document_id)
+		SELECT $1::bigint, 'invoice', id FROM invoices
+		WHERE organisation_id = $2 AND is_active = true AND destroyed_at IS NULL AND ($3::date IS NULL OR date >= $3)
+		UNION ALL
+		SELECT $1::bigint, 'payment', id FROM payments
+		WHERE organisation_id = $2 AND destroyed_at IS NULL AND ($3::date IS NULL OR date >= $3)
+		ORDER BY 2, 3
+		ON CONFLICT (connector_id, document_type, document_id) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, connector.ID, connector.OrganisationID, connector.StartDate)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// Due returns up to limit pending syncs of the connector which are due, invoices
+// before payments and the oldest documents first.
+func (m AccountingSyncModel) Due(connectorID int64, limit int) ([]*AccountingSync, error) {
+	query := `
+		SELECT id, connector_id, document_type, document_id, status, attempts
+		FROM accounting_syncs
+		WHERE connector_id = $1 AND status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY document_type, document_id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, connectorID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	syncs := []*AccountingSync{}
+
+	for rows.Next() {
+		var sync AccountingSync
+
+		err := rows.Scan(&sync.ID, &sync.ConnectorID, &sync.DocumentType, &sync.DocumentID, &sync.Status, &sync.Attempts)
+		if err != nil {
+			return nil, err
+		}
+
+		syncs = append(syncs, &sync)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return syncs, nil
+}
+
+// SetResult records an attempt. A failed attempt is tried again after a delay which
+// doubles with every attempt, from a minute up to a day, and fails for good after
+// MaxSyncAttempts or if the error is ErrSyncRejected.
+func (m AccountingSyncModel) SetResult(sync *AccountingSync, externalID string, syncErr error) error {
+	sync.Attempts++
+	sync.Error = nil
+
+	switch {
+	case syncErr == nil:
+		sync.Status = SyncSynced
+		if externalID != "" {
+			sync.ExternalID = &externalID
+		}
+	case sync.Attempts >= MaxSyncAttempts || errors.Is(syncErr, ErrSyncRejected):
+		message := syncErr.Error()
+		sync.Status = SyncFailed
+		sync.Error = &message
+	default:
+		message := syncErr.Error()
+		sync.Status = SyncPending
+		sync.Error = &message
+	}
+
+	delay := time.Minute << (sync.Attempts - 1)
+	if delay > 24*time.Hour {
+		delay = 24 * time.Hour
+	}
+
+	query := `
+		UPDATE accounting_syncs
+		SET status = $1, attempts = $2, error = $3, external_id = COALESCE($4, external_id),
+			next_attempt_at = NOW() + $5 * interval '1 second',
+			synced_at = CASE WHEN $1 = 'synced' THEN NOW() END
+		WHERE id = $6
+		RETURNING next_attempt_at, synced_at`
+
+	args := []interface{}{
+		sync.Status,
+		sync.Attempts,
+		sync.Error,
+		sync.ExternalID,
+		int64(delay / time.Second),
+		sync.ID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&sync.NextAttemptAt, &sync.SyncedAt)
+}
+
+// GetAll returns the latest syncs of the connector, those with the status if it isn't
+// empty.
+func (m AccountingSyncModel) GetAll(connectorID int64, status string, pagination Pagination) ([]*AccountingSync, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, connector_id, document_type, document_id, status, attempts, error, external_id,
+			next_attempt_at, synced_at, created_at
+		FROM accounting_syncs
+		WHERE connector_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, connectorID, status, pagination.limit(), pagination.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	syncs := []*AccountingSync{}
+
+	for rows.Next() {
+		var sync AccountingSync
+
+		err := rows.Scan(
+			&totalRecords,
+			&sync.ID,
+			&sync.ConnectorID,
+			&sync.DocumentType,
+			&sync.DocumentID,
+			&sync.Status,
+			&sync.Attempts,
+			&sync.Error,
+			&sync.ExternalID,
+			&sync.NextAttemptAt,
+			&sync.SyncedAt,
+			&sync.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		syncs = append(syncs, &sync)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(int64(totalRecords), pagination.Page, pagination.Limit)
+
+	return syncs, metadata, nil
+}
+
+// Retry makes a sync of the connector pending again, with all its attempts. A synced
+// document is sent again.
+func (m AccountingSyncModel) Retry(connectorID, id int64) (*AccountingSync, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE accounting_syncs
+		SET status = 'pending', attempts = 0, error = NULL, next_attempt_at = NOW()
+		WHERE connector_id = $1 AND id = $2
+		RETURNING id, connector_id, document_type, document_id, status, attempts, external_id, next_attempt_at, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var sync AccountingSync
+
+	err := m.DB.QueryRow(ctx, query, connectorID, id).Scan(
+		&sync.ID,
+		&sync.ConnectorID,
+		&sync.DocumentType,
+		&sync.DocumentID,
+		&sync.Status,
+		&sync.Attempts,
+		&sync.ExternalID,
+		&sync.NextAttemptAt,
+		&sync.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &sync, nil
+}
+
+// RetryAll makes the syncs of the connector with the status pending again, all of them
+// if it's empty, e.g. to send everything again after the accounting system was restored
+// from a backup. It returns how many syncs are pending again.
+func (m AccountingSyncModel) RetryAll(connectorID int64, status string) (int64, error) {
+	query := `
+		UPDATE accounting_syncs
+		SET status = 'pending', attempts = 0, error = NULL, next_attempt_at = NOW()
+		WHERE connector_id = $1 AND ($2 = '' OR status = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, connectorID, status)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
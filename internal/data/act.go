@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	// ErrActExists is returned when the agreement already has an act for the period.
+	ErrActExists = errors.New("the agreement already has an act for the period")
+	// ErrNothingToAct is returned when there are no invoices to put into an act.
+	ErrNothingToAct = errors.New("no invoices under the agreement in the period")
+)
+
+// Act is an act of services rendered. Acts generated for an agreement cover the
+// invoices of the agreement dated from PeriodStart to PeriodEnd.
+type Act struct {
+	ID             int64      `json:"id"`
+	IsActive       bool       `json:"is_active"`
+	Date           time.Time  `json:"date"`
+	Number         string     `json:"number"`
+	OrganisationID int64      `json:"organisation_id"`
+	CompanyID      int64      `json:"company_id"`
+	AgreementID    int64      `json:"agreement_id"`
+	Amount         Money      `json:"amount"`
+	Vat            Money      `json:"vat"`
+	PeriodStart    *time.Time `json:"period_start,omitempty"`
+	PeriodEnd      *time.Time `json:"period_end,omitempty"`
+	InvoiceIDs     []int64    `json:"invoice_ids,omitempty"`
+	UserID         *int64     `json:"user_id,omitempty"`
+	Items          []*ActItem `json:"act_items"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+// ActItem is a line of an act. The amount is without VAT, like that of invoice items.
+type ActItem struct {
+	ID          int64   `json:"id"`
+	Position    int     `json:"position"`
+	ProductID   int64   `json:"product_id,omitempty"`
+	Description string  `json:"description"`
+	UnitID      int64   `json:"unit_id,omitempty"`
+	Quantity    float64 `json:"quantity"`
+	Price       Money   `json:"price"`
+	Amount      Money   `json:"amount"`
+	VatRateID   int64   `json:"vat_rate_id,omitempty"`
+	Vat         Money   `json:"vat"`
+}
+
+// Define an ActModel struct type which wraps a pgx.Conn connection pool.
+type ActModel struct {
+	DB *pgxpool.Pool
+}
+
+// GenerateForAgreement puts the items of the invoices under the agreement dated from
+// act.PeriodStart to act.PeriodEnd into a new act dated at the end of the period. Items
+// of the same product, unit, price and VAT rate become one line with their quantities,
+// amounts and VAT summed up. Advance invoices are left out, as the final invoices
+// repeat them. Only invoices of act.OrganisationID are taken; the act gets the company
+// of the invoices.
+func (m ActModel) GenerateForAgreement(act *Act) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT COALESCE(array_agg(id ORDER BY date, id), '{}'), COALESCE(MIN(company_id), 0)
+		FROM invoices
+		WHERE agreement_id = $1 AND organisation_id = $2
+			AND date::date BETWEEN $3::date AND $4::date
+			AND is_advance IS NOT TRUE AND destroyed_at IS NULL`
+
+	err = tx.QueryRow(ctx, query, act.AgreementID, act.OrganisationID, act.PeriodStart, act.PeriodEnd).Scan(&act.InvoiceIDs, &act.CompanyID)
+	if err != nil {
+		return err
+	}
+
+	if len(act.InvoiceIDs) == 0 {
+		return ErrNothingToAct
+	}
+
+	act.Number, err = nextDocumentNumber(ctx, tx, act.OrganisationID, DocumentAct, act.Date)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO acts (is_active, date, number, organisation_id, company_id, agreement_id, period_start, period_end, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at, updated_at`
+
+	args := []interface{}{
+		act.IsActive,
+		act.Date,
+		act.Number,
+		act.OrganisationID,
+		act.CompanyID,
+		act.AgreementID,
+		act.PeriodStart,
+		act.PeriodEnd,
+		act.UserID,
+	}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&act.ID, &act.CreatedAt, &act.UpdatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrActExists
+		}
+		return err
+	}
+
+	// The lines are numbered in the order their products first appear on the invoices.
+	query = `
+		INSERT INTO act_items (act_id, position, product_id, description, unit_id, quantity, price, amount, vat_rate_id, vat)
+		SELECT $1, ROW_NUMBER() OVER (ORDER BY MIN(i.date), MIN(ii.position), MIN(ii.id)),
+			ii.product_id, MIN(ii.description), ii.unit_id, SUM(ii.quantity), ii.price,
+			SUM(ii.amount), ii.vat_rate_id, SUM(ii.vat)
+		FROM invoice_items ii
+		INNER JOIN invoices i ON i.id = ii.invoice_id
+		WHERE ii.invoice_id = ANY($2)
+		GROUP BY ii.product_id, ii.unit_id, ii.price, ii.vat_rate_id
+		RETURNING id, position, COALESCE(product_id, 0), COALESCE(description, ''), COALESCE(unit_id, 0),
+			quantity, price, amount, COALESCE(vat_rate_id, 0), vat`
+
+	rows, err := tx.Query(ctx, query, act.ID, act.InvoiceIDs)
+	if err != nil {
+		return err
+	}
+
+	act.Items, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (*ActItem, error) {
+		var item ActItem
+		err := row.Scan(
+			&item.ID,
+			&item.Position,
+			&item.ProductID,
+			&item.Description,
+			&item.UnitID,
+			&item.Quantity,
+			&item.Price,
+			&item.Amount,
+			&item.VatRateID,
+			&item.Vat,
+		)
+		return &item, err
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(act.Items, func(i, j int) bool { return act.Items[i].Position < act.Items[j].Position })
+
+	act.Amount, act.Vat = 0, 0
+	for _, item := range act.Items {
+		act.Amount += item.Amount
+		act.Vat += item.Vat
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE acts SET amount = $1, vat = $2 WHERE id = $3", act.Amount, act.Vat, act.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
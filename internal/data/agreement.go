@@ -4,27 +4,81 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// Agreement type
+var ErrAgreementAmountExceeded = errors.New("invoices exceed the agreement amount")
+
+// The warning percent of agreements created without one.
+const DefaultAgreementWarningPercent = 80
+
+// Agreement type. Amount is the contract amount, nil if the agreement has no limit.
 type Agreement struct {
-	ID          int64      `json:"id"`
-	StartAt     *time.Time `json:"start_at,omitempty"`
-	EndAt       *time.Time `json:"end_at,omitempty"`
-	Name        string     `json:"name"`
-	CompanyID   int64      `json:"company_id,omitempty"`
-	UserID      *int64     `json:"user_id,omitempty"`
-	Company     *Company   `json:"company,omitempty"`
-	User        *User      `json:"user,omitempty"`
-	DestroyedAt *time.Time `json:"destroyed_at,omitempty"`
-	CreatedAt   *time.Time `json:"created_at,omitempty"`
-	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	ID              int64      `json:"id"`
+	StartAt         *time.Time `json:"start_at,omitempty"`
+	EndAt           *time.Time `json:"end_at,omitempty"`
+	Name            string     `json:"name"`
+	Amount          *Money     `json:"amount"`
+	WarningPercent  int        `json:"warning_percent"`
+	BlockOverAmount bool       `json:"block_over_amount"`
+	// PenaltyRate is the contractual penalty for late payment in percent of the debt
+	// per day, nil if the agreement has none.
+	PenaltyRate *float64              `json:"penalty_rate"`
+	Utilisation *AgreementUtilisation `json:"utilisation,omitempty"`
+	CompanyID   int64                 `json:"company_id,omitempty"`
+	UserID      *int64                `json:"user_id,omitempty"`
+	Company     *Company              `json:"company,omitempty"`
+	User        *User                 `json:"user,omitempty"`
+	DestroyedAt *time.Time            `json:"destroyed_at,omitempty"`
+	CreatedAt   *time.Time            `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time            `json:"updated_at,omitempty"`
+}
+
+// AgreementUtilisation compares the invoices under an agreement with its amount.
+// Remaining and Percent are only set for agreements with an amount; Warning is set from
+// the warning percent on and Exceeded once the invoices are above the amount.
+type AgreementUtilisation struct {
+	Invoiced  Money    `json:"invoiced"`
+	Remaining *Money   `json:"remaining,omitempty"`
+	Percent   *float64 `json:"percent,omitempty"`
+	Warning   bool     `json:"warning"`
+	Exceeded  bool     `json:"exceeded"`
+}
+
+// agreementInvoiced sums the invoices of the agreement in the current row, archived
+// ones included. Advance invoices are left out, as the final invoices repeat them.
+const agreementInvoiced = `(SELECT COALESCE(SUM(amount), 0) FROM (
+		SELECT amount FROM invoices
+		WHERE agreement_id = agreements.id AND is_advance IS NOT TRUE AND destroyed_at IS NULL
+		UNION ALL
+		SELECT amount FROM invoices_archive
+		WHERE agreement_id = agreements.id AND is_advance IS NOT TRUE AND destroyed_at IS NULL) i)`
+
+// setUtilisation calculates the utilisation of the agreement from the invoiced sum.
+func (agreement *Agreement) setUtilisation(invoiced Money) {
+	utilisation := &AgreementUtilisation{Invoiced: invoiced}
+
+	if agreement.Amount != nil {
+		remaining := *agreement.Amount - invoiced
+		utilisation.Remaining = &remaining
+		utilisation.Exceeded = invoiced > *agreement.Amount
+
+		// The percent is rounded to two places; an agreement of zero is used up by
+		// anything invoiced.
+		if *agreement.Amount > 0 {
+			percent := float64(invoiced.mulDiv(10000, int64(*agreement.Amount), RoundingHalfUp)) / 100
+			utilisation.Percent = &percent
+			utilisation.Warning = int64(invoiced)*100 >= int64(*agreement.Amount)*int64(agreement.WarningPercent)
+		} else {
+			utilisation.Warning = invoiced > 0
+		}
+	}
+
+	agreement.Utilisation = utilisation
 }
 
 type AgreementFilters struct {
@@ -36,6 +90,10 @@ type AgreementFilters struct {
 func ValidateAgreement(v *validator.Validator, agreement *Agreement) {
 	v.Check(agreement.CompanyID != 0, "company_id", "must be provided")
 	v.Check(agreement.Name != "", "name", "must be provided")
+	v.Check(agreement.Amount == nil || *agreement.Amount >= 0, "amount", "must not be negative")
+	v.Check(agreement.WarningPercent >= 1 && agreement.WarningPercent <= 100, "warning_percent", "must be between 1 and 100")
+	v.Check(!agreement.BlockOverAmount || agreement.Amount != nil, "block_over_amount", "requires an amount")
+	v.Check(agreement.PenaltyRate == nil || *agreement.PenaltyRate > 0 && *agreement.PenaltyRate <= 100, "penalty_rate", "must be greater than 0 and at most 100")
 }
 
 func ValidateFilters(v *validator.Validator, f AgreementFilters) {
@@ -48,33 +106,29 @@ type AgreementModel struct {
 }
 
 func (m AgreementModel) GetAll(filters AgreementFilters, pagination Pagination) ([]*Agreement, Metadata, error) {
-	// Construct the SQL query to retrieve all movie records.
-	queryElements := []string{}
-	filterQuery := ""
-	q := ""
+	// The values of the filters are passed as query arguments; the limit and the offset
+	// follow them.
+	f := filter{}
+
 	if filters.CompanyID > 0 {
-		q = fmt.Sprintf("company_id = %d", filters.CompanyID)
-		queryElements = append(queryElements, q)
+		f.where("company_id = " + f.arg(filters.CompanyID))
 	}
 
-	if filters.Start != nil && filters.End != nil {
-		q = fmt.Sprintf("start_at BETWEEN '%s' AND '%s'", filters.Start.Format(time.RFC3339), filters.End.Format(time.RFC3339))
-		queryElements = append(queryElements, q)
-	}
+	f.dateRange("start_at", filters.Start, filters.End)
 
-	if len(queryElements) > 0 {
-		filterQuery = " WHERE " + strings.Join(queryElements, " AND ") + " "
-	}
+	// The count takes the arguments of the filter only, without the limit and offset.
+	filterQuery, args := f.clause(), f.args
 
 	query := fmt.Sprintf(`
-				SELECT id, start_at, end_at, name,
+				SELECT id, start_at, end_at, name, amount, warning_percent, block_over_amount, penalty_rate, %s,
 				(SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = company_id) row) AS company,
 				(SELECT row_to_json(row) FROM (SELECT id, name FROM users WHERE users.id = user_id) row) AS user, 
 				created_at, updated_at 
 			  	FROM agreements
 				%s
 				ORDER BY %s %s
-		        LIMIT $1 OFFSET $2`, filterQuery, pagination.sortColumn(), pagination.sortDirection())
+		        LIMIT %s OFFSET %s`, agreementInvoiced, filterQuery, pagination.sortColumn(), pagination.sortDirection(),
+		f.arg(pagination.limit()), f.arg(pagination.offset()))
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -82,7 +136,7 @@ func (m AgreementModel) GetAll(filters AgreementFilters, pagination Pagination)
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
-	rows, err := m.DB.Query(ctx, query, pagination.limit(), pagination.offset())
+	rows, err := m.DB.Query(ctx, query, f.args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -97,6 +151,7 @@ func (m AgreementModel) GetAll(filters AgreementFilters, pagination Pagination)
 	for rows.Next() {
 		// Initialize an empty Movie struct to hold the data for an individual movie.
 		var agreement Agreement
+		var invoiced Money
 
 		// Scan the values from the row into the Movie struct. Again, note that we're
 		// using the pq.Array() adapter on the genres field here.
@@ -105,6 +160,11 @@ func (m AgreementModel) GetAll(filters AgreementFilters, pagination Pagination)
 			&agreement.StartAt,
 			&agreement.EndAt,
 			&agreement.Name,
+			&agreement.Amount,
+			&agreement.WarningPercent,
+			&agreement.BlockOverAmount,
+			&agreement.PenaltyRate,
+			&invoiced,
 			&agreement.Company,
 			&agreement.User,
 			&agreement.CreatedAt,
@@ -114,6 +174,8 @@ func (m AgreementModel) GetAll(filters AgreementFilters, pagination Pagination)
 			return nil, Metadata{}, err
 		}
 
+		agreement.setUtilisation(invoiced)
+
 		// Add the Agreement struct to the slice.
 		agreements = append(agreements, &agreement)
 	}
@@ -126,7 +188,7 @@ func (m AgreementModel) GetAll(filters AgreementFilters, pagination Pagination)
 
 	// Generate a Metadata struct, passing in the total record count and pagination
 	// parameters from the client.
-	totalRecords, err := m.CountIDs()
+	totalRecords, err := m.CountIDs(filterQuery, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -140,8 +202,8 @@ func (m AgreementModel) GetAll(filters AgreementFilters, pagination Pagination)
 func (m AgreementModel) Insert(agreement *Agreement) error {
 	// Define the SQL query for inserting a new record
 	query := `
-		INSERT INTO agreements (start_at, end_at, name, company_id, user_id) 
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO agreements (start_at, end_at, name, amount, warning_percent, block_over_amount, penalty_rate, company_id, user_id) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		RETURNING id, start_at, end_at, name,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = company_id) row) AS company,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM users WHERE users.id = user_id) row) AS user,  
@@ -151,12 +213,16 @@ func (m AgreementModel) Insert(agreement *Agreement) error {
 		agreement.StartAt,
 		agreement.EndAt,
 		agreement.Name,
+		agreement.Amount,
+		agreement.WarningPercent,
+		agreement.BlockOverAmount,
+		agreement.PenaltyRate,
 		agreement.CompanyID,
 		agreement.UserID,
 	}
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(
+	err := m.DB.QueryRow(context.Background(), query, args...).Scan(
 		&agreement.ID,
 		&agreement.StartAt,
 		&agreement.EndAt,
@@ -166,6 +232,13 @@ func (m AgreementModel) Insert(agreement *Agreement) error {
 		&agreement.CreatedAt,
 		&agreement.UpdatedAt,
 	)
+	if err != nil {
+		return err
+	}
+
+	// A new agreement has no invoices yet.
+	agreement.setUtilisation(0)
+	return nil
 }
 
 // Add method for fetching a specific record from the agreements table.
@@ -179,7 +252,7 @@ func (m AgreementModel) Get(id int64) (*Agreement, error) {
 	}
 
 	// Define the SQL query for retrieving data.
-	query := `SELECT id, start_at, end_at, name,
+	query := `SELECT id, start_at, end_at, name, amount, warning_percent, block_over_amount, penalty_rate, ` + agreementInvoiced + `,
 		      (SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = company_id) row) AS company,
 			  (SELECT row_to_json(row) FROM (SELECT id, name FROM users WHERE users.id = user_id) row) AS user,  
 	          created_at, updated_at 
@@ -187,6 +260,7 @@ func (m AgreementModel) Get(id int64) (*Agreement, error) {
 
 	// Declare a Agreement struct to hold the data returned by the query.
 	var agreement Agreement
+	var invoiced Money
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 
@@ -200,6 +274,11 @@ func (m AgreementModel) Get(id int64) (*Agreement, error) {
 		&agreement.StartAt,
 		&agreement.EndAt,
 		&agreement.Name,
+		&agreement.Amount,
+		&agreement.WarningPercent,
+		&agreement.BlockOverAmount,
+		&agreement.PenaltyRate,
+		&invoiced,
 		&agreement.Company,
 		&agreement.User,
 		&agreement.CreatedAt,
@@ -218,6 +297,8 @@ func (m AgreementModel) Get(id int64) (*Agreement, error) {
 		}
 	}
 
+	agreement.setUtilisation(invoiced)
+
 	return &agreement, nil
 }
 
@@ -225,23 +306,78 @@ func (m AgreementModel) Get(id int64) (*Agreement, error) {
 func (m AgreementModel) Update(agreement *Agreement) error {
 	query := `
 		UPDATE agreements
-		SET start_at = $1, end_at = $2, name = $3, company_id = $4, user_id = $5, updated_at = NOW() 
-		WHERE id = $6
-		RETURNING updated_at`
+		SET start_at = $1, end_at = $2, name = $3, amount = $4, warning_percent = $5, block_over_amount = $6,
+		penalty_rate = $7, company_id = $8, user_id = $9, updated_at = NOW() 
+		WHERE id = $10
+		RETURNING ` + agreementInvoiced + `, updated_at`
 
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
 		agreement.StartAt,
 		agreement.EndAt,
 		agreement.Name,
+		agreement.Amount,
+		agreement.WarningPercent,
+		agreement.BlockOverAmount,
+		agreement.PenaltyRate,
 		agreement.CompanyID,
 		agreement.UserID,
 		agreement.ID,
 	}
 
+	var invoiced Money
+
 	// Use the QueryRow() method to execute the query, passing in the args slice as a
 	// variadic parameter and scanning the new version value into the movie struct.
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(&agreement.UpdatedAt)
+	err := m.DB.QueryRow(context.Background(), query, args...).Scan(&invoiced, &agreement.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	agreement.setUtilisation(invoiced)
+	return nil
+}
+
+// checkAgreementAmount rejects an increase of the invoiced sum of an agreement which
+// blocks invoices over its amount, if the invoices exceed the amount afterwards. The
+// agreement is locked until the end of the transaction, so concurrent invoices are
+// counted one after another. It has to run after the invoice has been updated.
+func checkAgreementAmount(ctx context.Context, tx pgx.Tx, agreementID int64, increase Money) error {
+	if agreementID == 0 || increase <= 0 {
+		return nil
+	}
+
+	var amount *Money
+	var block bool
+
+	err := tx.QueryRow(ctx, "SELECT amount, block_over_amount FROM agreements WHERE id = $1 FOR UPDATE", agreementID).Scan(&amount, &block)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if !block || amount == nil {
+		return nil
+	}
+
+	// The sum is read in a statement of its own, so it sees the invoices committed
+	// while waiting for the lock.
+	var invoiced Money
+
+	err = tx.QueryRow(ctx, "SELECT "+agreementInvoiced+" FROM agreements WHERE id = $1", agreementID).Scan(&invoiced)
+	if err != nil {
+		return err
+	}
+
+	if invoiced > *amount {
+		return ErrAgreementAmountExceeded
+	}
+
+	return nil
 }
 
 // Add method for deleting a specific record from the agreements table.
@@ -282,12 +418,12 @@ func (m AgreementModel) Delete(id int64) error {
 }
 
 // Count records in a table
-func (m AgreementModel) CountIDs() (int64, error) {
-	query := "select count(id) from agreements"
+func (m AgreementModel) CountIDs(filterQuery string, args ...interface{}) (int64, error) {
+	query := fmt.Sprintf("select count(id) from agreements %s", filterQuery)
 	var count int64
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	err := m.DB.QueryRow(ctx, query).Scan(&count)
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&count)
 
 	// Importantly, use defer to make sure that we cancel the context before the Get()
 	// method returns.
@@ -0,0 +1,347 @@
+package data
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ElOtro/stockup-api/internal/encryption"
+	"github.com/ElOtro/stockup-api/internal/faker"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Anonymizer replaces the personal data and the requisites in a database restored from
+// a production dump, so it can be used in staging. Names, emails, phones, addresses,
+// signatures and requisites are replaced with fake ones from the Faker; ids, amounts and
+// dates are kept, so every reference between the records still holds. The same INN is
+// replaced with the same fake requisites everywhere, duplicates stay duplicates, and the
+// fake INN, OGRN, KPP and bank accounts have valid check digits. Secrets and links to
+// the outside are removed, so staging can't reach the services production uses.
+type Anonymizer struct {
+	DB      *pgxpool.Pool
+	Keyring *encryption.Keyring
+	Faker   *faker.Faker
+	// Password is set for every user, their email becomes user<id>@example.com.
+	Password string
+
+	// requisites holds the fake requisites of every INN replaced so far.
+	requisites map[string]*faker.Company
+}
+
+// anonymizerSteps are run in this order, the branches and the bank accounts take the
+// fake requisites of their companies and organisations.
+var anonymizerSteps = []struct {
+	table string
+	run   func(a *Anonymizer, ctx context.Context, tx pgx.Tx) (int64, error)
+}{
+	{"organisations", (*Anonymizer).organisations},
+	{"organisation_requisites", (*Anonymizer).organisationRequisites},
+	{"bank_accounts", (*Anonymizer).bankAccounts},
+	{"companies", (*Anonymizer).companies},
+	{"company_branches", (*Anonymizer).companyBranches},
+	{"contacts", (*Anonymizer).contacts},
+	{"users", (*Anonymizer).users},
+	{"payments", execStep(`UPDATE payments SET description = 'Оплата по счету' WHERE COALESCE(description, '') <> ''`)},
+	{"warehouses", execStep(`UPDATE warehouses SET address = NULL WHERE address IS NOT NULL`)},
+	{"stock_movements", execStep(`UPDATE stock_movements SET description = NULL WHERE description IS NOT NULL`)},
+	{"communications", execStep(`UPDATE communications SET subject = kind || ' ' || id, error = NULL, details = '{}'::jsonb`)},
+	{"invoice_sendings", execStep(`UPDATE invoice_sendings SET subject = 'invoice ' || invoice_id, error = NULL WHERE subject IS NOT NULL OR error IS NOT NULL`)},
+	{"audit_events", execStep(`UPDATE audit_events SET details = '{}'::jsonb`)},
+	{"attachments", execStep(`UPDATE attachments SET name = 'attachment-' || id`)},
+	{"accounting_connectors", execStep(`UPDATE accounting_connectors SET is_active = false, url = NULL, token = NULL`)},
+	// The files of the generated documents stay in the storage of production.
+	{"generated_documents", execStep(`DELETE FROM generated_documents`)},
+	{"integration_tokens", execStep(`DELETE FROM integration_tokens`)},
+	{"invoice_links", execStep(`DELETE FROM invoice_links`)},
+	{"sms_settings", execStep(`DELETE FROM sms_settings`)},
+	{"duplicate_reports", execStep(`DELETE FROM duplicate_reports`)},
+}
+
+// execStep returns a step which runs the statement and counts the rows it affected.
+func execStep(query string) func(a *Anonymizer, ctx context.Context, tx pgx.Tx) (int64, error) {
+	return func(a *Anonymizer, ctx context.Context, tx pgx.Tx) (int64, error) {
+		result, err := tx.Exec(ctx, query)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected(), nil
+	}
+}
+
+// Run anonymizes the whole database in one transaction, nothing is changed if a step
+// fails. It returns the number of records changed or removed in every table.
+func (a *Anonymizer) Run(ctx context.Context) (map[string]int64, error) {
+	a.requisites = map[string]*faker.Company{}
+
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	counts := map[string]int64{}
+
+	for _, step := range anonymizerSteps {
+		n, err := step.run(a, ctx, tx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step.table, err)
+		}
+		counts[step.table] = n
+	}
+
+	return counts, tx.Commit(ctx)
+}
+
+// fake returns the fake requisites which replace the INN. An INN of 12 digits is one
+// of a person, it's replaced with the requisites of an individual entrepreneur. Every
+// record without an INN gets requisites of its own.
+func (a *Anonymizer) fake(inn string) *faker.Company {
+	if fake, ok := a.requisites[inn]; ok {
+		return fake
+	}
+
+	var fake *faker.Company
+	if len(inn) == 12 {
+		fake = a.Faker.NewEntrepreneur()
+	} else {
+		fake = a.Faker.NewCompany()
+	}
+
+	if inn != "" {
+		a.requisites[inn] = fake
+	}
+
+	return fake
+}
+
+// anonymizedRow is a record whose requisites are replaced.
+type anonymizedRow struct {
+	id   int64
+	inn  string
+	kind int
+}
+
+// collectRows returns the id, the INN and the kind of the records the query selects.
+func collectRows(ctx context.Context, tx pgx.Tx, query string) ([]anonymizedRow, error) {
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (anonymizedRow, error) {
+		var r anonymizedRow
+		err := row.Scan(&r.id, &r.inn, &r.kind)
+		return r, err
+	})
+}
+
+// The requisites in the details of organisations and companies are replaced, other
+// keys are kept.
+const replaceRequisites = `(COALESCE(details, '{}'::jsonb) - 'inn' - 'kpp' - 'ogrn' - 'address') || $2::jsonb`
+
+func (a *Anonymizer) organisations(ctx context.Context, tx pgx.Tx) (int64, error) {
+	rows, err := collectRows(ctx, tx, `SELECT id, COALESCE(details->>'inn', ''), 0 FROM organisations ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE organisations
+		SET name = $3, full_name = $4, ceo = $5, cfo = $6, stamp = NULL, ceo_sign = NULL, cfo_sign = NULL,
+			details = ` + replaceRequisites + `
+		WHERE id = $1`
+
+	for _, row := range rows {
+		fake := a.fake(row.inn)
+		details := &OrganisationDetails{INN: fake.INN, KPP: fake.KPP, OGRN: fake.OGRN, Address: fake.Address}
+
+		_, err = tx.Exec(ctx, query, row.id, details, fake.Name, fake.FullName, fake.CEO, fake.CFO)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(rows)), nil
+}
+
+// organisationRequisites replaces the history of the requisites with the fake ones of
+// the INN each record had, so a change of the INN stays a change.
+func (a *Anonymizer) organisationRequisites(ctx context.Context, tx pgx.Tx) (int64, error) {
+	rows, err := collectRows(ctx, tx, `SELECT id, COALESCE(details->>'inn', ''), 0 FROM organisation_requisites ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE organisation_requisites
+		SET full_name = $3, ceo = $4, cfo = $5, details = ` + replaceRequisites + `
+		WHERE id = $1`
+
+	for _, row := range rows {
+		fake := a.fake(row.inn)
+		details := &OrganisationDetails{INN: fake.INN, KPP: fake.KPP, OGRN: fake.OGRN, Address: fake.Address}
+
+		_, err = tx.Exec(ctx, query, row.id, details, fake.FullName, fake.CEO, fake.CFO)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(rows)), nil
+}
+
+// bankAccounts gives every account a fake bank and account number, encrypted like the
+// API stores them, with the requisites of the account holder.
+func (a *Anonymizer) bankAccounts(ctx context.Context, tx pgx.Tx) (int64, error) {
+	rows, err := collectRows(ctx, tx, `SELECT id, COALESCE(details->>'inn', ''), 0 FROM bank_accounts ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+
+	model := BankAccountModel{Keyring: a.Keyring}
+
+	for _, row := range rows {
+		account := a.Faker.NewBankAccount()
+		plain := &BankAccountDetails{BIK: account.BIK, Account: account.Account, CorrAccount: account.CorrAccount}
+
+		if row.inn != "" {
+			fake := a.fake(row.inn)
+			plain.INN, plain.KPP = fake.INN, fake.KPP
+		}
+
+		details, err := model.encrypt(plain)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE bank_accounts SET name = $2, details = $3 WHERE id = $1", row.id, account.Name, details)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(rows)), nil
+}
+
+func (a *Anonymizer) companies(ctx context.Context, tx pgx.Tx) (int64, error) {
+	rows, err := collectRows(ctx, tx, `SELECT id, COALESCE(details->>'inn', ''), COALESCE(company_type, 0) FROM companies ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE companies
+		SET name = $3, full_name = $4, logo = NULL, details = ` + replaceRequisites + `
+		WHERE id = $1`
+
+	for _, row := range rows {
+		fake := a.fake(row.inn)
+		details := &CompanyDetails{INN: fake.INN, KPP: fake.KPP, OGRN: fake.OGRN, Address: fake.Address}
+		name, fullName := fake.Name, fake.FullName
+
+		// A person is named without the entrepreneur and has no OGRNIP.
+		if row.kind == CompanyTypeIndividual {
+			name, fullName = fake.CEO, fake.CEO
+			details.OGRN = ""
+		}
+
+		_, err = tx.Exec(ctx, query, row.id, details, name, fullName)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(rows)), nil
+}
+
+// companyBranches gives the branches fake addresses and KPPs of the tax office of the
+// fake INN of their company, registered as separate divisions.
+func (a *Anonymizer) companyBranches(ctx context.Context, tx pgx.Tx) (int64, error) {
+	rows, err := collectRows(ctx, tx, `
+		SELECT b.id, COALESCE(c.details->>'inn', ''), 0
+		FROM company_branches b JOIN companies c ON c.id = b.company_id
+		ORDER BY b.id`)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE company_branches
+		SET name = 'Филиал ' || id, kpp = CASE WHEN kpp = '' THEN '' ELSE $2 END, address = $3
+		WHERE id = $1`
+
+	for _, row := range rows {
+		kpp := ""
+		if len(row.inn) >= 4 {
+			kpp = fmt.Sprintf("%s02%03d", row.inn[:4], 1+a.Faker.Intn(999))
+		}
+
+		_, err = tx.Exec(ctx, query, row.id, kpp, a.Faker.NewAddress())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(rows)), nil
+}
+
+// contacts get fake names, phones and emails; their signatures and messengers are
+// removed.
+func (a *Anonymizer) contacts(ctx context.Context, tx pgx.Tx) (int64, error) {
+	rows, err := collectRows(ctx, tx, `SELECT id, '', 0 FROM contacts ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE contacts
+		SET name = $2, phone = CASE WHEN COALESCE(phone, '') = '' THEN phone ELSE $3 END,
+			email = CASE WHEN COALESCE(email, '') = '' THEN email ELSE $4 END, sign = NULL, details = '{}'::jsonb
+		WHERE id = $1`
+
+	for _, row := range rows {
+		person := a.Faker.NewPerson(a.Faker.Intn(2) == 0)
+
+		_, err = tx.Exec(ctx, query, row.id, person.Name, person.Phone, person.Email)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(rows)), nil
+}
+
+// users get fake names and phones, the email user<id>@example.com and the password of
+// the Anonymizer. Their tokens stop working.
+func (a *Anonymizer) users(ctx context.Context, tx pgx.Tx) (int64, error) {
+	var hash password
+
+	err := hash.Set(a.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := collectRows(ctx, tx, `SELECT id, '', 0 FROM users ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE users
+		SET name = $2, email = 'user' || id || '@example.com', phone = CASE WHEN phone IS NULL THEN NULL ELSE $3 END,
+			avatar = NULL, password_hash = $4, token_version = token_version + 1
+		WHERE id = $1`
+
+	for _, row := range rows {
+		person := a.Faker.NewPerson(a.Faker.Intn(2) == 0)
+
+		_, err = tx.Exec(ctx, query, row.id, person.Name, person.Phone, hash.hash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(rows)), nil
+}
@@ -0,0 +1,419 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The scan states of an attached file. Files are unscanned when no scanner is
+// configured; pending files are scanned in the background and given up as failed
+// after MaxScanAttempts errors of the scanner.
+const (
+	ScanUnscanned = "unscanned"
+	ScanPending   = "pending"
+	ScanClean     = "clean"
+	ScanInfected  = "infected"
+	ScanFailed    = "failed"
+)
+
+const MaxScanAttempts = 5
+
+// Files no attachment refers to are kept for AttachmentFileGrace before they are
+// removed, so an upload which found the file can still attach it.
+const AttachmentFileGrace = time.Hour
+
+// AttachmentFile is the content of attachments, stored once per SHA-256. RefCount is
+// the number of attachments referring to it.
+type AttachmentFile struct {
+	ID          int64
+	SHA256      string
+	Size        int64
+	ContentType string
+	RefCount    int
+	ScanStatus  string
+}
+
+// Key returns the key of the file in the storage. The first two characters of the hash
+// spread the files over subdirectories.
+func (f *AttachmentFile) Key() string {
+	return AttachmentFileKey(f.SHA256)
+}
+
+// QuarantineKey returns the key the content of an infected file is moved to.
+func (f *AttachmentFile) QuarantineKey() string {
+	return "quarantine/" + f.SHA256
+}
+
+// AttachmentFileKey returns the storage key of the file with the SHA-256.
+func AttachmentFileKey(sha256 string) string {
+	return "attachments/" + sha256[:2] + "/" + sha256
+}
+
+// Attachment is a file attached to an invoice, e.g. the scan of the signed contract.
+// Identical files attached to many invoices share their content.
+type Attachment struct {
+	ID             int64      `json:"id"`
+	OrganisationID int64      `json:"organisation_id"`
+	InvoiceID      int64      `json:"invoice_id"`
+	FileID         int64      `json:"-"`
+	Name           string     `json:"name"`
+	Size           int64      `json:"size"`
+	ContentType    string     `json:"content_type"`
+	SHA256         string     `json:"sha256"`
+	ScanStatus     string     `json:"scan_status"`
+	ScanSignature  *string    `json:"scan_signature,omitempty"`
+	UserID         *int64     `json:"user_id"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
+
+func ValidateAttachment(v *validator.Validator, attachment *Attachment) {
+	v.Check(attachment.Name != "", "name", "must be provided")
+	v.Check(len(attachment.Name) <= 255, "name", "must not be more than 255 bytes long")
+}
+
+// Define an AttachmentModel struct type which wraps a pgx.Conn connection pool.
+type AttachmentModel struct {
+	DB *pgxpool.Pool
+}
+
+const attachmentColumns = `a.id, a.organisation_id, a.invoice_id, a.file_id, a.name,
+	f.size, f.content_type, f.sha256, f.scan_status, f.scan_signature, a.user_id, a.created_at`
+
+func scanAttachment(row pgx.Row) (*Attachment, error) {
+	var attachment Attachment
+
+	err := row.Scan(
+		&attachment.ID,
+		&attachment.OrganisationID,
+		&attachment.InvoiceID,
+		&attachment.FileID,
+		&attachment.Name,
+		&attachment.Size,
+		&attachment.ContentType,
+		&attachment.SHA256,
+		&attachment.ScanStatus,
+		&attachment.ScanSignature,
+		&attachment.UserID,
+		&attachment.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachment, nil
+}
+
+// GetAll returns the attachments of the invoice in the order they were added.
+func (m AttachmentModel) GetAll(invoiceID int64) ([]*Attachment, error) {
+	query := `
+		SELECT ` + attachmentColumns + `
+		FROM attachments a
+		JOIN attachment_files f ON f.id = a.file_id
+		WHERE a.invoice_id = $1
+		ORDER BY a.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []*Attachment{}
+
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// Get returns an attachment of the invoice.
+func (m AttachmentModel) Get(invoiceID, id int64) (*Attachment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + attachmentColumns + `
+		FROM attachments a
+		JOIN attachment_files f ON f.id = a.file_id
+		WHERE a.invoice_id = $1 AND a.id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	attachment, err := scanAttachment(m.DB.QueryRow(ctx, query, invoiceID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return attachment, nil
+}
+
+// ClaimFile returns the file with the SHA-256, which is added if it's new; created
+// tells whether its content still has to be stored. Claiming a file postpones its
+// removal by AttachmentFileGrace, so it can be attached even if no attachment refers
+// to it right now. A new file gets the scan status, ScanPending when a scanner is
+// configured; an unscanned file gets it as well, so it's scanned now.
+func (m AttachmentModel) ClaimFile(sha256 string, size int64, contentType, scanStatus string) (file *AttachmentFile, created bool, err error) {
+	query := `
+		INSERT INTO attachment_files (sha256, size, content_type, scan_status)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (sha256) DO UPDATE
+		SET updated_at = NOW(),
+			scan_status = CASE WHEN attachment_files.scan_status = 'unscanned'
+				THEN EXCLUDED.scan_status ELSE attachment_files.scan_status END
+		RETURNING id, sha256, size, content_type, ref_count, scan_status, xmax = 0`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	file = &AttachmentFile{}
+
+	err = m.DB.QueryRow(ctx, query, sha256, size, contentType, scanStatus).Scan(
+		&file.ID,
+		&file.SHA256,
+		&file.Size,
+		&file.ContentType,
+		&file.RefCount,
+		&file.ScanStatus,
+		&created,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return file, created, nil
+}
+
+// Insert adds the attachment of the claimed file.
+func (m AttachmentModel) Insert(attachment *Attachment) error {
+	query := `
+		INSERT INTO attachments (organisation_id, invoice_id, file_id, name, user_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		attachment.OrganisationID,
+		attachment.InvoiceID,
+		attachment.FileID,
+		attachment.Name,
+		attachment.UserID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&attachment.ID, &attachment.CreatedAt)
+}
+
+// Delete removes the attachment. Its file stays in the storage until
+// RemoveUnusedFiles() finds that no attachment refers to it.
+func (m AttachmentModel) Delete(invoiceID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, "DELETE FROM attachments WHERE invoice_id = $1 AND id = $2", invoiceID, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RemoveUnusedFiles removes up to batchSize files which no attachment has referred to
+// for AttachmentFileGrace. remove deletes the content of a file from the storage; the
+// row of the file is locked meanwhile, so an upload claiming the same file waits and
+// stores the content again. A file whose content can't be removed is kept.
+func (m AttachmentModel) RemoveUnusedFiles(batchSize int, remove func(file *AttachmentFile) error) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT id, sha256, size, content_type, ref_count, scan_status
+		FROM attachment_files
+		WHERE ref_count = 0 AND updated_at < $1
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.Query(ctx, query, time.Now().Add(-AttachmentFileGrace), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	files := []*AttachmentFile{}
+
+	for rows.Next() {
+		var file AttachmentFile
+
+		err := rows.Scan(&file.ID, &file.SHA256, &file.Size, &file.ContentType, &file.RefCount, &file.ScanStatus)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		files = append(files, &file)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, file := range files {
+		err = remove(file)
+		if err != nil {
+			continue
+		}
+
+		_, err = tx.Exec(ctx, "DELETE FROM attachment_files WHERE id = $1", file.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		removed++
+	}
+
+	return removed, tx.Commit(ctx)
+}
+
+// PendingFiles returns up to limit files waiting to be scanned, the oldest first.
+func (m AttachmentModel) PendingFiles(limit int) ([]*AttachmentFile, error) {
+	query := `
+		SELECT id, sha256, size, content_type, ref_count, scan_status
+		FROM attachment_files
+		WHERE scan_status = 'pending'
+		ORDER BY id
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*AttachmentFile{}
+
+	for rows.Next() {
+		var file AttachmentFile
+
+		err := rows.Scan(&file.ID, &file.SHA256, &file.Size, &file.ContentType, &file.RefCount, &file.ScanStatus)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, &file)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// FinishScan records the verdict on a pending file, ScanClean or ScanInfected with the
+// signature of the virus. It reports false if the file was no longer pending, e.g.
+// because another instance scanned it first.
+func (m AttachmentModel) FinishScan(file *AttachmentFile, status string, signature *string) (bool, error) {
+	query := `
+		UPDATE attachment_files
+		SET scan_status = $1, scan_signature = $2, scanned_at = NOW()
+		WHERE id = $3 AND scan_status = 'pending'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, status, signature, file.ID)
+	if err != nil {
+		return false, err
+	}
+
+	file.ScanStatus = status
+	return result.RowsAffected() > 0, nil
+}
+
+// FailScan counts a failed scan of a pending file, which is given up as ScanFailed
+// after MaxScanAttempts.
+func (m AttachmentModel) FailScan(file *AttachmentFile) error {
+	query := `
+		UPDATE attachment_files
+		SET scan_attempts = scan_attempts + 1,
+			scan_status = CASE WHEN scan_attempts + 1 >= $1 THEN 'failed' ELSE scan_status END
+		WHERE id = $2 AND scan_status = 'pending'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, MaxScanAttempts, file.ID)
+	return err
+}
+
+// RescanFile sets the file of the attachment back to pending, e.g. after the scan
+// failed or the signatures were updated. Infected files stay in the quarantine.
+func (m AttachmentModel) RescanFile(attachment *Attachment) error {
+	query := `
+		UPDATE attachment_files
+		SET scan_status = 'pending', scan_attempts = 0, scan_signature = NULL, scanned_at = NULL
+		WHERE id = $1 AND scan_status <> 'infected'
+		RETURNING scan_status`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, attachment.FileID).Scan(&attachment.ScanStatus)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	attachment.ScanSignature = nil
+	return nil
+}
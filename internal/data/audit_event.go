@@ -0,0 +1,50 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AuditEvent records a sensitive action performed by a user, like writing off an
+// invoice. Events are never updated or deleted by the application.
+type AuditEvent struct {
+	ID        int64                  `json:"id"`
+	UserID    *int64                 `json:"user_id,omitempty"`
+	Action    string                 `json:"action"`
+	Entity    string                 `json:"entity"`
+	EntityID  int64                  `json:"entity_id,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt *time.Time             `json:"created_at,omitempty"`
+}
+
+// Define a AuditEventModel struct type which wraps a pgx.Conn connection pool.
+type AuditEventModel struct {
+	DB *pgxpool.Pool
+}
+
+// Add method for inserting a new record in the audit_events table.
+func (m AuditEventModel) Insert(event *AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (user_id, action, entity, entity_id, details)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	if event.Details == nil {
+		event.Details = map[string]interface{}{}
+	}
+
+	args := []interface{}{
+		event.UserID,
+		event.Action,
+		event.Entity,
+		event.EntityID,
+		event.Details,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
@@ -0,0 +1,216 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The states of a backup. A backup which was still running when its instance stopped
+// is marked as failed by the next one.
+const (
+	BackupRunning   = "running"
+	BackupSucceeded = "succeeded"
+	BackupFailed    = "failed"
+)
+
+// Backup is a dump of the database written to the backup directory.
+type Backup struct {
+	ID         int64      `json:"id"`
+	Status     string     `json:"status"`
+	File       string     `json:"file"`
+	Size       *int64     `json:"size,omitempty"`
+	Error      *string    `json:"error,omitempty"`
+	UserID     *int64     `json:"user_id,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	RemovedAt  *time.Time `json:"removed_at,omitempty"`
+}
+
+// Define a BackupModel struct type which wraps a pgx.Conn connection pool.
+type BackupModel struct {
+	DB *pgxpool.Pool
+}
+
+// Insert records a running backup.
+func (m BackupModel) Insert(backup *Backup) error {
+	query := `
+		INSERT INTO backups (file, user_id)
+		VALUES ($1, $2)
+		RETURNING id, status, started_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, backup.File, backup.UserID).Scan(&backup.ID, &backup.Status, &backup.StartedAt)
+}
+
+// Finish records the result of the backup.
+func (m BackupModel) Finish(backup *Backup) error {
+	query := `
+		UPDATE backups
+		SET status = $1, size = $2, error = $3, finished_at = NOW()
+		WHERE id = $4
+		RETURNING finished_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, backup.Status, backup.Size, backup.Error, backup.ID).Scan(&backup.FinishedAt)
+}
+
+// Interrupt marks the backups which are still running as failed. It must only be
+// called while holding the backup lock, when no backup can be running.
+func (m BackupModel) Interrupt() error {
+	query := `
+		UPDATE backups
+		SET status = 'failed', error = 'interrupted', finished_at = NOW()
+		WHERE status = 'running'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query)
+	return err
+}
+
+// Get returns the backup.
+func (m BackupModel) Get(id int64) (*Backup, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, status, file, size, error, user_id, started_at, finished_at, removed_at
+		FROM backups
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var backup Backup
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&backup.ID,
+		&backup.Status,
+		&backup.File,
+		&backup.Size,
+		&backup.Error,
+		&backup.UserID,
+		&backup.StartedAt,
+		&backup.FinishedAt,
+		&backup.RemovedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &backup, nil
+}
+
+// GetAll returns the latest backups, the newest first.
+func (m BackupModel) GetAll(limit int) ([]*Backup, error) {
+	query := `
+		SELECT id, status, file, size, error, user_id, started_at, finished_at, removed_at
+		FROM backups
+		ORDER BY started_at DESC, id DESC
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backups := []*Backup{}
+
+	for rows.Next() {
+		var backup Backup
+
+		err := rows.Scan(
+			&backup.ID,
+			&backup.Status,
+			&backup.File,
+			&backup.Size,
+			&backup.Error,
+			&backup.UserID,
+			&backup.StartedAt,
+			&backup.FinishedAt,
+			&backup.RemovedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, &backup)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return backups, nil
+}
+
+// Expired returns the succeeded backups which the retention policy removes: all but
+// the newest keep backups and those started before the time. 0 and nil disable the
+// limits. The newest backup is never expired.
+func (m BackupModel) Expired(keep int, before *time.Time) ([]*Backup, error) {
+	query := `
+		SELECT id, file
+		FROM (
+			SELECT id, file, started_at, row_number() OVER (ORDER BY started_at DESC, id DESC) AS position
+			FROM backups
+			WHERE status = 'succeeded' AND removed_at IS NULL) b
+		WHERE position > 1
+			AND (($1 > 0 AND position > $1) OR started_at < $2)
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, keep, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backups := []*Backup{}
+
+	for rows.Next() {
+		var backup Backup
+
+		err := rows.Scan(&backup.ID, &backup.File)
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, &backup)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return backups, nil
+}
+
+// SetRemoved records that the file of the backup has been deleted.
+func (m BackupModel) SetRemoved(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, "UPDATE backups SET removed_at = NOW() WHERE id = $1", id)
+	return err
+}
@@ -3,11 +3,13 @@ package data
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/ElOtro/stockup-api/internal/encryption"
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // OrganisationDetails type details
@@ -35,9 +37,48 @@ func ValidateBankAccount(v *validator.Validator, bankAccount *BankAccount) {
 	v.Check(bankAccount.Name != "", "bank_accounts name", "must be provided")
 }
 
-// Define a BankAccount struct type which wraps a pgx.Conn connection pool.
+// Define a BankAccount struct type which wraps a pgx.Conn connection pool. Account
+// numbers are stored encrypted with the Keyring.
 type BankAccountModel struct {
-	DB *pgxpool.Pool
+	DB      *pgxpool.Pool
+	Keyring *encryption.Keyring
+}
+
+// encrypt returns a copy of the details with the account numbers encrypted.
+func (m BankAccountModel) encrypt(details *BankAccountDetails) (*BankAccountDetails, error) {
+	if details == nil {
+		return nil, nil
+	}
+
+	encrypted := *details
+
+	for _, field := range []*string{&encrypted.Account, &encrypted.CorrAccount} {
+		value, err := m.Keyring.Encrypt(*field)
+		if err != nil {
+			return nil, err
+		}
+		*field = value
+	}
+
+	return &encrypted, nil
+}
+
+// decrypt replaces the encrypted account numbers read from the database with their
+// plain values.
+func (m BankAccountModel) decrypt(details *BankAccountDetails) error {
+	if details == nil {
+		return nil
+	}
+
+	for _, field := range []*string{&details.Account, &details.CorrAccount} {
+		value, err := m.Keyring.Decrypt(*field)
+		if err != nil {
+			return err
+		}
+		*field = value
+	}
+
+	return nil
 }
 
 func (m BankAccountModel) GetAll(organisationID int64) ([]*BankAccount, error) {
@@ -83,6 +124,11 @@ func (m BankAccountModel) GetAll(organisationID int64) ([]*BankAccount, error) {
 			return nil, err
 		}
 
+		err = m.decrypt(bankAccount.Details)
+		if err != nil {
+			return nil, err
+		}
+
 		// Add the Organisation struct to the slice.
 		bankAccounts = append(bankAccounts, &bankAccount)
 	}
@@ -103,15 +149,20 @@ func (m BankAccountModel) Insert(organisationID int64, bankAccount *BankAccount)
 		INSERT INTO bank_accounts (organisation_id, name, is_default, details) VALUES ($1, $2, $3, $4)
 		RETURNING id, name, is_default, details, created_at, updated_at`
 
+	details, err := m.encrypt(bankAccount.Details)
+	if err != nil {
+		return err
+	}
+
 	args := []interface{}{
 		organisationID,
 		bankAccount.Name,
 		bankAccount.IsDefault,
-		bankAccount.Details,
+		details,
 	}
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(
+	err = m.DB.QueryRow(context.Background(), query, args...).Scan(
 		&bankAccount.ID,
 		&bankAccount.Name,
 		&bankAccount.IsDefault,
@@ -119,6 +170,11 @@ func (m BankAccountModel) Insert(organisationID int64, bankAccount *BankAccount)
 		&bankAccount.CreatedAt,
 		&bankAccount.UpdatedAt,
 	)
+	if err != nil {
+		return err
+	}
+
+	return m.decrypt(bankAccount.Details)
 }
 
 // Add method for fetching a specific record from the organisations table.
@@ -167,40 +223,60 @@ func (m BankAccountModel) Get(organisationID int64, id int64) (*BankAccount, err
 		}
 	}
 
+	err = m.decrypt(bankAccount.Details)
+	if err != nil {
+		return nil, err
+	}
+
+	bankAccount.OrganisationID = organisationID
+
 	return &bankAccount, nil
 }
 
-// Add method for updating a specific record in the organisations table.
+// Add method for updating a specific record in the bank_accounts table. Only a bank
+// account of bankAccount.OrganisationID is updated, ErrRecordNotFound is returned for
+// others.
 func (m BankAccountModel) Update(bankAccount *BankAccount) error {
 	query := `
 		UPDATE bank_accounts
 		SET name = $1, is_default = $2, details = $3, updated_at = NOW() 
-		WHERE id = $4
+		WHERE id = $4 AND organisation_id = $5
 		RETURNING updated_at`
 
+	details, err := m.encrypt(bankAccount.Details)
+	if err != nil {
+		return err
+	}
+
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
 		bankAccount.Name,
 		bankAccount.IsDefault,
-		bankAccount.Details,
+		details,
 		bankAccount.ID,
+		bankAccount.OrganisationID,
 	}
 
 	// Use the QueryRow() method to execute the query, passing in the args slice as a
 	// variadic parameter and scanning the new version value into the movie struct.
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(&bankAccount.UpdatedAt)
+	err = m.DB.QueryRow(context.Background(), query, args...).Scan(&bankAccount.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
 }
 
-// Add method for deleting a specific record from the organisations table.
-func (m BankAccountModel) Delete(id int64) error {
+// Add method for deleting a specific record from the bank_accounts table. Only a bank
+// account of the organisation is deleted.
+func (m BankAccountModel) Delete(organisationID, id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
-	if id < 1 {
+	if id < 1 || organisationID < 1 {
 		return ErrRecordNotFound
 	}
 
 	// Construct the SQL query to delete the record.
 	query := `
-		DELETE FROM bank_accounts WHERE id = $1`
+		DELETE FROM bank_accounts WHERE id = $1 AND organisation_id = $2`
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -209,7 +285,7 @@ func (m BankAccountModel) Delete(id int64) error {
 	// Execute the SQL query using the Exec() method, passing in the id variable as
 	// the value for the placeholder parameter. The Exec() method returns a sql.Result
 	// object.
-	result, err := m.DB.Exec(ctx, query, id)
+	result, err := m.DB.Exec(ctx, query, id, organisationID)
 	if err != nil {
 		return err
 	}
@@ -227,3 +303,65 @@ func (m BankAccountModel) Delete(id int64) error {
 
 	return nil
 }
+
+// RotateKeys re-encrypts the account numbers of all bank accounts with the current key
+// of the Keyring. Values stored before encryption was enabled are encrypted as well.
+// It returns the number of updated bank accounts.
+func (m BankAccountModel) RotateKeys() (int64, error) {
+	type row struct {
+		id      int64
+		details *BankAccountDetails
+	}
+
+	rows, err := m.DB.Query(context.Background(), "SELECT id, details FROM bank_accounts ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+
+	// Read all rows first, the connection can't be used for updates while the
+	// resultset is open.
+	bankAccounts := []*row{}
+	for rows.Next() {
+		var r row
+
+		err := rows.Scan(&r.id, &r.details)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		bankAccounts = append(bankAccounts, &r)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	query := "UPDATE bank_accounts SET details = $1 WHERE id = $2"
+
+	var updated int64
+	for _, r := range bankAccounts {
+		if r.details == nil {
+			continue
+		}
+
+		changed, err := rotateFields(m.Keyring, []*string{&r.details.Account, &r.details.CorrAccount})
+		if err != nil {
+			return updated, fmt.Errorf("bank account %d: %w", r.id, err)
+		}
+
+		if !changed {
+			continue
+		}
+
+		_, err = m.DB.Exec(context.Background(), query, r.details, r.id)
+		if err != nil {
+			return updated, err
+		}
+
+		updated++
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// BankAccountActivityParams describes the activity report of a bank account: the
+// periods of the kind Period from Start to End. Quarters and years start with the
+// month FiscalYearStart of the organisation.
+type BankAccountActivityParams struct {
+	OrganisationID  int64
+	BankAccountID   int64
+	Period          string
+	FiscalYearStart int
+	Start           *time.Time
+	End             *time.Time
+}
+
+// BankAccountActivity sums up per period the invoices which ask to pay to a bank
+// account and the payments received on it. Matched is the part of the received
+// amount applied to invoices, Unmatched the rest still to be reconciled.
+type BankAccountActivity struct {
+	Start         time.Time             `json:"start"`
+	End           time.Time             `json:"end"`
+	InvoicesCount int64                 `json:"invoices_count"`
+	Invoiced      Money                 `json:"invoiced"`
+	PaymentsCount int64                 `json:"payments_count"`
+	Received      Money                 `json:"received"`
+	Matched       Money                 `json:"matched"`
+	Unmatched     Money                 `json:"unmatched"`
+	Links         *BankAccountStatement `json:"links,omitempty"`
+}
+
+// BankAccountStatement links a period of the activity to the lists of its invoices and
+// payments, to compare them with the statement of the bank.
+type BankAccountStatement struct {
+	Invoices string `json:"invoices"`
+	Payments string `json:"payments"`
+}
+
+func ValidateBankAccountActivityParams(v *validator.Validator, params BankAccountActivityParams) {
+	v.Check(validator.In(params.Period, PeriodKinds...), "period", "must be month, quarter or year")
+}
+
+// Activity returns the activity of the bank account per period, oldest first. Periods
+// without invoices and payments are left out. Like the other reports it leaves out
+// advance and deleted invoices; archived invoices are included.
+func (m BankAccountModel) Activity(ctx context.Context, params BankAccountActivityParams) ([]*BankAccountActivity, error) {
+	// The invoices and the payments are filtered alike, with the same arguments.
+	f := filter{}
+	f.where("organisation_id = " + f.arg(params.OrganisationID))
+	f.where("bank_account_id = " + f.arg(params.BankAccountID))
+	f.where("destroyed_at IS NULL")
+	f.dateRange("date", params.Start, params.End)
+
+	// The months are summed up here and put together into the periods below, as
+	// quarters and years may start with any month.
+	query := fmt.Sprintf(`
+		WITH invoiced AS (
+			SELECT date_trunc('month', date) AS month, COUNT(*) AS count, SUM(amount) AS amount
+			FROM invoices_history
+			WHERE %s AND is_advance = false
+			GROUP BY 1
+		), received AS (
+			SELECT date_trunc('month', date) AS month, COUNT(*) AS count, SUM(amount) AS amount,
+				SUM(amount - (%s)) AS matched
+			FROM payments
+			WHERE %s
+			GROUP BY 1
+		)
+		SELECT month, COALESCE(i.count, 0), COALESCE(i.amount, 0),
+			COALESCE(r.count, 0), COALESCE(r.amount, 0), COALESCE(r.matched, 0)
+		FROM invoiced i FULL JOIN received r USING (month)
+		ORDER BY month`,
+		f.and(), paymentUnallocatedColumn, f.and())
+
+	// Create a context with a 3-second timeout, unless the caller has a deadline.
+	ctx, cancel := queryContext(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	activity := []*BankAccountActivity{}
+	var current *BankAccountActivity
+
+	for rows.Next() {
+		var month time.Time
+		var row BankAccountActivity
+
+		err := rows.Scan(
+			&month,
+			&row.InvoicesCount,
+			&row.Invoiced,
+			&row.PaymentsCount,
+			&row.Received,
+			&row.Matched,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		start, end := PeriodBounds(params.Period, month, params.FiscalYearStart)
+		if current == nil || !current.Start.Equal(start) {
+			current = &BankAccountActivity{Start: start, End: end}
+			activity = append(activity, current)
+		}
+
+		current.InvoicesCount += row.InvoicesCount
+		current.Invoiced += row.Invoiced
+		current.PaymentsCount += row.PaymentsCount
+		current.Received += row.Received
+		current.Matched += row.Matched
+		current.Unmatched = current.Received - current.Matched
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return activity, nil
+}
@@ -0,0 +1,466 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrPeriodInvoiced is returned when the month of a billing plan has already been
+// invoiced.
+var ErrPeriodInvoiced = errors.New("the period has already been invoiced")
+
+// BillingPlan is a retainer or subscription of a company: Amount is invoiced every
+// calendar month on InvoiceDay, and IncludedQuantity hours or items are included in
+// it. What is used above it is charged at OveragePrice with the next month's invoice.
+type BillingPlan struct {
+	ID               int64      `json:"id"`
+	OrganisationID   int64      `json:"organisation_id"`
+	CompanyID        int64      `json:"company_id"`
+	Name             string     `json:"name"`
+	ProductID        int64      `json:"product_id"`
+	UnitID           int64      `json:"unit_id,omitempty"`
+	VatRateID        int64      `json:"vat_rate_id,omitempty"`
+	Amount           Money      `json:"amount"`
+	IncludedQuantity float64    `json:"included_quantity"`
+	OveragePrice     Money      `json:"overage_price"`
+	InvoiceDay       int        `json:"invoice_day"`
+	StartsOn         time.Time  `json:"starts_on"`
+	EndsOn           *time.Time `json:"ends_on,omitempty"`
+	IsActive         bool       `json:"is_active"`
+	CreatedAt        *time.Time `json:"created_at,omitempty"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty"`
+}
+
+// BillingPlanUsage is a quantity used under a plan, counted in the month of its date.
+type BillingPlanUsage struct {
+	ID            int64      `json:"id"`
+	BillingPlanID int64      `json:"billing_plan_id"`
+	Date          time.Time  `json:"date"`
+	Quantity      float64    `json:"quantity"`
+	Description   string     `json:"description"`
+	UserID        *int64     `json:"user_id,omitempty"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+}
+
+// BillingPeriod is a month of a plan with the quantity used in it. Overage is the
+// quantity used above the included one, charged with the next month's invoice.
+type BillingPeriod struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Included  float64   `json:"included"`
+	Used      float64   `json:"used"`
+	Remaining float64   `json:"remaining"`
+	Overage   float64   `json:"overage"`
+	InvoiceID *int64    `json:"invoice_id,omitempty"`
+}
+
+type BillingPlanFilters struct {
+	OrganisationID int64
+	CompanyID      int64
+}
+
+func ValidateBillingPlan(v *validator.Validator, plan *BillingPlan) {
+	v.Check(plan.OrganisationID != 0, "organisation_id", "must be provided")
+	v.Check(plan.CompanyID != 0, "company_id", "must be provided")
+	v.Check(plan.ProductID != 0, "product_id", "must be provided")
+	v.Check(plan.Name != "", "name", "must be provided")
+	v.Check(len(plan.Name) <= 255, "name", "must not be more than 255 bytes long")
+	v.Check(plan.Amount >= 0, "amount", "must not be negative")
+	v.Check(plan.IncludedQuantity >= 0, "included_quantity", "must not be negative")
+	v.Check(plan.OveragePrice >= 0, "overage_price", "must not be negative")
+	v.Check(plan.InvoiceDay >= 1 && plan.InvoiceDay <= 28, "invoice_day", "must be a day between 1 and 28")
+	v.Check(!plan.StartsOn.IsZero(), "starts_on", "must be provided")
+	if plan.EndsOn != nil {
+		v.Check(!plan.EndsOn.Before(plan.StartsOn), "ends_on", "must not be before starts_on")
+	}
+}
+
+func ValidateBillingPlanUsage(v *validator.Validator, usage *BillingPlanUsage) {
+	v.Check(usage.Quantity > 0, "quantity", "must be greater than zero")
+	v.Check(usage.Quantity < 10_000_000, "quantity", "must be less than 10000000")
+	v.Check(!usage.Date.IsZero(), "date", "must be provided")
+	v.Check(len(usage.Description) <= 1000, "description", "must not be more than 1000 bytes long")
+}
+
+// PeriodStart returns the first day of the month of the day.
+func PeriodStart(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Define a BillingPlanModel struct type which wraps a pgx.Conn connection pool.
+type BillingPlanModel struct {
+	DB *pgxpool.Pool
+}
+
+const billingPlanColumns = `
+	id, organisation_id, company_id, name, product_id, COALESCE(unit_id, 0), COALESCE(vat_rate_id, 0), amount,
+	included_quantity, overage_price, invoice_day, starts_on, ends_on, is_active, created_at, updated_at`
+
+func scanBillingPlan(row pgx.Row) (*BillingPlan, error) {
+	var plan BillingPlan
+
+	err := row.Scan(
+		&plan.ID,
+		&plan.OrganisationID,
+		&plan.CompanyID,
+		&plan.Name,
+		&plan.ProductID,
+		&plan.UnitID,
+		&plan.VatRateID,
+		&plan.Amount,
+		&plan.IncludedQuantity,
+		&plan.OveragePrice,
+		&plan.InvoiceDay,
+		&plan.StartsOn,
+		&plan.EndsOn,
+		&plan.IsActive,
+		&plan.CreatedAt,
+		&plan.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plan, nil
+}
+
+func (m BillingPlanModel) all(query string, args ...interface{}) ([]*BillingPlan, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []*BillingPlan{}
+
+	for rows.Next() {
+		plan, err := scanBillingPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		plans = append(plans, plan)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return plans, nil
+}
+
+// GetAll returns the plans of the organisation, of one company if it is given.
+func (m BillingPlanModel) GetAll(filters BillingPlanFilters) ([]*BillingPlan, error) {
+	query := `
+		SELECT ` + billingPlanColumns + `
+		FROM billing_plans
+		WHERE ($1::bigint = 0 OR organisation_id = $1) AND ($2::bigint = 0 OR company_id = $2)
+		ORDER BY id`
+
+	return m.all(query, filters.OrganisationID, filters.CompanyID)
+}
+
+// Due returns the active plans which are due an invoice for the month of the day: the
+// month has started for them, its invoice day has come and it hasn't been invoiced
+// yet. Months missed while the job didn't run aren't invoiced afterwards, nor are the
+// plans of deleted companies or products.
+func (m BillingPlanModel) Due(day time.Time) ([]*BillingPlan, error) {
+	query := `
+		SELECT ` + billingPlanColumns + `
+		FROM billing_plans
+		WHERE is_active = true AND invoice_day <= $2
+			AND date_trunc('month', starts_on)::date <= $1::date AND (ends_on IS NULL OR ends_on >= $1::date)
+			AND NOT EXISTS (SELECT 1 FROM companies WHERE companies.id = billing_plans.company_id AND companies.destroyed_at IS NOT NULL)
+			AND NOT EXISTS (SELECT 1 FROM products WHERE products.id = billing_plans.product_id AND products.destroyed_at IS NOT NULL)
+			AND NOT EXISTS (
+				SELECT 1 FROM billing_plan_periods
+				WHERE billing_plan_id = billing_plans.id AND period_start = $1
+			)
+		ORDER BY id`
+
+	return m.all(query, PeriodStart(day), day.Day())
+}
+
+// Get returns the plan.
+func (m BillingPlanModel) Get(id int64) (*BillingPlan, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + billingPlanColumns + `
+		FROM billing_plans
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	plan, err := scanBillingPlan(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// Insert adds the plan.
+func (m BillingPlanModel) Insert(plan *BillingPlan) error {
+	query := `
+		INSERT INTO billing_plans (
+			organisation_id, company_id, name, product_id, unit_id, vat_rate_id, amount, included_quantity,
+			overage_price, invoice_day, starts_on, ends_on, is_active)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, 0), $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id, created_at, updated_at`
+
+	args := []interface{}{
+		plan.OrganisationID,
+		plan.CompanyID,
+		plan.Name,
+		plan.ProductID,
+		plan.UnitID,
+		plan.VatRateID,
+		plan.Amount,
+		plan.IncludedQuantity,
+		plan.OveragePrice,
+		plan.InvoiceDay,
+		plan.StartsOn,
+		plan.EndsOn,
+		plan.IsActive,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&plan.ID, &plan.CreatedAt, &plan.UpdatedAt)
+}
+
+// Update saves the plan. The months invoiced already keep their invoices.
+func (m BillingPlanModel) Update(plan *BillingPlan) error {
+	query := `
+		UPDATE billing_plans
+		SET name = $1, product_id = $2, unit_id = NULLIF($3, 0), vat_rate_id = NULLIF($4, 0), amount = $5,
+			included_quantity = $6, overage_price = $7, invoice_day = $8, starts_on = $9, ends_on = $10,
+			is_active = $11, updated_at = NOW()
+		WHERE id = $12
+		RETURNING updated_at`
+
+	args := []interface{}{
+		plan.Name,
+		plan.ProductID,
+		plan.UnitID,
+		plan.VatRateID,
+		plan.Amount,
+		plan.IncludedQuantity,
+		plan.OveragePrice,
+		plan.InvoiceDay,
+		plan.StartsOn,
+		plan.EndsOn,
+		plan.IsActive,
+		plan.ID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&plan.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the plan with its usage. The invoices it created are kept.
+func (m BillingPlanModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, "DELETE FROM billing_plans WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// InsertUsage records a quantity used under the plan.
+func (m BillingPlanModel) InsertUsage(usage *BillingPlanUsage) error {
+	query := `
+		INSERT INTO billing_plan_usages (billing_plan_id, date, quantity, description, user_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{usage.BillingPlanID, usage.Date, usage.Quantity, usage.Description, usage.UserID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&usage.ID, &usage.CreatedAt)
+}
+
+// GetUsage returns the usage recorded in the month starting at the period start.
+func (m BillingPlanModel) GetUsage(planID int64, periodStart time.Time) ([]*BillingPlanUsage, error) {
+	query := `
+		SELECT id, billing_plan_id, date, quantity, description, user_id, created_at
+		FROM billing_plan_usages
+		WHERE billing_plan_id = $1 AND date >= $2 AND date < $2::date + INTERVAL '1 month'
+		ORDER BY date, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, planID, periodStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*BillingPlanUsage, error) {
+		var usage BillingPlanUsage
+		err := row.Scan(&usage.ID, &usage.BillingPlanID, &usage.Date, &usage.Quantity, &usage.Description, &usage.UserID, &usage.CreatedAt)
+		return &usage, err
+	})
+}
+
+// Periods returns the months of the plan from the month of its start up to the month
+// of the day, or of its end if it ended before, the latest first.
+func (m BillingPlanModel) Periods(plan *BillingPlan, day time.Time) ([]*BillingPeriod, error) {
+	last := PeriodStart(day)
+	if plan.EndsOn != nil && plan.EndsOn.Before(last) {
+		last = PeriodStart(*plan.EndsOn)
+	}
+
+	query := `
+		SELECT months.start::date, COALESCE(SUM(u.quantity), 0), bpp.invoice_id
+		FROM generate_series(date_trunc('month', $2::timestamp), $3::timestamp, INTERVAL '1 month') AS months (start)
+		LEFT JOIN billing_plan_usages u ON u.billing_plan_id = $1
+			AND u.date >= months.start AND u.date < months.start + INTERVAL '1 month'
+		LEFT JOIN billing_plan_periods bpp ON bpp.billing_plan_id = $1 AND bpp.period_start = months.start
+		GROUP BY months.start, bpp.invoice_id
+		ORDER BY months.start DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, plan.ID, plan.StartsOn, last)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*BillingPeriod, error) {
+		var start time.Time
+		var used float64
+		var invoiceID *int64
+
+		err := row.Scan(&start, &used, &invoiceID)
+		if err != nil {
+			return nil, err
+		}
+
+		period := plan.Period(start, used)
+		period.InvoiceID = invoiceID
+
+		return period, nil
+	})
+}
+
+// Period returns the month of the plan starting at start with the quantity used in it.
+func (plan *BillingPlan) Period(start time.Time, used float64) *BillingPeriod {
+	period := &BillingPeriod{
+		Start:    start,
+		End:      start.AddDate(0, 1, -1),
+		Included: plan.IncludedQuantity,
+		Used:     used,
+	}
+
+	// Quantities are numeric(10,3), the difference is rounded to thousandths so a float
+	// remainder isn't charged.
+	difference := math.Round((used-plan.IncludedQuantity)*1000) / 1000
+	if difference > 0 {
+		period.Overage = difference
+	} else {
+		period.Remaining = -difference
+	}
+
+	return period
+}
+
+// Invoice creates the invoice of the month of the plan starting at periodStart and
+// records the month as invoiced, in one transaction. It returns ErrPeriodInvoiced if
+// the month has been invoiced already, e.g. by another instance.
+func (m BillingPlanModel) Invoice(planID int64, periodStart time.Time, invoice *Invoice, items []*InvoiceItem) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `
+		INSERT INTO billing_plan_periods (billing_plan_id, period_start) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, planID, periodStart)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrPeriodInvoiced
+	}
+
+	err = InvoiceModel{DB: m.DB}.insert(ctx, tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		item.InvoiceID = invoice.ID
+	}
+
+	err = insertInvoiceItems(ctx, tx, items)
+	if err != nil {
+		return err
+	}
+
+	_, err = recalculateInvoice(ctx, tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE billing_plan_periods SET invoice_id = $1
+		WHERE billing_plan_id = $2 AND period_start = $3`, invoice.ID, planID, periodStart)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
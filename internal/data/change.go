@@ -0,0 +1,63 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The channel the notify_change trigger announces the changes of the core tables on.
+const changesChannel = "table_changes"
+
+// Change is a row of a core table which has been inserted, updated or deleted by a
+// committed transaction of any API instance. OrganisationID is empty for rows which
+// are shared by all organisations, e.g. units.
+type Change struct {
+	Table          string `json:"table"`
+	Operation      string `json:"operation"`
+	ID             int64  `json:"id"`
+	OrganisationID *int64 `json:"organisation_id,omitempty"`
+}
+
+// Define a ChangeModel struct type which wraps a pgx.Conn connection pool.
+type ChangeModel struct {
+	DB *pgxpool.Pool
+}
+
+// Listen calls fn with every change until the context is cancelled or the connection
+// fails. Changes made while nobody listens are lost, so listening is called once the
+// connection listens and anything read before has to be assumed changed. The
+// connection is taken out of the pool for good, it can't be reused while it listens.
+func (m ChangeModel) Listen(ctx context.Context, listening func(), fn func(Change)) error {
+	pooled, err := m.DB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "LISTEN "+changesChannel)
+	if err != nil {
+		return err
+	}
+
+	listening()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var change Change
+
+		err = json.Unmarshal([]byte(notification.Payload), &change)
+		if err != nil {
+			return err
+		}
+
+		fn(change)
+	}
+}
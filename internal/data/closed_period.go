@@ -0,0 +1,201 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrPeriodAlreadyClosed is returned when the same period of an organisation is closed
+// twice.
+var ErrPeriodAlreadyClosed = errors.New("period already closed")
+
+// The kinds of periods which can be closed.
+const (
+	PeriodMonth   = "month"
+	PeriodQuarter = "quarter"
+	PeriodYear    = "year"
+)
+
+var PeriodKinds = []string{PeriodMonth, PeriodQuarter, PeriodYear}
+
+// ClosedPeriod is a period of an organisation closed for the books, from StartDate to
+// EndDate inclusive.
+type ClosedPeriod struct {
+	ID             int64      `json:"id"`
+	OrganisationID int64      `json:"organisation_id"`
+	Kind           string     `json:"kind"`
+	StartDate      time.Time  `json:"start_date"`
+	EndDate        time.Time  `json:"end_date"`
+	UserID         *int64     `json:"user_id,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
+
+func ValidateClosedPeriod(v *validator.Validator, period *ClosedPeriod) {
+	v.Check(period.OrganisationID != 0, "organisation_id", "must be provided")
+	v.Check(validator.In(period.Kind, PeriodKinds...), "kind", "must be month, quarter or year")
+}
+
+// PeriodBounds returns the first and the last day of the period of the kind the date
+// falls in. Quarters and years start with the month fiscalYearStart, e.g. with 4 the
+// first quarter runs from April to June.
+func PeriodBounds(kind string, date time.Time, fiscalYearStart int) (time.Time, time.Time) {
+	start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	months := 1
+	switch kind {
+	case PeriodQuarter:
+		months = 3
+	case PeriodYear:
+		months = 12
+	}
+
+	// The months since the start of the fiscal year.
+	offset := (int(date.Month()) - fiscalYearStart + 12) % 12
+	start = start.AddDate(0, -(offset % months), 0)
+
+	return start, start.AddDate(0, months, -1)
+}
+
+// Define a ClosedPeriodModel struct type which wraps a pgx.Conn connection pool.
+type ClosedPeriodModel struct {
+	DB *pgxpool.Pool
+}
+
+// Insert closes the period.
+func (m ClosedPeriodModel) Insert(period *ClosedPeriod) error {
+	query := `
+		INSERT INTO closed_periods (organisation_id, kind, start_date, end_date, user_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		period.OrganisationID,
+		period.Kind,
+		period.StartDate,
+		period.EndDate,
+		period.UserID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&period.ID, &period.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrPeriodAlreadyClosed
+		}
+		return err
+	}
+
+	return nil
+}
+
+// GetAll returns the closed periods of the organisation, the latest first.
+func (m ClosedPeriodModel) GetAll(organisationID int64) ([]*ClosedPeriod, error) {
+	query := `
+		SELECT id, organisation_id, kind, start_date, end_date, user_id, created_at
+		FROM closed_periods
+		WHERE organisation_id = $1
+		ORDER BY start_date DESC, end_date DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := []*ClosedPeriod{}
+
+	for rows.Next() {
+		var period ClosedPeriod
+
+		err := rows.Scan(
+			&period.ID,
+			&period.OrganisationID,
+			&period.Kind,
+			&period.StartDate,
+			&period.EndDate,
+			&period.UserID,
+			&period.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		periods = append(periods, &period)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return periods, nil
+}
+
+// Covering returns the earliest closed period of the organisation which one of the
+// dates falls in, or ErrRecordNotFound if they are all in open periods.
+func (m ClosedPeriodModel) Covering(organisationID int64, dates ...time.Time) (*ClosedPeriod, error) {
+	query := `
+		SELECT id, organisation_id, kind, start_date, end_date, user_id, created_at
+		FROM closed_periods
+		WHERE organisation_id = $1
+			AND EXISTS (SELECT 1 FROM unnest($2::date[]) AS d WHERE d BETWEEN start_date AND end_date)
+		ORDER BY start_date
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var period ClosedPeriod
+
+	err := m.DB.QueryRow(ctx, query, organisationID, dates).Scan(
+		&period.ID,
+		&period.OrganisationID,
+		&period.Kind,
+		&period.StartDate,
+		&period.EndDate,
+		&period.UserID,
+		&period.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &period, nil
+}
+
+// Delete reopens the period.
+func (m ClosedPeriodModel) Delete(organisationID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, "DELETE FROM closed_periods WHERE organisation_id = $1 AND id = $2", organisationID, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
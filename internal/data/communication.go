@@ -0,0 +1,288 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The kinds of the emails sent by the API: the statements of the statement mailer and
+// the invoices of send batches. Payment reminders are "reminder", other kinds are
+// chosen by whoever records the communication.
+const (
+	CommunicationStatement = "statement"
+	CommunicationInvoice   = "invoice"
+)
+
+// Channels of communications.
+const (
+	ChannelEmail   = "email"
+	ChannelSMS     = "sms"
+	ChannelWebhook = "webhook"
+	ChannelPortal  = "portal"
+)
+
+var CommunicationChannels = []string{ChannelEmail, ChannelSMS, ChannelWebhook, ChannelPortal}
+
+// Outcomes of communications. Portal views are "viewed", outbound messages are "sent"
+// or "failed".
+const (
+	CommunicationSent   = "sent"
+	CommunicationFailed = "failed"
+	CommunicationViewed = "viewed"
+)
+
+var CommunicationStatuses = []string{CommunicationSent, CommunicationFailed, CommunicationViewed}
+
+// Communication is an entry of the log of interactions with a company or its invoices.
+// Addresses are not logged, only the contact they were taken from.
+type Communication struct {
+	ID             int64                  `json:"id"`
+	OrganisationID int64                  `json:"organisation_id,omitempty"`
+	CompanyID      int64                  `json:"company_id"`
+	InvoiceID      *int64                 `json:"invoice_id,omitempty"`
+	ContactID      *int64                 `json:"contact_id,omitempty"`
+	UserID         *int64                 `json:"user_id,omitempty"`
+	Kind           string                 `json:"kind"`
+	Channel        string                 `json:"channel"`
+	Subject        string                 `json:"subject"`
+	PeriodStart    *time.Time             `json:"period_start,omitempty"`
+	Status         string                 `json:"status"`
+	Error          *string                `json:"error,omitempty"`
+	Details        map[string]interface{} `json:"details,omitempty"`
+	CreatedAt      *time.Time             `json:"created_at,omitempty"`
+}
+
+type CommunicationFilters struct {
+	CompanyID int64
+	InvoiceID int64
+	Channel   string
+	Kind      string
+	Start     *time.Time
+	End       *time.Time
+}
+
+func ValidateCommunication(v *validator.Validator, communication *Communication) {
+	v.Check(communication.CompanyID != 0, "company_id", "must be provided")
+	v.Check(communication.Kind != "", "kind", "must be provided")
+	v.Check(len(communication.Kind) <= 20, "kind", "must not be more than 20 bytes long")
+	v.Check(validator.In(communication.Channel, CommunicationChannels...), "channel", "must be email, sms, webhook or portal")
+	v.Check(validator.In(communication.Status, CommunicationStatuses...), "status", "must be sent, failed or viewed")
+	v.Check(communication.Status != CommunicationViewed || communication.Channel == ChannelPortal, "status", "viewed is only allowed for the portal")
+}
+
+func ValidateCommunicationFilters(v *validator.Validator, filters CommunicationFilters) {
+	if filters.Channel != "" {
+		v.Check(validator.In(filters.Channel, CommunicationChannels...), "channel", "must be email, sms, webhook or portal")
+	}
+}
+
+// StatementRecipient is a company which is due a statement from an organisation.
+type StatementRecipient struct {
+	OrganisationID int64
+	CompanyID      int64
+	ContactID      int64
+}
+
+// Define a CommunicationModel struct type which wraps a pgx.Conn connection pool.
+type CommunicationModel struct {
+	DB *pgxpool.Pool
+}
+
+// Add method for inserting a new record in the communications table. An invoice which
+// has been sent or viewed is no longer a draft.
+func (m CommunicationModel) Insert(communication *Communication) error {
+	query := `
+		WITH communication AS (
+			INSERT INTO communications (
+				organisation_id, company_id, invoice_id, contact_id, user_id, kind, channel, subject,
+				period_start, status, error, details)
+			VALUES (NULLIF($1::bigint, 0), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			RETURNING id, invoice_id, status, created_at
+		), sent AS (
+			` + markInvoiceSent("SELECT invoice_id FROM communication WHERE status IN ('sent', 'viewed')") + `
+		)
+		SELECT id, created_at FROM communication`
+
+	if communication.Details == nil {
+		communication.Details = map[string]interface{}{}
+	}
+
+	args := []interface{}{
+		communication.OrganisationID,
+		communication.CompanyID,
+		communication.InvoiceID,
+		communication.ContactID,
+		communication.UserID,
+		communication.Kind,
+		communication.Channel,
+		communication.Subject,
+		communication.PeriodStart,
+		communication.Status,
+		communication.Error,
+		communication.Details,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&communication.ID, &communication.CreatedAt)
+}
+
+// GetAll returns the timeline of communications with a company, newest first by
+// default.
+func (m CommunicationModel) GetAll(filters CommunicationFilters, pagination Pagination) ([]*Communication, Metadata, error) {
+	f := filter{}
+
+	if filters.CompanyID > 0 {
+		f.where("company_id = " + f.arg(filters.CompanyID))
+	}
+
+	if filters.InvoiceID > 0 {
+		f.where("invoice_id = " + f.arg(filters.InvoiceID))
+	}
+
+	if filters.Channel != "" {
+		f.where("channel = " + f.arg(filters.Channel))
+	}
+
+	if filters.Kind != "" {
+		f.where("kind = " + f.arg(filters.Kind))
+	}
+
+	f.dateRange("created_at", filters.Start, filters.End)
+
+	// The count takes the arguments of the filter only, without the limit and offset.
+	filterQuery, args := f.clause(), f.args
+
+	query := fmt.Sprintf(`
+		SELECT id, COALESCE(organisation_id, 0), company_id, invoice_id, contact_id, user_id, kind, channel,
+			subject, period_start, status, error, details, created_at
+		FROM communications
+		%s
+		ORDER BY %s %s, id %s
+		LIMIT %s OFFSET %s`, filterQuery, pagination.sortColumn(), pagination.sortDirection(),
+		pagination.sortDirection(), f.arg(pagination.limit()), f.arg(pagination.offset()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	communications := []*Communication{}
+
+	for rows.Next() {
+		var communication Communication
+
+		err := rows.Scan(
+			&communication.ID,
+			&communication.OrganisationID,
+			&communication.CompanyID,
+			&communication.InvoiceID,
+			&communication.ContactID,
+			&communication.UserID,
+			&communication.Kind,
+			&communication.Channel,
+			&communication.Subject,
+			&communication.PeriodStart,
+			&communication.Status,
+			&communication.Error,
+			&communication.Details,
+			&communication.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		communications = append(communications, &communication)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	totalRecords, err := m.CountIDs(filterQuery, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, pagination.Page, pagination.Limit)
+
+	return communications, metadata, nil
+}
+
+// Count records in a table
+func (m CommunicationModel) CountIDs(filterQuery string, args ...interface{}) (int64, error) {
+	query := fmt.Sprintf("select count(id) from communications %s", filterQuery)
+	var count int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&count)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// DueStatements returns the companies which opted in to statement emails, have open
+// invoices of an organisation and haven't been sent the statement of that organisation
+// for the period yet. Failed attempts don't count, so they are retried.
+func (m CommunicationModel) DueStatements(periodStart time.Time) ([]*StatementRecipient, error) {
+	query := `
+		SELECT DISTINCT i.organisation_id, c.id, c.statement_contact_id
+		FROM companies c
+		JOIN invoices i ON i.company_id = c.id
+		WHERE c.statement_contact_id IS NOT NULL AND c.destroyed_at IS NULL
+			AND i.organisation_id IS NOT NULL AND i.is_advance = false
+			AND i.written_off_at IS NULL AND i.status <> 'cancelled' AND i.destroyed_at IS NULL
+			AND COALESCE(i.amount, 0) + COALESCE(i.vat, 0) > COALESCE((SELECT SUM(amount) FROM payment_allocations WHERE invoice_id = i.id), 0)
+			AND NOT EXISTS (
+				SELECT 1 FROM communications cm
+				WHERE cm.company_id = c.id AND cm.organisation_id = i.organisation_id
+					AND cm.kind = $1 AND cm.period_start = $2 AND cm.status = $3)
+		ORDER BY i.organisation_id, c.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, CommunicationStatement, periodStart, CommunicationSent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := []*StatementRecipient{}
+
+	for rows.Next() {
+		var recipient StatementRecipient
+
+		err := rows.Scan(&recipient.OrganisationID, &recipient.CompanyID, &recipient.ContactID)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, &recipient)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
@@ -4,12 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"regexp"
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // CompanyDetails type details
@@ -20,20 +20,36 @@ type CompanyDetails struct {
 	Address string `json:"address,omitempty"`
 }
 
+// CompanyDefaults holds the settings which pre-fill a new invoice for the company
+// when the client doesn't send them.
+type CompanyDefaults struct {
+	OrganisationID  int64 `json:"organisation_id,omitempty"`
+	BankAccountID   int64 `json:"bank_account_id,omitempty"`
+	AgreementID     int64 `json:"agreement_id,omitempty"`
+	VatRateID       int64 `json:"vat_rate_id,omitempty"`
+	PaymentTermDays int   `json:"payment_term_days,omitempty"`
+}
+
 // Company type
 type Company struct {
-	ID           int64           `json:"id"`
-	Logo         *string         `json:"logo,omitempty"`
-	Name         string          `json:"name"`
-	FullName     string          `json:"full_name,omitempty"`
-	CompanyType  int             `json:"company_type,omitempty"`
-	Details      *CompanyDetails `json:"details,omitempty"`
-	UserID       *int64          `json:"user_id,omitempty"`
-	DestroyedAt  *time.Time      `json:"destroyed_at,omitempty"`
-	CreatedAt    *time.Time      `json:"created_at,omitempty"`
-	UpdatedAt    *time.Time      `json:"updated_at,omitempty"`
-	Organisation *Organisation   `json:"organisation,omitempty"`
-	Contacts     []*Contact      `json:"contacts,omitempty"`
+	ID          int64            `json:"id"`
+	Logo        *string          `json:"logo,omitempty"`
+	Name        string           `json:"name"`
+	FullName    string           `json:"full_name,omitempty"`
+	CompanyType int              `json:"company_type,omitempty"`
+	Details     *CompanyDetails  `json:"details,omitempty"`
+	GroupID     *int64           `json:"group_id,omitempty"`
+	Defaults    *CompanyDefaults `json:"defaults,omitempty"`
+	// The contact monthly statements are emailed to, nil if the company hasn't opted in.
+	StatementContactID *int64        `json:"statement_contact_id,omitempty"`
+	PaymentStats       *PaymentStats `json:"payment_stats,omitempty"`
+	AnonymizedAt       *time.Time    `json:"anonymized_at,omitempty"`
+	UserID             *int64        `json:"user_id,omitempty"`
+	DestroyedAt        *time.Time    `json:"destroyed_at,omitempty"`
+	CreatedAt          *time.Time    `json:"created_at,omitempty"`
+	UpdatedAt          *time.Time    `json:"updated_at,omitempty"`
+	Organisation       *Organisation `json:"organisation,omitempty"`
+	Contacts           []*Contact    `json:"contacts,omitempty"`
 }
 
 // CompanySearch  type
@@ -42,13 +58,39 @@ type CompanySearch struct {
 	Name string `json:"name"`
 }
 
+// The INN filter matches the beginning of the INN, so any number of digits is allowed.
+var innPrefixRX = regexp.MustCompile("^[0-9]*$")
+
+// Company types. company_type is an integer for historical reasons.
+const (
+	CompanyTypeLegalEntity  = 1
+	CompanyTypeEntrepreneur = 2
+	CompanyTypeIndividual   = 3
+)
+
 type CompanyFilters struct {
-	Name string
+	OrganisationID int64
+	Name           string
+	CompanyType    int
+	INN            string
+	// IncludeDeleted lists the deleted companies too, with their destroyed_at.
+	IncludeDeleted bool
 }
 
 func ValidateCompany(v *validator.Validator, company *Company) {
 	v.Check(company.Name != "", "name", "must be provided")
 	v.Check(company.CompanyType != 0, "company_type", "must be provided")
+
+	if company.Defaults != nil {
+		v.Check(company.Defaults.PaymentTermDays >= 0, "defaults.payment_term_days", "must not be negative")
+		v.Check(company.Defaults.PaymentTermDays <= 365, "defaults.payment_term_days", "must not be more than 365")
+	}
+}
+
+func ValidateCompanyFilters(v *validator.Validator, filters CompanyFilters) {
+	v.Check(filters.CompanyType >= 0, "company_type", "must not be negative")
+	v.Check(len(filters.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(filters.INN, innPrefixRX), "inn", "must contain digits only")
 }
 
 // Define a CompanyModel struct type which wraps a pgx.Conn connection pool.
@@ -57,21 +99,48 @@ type CompanyModel struct {
 }
 
 func (m CompanyModel) GetAll(filters CompanyFilters, pagination Pagination) ([]*Company, Metadata, error) {
-	// Construct the SQL query to retrieve all movie records.
-	queryElements := []string{}
-	filterQuery := ""
+	// Construct the SQL query to retrieve all movie records. Deleted companies, and those
+	// merged into another one, are left out unless asked for. The values of the filters
+	// are passed as query arguments; the limit and the offset follow them.
+	f := filter{}
+
+	if !filters.IncludeDeleted {
+		f.where("destroyed_at IS NULL")
+	}
+
+	// Companies aren't owned by an organisation, so the organisation filter selects the
+	// companies it has issued invoices to or received payments from.
+	if filters.OrganisationID > 0 {
+		organisationID := f.arg(filters.OrganisationID)
+		f.where(`id IN (
+			SELECT company_id FROM invoices_history WHERE organisation_id = ` + organisationID + `
+			UNION SELECT company_id FROM payments WHERE organisation_id = ` + organisationID + `)`)
+	}
+
+	if filters.CompanyType > 0 {
+		f.where("company_type = " + f.arg(filters.CompanyType))
+	}
+
+	if filters.Name != "" {
+		name := f.arg("%" + likeEscaper.Replace(filters.Name) + "%")
+		f.where("(name ILIKE " + name + " OR full_name ILIKE " + name + ")")
+	}
 
-	if len(queryElements) > 0 {
-		filterQuery = " WHERE " + strings.Join(queryElements, " AND ") + " "
+	if filters.INN != "" {
+		f.where("details->>'inn' LIKE " + f.arg(likeEscaper.Replace(filters.INN)+"%"))
 	}
 
+	// The count takes the arguments of the filter only, without the limit and offset.
+	filterQuery, args := f.clause(), f.args
+
 	// Construct the SQL query to retrieve all movie records.
 	query := fmt.Sprintf(`
-		SELECT id, logo, name, full_name, company_type, details, user_id, created_at, updated_at
+		SELECT id, logo, name, full_name, company_type, details, group_id, payment_stats, user_id, destroyed_at,
+			created_at, updated_at
 		FROM companies
 		%s
-		ORDER BY %s %s
-		LIMIT $1 OFFSET $2`, filterQuery, pagination.sortColumn(), pagination.sortDirection())
+		ORDER BY %s %s NULLS LAST
+		LIMIT %s OFFSET %s`, filterQuery, pagination.sortColumn(), pagination.sortDirection(), f.arg(pagination.limit()), f.arg(pagination.offset()))
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -79,7 +148,7 @@ func (m CompanyModel) GetAll(filters CompanyFilters, pagination Pagination) ([]*
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
-	rows, err := m.DB.Query(ctx, query, pagination.limit(), pagination.offset())
+	rows, err := m.DB.Query(ctx, query, f.args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -104,7 +173,10 @@ func (m CompanyModel) GetAll(filters CompanyFilters, pagination Pagination) ([]*
 			&company.FullName,
 			&company.CompanyType,
 			&company.Details,
+			&company.GroupID,
+			&company.PaymentStats,
 			&company.UserID,
+			&company.DestroyedAt,
 			&company.CreatedAt,
 			&company.UpdatedAt,
 		)
@@ -124,7 +196,7 @@ func (m CompanyModel) GetAll(filters CompanyFilters, pagination Pagination) ([]*
 
 	// Generate a Metadata struct, passing in the total record count and pagination
 	// parameters from the client.
-	totalRecords, err := m.CountIDs()
+	totalRecords, err := m.CountIDs(filterQuery, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -136,22 +208,16 @@ func (m CompanyModel) GetAll(filters CompanyFilters, pagination Pagination) ([]*
 
 // Use for search companies
 func (m CompanyModel) Search(filters CompanyFilters) ([]*CompanySearch, error) {
-	// Construct the SQL query to retrieve all movie records.
-	queryElements := []string{}
-	filterQuery := ""
-	q := ""
+	// The name is passed as a query argument, like the filters of GetAll.
+	f := filter{}
+	f.where("destroyed_at IS NULL")
 
 	if filters.Name != "" {
-		q = fmt.Sprintf("(to_tsvector('simple', name) @@ plainto_tsquery('simple', '%s') OR name = '')", filters.Name)
-		queryElements = append(queryElements, q)
-	}
-
-	if len(queryElements) > 0 {
-		filterQuery = " WHERE " + strings.Join(queryElements, " AND ") + " "
+		f.where("(to_tsvector('simple', name) @@ plainto_tsquery('simple', " + f.arg(filters.Name) + ") OR name = '')")
 	}
 
 	// Construct the SQL query to retrieve all movie records.
-	query := fmt.Sprintf("SELECT id, name FROM companies %s  ORDER BY name LIMIT 10", filterQuery)
+	query := "SELECT id, name FROM companies" + f.clause() + "ORDER BY name LIMIT 10"
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -159,7 +225,7 @@ func (m CompanyModel) Search(filters CompanyFilters) ([]*CompanySearch, error) {
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
-	rows, err := m.DB.Query(ctx, query)
+	rows, err := m.DB.Query(ctx, query, f.args...)
 	if err != nil {
 		return nil, err
 	}
@@ -203,14 +269,17 @@ func (m CompanyModel) Insert(company *Company) error {
 	// Define the SQL query for inserting a new record
 	query := `
 		INSERT INTO companies (
-			name, full_name, company_type, details) VALUES ($1, $2, $3, $4)
-		RETURNING id, name, full_name, company_type, details, created_at, updated_at`
+			name, full_name, company_type, details, group_id, defaults) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, name, full_name, company_type, details, group_id, defaults, statement_contact_id,
+		created_at, updated_at`
 
 	args := []interface{}{
 		company.Name,
 		company.FullName,
 		company.CompanyType,
 		company.Details,
+		company.GroupID,
+		company.Defaults,
 	}
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool
@@ -220,6 +289,9 @@ func (m CompanyModel) Insert(company *Company) error {
 		&company.FullName,
 		&company.CompanyType,
 		&company.Details,
+		&company.GroupID,
+		&company.Defaults,
+		&company.StatementContactID,
 		&company.CreatedAt,
 		&company.UpdatedAt,
 	)
@@ -237,8 +309,9 @@ func (m CompanyModel) Get(id int64) (*Company, error) {
 
 	// Define the SQL query for retrieving data.
 	query := `
-		SELECT id, name, full_name, company_type, details, created_at, updated_at 
-		FROM companies WHERE id = $1`
+		SELECT id, name, full_name, company_type, details, group_id, defaults, statement_contact_id,
+		payment_stats, anonymized_at, created_at, updated_at 
+		FROM companies WHERE id = $1 AND destroyed_at IS NULL`
 
 	// Declare a Company struct to hold the data returned by the query.
 	var company Company
@@ -256,6 +329,11 @@ func (m CompanyModel) Get(id int64) (*Company, error) {
 		&company.FullName,
 		&company.CompanyType,
 		&company.Details,
+		&company.GroupID,
+		&company.Defaults,
+		&company.StatementContactID,
+		&company.PaymentStats,
+		&company.AnonymizedAt,
 		&company.CreatedAt,
 		&company.UpdatedAt,
 	)
@@ -279,8 +357,9 @@ func (m CompanyModel) Get(id int64) (*Company, error) {
 func (m CompanyModel) Update(company *Company) error {
 	query := `
 		UPDATE companies
-		SET logo = $1, name = $2, full_name = $3, company_type = $4, details = $5, updated_at = NOW() 
-		WHERE id = $6
+		SET logo = $1, name = $2, full_name = $3, company_type = $4, details = $5, group_id = $6, defaults = $7,
+		statement_contact_id = $8, updated_at = NOW() 
+		WHERE id = $9
 		RETURNING updated_at`
 
 	// Create an args slice containing the values for the placeholder parameters.
@@ -290,6 +369,9 @@ func (m CompanyModel) Update(company *Company) error {
 		company.FullName,
 		company.CompanyType,
 		company.Details,
+		company.GroupID,
+		company.Defaults,
+		company.StatementContactID,
 		company.ID,
 	}
 
@@ -298,7 +380,8 @@ func (m CompanyModel) Update(company *Company) error {
 	return m.DB.QueryRow(context.Background(), query, args...).Scan(&company.UpdatedAt)
 }
 
-// Add method for deleting a specific record from the companies table.
+// Add method for deleting a specific record from the companies table. The record is only
+// marked as destroyed, the documents referring to it keep it.
 func (m CompanyModel) Delete(id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
@@ -307,7 +390,8 @@ func (m CompanyModel) Delete(id int64) error {
 
 	// Construct the SQL query to delete the record.
 	query := `
-		DELETE FROM companies WHERE id = $1`
+		UPDATE companies SET destroyed_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND destroyed_at IS NULL`
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -336,12 +420,12 @@ func (m CompanyModel) Delete(id int64) error {
 }
 
 // Count records in a table
-func (m CompanyModel) CountIDs() (int64, error) {
-	query := "select count(id) from companies"
+func (m CompanyModel) CountIDs(filterQuery string, args ...interface{}) (int64, error) {
+	query := fmt.Sprintf("select count(id) from companies %s", filterQuery)
 	var count int64
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	err := m.DB.QueryRow(ctx, query).Scan(&count)
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&count)
 
 	// Importantly, use defer to make sure that we cancel the context before the Get()
 	// method returns.
@@ -360,3 +444,100 @@ func (m CompanyModel) CountIDs() (int64, error) {
 	}
 	return count, nil
 }
+
+// Anonymize irreversibly removes personal data of the company's contacts. Invoices,
+// payments and the company record itself are kept, so financial reports stay intact.
+// It returns the number of anonymized contacts.
+func (m CompanyModel) Anonymize(id int64) (int64, error) {
+	if id < 1 {
+		return 0, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// Mark the company first, so two concurrent requests can't both succeed.
+	query := `
+		UPDATE companies SET logo = NULL, anonymized_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND anonymized_at IS NULL`
+
+	result, err := tx.Exec(ctx, query, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if result.RowsAffected() == 0 {
+		return 0, ErrEditConflict
+	}
+
+	query = `
+		UPDATE contacts
+		SET title = '', name = 'anonymized', phone = '', email = '', sign = NULL, details = '{}'::jsonb, updated_at = NOW()
+		WHERE company_id = $1`
+
+	result, err = tx.Exec(ctx, query, id)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// Merge moves the invoices, acts, payments, contacts, branches, agreements and
+// communications of the duplicates to the company and soft-deletes the duplicates, in
+// one transaction. It returns how many records of each table were moved,
+// ErrRecordNotFound when the company doesn't exist and ErrMergeDuplicates when one of
+// the duplicates doesn't.
+func (m CompanyModel) Merge(id int64, duplicateIDs []int64) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = lockMergedRecords(ctx, tx, "companies", id, duplicateIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The branches of the duplicates are moved as well, the default stays that of the
+	// company.
+	_, err = tx.Exec(ctx, `UPDATE company_branches SET is_default = false WHERE company_id = ANY($1) AND is_default`, duplicateIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	moved := map[string]int64{}
+
+	for _, table := range []string{"invoices", "invoices_archive", "acts", "payments", "contacts", "company_branches", "agreements", "communications"} {
+		result, err := tx.Exec(ctx, `UPDATE `+table+` SET company_id = $1 WHERE company_id = ANY($2)`, id, duplicateIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		moved[table] = result.RowsAffected()
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE companies SET destroyed_at = NOW(), updated_at = NOW() WHERE id = ANY($1)`, duplicateIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return moved, tx.Commit(ctx)
+}
@@ -0,0 +1,247 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrBranchInUse is returned when a branch which invoices are issued to is deleted.
+var ErrBranchInUse = errors.New("the branch is used by invoices")
+
+// A KPP is 9 characters: the tax office, the reason code and a serial number. The
+// reason code may contain capital latin letters.
+var KPPRX = regexp.MustCompile("^[0-9]{4}[0-9A-Z]{2}[0-9]{3}$")
+
+// CompanyBranch is a division of a company with its own KPP and address, e.g. a
+// branch office of a large customer which is invoiced separately. Documents issued to
+// a branch are printed with its KPP and address instead of those of the company.
+type CompanyBranch struct {
+	ID        int64      `json:"id" db:"id"`
+	CompanyID int64      `json:"company_id" db:"company_id"`
+	Name      string     `json:"name" db:"name"`
+	KPP       string     `json:"kpp" db:"kpp"`
+	Address   string     `json:"address" db:"address"`
+	IsDefault bool       `json:"is_default" db:"is_default"`
+	CreatedAt *time.Time `json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func ValidateCompanyBranch(v *validator.Validator, branch *CompanyBranch) {
+	v.Check(branch.Name != "", "name", "must be provided")
+	v.Check(len(branch.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(branch.KPP == "" || validator.Matches(branch.KPP, KPPRX), "kpp", "must be 9 characters like 773601001")
+	v.Check(len(branch.Address) <= 1000, "address", "must not be more than 1000 bytes long")
+}
+
+// ApplyTo replaces the KPP and the address in the details of the company with those
+// of the branch, keeping the ones of the company the branch leaves empty.
+func (b *CompanyBranch) ApplyTo(details *CompanyDetails) *CompanyDetails {
+	applied := CompanyDetails{}
+	if details != nil {
+		applied = *details
+	}
+
+	if b.KPP != "" {
+		applied.KPP = b.KPP
+	}
+	if b.Address != "" {
+		applied.Address = b.Address
+	}
+
+	return &applied
+}
+
+// Define a CompanyBranchModel struct type which wraps a pgx.Conn connection pool.
+type CompanyBranchModel struct {
+	DB *pgxpool.Pool
+}
+
+const companyBranchColumns = "id, company_id, name, kpp, address, is_default, created_at, updated_at"
+
+// GetAll returns the branches of the company, the default one first.
+func (m CompanyBranchModel) GetAll(companyID int64) ([]*CompanyBranch, error) {
+	query := `
+		SELECT ` + companyBranchColumns + `
+		FROM company_branches
+		WHERE company_id = $1
+		ORDER BY is_default DESC, name, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[CompanyBranch])
+}
+
+// Get returns a branch of the company.
+func (m CompanyBranchModel) Get(companyID, id int64) (*CompanyBranch, error) {
+	if id < 1 || companyID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + companyBranchColumns + `
+		FROM company_branches
+		WHERE company_id = $1 AND id = $2`
+
+	return m.getOne(query, companyID, id)
+}
+
+// Default returns the default branch of the company, ErrRecordNotFound if it has none.
+func (m CompanyBranchModel) Default(companyID int64) (*CompanyBranch, error) {
+	query := `
+		SELECT ` + companyBranchColumns + `
+		FROM company_branches
+		WHERE company_id = $1 AND is_default`
+
+	return m.getOne(query, companyID)
+}
+
+func (m CompanyBranchModel) getOne(query string, args ...interface{}) (*CompanyBranch, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	branch, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[CompanyBranch])
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return branch, nil
+}
+
+// Insert adds a branch to branch.CompanyID. A new default branch replaces the previous
+// default of the company.
+func (m CompanyBranchModel) Insert(branch *CompanyBranch) error {
+	query := `
+		INSERT INTO company_branches (company_id, name, kpp, address, is_default)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, updated_at`
+
+	args := []interface{}{branch.CompanyID, branch.Name, branch.KPP, branch.Address, branch.IsDefault}
+
+	return m.save(branch, func(ctx context.Context, tx pgx.Tx) error {
+		return tx.QueryRow(ctx, query, args...).Scan(&branch.ID, &branch.CreatedAt, &branch.UpdatedAt)
+	})
+}
+
+// Update changes a branch of branch.CompanyID, ErrRecordNotFound is returned for others.
+// Making it the default replaces the previous default of the company.
+func (m CompanyBranchModel) Update(branch *CompanyBranch) error {
+	query := `
+		UPDATE company_branches
+		SET name = $1, kpp = $2, address = $3, is_default = $4, updated_at = NOW()
+		WHERE id = $5 AND company_id = $6
+		RETURNING updated_at`
+
+	args := []interface{}{branch.Name, branch.KPP, branch.Address, branch.IsDefault, branch.ID, branch.CompanyID}
+
+	return m.save(branch, func(ctx context.Context, tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, query, args...).Scan(&branch.UpdatedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	})
+}
+
+// save writes the branch with write in a transaction which first takes the default from
+// the other branches of the company if the branch becomes its default.
+func (m CompanyBranchModel) save(branch *CompanyBranch, write func(ctx context.Context, tx pgx.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	if branch.IsDefault {
+		query := `
+			UPDATE company_branches SET is_default = false, updated_at = NOW()
+			WHERE company_id = $1 AND is_default AND id <> $2`
+
+		_, err = tx.Exec(ctx, query, branch.CompanyID, branch.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = write(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Delete removes a branch of the company. Branches which invoices are issued to,
+// archived ones included, are kept and ErrBranchInUse is returned, as the invoices are
+// printed with their KPP and address.
+func (m CompanyBranchModel) Delete(companyID, id int64) error {
+	if id < 1 || companyID < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	var inUse bool
+
+	query := `
+		SELECT EXISTS (SELECT 1 FROM invoices_history WHERE branch_id = b.id)
+		FROM company_branches b
+		WHERE b.id = $1 AND b.company_id = $2
+		FOR UPDATE`
+
+	err = tx.QueryRow(ctx, query, id, companyID).Scan(&inUse)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if inUse {
+		return ErrBranchInUse
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM company_branches WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
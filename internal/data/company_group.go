@@ -0,0 +1,80 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CompanyGroup type joins companies of one holding, so their statements and
+// outstanding balances can be consolidated.
+type CompanyGroup struct {
+	ID          int64            `json:"id" db:"id"`
+	Name        string           `json:"name" db:"name"`
+	Companies   []*CompanySearch `json:"companies,omitempty" db:"companies"`
+	DestroyedAt *time.Time       `json:"destroyed_at,omitempty" db:"destroyed_at"`
+	CreatedAt   *time.Time       `json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt   *time.Time       `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func ValidateCompanyGroup(v *validator.Validator, companyGroup *CompanyGroup) {
+	v.Check(companyGroup.Name != "", "name", "must be provided")
+}
+
+// Define a CompanyGroupModel struct type which wraps a pgx.Conn connection pool.
+type CompanyGroupModel struct {
+	DB *pgxpool.Pool
+}
+
+// Groups are deleted for good, their companies are released by the foreign key.
+func (m CompanyGroupModel) repository() repository[CompanyGroup] {
+	return repository[CompanyGroup]{
+		DB:      m.DB,
+		table:   "company_groups",
+		columns: []string{"id", "name", "created_at", "updated_at"},
+	}
+}
+
+func (m CompanyGroupModel) GetAll() ([]*CompanyGroup, error) {
+	return m.repository().all(context.Background(), "", "id")
+}
+
+// Add method for inserting a new record in the company_groups table.
+func (m CompanyGroupModel) Insert(companyGroup *CompanyGroup) error {
+	return m.repository().insert(companyGroup, []string{"name"}, companyGroup.Name)
+}
+
+// Add method for fetching a specific record from the company_groups table.
+func (m CompanyGroupModel) Get(id int64) (*CompanyGroup, error) {
+	// The PostgreSQL bigserial type that we're using for the movie ID starts
+	// auto-incrementing at 1 by default, so we know that no company groups will have ID values
+	// less than that. To avoid making an unnecessary database call, we take a shortcut
+	// and return an ErrRecordNotFound error straight away.
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	// Define the SQL query for retrieving data.
+	query := `
+		SELECT id, name,
+		(SELECT json_agg(row) FROM (SELECT id, name FROM companies WHERE group_id = company_groups.id AND destroyed_at IS NULL ORDER BY name) row) AS companies,
+		created_at, updated_at
+		FROM company_groups WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.repository().one(ctx, query, id)
+}
+
+// Add method for updating a specific record in the company_groups table.
+func (m CompanyGroupModel) Update(companyGroup *CompanyGroup) error {
+	return m.repository().update(companyGroup, companyGroup.ID, []string{"name"}, companyGroup.Name)
+}
+
+// Add method for deleting a specific record from the company_groups table.
+func (m CompanyGroupModel) Delete(id int64) error {
+	return m.repository().delete(id)
+}
@@ -3,22 +3,86 @@ package data
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/ElOtro/stockup-api/internal/encryption"
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// ContactDetails type details
+// ContactDetails holds further ways to reach a contact: its handles in messengers, by
+// messenger, its secondary emails and free notes. The handles and the emails are
+// personal data and stored encrypted like the email of the contact.
 type ContactDetails struct {
-	Telegram string `json:"telegram"`
+	Messengers map[string]string `json:"messengers,omitempty"`
+	Emails     []string          `json:"emails,omitempty"`
+	Notes      string            `json:"notes,omitempty"`
 }
 
+// The messengers a contact can be reached in.
+const (
+	MessengerTelegram = "telegram"
+	MessengerWhatsApp = "whatsapp"
+	MessengerViber    = "viber"
+	MessengerSignal   = "signal"
+)
+
+var Messengers = []string{MessengerTelegram, MessengerWhatsApp, MessengerViber, MessengerSignal}
+
+func ValidateContactDetails(v *validator.Validator, details *ContactDetails) {
+	for messenger, handle := range details.Messengers {
+		v.Check(validator.In(messenger, Messengers...), "details.messengers", "must be telegram, whatsapp, viber or signal")
+		v.Check(handle != "", "details.messengers", "must not contain empty handles")
+		v.Check(len(handle) <= 100, "details.messengers", "must not contain handles more than 100 bytes long")
+	}
+
+	v.Check(len(details.Emails) <= 10, "details.emails", "must not contain more than 10 emails")
+	for _, email := range details.Emails {
+		v.Check(validator.Matches(email, validator.EmailRX), "details.emails", "must contain valid email addresses only")
+	}
+	v.Check(validator.Unique(details.Emails), "details.emails", "must not contain duplicate values")
+
+	v.Check(len(details.Notes) <= 2000, "details.notes", "must not be more than 2000 bytes long")
+}
+
+// transform replaces the emails and the messenger handles of the details with the
+// results of fn.
+func (d *ContactDetails) transform(fn func(string) (string, error)) error {
+	for i, email := range d.Emails {
+		value, err := fn(email)
+		if err != nil {
+			return err
+		}
+		d.Emails[i] = value
+	}
+
+	for messenger, handle := range d.Messengers {
+		value, err := fn(handle)
+		if err != nil {
+			return err
+		}
+		d.Messengers[messenger] = value
+	}
+
+	return nil
+}
+
+// The roles of a contact in the paperwork of its company.
+const (
+	ContactRoleSigner     = "signer"
+	ContactRoleAccountant = "accountant"
+	ContactRoleRecipient  = "recipient"
+)
+
+var ContactRoles = []string{ContactRoleSigner, ContactRoleAccountant, ContactRoleRecipient}
+
 // Contact type details
 type Contact struct {
 	ID          int64           `json:"id"`
 	Role        int             `json:"role"`
+	Roles       []string        `json:"roles"`
 	Title       string          `json:"title"`
 	Name        string          `json:"name"`
 	Phone       string          `json:"phone"`
@@ -31,25 +95,109 @@ type Contact struct {
 	DestroyedAt *time.Time      `json:"destroyed_at,omitempty"`
 	CreatedAt   *time.Time      `json:"created_at,omitempty"`
 	UpdatedAt   *time.Time      `json:"updated_at,omitempty"`
+	// Unsubscribed contacts are left out of the mail-merge exports.
+	Unsubscribed bool `json:"unsubscribed"`
 }
 
 func ValidateContact(v *validator.Validator, contact *Contact) {
 	v.Check(contact.Role != 0, "role", "must be provided")
 	v.Check(contact.Name != "", "name", "must be provided")
 	v.Check(!contact.StartAt.IsZero(), "start_at", "must be provided")
+
+	for _, role := range contact.Roles {
+		v.Check(validator.In(role, ContactRoles...), "roles", "must be signer, accountant or recipient")
+	}
+	v.Check(validator.Unique(contact.Roles), "roles", "must not contain duplicate values")
+
+	if contact.Details != nil {
+		ValidateContactDetails(v, contact.Details)
+	}
 }
 
-// Define a ContactModel struct type which wraps a pgx.Conn connection pool.
+// HasRole reports whether the contact has the role.
+func (c *Contact) HasRole(role string) bool {
+	return validator.In(role, c.Roles...)
+}
+
+// Define a ContactModel struct type which wraps a pgx.Conn connection pool. Names,
+// phones and emails of contacts are personal data, so they are stored encrypted with
+// the Keyring.
 type ContactModel struct {
-	DB *pgxpool.Pool
+	DB      *pgxpool.Pool
+	Keyring *encryption.Keyring
+}
+
+// encrypt returns the encrypted name, phone and email of the contact.
+func (m ContactModel) encrypt(contact *Contact) ([]string, error) {
+	values := []string{contact.Name, contact.Phone, contact.Email}
+
+	for i := range values {
+		encrypted, err := m.Keyring.Encrypt(values[i])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = encrypted
+	}
+
+	return values, nil
+}
+
+// encryptDetails returns a copy of the details of the contact with the emails and the
+// messenger handles encrypted. Contacts without details get empty ones.
+func (m ContactModel) encryptDetails(contact *Contact) (*ContactDetails, error) {
+	encrypted := &ContactDetails{}
+	if contact.Details == nil {
+		return encrypted, nil
+	}
+
+	encrypted.Notes = contact.Details.Notes
+
+	if len(contact.Details.Emails) > 0 {
+		encrypted.Emails = append([]string{}, contact.Details.Emails...)
+	}
+
+	if len(contact.Details.Messengers) > 0 {
+		encrypted.Messengers = make(map[string]string, len(contact.Details.Messengers))
+		for messenger, handle := range contact.Details.Messengers {
+			encrypted.Messengers[messenger] = handle
+		}
+	}
+
+	err := encrypted.transform(m.Keyring.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+// decrypt replaces the encrypted fields of a contact read from the database with
+// their plain values.
+func (m ContactModel) decrypt(contact *Contact) error {
+	for _, field := range []*string{&contact.Name, &contact.Phone, &contact.Email} {
+		plain, err := m.Keyring.Decrypt(*field)
+		if err != nil {
+			return err
+		}
+		*field = plain
+	}
+
+	if contact.Details != nil {
+		return contact.Details.transform(m.Keyring.Decrypt)
+	}
+
+	return nil
 }
 
-func (m ContactModel) GetAll(companyID int64) ([]*Contact, error) {
+// GetAll returns the contacts of the company, only the ones with the role unless it's
+// empty.
+func (m ContactModel) GetAll(companyID int64, role string) ([]*Contact, error) {
 	// Construct the SQL query to retrieve all movie records.
 	query := `
-		SELECT id, role, title, name, phone, email, start_at, details, created_at, updated_at 
+		SELECT id, role, roles, title, name, phone, email, start_at, sign, details, created_at, updated_at, unsubscribed 
 		FROM contacts 
-		WHERE company_id = $1`
+		WHERE company_id = $1 AND ($2 = '' OR $2 = ANY(roles))
+		ORDER BY id`
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -57,7 +205,7 @@ func (m ContactModel) GetAll(companyID int64) ([]*Contact, error) {
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
-	rows, err := m.DB.Query(ctx, query, companyID)
+	rows, err := m.DB.Query(ctx, query, companyID, role)
 	if err != nil {
 		return nil, err
 	}
@@ -78,19 +226,27 @@ func (m ContactModel) GetAll(companyID int64) ([]*Contact, error) {
 		err := rows.Scan(
 			&contact.ID,
 			&contact.Role,
+			&contact.Roles,
 			&contact.Title,
 			&contact.Name,
 			&contact.Phone,
 			&contact.Email,
 			&contact.StartAt,
+			&contact.Sign,
 			&contact.Details,
 			&contact.CreatedAt,
 			&contact.UpdatedAt,
+			&contact.Unsubscribed,
 		)
 		if err != nil {
 			return nil, err
 		}
 
+		err = m.decrypt(&contact)
+		if err != nil {
+			return nil, err
+		}
+
 		// Add the Organisation struct to the slice.
 		contacts = append(contacts, &contact)
 	}
@@ -104,38 +260,143 @@ func (m ContactModel) GetAll(companyID int64) ([]*Contact, error) {
 	return contacts, nil
 }
 
+// ContactExportFilters select the contacts of a mail-merge export. Without company IDs
+// the contacts of all companies are exported, with an organisation only those of the
+// companies it has issued invoices to or received payments from.
+type ContactExportFilters struct {
+	OrganisationID int64
+	CompanyIDs     []int64
+	Role           string
+}
+
+// ExportedContact is a contact with the name of its company.
+type ExportedContact struct {
+	Contact
+	CompanyName string
+}
+
+// Export returns the contacts for a mail-merge campaign, ordered by company. Contacts
+// which unsubscribed, have neither an email nor a phone or whose companies have been
+// deleted or anonymized are left out.
+func (m ContactModel) Export(filters ContactExportFilters) ([]*ExportedContact, error) {
+	query := `
+		SELECT c.id, c.company_id, COALESCE(co.name, ''), c.roles, COALESCE(c.title, ''), c.name, c.phone, c.email
+		FROM contacts c
+		INNER JOIN companies co ON co.id = c.company_id
+		WHERE c.unsubscribed = false AND c.destroyed_at IS NULL
+			AND co.destroyed_at IS NULL AND co.anonymized_at IS NULL
+			AND ($1 = '' OR $1 = ANY(c.roles))
+			AND (cardinality($2::bigint[]) = 0 OR c.company_id = ANY($2))
+			AND ($3::bigint = 0 OR c.company_id IN (
+				SELECT company_id FROM invoices_history WHERE organisation_id = $3
+				UNION SELECT company_id FROM payments WHERE organisation_id = $3))
+		ORDER BY co.name, c.company_id, c.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	companyIDs := filters.CompanyIDs
+	if companyIDs == nil {
+		companyIDs = []int64{}
+	}
+
+	rows, err := m.DB.Query(ctx, query, filters.Role, companyIDs, filters.OrganisationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contacts := []*ExportedContact{}
+
+	for rows.Next() {
+		var contact ExportedContact
+
+		err := rows.Scan(
+			&contact.ID,
+			&contact.CompanyID,
+			&contact.CompanyName,
+			&contact.Roles,
+			&contact.Title,
+			&contact.Name,
+			&contact.Phone,
+			&contact.Email,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.decrypt(&contact.Contact)
+		if err != nil {
+			return nil, err
+		}
+
+		if contact.Email == "" && contact.Phone == "" {
+			continue
+		}
+
+		contacts = append(contacts, &contact)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return contacts, nil
+}
+
 // Add method for inserting a new record in the contacts table.
 func (m ContactModel) Insert(companyID int64, contact *Contact) error {
 	// Define the SQL query for inserting a new record
 	query := `
-		INSERT INTO contacts (company_id, role, title, name, phone, email, start_at, details) 
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		RETURNING id, role, title, name, phone, email, start_at, details, created_at, updated_at`
+		INSERT INTO contacts (company_id, role, roles, title, name, phone, email, start_at, sign, details, unsubscribed) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id, role, roles, title, name, phone, email, start_at, sign, details, created_at, updated_at, unsubscribed`
+
+	encrypted, err := m.encrypt(contact)
+	if err != nil {
+		return err
+	}
+
+	details, err := m.encryptDetails(contact)
+	if err != nil {
+		return err
+	}
 
 	args := []interface{}{
 		companyID,
 		contact.Role,
+		contact.roles(),
 		contact.Title,
-		contact.Name,
-		contact.Phone,
-		contact.Email,
+		encrypted[0],
+		encrypted[1],
+		encrypted[2],
 		contact.StartAt,
-		contact.Details,
+		contact.Sign,
+		details,
+		contact.Unsubscribed,
 	}
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(
+	err = m.DB.QueryRow(context.Background(), query, args...).Scan(
 		&contact.ID,
 		&contact.Role,
+		&contact.Roles,
 		&contact.Title,
 		&contact.Name,
 		&contact.Phone,
 		&contact.Email,
 		&contact.StartAt,
+		&contact.Sign,
 		&contact.Details,
 		&contact.CreatedAt,
 		&contact.UpdatedAt,
+		&contact.Unsubscribed,
 	)
+	if err != nil {
+		return err
+	}
+
+	return m.decrypt(contact)
 }
 
 // Add method for fetching a specific record from the organisations table.
@@ -147,7 +408,7 @@ func (m ContactModel) Get(companyID int64, id int64) (*Contact, error) {
 
 	// Define the SQL query for retrieving data.
 	query := `
-		SELECT id, role, title, name, phone, email, start_at, details, created_at, updated_at 
+		SELECT id, role, roles, title, name, phone, email, start_at, sign, details, created_at, updated_at, unsubscribed 
 		FROM contacts 
 		WHERE company_id = $1 AND id = $2`
 
@@ -166,14 +427,17 @@ func (m ContactModel) Get(companyID int64, id int64) (*Contact, error) {
 	err := m.DB.QueryRow(ctx, query, args...).Scan(
 		&contact.ID,
 		&contact.Role,
+		&contact.Roles,
 		&contact.Title,
 		&contact.Name,
 		&contact.Phone,
 		&contact.Email,
 		&contact.StartAt,
+		&contact.Sign,
 		&contact.Details,
 		&contact.CreatedAt,
 		&contact.UpdatedAt,
+		&contact.Unsubscribed,
 	)
 
 	// Handle any errors. If there was no matching movie found, Scan() will return
@@ -188,45 +452,111 @@ func (m ContactModel) Get(companyID int64, id int64) (*Contact, error) {
 		}
 	}
 
+	err = m.decrypt(&contact)
+	if err != nil {
+		return nil, err
+	}
+
+	contact.CompanyID = companyID
+
 	return &contact, nil
 }
 
-// Add method for updating a specific record in the organisations table.
+// Add method for updating a specific record in the contacts table. Only a contact of
+// contact.CompanyID is updated, ErrRecordNotFound is returned for others.
 // role, title, name, phone, email, start_at
 func (m ContactModel) Update(contact *Contact) error {
 	query := `
 		UPDATE contacts
-		SET role = $1, title = $2, name = $3, phone = $4, email = $5, start_at = $6, details = $7, updated_at = NOW() 
-		WHERE id = $8
+		SET role = $1, roles = $2, title = $3, name = $4, phone = $5, email = $6, start_at = $7, sign = $8, details = $9,
+			unsubscribed = $10, updated_at = NOW() 
+		WHERE id = $11 AND company_id = $12
 		RETURNING updated_at`
 
+	encrypted, err := m.encrypt(contact)
+	if err != nil {
+		return err
+	}
+
+	details, err := m.encryptDetails(contact)
+	if err != nil {
+		return err
+	}
+
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
 		contact.Role,
+		contact.roles(),
 		contact.Title,
-		contact.Name,
-		contact.Phone,
-		contact.Email,
+		encrypted[0],
+		encrypted[1],
+		encrypted[2],
 		contact.StartAt,
-		contact.Details,
+		contact.Sign,
+		details,
+		contact.Unsubscribed,
 		contact.ID,
+		contact.CompanyID,
 	}
 
 	// Use the QueryRow() method to execute the query, passing in the args slice as a
 	// variadic parameter and scanning the new version value into the movie struct.
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(&contact.UpdatedAt)
+	err = m.DB.QueryRow(context.Background(), query, args...).Scan(&contact.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
 }
 
-// Add method for deleting a specific record from the organisations table.
-func (m ContactModel) Delete(id int64) error {
+// roles returns the roles to store, the column doesn't accept NULL.
+func (c *Contact) roles() []string {
+	if c.Roles == nil {
+		return []string{}
+	}
+	return c.Roles
+}
+
+// Signer returns the contact who signs the documents of the company dated date: the
+// signer who started last before that date. Signers without a start date are only
+// used when no other one has started. ErrRecordNotFound is returned if the company
+// has no signer.
+func (m ContactModel) Signer(companyID int64, date time.Time) (*Contact, error) {
+	query := `
+		SELECT id
+		FROM contacts
+		WHERE company_id = $1 AND $3 = ANY(roles) AND (start_at IS NULL OR start_at <= $2)
+		ORDER BY start_at DESC NULLS LAST, id DESC
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRow(ctx, query, companyID, date, ContactRoleSigner).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return m.Get(companyID, id)
+}
+
+// Add method for deleting a specific record from the contacts table. Only a contact of
+// the company is deleted.
+func (m ContactModel) Delete(companyID, id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
-	if id < 1 {
+	if id < 1 || companyID < 1 {
 		return ErrRecordNotFound
 	}
 
 	// Construct the SQL query to delete the record.
 	query := `
-		DELETE FROM contacts WHERE id = $1`
+		DELETE FROM contacts WHERE id = $1 AND company_id = $2`
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -235,7 +565,7 @@ func (m ContactModel) Delete(id int64) error {
 	// Execute the SQL query using the Exec() method, passing in the id variable as
 	// the value for the placeholder parameter. The Exec() method returns a sql.Result
 	// object.
-	result, err := m.DB.Exec(ctx, query, id)
+	result, err := m.DB.Exec(ctx, query, id, companyID)
 	if err != nil {
 		return err
 	}
@@ -253,3 +583,76 @@ func (m ContactModel) Delete(id int64) error {
 
 	return nil
 }
+
+// RotateKeys re-encrypts the personal data of all contacts with the current key of
+// the Keyring. Values stored before encryption was enabled are encrypted as well. It
+// returns the number of updated contacts.
+func (m ContactModel) RotateKeys() (int64, error) {
+	type row struct {
+		id      int64
+		fields  [3]*string
+		details ContactDetails
+	}
+
+	rows, err := m.DB.Query(context.Background(), "SELECT id, name, phone, email, COALESCE(details, '{}') FROM contacts ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+
+	// Read all rows first, the connection can't be used for updates while the
+	// resultset is open.
+	contacts := []*row{}
+	for rows.Next() {
+		var r row
+
+		err := rows.Scan(&r.id, &r.fields[0], &r.fields[1], &r.fields[2], &r.details)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		contacts = append(contacts, &r)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	query := "UPDATE contacts SET name = $1, phone = $2, email = $3, details = $4 WHERE id = $5"
+
+	var updated int64
+	for _, r := range contacts {
+		changed, err := rotateFields(m.Keyring, r.fields[:])
+		if err != nil {
+			return updated, fmt.Errorf("contact %d: %w", r.id, err)
+		}
+
+		// The details are rotated value by value, as the messenger handles are kept in
+		// a map.
+		err = r.details.transform(func(value string) (string, error) {
+			rotated, ok, err := m.Keyring.Rotate(value)
+			if err != nil || !ok {
+				return value, err
+			}
+			changed = true
+			return rotated, nil
+		})
+		if err != nil {
+			return updated, fmt.Errorf("contact %d: %w", r.id, err)
+		}
+
+		if !changed {
+			continue
+		}
+
+		_, err = m.DB.Exec(context.Background(), query, r.fields[0], r.fields[1], r.fields[2], &r.details, r.id)
+		if err != nil {
+			return updated, err
+		}
+
+		updated++
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// TableStats describes the size of a table and the rows written to it since the
+// statistics of the database were last reset. Rows is the planner's estimate, counting
+// the rows of large tables exactly would take too long.
+type TableStats struct {
+	Table          string     `json:"table"`
+	Rows           int64      `json:"rows"`
+	SizeBytes      int64      `json:"size_bytes"`
+	Inserted       int64      `json:"inserted"`
+	Updated        int64      `json:"updated"`
+	Deleted        int64      `json:"deleted"`
+	InsertedPerDay float64    `json:"inserted_per_day"`
+	LastAnalyzedAt *time.Time `json:"last_analyzed_at,omitempty"`
+}
+
+// OrganisationStats is the number of documents of an organisation, archived invoices
+// included. Recent counts the documents created in the last days of the request.
+type OrganisationStats struct {
+	OrganisationID int64  `json:"organisation_id"`
+	Name           string `json:"name"`
+	Invoices       int64  `json:"invoices"`
+	Acts           int64  `json:"acts"`
+	Documents      int64  `json:"documents"`
+	Recent         int64  `json:"recent"`
+}
+
+// DatabaseStats is the result of the database growth report.
+type DatabaseStats struct {
+	SizeBytes     int64                `json:"size_bytes"`
+	StatsSince    *time.Time           `json:"stats_since"`
+	Days          int                  `json:"days"`
+	Tables        []*TableStats        `json:"tables"`
+	Organisations []*OrganisationStats `json:"organisations"`
+}
+
+// DatabaseStatsFilters selects how many organisations are listed and which days count
+// as recent.
+type DatabaseStatsFilters struct {
+	Organisations int
+	Days          int
+}
+
+func ValidateDatabaseStatsFilters(v *validator.Validator, filters DatabaseStatsFilters) {
+	v.Check(filters.Organisations > 0, "organisations", "must be greater than zero")
+	v.Check(filters.Organisations <= 100, "organisations", "must be a maximum of 100")
+	v.Check(filters.Days > 0, "days", "must be greater than zero")
+	v.Check(filters.Days <= 365, "days", "must be a maximum of 365")
+}
+
+// Stats reports the size of the database and its tables, the rows written since the
+// statistics were reset and the organisations with the most documents. PostgreSQL
+// older than 15 leaves stats_reset empty until the first reset, the start of the
+// server is used instead then.
+func (m MaintenanceModel) Stats(filters DatabaseStatsFilters) (*DatabaseStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stats := &DatabaseStats{
+		Days:          filters.Days,
+		Tables:        []*TableStats{},
+		Organisations: []*OrganisationStats{},
+	}
+
+	query := `
+		SELECT pg_database_size(datname), COALESCE(stats_reset, pg_postmaster_start_time())
+		FROM pg_stat_database
+		WHERE datname = current_database()`
+
+	err := m.DB.QueryRow(ctx, query).Scan(&stats.SizeBytes, &stats.StatsSince)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT relname, GREATEST(n_live_tup, 0), pg_total_relation_size(relid), n_tup_ins, n_tup_upd, n_tup_del,
+			GREATEST(last_analyze, last_autoanalyze)
+		FROM pg_stat_user_tables
+		WHERE schemaname = ANY(current_schemas(false))
+		ORDER BY pg_total_relation_size(relid) DESC, relname`
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// The writes are spread over at least a day, so a recent reset doesn't make
+	// the rate look huge.
+	days := 1.0
+	if stats.StatsSince != nil && time.Since(*stats.StatsSince).Hours() > 24 {
+		days = time.Since(*stats.StatsSince).Hours() / 24
+	}
+
+	for rows.Next() {
+		var table TableStats
+
+		err := rows.Scan(
+			&table.Table,
+			&table.Rows,
+			&table.SizeBytes,
+			&table.Inserted,
+			&table.Updated,
+			&table.Deleted,
+			&table.LastAnalyzedAt,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		table.InsertedPerDay = float64(table.Inserted) / days
+		stats.Tables = append(stats.Tables, &table)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		WITH documents AS (
+			SELECT organisation_id, 'invoice' AS kind, created_at FROM invoices_history WHERE destroyed_at IS NULL
+			UNION ALL
+			SELECT organisation_id, 'act', created_at FROM acts WHERE destroyed_at IS NULL
+		)
+		SELECT o.id, COALESCE(o.name, ''),
+			COUNT(*) FILTER (WHERE d.kind = 'invoice'),
+			COUNT(*) FILTER (WHERE d.kind = 'act'),
+			COUNT(*),
+			COUNT(*) FILTER (WHERE d.created_at >= NOW() - make_interval(days => $1))
+		FROM documents d
+		JOIN organisations o ON o.id = d.organisation_id
+		GROUP BY o.id, o.name
+		ORDER BY COUNT(*) DESC, o.id
+		LIMIT $2`
+
+	rows, err = m.DB.Query(ctx, query, filters.Days, filters.Organisations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var organisation OrganisationStats
+
+		err := rows.Scan(
+			&organisation.OrganisationID,
+			&organisation.Name,
+			&organisation.Invoices,
+			&organisation.Acts,
+			&organisation.Documents,
+			&organisation.Recent,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.Organisations = append(stats.Organisations, &organisation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
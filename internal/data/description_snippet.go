@@ -0,0 +1,206 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrDuplicateSnippet = errors.New("duplicate description snippet")
+
+// DescriptionSnippet is a reusable description of invoice items, e.g. "Консультационные
+// услуги за ...". UsageCount counts how often it has been inserted into an item.
+type DescriptionSnippet struct {
+	ID         int64      `json:"id" db:"id"`
+	Name       string     `json:"name,omitempty" db:"name"`
+	Text       string     `json:"text" db:"text"`
+	UsageCount int        `json:"usage_count" db:"usage_count"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	UserID     *int64     `json:"user_id,omitempty" db:"user_id"`
+	CreatedAt  *time.Time `json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func ValidateDescriptionSnippet(v *validator.Validator, snippet *DescriptionSnippet) {
+	v.Check(snippet.Text != "", "text", "must be provided")
+	v.Check(len(snippet.Text) <= 1024, "text", "must not be more than 1024 bytes long")
+	v.Check(len(snippet.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+// Define a DescriptionSnippetModel struct type which wraps a pgx.Conn connection pool.
+type DescriptionSnippetModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetAll returns the snippets of the organisation, the most used first.
+func (m DescriptionSnippetModel) GetAll(organisationID int64) ([]*DescriptionSnippet, error) {
+	query := `
+		SELECT id, COALESCE(name, '') AS name, text, usage_count, last_used_at, user_id, created_at, updated_at
+		FROM description_snippets
+		WHERE organisation_id = $1
+		ORDER BY usage_count DESC, last_used_at DESC NULLS LAST, id`
+
+	return m.query(query, organisationID)
+}
+
+// Suggest returns up to limit snippets of the organisation whose name or text contains
+// the search term, ranked by usage and then by the time they were last used. An empty
+// term matches every snippet.
+func (m DescriptionSnippetModel) Suggest(organisationID int64, term string, limit int) ([]*DescriptionSnippet, error) {
+	query := `
+		SELECT id, COALESCE(name, '') AS name, text, usage_count, last_used_at, user_id, created_at, updated_at
+		FROM description_snippets
+		WHERE organisation_id = $1 AND (text ILIKE $2 OR name ILIKE $2)
+		ORDER BY usage_count DESC, last_used_at DESC NULLS LAST, id
+		LIMIT $3`
+
+	return m.query(query, organisationID, "%"+likeEscaper.Replace(term)+"%", limit)
+}
+
+func (m DescriptionSnippetModel) query(query string, args ...interface{}) ([]*DescriptionSnippet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[DescriptionSnippet])
+}
+
+// Add method for inserting a new record in the description_snippets table.
+func (m DescriptionSnippetModel) Insert(organisationID int64, snippet *DescriptionSnippet) error {
+	query := `
+		INSERT INTO description_snippets (organisation_id, name, text, user_id)
+		VALUES ($1, NULLIF($2, ''), $3, $4)
+		RETURNING id, usage_count, created_at, updated_at`
+
+	args := []interface{}{organisationID, snippet.Name, snippet.Text, snippet.UserID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&snippet.ID, &snippet.UsageCount, &snippet.CreatedAt, &snippet.UpdatedAt)
+	if err != nil {
+		return uniqueSnippetError(err)
+	}
+
+	return nil
+}
+
+// Add method for fetching a specific record from the description_snippets table.
+func (m DescriptionSnippetModel) Get(organisationID int64, id int64) (*DescriptionSnippet, error) {
+	if id < 1 || organisationID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, COALESCE(name, '') AS name, text, usage_count, last_used_at, user_id, created_at, updated_at
+		FROM description_snippets
+		WHERE organisation_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	snippet, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[DescriptionSnippet])
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return snippet, nil
+}
+
+// Add method for updating a specific record in the description_snippets table. The
+// usage is kept.
+func (m DescriptionSnippetModel) Update(snippet *DescriptionSnippet) error {
+	query := `
+		UPDATE description_snippets
+		SET name = NULLIF($1, ''), text = $2, updated_at = NOW()
+		WHERE id = $3
+		RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, snippet.Name, snippet.Text, snippet.ID).Scan(&snippet.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return uniqueSnippetError(err)
+		}
+	}
+
+	return nil
+}
+
+// Use counts a use of the snippet, i.e. its text has been inserted into an invoice
+// item.
+func (m DescriptionSnippetModel) Use(snippet *DescriptionSnippet) error {
+	query := `
+		UPDATE description_snippets
+		SET usage_count = usage_count + 1, last_used_at = NOW()
+		WHERE id = $1
+		RETURNING usage_count, last_used_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, snippet.ID).Scan(&snippet.UsageCount, &snippet.LastUsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add method for deleting a specific record from the description_snippets table.
+func (m DescriptionSnippetModel) Delete(organisationID int64, id int64) error {
+	if id < 1 || organisationID < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM description_snippets WHERE organisation_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, organisationID, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// uniqueSnippetError reports a second snippet with the same text in an organisation as
+// ErrDuplicateSnippet.
+func uniqueSnippetError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrDuplicateSnippet
+	}
+	return err
+}
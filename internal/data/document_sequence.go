@@ -0,0 +1,243 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Document types which are numbered independently of each other.
+const (
+	DocumentInvoice      = "invoice"
+	DocumentAct          = "act"
+	DocumentQuote        = "quote"
+	DocumentDeliveryNote = "delivery_note"
+	DocumentCreditNote   = "credit_note"
+)
+
+var DocumentTypes = []string{DocumentInvoice, DocumentAct, DocumentQuote, DocumentDeliveryNote, DocumentCreditNote}
+
+// The longest number which fits into the number columns of the documents.
+const maxDocumentNumberLength = 50
+
+// DocumentSequence is the numbering of one document type of an organisation. Template
+// contains {number}, which is replaced by the number padded with zeros to Padding
+// digits, and optionally {year}, {yy} and {month} of the document date.
+type DocumentSequence struct {
+	ID             int64      `json:"id,omitempty" db:"id"`
+	OrganisationID int64      `json:"organisation_id" db:"organisation_id"`
+	DocumentType   string     `json:"document_type" db:"document_type"`
+	Template       string     `json:"template" db:"template"`
+	Padding        int        `json:"padding" db:"padding"`
+	NextNumber     int64      `json:"next_number" db:"next_number"`
+	ResetYearly    bool       `json:"reset_yearly" db:"reset_yearly"`
+	Year           *int       `json:"year,omitempty" db:"year"`
+	Preview        string     `json:"preview" db:"-"`
+	UserID         *int64     `json:"user_id,omitempty" db:"user_id"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+// NewDocumentSequence returns the numbering a document type starts with: plain numbers
+// from 1.
+func NewDocumentSequence(organisationID int64, documentType string) *DocumentSequence {
+	return &DocumentSequence{
+		OrganisationID: organisationID,
+		DocumentType:   documentType,
+		Template:       "{number}",
+		NextNumber:     1,
+	}
+}
+
+// Format prints the number of a document dated date according to the template.
+func (s *DocumentSequence) Format(number int64, date time.Time) string {
+	n := strconv.FormatInt(number, 10)
+	if len(n) < s.Padding {
+		n = strings.Repeat("0", s.Padding-len(n)) + n
+	}
+
+	r := strings.NewReplacer(
+		"{number}", n,
+		"{year}", date.Format("2006"),
+		"{yy}", date.Format("06"),
+		"{month}", date.Format("01"),
+	)
+
+	return r.Replace(s.Template)
+}
+
+func ValidateDocumentSequence(v *validator.Validator, s *DocumentSequence) {
+	v.Check(validator.In(s.DocumentType, DocumentTypes...), "document_type", "must be invoice, act, quote, delivery_note or credit_note")
+	v.Check(strings.Contains(s.Template, "{number}"), "template", "must contain {number}")
+	v.Check(len(s.Template) <= 50, "template", "must not be more than 50 bytes long")
+	v.Check(s.Padding >= 0 && s.Padding <= 10, "padding", "must be between 0 and 10")
+	v.Check(s.NextNumber > 0, "next_number", "must be greater than zero")
+
+	// A number with all the digits of the next one and a four digit year has to fit
+	// into the documents.
+	if v.Valid() {
+		sample := s.Format(s.NextNumber, time.Date(2000, time.December, 1, 0, 0, 0, 0, time.UTC))
+		v.Check(len(sample) <= maxDocumentNumberLength, "template", fmt.Sprintf("must not make numbers longer than %d bytes", maxDocumentNumberLength))
+	}
+}
+
+// Define a DocumentSequenceModel struct type which wraps a pgx.Conn connection pool.
+type DocumentSequenceModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetAll returns the numbering of every document type of the organisation. Types which
+// have never been set up or numbered are returned with the default numbering.
+func (m DocumentSequenceModel) GetAll(organisationID int64) ([]*DocumentSequence, error) {
+	query := `
+		SELECT id, organisation_id, document_type, template, padding, next_number, reset_yearly, year, user_id, updated_at
+		FROM document_sequences
+		WHERE organisation_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[DocumentSequence])
+	if err != nil {
+		return nil, err
+	}
+
+	byType := make(map[string]*DocumentSequence)
+	for _, s := range stored {
+		byType[s.DocumentType] = s
+	}
+
+	sequences := []*DocumentSequence{}
+
+	for _, documentType := range DocumentTypes {
+		s, ok := byType[documentType]
+		if !ok {
+			s = NewDocumentSequence(organisationID, documentType)
+		}
+
+		s.setPreview()
+		sequences = append(sequences, s)
+	}
+
+	return sequences, nil
+}
+
+// Get returns the numbering of a document type of the organisation, the default one if
+// it has never been set up.
+func (m DocumentSequenceModel) Get(organisationID int64, documentType string) (*DocumentSequence, error) {
+	if !validator.In(documentType, DocumentTypes...) {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, organisation_id, document_type, template, padding, next_number, reset_yearly, year, user_id, updated_at
+		FROM document_sequences
+		WHERE organisation_id = $1 AND document_type = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID, documentType)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[DocumentSequence])
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			s = NewDocumentSequence(organisationID, documentType)
+		default:
+			return nil, err
+		}
+	}
+
+	s.setPreview()
+
+	return s, nil
+}
+
+// Save stores the numbering of a document type, creating the row on its first change.
+// Setting next_number below numbers already issued makes them issued again, which is
+// up to the organisation.
+func (m DocumentSequenceModel) Save(s *DocumentSequence) error {
+	query := `
+		INSERT INTO document_sequences (organisation_id, document_type, template, padding, next_number, reset_yearly, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (organisation_id, document_type) DO UPDATE
+		SET template = EXCLUDED.template, padding = EXCLUDED.padding, next_number = EXCLUDED.next_number,
+			reset_yearly = EXCLUDED.reset_yearly, user_id = EXCLUDED.user_id, updated_at = NOW()
+		RETURNING id, year, updated_at`
+
+	args := []interface{}{
+		s.OrganisationID,
+		s.DocumentType,
+		s.Template,
+		s.Padding,
+		s.NextNumber,
+		s.ResetYearly,
+		s.UserID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&s.ID, &s.Year, &s.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	s.setPreview()
+
+	return nil
+}
+
+// setPreview shows how the next number will look on a document dated today.
+func (s *DocumentSequence) setPreview() {
+	number := s.NextNumber
+	year := time.Now().Year()
+	if s.ResetYearly && s.Year != nil && year > *s.Year {
+		number = 1
+	}
+
+	s.Preview = s.Format(number, time.Now())
+}
+
+// nextDocumentNumber takes the next number of a document type of the organisation for
+// a document dated date. The sequence row stays locked until the transaction ends, so
+// concurrent documents get different numbers and a rolled back document doesn't use up
+// its number. A document dated in a year before the last numbered one doesn't reset
+// the numbering, it continues the current year's.
+func nextDocumentNumber(ctx context.Context, db dbtx, organisationID int64, documentType string, date time.Time) (string, error) {
+	query := `
+		INSERT INTO document_sequences (organisation_id, document_type, next_number, year)
+		VALUES ($1, $2, 2, $3)
+		ON CONFLICT (organisation_id, document_type) DO UPDATE
+		SET next_number = CASE
+				WHEN document_sequences.reset_yearly AND document_sequences.year < EXCLUDED.year THEN 2
+				ELSE document_sequences.next_number + 1
+			END,
+			year = GREATEST(document_sequences.year, EXCLUDED.year)
+		RETURNING template, padding, next_number - 1`
+
+	s := DocumentSequence{OrganisationID: organisationID, DocumentType: documentType}
+	var number int64
+
+	err := db.QueryRow(ctx, query, organisationID, documentType, date.Year()).Scan(&s.Template, &s.Padding, &number)
+	if err != nil {
+		return "", err
+	}
+
+	return s.Format(number, date), nil
+}
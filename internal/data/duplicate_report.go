@@ -0,0 +1,342 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrMergeDuplicates is returned when a record to merge doesn't exist or is deleted.
+var ErrMergeDuplicates = errors.New("the records to merge don't exist")
+
+// The states of a duplicate report. A report which was still running when its
+// instance stopped is marked as failed by the next one.
+const (
+	DuplicateReportRunning   = "running"
+	DuplicateReportSucceeded = "succeeded"
+	DuplicateReportFailed    = "failed"
+)
+
+// The reasons records are taken for duplicates.
+const (
+	DuplicateByINN  = "inn"
+	DuplicateBySKU  = "sku"
+	DuplicateByName = "name"
+)
+
+// DuplicateRecord is a company or product of a duplicate group.
+type DuplicateRecord struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// MergeLink is the request which merges the duplicates of a group into its first,
+// oldest record.
+type MergeLink struct {
+	Method string  `json:"method"`
+	Href   string  `json:"href"`
+	IDs    []int64 `json:"ids"`
+}
+
+// DuplicateGroup is a set of companies or products which are likely the same. Key is
+// the INN, SKU or normalized name they share. Merge is added by the API.
+type DuplicateGroup struct {
+	Entity  string             `json:"entity"`
+	Reason  string             `json:"reason"`
+	Key     string             `json:"key"`
+	Records []*DuplicateRecord `json:"records"`
+	Merge   *MergeLink         `json:"merge,omitempty"`
+}
+
+// DuplicateReport is a search for duplicate companies and products made in the
+// background.
+type DuplicateReport struct {
+	ID         int64             `json:"id"`
+	Status     string            `json:"status"`
+	Groups     []*DuplicateGroup `json:"groups"`
+	Error      *string           `json:"error,omitempty"`
+	UserID     *int64            `json:"user_id,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+}
+
+// The legal forms which are left out of company names when they are compared.
+var legalForms = map[string]bool{
+	"ооо": true, "оао": true, "зао": true, "пао": true, "ао": true, "нао": true,
+	"ип": true, "чп": true, "гуп": true, "муп": true, "ано": true,
+	"llc": true, "ltd": true, "inc": true, "gmbh": true,
+}
+
+// NormalizeName reduces a name to its lowercase words without punctuation, quotes and
+// legal forms, so "ООО «Ромашка»" and "Ромашка, ооо" are the same. ё is taken for е.
+func NormalizeName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	normalized := words[:0]
+	for _, word := range words {
+		if !legalForms[word] {
+			normalized = append(normalized, strings.ReplaceAll(word, "ё", "е"))
+		}
+	}
+
+	return strings.Join(normalized, " ")
+}
+
+// Define a DuplicateReportModel struct type which wraps a pgx.Conn connection pool.
+type DuplicateReportModel struct {
+	DB *pgxpool.Pool
+}
+
+// Insert records a running report.
+func (m DuplicateReportModel) Insert(report *DuplicateReport) error {
+	query := `
+		INSERT INTO duplicate_reports (user_id)
+		VALUES ($1)
+		RETURNING id, status, started_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	report.Groups = []*DuplicateGroup{}
+
+	return m.DB.QueryRow(ctx, query, report.UserID).Scan(&report.ID, &report.Status, &report.StartedAt)
+}
+
+// Finish records the result of the report.
+func (m DuplicateReportModel) Finish(report *DuplicateReport) error {
+	query := `
+		UPDATE duplicate_reports
+		SET status = $1, groups = $2, error = $3, finished_at = NOW()
+		WHERE id = $4
+		RETURNING finished_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, report.Status, report.Groups, report.Error, report.ID).Scan(&report.FinishedAt)
+}
+
+// Interrupt marks the reports which are still running as failed. It must only be
+// called while holding the duplicate report lock, when no report can be running.
+func (m DuplicateReportModel) Interrupt() error {
+	query := `
+		UPDATE duplicate_reports
+		SET status = 'failed', error = 'interrupted', finished_at = NOW()
+		WHERE status = 'running'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query)
+	return err
+}
+
+const duplicateReportColumns = `id, status, groups, error, user_id, started_at, finished_at`
+
+func scanDuplicateReport(row pgx.Row) (*DuplicateReport, error) {
+	var report DuplicateReport
+
+	err := row.Scan(
+		&report.ID,
+		&report.Status,
+		&report.Groups,
+		&report.Error,
+		&report.UserID,
+		&report.StartedAt,
+		&report.FinishedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &report, nil
+}
+
+// Get returns the report.
+func (m DuplicateReportModel) Get(id int64) (*DuplicateReport, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + duplicateReportColumns + `
+		FROM duplicate_reports
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanDuplicateReport(m.DB.QueryRow(ctx, query, id))
+}
+
+// Latest returns the latest report.
+func (m DuplicateReportModel) Latest() (*DuplicateReport, error) {
+	query := `
+		SELECT ` + duplicateReportColumns + `
+		FROM duplicate_reports
+		ORDER BY id DESC
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanDuplicateReport(m.DB.QueryRow(ctx, query))
+}
+
+// Find looks for companies with the same INN or normalized name and for products with
+// the same SKU or normalized name. A record can be in a group by its INN or SKU and in
+// another by its name.
+func (m DuplicateReportModel) Find(ctx context.Context) ([]*DuplicateGroup, error) {
+	groups := []*DuplicateGroup{}
+
+	companies, err := m.candidates(ctx, `
+		SELECT id, COALESCE(name, ''), COALESCE(details->>'inn', '')
+		FROM companies
+		WHERE destroyed_at IS NULL AND anonymized_at IS NULL
+		ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	groups = append(groups, groupDuplicates("company", DuplicateByINN, companies, func(c duplicateCandidate) string {
+		return strings.TrimSpace(c.code)
+	})...)
+	groups = append(groups, groupDuplicates("company", DuplicateByName, companies, func(c duplicateCandidate) string {
+		return NormalizeName(c.name)
+	})...)
+
+	products, err := m.candidates(ctx, `
+		SELECT id, COALESCE(name, ''), COALESCE(sku, '')
+		FROM products
+		WHERE destroyed_at IS NULL
+		ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	groups = append(groups, groupDuplicates("product", DuplicateBySKU, products, func(c duplicateCandidate) string {
+		return strings.ToLower(strings.TrimSpace(c.code))
+	})...)
+	groups = append(groups, groupDuplicates("product", DuplicateByName, products, func(c duplicateCandidate) string {
+		return NormalizeName(c.name)
+	})...)
+
+	return groups, nil
+}
+
+// duplicateCandidate is a company with its INN or a product with its SKU.
+type duplicateCandidate struct {
+	id   int64
+	name string
+	code string
+}
+
+func (m DuplicateReportModel) candidates(ctx context.Context, query string) ([]duplicateCandidate, error) {
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []duplicateCandidate{}
+
+	for rows.Next() {
+		var c duplicateCandidate
+
+		err := rows.Scan(&c.id, &c.name, &c.code)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+// groupDuplicates groups the candidates, ordered by ID, by the key and returns the
+// groups of more than one. Empty keys aren't grouped.
+func groupDuplicates(entity, reason string, candidates []duplicateCandidate, key func(duplicateCandidate) string) []*DuplicateGroup {
+	byKey := map[string]*DuplicateGroup{}
+	keys := []string{}
+
+	for _, c := range candidates {
+		k := key(c)
+		if k == "" {
+			continue
+		}
+
+		group, ok := byKey[k]
+		if !ok {
+			group = &DuplicateGroup{Entity: entity, Reason: reason, Key: k}
+			byKey[k] = group
+			keys = append(keys, k)
+		}
+
+		group.Records = append(group.Records, &DuplicateRecord{ID: c.id, Name: c.name})
+	}
+
+	sort.Strings(keys)
+
+	groups := []*DuplicateGroup{}
+	for _, k := range keys {
+		if len(byKey[k].Records) > 1 {
+			groups = append(groups, byKey[k])
+		}
+	}
+
+	return groups
+}
+
+// lockMergedRecords locks the record which the duplicates are merged into and the
+// duplicates in one statement, so neither can be merged or changed at the same time.
+// Deleted records can't be merged.
+func lockMergedRecords(ctx context.Context, tx pgx.Tx, table string, id int64, duplicateIDs []int64) error {
+	query := `SELECT id FROM ` + table + ` WHERE (id = $1 OR id = ANY($2)) AND destroyed_at IS NULL FOR UPDATE`
+
+	rows, err := tx.Query(ctx, query, id, duplicateIDs)
+	if err != nil {
+		return err
+	}
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return err
+	}
+
+	var target bool
+	duplicates := 0
+	for _, locked := range ids {
+		if locked == id {
+			target = true
+		} else {
+			duplicates++
+		}
+	}
+
+	switch {
+	case !target:
+		return ErrRecordNotFound
+	case duplicates != len(duplicateIDs):
+		return ErrMergeDuplicates
+	}
+
+	return nil
+}
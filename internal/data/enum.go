@@ -0,0 +1,83 @@
+package data
+
+// EnumValue is a value of a field with a fixed set of values and the label clients show
+// for it.
+type EnumValue struct {
+	Value interface{} `json:"value"`
+	Label string      `json:"label"`
+}
+
+// Enums are the values of the fields with a fixed set of values, by field name, in the
+// order clients list them. Integer fields have integer values, the others strings. The
+// legacy integer role of contacts is left out, the roles list replaced it.
+var Enums = map[string][]EnumValue{
+	"company_type": {
+		{CompanyTypeLegalEntity, "Legal entity"},
+		{CompanyTypeEntrepreneur, "Individual entrepreneur"},
+		{CompanyTypeIndividual, "Individual"},
+	},
+	"product_type": {
+		{ProductTypeGoods, "Goods"},
+		{ProductTypeService, "Service"},
+		{ProductTypeKit, "Kit"},
+	},
+	"contact_role": {
+		{ContactRoleSigner, "Signer"},
+		{ContactRoleAccountant, "Accountant"},
+		{ContactRoleRecipient, "Recipient"},
+	},
+	"invoice_status": {
+		{InvoiceStatusUnpaid, "Unpaid"},
+		{InvoiceStatusPartiallyPaid, "Partially paid"},
+		{InvoiceStatusPaid, "Paid"},
+		{InvoiceStatusOverdue, "Overdue"},
+		{InvoiceStatusWrittenOff, "Written off"},
+		{InvoiceStatusDraft, "Draft"},
+		{InvoiceStatusSent, "Sent"},
+		{InvoiceStatusShipped, "Shipped"},
+		{InvoiceStatusCancelled, "Cancelled"},
+	},
+	"discount_type": {
+		{DiscountPercent, "Percent"},
+		{DiscountAbsolute, "Amount"},
+	},
+	"vat_mode": {
+		{VatOnTop, "VAT on top"},
+		{VatIncluded, "VAT included"},
+	},
+	"document_type": {
+		{DocumentInvoice, "Invoice"},
+		{DocumentAct, "Act"},
+		{DocumentQuote, "Quote"},
+		{DocumentDeliveryNote, "Delivery note"},
+		{DocumentCreditNote, "Credit note"},
+	},
+	"penalty_basis": {
+		{PenaltyContract, "Contractual rate"},
+		{PenaltyKeyRate, "Key rate"},
+	},
+	"period_kind": {
+		{PeriodMonth, "Month"},
+		{PeriodQuarter, "Quarter"},
+		{PeriodYear, "Year"},
+	},
+	"communication_channel": {
+		{ChannelEmail, "Email"},
+		{ChannelSMS, "SMS"},
+		{ChannelWebhook, "Webhook"},
+		{ChannelPortal, "Portal"},
+	},
+	"communication_status": {
+		{CommunicationSent, "Sent"},
+		{CommunicationFailed, "Failed"},
+		{CommunicationViewed, "Viewed"},
+	},
+	"connector_kind": {
+		{ConnectorOneC, "1C"},
+		{ConnectorHTTP, "HTTP"},
+	},
+	"integration_scope": {
+		{ScopeInvoicesRead, "Read invoices"},
+		{ScopeInvoicesWrite, "Create invoices"},
+	},
+}
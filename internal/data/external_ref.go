@@ -0,0 +1,57 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+)
+
+// ExternalSystemRX matches the names external systems are known by in the references
+// of invoices, e.g. crm or 1c.
+var ExternalSystemRX = regexp.MustCompile("^[a-z0-9_-]{1,30}$")
+
+func ValidateExternalRef(v *validator.Validator, system, ref string) {
+	v.Check(ExternalSystemRX.MatchString(system), "system", "must be up to 30 lowercase letters, digits, dashes or underscores")
+	v.Check(ref != "", "ref", "must be provided")
+	v.Check(len(ref) <= 255, "ref", "must not be more than 255 bytes long")
+}
+
+// SetExternalRef sets the reference of the invoice in the external system, replacing
+// the one it had there. Archived invoices keep their references too, so that external
+// systems can still find them. It returns the references of the invoice, or
+// ErrRecordNotFound if it doesn't exist.
+func (m InvoiceModel) SetExternalRef(id int64, system, ref string) (map[string]string, error) {
+	return m.updateExternalRefs(id, "external_refs || jsonb_build_object($2::text, $3::text)", system, ref)
+}
+
+// DeleteExternalRef removes the reference of the invoice in the external system.
+func (m InvoiceModel) DeleteExternalRef(id int64, system string) (map[string]string, error) {
+	return m.updateExternalRefs(id, "external_refs - $2::text", system)
+}
+
+func (m InvoiceModel) updateExternalRefs(id int64, value string, args ...interface{}) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	refs := map[string]string{}
+
+	for _, table := range []string{"invoices", "invoices_archive"} {
+		query := "UPDATE " + table + " SET external_refs = " + value + " WHERE id = $1 RETURNING external_refs"
+
+		err := m.DB.QueryRow(ctx, query, append([]interface{}{id}, args...)...).Scan(&refs)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		return refs, nil
+	}
+
+	return nil, ErrRecordNotFound
+}
@@ -0,0 +1,205 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The features which can be turned on and off per organisation.
+const (
+	FeatureAccounting   = "accounting"
+	FeatureBillingPlans = "billing_plans"
+	FeatureInvoiceLinks = "invoice_links"
+)
+
+// Features are the features with their default, which applies when neither the
+// organisation nor the global flag set them. Features which are being rolled out are
+// off by default.
+var Features = map[string]bool{
+	FeatureAccounting:   true,
+	FeatureBillingPlans: false,
+	FeatureInvoiceLinks: true,
+}
+
+// FeatureFlag turns a feature on or off for an organisation or, without
+// OrganisationID, for all organisations which have no flag of their own.
+type FeatureFlag struct {
+	ID             int64      `json:"id"`
+	Feature        string     `json:"feature"`
+	OrganisationID *int64     `json:"organisation_id"`
+	Enabled        bool       `json:"enabled"`
+	UserID         *int64     `json:"user_id,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+func ValidateFeature(v *validator.Validator, feature string) {
+	_, ok := Features[feature]
+	v.Check(ok, "feature", "must be a known feature")
+}
+
+// Define a FeatureFlagModel struct type which wraps a pgx.Conn connection pool.
+type FeatureFlagModel struct {
+	DB *pgxpool.Pool
+}
+
+// Enabled reports whether the feature is on for the organisation: its own flag, else
+// the global flag, else the default of the feature. An organisationID of 0 only looks
+// at the global flag.
+func (m FeatureFlagModel) Enabled(feature string, organisationID int64) (bool, error) {
+	query := `
+		SELECT enabled
+		FROM feature_flags
+		WHERE feature = $1 AND (organisation_id = $2 OR organisation_id IS NULL)
+		ORDER BY organisation_id NULLS LAST
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var enabled bool
+
+	err := m.DB.QueryRow(ctx, query, feature, organisationID).Scan(&enabled)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Features[feature], nil
+		}
+		return false, err
+	}
+
+	return enabled, nil
+}
+
+// EnabledFeatures returns whether every feature is on for the organisation, by
+// Enabled()'s precedence.
+func (m FeatureFlagModel) EnabledFeatures(organisationID int64) (map[string]bool, error) {
+	query := `
+		SELECT DISTINCT ON (feature) feature, enabled
+		FROM feature_flags
+		WHERE organisation_id = $1 OR organisation_id IS NULL
+		ORDER BY feature, organisation_id NULLS LAST`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	features := make(map[string]bool, len(Features))
+	for feature, enabled := range Features {
+		features[feature] = enabled
+	}
+
+	for rows.Next() {
+		var feature string
+		var enabled bool
+
+		err := rows.Scan(&feature, &enabled)
+		if err != nil {
+			return nil, err
+		}
+
+		// Flags of features which have been removed since are left out.
+		if _, ok := Features[feature]; ok {
+			features[feature] = enabled
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return features, nil
+}
+
+// GetAll returns all the flags, the global ones first.
+func (m FeatureFlagModel) GetAll() ([]*FeatureFlag, error) {
+	query := `
+		SELECT id, feature, organisation_id, enabled, user_id, created_at, updated_at
+		FROM feature_flags
+		ORDER BY feature, organisation_id NULLS FIRST`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []*FeatureFlag{}
+
+	for rows.Next() {
+		var flag FeatureFlag
+
+		err := rows.Scan(
+			&flag.ID,
+			&flag.Feature,
+			&flag.OrganisationID,
+			&flag.Enabled,
+			&flag.UserID,
+			&flag.CreatedAt,
+			&flag.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		flags = append(flags, &flag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return flags, nil
+}
+
+// Set turns the feature on or off for the organisation of the flag, or globally,
+// replacing the flag set before.
+func (m FeatureFlagModel) Set(flag *FeatureFlag) error {
+	query := `
+		INSERT INTO feature_flags (feature, organisation_id, enabled, user_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (feature, COALESCE(organisation_id, 0))
+		DO UPDATE SET enabled = EXCLUDED.enabled, user_id = EXCLUDED.user_id, updated_at = NOW()
+		RETURNING id, created_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{flag.Feature, flag.OrganisationID, flag.Enabled, flag.UserID}
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&flag.ID, &flag.CreatedAt, &flag.UpdatedAt)
+}
+
+// Delete removes the flag of the organisation, or the global one with an
+// organisationID of 0, so the feature falls back to the global flag or its default.
+func (m FeatureFlagModel) Delete(feature string, organisationID int64) error {
+	query := `
+		DELETE FROM feature_flags
+		WHERE feature = $1 AND COALESCE(organisation_id, 0) = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, feature, organisationID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
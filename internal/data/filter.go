@@ -0,0 +1,66 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// filter builds the WHERE clause of a list query. Values given by the client are never
+// written into the SQL: arg passes them as query arguments and returns their
+// placeholder, $1, $2... in the order they are added, so a query may add its own
+// arguments after the filter's, like the limit and the offset.
+//
+//	f := filter{}
+//	f.where("company_id = " + f.arg(filters.CompanyID))
+//	query := "SELECT id FROM invoices" + f.clause() + "LIMIT " + f.arg(limit)
+//	rows, err := m.DB.Query(ctx, query, f.args...)
+type filter struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds the value to the query arguments and returns its placeholder. A placeholder
+// may be used several times in the conditions.
+func (f *filter) arg(value interface{}) string {
+	f.args = append(f.args, value)
+	return fmt.Sprintf("$%d", len(f.args))
+}
+
+// where adds the condition, the conditions are joined by AND.
+func (f *filter) where(condition string) {
+	f.conditions = append(f.conditions, condition)
+}
+
+// dateRange limits the column to the range, nothing is added if neither end of the
+// range is given.
+func (f *filter) dateRange(column string, start, end *time.Time) {
+	switch {
+	case start != nil && end != nil:
+		f.where(column + " BETWEEN " + f.arg(*start) + " AND " + f.arg(*end))
+	case start != nil:
+		f.where(column + " >= " + f.arg(*start))
+	case end != nil:
+		f.where(column + " <= " + f.arg(*end))
+	}
+}
+
+// clause returns the WHERE clause with a space around it, or a space if there are no
+// conditions.
+func (f *filter) clause() string {
+	if len(f.conditions) == 0 {
+		return " "
+	}
+
+	return " WHERE " + strings.Join(f.conditions, " AND ") + " "
+}
+
+// and returns the conditions joined by AND, or TRUE if there are none, for queries
+// which put them into a WHERE clause of their own.
+func (f *filter) and() string {
+	if len(f.conditions) == 0 {
+		return "TRUE"
+	}
+
+	return strings.Join(f.conditions, " AND ")
+}
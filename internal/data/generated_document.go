@@ -0,0 +1,268 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The formats documents are generated in: printed PDF documents and the CommerceML
+// exchange files of 1C connectors.
+const (
+	DocumentFormatPDF        = "pdf"
+	DocumentFormatCommerceML = "commerceml"
+)
+
+// GeneratedDocument is a version of a document as it was issued, e.g. an invoice
+// printed as PDF. The content is kept in the storage, so the document can be handed
+// out again as it was, even after the requisites it was printed with have changed.
+// Versions are never changed, a document whose content changed gets a new one.
+// RetainUntil is nil for versions which are kept for good.
+type GeneratedDocument struct {
+	ID             int64      `json:"id" db:"id"`
+	OrganisationID int64      `json:"organisation_id" db:"organisation_id"`
+	DocumentType   string     `json:"document_type" db:"document_type"`
+	DocumentID     int64      `json:"document_id" db:"document_id"`
+	Format         string     `json:"format" db:"format"`
+	Version        int        `json:"version" db:"version"`
+	Name           string     `json:"name" db:"name"`
+	ContentType    string     `json:"content_type" db:"content_type"`
+	Size           int64      `json:"size" db:"size"`
+	SHA256         string     `json:"sha256" db:"sha256"`
+	RetainUntil    *time.Time `json:"retain_until" db:"retain_until"`
+	UserID         *int64     `json:"user_id" db:"user_id"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Key returns the key of the content in the storage. The content is stored once per
+// organisation and SHA-256, so the files of an organisation stay apart from those of
+// the others.
+func (d *GeneratedDocument) Key() string {
+	return GeneratedDocumentKey(d.OrganisationID, d.SHA256)
+}
+
+// GeneratedDocumentKey returns the storage key of the content of an organisation with
+// the SHA-256.
+func GeneratedDocumentKey(organisationID int64, sha256 string) string {
+	return "documents/" + strconv.FormatInt(organisationID, 10) + "/" + sha256[:2] + "/" + sha256
+}
+
+// Define a GeneratedDocumentModel struct type which wraps a pgx.Conn connection pool.
+type GeneratedDocumentModel struct {
+	DB *pgxpool.Pool
+}
+
+const generatedDocumentColumns = `id, organisation_id, document_type, document_id, format, version, name,
+	content_type, size, sha256, retain_until, user_id, created_at`
+
+// GetAll returns the versions of the document in every format, the latest first.
+func (m GeneratedDocumentModel) GetAll(documentType string, documentID int64) ([]*GeneratedDocument, error) {
+	query := `
+		SELECT ` + generatedDocumentColumns + `
+		FROM generated_documents
+		WHERE document_type = $1 AND document_id = $2
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, documentType, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[GeneratedDocument])
+}
+
+// Get returns a version of the document.
+func (m GeneratedDocumentModel) Get(documentType string, documentID, id int64) (*GeneratedDocument, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + generatedDocumentColumns + `
+		FROM generated_documents
+		WHERE document_type = $1 AND document_id = $2 AND id = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, documentType, documentID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[GeneratedDocument])
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return document, nil
+}
+
+// Record adds the document as a new version unless the latest version of the document
+// in its format has the same content; created tells whether it was added, otherwise
+// the document is filled from the latest version. store puts the content into the
+// storage before a new version is inserted. The organisation is locked meanwhile, so
+// RemoveExpired() can't remove the content shared with an expiring version before the
+// new version refers to it, and versions are numbered one after the other.
+func (m GeneratedDocumentModel) Record(document *GeneratedDocument, store func(document *GeneratedDocument) error) (created bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	err = lockGeneratedDocuments(ctx, tx, document.OrganisationID)
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+		SELECT ` + generatedDocumentColumns + `
+		FROM generated_documents
+		WHERE document_type = $1 AND document_id = $2 AND format = $3
+		ORDER BY version DESC
+		LIMIT 1`
+
+	rows, err := tx.Query(ctx, query, document.DocumentType, document.DocumentID, document.Format)
+	if err != nil {
+		return false, err
+	}
+
+	latest, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[GeneratedDocument])
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		document.Version = 1
+	case err != nil:
+		return false, err
+	case latest.SHA256 == document.SHA256:
+		*document = *latest
+		return false, nil
+	default:
+		document.Version = latest.Version + 1
+	}
+
+	err = store(document)
+	if err != nil {
+		return false, err
+	}
+
+	query = `
+		INSERT INTO generated_documents (organisation_id, document_type, document_id, format, version, name,
+			content_type, size, sha256, retain_until, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		document.OrganisationID,
+		document.DocumentType,
+		document.DocumentID,
+		document.Format,
+		document.Version,
+		document.Name,
+		document.ContentType,
+		document.Size,
+		document.SHA256,
+		document.RetainUntil,
+		document.UserID,
+	}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&document.ID, &document.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// RemoveExpired removes up to batchSize versions whose retention has passed. remove
+// deletes the content of a version from the storage; it's only called if no other
+// version of the organisation has the same content. A version whose content can't be
+// removed is kept.
+func (m GeneratedDocumentModel) RemoveExpired(batchSize int, remove func(document *GeneratedDocument) error) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT ` + generatedDocumentColumns + `
+		FROM generated_documents
+		WHERE retain_until < CURRENT_DATE
+		ORDER BY organisation_id, id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.Query(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	expired, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[GeneratedDocument])
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, document := range expired {
+		err = lockGeneratedDocuments(ctx, tx, document.OrganisationID)
+		if err != nil {
+			return 0, err
+		}
+
+		var shared bool
+
+		query := `
+			SELECT EXISTS (
+				SELECT 1 FROM generated_documents
+				WHERE organisation_id = $1 AND sha256 = $2 AND id <> $3
+			)`
+
+		err = tx.QueryRow(ctx, query, document.OrganisationID, document.SHA256, document.ID).Scan(&shared)
+		if err != nil {
+			return 0, err
+		}
+
+		if !shared && remove(document) != nil {
+			continue
+		}
+
+		_, err = tx.Exec(ctx, "DELETE FROM generated_documents WHERE id = $1", document.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		removed++
+	}
+
+	return removed, tx.Commit(ctx)
+}
+
+// lockGeneratedDocuments locks the generated documents of the organisation until the
+// end of the transaction.
+func lockGeneratedDocuments(ctx context.Context, tx pgx.Tx, organisationID int64) error {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('generated_documents'), $1::integer)", organisationID)
+	return err
+}
@@ -3,10 +3,35 @@ package data
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/ElOtro/stockup-api/internal/encryption"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// dbtx is implemented by both the connection pool and a transaction, so a query can
+// run on its own or as a part of a larger transaction.
+type dbtx interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// queryContext returns the context for a query run on behalf of ctx. A deadline of ctx,
+// e.g. the timeout of the route of a request, applies as it is, else the query gets the
+// timeout.
+func queryContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
 // Define a ContactModel struct type which wraps a pgx.Conn connection pool.
 type Helper struct {
 	DB *pgxpool.Pool
@@ -15,7 +40,7 @@ type Helper struct {
 // Retrieve the "id" URL parameter from the current request context, then convert it to
 // an integer and return it. If the operation isn't successful, return 0 and an error.
 func (h Helper) pluckIDs(table string) ([]int64, error) {
-	query := fmt.Sprintf("select id from %s", table)
+	query := fmt.Sprintf("select id from %s order by id", table)
 	var ids []int64
 	rows, _ := h.DB.Query(context.Background(), query)
 	for rows.Next() {
@@ -29,3 +54,30 @@ func (h Helper) pluckIDs(table string) ([]int64, error) {
 	}
 	return ids, nil
 }
+
+// likeEscaper escapes the wildcard characters of a value used in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// rotateFields re-encrypts the non-nil values in place with the current key of the
+// keyring and reports whether any of them has changed.
+func rotateFields(keyring *encryption.Keyring, fields []*string) (bool, error) {
+	changed := false
+
+	for _, field := range fields {
+		if field == nil {
+			continue
+		}
+
+		rotated, ok, err := keyring.Rotate(*field)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			*field = rotated
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
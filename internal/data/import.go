@@ -0,0 +1,682 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/commerceml"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrImportProblems is returned when an exchange file can't be imported as a whole, the
+// problems are listed in the result.
+var ErrImportProblems = errors.New("the exchange file has problems")
+
+// What an import did with a record of the file.
+const (
+	ImportCreated  = "created"
+	ImportExisting = "existing"
+	ImportSkipped  = "skipped"
+)
+
+// The name of the agreement created for companies which have none, the name 1C gives
+// the default agreement of a counterparty.
+const importAgreementName = "Основной договор"
+
+// ImportParams describes an import into the organisation. A dry run does everything
+// but commit.
+type ImportParams struct {
+	OrganisationID int64
+	UserID         int64
+	DryRun         bool
+}
+
+// ImportEntry is a record of the file and what the import did with it. ID is the
+// record the entry was matched with or created as; it's left out for records created
+// by a dry run.
+type ImportEntry struct {
+	Action     string `json:"action"`
+	ID         int64  `json:"id,omitempty"`
+	ExternalID string `json:"external_id,omitempty"`
+	Name       string `json:"name"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// ImportResult lists the records of an import. Problems prevent the import, warnings
+// don't.
+type ImportResult struct {
+	DryRun     bool           `json:"dry_run"`
+	Units      []*ImportEntry `json:"units"`
+	Products   []*ImportEntry `json:"products"`
+	Companies  []*ImportEntry `json:"companies"`
+	Agreements []*ImportEntry `json:"agreements"`
+	Invoices   []*ImportEntry `json:"invoices"`
+	Problems   []string       `json:"problems"`
+	Warnings   []string       `json:"warnings"`
+}
+
+// Define a ImportModel struct type which wraps a pgx.Conn connection pool.
+type ImportModel struct {
+	DB *pgxpool.Pool
+}
+
+// CommerceML imports the products, the counterparties and the invoices of a 1C
+// exchange file in one transaction. Records which exist already are matched instead of
+// created: products by SKU or else by name, units by name, companies by INN and KPP
+// (their own or that of a branch) or else by name and invoices by number within the
+// year. VAT rates are never created, every rate of the file has to exist. The import
+// is rolled back for a dry run and when there are problems, in that case
+// ErrImportProblems is returned with the result.
+func (m ImportModel) CommerceML(exchange *commerceml.Exchange, params ImportParams) (*ImportResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	imp := &importer{
+		ctx:    ctx,
+		tx:     tx,
+		params: params,
+		result: &ImportResult{
+			DryRun:     params.DryRun,
+			Units:      []*ImportEntry{},
+			Products:   []*ImportEntry{},
+			Companies:  []*ImportEntry{},
+			Agreements: []*ImportEntry{},
+			Invoices:   []*ImportEntry{},
+			Problems:   []string{},
+			Warnings:   []string{},
+		},
+		units:      map[string]int64{},
+		products:   map[string]*importedProduct{},
+		companies:  map[string]*importedCompany{},
+		agreements: map[int64]int64{},
+	}
+
+	err = imp.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, product := range exchange.Products {
+		_, err = imp.product(product)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, counterparty := range exchange.Counterparties {
+		_, err = imp.company(counterparty)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, document := range exchange.Documents {
+		err = imp.invoice(document)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(imp.result.Problems) > 0 {
+		return imp.result, ErrImportProblems
+	}
+
+	if params.DryRun {
+		return imp.result, nil
+	}
+
+	return imp.result, tx.Commit(ctx)
+}
+
+// importedProduct is a product of the file with the record it was matched with.
+type importedProduct struct {
+	ID        int64
+	UnitID    int64
+	VatRateID int64
+	VatRate   float64
+}
+
+// importedCompany is a counterparty of the file with the company it was matched with,
+// and the branch of the company if the counterparty has the KPP of one.
+type importedCompany struct {
+	ID       int64
+	BranchID *int64
+}
+
+// importer holds the state of an import, the records of the file are looked up by
+// their 1C id, or by name where the file gives none.
+type importer struct {
+	ctx        context.Context
+	tx         pgx.Tx
+	params     ImportParams
+	result     *ImportResult
+	vatRates   []*VatRate
+	units      map[string]int64
+	products   map[string]*importedProduct
+	companies  map[string]*importedCompany
+	agreements map[int64]int64
+
+	bankAccountID int64
+}
+
+func (imp *importer) problem(format string, args ...interface{}) {
+	imp.result.Problems = append(imp.result.Problems, fmt.Sprintf(format, args...))
+}
+
+func (imp *importer) warning(format string, args ...interface{}) {
+	imp.result.Warnings = append(imp.result.Warnings, fmt.Sprintf(format, args...))
+}
+
+// created returns the id of a created record for the result, none for a dry run.
+func (imp *importer) created(id int64) int64 {
+	if imp.params.DryRun {
+		return 0
+	}
+	return id
+}
+
+// load reads the units, the VAT rates and the bank account of the organisation the
+// invoices are made out from.
+func (imp *importer) load() error {
+	rows, err := imp.tx.Query(imp.ctx, "SELECT id, name FROM units WHERE destroyed_at IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var id int64
+		var name string
+
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		if _, ok := imp.units[strings.ToLower(name)]; !ok {
+			imp.units[strings.ToLower(name)] = id
+		}
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	query := `
+		SELECT id, is_active, is_default, rate, name, valid_from, valid_to
+		FROM vat_rates
+		WHERE destroyed_at IS NULL AND is_active = true
+		ORDER BY is_default DESC, id`
+
+	rows, err = imp.tx.Query(imp.ctx, query)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var vatRate VatRate
+
+		err = rows.Scan(
+			&vatRate.ID,
+			&vatRate.IsActive,
+			&vatRate.IsDefault,
+			&vatRate.Rate,
+			&vatRate.Name,
+			&vatRate.ValidFrom,
+			&vatRate.ValidTo,
+		)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		imp.vatRates = append(imp.vatRates, &vatRate)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	query = `
+		SELECT id FROM bank_accounts
+		WHERE organisation_id = $1
+		ORDER BY is_default DESC, id
+		LIMIT 1`
+
+	err = imp.tx.QueryRow(imp.ctx, query, imp.params.OrganisationID).Scan(&imp.bankAccountID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	return nil
+}
+
+// vatRate returns the rate with the percentage valid on the date, the default rate if
+// the file gives no percentage.
+func (imp *importer) vatRate(rate *float64, date time.Time) *VatRate {
+	for _, vatRate := range imp.vatRates {
+		if !vatRate.ValidOn(date) {
+			continue
+		}
+		if rate == nil && vatRate.IsDefault || rate != nil && vatRate.Rate == *rate {
+			return vatRate
+		}
+	}
+	return nil
+}
+
+// unit returns the unit with the name, created if there's none.
+func (imp *importer) unit(name string) (int64, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	if id, ok := imp.units[strings.ToLower(name)]; ok {
+		return id, nil
+	}
+
+	var id int64
+
+	err := imp.tx.QueryRow(imp.ctx, "INSERT INTO units (name) VALUES ($1) RETURNING id", name).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	imp.units[strings.ToLower(name)] = id
+	imp.result.Units = append(imp.result.Units, &ImportEntry{Action: ImportCreated, ID: imp.created(id), Name: name})
+
+	return id, nil
+}
+
+// product returns the product of the file, matched with an existing one or created.
+// It returns nil if the product can't be imported.
+func (imp *importer) product(p commerceml.Product) (*importedProduct, error) {
+	key := p.ID
+	if key == "" {
+		key = "name:" + strings.ToLower(p.Name)
+	}
+
+	if product, ok := imp.products[key]; ok {
+		return product, nil
+	}
+
+	if p.Name == "" {
+		imp.problem("product %s has no name", p.ID)
+		imp.products[key] = nil
+		return nil, nil
+	}
+
+	entry := &ImportEntry{ExternalID: p.ID, Name: p.Name}
+	product := &importedProduct{}
+
+	query := `
+		SELECT p.id, COALESCE(p.unit_id, 0), COALESCE(p.vat_rate_id, 0), COALESCE(vr.rate, 0)
+		FROM products p
+		LEFT JOIN vat_rates vr ON vr.id = p.vat_rate_id
+		WHERE p.destroyed_at IS NULL AND (p.sku = $1 AND $1 <> '' OR $1 = '' AND lower(p.name) = lower($2))
+		ORDER BY p.id
+		LIMIT 1`
+
+	err := imp.tx.QueryRow(imp.ctx, query, p.SKU, p.Name).Scan(&product.ID, &product.UnitID, &product.VatRateID, &product.VatRate)
+
+	switch {
+	case err == nil:
+		entry.Action = ImportExisting
+		entry.ID = product.ID
+	case errors.Is(err, pgx.ErrNoRows):
+		vatRate := imp.vatRate(p.VatRate, time.Now())
+		if vatRate == nil {
+			imp.problem("product %q: there's no %s", p.Name, describeImportRate(p.VatRate))
+			imp.products[key] = nil
+			return nil, nil
+		}
+		product.VatRateID, product.VatRate = vatRate.ID, vatRate.Rate
+
+		product.UnitID, err = imp.unit(p.Unit)
+		if err != nil {
+			return nil, err
+		}
+
+		query = `
+			INSERT INTO products (is_active, product_type, name, description, sku, price, vat_rate_id, unit_id, user_id)
+			VALUES (true, 1, $1, $2, $3, 0, $4, NULLIF($5, 0), $6)
+			RETURNING id`
+
+		err = imp.tx.QueryRow(imp.ctx, query, p.Name, p.Description, p.SKU, product.VatRateID, product.UnitID, imp.params.UserID).Scan(&product.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Action = ImportCreated
+		entry.ID = imp.created(product.ID)
+	default:
+		return nil, err
+	}
+
+	imp.products[key] = product
+	imp.result.Products = append(imp.result.Products, entry)
+
+	return product, nil
+}
+
+// company returns the id of the company of the counterparty, matched with an existing
+// one or created, or 0 if it can't be imported.
+func (imp *importer) company(c commerceml.Counterparty) (*importedCompany, error) {
+	key := c.ID
+	if key == "" {
+		key = "inn:" + c.INN + "/" + c.KPP + "/" + strings.ToLower(c.Name)
+	}
+
+	if company, ok := imp.companies[key]; ok {
+		return company, nil
+	}
+
+	if c.Name == "" {
+		imp.problem("counterparty %s has no name", c.ID)
+		imp.companies[key] = &importedCompany{}
+		return imp.companies[key], nil
+	}
+
+	entry := &ImportEntry{ExternalID: c.ID, Name: c.Name}
+
+	// A counterparty with the KPP of a branch is that branch of the company.
+	query := `
+		SELECT c.id, b.id FROM companies c
+		LEFT JOIN company_branches b ON b.company_id = c.id AND $2 <> '' AND b.kpp = $2
+			AND COALESCE(c.details->>'kpp', '') <> $2
+		WHERE c.destroyed_at IS NULL
+			AND ($1 <> '' AND c.details->>'inn' = $1 AND ($2 = '' OR COALESCE(c.details->>'kpp', '') = $2 OR b.id IS NOT NULL)
+				OR $1 = '' AND lower(c.name) = lower($3))
+		ORDER BY c.id, b.id
+		LIMIT 1`
+
+	var id int64
+	var branchID *int64
+
+	err := imp.tx.QueryRow(imp.ctx, query, c.INN, c.KPP, c.Name).Scan(&id, &branchID)
+
+	switch {
+	case err == nil:
+		entry.Action = ImportExisting
+		entry.ID = id
+	case errors.Is(err, pgx.ErrNoRows):
+		details := &CompanyDetails{INN: c.INN, KPP: c.KPP, Address: c.Address}
+
+		query = `
+			INSERT INTO companies (name, full_name, company_type, details)
+			VALUES ($1, $2, 1, $3)
+			RETURNING id`
+
+		err = imp.tx.QueryRow(imp.ctx, query, c.Name, c.FullName, details).Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Action = ImportCreated
+		entry.ID = imp.created(id)
+	default:
+		return nil, err
+	}
+
+	company := &importedCompany{ID: id, BranchID: branchID}
+
+	imp.companies[key] = company
+	imp.result.Companies = append(imp.result.Companies, entry)
+
+	return company, nil
+}
+
+// agreement returns the agreement invoices of the company are imported under: the one
+// of the company defaults, the latest one of the company or a new one.
+func (imp *importer) agreement(companyID int64, companyName string) (int64, error) {
+	if id, ok := imp.agreements[companyID]; ok {
+		return id, nil
+	}
+
+	query := `
+		SELECT a.id FROM agreements a
+		JOIN companies c ON c.id = a.company_id
+		WHERE a.company_id = $1 AND a.destroyed_at IS NULL
+		ORDER BY a.id = COALESCE((c.defaults->>'agreement_id')::bigint, 0) DESC, a.start_at DESC NULLS LAST, a.id DESC
+		LIMIT 1`
+
+	var id int64
+
+	err := imp.tx.QueryRow(imp.ctx, query, companyID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		query = `
+			INSERT INTO agreements (name, warning_percent, company_id, user_id)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id`
+
+		err = imp.tx.QueryRow(imp.ctx, query, importAgreementName, DefaultAgreementWarningPercent, companyID, imp.params.UserID).Scan(&id)
+		if err == nil {
+			imp.result.Agreements = append(imp.result.Agreements, &ImportEntry{
+				Action: ImportCreated,
+				ID:     imp.created(id),
+				Name:   fmt.Sprintf("%s (%s)", importAgreementName, companyName),
+			})
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	imp.agreements[companyID] = id
+
+	return id, nil
+}
+
+// invoice imports an invoice or an order of the file as an invoice with its lines.
+func (imp *importer) invoice(d commerceml.Document) error {
+	entry := &ImportEntry{ExternalID: d.ID, Name: d.Number}
+	imp.result.Invoices = append(imp.result.Invoices, entry)
+
+	if d.Operation != commerceml.OperationInvoice && d.Operation != commerceml.OperationOrder {
+		entry.Action = ImportSkipped
+		entry.Reason = fmt.Sprintf("%q is not an invoice", d.Operation)
+		return nil
+	}
+
+	name := fmt.Sprintf("invoice %s of %s", d.Number, d.Date)
+
+	date, err := time.Parse("2006-01-02", strings.SplitN(d.Date, "T", 2)[0])
+	if err != nil {
+		imp.problem("%s: the date must be in the YYYY-MM-DD format", name)
+		return nil
+	}
+
+	if currency := strings.ToLower(d.Currency); currency != "" && currency != "руб" && currency != "rub" && currency != "643" {
+		imp.problem("%s: the currency %s is not supported", name, d.Currency)
+		return nil
+	}
+
+	var id int64
+
+	query := `
+		SELECT id FROM invoices_history
+		WHERE organisation_id = $1 AND number = $2 AND date_part('year', date) = $3 AND destroyed_at IS NULL
+		LIMIT 1`
+
+	err = imp.tx.QueryRow(imp.ctx, query, imp.params.OrganisationID, d.Number, date.Year()).Scan(&id)
+	switch {
+	case err == nil:
+		entry.Action = ImportExisting
+		entry.ID = id
+		return nil
+	case !errors.Is(err, pgx.ErrNoRows):
+		return err
+	}
+
+	buyer := d.Buyer()
+	if buyer == nil {
+		imp.problem("%s has no buyer", name)
+		return nil
+	}
+
+	company, err := imp.company(*buyer)
+	if err != nil || company.ID == 0 {
+		return err
+	}
+
+	if imp.bankAccountID == 0 {
+		imp.problem("%s: the organisation has no bank account", name)
+		return nil
+	}
+
+	agreementID, err := imp.agreement(company.ID, buyer.Name)
+	if err != nil {
+		return err
+	}
+
+	invoice := &Invoice{
+		IsActive:       true,
+		Date:           date,
+		Number:         d.Number,
+		OrganisationID: imp.params.OrganisationID,
+		BankAccountID:  imp.bankAccountID,
+		CompanyID:      company.ID,
+		BranchID:       company.BranchID,
+		AgreementID:    agreementID,
+		VatMode:        VatOnTop,
+	}
+
+	items := []*InvoiceItem{}
+	valid := true
+
+	for i, line := range d.Items {
+		item, err := imp.invoiceItem(name, i+1, line, date)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			valid = false
+			continue
+		}
+		items = append(items, item)
+	}
+
+	if !valid {
+		return nil
+	}
+
+	if len(items) == 0 {
+		imp.problem("%s has no lines", name)
+		return nil
+	}
+
+	err = InvoiceModel{}.insert(imp.ctx, imp.tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		item.InvoiceID = invoice.ID
+	}
+
+	err = insertInvoiceItems(imp.ctx, imp.tx, items)
+	if err != nil {
+		return err
+	}
+
+	_, err = recalculateInvoice(imp.ctx, imp.tx, invoice)
+	if err != nil {
+		if errors.Is(err, ErrAgreementAmountExceeded) {
+			imp.problem("%s exceeds the amount of its agreement", name)
+			return nil
+		}
+		return err
+	}
+
+	if sum, err := ParseMoney(d.Sum); err == nil && sum != invoice.Amount+invoice.Vat {
+		imp.warning("%s: the total is %s, the file says %s", name, (invoice.Amount + invoice.Vat).String(), sum.String())
+	}
+
+	entry.Action = ImportCreated
+	entry.ID = imp.created(invoice.ID)
+
+	return nil
+}
+
+// invoiceItem returns the invoice line of a line of the file, or nil if it can't be
+// imported. Prices including VAT are converted to prices without VAT, the VAT is
+// added on top of the lines.
+func (imp *importer) invoiceItem(name string, position int, line commerceml.DocumentItem, date time.Time) (*InvoiceItem, error) {
+	product, err := imp.product(line.Product)
+	if err != nil || product == nil {
+		return nil, err
+	}
+
+	quantity, err := strconv.ParseFloat(line.Quantity, 64)
+	if err != nil || quantity <= 0 {
+		imp.problem("%s, line %d: the quantity must be a positive number", name, position)
+		return nil, nil
+	}
+
+	price, err := ParseMoney(line.Price)
+	if err != nil || price < 0 {
+		imp.problem("%s, line %d: the price must be a decimal with up to two places", name, position)
+		return nil, nil
+	}
+
+	// Lines without a rate take the rate of the product, or the default one.
+	rate := line.VatRate
+	if rate == nil && product.VatRateID != 0 {
+		rate = &product.VatRate
+	}
+
+	vatRate := imp.vatRate(rate, date)
+	if vatRate == nil {
+		imp.problem("%s, line %d: there's no %s valid on %s", name, position, describeImportRate(rate), date.Format("2006-01-02"))
+		return nil, nil
+	}
+
+	unitID, err := imp.unit(line.Unit)
+	if err != nil {
+		return nil, err
+	}
+	if unitID == 0 {
+		unitID = product.UnitID
+	}
+	if unitID == 0 {
+		imp.problem("%s, line %d: the line has no unit", name, position)
+		return nil, nil
+	}
+
+	if line.VatIncluded {
+		price = price.mulDiv(100*100, 100*100+vatRateHundredths(vatRate.Rate), DefaultRoundingPolicy.Mode)
+	}
+
+	return &InvoiceItem{
+		Position:     position,
+		ProductID:    product.ID,
+		Description:  line.Description,
+		UnitID:       unitID,
+		Quantity:     quantity,
+		Price:        price,
+		DiscountType: DiscountPercent,
+		VatRateID:    vatRate.ID,
+	}, nil
+}
+
+func describeImportRate(rate *float64) string {
+	if rate == nil {
+		return "default VAT rate"
+	}
+	return "VAT rate of " + strconv.FormatFloat(*rate, 'f', -1, 64) + "%"
+}
@@ -0,0 +1,213 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FlatInvoice is an invoice as the integration endpoints return it: one level of plain
+// fields, which no-code platforms map without parsing nested objects. Dates are
+// YYYY-MM-DD and amounts are numbers in roubles.
+type FlatInvoice struct {
+	ID             int64   `json:"id"`
+	Number         string  `json:"number"`
+	Date           string  `json:"date"`
+	DueDate        *string `json:"due_date"`
+	IsActive       bool    `json:"is_active"`
+	Status         string  `json:"status"`
+	OrganisationID int64   `json:"organisation_id"`
+	CompanyID      int64   `json:"company_id"`
+	CompanyName    string  `json:"company_name"`
+	CompanyINN     string  `json:"company_inn"`
+	Amount         Money   `json:"amount"`
+	Vat            Money   `json:"vat"`
+	Total          Money   `json:"total"`
+	Paid           Money   `json:"paid"`
+	CreatedAt      string  `json:"created_at"`
+}
+
+// Define a IntegrationModel struct type which wraps a pgx.Conn connection pool. It
+// reads the data of the integration endpoints.
+type IntegrationModel struct {
+	DB *pgxpool.Pool
+}
+
+const flatInvoiceQuery = `
+	SELECT i.id, i.number, to_char(i.date, 'YYYY-MM-DD'), to_char(i.due_date, 'YYYY-MM-DD'), i.is_active,
+		CASE
+			WHEN i.status = 'cancelled' THEN 'cancelled'
+			WHEN i.written_off_at IS NOT NULL THEN 'written_off'
+			WHEN COALESCE(i.amount, 0) > 0 AND p.paid >= i.amount + COALESCE(i.vat, 0) THEN 'paid'
+			WHEN i.due_date < NOW() THEN 'overdue'
+			WHEN p.paid > 0 THEN 'partially_paid'
+			ELSE 'unpaid'
+		END,
+		i.organisation_id, i.company_id, COALESCE(c.name, ''), COALESCE(c.details->>'inn', ''),
+		COALESCE(i.amount, 0), COALESCE(i.vat, 0), COALESCE(i.amount, 0) + COALESCE(i.vat, 0), p.paid,
+		to_char(i.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+	FROM invoices i
+	LEFT JOIN companies c ON c.id = i.company_id
+	CROSS JOIN LATERAL (
+		SELECT COALESCE(SUM(amount), 0) AS paid FROM payment_allocations WHERE invoice_id = i.id
+	) p
+	WHERE i.organisation_id = $1 AND i.destroyed_at IS NULL`
+
+func scanFlatInvoice(row pgx.Row) (*FlatInvoice, error) {
+	var invoice FlatInvoice
+
+	err := row.Scan(
+		&invoice.ID,
+		&invoice.Number,
+		&invoice.Date,
+		&invoice.DueDate,
+		&invoice.IsActive,
+		&invoice.Status,
+		&invoice.OrganisationID,
+		&invoice.CompanyID,
+		&invoice.CompanyName,
+		&invoice.CompanyINN,
+		&invoice.Amount,
+		&invoice.Vat,
+		&invoice.Total,
+		&invoice.Paid,
+		&invoice.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invoice, nil
+}
+
+// LatestInvoices returns the latest invoices of the organisation, the newest first,
+// which is the order polling triggers of no-code platforms expect.
+func (m IntegrationModel) LatestInvoices(organisationID int64, limit int) ([]*FlatInvoice, error) {
+	query := flatInvoiceQuery + `
+		ORDER BY i.id DESC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invoices := []*FlatInvoice{}
+
+	for rows.Next() {
+		invoice, err := scanFlatInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
+
+// Invoice returns an invoice of the organisation.
+func (m IntegrationModel) Invoice(organisationID, id int64) (*FlatInvoice, error) {
+	query := flatInvoiceQuery + ` AND i.id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	invoice, err := scanFlatInvoice(m.DB.QueryRow(ctx, query, organisationID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return invoice, nil
+}
+
+// CompanyByINN returns the ID of the company with the INN, and the KPP if it isn't
+// empty. A KPP of a branch of the company matches as well, the branch is returned
+// then; it is nil for the KPP of the company itself.
+func (m IntegrationModel) CompanyByINN(inn, kpp string) (int64, *int64, error) {
+	query := `
+		SELECT c.id, b.id FROM companies c
+		LEFT JOIN company_branches b ON b.company_id = c.id AND $2 <> '' AND b.kpp = $2
+			AND COALESCE(c.details->>'kpp', '') <> $2
+		WHERE c.destroyed_at IS NULL AND c.details->>'inn' = $1
+			AND ($2 = '' OR COALESCE(c.details->>'kpp', '') = $2 OR b.id IS NOT NULL)
+		ORDER BY c.id, b.id
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+	var branchID *int64
+
+	err := m.DB.QueryRow(ctx, query, inn, kpp).Scan(&id, &branchID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, nil, ErrRecordNotFound
+		default:
+			return 0, nil, err
+		}
+	}
+
+	return id, branchID, nil
+}
+
+// ProductBySKU returns the ID of the product with the SKU.
+func (m IntegrationModel) ProductBySKU(sku string) (int64, error) {
+	query := `
+		SELECT id FROM products
+		WHERE destroyed_at IS NULL AND sku = $1
+		ORDER BY id
+		LIMIT 1`
+
+	return m.findID(query, sku)
+}
+
+// CompanyAgreement returns the ID of the agreement invoices of the company are made out
+// under: the default of the company, or else the latest one.
+func (m IntegrationModel) CompanyAgreement(companyID int64) (int64, error) {
+	query := `
+		SELECT a.id FROM agreements a
+		JOIN companies c ON c.id = a.company_id
+		WHERE a.company_id = $1 AND a.destroyed_at IS NULL
+		ORDER BY a.id = COALESCE((c.defaults->>'agreement_id')::bigint, 0) DESC, a.start_at DESC NULLS LAST, a.id DESC
+		LIMIT 1`
+
+	return m.findID(query, companyID)
+}
+
+func (m IntegrationModel) findID(query string, args ...interface{}) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
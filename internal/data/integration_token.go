@@ -0,0 +1,217 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The scopes an integration token can be given.
+const (
+	ScopeInvoicesRead  = "invoices:read"
+	ScopeInvoicesWrite = "invoices:write"
+)
+
+var IntegrationScopes = []string{ScopeInvoicesRead, ScopeInvoicesWrite}
+
+// The plaintext of integration tokens starts with the prefix, so they can be told apart
+// from the JWTs of the users.
+const IntegrationTokenPrefix = "stk_"
+
+// IntegrationToken lets a no-code platform act for the user within the organisation.
+// Plaintext is only set when the token is created, it's never stored.
+type IntegrationToken struct {
+	ID             int64      `json:"id"`
+	UserID         int64      `json:"user_id"`
+	OrganisationID int64      `json:"organisation_id"`
+	Name           string     `json:"name"`
+	Plaintext      string     `json:"token,omitempty"`
+	Prefix         string     `json:"prefix"`
+	Scopes         []string   `json:"scopes"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
+
+// HasScope reports whether the token was given the scope.
+func (t *IntegrationToken) HasScope(scope string) bool {
+	return validator.In(scope, t.Scopes...)
+}
+
+func ValidateIntegrationToken(v *validator.Validator, token *IntegrationToken) {
+	v.Check(token.OrganisationID != 0, "organisation_id", "must be provided")
+	v.Check(token.Name != "", "name", "must be provided")
+	v.Check(len(token.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(token.Scopes) > 0, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(token.Scopes), "scopes", "must not contain duplicate values")
+
+	for _, scope := range token.Scopes {
+		v.Check(validator.In(scope, IntegrationScopes...), "scopes", "must only contain invoices:read and invoices:write")
+	}
+
+	if token.ExpiresAt != nil {
+		v.Check(token.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+	}
+}
+
+// Define a IntegrationTokenModel struct type which wraps a pgx.Conn connection pool.
+type IntegrationTokenModel struct {
+	DB *pgxpool.Pool
+}
+
+func hashIntegrationToken(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+// Insert generates the plaintext of the token and stores its hash.
+func (m IntegrationTokenModel) Insert(token *IntegrationToken) error {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	token.Plaintext = IntegrationTokenPrefix + strings.ToLower(encoding.EncodeToString(randomBytes))
+	token.Prefix = token.Plaintext[:len(IntegrationTokenPrefix)+8]
+
+	query := `
+		INSERT INTO integration_tokens (user_id, organisation_id, name, hash, prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		token.UserID,
+		token.OrganisationID,
+		token.Name,
+		hashIntegrationToken(token.Plaintext),
+		token.Prefix,
+		token.Scopes,
+		token.ExpiresAt,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+}
+
+// GetForPlaintext returns the token with the plaintext if it's neither revoked nor
+// expired, and records that it was used.
+func (m IntegrationTokenModel) GetForPlaintext(plaintext string) (*IntegrationToken, error) {
+	query := `
+		UPDATE integration_tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING id, user_id, organisation_id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token, err := scanIntegrationToken(m.DB.QueryRow(ctx, query, hashIntegrationToken(plaintext)))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+func scanIntegrationToken(row pgx.Row) (*IntegrationToken, error) {
+	var token IntegrationToken
+
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.OrganisationID,
+		&token.Name,
+		&token.Prefix,
+		&token.Scopes,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.RevokedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// GetAll returns the tokens of the user, the revoked ones included.
+func (m IntegrationTokenModel) GetAll(userID int64) ([]*IntegrationToken, error) {
+	query := `
+		SELECT id, user_id, organisation_id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at
+		FROM integration_tokens
+		WHERE user_id = $1
+		ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*IntegrationToken{}
+
+	for rows.Next() {
+		token, err := scanIntegrationToken(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Revoke revokes a token of the user, it's kept for the list.
+func (m IntegrationTokenModel) Revoke(userID, id int64) (*IntegrationToken, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE integration_tokens
+		SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE user_id = $1 AND id = $2
+		RETURNING id, user_id, organisation_id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token, err := scanIntegrationToken(m.DB.QueryRow(ctx, query, userID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
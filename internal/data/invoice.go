@@ -4,52 +4,180 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// ErrInvoiceHasPayments is returned when an invoice which payments or returns have been
+// allocated to is deleted.
+var ErrInvoiceHasPayments = errors.New("the invoice has payments or returns")
+
+// ErrInvalidTransition is returned when the invoice can't be moved from its workflow
+// status to the one requested, e.g. a cancelled invoice is sent.
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// ErrInvoiceNotPaid is returned when an invoice whose total isn't covered by the
+// payments allocated to it is marked as paid.
+var ErrInvoiceNotPaid = errors.New("the invoice isn't paid in full")
+
+// ErrInvoiceShipped is returned when an invoice which has been shipped is shipped
+// again or deleted.
+var ErrInvoiceShipped = errors.New("the invoice has been shipped")
+
 // Invoice type details
 type Invoice struct {
-	ID             int64          `json:"id"`
-	IsActive       bool           `json:"is_active"`
-	Date           time.Time      `json:"date"`
-	Number         string         `json:"number"`
-	OrganisationID int64          `json:"organisation_id,omitempty"`
-	BankAccountID  int64          `json:"bank_account_id,omitempty"`
-	CompanyID      int64          `json:"company_id,omitempty"`
-	AgreementID    int64          `json:"agreement_id,omitempty"`
-	Amount         float64        `json:"amount"`
-	Discount       float64        `json:"discount"`
-	Vat            float64        `json:"vat"`
-	UserID         int64          `json:"user_id,omitempty"`
-	UUID           string         `json:"uuid,omitempty"`
-	DestroyedAt    *time.Time     `json:"destroyed_at,omitempty"`
-	Organisation   *Organisation  `json:"organisation,omitempty"`
-	BankAccount    *BankAccount   `json:"bank_account,omitempty"`
-	Company        *Company       `json:"company,omitempty"`
-	Agreement      *Agreement     `json:"agreement,omitempty"`
-	User           *User          `json:"user,omitempty"`
-	InvoiceItems   []*InvoiceItem `json:"invoice_items,omitempty"`
-	CreatedAt      *time.Time     `json:"created_at,omitempty"`
-	UpdatedAt      *time.Time     `json:"updated_at,omitempty"`
+	ID             int64      `json:"id"`
+	IsActive       bool       `json:"is_active"`
+	IsAdvance      bool       `json:"is_advance"`
+	Date           time.Time  `json:"date"`
+	DueDate        *time.Time `json:"due_date,omitempty"`
+	Number         string     `json:"number"`
+	OrganisationID int64      `json:"organisation_id,omitempty"`
+	BankAccountID  int64      `json:"bank_account_id,omitempty"`
+	CompanyID      int64      `json:"company_id,omitempty"`
+	AgreementID    int64      `json:"agreement_id,omitempty"`
+	// The contact who signs the invoice for the company, see ContactModel.Signer.
+	SignerContactID *int64         `json:"signer_contact_id,omitempty"`
+	Amount          Money          `json:"amount"`
+	Discount        Money          `json:"discount"`
+	DiscountType    string         `json:"discount_type,omitempty"`
+	DiscountValue   Money          `json:"discount_value,omitempty"`
+	Vat             Money          `json:"vat"`
+	UserID          int64          `json:"user_id,omitempty"`
+	UUID            string         `json:"uuid,omitempty"`
+	WrittenOffAt    *time.Time     `json:"written_off_at,omitempty"`
+	WriteOffReason  *string        `json:"write_off_reason,omitempty"`
+	Archived        bool           `json:"archived,omitempty"`
+	TaxationSystem  string         `json:"taxation_system,omitempty"`
+	DestroyedAt     *time.Time     `json:"destroyed_at,omitempty"`
+	Organisation    *Organisation  `json:"organisation,omitempty"`
+	BankAccount     *BankAccount   `json:"bank_account,omitempty"`
+	Company         *Company       `json:"company,omitempty"`
+	Agreement       *Agreement     `json:"agreement,omitempty"`
+	User            *User          `json:"user,omitempty"`
+	InvoiceItems    []*InvoiceItem `json:"invoice_items,omitempty"`
+	CreatedAt       *time.Time     `json:"created_at,omitempty"`
+	UpdatedAt       *time.Time     `json:"updated_at,omitempty"`
+	// Whether the prices include VAT or it is added on top, lines may differ.
+	VatMode string `json:"vat_mode"`
+	// The references of the invoice in external systems, by system.
+	ExternalRefs map[string]string `json:"external_refs,omitempty"`
+	// The branch of the company the invoice is issued to, see CompanyBranch.
+	BranchID *int64 `json:"branch_id,omitempty"`
+	// The workflow status: draft, sent, shipped, paid or cancelled, see
+	// InvoiceModel.Transition and InvoiceModel.Ship.
+	Status    string     `json:"status"`
+	ShippedAt *time.Time `json:"shipped_at,omitempty"`
+	// What the payments and returns allocated to the invoice cover of its total, the
+	// amount and the VAT, and what is still to be paid.
+	Paid        Money `json:"paid"`
+	Outstanding Money `json:"outstanding"`
+}
+
+// Workflow statuses of an invoice. An invoice is a draft until it's sent to the
+// company, either marked as sent or sent by the API; it's shipped once its goods have
+// left the warehouse and paid once the payments allocated to it cover its amount and
+// it's marked as paid. Paid and cancelled invoices stay so.
+const (
+	InvoiceStatusDraft     = "draft"
+	InvoiceStatusSent      = "sent"
+	InvoiceStatusShipped   = "shipped"
+	InvoiceStatusCancelled = "cancelled"
+)
+
+// invoiceTransitions holds the workflow statuses an invoice can be moved to from each
+// status. Shipped invoices can't be cancelled, their goods are returned instead.
+var invoiceTransitions = map[string][]string{
+	InvoiceStatusDraft:   {InvoiceStatusSent, InvoiceStatusShipped, InvoiceStatusPaid, InvoiceStatusCancelled},
+	InvoiceStatusSent:    {InvoiceStatusShipped, InvoiceStatusPaid, InvoiceStatusCancelled},
+	InvoiceStatusShipped: {InvoiceStatusPaid},
+}
+
+// Invoice statuses, derived from the payments allocated to the invoice, its due date
+// and the write-off. Invoices can be listed by these and by the workflow statuses.
+const (
+	InvoiceStatusUnpaid        = "unpaid"
+	InvoiceStatusPartiallyPaid = "partially_paid"
+	InvoiceStatusPaid          = "paid"
+	InvoiceStatusOverdue       = "overdue"
+	InvoiceStatusWrittenOff    = "written_off"
+)
+
+var InvoiceStatuses = []string{InvoiceStatusUnpaid, InvoiceStatusPartiallyPaid, InvoiceStatusPaid, InvoiceStatusOverdue, InvoiceStatusWrittenOff,
+	InvoiceStatusDraft, InvoiceStatusSent, InvoiceStatusShipped, InvoiceStatusCancelled}
+
+// invoicePaidColumn sums up the payments allocated to the invoice.
+const invoicePaidColumn = "COALESCE((SELECT SUM(amount) FROM payment_allocations WHERE invoice_id = invoices.id), 0)"
+
+// invoiceTotalColumn is what the invoice bills, the amount without VAT and the VAT.
+const invoiceTotalColumn = "(COALESCE(amount, 0) + COALESCE(vat, 0))"
+
+// invoiceStatusConditions holds the SQL condition selecting the invoices of each status.
+// Overdue invoices are unpaid or partially paid ones, so they match those statuses too.
+// Cancelled invoices aren't owed, so they only match their workflow status; the paid
+// ones match the paid status as they're paid in full.
+var invoiceStatusConditions = map[string]string{
+	InvoiceStatusUnpaid:        "status <> 'cancelled' AND written_off_at IS NULL AND COALESCE(amount, 0) > 0 AND " + invoicePaidColumn + " = 0",
+	InvoiceStatusPartiallyPaid: "status <> 'cancelled' AND written_off_at IS NULL AND " + invoicePaidColumn + " > 0 AND " + invoicePaidColumn + " < " + invoiceTotalColumn,
+	InvoiceStatusPaid:          "status <> 'cancelled' AND written_off_at IS NULL AND " + invoicePaidColumn + " >= " + invoiceTotalColumn,
+	InvoiceStatusOverdue:       "status <> 'cancelled' AND written_off_at IS NULL AND due_date < NOW() AND " + invoicePaidColumn + " < " + invoiceTotalColumn,
+	InvoiceStatusWrittenOff:    "written_off_at IS NOT NULL",
+	InvoiceStatusDraft:         "status = 'draft'",
+	InvoiceStatusSent:          "status = 'sent'",
+	InvoiceStatusShipped:       "status = 'shipped'",
+	InvoiceStatusCancelled:     "status = 'cancelled'",
 }
 
 type InvoiceFilters struct {
 	OrganisationID int64
 	CompanyID      int64
 	AgreementID    int64
+	GroupID        int64
+	BankAccountID  int64
 	Start          *time.Time
 	End            *time.Time
+	Status         string
+	MinAmount      *Money
+	MaxAmount      *Money
+	NumberPrefix   string
+	// ExternalRef selects the invoices with the reference in an external system, given
+	// as system:ref.
+	ExternalRef string
+	// IncludeDeleted lists the deleted invoices too, with their destroyed_at.
+	IncludeDeleted bool
 }
 
 func ValidateInvoice(v *validator.Validator, invoice *Invoice) {
 	v.Check(invoice.OrganisationID != 0, "organisation_id", "must be provided")
 	v.Check(invoice.CompanyID != 0, "company_id", "must be provided")
+
+	if invoice.DiscountType != "" {
+		ValidateDiscount(v, "discount", invoice.DiscountType, invoice.DiscountValue)
+	}
+
+	v.Check(validator.In(invoice.VatMode, VatModes...), "vat_mode", "must be on_top or included")
+}
+
+func ValidateInvoiceFilters(v *validator.Validator, filters InvoiceFilters) {
+	if filters.Status != "" {
+		v.Check(validator.In(filters.Status, InvoiceStatuses...), "status", "invalid status value")
+	}
+	if filters.MinAmount != nil {
+		v.Check(*filters.MinAmount >= 0, "min_amount", "must not be negative")
+	}
+	if filters.MinAmount != nil && filters.MaxAmount != nil {
+		v.Check(*filters.MaxAmount >= *filters.MinAmount, "max_amount", "must not be less than min_amount")
+	}
+	v.Check(len(filters.NumberPrefix) <= 50, "number", "must not be more than 50 bytes long")
+
+	if filters.ExternalRef != "" {
+		system, ref, ok := strings.Cut(filters.ExternalRef, ":")
+		v.Check(ok && ExternalSystemRX.MatchString(system) && ref != "", "external_ref", "must be given as system:ref")
+	}
 }
 
 // Define a InvoiceModel struct type which wraps a pgx.Conn connection pool.
@@ -58,50 +186,73 @@ type InvoiceModel struct {
 }
 
 func (m InvoiceModel) GetAll(filters InvoiceFilters, pagination Pagination) ([]*Invoice, Metadata, error) {
-	// Construct the SQL query to retrieve all movie records.
-	queryElements := []string{}
-	filterQuery := ""
-	q := ""
+	// The values of the filters are passed as query arguments; the limit and the offset
+	// follow them.
+	f := filter{}
 
 	if filters.OrganisationID > 0 {
-		q = fmt.Sprintf("organisation_id = %d", filters.OrganisationID)
-		queryElements = append(queryElements, q)
+		f.where("organisation_id = " + f.arg(filters.OrganisationID))
 	}
 
 	if filters.CompanyID > 0 {
-		q = fmt.Sprintf("company_id = %d", filters.CompanyID)
-		queryElements = append(queryElements, q)
+		f.where("company_id = " + f.arg(filters.CompanyID))
 	}
 
 	if filters.AgreementID > 0 {
-		q = fmt.Sprintf("agreement_id = %d", filters.AgreementID)
-		queryElements = append(queryElements, q)
+		f.where("agreement_id = " + f.arg(filters.AgreementID))
+	}
+
+	if filters.GroupID > 0 {
+		f.where("company_id IN (SELECT id FROM companies WHERE group_id = " + f.arg(filters.GroupID) + ")")
+	}
+
+	f.dateRange("date", filters.Start, filters.End)
+
+	if filters.BankAccountID > 0 {
+		f.where("bank_account_id = " + f.arg(filters.BankAccountID))
+	}
+
+	if filters.Status != "" {
+		f.where("(" + invoiceStatusConditions[filters.Status] + ")")
 	}
 
-	if filters.Start != nil && filters.End != nil {
-		q = fmt.Sprintf("date BETWEEN '%s' AND '%s'", filters.Start.Format(time.RFC3339), filters.End.Format(time.RFC3339))
-		queryElements = append(queryElements, q)
+	if filters.MinAmount != nil {
+		f.where("COALESCE(amount, 0) >= " + f.arg(*filters.MinAmount))
 	}
 
-	q = "destroyed_at IS NULL"
-	queryElements = append(queryElements, q)
+	if filters.MaxAmount != nil {
+		f.where("COALESCE(amount, 0) <= " + f.arg(*filters.MaxAmount))
+	}
+
+	if filters.NumberPrefix != "" {
+		f.where("number LIKE " + f.arg(likeEscaper.Replace(filters.NumberPrefix)+"%"))
+	}
+
+	if filters.ExternalRef != "" {
+		system, ref, _ := strings.Cut(filters.ExternalRef, ":")
+		f.where("external_refs @> " + f.arg(map[string]string{system: ref}))
+	}
 
-	if len(queryElements) > 0 {
-		filterQuery = " WHERE " + strings.Join(queryElements, " AND ") + " "
+	if !filters.IncludeDeleted {
+		f.where("destroyed_at IS NULL")
 	}
+
+	// The count takes the arguments of the filter only, without the limit and offset.
+	filterQuery, args := f.clause(), f.args
+
 	// Construct the SQL query to retrieve all movie records.
 	query := fmt.Sprintf(`
-	SELECT id, is_active, date, number, amount, discount, vat, 
+	SELECT id, is_active, is_advance, date, due_date, number, amount, discount, vat, 
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM organisations WHERE organisations.id = organisation_id) row) AS organisation,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM bank_accounts WHERE bank_accounts.id = bank_account_id) row) AS bank_account,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = company_id) row) AS company,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM agreements WHERE agreements.id = agreement_id) row) AS agreement,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM users WHERE users.id = user_id) row) AS user,   
-		uuid, created_at, updated_at 
+		uuid, written_off_at, write_off_reason, external_refs, status, shipped_at, `+invoicePaidColumn+`, destroyed_at, created_at, updated_at 
 	FROM invoices 
 	%s
 	ORDER BY %s %s
-	LIMIT $1 OFFSET $2`, filterQuery, pagination.sortColumn(), pagination.sortDirection())
+	LIMIT %s OFFSET %s`, filterQuery, pagination.sortColumn(), pagination.sortDirection(), f.arg(pagination.limit()), f.arg(pagination.offset()))
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -109,7 +260,7 @@ func (m InvoiceModel) GetAll(filters InvoiceFilters, pagination Pagination) ([]*
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
-	rows, err := m.DB.Query(ctx, query, pagination.limit(), pagination.offset())
+	rows, err := m.DB.Query(ctx, query, f.args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -130,7 +281,9 @@ func (m InvoiceModel) GetAll(filters InvoiceFilters, pagination Pagination) ([]*
 		err := rows.Scan(
 			&invoice.ID,
 			&invoice.IsActive,
+			&invoice.IsAdvance,
 			&invoice.Date,
+			&invoice.DueDate,
 			&invoice.Number,
 			&invoice.Amount,
 			&invoice.Discount,
@@ -141,6 +294,13 @@ func (m InvoiceModel) GetAll(filters InvoiceFilters, pagination Pagination) ([]*
 			&invoice.Agreement,
 			&invoice.User,
 			&invoice.UUID,
+			&invoice.WrittenOffAt,
+			&invoice.WriteOffReason,
+			&invoice.ExternalRefs,
+			&invoice.Status,
+			&invoice.ShippedAt,
+			&invoice.Paid,
+			&invoice.DestroyedAt,
 			&invoice.CreatedAt,
 			&invoice.UpdatedAt,
 		)
@@ -148,6 +308,8 @@ func (m InvoiceModel) GetAll(filters InvoiceFilters, pagination Pagination) ([]*
 			return nil, Metadata{}, err
 		}
 
+		invoice.Outstanding = invoice.Amount + invoice.Vat - invoice.Paid
+
 		// Add the Invoice struct to the slice.
 		invoices = append(invoices, &invoice)
 	}
@@ -160,7 +322,7 @@ func (m InvoiceModel) GetAll(filters InvoiceFilters, pagination Pagination) ([]*
 
 	// Generate a Metadata struct, passing in the total record count and pagination
 	// parameters from the client.
-	totalRecords, err := m.CountIDs(filterQuery)
+	totalRecords, err := m.CountIDs(filterQuery, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -172,41 +334,119 @@ func (m InvoiceModel) GetAll(filters InvoiceFilters, pagination Pagination) ([]*
 
 // Add method for inserting a new record in the Invoices table.
 func (m InvoiceModel) Insert(invoice *Invoice) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// The number is only taken if the invoice is inserted.
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	err = m.insert(ctx, tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// InsertWithItems inserts the invoice and its items and calculates the totals in one
+// transaction, so an item which can't be inserted doesn't leave a partial invoice
+// behind.
+func (m InvoiceModel) InsertWithItems(invoice *Invoice, items []*InvoiceItem) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	err = m.insert(ctx, tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		item.InvoiceID = invoice.ID
+	}
+
+	err = insertInvoiceItems(ctx, tx, items)
+	if err != nil {
+		return err
+	}
+
+	lines, err := recalculateInvoice(ctx, tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if line, ok := lines[item.ID]; ok {
+			line.apply(item)
+		}
+	}
+
+	invoice.InvoiceItems = items
+
+	return tx.Commit(ctx)
+}
+
+func (m InvoiceModel) insert(ctx context.Context, db dbtx, invoice *Invoice) error {
 	// Define the SQL query for inserting a new record
 	query := `
 		INSERT INTO invoices (
-			is_active, date, number, organisation_id, bank_account_id, company_id, agreement_id) 
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, is_active, date, number, amount, discount, vat,
+			is_active, is_advance, date, due_date, number, organisation_id, bank_account_id, company_id, agreement_id,
+			discount_type, discount_value, signer_contact_id, vat_mode, branch_id) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11, $12, $13, $14)
+		RETURNING id, is_active, is_advance, date, due_date, number, amount, discount, vat,
 				  (SELECT row_to_json(row) FROM (SELECT id, name FROM organisations WHERE organisations.id = organisation_id) row) AS organisation,
 		          (SELECT row_to_json(row) FROM (SELECT id, name FROM bank_accounts WHERE bank_accounts.id = bank_account_id) row) AS bank_account,
 		          (SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = company_id) row) AS company,
 		          (SELECT row_to_json(row) FROM (SELECT id, name FROM agreements WHERE agreements.id = agreement_id) row) AS agreement,  
-				  uuid, created_at, updated_at`
+				  uuid, status, created_at, updated_at`
 
-	// Set new number
+	// Number the invoice from the invoice sequence of the organisation unless a number
+	// has been given.
 	if invoice.Number == "" {
-		number, err := m.GetNumber(invoice.OrganisationID)
-		if err == nil {
-			invoice.Number = number
+		number, err := nextDocumentNumber(ctx, db, invoice.OrganisationID, DocumentInvoice, invoice.Date)
+		if err != nil {
+			return err
 		}
+		invoice.Number = number
 	}
 
 	args := []interface{}{
 		invoice.IsActive,
+		invoice.IsAdvance,
 		invoice.Date,
+		invoice.DueDate,
 		invoice.Number,
 		invoice.OrganisationID,
 		invoice.BankAccountID,
 		invoice.CompanyID,
 		invoice.AgreementID,
+		invoice.DiscountType,
+		invoice.DiscountValue,
+		invoice.SignerContactID,
+		invoice.VatMode,
+		invoice.BranchID,
 	}
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(
+	return db.QueryRow(ctx, query, args...).Scan(
 		&invoice.ID,
 		&invoice.IsActive,
+		&invoice.IsAdvance,
 		&invoice.Date,
+		&invoice.DueDate,
 		&invoice.Number,
 		&invoice.Amount,
 		&invoice.Discount,
@@ -216,13 +456,24 @@ func (m InvoiceModel) Insert(invoice *Invoice) error {
 		&invoice.Company,
 		&invoice.Agreement,
 		&invoice.UUID,
+		&invoice.Status,
 		&invoice.CreatedAt,
 		&invoice.UpdatedAt,
 	)
 }
 
-// Add method for fetching a specific record from the invoices table.
+// Add method for fetching a specific record from the invoices table. Deleted invoices
+// aren't found.
 func (m InvoiceModel) Get(id int64) (*Invoice, error) {
+	return m.get(id, false)
+}
+
+// GetDeleted returns the invoice if it has been deleted, so it can be restored.
+func (m InvoiceModel) GetDeleted(id int64) (*Invoice, error) {
+	return m.get(id, true)
+}
+
+func (m InvoiceModel) get(id int64, deleted bool) (*Invoice, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no invoices will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shortcut
@@ -233,14 +484,21 @@ func (m InvoiceModel) Get(id int64) (*Invoice, error) {
 
 	// Define the SQL query for retrieving data.
 	query := `
-	SELECT id, is_active, date, number, amount, discount, vat, 
+	SELECT id, is_active, is_advance, date, due_date, number, amount, discount, vat, 
+		COALESCE(organisation_id, 0), COALESCE(bank_account_id, 0), COALESCE(company_id, 0), COALESCE(agreement_id, 0),
+		signer_contact_id, branch_id,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM organisations WHERE organisations.id = organisation_id) row) AS organisation,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM bank_accounts WHERE bank_accounts.id = bank_account_id) row) AS bank_account,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = company_id) row) AS company,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM agreements WHERE agreements.id = agreement_id) row) AS agreement,
 		(SELECT row_to_json(row) FROM (SELECT id, name FROM users WHERE users.id = user_id) row) AS user,   
-		uuid, created_at, updated_at    
-	FROM invoices WHERE id = $1`
+		uuid, written_off_at, write_off_reason, archived,
+		COALESCE(discount_type, ''), COALESCE(discount_value, 0), vat_mode,
+		COALESCE(organisation_taxation_system(organisation_id, date::date), 'osno'),
+		external_refs, status, shipped_at,
+		COALESCE((SELECT SUM(amount) FROM payment_allocations WHERE invoice_id = invoices_history.id), 0),
+		destroyed_at, created_at, updated_at    
+	FROM invoices_history WHERE id = $1 AND (destroyed_at IS NOT NULL) = $2`
 
 	// Declare a Invoice struct to hold the data returned by the query.
 	var invoice Invoice
@@ -252,20 +510,40 @@ func (m InvoiceModel) Get(id int64) (*Invoice, error) {
 	defer cancel()
 
 	// Execute the query using the QueryRow() method, passing in the provided id value
-	err := m.DB.QueryRow(ctx, query, id).Scan(
+	err := m.DB.QueryRow(ctx, query, id, deleted).Scan(
 		&invoice.ID,
 		&invoice.IsActive,
+		&invoice.IsAdvance,
 		&invoice.Date,
+		&invoice.DueDate,
 		&invoice.Number,
 		&invoice.Amount,
 		&invoice.Discount,
 		&invoice.Vat,
+		&invoice.OrganisationID,
+		&invoice.BankAccountID,
+		&invoice.CompanyID,
+		&invoice.AgreementID,
+		&invoice.SignerContactID,
+		&invoice.BranchID,
 		&invoice.Organisation,
 		&invoice.BankAccount,
 		&invoice.Company,
 		&invoice.Agreement,
 		&invoice.User,
 		&invoice.UUID,
+		&invoice.WrittenOffAt,
+		&invoice.WriteOffReason,
+		&invoice.Archived,
+		&invoice.DiscountType,
+		&invoice.DiscountValue,
+		&invoice.VatMode,
+		&invoice.TaxationSystem,
+		&invoice.ExternalRefs,
+		&invoice.Status,
+		&invoice.ShippedAt,
+		&invoice.Paid,
+		&invoice.DestroyedAt,
 		&invoice.CreatedAt,
 		&invoice.UpdatedAt,
 	)
@@ -282,138 +560,509 @@ func (m InvoiceModel) Get(id int64) (*Invoice, error) {
 		}
 	}
 
+	invoice.Outstanding = invoice.Amount + invoice.Vat - invoice.Paid
+
 	return &invoice, nil
 }
 
-// Add method for updating a specific record in the invoices table.
+// Add method for updating a specific record in the invoices table. The totals are
+// recalculated from the items afterwards, as the invoice discount or the date (and with
+// it the taxation system) may have changed.
 func (m InvoiceModel) Update(invoice *Invoice) error {
 	query := `
 		UPDATE invoices
-		SET is_active = $1, date = $2, number = $3, organisation_id = $4, bank_account_id = $5, 
-		company_id = $6, agreement_id = $7, amount = $8, discount = $9, vat = $10, updated_at = NOW() 
-		WHERE id = $11
-		RETURNING updated_at`
+		SET is_active = $1, is_advance = $2, date = $3, due_date = $4, number = $5, organisation_id = $6, bank_account_id = $7, 
+		company_id = $8, agreement_id = $9, discount_type = NULLIF($10, ''), discount_value = $11, signer_contact_id = $12,
+		vat_mode = $13, branch_id = $14, updated_at = NOW() 
+		FROM (SELECT COALESCE(agreement_id, 0) AS agreement_id, COALESCE(is_advance, false) AS is_advance
+			FROM invoices WHERE id = $15) previous
+		WHERE id = $15
+		RETURNING previous.agreement_id, previous.is_advance`
 
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
 		invoice.IsActive,
+		invoice.IsAdvance,
 		invoice.Date,
+		invoice.DueDate,
 		invoice.Number,
 		invoice.OrganisationID,
 		invoice.BankAccountID,
 		invoice.CompanyID,
 		invoice.AgreementID,
-		invoice.Amount,
-		invoice.Discount,
-		invoice.Vat,
+		invoice.DiscountType,
+		invoice.DiscountValue,
+		invoice.SignerContactID,
+		invoice.VatMode,
+		invoice.BranchID,
 		invoice.ID,
 	}
 
-	// Use the QueryRow() method to execute the query, passing in the args slice as a
-	// variadic parameter and scanning the new version value into the movie struct.
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(&invoice.UpdatedAt)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	err = lockInvoice(ctx, tx, invoice.ID)
+	if err != nil {
+		return err
+	}
+
+	var previousAgreementID int64
+	var wasAdvance bool
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&previousAgreementID, &wasAdvance)
+	if err != nil {
+		return err
+	}
+
+	_, err = recalculateInvoice(ctx, tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	// An invoice which is moved to another agreement or is no longer an advance counts
+	// against the agreement with its whole amount.
+	if !invoice.IsAdvance && (invoice.AgreementID != previousAgreementID || wasAdvance) {
+		err = checkAgreementAmount(ctx, tx, invoice.AgreementID, invoice.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
 }
 
-// Add method for deleting a specific record from the invoices table.
+// Add method for deleting a specific record from the invoices table. The invoice is
+// only marked as destroyed, with its items, attachments and links kept, so it can be
+// restored. Invoices which payments or returns have been allocated to are kept, so the
+// payment history doesn't vanish with them, and ErrInvoiceHasPayments is returned.
 func (m InvoiceModel) Delete(id int64) error {
-	// Return an ErrRecordNotFound error if the movie ID is less than 1.
+	// Return an ErrRecordNotFound error if the invoice ID is less than 1.
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// The lock keeps payments from being applied to the invoice while it's deleted.
+	err = lockInvoice(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = checkInvoiceUnpaid(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	// The goods of a shipped invoice have left the warehouse, they are returned instead.
+	var shipped bool
+
+	err = tx.QueryRow(ctx, "SELECT shipped_at IS NOT NULL FROM invoices WHERE id = $1", id).Scan(&shipped)
+	if err != nil {
+		return err
+	}
+
+	if shipped {
+		return ErrInvoiceShipped
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE invoices SET destroyed_at = NOW(), updated_at = NOW() WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Restore brings back a deleted invoice. ErrRecordNotFound is returned if there's no
+// deleted invoice with the id, e.g. it has been restored already, or its organisation
+// has been deleted.
+func (m InvoiceModel) Restore(id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	// Construct the SQL query to delete the record.
 	query := `
-		DELETE FROM invoices WHERE id = $1`
+		UPDATE invoices SET destroyed_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND destroyed_at IS NOT NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM organisations
+				WHERE organisations.id = invoices.organisation_id AND organisations.destroyed_at IS NOT NULL
+			)`
 
-	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Execute the SQL query using the Exec() method, passing in the id variable as
-	// the value for the placeholder parameter. The Exec() method returns a sql.Result
-	// object.
 	result, err := m.DB.Exec(ctx, query, id)
 	if err != nil {
 		return err
 	}
 
-	// Call the RowsAffected() method on the sql.Result object to get the number of rows
-	// affected by the query.
-	rowsAffected := result.RowsAffected()
-
-	// If no rows were affected, we know that the invoices table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
-	if rowsAffected == 0 {
+	if result.RowsAffected() == 0 {
 		return ErrRecordNotFound
 	}
 
 	return nil
 }
 
-// Add method for deleting a specific record from the invoices table.
-func (m InvoiceModel) GetNumber(organisationID int64) (string, error) {
-	if organisationID < 1 {
-		return "", ErrRecordNotFound
-	}
-
-	// Define the SQL query for retrieving data.
-	query := "SELECT id, number FROM invoices WHERE organisation_id = $1 ORDER BY created_at DESC LIMIT 1"
-
-	// Declare a Invoice struct to hold the data returned by the query.
-	var invoice Invoice
+// WriteOff marks the invoice as bad debt. The invoice itself and its items are kept for
+// history, but it is excluded from receivables reports from now on.
+func (m InvoiceModel) WriteOff(invoice *Invoice, reason string) error {
+	query := `
+		UPDATE invoices
+		SET written_off_at = NOW(), write_off_reason = $1, updated_at = NOW()
+		WHERE id = $2 AND written_off_at IS NULL AND destroyed_at IS NULL
+		RETURNING written_off_at, write_off_reason, updated_at`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	// Importantly, use defer to make sure that we cancel the context before the Get() method returns.
 	defer cancel()
 
-	// Execute the query using the QueryRow() method, passing in the provided id value
-	err := m.DB.QueryRow(ctx, query, organisationID).Scan(
-		&invoice.ID,
-		&invoice.Number,
+	err := m.DB.QueryRow(ctx, query, reason, invoice.ID).Scan(
+		&invoice.WrittenOffAt,
+		&invoice.WriteOffReason,
+		&invoice.UpdatedAt,
 	)
 
-	// Handle any errors. If there was no matching found, Scan() will return
-	// a sql.ErrNoRows error. We check for this and return our custom ErrRecordNotFound
-	// error instead.
+	// No rows means that somebody else has written the invoice off (or deleted it)
+	// since we fetched it.
 	if err != nil {
 		switch {
 		case errors.Is(err, pgx.ErrNoRows):
-			return "1", nil
+			return ErrEditConflict
 		default:
-			return "", err
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Transition moves the invoice to the workflow status, see invoiceTransitions. An
+// invoice is only marked as paid if the payments allocated to it cover its amount, and
+// only cancelled if no payments or returns have been allocated to it, so it can't stay
+// in the receivables. ErrInvalidTransition, ErrInvoiceNotPaid or ErrInvoiceHasPayments
+// is returned otherwise.
+func (m InvoiceModel) Transition(invoice *Invoice, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// The lock keeps payments from being applied to the invoice meanwhile.
+	err = lockInvoice(ctx, tx, invoice.ID)
+	if err != nil {
+		return err
+	}
+
+	// The invoice is paid once the allocations cover its total, VAT included.
+	var current string
+	var total, paid Money
+
+	query := `
+		SELECT status, COALESCE(amount, 0) + COALESCE(vat, 0), ` + invoicePaidColumn + `
+		FROM invoices WHERE id = $1`
+
+	err = tx.QueryRow(ctx, query, invoice.ID).Scan(&current, &total, &paid)
+	if err != nil {
+		return err
+	}
+
+	if !validator.In(status, invoiceTransitions[current]...) {
+		return ErrInvalidTransition
+	}
+
+	switch status {
+	case InvoiceStatusPaid:
+		if paid < total {
+			return ErrInvoiceNotPaid
+		}
+	case InvoiceStatusCancelled:
+		err = checkInvoiceUnpaid(ctx, tx, invoice.ID)
+		if err != nil {
+			return err
 		}
 	}
 
-	n, err := strconv.Atoi(invoice.Number)
+	query = `
+		UPDATE invoices SET status = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING status, updated_at`
+
+	err = tx.QueryRow(ctx, query, status, invoice.ID).Scan(&invoice.Status, &invoice.UpdatedAt)
 	if err != nil {
-		return "", err
+		return err
 	}
-	number := strconv.Itoa(n + 1)
-	return number, nil
+
+	return tx.Commit(ctx)
 }
 
-// Add method for updating a specific record in the invoices table.
+// Ship takes the goods of the invoice from the warehouse: a shipment of the quantity
+// of every product of the goods lines and of the component goods of kit lines, summed
+// up, dated at the date, which the invoice is marked as shipped at. A draft or sent
+// invoice moves to shipped, a paid one stays paid. It returns the shipments,
+// ErrInvoiceShipped if the invoice has been shipped before, ErrInvalidTransition if it
+// can't be shipped from its status, ErrInsufficientStock if the warehouse doesn't hold
+// enough of the goods and ErrRecordNotFound if the invoice or the warehouse doesn't
+// exist.
+func (m InvoiceModel) Ship(invoice *Invoice, warehouseID int64, date time.Time, userID int64) ([]*StockMovement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// The lock keeps the invoice from being shipped twice at the same time.
+	err = lockInvoice(ctx, tx, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var current string
+	var shippedAt *time.Time
+
+	err = tx.QueryRow(ctx, "SELECT status, shipped_at FROM invoices WHERE id = $1", invoice.ID).Scan(&current, &shippedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if shippedAt != nil {
+		return nil, ErrInvoiceShipped
+	}
+
+	if current != InvoiceStatusPaid && !validator.In(InvoiceStatusShipped, invoiceTransitions[current]...) {
+		return nil, ErrInvalidTransition
+	}
+
+	// Kits kept as one line (keep_kit) ship their component goods, the quantity of the
+	// kit times that of the component, rounded like the lines of an expanded kit.
+	query := `
+		INSERT INTO stock_movements (warehouse_id, product_id, kind, date, quantity, invoice_id, user_id)
+		SELECT $1, line.product_id, $2, $3, -SUM(line.quantity), $5, $4
+		FROM (
+			SELECT ii.product_id, ii.quantity
+			FROM invoice_items ii
+			INNER JOIN products p ON p.id = ii.product_id
+			WHERE ii.invoice_id = $5 AND p.product_type = $6
+			UNION ALL
+			SELECT kc.product_id, ROUND(ii.quantity * kc.quantity, 3)
+			FROM invoice_items ii
+			INNER JOIN products kit ON kit.id = ii.product_id
+			INNER JOIN kit_components kc ON kc.kit_id = kit.id
+			INNER JOIN products p ON p.id = kc.product_id
+			WHERE ii.invoice_id = $5 AND kit.product_type = $7 AND p.product_type = $6
+		) AS line
+		GROUP BY line.product_id
+		HAVING SUM(line.quantity) > 0
+		RETURNING ` + stockMovementColumns
+
+	shipments, err := moveStock(ctx, tx, warehouseID, query, warehouseID, StockShipment, date, userID, invoice.ID, ProductTypeGoods, ProductTypeKit)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		UPDATE invoices
+		SET status = CASE WHEN status = 'paid' THEN status ELSE 'shipped' END, shipped_at = $2, updated_at = NOW()
+		WHERE id = $1
+		RETURNING status, shipped_at, updated_at`
+
+	err = tx.QueryRow(ctx, query, invoice.ID, date).Scan(&invoice.Status, &invoice.ShippedAt, &invoice.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return shipments, tx.Commit(ctx)
+}
+
+// markInvoiceSent is the part of a query which moves the draft invoice selected by
+// the subquery to sent, for the queries recording that an invoice has been sent.
+func markInvoiceSent(subquery string) string {
+	return "UPDATE invoices SET status = 'sent', updated_at = NOW() WHERE id = (" + subquery + ") AND status = 'draft'"
+}
+
+// checkInvoiceUnpaid returns ErrInvoiceHasPayments if payments or returns have been
+// allocated to the invoice.
+func checkInvoiceUnpaid(ctx context.Context, tx pgx.Tx, id int64) error {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM payment_allocations pa
+			INNER JOIN payments p ON p.id = pa.payment_id
+			WHERE pa.invoice_id = $1 AND p.destroyed_at IS NULL
+		) OR EXISTS (SELECT 1 FROM returns WHERE invoice_id = $1)`
+
+	var paid bool
+
+	err := tx.QueryRow(ctx, query, id).Scan(&paid)
+	if err != nil {
+		return err
+	}
+
+	if paid {
+		return ErrInvoiceHasPayments
+	}
+
+	return nil
+}
+
+// Archive moves the settled invoices issued before the given date and their items to
+// the archive tables. Only invoices which are paid in full, written off or deleted are
+// moved, so the receivables never depend on the archive. Every batch of invoices is
+// moved in a transaction of its own. It returns the number of archived invoices.
+func (m InvoiceModel) Archive(before time.Time, batchSize int) (int64, error) {
+	var archived int64
+
+	for {
+		n, err := m.archiveBatch(before, batchSize)
+		if err != nil {
+			return archived, err
+		}
+
+		archived += n
+
+		if n < int64(batchSize) {
+			return archived, nil
+		}
+	}
+}
+
+func (m InvoiceModel) archiveBatch(before time.Time, batchSize int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// Invoices locked by a running request are skipped and picked up next time.
+	query := `
+		SELECT id FROM invoices
+		WHERE date < $1 AND (
+			written_off_at IS NOT NULL OR destroyed_at IS NOT NULL OR
+			COALESCE(amount, 0) + COALESCE(vat, 0) <= COALESCE((SELECT SUM(amount) FROM payment_allocations WHERE invoice_id = invoices.id), 0))
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.Query(ctx, query, before, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// The invoices have to be in the archive before they are deleted, otherwise the
+	// delete trigger removes their payment allocations. Deleting an invoice cascades
+	// to its items.
+	queries := []string{
+		"INSERT INTO invoice_items_archive SELECT * FROM invoice_items WHERE invoice_id = ANY($1)",
+		"INSERT INTO invoices_archive SELECT * FROM invoices WHERE id = ANY($1)",
+		"DELETE FROM invoices WHERE id = ANY($1)",
+	}
+
+	for _, query := range queries {
+		_, err = tx.Exec(ctx, query, ids)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(ids)), nil
+}
+
+// UpdateTotals recalculates the discounts, the amount and VAT of the invoice from its
+// items. The
+// invoice row is locked first, so concurrent changes of the items are summed up one
+// after another and can't overwrite each other's totals.
 func (m InvoiceModel) UpdateTotals(id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	queryItems := "SELECT COALESCE(SUM(amount), 0) as amount, COALESCE(SUM(vat), 0) as vat FROM invoice_items WHERE invoice_id = $1"
-
-	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var amount float64
-	var vat float64
-	// Execute the query using the QueryRow() method, passing in the provided id value
-	err := m.DB.QueryRow(ctx, queryItems, id).Scan(&amount, &vat)
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
 
-	// Handle any errors. If there was no matching found, Scan() will return
-	// a sql.ErrNoRows error. We check for this and return our custom ErrRecordNotFound
-	// error instead.
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	err = lockInvoice(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = recalculateInvoice(ctx, tx, &Invoice{ID: id})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// lockInvoice locks the invoice row until the end of the transaction. Every change of
+// invoice items takes this lock before it touches the items. Deleted invoices aren't
+// found, so they can't be changed until they are restored.
+func lockInvoice(ctx context.Context, tx pgx.Tx, id int64) error {
+	err := tx.QueryRow(ctx, "SELECT id FROM invoices WHERE id = $1 AND destroyed_at IS NULL FOR UPDATE", id).Scan(&id)
 	if err != nil {
 		switch {
 		case errors.Is(err, pgx.ErrNoRows):
@@ -422,25 +1071,41 @@ func (m InvoiceModel) UpdateTotals(id int64) error {
 			return err
 		}
 	}
+	return nil
+}
 
-	query := "UPDATE invoices SET amount = $1, vat = $2, updated_at = NOW() WHERE id = $3 RETURNING id"
-
-	// Use the QueryRow() method to execute the query, passing in the args slice as a
-	// variadic parameter and scanning the new version value into the movie struct.
-	err = m.DB.QueryRow(context.Background(), query, amount, vat, id).Scan(&id)
+// updateInvoiceTotals sums up the items of the invoice and stores the totals in a single
+// statement, setting the new values on the invoice struct.
+func updateInvoiceTotals(ctx context.Context, db dbtx, invoice *Invoice) error {
+	query := `
+		UPDATE invoices SET amount = t.amount, discount = t.discount, vat = t.vat, updated_at = NOW()
+		FROM (
+			SELECT COALESCE(SUM(amount), 0) AS amount, COALESCE(SUM(discount + invoice_discount), 0) AS discount,
+				COALESCE(SUM(vat), 0) AS vat
+			FROM invoice_items WHERE invoice_id = $1
+		) t
+		WHERE invoices.id = $1
+		RETURNING invoices.amount, invoices.discount, invoices.vat, invoices.updated_at`
+
+	err := db.QueryRow(ctx, query, invoice.ID).Scan(&invoice.Amount, &invoice.Discount, &invoice.Vat, &invoice.UpdatedAt)
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
 	}
 	return nil
 }
 
 // Count records in a table
-func (m InvoiceModel) CountIDs(filterQuery string) (int64, error) {
+func (m InvoiceModel) CountIDs(filterQuery string, args ...interface{}) (int64, error) {
 	query := fmt.Sprintf("select count(id) from invoices %s", filterQuery)
 	var count int64
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	err := m.DB.QueryRow(ctx, query).Scan(&count)
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&count)
 
 	// Importantly, use defer to make sure that we cancel the context before the Get()
 	// method returns.
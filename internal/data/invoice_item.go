@@ -6,35 +6,66 @@ import (
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // InvoiceItem struct
 type InvoiceItem struct {
-	ID           int64      `json:"id"`
-	InvoiceID    int64      `json:"invoice_id,omitempty"`
-	Position     int        `json:"position"`
-	ProductID    int64      `json:"product_id,omitempty"`
-	Description  string     `json:"description"`
-	UnitID       int64      `json:"unit_id,omitempty"`
-	Quantity     float64    `json:"quantity"`
-	Price        float64    `json:"price"`
-	Amount       float64    `json:"amount"`
-	DiscountRate int        `json:"discount_rate"`
-	Discount     float64    `json:"discount"`
-	VatRateID    int64      `json:"vat_rate_id,omitempty"`
-	Vat          float64    `json:"vat"`
-	Product      *Product   `json:"product"`
-	Unit         *Unit      `json:"unit"`
-	VatRate      *VatRate   `json:"vat_rate"`
-	CreatedAt    *time.Time `json:"created_at"`
-	UpdatedAt    *time.Time `json:"updated_at"`
+	ID           int64   `json:"id"`
+	InvoiceID    int64   `json:"invoice_id,omitempty"`
+	Position     int     `json:"position"`
+	ProductID    int64   `json:"product_id,omitempty"`
+	Description  string  `json:"description"`
+	UnitID       int64   `json:"unit_id,omitempty"`
+	Quantity     float64 `json:"quantity"`
+	Price        Money   `json:"price"`
+	Amount       Money   `json:"amount"`
+	DiscountType string  `json:"discount_type"`
+	DiscountRate int     `json:"discount_rate"`
+	Discount     Money   `json:"discount"`
+	// The part of the invoice discount allocated to the line, already subtracted from
+	// the amount.
+	InvoiceDiscount Money      `json:"invoice_discount"`
+	VatRateID       int64      `json:"vat_rate_id,omitempty"`
+	Vat             Money      `json:"vat"`
+	Product         *Product   `json:"product"`
+	Unit            *Unit      `json:"unit"`
+	VatRate         *VatRate   `json:"vat_rate"`
+	CreatedAt       *time.Time `json:"created_at"`
+	UpdatedAt       *time.Time `json:"updated_at"`
+	// VatMode overrides the VAT mode of the invoice for the line, nil follows it.
+	VatMode *string `json:"vat_mode"`
+	// KeepKit is only read from requests: a kit is added as one line instead of a
+	// line per component.
+	KeepKit bool `json:"keep_kit,omitempty"`
+}
+
+// FrequentItem is a product which was invoiced to a company, with the values of its
+// latest invoice line, used to suggest lines for new invoices.
+type FrequentItem struct {
+	Product        *Product  `json:"product"`
+	Unit           *Unit     `json:"unit"`
+	VatRate        *VatRate  `json:"vat_rate"`
+	TimesInvoiced  int64     `json:"times_invoiced"`
+	TotalQuantity  float64   `json:"total_quantity"`
+	LastPrice      Money     `json:"last_price"`
+	LastInvoicedAt time.Time `json:"last_invoiced_at"`
 }
 
 func ValidateInvoiceItem(v *validator.Validator, invoice *InvoiceItem) {
 	// v.Check(invoice.InvoiceID != 0, "invoice_id", "must be provided")
 	v.Check(invoice.ProductID != 0, "product_id", "must be provided")
+
+	if invoice.DiscountType == DiscountPercent {
+		ValidateDiscount(v, "discount", invoice.DiscountType, Money(invoice.DiscountRate*100))
+	} else {
+		ValidateDiscount(v, "discount", invoice.DiscountType, invoice.Discount)
+	}
+
+	if invoice.VatMode != nil {
+		v.Check(validator.In(*invoice.VatMode, VatModes...), "vat_mode", "must be on_top or included")
+	}
 }
 
 // Define a InvoiceItemModel struct type which wraps a pgx.Conn connection pool.
@@ -57,14 +88,14 @@ func (m InvoiceItemModel) GetAll(invoiceID int64) ([]*InvoiceItem, error) {
 				(SELECT id, name
 				FROM units
 				WHERE units.id = unit_id) row) AS unit, 
-		quantity, price, amount, discount_rate, discount, vat,
+		quantity, price, amount, discount_type, discount_rate, discount, invoice_discount, vat_mode, vat,
 		(SELECT row_to_json(row)
 				FROM
 				(SELECT id, name
 				FROM vat_rates
 				WHERE vat_rates.id = vat_rate_id) row) AS vat_rate, 
 		created_at, updated_at 
-		FROM invoice_items 
+		FROM invoice_items_history
 		WHERE invoice_id = $1`
 
 	// Create a context with a 3-second timeout.
@@ -100,8 +131,11 @@ func (m InvoiceItemModel) GetAll(invoiceID int64) ([]*InvoiceItem, error) {
 			&invoiceItem.Quantity,
 			&invoiceItem.Price,
 			&invoiceItem.Amount,
+			&invoiceItem.DiscountType,
 			&invoiceItem.DiscountRate,
 			&invoiceItem.Discount,
+			&invoiceItem.InvoiceDiscount,
+			&invoiceItem.VatMode,
 			&invoiceItem.Vat,
 			&invoiceItem.VatRate,
 			&invoiceItem.CreatedAt,
@@ -124,22 +158,81 @@ func (m InvoiceItemModel) GetAll(invoiceID int64) ([]*InvoiceItem, error) {
 	return invoiceItems, nil
 }
 
-// Add method for inserting a new record in the Organisations table.
+// Add method for inserting a new record in the invoice_items table. The totals of the
+// invoice are updated in the same transaction.
 func (m InvoiceItemModel) Insert(invoiceID int64, invoiceItem *InvoiceItem) error {
-	// Define the SQL query for inserting a new record
-	query := `
-		INSERT INTO invoice_items (
-			invoice_id, position, product_id, description, unit_id, quantity, price, 
-			amount, discount_rate, discount, vat_rate_id, vat
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
-		RETURNING id,
-		          (SELECT row_to_json(row) FROM (SELECT id, name FROM products WHERE products.id = product_id) row) AS product,
-				  (SELECT row_to_json(row) FROM (SELECT id, name FROM units WHERE units.id = unit_id) row) AS unit,
-				  (SELECT row_to_json(row) FROM (SELECT id, name FROM vat_rates WHERE vat_rates.id = vat_rate_id) row) AS vat_rate, 
-				  vat, created_at, updated_at`
+	invoiceItem.InvoiceID = invoiceID
 
-	args := []interface{}{
-		invoiceID,
+	return m.withInvoiceLock(invoiceID, []*InvoiceItem{invoiceItem}, func(ctx context.Context, tx pgx.Tx) error {
+		return insertInvoiceItem(ctx, tx, invoiceItem)
+	})
+}
+
+// InsertAll inserts several items into the invoice at once, e.g. the components of a
+// kit, and updates the totals of the invoice in the same transaction.
+func (m InvoiceItemModel) InsertAll(invoiceID int64, invoiceItems []*InvoiceItem) error {
+	for _, invoiceItem := range invoiceItems {
+		invoiceItem.InvoiceID = invoiceID
+	}
+
+	return m.withInvoiceLock(invoiceID, invoiceItems, func(ctx context.Context, tx pgx.Tx) error {
+		return insertInvoiceItems(ctx, tx, invoiceItems)
+	})
+}
+
+// withInvoiceLock runs fn in a transaction holding the lock of the invoice and
+// recalculates the lines and the totals of the invoice afterwards. The calculated
+// values are copied to the items.
+func (m InvoiceItemModel) withInvoiceLock(invoiceID int64, invoiceItems []*InvoiceItem, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	err = lockInvoice(ctx, tx, invoiceID)
+	if err != nil {
+		return err
+	}
+
+	err = fn(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	lines, err := recalculateInvoice(ctx, tx, &Invoice{ID: invoiceID})
+	if err != nil {
+		return err
+	}
+
+	for _, invoiceItem := range invoiceItems {
+		if line, ok := lines[invoiceItem.ID]; ok {
+			line.apply(invoiceItem)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+const insertInvoiceItemQuery = `
+	INSERT INTO invoice_items (
+		invoice_id, position, product_id, description, unit_id, quantity, price, 
+		amount, discount_type, discount_rate, discount, vat_rate_id, vat, vat_mode
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+	RETURNING id,
+	          (SELECT row_to_json(row) FROM (SELECT id, name FROM products WHERE products.id = product_id) row) AS product,
+			  (SELECT row_to_json(row) FROM (SELECT id, name FROM units WHERE units.id = unit_id) row) AS unit,
+			  (SELECT row_to_json(row) FROM (SELECT id, name FROM vat_rates WHERE vat_rates.id = vat_rate_id) row) AS vat_rate, 
+			  vat, created_at, updated_at`
+
+func (invoiceItem *InvoiceItem) insertArgs() []interface{} {
+	return []interface{}{
+		invoiceItem.InvoiceID,
 		invoiceItem.Position,
 		invoiceItem.ProductID,
 		invoiceItem.Description,
@@ -147,14 +240,18 @@ func (m InvoiceItemModel) Insert(invoiceID int64, invoiceItem *InvoiceItem) erro
 		invoiceItem.Quantity,
 		invoiceItem.Price,
 		invoiceItem.Amount,
+		invoiceItem.DiscountType,
 		invoiceItem.DiscountRate,
 		invoiceItem.Discount,
 		invoiceItem.VatRateID,
 		invoiceItem.Vat,
+		invoiceItem.VatMode,
 	}
+}
 
-	// Use the QueryRow() method to execute the SQL query on our connection pool
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(
+// scanInserted reads the columns returned by insertInvoiceItemQuery.
+func (invoiceItem *InvoiceItem) scanInserted(row pgx.Row) error {
+	return row.Scan(
 		&invoiceItem.ID,
 		&invoiceItem.Product,
 		&invoiceItem.Unit,
@@ -165,6 +262,23 @@ func (m InvoiceItemModel) Insert(invoiceID int64, invoiceItem *InvoiceItem) erro
 	)
 }
 
+func insertInvoiceItem(ctx context.Context, db dbtx, invoiceItem *InvoiceItem) error {
+	return invoiceItem.scanInserted(db.QueryRow(ctx, insertInvoiceItemQuery, invoiceItem.insertArgs()...))
+}
+
+// insertInvoiceItems inserts the items in a single round trip to the database, which
+// matters for invoices with many lines. The first item which can't be inserted fails
+// the batch.
+func insertInvoiceItems(ctx context.Context, db dbtx, invoiceItems []*InvoiceItem) error {
+	batch := &pgx.Batch{}
+
+	for _, invoiceItem := range invoiceItems {
+		batch.Queue(insertInvoiceItemQuery, invoiceItem.insertArgs()...).QueryRow(invoiceItem.scanInserted)
+	}
+
+	return db.SendBatch(ctx, batch).Close()
+}
+
 // Add method for fetching a specific record from the organisations table.
 func (m InvoiceItemModel) Get(invoiceID int64, id int64) (*InvoiceItem, error) {
 
@@ -186,14 +300,15 @@ func (m InvoiceItemModel) Get(invoiceID int64, id int64) (*InvoiceItem, error) {
 				(SELECT id, name
 				FROM units
 				WHERE units.id = unit_id) row) AS unit, 
-		quantity, price, amount, discount_rate, discount,
+		quantity, price, amount, discount_type, discount_rate, discount, invoice_discount, vat_mode,
+		COALESCE(product_id, 0), COALESCE(unit_id, 0), COALESCE(vat_rate_id, 0),
 		(SELECT row_to_json(row)
 				FROM
 				(SELECT id, name
 				FROM vat_rates
 				WHERE vat_rates.id = vat_rate_id) row) AS vat_rate, 
 		vat, created_at, updated_at 
-		FROM invoice_items 
+		FROM invoice_items_history
 		WHERE invoice_id = $1 AND id = $2`
 
 	args := []interface{}{invoiceID, id}
@@ -217,8 +332,14 @@ func (m InvoiceItemModel) Get(invoiceID int64, id int64) (*InvoiceItem, error) {
 		&invoiceItem.Quantity,
 		&invoiceItem.Price,
 		&invoiceItem.Amount,
+		&invoiceItem.DiscountType,
 		&invoiceItem.DiscountRate,
 		&invoiceItem.Discount,
+		&invoiceItem.InvoiceDiscount,
+		&invoiceItem.VatMode,
+		&invoiceItem.ProductID,
+		&invoiceItem.UnitID,
+		&invoiceItem.VatRateID,
 		&invoiceItem.VatRate,
 		&invoiceItem.Vat,
 		&invoiceItem.CreatedAt,
@@ -240,14 +361,15 @@ func (m InvoiceItemModel) Get(invoiceID int64, id int64) (*InvoiceItem, error) {
 	return &invoiceItem, nil
 }
 
-// Add method for updating a specific record in the organisations table.
+// Add method for updating a specific record in the invoice_items table. The totals of
+// the invoice are updated in the same transaction.
 func (m InvoiceItemModel) Update(invoiceItem *InvoiceItem) error {
 	query := `
 		UPDATE invoice_items
 		SET position = $1, product_id = $2, description = $3, unit_id = $4, 
-		    quantity = $5, price = $6, amount = $7, discount_rate = $8, discount = $9, 
-			vat_rate_id = $10, vat = $11, updated_at = NOW() 
-		WHERE id = $12
+		    quantity = $5, price = $6, amount = $7, discount_type = $8, discount_rate = $9, discount = $10, 
+			vat_rate_id = $11, vat = $12, vat_mode = $13, updated_at = NOW() 
+		WHERE id = $14 AND invoice_id = $15
 		RETURNING vat, updated_at, 
 		          (SELECT row_to_json(row) FROM (SELECT id, name FROM products WHERE products.id = product_id) row) AS product,
 				  (SELECT row_to_json(row) FROM (SELECT id, name FROM units WHERE units.id = unit_id) row) AS unit,
@@ -262,57 +384,164 @@ func (m InvoiceItemModel) Update(invoiceItem *InvoiceItem) error {
 		invoiceItem.Quantity,
 		invoiceItem.Price,
 		invoiceItem.Amount,
+		invoiceItem.DiscountType,
 		invoiceItem.DiscountRate,
 		invoiceItem.Discount,
 		invoiceItem.VatRateID,
 		invoiceItem.Vat,
+		invoiceItem.VatMode,
 		invoiceItem.ID,
+		invoiceItem.InvoiceID,
 	}
 
-	// Use the QueryRow() method to execute the query, passing in the args slice as a
-	// variadic parameter and scanning the new version value into the movie struct.
-	return m.DB.QueryRow(context.Background(), query, args...).Scan(
-		&invoiceItem.Vat,
-		&invoiceItem.UpdatedAt,
-		&invoiceItem.Product,
-		&invoiceItem.Unit,
-		&invoiceItem.VatRate,
-	)
+	return m.withInvoiceLock(invoiceItem.InvoiceID, []*InvoiceItem{invoiceItem}, func(ctx context.Context, tx pgx.Tx) error {
+		// Use the QueryRow() method to execute the query, passing in the args slice as a
+		// variadic parameter and scanning the new version value into the movie struct.
+		err := tx.QueryRow(ctx, query, args...).Scan(
+			&invoiceItem.Vat,
+			&invoiceItem.UpdatedAt,
+			&invoiceItem.Product,
+			&invoiceItem.Unit,
+			&invoiceItem.VatRate,
+		)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	})
 }
 
-// Add method for deleting a specific record from the organisations table.
-func (m InvoiceItemModel) Delete(id int64) error {
+// Add method for deleting a specific record from the invoice_items table. The totals
+// of the invoice are updated in the same transaction.
+func (m InvoiceItemModel) Delete(invoiceID, id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
-	if id < 1 {
+	if id < 1 || invoiceID < 1 {
 		return ErrRecordNotFound
 	}
 
 	// Construct the SQL query to delete the record.
 	query := `
-		DELETE FROM invoice_items WHERE id = $1`
+		DELETE FROM invoice_items WHERE id = $1 AND invoice_id = $2`
+
+	return m.withInvoiceLock(invoiceID, nil, func(ctx context.Context, tx pgx.Tx) error {
+		result, err := tx.Exec(ctx, query, id, invoiceID)
+		if err != nil {
+			return err
+		}
+
+		// If no rows were affected, the invoice doesn't have an item with the provided
+		// ID. In that case we return an ErrRecordNotFound error.
+		if result.RowsAffected() == 0 {
+			return ErrRecordNotFound
+		}
+
+		return nil
+	})
+}
+
+// GetFrequent returns the products most often invoiced to the company, together with
+// the price, unit and VAT rate of the latest line for each of them.
+func (m InvoiceItemModel) GetFrequent(companyID int64, limit int) ([]*FrequentItem, error) {
+	query := `
+		SELECT
+		(SELECT row_to_json(row) FROM (SELECT id, name, sku FROM products WHERE products.id = t.product_id) row) AS product,
+		(SELECT row_to_json(row) FROM (SELECT id, name FROM units WHERE units.id = t.unit_id) row) AS unit,
+		(SELECT row_to_json(row) FROM (SELECT id, name, rate FROM vat_rates WHERE vat_rates.id = t.vat_rate_id) row) AS vat_rate,
+		t.times_invoiced, t.total_quantity, t.price, t.date
+		FROM (
+			SELECT ii.product_id, ii.unit_id, ii.vat_rate_id, ii.price, i.date,
+				COUNT(*) OVER products_window AS times_invoiced,
+				SUM(ii.quantity) OVER products_window AS total_quantity,
+				ROW_NUMBER() OVER (PARTITION BY ii.product_id ORDER BY i.date DESC, ii.id DESC) AS rn
+			FROM invoice_items ii
+			JOIN invoices i ON i.id = ii.invoice_id
+			WHERE i.company_id = $1 AND i.destroyed_at IS NULL AND ii.product_id IS NOT NULL
+			WINDOW products_window AS (PARTITION BY ii.product_id)
+		) t
+		WHERE t.rn = 1
+		ORDER BY t.times_invoiced DESC, t.date DESC
+		LIMIT $2`
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Execute the SQL query using the Exec() method, passing in the id variable as
-	// the value for the placeholder parameter. The Exec() method returns a sql.Result
-	// object.
-	result, err := m.DB.Exec(ctx, query, id)
+	rows, err := m.DB.Query(ctx, query, companyID, limit)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Call the RowsAffected() method on the sql.Result object to get the number of rows
-	// affected by the query.
-	rowsAffected := result.RowsAffected()
+	// Importantly, defer a call to rows.Close() to ensure that the resultset is closed
+	// before GetFrequent() returns.
+	defer rows.Close()
 
-	// If no rows were affected, we know that the organisations table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	items := []*FrequentItem{}
+
+	for rows.Next() {
+		var item FrequentItem
+
+		err := rows.Scan(
+			&item.Product,
+			&item.Unit,
+			&item.VatRate,
+			&item.TimesInvoiced,
+			&item.TotalQuantity,
+			&item.LastPrice,
+			&item.LastInvoicedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return items, nil
+}
+
+// GetLastUsed returns the lines of the latest invoice of the company, of the
+// organisation unless it is 0, as lines for a new invoice: without IDs and calculated
+// amounts. It returns an empty slice if the company has no invoices.
+func (m InvoiceItemModel) GetLastUsed(companyID, organisationID int64) ([]*InvoiceItem, error) {
+	query := `
+		SELECT COALESCE(ii.position, 0), COALESCE(ii.product_id, 0), COALESCE(ii.description, ''), COALESCE(ii.unit_id, 0),
+			COALESCE(ii.quantity, 0), COALESCE(ii.price, 0), ii.discount_type, COALESCE(ii.discount_rate, 0),
+			COALESCE(ii.discount, 0), COALESCE(ii.vat_rate_id, 0), ii.vat_mode
+		FROM invoice_items ii
+		WHERE ii.invoice_id = (
+			SELECT id FROM invoices
+			WHERE company_id = $1 AND ($2::bigint = 0 OR organisation_id = $2) AND destroyed_at IS NULL
+			ORDER BY date DESC, id DESC
+			LIMIT 1)
+		ORDER BY ii.position, ii.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, companyID, organisationID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*InvoiceItem, error) {
+		var item InvoiceItem
+		err := row.Scan(
+			&item.Position,
+			&item.ProductID,
+			&item.Description,
+			&item.UnitID,
+			&item.Quantity,
+			&item.Price,
+			&item.DiscountType,
+			&item.DiscountRate,
+			&item.Discount,
+			&item.VatRateID,
+			&item.VatMode,
+		)
+		return &item, err
+	})
 }
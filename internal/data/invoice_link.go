@@ -0,0 +1,225 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrLinkExpired is returned for a link which has expired or was revoked.
+var ErrLinkExpired = errors.New("link expired")
+
+// Public links expire after DefaultLinkExpiry unless another expiry is given, at the
+// latest after MaxLinkExpiry.
+const (
+	DefaultLinkExpiry = 30 * 24 * time.Hour
+	MaxLinkExpiry     = 365 * 24 * time.Hour
+)
+
+// The slugs of links are drawn from the letters and digits, 12 of them give 71 bits.
+const (
+	linkSlugAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	linkSlugLength   = 12
+)
+
+// InvoiceLink is a public link to an invoice. URL is set by the API, it's not stored.
+type InvoiceLink struct {
+	ID             int64      `json:"id"`
+	Slug           string     `json:"slug"`
+	URL            string     `json:"url"`
+	OrganisationID int64      `json:"organisation_id"`
+	InvoiceID      int64      `json:"invoice_id"`
+	UserID         *int64     `json:"user_id"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	Views          int        `json:"views"`
+	LastViewedAt   *time.Time `json:"last_viewed_at,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
+
+func ValidateInvoiceLink(v *validator.Validator, link *InvoiceLink) {
+	v.Check(link.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+	v.Check(link.ExpiresAt.Before(time.Now().Add(MaxLinkExpiry)), "expires_at", "must be within a year")
+}
+
+// newLinkSlug returns a random slug. Bytes beyond the largest multiple of the alphabet
+// are skipped, so every character is equally likely.
+func newLinkSlug() (string, error) {
+	limit := 256 - 256%len(linkSlugAlphabet)
+	slug := make([]byte, 0, linkSlugLength)
+	random := make([]byte, linkSlugLength*2)
+
+	for len(slug) < linkSlugLength {
+		_, err := rand.Read(random)
+		if err != nil {
+			return "", err
+		}
+
+		for _, b := range random {
+			if int(b) < limit && len(slug) < linkSlugLength {
+				slug = append(slug, linkSlugAlphabet[int(b)%len(linkSlugAlphabet)])
+			}
+		}
+	}
+
+	return string(slug), nil
+}
+
+// Define an InvoiceLinkModel struct type which wraps a pgx.Conn connection pool.
+type InvoiceLinkModel struct {
+	DB *pgxpool.Pool
+}
+
+const invoiceLinkColumns = `id, slug, organisation_id, invoice_id, user_id, expires_at, revoked_at,
+	views, last_viewed_at, created_at`
+
+func scanInvoiceLink(row pgx.Row) (*InvoiceLink, error) {
+	var link InvoiceLink
+
+	err := row.Scan(
+		&link.ID,
+		&link.Slug,
+		&link.OrganisationID,
+		&link.InvoiceID,
+		&link.UserID,
+		&link.ExpiresAt,
+		&link.RevokedAt,
+		&link.Views,
+		&link.LastViewedAt,
+		&link.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &link, nil
+}
+
+// Insert generates the slug of the link and stores it.
+func (m InvoiceLinkModel) Insert(link *InvoiceLink) error {
+	slug, err := newLinkSlug()
+	if err != nil {
+		return err
+	}
+
+	link.Slug = slug
+
+	query := `
+		INSERT INTO invoice_links (slug, organisation_id, invoice_id, user_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{link.Slug, link.OrganisationID, link.InvoiceID, link.UserID, link.ExpiresAt}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&link.ID, &link.CreatedAt)
+}
+
+// GetAll returns the links of the invoice, the newest first.
+func (m InvoiceLinkModel) GetAll(invoiceID int64) ([]*InvoiceLink, error) {
+	query := `
+		SELECT ` + invoiceLinkColumns + `
+		FROM invoice_links
+		WHERE invoice_id = $1
+		ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*InvoiceLink{}
+
+	for rows.Next() {
+		link, err := scanInvoiceLink(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, link)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+// View returns the link with the slug and counts the view. ErrLinkExpired is returned
+// for a link which has expired or was revoked, which isn't counted.
+func (m InvoiceLinkModel) View(slug string) (*InvoiceLink, error) {
+	if len(slug) != linkSlugLength {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE invoice_links
+		SET views = views + 1, last_viewed_at = NOW()
+		WHERE slug = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING ` + invoiceLinkColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	link, err := scanInvoiceLink(m.DB.QueryRow(ctx, query, slug))
+	if err == nil {
+		return link, nil
+	}
+
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	var exists bool
+
+	err = m.DB.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM invoice_links WHERE slug = $1)", slug).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return nil, ErrLinkExpired
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+// Revoke revokes a link of the invoice, it's kept for the list.
+func (m InvoiceLinkModel) Revoke(invoiceID, id int64) (*InvoiceLink, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE invoice_links
+		SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE invoice_id = $1 AND id = $2
+		RETURNING ` + invoiceLinkColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	link, err := scanInvoiceLink(m.DB.QueryRow(ctx, query, invoiceID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return link, nil
+}
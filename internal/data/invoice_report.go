@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// The dimensions invoices can be grouped by and the metrics summed up per group, in
+// the order they are listed in the responses.
+var (
+	InvoiceReportDimensions = []string{"company", "month", "project", "product"}
+	InvoiceReportMetrics    = []string{"amount", "vat", "total", "count"}
+)
+
+// invoiceReportDimension is compiled to SQL as the expression the rows are grouped and
+// ordered by and the value returned for the group, e.g. the id and name of a company.
+type invoiceReportDimension struct {
+	group string
+	value string
+}
+
+var invoiceReportDimensions = map[string]invoiceReportDimension{
+	"company": {
+		group: "i.company_id",
+		value: "(SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = i.company_id) row)",
+	},
+	"month": {
+		group: "to_char(i.date, 'YYYY-MM')",
+		value: "to_char(i.date, 'YYYY-MM')",
+	},
+	"project": {
+		group: "i.project_id",
+		value: "(SELECT row_to_json(row) FROM (SELECT id, name FROM projects WHERE projects.id = i.project_id) row)",
+	},
+	"product": {
+		group: "ii.product_id",
+		value: "(SELECT row_to_json(row) FROM (SELECT id, name FROM products WHERE products.id = ii.product_id) row)",
+	},
+}
+
+// The metrics are summed up from the invoices, or from their items when the report is
+// grouped by product. The amounts of the items already include their share of the
+// invoice discount, so both add up to the same totals.
+var (
+	invoiceReportMetrics = map[string]string{
+		"amount": "COALESCE(SUM(i.amount), 0)",
+		"vat":    "COALESCE(SUM(i.vat), 0)",
+		"total":  "COALESCE(SUM(i.amount + i.vat), 0)",
+		"count":  "COUNT(*)",
+	}
+	invoiceReportItemMetrics = map[string]string{
+		"amount": "COALESCE(SUM(ii.amount), 0)",
+		"vat":    "COALESCE(SUM(ii.vat), 0)",
+		"total":  "COALESCE(SUM(ii.amount + ii.vat), 0)",
+		"count":  "COUNT(DISTINCT i.id)",
+	}
+)
+
+// InvoiceReportParams describes a report of the invoices issued in a period.
+type InvoiceReportParams struct {
+	OrganisationID int64
+	CompanyID      int64
+	Start          *time.Time
+	End            *time.Time
+	GroupBy        []string
+	Metrics        []string
+}
+
+// InvoiceReport holds a row per group with the values of the dimensions and the
+// metrics by their names, and the metrics over all invoices of the report.
+type InvoiceReport struct {
+	Rows   []map[string]interface{} `json:"rows"`
+	Totals map[string]interface{}   `json:"totals"`
+}
+
+func ValidateInvoiceReportParams(v *validator.Validator, params InvoiceReportParams) {
+	v.Check(len(params.GroupBy) > 0, "group_by", "must be provided")
+	v.Check(len(params.GroupBy) <= 3, "group_by", "must not contain more than 3 dimensions")
+	v.Check(validator.Unique(params.GroupBy), "group_by", "must not contain duplicate values")
+	for _, dimension := range params.GroupBy {
+		v.Check(validator.In(dimension, InvoiceReportDimensions...), "group_by", "must be company, month, project or product")
+	}
+
+	v.Check(len(params.Metrics) > 0, "metrics", "must be provided")
+	v.Check(validator.Unique(params.Metrics), "metrics", "must not contain duplicate values")
+	for _, metric := range params.Metrics {
+		v.Check(validator.In(metric, InvoiceReportMetrics...), "metrics", "must be amount, vat, total or count")
+	}
+}
+
+// Invoices groups the invoices of the report by the dimensions and sums up the metrics.
+// Only the names validated by ValidateInvoiceReportParams() are compiled to SQL. Like
+// the other reports it leaves out advance and deleted invoices; archived invoices are
+// included.
+func (m ReportModel) Invoices(ctx context.Context, params InvoiceReportParams) (*InvoiceReport, error) {
+	f := filter{}
+	f.where("i.is_advance = false")
+	f.where("i.destroyed_at IS NULL")
+
+	if params.OrganisationID > 0 {
+		f.where("i.organisation_id = " + f.arg(params.OrganisationID))
+	}
+
+	if params.CompanyID > 0 {
+		f.where("i.company_id = " + f.arg(params.CompanyID))
+	}
+
+	f.dateRange("i.date", params.Start, params.End)
+
+	source := "invoices_history i"
+	metrics := invoiceReportMetrics
+	for _, dimension := range params.GroupBy {
+		if dimension == "product" {
+			source = "invoices_history i JOIN invoice_items_history ii ON ii.invoice_id = i.id"
+			metrics = invoiceReportItemMetrics
+		}
+	}
+
+	from := fmt.Sprintf("FROM %s WHERE %s", source, f.and())
+
+	var values, groups, aggregates []string
+	for _, dimension := range params.GroupBy {
+		values = append(values, invoiceReportDimensions[dimension].value)
+		groups = append(groups, invoiceReportDimensions[dimension].group)
+	}
+	for _, metric := range params.Metrics {
+		aggregates = append(aggregates, metrics[metric])
+	}
+
+	ctx, cancel := queryContext(ctx, 10*time.Second)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		SELECT %s, %s
+		%s
+		GROUP BY %s
+		ORDER BY %s`, strings.Join(values, ", "), strings.Join(aggregates, ", "), from,
+		strings.Join(groups, ", "), strings.Join(groups, ", "))
+
+	rows, err := m.DB.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &InvoiceReport{Rows: []map[string]interface{}{}}
+
+	for rows.Next() {
+		dest := make([]interface{}, len(params.GroupBy))
+		for i := range dest {
+			dest[i] = new(interface{})
+		}
+		dest = append(dest, invoiceReportMetricDest(params.Metrics)...)
+
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+
+		row := map[string]interface{}{}
+		for i, dimension := range params.GroupBy {
+			row[dimension] = *dest[i].(*interface{})
+		}
+		for i, metric := range params.Metrics {
+			row[metric] = invoiceReportMetricValue(dest[len(params.GroupBy)+i])
+		}
+
+		report.Rows = append(report.Rows, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The totals are queried without grouping, the invoices of a product report may
+	// be counted in several groups.
+	dest := invoiceReportMetricDest(params.Metrics)
+
+	err = m.DB.QueryRow(ctx, fmt.Sprintf("SELECT %s %s", strings.Join(aggregates, ", "), from)).Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Totals = map[string]interface{}{}
+	for i, metric := range params.Metrics {
+		report.Totals[metric] = invoiceReportMetricValue(dest[i])
+	}
+
+	return report, nil
+}
+
+// invoiceReportMetricDest returns the values the metrics are scanned into.
+func invoiceReportMetricDest(metrics []string) []interface{} {
+	dest := make([]interface{}, len(metrics))
+	for i, metric := range metrics {
+		if metric == "count" {
+			dest[i] = new(int64)
+		} else {
+			dest[i] = new(Money)
+		}
+	}
+	return dest
+}
+
+// invoiceReportMetricValue returns the value a metric was scanned into.
+func invoiceReportMetricValue(dest interface{}) interface{} {
+	switch dest := dest.(type) {
+	case *int64:
+		return *dest
+	case *Money:
+		return *dest
+	}
+	return dest
+}
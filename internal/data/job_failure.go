@@ -0,0 +1,115 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrUnknownJob is returned when the failure of a job which can't be retried is.
+var ErrUnknownJob = errors.New("unknown job")
+
+// The jobs whose failures can be retried: the document syncs of accounting connectors,
+// the virus scans of attachment files and organisation deletions.
+const (
+	JobAccountingSync       = "accounting_sync"
+	JobAttachmentScan       = "attachment_scan"
+	JobOrganisationDeletion = "organisation_deletion"
+)
+
+var RetryableJobs = []string{JobAccountingSync, JobAttachmentScan, JobOrganisationDeletion}
+
+// JobFailure is a record a background job has given up on. Subject describes the
+// record, e.g. the document of a sync.
+type JobFailure struct {
+	Job       string     `json:"job" db:"job"`
+	ID        int64      `json:"id" db:"id"`
+	Subject   string     `json:"subject" db:"subject"`
+	Error     *string    `json:"error,omitempty" db:"error"`
+	CreatedAt *time.Time `json:"created_at,omitempty" db:"created_at"`
+}
+
+// Define a JobFailureModel struct type which wraps a pgx.Conn connection pool.
+type JobFailureModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetAll returns up to limit failures of every job, the latest first.
+func (m JobFailureModel) GetAll(limit int) ([]*JobFailure, error) {
+	query := `
+		SELECT 'accounting_sync' AS job, s.id, format('%s %s of connector %s', s.document_type, s.document_id, s.connector_id) AS subject,
+			s.error, s.created_at
+		FROM accounting_syncs s
+		WHERE s.status = 'failed'
+		UNION ALL
+		SELECT 'attachment_scan', f.id, format('file %s', f.sha256), NULL, f.created_at
+		FROM attachment_files f
+		WHERE f.scan_status = 'failed'
+		UNION ALL
+		SELECT 'organisation_deletion', d.id, format('organisation %s', d.organisation_id), d.error, d.created_at
+		FROM organisation_deletions d
+		WHERE d.status = 'failed'
+		ORDER BY created_at DESC, id DESC
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[JobFailure])
+}
+
+// Retry hands the failed record of the job back to it, it's picked up by the next run:
+// a sync is pending again with all its attempts, a file is scanned again and a deletion
+// continues where it stopped. ErrRecordNotFound is returned if the record hasn't
+// failed, ErrDeletionRunning if the organisation is being deleted again meanwhile.
+func (m JobFailureModel) Retry(job string, id int64) error {
+	var query string
+
+	switch job {
+	case JobAccountingSync:
+		query = `
+			UPDATE accounting_syncs
+			SET status = 'pending', attempts = 0, error = NULL, next_attempt_at = NOW()
+			WHERE id = $1 AND status = 'failed'`
+	case JobAttachmentScan:
+		query = `
+			UPDATE attachment_files
+			SET scan_status = 'pending', scan_attempts = 0, scan_signature = NULL, scanned_at = NULL
+			WHERE id = $1 AND scan_status = 'failed'`
+	case JobOrganisationDeletion:
+		query = `
+			UPDATE organisation_deletions
+			SET status = 'pending', error = NULL, finished_at = NULL, updated_at = NOW()
+			WHERE id = $1 AND status = 'failed'`
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownJob, job)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrDeletionRunning
+		}
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
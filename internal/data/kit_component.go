@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// KitComponent is a product contained in a kit, Quantity times per kit.
+type KitComponent struct {
+	ID        int64    `json:"id"`
+	KitID     int64    `json:"kit_id"`
+	ProductID int64    `json:"product_id"`
+	Product   *Product `json:"product,omitempty"`
+	Quantity  float64  `json:"quantity"`
+	Position  int      `json:"position"`
+}
+
+func ValidateKitComponents(v *validator.Validator, kitID int64, components []*KitComponent) {
+	productIDs := make([]int64, 0, len(components))
+
+	for _, component := range components {
+		v.Check(component.ProductID != 0, "components", "must all have a product_id")
+		v.Check(component.ProductID != kitID, "components", "must not contain the kit itself")
+		v.Check(component.Quantity > 0, "components", "must all have a positive quantity")
+		productIDs = append(productIDs, component.ProductID)
+	}
+
+	v.Check(validator.Unique(productIDs), "components", "must not contain a product twice")
+}
+
+// ExpandKit returns the lines a kit line of an invoice is replaced with, one per
+// component: the quantity of the kit times that of the component, at the price, unit
+// and VAT rate of the component product. Components without a VAT rate get the rate of
+// the kit line. The percent discount and the VAT mode of the kit line are kept, the
+// lines take consecutive positions from that of the kit line.
+func ExpandKit(item *InvoiceItem, components []*KitComponent) []*InvoiceItem {
+	lines := make([]*InvoiceItem, 0, len(components))
+
+	for i, component := range components {
+		line := &InvoiceItem{
+			InvoiceID:    item.InvoiceID,
+			Position:     item.Position + i,
+			ProductID:    component.ProductID,
+			Description:  component.Product.Name,
+			Quantity:     math.Round(item.Quantity*component.Quantity*1000) / 1000,
+			Price:        component.Product.Price,
+			DiscountType: item.DiscountType,
+			DiscountRate: item.DiscountRate,
+			VatRateID:    item.VatRateID,
+			VatMode:      item.VatMode,
+		}
+
+		if component.Product.UnitID != nil {
+			line.UnitID = *component.Product.UnitID
+		}
+
+		if component.Product.VatRateID != nil {
+			line.VatRateID = *component.Product.VatRateID
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// Define a KitComponentModel struct type which wraps a pgx.Conn connection pool.
+type KitComponentModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetAll returns the components of the kit with their products, in their order.
+// Deleted products are left out.
+func (m KitComponentModel) GetAll(kitID int64) ([]*KitComponent, error) {
+	components, err := m.getAll([]int64{kitID})
+	if err != nil {
+		return nil, err
+	}
+
+	if components[kitID] == nil {
+		return []*KitComponent{}, nil
+	}
+
+	return components[kitID], nil
+}
+
+// GetForKits returns the components of those of the products which are kits, by kit.
+// Products which aren't kits, or kits without components, aren't in the map.
+func (m KitComponentModel) GetForKits(productIDs []int64) (map[int64][]*KitComponent, error) {
+	if len(productIDs) == 0 {
+		return map[int64][]*KitComponent{}, nil
+	}
+
+	return m.getAll(productIDs)
+}
+
+func (m KitComponentModel) getAll(kitIDs []int64) (map[int64][]*KitComponent, error) {
+	query := `
+		SELECT kc.id, kc.kit_id, kc.product_id, kc.quantity, kc.position,
+			p.name, COALESCE(p.description, ''), COALESCE(p.sku, ''), COALESCE(p.price, 0), p.vat_rate_id, p.unit_id
+		FROM kit_components kc
+		INNER JOIN products kit ON kit.id = kc.kit_id
+		INNER JOIN products p ON p.id = kc.product_id
+		WHERE kc.kit_id = ANY($1) AND kit.product_type = $2
+			AND kit.destroyed_at IS NULL AND p.destroyed_at IS NULL
+		ORDER BY kc.kit_id, kc.position, kc.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, kitIDs, ProductTypeKit)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*KitComponent, error) {
+		component := KitComponent{Product: &Product{}}
+		err := row.Scan(
+			&component.ID,
+			&component.KitID,
+			&component.ProductID,
+			&component.Quantity,
+			&component.Position,
+			&component.Product.Name,
+			&component.Product.Description,
+			&component.Product.SKU,
+			&component.Product.Price,
+			&component.Product.VatRateID,
+			&component.Product.UnitID,
+		)
+		component.Product.ID = component.ProductID
+		return &component, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	components := map[int64][]*KitComponent{}
+	for _, component := range list {
+		components[component.KitID] = append(components[component.KitID], component)
+	}
+
+	return components, nil
+}
+
+// Replace replaces the components of the kit, which are numbered in the given order.
+func (m KitComponentModel) Replace(kitID int64, components []*KitComponent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "DELETE FROM kit_components WHERE kit_id = $1", kitID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO kit_components (kit_id, product_id, quantity, position)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`
+
+	for i, component := range components {
+		component.KitID = kitID
+		component.Position = i + 1
+
+		err = tx.QueryRow(ctx, query, kitID, component.ProductID, component.Quantity, component.Position).Scan(&component.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Lock is a session-level advisory lock, held on a connection of its own. PostgreSQL
+// releases it when the connection is lost, so a crashed instance can't keep it.
+type Lock struct {
+	name string
+	conn *pgxpool.Conn
+}
+
+// Define a LockModel struct type which wraps a pgx.Conn connection pool.
+type LockModel struct {
+	DB *pgxpool.Pool
+}
+
+// TryLock takes the advisory lock with the name without waiting for it. It returns nil
+// if another session holds the lock. The name is hashed to the key of the lock, so
+// only locks taken by name should be used in this database.
+func (m LockModel) TryLock(ctx context.Context, name string) (*Lock, error) {
+	conn, err := m.DB.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+
+	err = conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&locked)
+	if err != nil || !locked {
+		conn.Release()
+		return nil, err
+	}
+
+	return &Lock{name: name, conn: conn}, nil
+}
+
+// Held reports whether the lock is still held, which is the case as long as its
+// connection is alive.
+func (l *Lock) Held() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return l.conn.Ping(ctx) == nil
+}
+
+// Unlock releases the lock and returns its connection to the pool. A connection which
+// can't release the lock is closed, which releases it as well.
+func (l *Lock) Unlock() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := l.conn.Exec(ctx, "SELECT pg_advisory_unlock(hashtext($1))", l.name)
+	if err != nil {
+		l.conn.Conn().Close(ctx)
+	}
+
+	l.conn.Release()
+
+	return err
+}
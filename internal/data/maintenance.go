@@ -0,0 +1,375 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Names of the consistency checks.
+const (
+	CheckInvoiceTotals    = "invoice_totals"
+	CheckMissingProduct   = "missing_product"
+	CheckAgreementCompany = "agreement_company"
+)
+
+// Inconsistency is a record which breaks a rule the application relies on, usually
+// after data has been imported directly into the database. Fixable inconsistencies
+// are repaired by Fix(), the others have to be corrected by hand.
+type Inconsistency struct {
+	Check    string `json:"check"`
+	Entity   string `json:"entity"`
+	EntityID int64  `json:"entity_id"`
+	Message  string `json:"message"`
+	Fixable  bool   `json:"fixable"`
+}
+
+// Define a MaintenanceModel struct type which wraps a pgx.Conn connection pool.
+type MaintenanceModel struct {
+	DB *pgxpool.Pool
+}
+
+// Invoices whose totals differ from the sums of their items.
+const invoiceTotalsMismatchQuery = `
+	SELECT i.id, COALESCE(i.amount, 0), COALESCE(i.vat, 0), COALESCE(t.amount, 0), COALESCE(t.vat, 0)
+	FROM invoices i
+	LEFT JOIN (
+		SELECT invoice_id, SUM(amount) AS amount, SUM(vat) AS vat
+		FROM invoice_items GROUP BY invoice_id
+	) t ON t.invoice_id = i.id
+	WHERE i.destroyed_at IS NULL
+	AND (COALESCE(i.amount, 0) <> COALESCE(t.amount, 0) OR COALESCE(i.vat, 0) <> COALESCE(t.vat, 0))`
+
+// Invoices referencing an agreement of another company.
+const agreementCompanyMismatchQuery = `
+	SELECT i.id, i.company_id, a.id, a.company_id
+	FROM invoices i
+	JOIN agreements a ON a.id = i.agreement_id
+	WHERE i.destroyed_at IS NULL AND a.company_id IS DISTINCT FROM i.company_id`
+
+// Check runs all consistency checks and returns the records which fail them.
+func (m MaintenanceModel) Check() ([]*Inconsistency, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	inconsistencies := []*Inconsistency{}
+
+	rows, err := m.DB.Query(ctx, invoiceTotalsMismatchQuery+" ORDER BY i.id")
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id int64
+		var amount, vat, itemsAmount, itemsVat Money
+
+		err := rows.Scan(&id, &amount, &vat, &itemsAmount, &itemsVat)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		inconsistencies = append(inconsistencies, &Inconsistency{
+			Check:    CheckInvoiceTotals,
+			Entity:   "invoice",
+			EntityID: id,
+			Message: fmt.Sprintf("amount %s and vat %s, but the items sum up to %s and %s",
+				amount, vat, itemsAmount, itemsVat),
+			Fixable: true,
+		})
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Products can't be deleted while they are referenced, but they can be destroyed
+	// (hidden) or the reference may be missing altogether.
+	query := `
+		SELECT ii.id, ii.invoice_id, COALESCE(ii.product_id, 0)
+		FROM invoice_items ii
+		JOIN invoices i ON i.id = ii.invoice_id
+		LEFT JOIN products p ON p.id = ii.product_id
+		WHERE i.destroyed_at IS NULL AND (p.id IS NULL OR p.destroyed_at IS NOT NULL)
+		ORDER BY ii.id`
+
+	rows, err = m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id, invoiceID, productID int64
+
+		err := rows.Scan(&id, &invoiceID, &productID)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		message := fmt.Sprintf("item of invoice %d has no product", invoiceID)
+		if productID > 0 {
+			message = fmt.Sprintf("item of invoice %d references deleted product %d", invoiceID, productID)
+		}
+
+		inconsistencies = append(inconsistencies, &Inconsistency{
+			Check:    CheckMissingProduct,
+			Entity:   "invoice_item",
+			EntityID: id,
+			Message:  message,
+		})
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.Query(ctx, agreementCompanyMismatchQuery+" ORDER BY i.id")
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id, agreementID int64
+		var companyID, agreementCompanyID *int64
+
+		err := rows.Scan(&id, &companyID, &agreementID, &agreementCompanyID)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		inconsistencies = append(inconsistencies, &Inconsistency{
+			Check:    CheckAgreementCompany,
+			Entity:   "invoice",
+			EntityID: id,
+			Message: fmt.Sprintf("agreement %d belongs to company %s, the invoice to company %s",
+				agreementID, formatID(agreementCompanyID), formatID(companyID)),
+			Fixable: true,
+		})
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return inconsistencies, nil
+}
+
+// Fix repairs the fixable inconsistencies in a single transaction: invoice totals are
+// recalculated from the items and agreements of other companies are removed from the
+// invoices. It returns the number of fixed records per check.
+func (m MaintenanceModel) Fix() (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	fixed := map[string]int64{}
+
+	query := fmt.Sprintf(`
+		UPDATE invoices SET amount = m.items_amount, vat = m.items_vat, updated_at = NOW()
+		FROM (%s) AS m (id, amount, vat, items_amount, items_vat)
+		WHERE invoices.id = m.id`, invoiceTotalsMismatchQuery)
+
+	tag, err := tx.Exec(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	fixed[CheckInvoiceTotals] = tag.RowsAffected()
+
+	query = fmt.Sprintf(`
+		UPDATE invoices SET agreement_id = NULL, updated_at = NOW()
+		FROM (%s) AS m (id, company_id, agreement_id, agreement_company_id)
+		WHERE invoices.id = m.id`, agreementCompanyMismatchQuery)
+
+	tag, err = tx.Exec(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	fixed[CheckAgreementCompany] = tag.RowsAffected()
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return fixed, nil
+}
+
+// RecalculateFilters selects the invoices whose totals are recalculated. VatRateID
+// selects the invoices having at least one item with that VAT rate.
+type RecalculateFilters struct {
+	OrganisationID int64
+	CompanyID      int64
+	VatRateID      int64
+	Start          *time.Time
+	End            *time.Time
+	BatchSize      int
+}
+
+func ValidateRecalculateFilters(v *validator.Validator, filters RecalculateFilters) {
+	v.Check(filters.BatchSize > 0, "batch_size", "must be greater than zero")
+	v.Check(filters.BatchSize <= 5000, "batch_size", "must be a maximum of 5000")
+	v.Check((filters.Start == nil) == (filters.End == nil), "start", "must be given together with end")
+	if filters.Start != nil && filters.End != nil {
+		v.Check(!filters.End.Before(*filters.Start), "end", "must not be before start")
+	}
+}
+
+// RecalculateTotals recomputes the amount, discount and VAT of the invoices from their
+// items. Invoices are processed in batches of BatchSize, each batch in a statement of
+// its own, so a large recalculation doesn't lock all invoices at once. It returns the
+// number of checked invoices and the number of invoices which have been changed.
+func (m MaintenanceModel) RecalculateTotals(filters RecalculateFilters) (int64, int64, error) {
+	f := filter{}
+
+	if filters.OrganisationID > 0 {
+		f.where("organisation_id = " + f.arg(filters.OrganisationID))
+	}
+
+	if filters.CompanyID > 0 {
+		f.where("company_id = " + f.arg(filters.CompanyID))
+	}
+
+	if filters.VatRateID > 0 {
+		f.where("id IN (SELECT invoice_id FROM invoice_items WHERE vat_rate_id = " + f.arg(filters.VatRateID) + ")")
+	}
+
+	f.dateRange("date", filters.Start, filters.End)
+	f.where("destroyed_at IS NULL")
+
+	// Batches are taken by keyset pagination on the id, which stays correct while the
+	// previous batches are being updated. The last id of the previous batch and the
+	// batch size follow the arguments of the filter.
+	selectQuery := fmt.Sprintf(`
+		SELECT id FROM invoices
+		WHERE %s AND id > $%d
+		ORDER BY id
+		LIMIT $%d`, f.and(), len(f.args)+1, len(f.args)+2)
+
+	updateQuery := `
+		UPDATE invoices SET amount = t.amount, discount = t.discount, vat = t.vat, updated_at = NOW()
+		FROM (
+			SELECT i.id,
+				COALESCE(SUM(ii.amount), 0) AS amount,
+				COALESCE(SUM(ii.discount + ii.invoice_discount), 0) AS discount,
+				COALESCE(SUM(ii.vat), 0) AS vat
+			FROM invoices i
+			LEFT JOIN invoice_items ii ON ii.invoice_id = i.id
+			WHERE i.id = ANY($1)
+			GROUP BY i.id
+		) t
+		WHERE invoices.id = t.id
+		AND (COALESCE(invoices.amount, 0), COALESCE(invoices.discount, 0), COALESCE(invoices.vat, 0))
+			IS DISTINCT FROM (t.amount, t.discount, t.vat)`
+
+	var checked, updated int64
+	var lastID int64
+
+	for {
+		ids, err := m.recalculateBatch(selectQuery, updateQuery, f.args, lastID, filters.BatchSize, &updated)
+		if err != nil {
+			return checked, updated, err
+		}
+
+		checked += int64(len(ids))
+
+		if len(ids) < filters.BatchSize {
+			break
+		}
+
+		lastID = ids[len(ids)-1]
+	}
+
+	return checked, updated, nil
+}
+
+func (m MaintenanceModel) recalculateBatch(selectQuery, updateQuery string, args []interface{}, lastID int64, batchSize int, updated *int64) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, selectQuery, append(args[:len(args):len(args)], lastID, batchSize)...)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	tag, err := m.DB.Exec(ctx, updateQuery, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	*updated += tag.RowsAffected()
+
+	return ids, nil
+}
+
+func formatID(id *int64) string {
+	if id == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%d", *id)
+}
+
+// SchemaVersion returns the version of the last migration applied by migrate and
+// whether it failed half-way. Version is 0 if no migration has been applied.
+func (m MaintenanceModel) SchemaVersion() (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var version int64
+	var dirty bool
+
+	err = m.DB.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
@@ -3,7 +3,8 @@ package data
 import (
 	"errors"
 
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/ElOtro/stockup-api/internal/encryption"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -15,37 +16,118 @@ var (
 
 // Create a Models struct which wraps all models.
 type Models struct {
-	Users         UserModel
-	Organisations OrganisationModel
-	BankAccounts  BankAccountModel
-	Companies     CompanyModel
-	Contacts      ContactModel
-	Agreements    AgreementModel
-	Projects      ProjectModel
-	Products      ProductModel
-	Units         UnitModel
-	VatRates      VatRateModel
-	Invoices      InvoiceModel
-	InvoiceItems  InvoiceItemModel
-	Helper        Helper
+	Users                 UserModel
+	UserPreferences       UserPreferencesModel
+	Organisations         OrganisationModel
+	Taxation              TaxationModel
+	Requisites            OrganisationRequisitesModel
+	BankAccounts          BankAccountModel
+	Companies             CompanyModel
+	CompanyGroups         CompanyGroupModel
+	Contacts              ContactModel
+	CompanyBranches       CompanyBranchModel
+	Agreements            AgreementModel
+	Projects              ProjectModel
+	Products              ProductModel
+	Returns               ReturnModel
+	KitComponents         KitComponentModel
+	Units                 UnitModel
+	VatRates              VatRateModel
+	Invoices              InvoiceModel
+	InvoiceItems          InvoiceItemModel
+	Payments              PaymentModel
+	Permissions           PermissionModel
+	AuditEvents           AuditEventModel
+	Communications        CommunicationModel
+	Reports               ReportModel
+	DescriptionSnippets   DescriptionSnippetModel
+	DocumentSequences     DocumentSequenceModel
+	Maintenance           MaintenanceModel
+	Changes               ChangeModel
+	Locks                 LockModel
+	SendBatches           SendBatchModel
+	ClosedPeriods         ClosedPeriodModel
+	Backups               BackupModel
+	Imports               ImportModel
+	AccountingConnectors  AccountingConnectorModel
+	AccountingSyncs       AccountingSyncModel
+	IntegrationTokens     IntegrationTokenModel
+	Integrations          IntegrationModel
+	SMSSettings           SMSSettingsModel
+	PaymentReminderRules  PaymentReminderRuleModel
+	Attachments           AttachmentModel
+	GeneratedDocuments    GeneratedDocumentModel
+	Penalties             PenaltyModel
+	InvoiceLinks          InvoiceLinkModel
+	OrganisationDeletions OrganisationDeletionModel
+	DuplicateReports      DuplicateReportModel
+	BillingPlans          BillingPlanModel
+	FeatureFlags          FeatureFlagModel
+	TotalsMismatches      TotalsMismatchModel
+	Acts                  ActModel
+	Warehouses            WarehouseModel
+	Stock                 StockModel
+	JobFailures           JobFailureModel
+	Helper                Helper
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
-// the initialized InvoiceModel.
-func NewModels(db *pgxpool.Pool) Models {
+// the initialized InvoiceModel. The keyring encrypts sensitive fields, it may be nil
+// in which case they are stored as plain text.
+func NewModels(db *pgxpool.Pool, keyring *encryption.Keyring) Models {
 	return Models{
-		Users:         UserModel{DB: db},
-		Organisations: OrganisationModel{DB: db},
-		BankAccounts:  BankAccountModel{DB: db},
-		Companies:     CompanyModel{DB: db},
-		Contacts:      ContactModel{DB: db},
-		Agreements:    AgreementModel{DB: db},
-		Projects:      ProjectModel{DB: db},
-		Products:      ProductModel{DB: db},
-		Units:         UnitModel{DB: db},
-		VatRates:      VatRateModel{DB: db},
-		Invoices:      InvoiceModel{DB: db},
-		InvoiceItems:  InvoiceItemModel{DB: db},
-		Helper:        Helper{DB: db},
+		Users:                 UserModel{DB: db},
+		UserPreferences:       UserPreferencesModel{DB: db},
+		Organisations:         OrganisationModel{DB: db},
+		Taxation:              TaxationModel{DB: db},
+		Requisites:            OrganisationRequisitesModel{DB: db},
+		BankAccounts:          BankAccountModel{DB: db, Keyring: keyring},
+		Companies:             CompanyModel{DB: db},
+		CompanyGroups:         CompanyGroupModel{DB: db},
+		Contacts:              ContactModel{DB: db, Keyring: keyring},
+		CompanyBranches:       CompanyBranchModel{DB: db},
+		Agreements:            AgreementModel{DB: db},
+		Projects:              ProjectModel{DB: db},
+		Products:              ProductModel{DB: db},
+		Returns:               ReturnModel{DB: db},
+		KitComponents:         KitComponentModel{DB: db},
+		Units:                 UnitModel{DB: db},
+		VatRates:              VatRateModel{DB: db},
+		Invoices:              InvoiceModel{DB: db},
+		InvoiceItems:          InvoiceItemModel{DB: db},
+		Payments:              PaymentModel{DB: db},
+		Permissions:           PermissionModel{DB: db},
+		AuditEvents:           AuditEventModel{DB: db},
+		Communications:        CommunicationModel{DB: db},
+		Reports:               ReportModel{DB: db},
+		DescriptionSnippets:   DescriptionSnippetModel{DB: db},
+		DocumentSequences:     DocumentSequenceModel{DB: db},
+		Maintenance:           MaintenanceModel{DB: db},
+		Changes:               ChangeModel{DB: db},
+		Locks:                 LockModel{DB: db},
+		SendBatches:           SendBatchModel{DB: db},
+		ClosedPeriods:         ClosedPeriodModel{DB: db},
+		Backups:               BackupModel{DB: db},
+		Imports:               ImportModel{DB: db},
+		AccountingConnectors:  AccountingConnectorModel{DB: db, Keyring: keyring},
+		AccountingSyncs:       AccountingSyncModel{DB: db},
+		IntegrationTokens:     IntegrationTokenModel{DB: db},
+		Integrations:          IntegrationModel{DB: db},
+		SMSSettings:           SMSSettingsModel{DB: db, Keyring: keyring},
+		PaymentReminderRules:  PaymentReminderRuleModel{DB: db},
+		Attachments:           AttachmentModel{DB: db},
+		GeneratedDocuments:    GeneratedDocumentModel{DB: db},
+		Penalties:             PenaltyModel{DB: db},
+		InvoiceLinks:          InvoiceLinkModel{DB: db},
+		OrganisationDeletions: OrganisationDeletionModel{DB: db},
+		DuplicateReports:      DuplicateReportModel{DB: db},
+		BillingPlans:          BillingPlanModel{DB: db},
+		FeatureFlags:          FeatureFlagModel{DB: db},
+		TotalsMismatches:      TotalsMismatchModel{DB: db},
+		Acts:                  ActModel{DB: db},
+		Warehouses:            WarehouseModel{DB: db},
+		Stock:                 StockModel{DB: db},
+		JobFailures:           JobFailureModel{DB: db},
+		Helper:                Helper{DB: db},
 	}
 }
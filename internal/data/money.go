@@ -0,0 +1,176 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Money is an exact decimal with two places, stored as a whole number of kopecks. All
+// money columns are numeric(15,2), so every stored value fits without rounding. It is
+// encoded in JSON as a number (12.30) and accepts a number or a string.
+type Money int64
+
+var ErrInvalidMoney = errors.New("must be a decimal value with at most two decimal places")
+
+// NewMoney converts a float, e.g. a generated price, rounding halves away from zero.
+func NewMoney(value float64) Money {
+	return Money(math.Round(value * 100))
+}
+
+// ParseMoney parses a decimal like "-1234.5". More than two decimal places, exponents
+// and anything but digits, a sign and a point are rejected rather than rounded.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+
+	whole, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+	}
+
+	if whole == "" && fraction == "" || len(fraction) > 2 {
+		return 0, ErrInvalidMoney
+	}
+
+	for _, c := range whole + fraction {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidMoney
+		}
+	}
+
+	fraction += strings.Repeat("0", 2-len(fraction))
+
+	kopecks, err := strconv.ParseInt("0"+whole+fraction, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidMoney
+	}
+
+	if negative {
+		kopecks = -kopecks
+	}
+
+	return Money(kopecks), nil
+}
+
+// Float64 returns the value in roubles. It is only meant for generated data, amounts
+// are never calculated in floats.
+func (m Money) Float64() float64 {
+	return float64(m) / 100
+}
+
+// String formats the value with exactly two decimal places.
+func (m Money) String() string {
+	sign := ""
+	kopecks := int64(m)
+	if kopecks < 0 {
+		sign = "-"
+		kopecks = -kopecks
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, kopecks/100, kopecks%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+
+	value, err := ParseMoney(strings.Trim(s, `"`))
+	if err != nil {
+		return err
+	}
+
+	*m = value
+	return nil
+}
+
+// NumericValue passes the value to PostgreSQL as an exact decimal, so it is never
+// converted to a float on its way to a numeric column.
+func (m Money) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(m)), Exp: -2, Valid: true}, nil
+}
+
+// ScanInt64 reads integer results, e.g. a literal 0, as whole roubles. Without it pgx
+// would scan them into the underlying int64 as kopecks.
+func (m *Money) ScanInt64(n pgtype.Int8) error {
+	if !n.Valid {
+		*m = 0
+		return nil
+	}
+
+	*m = Money(n.Int64 * 100)
+	return nil
+}
+
+// ScanNumeric reads numeric columns. A value with more than two decimal places, e.g.
+// the result of a division, is rounded half away from zero. NULL is read as zero.
+func (m *Money) ScanNumeric(n pgtype.Numeric) error {
+	if !n.Valid {
+		*m = 0
+		return nil
+	}
+
+	if n.NaN || n.InfinityModifier != pgtype.Finite {
+		return ErrInvalidMoney
+	}
+
+	if n.Int == nil {
+		*m = 0
+		return nil
+	}
+
+	kopecks := new(big.Int).Set(n.Int)
+	exp := int64(n.Exp) + 2
+
+	if exp >= 0 {
+		kopecks.Mul(kopecks, new(big.Int).Exp(big.NewInt(10), big.NewInt(exp), nil))
+	} else {
+		kopecks = roundQuo(kopecks, new(big.Int).Exp(big.NewInt(10), big.NewInt(-exp), nil), RoundingHalfUp)
+	}
+
+	if !kopecks.IsInt64() {
+		return ErrInvalidMoney
+	}
+
+	*m = Money(kopecks.Int64())
+	return nil
+}
+
+// mulDiv returns value × num / den rounded to kopecks in the given mode. The product is
+// calculated without overflow.
+func (m Money) mulDiv(num, den int64, mode string) Money {
+	product := new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(num))
+	return Money(roundQuo(product, big.NewInt(den), mode).Int64())
+}
+
+// roundQuo divides x by the positive y and rounds the quotient in the given mode.
+func roundQuo(x, y *big.Int, mode string) *big.Int {
+	q, r := new(big.Int).QuoRem(x, y, new(big.Int))
+	if r.Sign() == 0 || mode == RoundingDown {
+		return q
+	}
+
+	// Compare the remainder to half of the divisor.
+	half := new(big.Int).Abs(r)
+	half.Mul(half, big.NewInt(2))
+	cmp := half.Cmp(y)
+
+	if cmp > 0 || cmp == 0 && (mode != RoundingHalfEven || q.Bit(0) == 1) {
+		q.Add(q, big.NewInt(int64(x.Sign())))
+	}
+
+	return q
+}
@@ -0,0 +1,82 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Money
+		wantErr bool
+	}{
+		{input: "0", want: 0},
+		{input: "12", want: 1200},
+		{input: "12.3", want: 1230},
+		{input: "12.30", want: 1230},
+		{input: " 1234.56 ", want: 123456},
+		{input: ".5", want: 50},
+		{input: "5.", want: 500},
+		{input: "+7.01", want: 701},
+		{input: "-0.01", want: -1},
+		{input: "-1234.5", want: -123450},
+		{input: "92233720368547758.07", want: 9223372036854775807},
+		{input: "-92233720368547758.07", want: -9223372036854775807},
+		{input: "92233720368547758.08", wantErr: true},
+		{input: "100000000000000000000", wantErr: true},
+		{input: "1.234", wantErr: true},
+		{input: "1.005", wantErr: true},
+		{input: "1e3", wantErr: true},
+		{input: "1,50", wantErr: true},
+		{input: "--1", wantErr: true},
+		{input: "-", wantErr: true},
+		{input: ".", wantErr: true},
+		{input: "", wantErr: true},
+		{input: "abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseMoney(tt.input)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidMoney) {
+					t.Errorf("got %d, %v, want %v", got, err, ErrInvalidMoney)
+				}
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("got %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Money
+		out   string
+	}{
+		{input: `12.3`, want: 1230, out: `12.30`},
+		{input: `"12.3"`, want: 1230, out: `12.30`},
+		{input: `-0.05`, want: -5, out: `-0.05`},
+		{input: `0`, want: 0, out: `0.00`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var m Money
+			if err := json.Unmarshal([]byte(tt.input), &m); err != nil || m != tt.want {
+				t.Fatalf("got %d, %v, want %d", m, err, tt.want)
+			}
+
+			out, err := json.Marshal(m)
+			if err != nil || string(out) != tt.out {
+				t.Errorf("got %s, %v, want %s", out, err, tt.out)
+			}
+		})
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"time"
+	"unicode/utf8"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // OrganisationDetails type details
@@ -21,28 +22,52 @@ type OrganisationDetails struct {
 
 // Organisation type details
 type Organisation struct {
-	ID                 int64                `json:"id"`
-	Name               string               `json:"name"`
-	FullName           string               `json:"full_name,omitempty"`
-	CEO                string               `json:"ceo,omitempty"`
-	CEOTitle           string               `json:"ceo_title,omitempty"`
-	CFO                string               `json:"cfo,omitempty"`
-	CFOTitle           string               `json:"cfo_title,omitempty"`
-	Stamp              *string              `json:"stamp,omitempty"`
-	CEOSign            *string              `json:"ceo_sign,omitempty"`
-	CFOSign            *string              `json:"cfo_sign,omitempty"`
-	IsVatPayer         bool                 `json:"is_vat_payer,omitempty"`
+	ID             int64   `json:"id"`
+	Name           string  `json:"name"`
+	FullName       string  `json:"full_name,omitempty"`
+	CEO            string  `json:"ceo,omitempty"`
+	CEOTitle       string  `json:"ceo_title,omitempty"`
+	CFO            string  `json:"cfo,omitempty"`
+	CFOTitle       string  `json:"cfo_title,omitempty"`
+	Stamp          *string `json:"stamp,omitempty"`
+	CEOSign        *string `json:"ceo_sign,omitempty"`
+	CFOSign        *string `json:"cfo_sign,omitempty"`
+	IsVatPayer     bool    `json:"is_vat_payer,omitempty"`
+	TaxationSystem string  `json:"taxation_system,omitempty"`
+	VatRounding    string  `json:"vat_rounding,omitempty"`
+	RoundingMode   string  `json:"rounding_mode,omitempty"`
+	// The month the fiscal year starts with, 1 for a calendar year.
+	FiscalYearStart    int                  `json:"fiscal_year_start,omitempty"`
 	Details            *OrganisationDetails `json:"details,omitempty"`
 	DestroyedAt        *time.Time           `json:"destroyed_at,omitempty"`
 	CreatedAt          *time.Time           `json:"created_at,omitempty"`
 	UpdatedAt          *time.Time           `json:"updated_at,omitempty"`
 	DefaultBankAccount *BankAccount         `json:"default_bank_account,omitempty"`
 	BankAccounts       []*BankAccount       `json:"bank_accounts,omitempty"`
+	// Invoices which haven't been sent yet are printed with the watermark, none when
+	// empty, and without the bank requisites if DraftHidesRequisites is set.
+	DraftWatermark       string `json:"draft_watermark"`
+	DraftHidesRequisites bool   `json:"draft_hides_requisites"`
 }
 
+// DefaultDraftWatermark is printed across the invoices of a new organisation until
+// they are sent.
+const DefaultDraftWatermark = "ЧЕРНОВИК"
+
 func ValidateOrganisation(v *validator.Validator, organisation *Organisation) {
 	v.Check(organisation.Name != "", "name", "must be provided")
 	v.Check(organisation.FullName != "", "full_name", "must be provided")
+
+	ValidateRoundingPolicy(v, organisation.RoundingPolicy())
+
+	v.Check(organisation.FiscalYearStart >= 1 && organisation.FiscalYearStart <= 12, "fiscal_year_start", "must be a month between 1 and 12")
+	v.Check(utf8.RuneCountInString(organisation.DraftWatermark) <= 50, "draft_watermark", "must not be more than 50 characters long")
+}
+
+// RoundingPolicy returns the rounding rules the totals of the organisation's documents
+// are calculated with.
+func (o *Organisation) RoundingPolicy() RoundingPolicy {
+	return RoundingPolicy{VatRounding: o.VatRounding, Mode: o.RoundingMode}
 }
 
 // Define a OrganisationModel struct type which wraps a pgx.Conn connection pool.
@@ -53,9 +78,12 @@ type OrganisationModel struct {
 func (m OrganisationModel) GetAll() ([]*Organisation, error) {
 	// Construct the SQL query to retrieve all movie records.
 	query := fmt.Sprintf(`
-		SELECT id, name, full_name, ceo, ceo_title, cfo, cfo_title, stamp, ceo_sign, cfo_sign, is_vat_payer, 
-		details, created_at, updated_at 
-		FROM organisations`)
+		SELECT id, name, full_name, ceo, ceo_title, cfo, cfo_title, stamp, ceo_sign, cfo_sign,
+		organisation_taxation_system(id, CURRENT_DATE) = 'osno', organisation_taxation_system(id, CURRENT_DATE),
+		vat_rounding, rounding_mode, fiscal_year_start, draft_watermark, draft_hides_requisites, details,
+		created_at, updated_at 
+		FROM organisations
+		WHERE destroyed_at IS NULL`)
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -93,6 +121,12 @@ func (m OrganisationModel) GetAll() ([]*Organisation, error) {
 			&organisation.CEOSign,
 			&organisation.CFOSign,
 			&organisation.IsVatPayer,
+			&organisation.TaxationSystem,
+			&organisation.VatRounding,
+			&organisation.RoundingMode,
+			&organisation.FiscalYearStart,
+			&organisation.DraftWatermark,
+			&organisation.DraftHidesRequisites,
 			&organisation.Details,
 			&organisation.CreatedAt,
 			&organisation.UpdatedAt,
@@ -120,9 +154,11 @@ func (m OrganisationModel) Insert(organisation *Organisation) error {
 	query := `
 		INSERT INTO organisations (
 			name, full_name, ceo, ceo_title, cfo, cfo_title, stamp, ceo_sign, cfo_sign, is_vat_payer, 
-			details) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			details, vat_rounding, rounding_mode, fiscal_year_start, draft_watermark, draft_hides_requisites)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 		RETURNING id, name, full_name, ceo, ceo_title, cfo, cfo_title, stamp, ceo_sign, cfo_sign, is_vat_payer, 
-		          details, created_at, updated_at`
+		          details, vat_rounding, rounding_mode, fiscal_year_start, draft_watermark, draft_hides_requisites,
+		          created_at, updated_at`
 
 	args := []interface{}{
 		organisation.Name,
@@ -136,6 +172,11 @@ func (m OrganisationModel) Insert(organisation *Organisation) error {
 		organisation.CFOSign,
 		organisation.IsVatPayer,
 		organisation.Details,
+		organisation.VatRounding,
+		organisation.RoundingMode,
+		organisation.FiscalYearStart,
+		organisation.DraftWatermark,
+		organisation.DraftHidesRequisites,
 	}
 
 	// fmt.Println(args)
@@ -144,8 +185,9 @@ func (m OrganisationModel) Insert(organisation *Organisation) error {
 	return m.DB.QueryRow(context.Background(), query, args...).Scan(&organisation.ID, &organisation.Name,
 		&organisation.FullName, &organisation.CEO, &organisation.CEOTitle, &organisation.CFO,
 		&organisation.CFOTitle, &organisation.Stamp, &organisation.CEOSign, &organisation.CFOSign,
-		&organisation.IsVatPayer, &organisation.Details, &organisation.CreatedAt,
-		&organisation.UpdatedAt,
+		&organisation.IsVatPayer, &organisation.Details, &organisation.VatRounding,
+		&organisation.RoundingMode, &organisation.FiscalYearStart, &organisation.DraftWatermark,
+		&organisation.DraftHidesRequisites, &organisation.CreatedAt, &organisation.UpdatedAt,
 	)
 }
 
@@ -161,14 +203,16 @@ func (m OrganisationModel) Get(id int64) (*Organisation, error) {
 
 	// Define the SQL query for retrieving data.
 	query := `
-		SELECT id, name, full_name, ceo, ceo_title, cfo, cfo_title, stamp, ceo_sign, cfo_sign, is_vat_payer, 
-		details, created_at, updated_at, 
+		SELECT id, name, full_name, ceo, ceo_title, cfo, cfo_title, stamp, ceo_sign, cfo_sign,
+		organisation_taxation_system(id, CURRENT_DATE) = 'osno', organisation_taxation_system(id, CURRENT_DATE),
+		vat_rounding, rounding_mode, fiscal_year_start, draft_watermark, draft_hides_requisites, details,
+		created_at, updated_at, 
 		(SELECT row_to_json(oba)
 		 FROM
 		 (SELECT id, name
 		  FROM bank_accounts
 		  WHERE organisation_id = $1 AND bank_accounts.is_default = true) oba) AS default_bank_account 
-		FROM organisations WHERE id = $1`
+		FROM organisations WHERE id = $1 AND destroyed_at IS NULL`
 
 	// Declare a Organisation struct to hold the data returned by the query.
 	var organisation Organisation
@@ -195,6 +239,12 @@ func (m OrganisationModel) Get(id int64) (*Organisation, error) {
 		&organisation.CEOSign,
 		&organisation.CFOSign,
 		&organisation.IsVatPayer,
+		&organisation.TaxationSystem,
+		&organisation.VatRounding,
+		&organisation.RoundingMode,
+		&organisation.FiscalYearStart,
+		&organisation.DraftWatermark,
+		&organisation.DraftHidesRequisites,
 		&organisation.Details,
 		&organisation.CreatedAt,
 		&organisation.UpdatedAt,
@@ -221,8 +271,10 @@ func (m OrganisationModel) Update(organisation *Organisation) error {
 	query := `
 		UPDATE organisations
 		SET name = $1, full_name = $2, ceo = $3, ceo_title = $4, cfo = $5, cfo_title = $6,
-		stamp = $7, ceo_sign = $8, cfo_sign = $9, is_vat_payer = $10, details = $11, updated_at =  NOW() 
-		WHERE id = $12
+		stamp = $7, ceo_sign = $8, cfo_sign = $9, is_vat_payer = $10, details = $11, vat_rounding = $12,
+		rounding_mode = $13, fiscal_year_start = $14, draft_watermark = $15, draft_hides_requisites = $16,
+		updated_at =  NOW() 
+		WHERE id = $17
 		RETURNING updated_at`
 
 	// Create an args slice containing the values for the placeholder parameters.
@@ -238,6 +290,11 @@ func (m OrganisationModel) Update(organisation *Organisation) error {
 		organisation.CFOSign,
 		organisation.IsVatPayer,
 		organisation.Details,
+		organisation.VatRounding,
+		organisation.RoundingMode,
+		organisation.FiscalYearStart,
+		organisation.DraftWatermark,
+		organisation.DraftHidesRequisites,
 		organisation.ID,
 	}
 
@@ -246,39 +303,68 @@ func (m OrganisationModel) Update(organisation *Organisation) error {
 	return m.DB.QueryRow(context.Background(), query, args...).Scan(&organisation.UpdatedAt)
 }
 
-// Add method for deleting a specific record from the organisations table.
-func (m OrganisationModel) Delete(id int64) error {
-	// Return an ErrRecordNotFound error if the movie ID is less than 1.
-	if id < 1 {
-		return ErrRecordNotFound
-	}
-
-	// Construct the SQL query to delete the record.
+// GetAllForUser returns the organisations the user is a member of.
+func (m OrganisationModel) GetAllForUser(userID int64) ([]*Organisation, error) {
 	query := `
-		DELETE FROM organisations WHERE id = $1`
+		SELECT organisations.id, organisations.name, organisations.full_name
+		FROM organisations
+		INNER JOIN users_organisations ON users_organisations.organisation_id = organisations.id
+		WHERE users_organisations.user_id = $1 AND organisations.destroyed_at IS NULL
+		ORDER BY organisations.name`
 
-	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Execute the SQL query using the Exec() method, passing in the id variable as
-	// the value for the placeholder parameter. The Exec() method returns a sql.Result
-	// object.
-	result, err := m.DB.Exec(ctx, query, id)
+	rows, err := m.DB.Query(ctx, query, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
+
+	organisations := []*Organisation{}
+
+	for rows.Next() {
+		var organisation Organisation
 
-	// Call the RowsAffected() method on the sql.Result object to get the number of rows
-	// affected by the query.
-	rowsAffected := result.RowsAffected()
+		err := rows.Scan(&organisation.ID, &organisation.Name, &organisation.FullName)
+		if err != nil {
+			return nil, err
+		}
 
-	// If no rows were affected, we know that the organisations table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+		organisations = append(organisations, &organisation)
 	}
 
-	return nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return organisations, nil
+}
+
+// HasUser reports whether the user is a member of the organisation.
+func (m OrganisationModel) HasUser(organisationID, userID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM users_organisations WHERE organisation_id = $1 AND user_id = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRow(ctx, query, organisationID, userID).Scan(&exists)
+
+	return exists, err
+}
+
+// AddUser makes the user a member of the organisation.
+func (m OrganisationModel) AddUser(organisationID, userID int64) error {
+	query := `
+		INSERT INTO users_organisations (organisation_id, user_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, organisationID, userID)
+	return err
 }
@@ -0,0 +1,328 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrDeletionRunning is returned when the organisation is already being deleted.
+var ErrDeletionRunning = errors.New("the organisation is already being deleted")
+
+// The states of an organisation deletion. A failed deletion can be started again, the
+// records it deleted stay deleted.
+const (
+	DeletionPending = "pending"
+	DeletionRunning = "running"
+	DeletionDone    = "done"
+	DeletionFailed  = "failed"
+)
+
+// DeletionSteps are the tables whose records of the organisation are soft-deleted, in
+// this order. The items of invoices and acts go with their documents.
+var DeletionSteps = []string{"payments", "invoices", "acts", "projects", "bank_accounts", "warehouses"}
+
+// DeletionPreview counts the records deleting the organisation affects. Deleted are
+// soft-deleted by the steps, Revoked stop working and Stopped aren't processed any
+// more. Kept stay as they are, archived invoices are kept for the retention period.
+// Total is the number of records the progress of a deletion counts.
+type DeletionPreview struct {
+	OrganisationID int64          `json:"organisation_id"`
+	Deleted        map[string]int `json:"deleted"`
+	Revoked        map[string]int `json:"revoked"`
+	Stopped        map[string]int `json:"stopped"`
+	Kept           map[string]int `json:"kept"`
+	Total          int            `json:"total"`
+}
+
+// OrganisationDeletion is the deletion of an organisation in the background. Done
+// counts the records of the steps deleted so far out of Total, Step is the table the
+// deletion is at.
+type OrganisationDeletion struct {
+	ID             int64      `json:"id"`
+	OrganisationID int64      `json:"organisation_id"`
+	UserID         *int64     `json:"user_id,omitempty"`
+	Status         string     `json:"status"`
+	Step           *string    `json:"step,omitempty"`
+	Total          int        `json:"total"`
+	Done           int        `json:"done"`
+	Error          *string    `json:"error,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+// Define an OrganisationDeletionModel struct type which wraps a pgx.Conn connection pool.
+type OrganisationDeletionModel struct {
+	DB *pgxpool.Pool
+}
+
+const organisationDeletionColumns = `id, organisation_id, user_id, status, step, total, done, error,
+	started_at, finished_at, created_at, updated_at`
+
+func scanOrganisationDeletion(row pgx.Row) (*OrganisationDeletion, error) {
+	var deletion OrganisationDeletion
+
+	err := row.Scan(
+		&deletion.ID,
+		&deletion.OrganisationID,
+		&deletion.UserID,
+		&deletion.Status,
+		&deletion.Step,
+		&deletion.Total,
+		&deletion.Done,
+		&deletion.Error,
+		&deletion.StartedAt,
+		&deletion.FinishedAt,
+		&deletion.CreatedAt,
+		&deletion.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &deletion, nil
+}
+
+// Preview counts the records of the organisation which deleting it would affect.
+func (m OrganisationDeletionModel) Preview(organisationID int64) (*DeletionPreview, error) {
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM payments WHERE organisation_id = $1 AND destroyed_at IS NULL),
+			(SELECT COUNT(*) FROM invoices WHERE organisation_id = $1 AND destroyed_at IS NULL),
+			(SELECT COUNT(*) FROM acts WHERE organisation_id = $1 AND destroyed_at IS NULL),
+			(SELECT COUNT(*) FROM projects WHERE organisation_id = $1 AND destroyed_at IS NULL),
+			(SELECT COUNT(*) FROM bank_accounts WHERE organisation_id = $1 AND destroyed_at IS NULL),
+			(SELECT COUNT(*) FROM warehouses WHERE organisation_id = $1 AND destroyed_at IS NULL),
+			(SELECT COUNT(*) FROM integration_tokens WHERE organisation_id = $1 AND revoked_at IS NULL),
+			(SELECT COUNT(*) FROM invoice_links
+			 WHERE organisation_id = $1 AND revoked_at IS NULL AND expires_at > NOW()),
+			(SELECT COUNT(*) FROM invoice_sendings s JOIN send_batches b ON b.id = s.send_batch_id
+			 WHERE b.organisation_id = $1 AND s.status = 'pending'),
+			(SELECT COUNT(*) FROM accounting_connectors WHERE organisation_id = $1 AND is_active),
+			(SELECT COUNT(*) FROM invoices_archive WHERE organisation_id = $1),
+			(SELECT COUNT(*) FROM communications WHERE organisation_id = $1),
+			(SELECT COUNT(*) FROM attachments WHERE organisation_id = $1),
+			(SELECT COUNT(*) FROM users_organisations WHERE organisation_id = $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var payments, invoices, acts, projects, bankAccounts, warehouses, tokens, links, sendings, connectors,
+		archived, communications, attachments, members int
+
+	err := m.DB.QueryRow(ctx, query, organisationID).Scan(
+		&payments, &invoices, &acts, &projects, &bankAccounts, &warehouses,
+		&tokens, &links,
+		&sendings, &connectors,
+		&archived, &communications, &attachments, &members,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeletionPreview{
+		OrganisationID: organisationID,
+		Deleted: map[string]int{
+			"payments":      payments,
+			"invoices":      invoices,
+			"acts":          acts,
+			"projects":      projects,
+			"bank_accounts": bankAccounts,
+			"warehouses":    warehouses,
+		},
+		Revoked: map[string]int{
+			"integration_tokens": tokens,
+			"invoice_links":      links,
+		},
+		Stopped: map[string]int{
+			"invoice_sendings":      sendings,
+			"accounting_connectors": connectors,
+		},
+		Kept: map[string]int{
+			"archived_invoices": archived,
+			"communications":    communications,
+			"attachments":       attachments,
+			"members":           members,
+		},
+		Total: payments + invoices + acts + projects + bankAccounts + warehouses,
+	}, nil
+}
+
+// Insert records a pending deletion. ErrDeletionRunning is returned while another
+// deletion of the organisation is pending or running.
+func (m OrganisationDeletionModel) Insert(deletion *OrganisationDeletion) error {
+	query := `
+		INSERT INTO organisation_deletions (organisation_id, user_id, total)
+		VALUES ($1, $2, $3)
+		RETURNING ` + organisationDeletionColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	inserted, err := scanOrganisationDeletion(m.DB.QueryRow(ctx, query, deletion.OrganisationID, deletion.UserID, deletion.Total))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrDeletionRunning
+		}
+		return err
+	}
+
+	*deletion = *inserted
+
+	return nil
+}
+
+// Latest returns the latest deletion of the organisation.
+func (m OrganisationDeletionModel) Latest(organisationID int64) (*OrganisationDeletion, error) {
+	query := `
+		SELECT ` + organisationDeletionColumns + `
+		FROM organisation_deletions
+		WHERE organisation_id = $1
+		ORDER BY id DESC
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanOrganisationDeletion(m.DB.QueryRow(ctx, query, organisationID))
+}
+
+// Next starts the oldest deletion which isn't finished and returns it, or returns
+// ErrRecordNotFound. The caller must hold the deletion lock, so a deletion which is
+// still running was interrupted and is continued.
+func (m OrganisationDeletionModel) Next() (*OrganisationDeletion, error) {
+	query := `
+		UPDATE organisation_deletions
+		SET status = 'running', started_at = COALESCE(started_at, NOW()), updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM organisation_deletions
+			WHERE status IN ('pending', 'running')
+			ORDER BY id
+			LIMIT 1)
+		RETURNING ` + organisationDeletionColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanOrganisationDeletion(m.DB.QueryRow(ctx, query))
+}
+
+// DeleteBatch soft-deletes up to limit records of the organisation in the table of the
+// step and adds them to the progress of the deletion. It returns how many records were
+// deleted, none once the step is done.
+func (m OrganisationDeletionModel) DeleteBatch(deletion *OrganisationDeletion, step string, limit int) (int, error) {
+	var valid bool
+	for _, s := range DeletionSteps {
+		valid = valid || s == step
+	}
+	if !valid {
+		return 0, errors.New("unknown deletion step " + step)
+	}
+
+	// Records added after the deletion was started are deleted as well, the total is
+	// raised so the progress doesn't go beyond it.
+	query := `
+		WITH batch AS (
+			SELECT id FROM ` + step + `
+			WHERE organisation_id = $1 AND destroyed_at IS NULL
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		), deleted AS (
+			UPDATE ` + step + ` SET destroyed_at = NOW()
+			WHERE id IN (SELECT id FROM batch)
+			RETURNING id
+		)
+		UPDATE organisation_deletions
+		SET step = $3, done = done + (SELECT COUNT(*) FROM deleted),
+			total = GREATEST(total, done + (SELECT COUNT(*) FROM deleted)), updated_at = NOW()
+		WHERE id = $4
+		RETURNING (SELECT COUNT(*) FROM deleted), done, total, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var deleted int
+
+	err := m.DB.QueryRow(ctx, query, deletion.OrganisationID, limit, step, deletion.ID).
+		Scan(&deleted, &deletion.Done, &deletion.Total, &deletion.UpdatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	deletion.Step = &step
+
+	return deleted, nil
+}
+
+// Finish deletes the organisation itself once its records are deleted. Its integration
+// tokens and invoice links are revoked, its pending invoice emails are failed and its
+// accounting connectors are deactivated, in one transaction with the deletion.
+func (m OrganisationDeletionModel) Finish(deletion *OrganisationDeletion) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	queries := []string{
+		`UPDATE organisations SET destroyed_at = NOW() WHERE id = $1 AND destroyed_at IS NULL`,
+		`UPDATE integration_tokens SET revoked_at = NOW() WHERE organisation_id = $1 AND revoked_at IS NULL`,
+		`UPDATE invoice_links SET revoked_at = NOW() WHERE organisation_id = $1 AND revoked_at IS NULL`,
+		`UPDATE invoice_sendings SET status = 'failed', error = 'the organisation was deleted'
+		 WHERE status = 'pending' AND send_batch_id IN (SELECT id FROM send_batches WHERE organisation_id = $1)`,
+		`UPDATE accounting_connectors SET is_active = false, updated_at = NOW() WHERE organisation_id = $1 AND is_active`,
+	}
+
+	for _, query := range queries {
+		_, err = tx.Exec(ctx, query, deletion.OrganisationID)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		UPDATE organisation_deletions
+		SET status = 'done', step = NULL, finished_at = NOW(), updated_at = NOW()
+		WHERE id = $1
+		RETURNING status, finished_at, updated_at`
+
+	err = tx.QueryRow(ctx, query, deletion.ID).Scan(&deletion.Status, &deletion.FinishedAt, &deletion.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	deletion.Step = nil
+
+	return tx.Commit(ctx)
+}
+
+// Fail records why the deletion failed.
+func (m OrganisationDeletionModel) Fail(deletion *OrganisationDeletion, message string) error {
+	query := `
+		UPDATE organisation_deletions
+		SET status = 'failed', error = $1, finished_at = NOW(), updated_at = NOW()
+		WHERE id = $2
+		RETURNING status, finished_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	deletion.Error = &message
+
+	return m.DB.QueryRow(ctx, query, message, deletion.ID).Scan(&deletion.Status, &deletion.FinishedAt, &deletion.UpdatedAt)
+}
@@ -0,0 +1,222 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// OrganisationRequisites is a record of the requisites history of an organisation: the
+// names, the signers and the details printed on its documents. It applies from
+// ValidFrom until the next record, a nil ValidFrom means since the beginning.
+type OrganisationRequisites struct {
+	ID             int64                `json:"id" db:"id"`
+	OrganisationID int64                `json:"organisation_id" db:"organisation_id"`
+	ValidFrom      *time.Time           `json:"valid_from" db:"valid_from"`
+	FullName       string               `json:"full_name" db:"full_name"`
+	CEO            string               `json:"ceo" db:"ceo"`
+	CEOTitle       string               `json:"ceo_title" db:"ceo_title"`
+	CFO            string               `json:"cfo" db:"cfo"`
+	CFOTitle       string               `json:"cfo_title" db:"cfo_title"`
+	Details        *OrganisationDetails `json:"details" db:"details"`
+	UserID         *int64               `json:"user_id,omitempty" db:"user_id"`
+	CreatedAt      *time.Time           `json:"created_at,omitempty" db:"created_at"`
+}
+
+func ValidateOrganisationRequisites(v *validator.Validator, requisites *OrganisationRequisites) {
+	v.Check(requisites.ValidFrom != nil, "valid_from", "must be provided")
+	v.Check(requisites.FullName != "", "full_name", "must be provided")
+}
+
+// Requisites returns the requisites the organisation holds now.
+func (o *Organisation) Requisites() *OrganisationRequisites {
+	requisites := &OrganisationRequisites{
+		OrganisationID: o.ID,
+		FullName:       o.FullName,
+		CEO:            o.CEO,
+		CEOTitle:       o.CEOTitle,
+		CFO:            o.CFO,
+		CFOTitle:       o.CFOTitle,
+		Details:        &OrganisationDetails{},
+	}
+
+	if o.Details != nil {
+		details := *o.Details
+		requisites.Details = &details
+	}
+
+	return requisites
+}
+
+// SameAs reports whether the two records hold the same requisites, whatever their
+// dates.
+func (r *OrganisationRequisites) SameAs(other *OrganisationRequisites) bool {
+	details := func(d *OrganisationDetails) OrganisationDetails {
+		if d == nil {
+			return OrganisationDetails{}
+		}
+		return *d
+	}
+
+	return r.FullName == other.FullName && r.CEO == other.CEO && r.CEOTitle == other.CEOTitle &&
+		r.CFO == other.CFO && r.CFOTitle == other.CFOTitle && details(r.Details) == details(other.Details)
+}
+
+// ApplyRequisites replaces the requisites of the organisation, so its documents of
+// another date are printed with the requisites in force then.
+func (o *Organisation) ApplyRequisites(requisites *OrganisationRequisites) {
+	o.FullName = requisites.FullName
+	o.CEO = requisites.CEO
+	o.CEOTitle = requisites.CEOTitle
+	o.CFO = requisites.CFO
+	o.CFOTitle = requisites.CFOTitle
+	o.Details = requisites.Details
+}
+
+// Define a OrganisationRequisitesModel struct type which wraps a pgx.Conn connection pool.
+type OrganisationRequisitesModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetAll returns the requisites history of the organisation, oldest first.
+func (m OrganisationRequisitesModel) GetAll(organisationID int64) ([]*OrganisationRequisites, error) {
+	query := `
+		SELECT id, organisation_id, valid_from, full_name, ceo, ceo_title, cfo, cfo_title, details,
+			user_id, created_at
+		FROM organisation_requisites
+		WHERE organisation_id = $1
+		ORDER BY valid_from NULLS FIRST`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID)
+	if err != nil {
+		return nil, err
+	}
+
+	requisites, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[OrganisationRequisites])
+	if err != nil {
+		return nil, err
+	}
+
+	return requisites, nil
+}
+
+// GetOn returns the requisites of the organisation in force on the date. It returns
+// ErrRecordNotFound for organisations without any history, whose current requisites
+// apply to all dates.
+func (m OrganisationRequisitesModel) GetOn(organisationID int64, date time.Time) (*OrganisationRequisites, error) {
+	query := `
+		SELECT id, organisation_id, valid_from, full_name, ceo, ceo_title, cfo, cfo_title, details,
+			user_id, created_at
+		FROM organisation_requisites
+		WHERE organisation_id = $1 AND (valid_from IS NULL OR valid_from <= $2::date)
+		ORDER BY valid_from DESC NULLS LAST
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID, date)
+	if err != nil {
+		return nil, err
+	}
+
+	requisites, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[OrganisationRequisites])
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return requisites, nil
+}
+
+// Insert records requisites in force from the given date. A record on a date which
+// already has one replaces it. The first record of an organisation without any
+// history also records previous, the requisites held so far, so earlier documents keep
+// them. The columns of the organisation are updated to the requisites in force today.
+func (m OrganisationRequisitesModel) Insert(requisites *OrganisationRequisites, previous *OrganisationRequisites) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO organisation_requisites (organisation_id, full_name, ceo, ceo_title, cfo, cfo_title, details)
+		SELECT $1, $2, $3, $4, $5, $6, $7
+		WHERE NOT EXISTS (SELECT 1 FROM organisation_requisites WHERE organisation_id = $1)`
+
+	args := []interface{}{
+		requisites.OrganisationID,
+		previous.FullName,
+		previous.CEO,
+		previous.CEOTitle,
+		previous.CFO,
+		previous.CFOTitle,
+		previous.Details,
+	}
+
+	_, err = tx.Exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO organisation_requisites (organisation_id, valid_from, full_name, ceo, ceo_title, cfo, cfo_title, details, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (organisation_id, valid_from) DO UPDATE
+		SET full_name = EXCLUDED.full_name, ceo = EXCLUDED.ceo, ceo_title = EXCLUDED.ceo_title,
+			cfo = EXCLUDED.cfo, cfo_title = EXCLUDED.cfo_title, details = EXCLUDED.details,
+			user_id = EXCLUDED.user_id, created_at = NOW()
+		RETURNING id, created_at`
+
+	args = []interface{}{
+		requisites.OrganisationID,
+		requisites.ValidFrom,
+		requisites.FullName,
+		requisites.CEO,
+		requisites.CEOTitle,
+		requisites.CFO,
+		requisites.CFOTitle,
+		requisites.Details,
+		requisites.UserID,
+	}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&requisites.ID, &requisites.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE organisations
+		SET full_name = current.full_name, ceo = current.ceo, ceo_title = current.ceo_title,
+			cfo = current.cfo, cfo_title = current.cfo_title, details = current.details, updated_at = NOW()
+		FROM (SELECT full_name, ceo, ceo_title, cfo, cfo_title, details
+			  FROM organisation_requisites
+			  WHERE organisation_id = $1 AND (valid_from IS NULL OR valid_from <= CURRENT_DATE)
+			  ORDER BY valid_from DESC NULLS LAST
+			  LIMIT 1) current
+		WHERE organisations.id = $1`
+
+	_, err = tx.Exec(ctx, query, requisites.OrganisationID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
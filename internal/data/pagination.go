@@ -1,6 +1,7 @@
 package data
 
 import (
+	"fmt"
 	"math"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
@@ -8,16 +9,19 @@ import (
 
 // Define a new Metadata struct for holding the pagination metadata.
 type Metadata struct {
-	CurrentPage  int   `json:"current_page,omitempty"`
-	PageSize     int   `json:"page_size,omitempty"`
-	FirstPage    int   `json:"first_page,omitempty"`
-	LastPage     int   `json:"last_page,omitempty"`
-	TotalRecords int64 `json:"total_records,omitempty"`
+	CurrentPage  int   `json:"current_page"`
+	PageSize     int   `json:"page_size"`
+	FirstPage    int   `json:"first_page"`
+	LastPage     int   `json:"last_page"`
+	TotalRecords int64 `json:"total_records"`
+	HasNext      bool  `json:"has_next"`
+	HasPrev      bool  `json:"has_prev"`
 }
 
 type Pagination struct {
 	Page              int
 	Limit             int
+	MaxLimit          int
 	Sort              string
 	Direction         string
 	SortSafelist      []string
@@ -28,13 +32,46 @@ func ValidatePagination(v *validator.Validator, p Pagination) {
 	// Check that the page and page_size parameters contain sensible values.
 	v.Check(p.Page > 0, "page", "must be greater than zero")
 	v.Check(p.Page <= 10_000_000, "page", "must be a maximum of 10 million")
-	v.Check(p.Limit > 0, "limit", "must be greater than zero")
-	v.Check(p.Limit <= 100, "limit", "must be a maximum of 100")
+	ValidateLimit(v, p.Limit, p.MaxLimit)
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(p.Sort, p.SortSafelist...), "sort", "invalid sort value")
 	v.Check(validator.In(p.Direction, p.DirectionSafelist...), "direction", "invalid direction value")
 }
 
+// PageLimits are the default and the maximum page size of a list endpoint.
+type PageLimits struct {
+	Default int
+	Max     int
+}
+
+// The page size of lists without limits of their own.
+var DefaultPageLimit = PageLimits{Default: 20, Max: 100}
+
+// DefaultPageLimits holds the page sizes of the list endpoints. Small reference lists
+// may be fetched at once, documents are limited to smaller pages.
+var DefaultPageLimits = map[string]PageLimits{
+	"companies":            {Default: 20, Max: 1000},
+	"agreements":           {Default: 20, Max: 1000},
+	"description_snippets": {Default: 10, Max: 50},
+	"frequent_items":       {Default: 10, Max: 50},
+	"invoices":             {Default: 20, Max: 100},
+	"payments":             {Default: 20, Max: 100},
+	"communications":       {Default: 20, Max: 100},
+	"accounting_syncs":     {Default: 20, Max: 100},
+	"stock_movements":      {Default: 20, Max: 100},
+}
+
+// ValidateLimit checks the page size against the maximum of the endpoint, the maximum
+// of DefaultPageLimit if it is zero.
+func ValidateLimit(v *validator.Validator, limit, max int) {
+	if max == 0 {
+		max = DefaultPageLimit.Max
+	}
+
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= max, "limit", fmt.Sprintf("must be a maximum of %d", max))
+}
+
 // Check that the client-provided Sort field matches one of the entries in our safelist
 // and if it does, extract the column name from the Sort field by stripping the leading
 // hyphen character (if one exists).
@@ -74,16 +111,21 @@ func (p Pagination) offset() int {
 // up a float to the nearest integer. So, for example, if there were 12 records in total
 // and a page size of 5, the last page value would be math.Ceil(12/5) = 3.
 func calculateMetadata(totalRecords int64, page, limit int) Metadata {
-	if totalRecords == 0 {
-		// Note that we return an empty Metadata struct if there are no records.
-		return Metadata{}
+	lastPage := int(math.Ceil(float64(totalRecords) / float64(limit)))
+
+	// An empty list still consists of a single (empty) page, so the metadata keeps the
+	// same shape whether there are records or not.
+	if lastPage < 1 {
+		lastPage = 1
 	}
 
 	return Metadata{
 		CurrentPage:  page,
 		PageSize:     limit,
 		FirstPage:    1,
-		LastPage:     int(math.Ceil(float64(totalRecords) / float64(limit))),
+		LastPage:     lastPage,
 		TotalRecords: totalRecords,
+		HasNext:      page < lastPage,
+		HasPrev:      page > 1,
 	}
 }
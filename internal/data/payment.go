@@ -0,0 +1,619 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Define custom errors returned when payments can't be applied to an invoice.
+var (
+	ErrInvoiceSettled        = errors.New("invoice is already settled")
+	ErrNoUnallocatedPayments = errors.New("no unallocated payments")
+)
+
+// Define custom errors returned when a payment can't be changed or deleted: its amount
+// can't drop below what has been allocated, and payments allocated to archived invoices
+// are kept, as those invoices are settled for good.
+var (
+	ErrPaymentOverAllocated = errors.New("the payment is allocated beyond the amount")
+	ErrPaymentArchived      = errors.New("the payment is allocated to archived invoices")
+)
+
+// Payment type details
+type Payment struct {
+	ID             int64         `json:"id"`
+	Date           time.Time     `json:"date"`
+	Number         string        `json:"number,omitempty"`
+	OrganisationID int64         `json:"organisation_id,omitempty"`
+	BankAccountID  *int64        `json:"bank_account_id,omitempty"`
+	CompanyID      int64         `json:"company_id,omitempty"`
+	Amount         Money         `json:"amount"`
+	Unallocated    Money         `json:"unallocated"`
+	Description    string        `json:"description,omitempty"`
+	UserID         *int64        `json:"user_id,omitempty"`
+	Organisation   *Organisation `json:"organisation,omitempty"`
+	BankAccount    *BankAccount  `json:"bank_account,omitempty"`
+	Company        *Company      `json:"company,omitempty"`
+	DestroyedAt    *time.Time    `json:"destroyed_at,omitempty"`
+	CreatedAt      *time.Time    `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time    `json:"updated_at,omitempty"`
+}
+
+// PaymentAllocation links a part of a payment to an invoice. A payment which has no
+// allocations to regular (non-advance) invoices is an advance, which can be applied
+// later to a future invoice ("зачет аванса").
+type PaymentAllocation struct {
+	ID        int64      `json:"id"`
+	PaymentID int64      `json:"payment_id"`
+	InvoiceID int64      `json:"invoice_id"`
+	Amount    Money      `json:"amount"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+type PaymentFilters struct {
+	OrganisationID int64
+	CompanyID      int64
+	BankAccountID  int64
+	Start          *time.Time
+	End            *time.Time
+	Unallocated    bool
+}
+
+func ValidatePayment(v *validator.Validator, payment *Payment) {
+	v.Check(!payment.Date.IsZero(), "date", "must be provided")
+	v.Check(payment.OrganisationID != 0, "organisation_id", "must be provided")
+	v.Check(payment.CompanyID != 0, "company_id", "must be provided")
+	v.Check(payment.Amount > 0, "amount", "must be greater than zero")
+}
+
+// Define a PaymentModel struct type which wraps a pgx.Conn connection pool.
+type PaymentModel struct {
+	DB *pgxpool.Pool
+}
+
+// The unallocated amount of a payment is the part which hasn't been applied to invoices
+// yet, advance and archived invoices included.
+const paymentUnallocatedColumn = `amount - COALESCE((
+	SELECT SUM(pa.amount) FROM payment_allocations pa WHERE pa.payment_id = payments.id), 0)`
+
+func (m PaymentModel) GetAll(filters PaymentFilters, pagination Pagination) ([]*Payment, Metadata, error) {
+	// The values of the filters are passed as query arguments; the limit and the offset
+	// follow them.
+	f := filter{}
+
+	if filters.OrganisationID > 0 {
+		f.where("organisation_id = " + f.arg(filters.OrganisationID))
+	}
+
+	if filters.CompanyID > 0 {
+		f.where("company_id = " + f.arg(filters.CompanyID))
+	}
+
+	if filters.BankAccountID > 0 {
+		f.where("bank_account_id = " + f.arg(filters.BankAccountID))
+	}
+
+	f.dateRange("date", filters.Start, filters.End)
+
+	if filters.Unallocated {
+		f.where("(" + paymentUnallocatedColumn + ") > 0")
+	}
+
+	f.where("destroyed_at IS NULL")
+
+	// The count takes the arguments of the filter only, without the limit and offset.
+	filterQuery, args := f.clause(), f.args
+
+	// Construct the SQL query to retrieve all payment records.
+	query := fmt.Sprintf(`
+	SELECT id, date, number, amount, %s AS unallocated, description,
+		(SELECT row_to_json(row) FROM (SELECT id, name FROM organisations WHERE organisations.id = organisation_id) row) AS organisation,
+		(SELECT row_to_json(row) FROM (SELECT id, name FROM bank_accounts WHERE bank_accounts.id = bank_account_id) row) AS bank_account,
+		(SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = company_id) row) AS company,
+		created_at, updated_at
+	FROM payments
+	%s
+	ORDER BY %s %s
+	LIMIT %s OFFSET %s`, paymentUnallocatedColumn, filterQuery, pagination.sortColumn(), pagination.sortDirection(),
+		f.arg(pagination.limit()), f.arg(pagination.offset()))
+
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// Importantly, defer a call to rows.Close() to ensure that the resultset is closed
+	// before GetAll() returns.
+	defer rows.Close()
+
+	payments := []*Payment{}
+
+	for rows.Next() {
+		var payment Payment
+
+		err := rows.Scan(
+			&payment.ID,
+			&payment.Date,
+			&payment.Number,
+			&payment.Amount,
+			&payment.Unallocated,
+			&payment.Description,
+			&payment.Organisation,
+			&payment.BankAccount,
+			&payment.Company,
+			&payment.CreatedAt,
+			&payment.UpdatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		// Add the Payment struct to the slice.
+		payments = append(payments, &payment)
+	}
+
+	// When the rows.Next() loop has finished, call rows.Err() to retrieve any error
+	// that was encountered during the iteration.
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	totalRecords, err := m.CountIDs(filterQuery, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, pagination.Page, pagination.Limit)
+
+	return payments, metadata, nil
+}
+
+// Add method for updating the date, the number, the bank account, the amount and the
+// description of a payment. The allocations are kept, so the amount can't be less than
+// what has been allocated to either regular or advance invoices, see Apply();
+// ErrPaymentOverAllocated is returned otherwise.
+func (m PaymentModel) Update(payment *Payment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// The lock keeps the payment from being applied to invoices meanwhile.
+	err = lockPayment(ctx, tx, payment.ID)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT COALESCE(SUM(amount), 0) FROM payment_allocations WHERE payment_id = $1"
+
+	var allocated Money
+
+	err = tx.QueryRow(ctx, query, payment.ID).Scan(&allocated)
+	if err != nil {
+		return err
+	}
+
+	if payment.Amount < allocated {
+		return ErrPaymentOverAllocated
+	}
+
+	query = fmt.Sprintf(`
+		UPDATE payments
+		SET date = $1, number = $2, bank_account_id = $3, amount = $4, description = $5, updated_at = NOW()
+		WHERE id = $6 AND destroyed_at IS NULL
+		RETURNING %s, updated_at`, paymentUnallocatedColumn)
+
+	args := []interface{}{
+		payment.Date,
+		payment.Number,
+		payment.BankAccountID,
+		payment.Amount,
+		payment.Description,
+		payment.ID,
+	}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&payment.Unallocated, &payment.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Delete marks the payment as deleted and removes its allocations, so the invoices it
+// paid are outstanding again; those which were marked as paid are sent again. It
+// returns the invoices the payment was allocated to. Payments allocated to archived
+// invoices are kept and ErrPaymentArchived is returned.
+func (m PaymentModel) Delete(id int64) ([]int64, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// The invoices are locked before the payment, in the order Apply() locks them.
+	query := `
+		SELECT id FROM invoices
+		WHERE id IN (SELECT invoice_id FROM payment_allocations WHERE payment_id = $1)
+		ORDER BY id
+		FOR UPDATE`
+
+	_, err = tx.Exec(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockPayment(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT EXISTS (
+			SELECT 1 FROM payment_allocations pa
+			JOIN invoices_archive i ON i.id = pa.invoice_id
+			WHERE pa.payment_id = $1
+		)`
+
+	var archived bool
+
+	err = tx.QueryRow(ctx, query, id).Scan(&archived)
+	if err != nil {
+		return nil, err
+	}
+
+	if archived {
+		return nil, ErrPaymentArchived
+	}
+
+	rows, err := tx.Query(ctx, "DELETE FROM payment_allocations WHERE payment_id = $1 RETURNING invoice_id", id)
+	if err != nil {
+		return nil, err
+	}
+
+	invoiceIDs, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE payments SET destroyed_at = NOW(), updated_at = NOW() WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		UPDATE invoices SET status = CASE WHEN shipped_at IS NULL THEN 'sent' ELSE 'shipped' END, updated_at = NOW()
+		WHERE id = ANY($1) AND status = 'paid' AND ` + invoiceTotalColumn + ` > ` + invoicePaidColumn
+
+	_, err = tx.Exec(ctx, query, invoiceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return invoiceIDs, tx.Commit(ctx)
+}
+
+// Add method for inserting a new record in the payments table.
+func (m PaymentModel) Insert(payment *Payment) error {
+	query := `
+		INSERT INTO payments (
+			date, number, organisation_id, bank_account_id, company_id, amount, description, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, amount,
+				  (SELECT row_to_json(row) FROM (SELECT id, name FROM organisations WHERE organisations.id = organisation_id) row) AS organisation,
+				  (SELECT row_to_json(row) FROM (SELECT id, name FROM bank_accounts WHERE bank_accounts.id = bank_account_id) row) AS bank_account,
+				  (SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = company_id) row) AS company,
+				  created_at, updated_at`
+
+	args := []interface{}{
+		payment.Date,
+		payment.Number,
+		payment.OrganisationID,
+		payment.BankAccountID,
+		payment.CompanyID,
+		payment.Amount,
+		payment.Description,
+		payment.UserID,
+	}
+
+	err := m.DB.QueryRow(context.Background(), query, args...).Scan(
+		&payment.ID,
+		&payment.Amount,
+		&payment.Organisation,
+		&payment.BankAccount,
+		&payment.Company,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	// A new payment isn't applied to anything yet.
+	payment.Unallocated = payment.Amount
+
+	return nil
+}
+
+// Get returns the payment.
+func (m PaymentModel) Get(id int64) (*Payment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, date, number, organisation_id, bank_account_id, company_id, amount, %s AS unallocated, description,
+			created_at, updated_at
+		FROM payments
+		WHERE id = $1 AND destroyed_at IS NULL`, paymentUnallocatedColumn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var payment Payment
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&payment.ID,
+		&payment.Date,
+		&payment.Number,
+		&payment.OrganisationID,
+		&payment.BankAccountID,
+		&payment.CompanyID,
+		&payment.Amount,
+		&payment.Unallocated,
+		&payment.Description,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &payment, nil
+}
+
+// GetAllocations returns the allocations of the payment to invoices.
+func (m PaymentModel) GetAllocations(paymentID int64) ([]*PaymentAllocation, error) {
+	query := `
+		SELECT id, payment_id, invoice_id, amount, created_at
+		FROM payment_allocations
+		WHERE payment_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allocations := []*PaymentAllocation{}
+
+	for rows.Next() {
+		var allocation PaymentAllocation
+
+		err := rows.Scan(
+			&allocation.ID,
+			&allocation.PaymentID,
+			&allocation.InvoiceID,
+			&allocation.Amount,
+			&allocation.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		allocations = append(allocations, &allocation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return allocations, nil
+}
+
+// Apply allocates unallocated payments of the invoice's company to the invoice until it
+// is settled. If paymentIDs is not empty only those payments are considered, otherwise
+// payments are taken oldest first. The whole operation runs in a transaction with the
+// invoice and payment rows locked, so concurrent requests can't over-allocate.
+func (m PaymentModel) Apply(invoice *Invoice, paymentIDs []int64) ([]*PaymentAllocation, error) {
+	if invoice == nil || invoice.ID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// Lock the invoice and calculate how much of its total, VAT included, is still
+	// outstanding. Nothing is owed on a cancelled invoice.
+	var outstanding Money
+	query := `
+		SELECT CASE WHEN status = 'cancelled' THEN 0
+			ELSE COALESCE(amount, 0) + COALESCE(vat, 0) - ` + invoicePaidColumn + ` END
+		FROM invoices
+		WHERE id = $1 AND destroyed_at IS NULL
+		FOR UPDATE`
+
+	err = tx.QueryRow(ctx, query, invoice.ID).Scan(&outstanding)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if outstanding <= 0 {
+		return nil, ErrInvoiceSettled
+	}
+
+	// Every allocation of a payment counts, to advance and regular invoices alike, so a
+	// payment is never allocated beyond its amount.
+	query = `
+		SELECT id, amount - COALESCE((
+			SELECT SUM(pa.amount) FROM payment_allocations pa
+			WHERE pa.payment_id = payments.id), 0) AS available
+		FROM payments
+		WHERE company_id = $1 AND organisation_id = $2 AND destroyed_at IS NULL`
+
+	args := []interface{}{invoice.CompanyID, invoice.OrganisationID}
+
+	if len(paymentIDs) > 0 {
+		query += " AND id = ANY($3)"
+		args = append(args, paymentIDs)
+	}
+
+	query += " ORDER BY date, id FOR UPDATE"
+
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		id        int64
+		available Money
+	}
+
+	candidates := []candidate{}
+	for rows.Next() {
+		var c candidate
+		err := rows.Scan(&c.id, &c.available)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c.available > 0 {
+			candidates = append(candidates, c)
+		}
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(candidates) == 0 {
+		return nil, ErrNoUnallocatedPayments
+	}
+
+	query = `
+		INSERT INTO payment_allocations (payment_id, invoice_id, amount)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	allocations := []*PaymentAllocation{}
+	for _, c := range candidates {
+		if outstanding <= 0 {
+			break
+		}
+
+		amount := c.available
+		if amount > outstanding {
+			amount = outstanding
+		}
+
+		allocation := &PaymentAllocation{
+			PaymentID: c.id,
+			InvoiceID: invoice.ID,
+			Amount:    amount,
+		}
+
+		err = tx.QueryRow(ctx, query, c.id, invoice.ID, amount).Scan(&allocation.ID, &allocation.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		outstanding -= amount
+		allocations = append(allocations, allocation)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return allocations, nil
+}
+
+// lockPayment locks the payment until the end of the transaction. ErrRecordNotFound is
+// returned if it doesn't exist or has been deleted.
+func lockPayment(ctx context.Context, tx pgx.Tx, id int64) error {
+	err := tx.QueryRow(ctx, "SELECT id FROM payments WHERE id = $1 AND destroyed_at IS NULL FOR UPDATE", id).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Count records in a table
+func (m PaymentModel) CountIDs(filterQuery string, args ...interface{}) (int64, error) {
+	query := fmt.Sprintf("select count(id) from payments %s", filterQuery)
+	var count int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&count)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,306 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrDuplicateReminderRule is returned when an organisation gets a second rule for the
+// same day and channel.
+var ErrDuplicateReminderRule = errors.New("duplicate reminder rule")
+
+// The kind of the communications of payment reminders.
+const CommunicationReminder = "reminder"
+
+// The channels payment reminders are delivered through.
+var ReminderChannels = []string{ChannelEmail, ChannelSMS}
+
+// A reminder which failed is tried again at the next runs of the reminder job, until it
+// failed MaxReminderAttempts times or is more than ReminderCatchUpDays late.
+const (
+	MaxReminderAttempts = 3
+	ReminderCatchUpDays = 7
+)
+
+// PaymentReminderRule reminds the companies of the organisation of their unpaid
+// invoices Days days after the due date, or before it when Days is negative.
+type PaymentReminderRule struct {
+	ID             int64      `json:"id"`
+	OrganisationID int64      `json:"organisation_id"`
+	Days           int        `json:"days"`
+	Channel        string     `json:"channel"`
+	IsActive       bool       `json:"is_active"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+// DueReminder is an unpaid invoice which a rule reminds of.
+type DueReminder struct {
+	InvoiceID   int64
+	CompanyID   int64
+	Number      string
+	Date        time.Time
+	DueDate     time.Time
+	Outstanding Money
+}
+
+func ValidatePaymentReminderRule(v *validator.Validator, rule *PaymentReminderRule) {
+	v.Check(rule.Days >= -30, "days", "must not be less than -30")
+	v.Check(rule.Days <= 365, "days", "must not be more than 365")
+	v.Check(validator.In(rule.Channel, ReminderChannels...), "channel", "must be email or sms")
+}
+
+// Define a PaymentReminderRuleModel struct type which wraps a pgx.Conn connection pool.
+type PaymentReminderRuleModel struct {
+	DB *pgxpool.Pool
+}
+
+const paymentReminderRuleColumns = `id, organisation_id, days, channel, is_active, created_at, updated_at`
+
+func scanPaymentReminderRule(row pgx.Row) (*PaymentReminderRule, error) {
+	var rule PaymentReminderRule
+
+	err := row.Scan(
+		&rule.ID,
+		&rule.OrganisationID,
+		&rule.Days,
+		&rule.Channel,
+		&rule.IsActive,
+		&rule.CreatedAt,
+		&rule.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+func (m PaymentReminderRuleModel) all(query string, args ...interface{}) ([]*PaymentReminderRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*PaymentReminderRule{}
+
+	for rows.Next() {
+		rule, err := scanPaymentReminderRule(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// GetAll returns the reminder rules of the organisation in the order they apply.
+func (m PaymentReminderRuleModel) GetAll(organisationID int64) ([]*PaymentReminderRule, error) {
+	query := `
+		SELECT ` + paymentReminderRuleColumns + `
+		FROM payment_reminder_rules
+		WHERE organisation_id = $1
+		ORDER BY days, channel`
+
+	return m.all(query, organisationID)
+}
+
+// GetActive returns the active reminder rules of all organisations.
+func (m PaymentReminderRuleModel) GetActive() ([]*PaymentReminderRule, error) {
+	query := `
+		SELECT ` + paymentReminderRuleColumns + `
+		FROM payment_reminder_rules
+		WHERE is_active = true
+		ORDER BY organisation_id, days, channel`
+
+	return m.all(query)
+}
+
+// Get returns a reminder rule of the organisation.
+func (m PaymentReminderRuleModel) Get(organisationID, id int64) (*PaymentReminderRule, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + paymentReminderRuleColumns + `
+		FROM payment_reminder_rules
+		WHERE organisation_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rule, err := scanPaymentReminderRule(m.DB.QueryRow(ctx, query, organisationID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return rule, nil
+}
+
+// Insert adds the reminder rule, an organisation can have one rule per day and channel.
+func (m PaymentReminderRuleModel) Insert(rule *PaymentReminderRule) error {
+	query := `
+		INSERT INTO payment_reminder_rules (organisation_id, days, channel, is_active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at`
+
+	args := []interface{}{rule.OrganisationID, rule.Days, rule.Channel, rule.IsActive}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&rule.ID, &rule.CreatedAt, &rule.UpdatedAt)
+	return reminderRuleError(err)
+}
+
+// Update saves the reminder rule.
+func (m PaymentReminderRuleModel) Update(rule *PaymentReminderRule) error {
+	query := `
+		UPDATE payment_reminder_rules
+		SET days = $1, channel = $2, is_active = $3, updated_at = NOW()
+		WHERE organisation_id = $4 AND id = $5
+		RETURNING updated_at`
+
+	args := []interface{}{rule.Days, rule.Channel, rule.IsActive, rule.OrganisationID, rule.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&rule.UpdatedAt)
+	return reminderRuleError(err)
+}
+
+// reminderRuleError maps the errors of saving a rule to ErrRecordNotFound and
+// ErrDuplicateReminderRule.
+func reminderRuleError(err error) error {
+	var pgErr *pgconn.PgError
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrRecordNotFound
+	case errors.As(err, &pgErr) && pgErr.Code == "23505":
+		return ErrDuplicateReminderRule
+	default:
+		return err
+	}
+}
+
+// Delete removes the reminder rule. The reminders it sent stay in the communications
+// log.
+func (m PaymentReminderRuleModel) Delete(organisationID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, "DELETE FROM payment_reminder_rules WHERE organisation_id = $1 AND id = $2", organisationID, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Due returns the posted, unpaid invoices of the organisation of the rule which the
+// rule reminds of on the day: those whose reminder day is the day or one of the
+// ReminderCatchUpDays before it, so the reminders missed while the job didn't run are
+// still sent. An invoice is reminded once per rule; failed reminders count against
+// MaxReminderAttempts.
+func (m PaymentReminderRuleModel) Due(rule *PaymentReminderRule, day time.Time) ([]*DueReminder, error) {
+	query := `
+		SELECT i.id, i.company_id, i.number, i.date, i.due_date, i.amount + COALESCE(i.vat, 0) - p.paid
+		FROM invoices i
+		CROSS JOIN LATERAL (
+			SELECT COALESCE(SUM(amount), 0) AS paid FROM payment_allocations WHERE invoice_id = i.id
+		) p
+		WHERE i.organisation_id = $1 AND i.is_active = true AND i.is_advance = false
+			AND i.written_off_at IS NULL AND i.status <> 'cancelled' AND i.destroyed_at IS NULL
+			AND i.company_id IS NOT NULL AND i.due_date IS NOT NULL AND i.amount + COALESCE(i.vat, 0) > p.paid
+			AND i.due_date::date + $2::integer BETWEEN $3::date - $4::integer AND $3::date
+			AND NOT EXISTS (
+				SELECT 1 FROM communications cm
+				WHERE cm.invoice_id = i.id AND cm.kind = $5 AND cm.details->>'rule_id' = $6::bigint::text
+					AND cm.status = $7)
+			AND (
+				SELECT COUNT(*) FROM communications cm
+				WHERE cm.invoice_id = i.id AND cm.kind = $5 AND cm.details->>'rule_id' = $6::bigint::text
+					AND cm.status = $8) < $9
+		ORDER BY i.due_date, i.id`
+
+	args := []interface{}{
+		rule.OrganisationID,
+		rule.Days,
+		day,
+		ReminderCatchUpDays,
+		CommunicationReminder,
+		rule.ID,
+		CommunicationSent,
+		CommunicationFailed,
+		MaxReminderAttempts,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reminders := []*DueReminder{}
+
+	for rows.Next() {
+		var reminder DueReminder
+
+		err := rows.Scan(
+			&reminder.InvoiceID,
+			&reminder.CompanyID,
+			&reminder.Number,
+			&reminder.Date,
+			&reminder.DueDate,
+			&reminder.Outstanding,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		reminders = append(reminders, &reminder)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reminders, nil
+}
@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// PaymentStats describes how a company pays its invoices. Advance and deleted invoices
+// are left out, as are archived ones. Days are counted from the invoice date to the
+// payment which settled it, lateness from the due date (the invoice date if there is
+// none). The weighted days to pay count every invoice by its amount, the on-time ratio
+// is the share of the paid invoices which were paid by their due date.
+type PaymentStats struct {
+	Invoices          int       `json:"invoices"`
+	Paid              int       `json:"paid"`
+	AverageDaysToPay  *float64  `json:"average_days_to_pay,omitempty"`
+	WeightedDaysToPay *float64  `json:"weighted_days_to_pay,omitempty"`
+	MedianDaysToPay   *float64  `json:"median_days_to_pay,omitempty"`
+	AverageDaysLate   *float64  `json:"average_days_late,omitempty"`
+	PaidLate          int       `json:"paid_late"`
+	OnTimeRatio       *float64  `json:"on_time_ratio,omitempty"`
+	Overdue           int       `json:"overdue"`
+	OverdueAmount     Money     `json:"overdue_amount"`
+	WrittenOff        int       `json:"written_off"`
+	WrittenOffAmount  Money     `json:"written_off_amount"`
+	Score             int       `json:"score"`
+	Rating            string    `json:"rating"`
+	CalculatedAt      time.Time `json:"calculated_at"`
+}
+
+// calculateScore rates the payment discipline from 100 (always paid on time) down to
+// 0. Up to 40 points are taken for the average lateness (60 days and more take all of
+// them), up to 30 for the share of invoices which are overdue and up to 30 for the
+// share written off. The rating is A from 80 points on, B from 60, C from 40 and D
+// below.
+func (s *PaymentStats) calculateScore() {
+	score := 100.0
+
+	if s.AverageDaysLate != nil {
+		score -= 40 * math.Min(*s.AverageDaysLate, 60) / 60
+	}
+
+	if s.Invoices > 0 {
+		score -= 30 * float64(s.Overdue) / float64(s.Invoices)
+		score -= 30 * float64(s.WrittenOff) / float64(s.Invoices)
+	}
+
+	s.Score = int(math.Round(math.Max(score, 0)))
+
+	switch {
+	case s.Score >= 80:
+		s.Rating = "A"
+	case s.Score >= 60:
+		s.Rating = "B"
+	case s.Score >= 40:
+		s.Rating = "C"
+	default:
+		s.Rating = "D"
+	}
+}
+
+// CalculatePaymentStats recalculates the payment stats of every company with invoices
+// and removes them from companies which have none left. It returns the number of
+// companies updated.
+func (m CompanyModel) CalculatePaymentStats() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	return m.calculatePaymentStats(ctx, nil)
+}
+
+// RecalculatePaymentStats recalculates the payment stats of one company, after a
+// payment or a return has settled one of its invoices.
+func (m CompanyModel) RecalculatePaymentStats(companyID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.calculatePaymentStats(ctx, []int64{companyID})
+	return err
+}
+
+// calculatePaymentStats recalculates the payment stats of the given companies, or of
+// all of them if companyIDs is nil.
+func (m CompanyModel) calculatePaymentStats(ctx context.Context, companyIDs []int64) (int64, error) {
+	query := `
+		WITH invoice_payments AS (
+			SELECT i.company_id, i.date::date AS date, COALESCE(i.due_date, i.date)::date AS due_date,
+				COALESCE(i.amount, 0) + COALESCE(i.vat, 0) AS amount, i.written_off_at, COALESCE(SUM(pa.amount), 0) AS paid,
+				MAX(p.date)::date AS paid_at
+			FROM invoices i
+			LEFT JOIN payment_allocations pa ON pa.invoice_id = i.id
+			LEFT JOIN payments p ON p.id = pa.payment_id
+			WHERE i.company_id IS NOT NULL AND i.destroyed_at IS NULL AND i.is_advance IS NOT TRUE
+				AND i.status <> 'cancelled'
+				AND i.amount > 0 AND ($1::bigint[] IS NULL OR i.company_id = ANY($1))
+			GROUP BY i.id
+		), settled AS (
+			SELECT *, written_off_at IS NULL AND paid >= amount AS is_paid FROM invoice_payments
+		)
+		SELECT company_id, COUNT(*),
+			COUNT(*) FILTER (WHERE is_paid),
+			ROUND(AVG(paid_at - date) FILTER (WHERE is_paid), 1)::float8,
+			ROUND(AVG(GREATEST(paid_at - due_date, 0)) FILTER (WHERE is_paid), 1)::float8,
+			ROUND(SUM((paid_at - date) * amount) FILTER (WHERE is_paid AND paid_at IS NOT NULL)
+				/ NULLIF(SUM(amount) FILTER (WHERE is_paid AND paid_at IS NOT NULL), 0), 1)::float8,
+			(PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY paid_at - date) FILTER (WHERE is_paid))::float8,
+			COUNT(*) FILTER (WHERE is_paid AND paid_at > due_date),
+			ROUND(COUNT(*) FILTER (WHERE is_paid AND paid_at <= due_date)::numeric
+				/ NULLIF(COUNT(*) FILTER (WHERE is_paid AND paid_at IS NOT NULL), 0), 3)::float8,
+			COUNT(*) FILTER (WHERE NOT is_paid AND written_off_at IS NULL AND due_date < CURRENT_DATE),
+			COALESCE(SUM(amount - paid) FILTER (WHERE NOT is_paid AND written_off_at IS NULL AND due_date < CURRENT_DATE), 0),
+			COUNT(*) FILTER (WHERE written_off_at IS NOT NULL),
+			COALESCE(SUM(amount - paid) FILTER (WHERE written_off_at IS NOT NULL), 0)
+		FROM settled
+		GROUP BY company_id`
+
+	rows, err := m.DB.Query(ctx, query, companyIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	stats := map[int64]*PaymentStats{}
+
+	for rows.Next() {
+		var companyID int64
+		s := PaymentStats{CalculatedAt: now}
+
+		err := rows.Scan(
+			&companyID,
+			&s.Invoices,
+			&s.Paid,
+			&s.AverageDaysToPay,
+			&s.AverageDaysLate,
+			&s.WeightedDaysToPay,
+			&s.MedianDaysToPay,
+			&s.PaidLate,
+			&s.OnTimeRatio,
+			&s.Overdue,
+			&s.OverdueAmount,
+			&s.WrittenOff,
+			&s.WrittenOffAmount,
+		)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		s.calculateScore()
+		stats[companyID] = &s
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	ids := make([]int64, 0, len(stats))
+	for companyID, s := range stats {
+		_, err = m.DB.Exec(ctx, "UPDATE companies SET payment_stats = $1 WHERE id = $2", s, companyID)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, companyID)
+	}
+
+	query = `
+		UPDATE companies SET payment_stats = NULL
+		WHERE payment_stats IS NOT NULL AND id <> ALL($1) AND ($2::bigint[] IS NULL OR id = ANY($2))`
+
+	_, err = m.DB.Exec(ctx, query, ids, companyIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(ids)), nil
+}
@@ -0,0 +1,376 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrPenaltyCharged is returned when a penalty invoice is created for days which have
+// been charged by another one meanwhile.
+var ErrPenaltyCharged = errors.New("the penalty has been charged meanwhile")
+
+// ErrNoKeyRate is wrapped by the errors of penalties calculated with the key rate for
+// days before the first known key rate.
+var ErrNoKeyRate = errors.New("no key rate is known")
+
+// The bases of late-payment penalties: the contractual rate per day, or the key rate
+// of the Bank of Russia per year (article 395 of the Civil Code).
+const (
+	PenaltyContract = "contract"
+	PenaltyKeyRate  = "key_rate"
+)
+
+// KeyRate is the key rate of the Bank of Russia in percent per year, in effect from
+// EffectiveFrom until the next one.
+type KeyRate struct {
+	EffectiveFrom time.Time  `json:"effective_from" db:"effective_from"`
+	Rate          float64    `json:"rate" db:"rate"`
+	CreatedAt     *time.Time `json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func ValidateKeyRate(v *validator.Validator, rate *KeyRate) {
+	v.Check(rate.Rate >= 0 && rate.Rate < 1000, "rate", "must be between 0 and 999.99")
+	v.Check(rate.Rate == math.Round(rate.Rate*100)/100, "rate", "must have at most two decimal places")
+}
+
+// Settlement is an amount allocated to an invoice on a day, by a payment or a return.
+type Settlement struct {
+	Date   time.Time
+	Amount Money
+}
+
+// PenaltyPeriod is a run of days with the same debt and rate. Rate is in percent per
+// day for contractual penalties and per year of DaysInYear days for the key rate.
+type PenaltyPeriod struct {
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Days       int       `json:"days"`
+	Debt       Money     `json:"debt"`
+	Rate       float64   `json:"rate"`
+	DaysInYear int       `json:"days_in_year,omitempty"`
+	Amount     Money     `json:"amount"`
+}
+
+// Penalty is the late-payment penalty of an invoice as of a day. Only the days after
+// the due date which no penalty invoice has charged yet are counted; ChargedUntil is
+// the last day charged before. Debt is what is outstanding on AsOf.
+type Penalty struct {
+	InvoiceID    int64            `json:"invoice_id"`
+	Basis        string           `json:"basis"`
+	AsOf         time.Time        `json:"as_of"`
+	DueDate      time.Time        `json:"due_date"`
+	ChargedUntil *time.Time       `json:"charged_until"`
+	Debt         Money            `json:"debt"`
+	Amount       Money            `json:"amount"`
+	Periods      []*PenaltyPeriod `json:"periods"`
+}
+
+// PenaltyInput is what a penalty is calculated from. Amount is the total of the invoice,
+// VAT included, as that is the debt. DailyRate is the contractual rate, KeyRates are
+// used without it and have to be sorted by EffectiveFrom.
+type PenaltyInput struct {
+	Amount       Money
+	DueDate      time.Time
+	WrittenOffAt *time.Time
+	Settlements  []Settlement
+	ChargedUntil *time.Time
+	AsOf         time.Time
+	DailyRate    *float64
+	KeyRates     []*KeyRate
+}
+
+// Rates are calculated in ten-thousandths of a percent, so the money is never
+// multiplied by a float.
+const penaltyRateScale = 10000
+
+// CalculatePenalty calculates the penalty day by day from the day after the due date
+// (or after the last day charged) up to and including AsOf, or the day the invoice was
+// written off. A settlement reduces the debt from the day after it, the day of the
+// payment is still overdue. The days are grouped into periods with the same debt and
+// rate, the penalty of each period is rounded to kopecks.
+func CalculatePenalty(input PenaltyInput) (*Penalty, error) {
+	penalty := &Penalty{
+		Basis:        PenaltyKeyRate,
+		AsOf:         civilDay(input.AsOf),
+		DueDate:      civilDay(input.DueDate),
+		ChargedUntil: input.ChargedUntil,
+		Periods:      []*PenaltyPeriod{},
+	}
+	if input.DailyRate != nil {
+		penalty.Basis = PenaltyContract
+	}
+
+	start := penalty.DueDate.AddDate(0, 0, 1)
+	if input.ChargedUntil != nil && !civilDay(*input.ChargedUntil).Before(start) {
+		start = civilDay(*input.ChargedUntil).AddDate(0, 0, 1)
+	}
+
+	end := penalty.AsOf
+	if input.WrittenOffAt != nil && civilDay(*input.WrittenOffAt).Before(end) {
+		end = civilDay(*input.WrittenOffAt)
+	}
+
+	// The debt of a day is the total less what has been settled before the day.
+	debtOn := func(day time.Time) Money {
+		debt := input.Amount
+		for _, s := range input.Settlements {
+			if civilDay(s.Date).Before(day) {
+				debt -= s.Amount
+			}
+		}
+		return debt
+	}
+
+	penalty.Debt = debtOn(penalty.AsOf.AddDate(0, 0, 1))
+
+	var period *PenaltyPeriod
+
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		debt := debtOn(day)
+		if debt <= 0 {
+			period = nil
+			continue
+		}
+
+		var rate float64
+		var daysInYear int
+
+		if input.DailyRate != nil {
+			rate = *input.DailyRate
+		} else {
+			keyRate := keyRateOn(input.KeyRates, day)
+			if keyRate == nil {
+				return nil, fmt.Errorf("%w for %s", ErrNoKeyRate, day.Format("2006-01-02"))
+			}
+			rate = keyRate.Rate
+			daysInYear = time.Date(day.Year(), time.December, 31, 0, 0, 0, 0, time.UTC).YearDay()
+		}
+
+		if period == nil || period.Debt != debt || period.Rate != rate || period.DaysInYear != daysInYear {
+			period = &PenaltyPeriod{Start: day, Debt: debt, Rate: rate, DaysInYear: daysInYear}
+			penalty.Periods = append(penalty.Periods, period)
+		}
+
+		period.End = day
+		period.Days++
+	}
+
+	for _, period := range penalty.Periods {
+		den := int64(100 * penaltyRateScale)
+		if period.DaysInYear > 0 {
+			den *= int64(period.DaysInYear)
+		}
+
+		units := int64(math.Round(period.Rate * penaltyRateScale))
+		period.Amount = period.Debt.mulDiv(units*int64(period.Days), den, RoundingHalfUp)
+		penalty.Amount += period.Amount
+	}
+
+	return penalty, nil
+}
+
+// keyRateOn returns the key rate in effect on the day, nil if none is known.
+func keyRateOn(rates []*KeyRate, day time.Time) *KeyRate {
+	var found *KeyRate
+	for _, rate := range rates {
+		if civilDay(rate.EffectiveFrom).After(day) {
+			break
+		}
+		found = rate
+	}
+	return found
+}
+
+// civilDay returns the date of t at midnight UTC, so days can be counted and compared
+// regardless of the time and the time zone.
+func civilDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Define a PenaltyModel struct type which wraps a pgx.Conn connection pool.
+type PenaltyModel struct {
+	DB *pgxpool.Pool
+}
+
+// KeyRates returns the key rates, the oldest first.
+func (m PenaltyModel) KeyRates() ([]*KeyRate, error) {
+	query := `
+		SELECT effective_from, rate, created_at, updated_at
+		FROM key_rates
+		ORDER BY effective_from`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[KeyRate])
+}
+
+// SetKeyRate adds the key rate, or changes the rate in effect from its day.
+func (m PenaltyModel) SetKeyRate(rate *KeyRate) error {
+	query := `
+		INSERT INTO key_rates (effective_from, rate)
+		VALUES ($1, $2)
+		ON CONFLICT (effective_from) DO UPDATE SET rate = EXCLUDED.rate, updated_at = NOW()
+		RETURNING created_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, rate.EffectiveFrom, rate.Rate).Scan(&rate.CreatedAt, &rate.UpdatedAt)
+}
+
+// DeleteKeyRate removes the key rate in effect from the day.
+func (m PenaltyModel) DeleteKeyRate(effectiveFrom time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, "DELETE FROM key_rates WHERE effective_from = $1", effectiveFrom)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Settlements returns the payments and returns allocated to the invoice with their
+// dates, the oldest first.
+func (m PenaltyModel) Settlements(invoiceID int64) ([]Settlement, error) {
+	query := `
+		SELECT COALESCE(p.date, r.date, a.created_at), COALESCE(a.amount, 0)
+		FROM payment_allocations a
+		LEFT JOIN payments p ON p.id = a.payment_id
+		LEFT JOIN returns r ON r.id = a.return_id
+		WHERE a.invoice_id = $1
+		ORDER BY 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Settlement, error) {
+		var s Settlement
+		err := row.Scan(&s.Date, &s.Amount)
+		return s, err
+	})
+}
+
+// ChargedUntil returns the last day of the invoice charged by a penalty invoice which
+// hasn't been deleted, nil if none has been charged.
+func (m PenaltyModel) ChargedUntil(invoiceID int64) (*time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return chargedUntil(ctx, m.DB, invoiceID)
+}
+
+func chargedUntil(ctx context.Context, db dbtx, invoiceID int64) (*time.Time, error) {
+	query := `
+		SELECT MAX(p.period_end)
+		FROM invoice_penalties p
+		JOIN invoices_history i ON i.id = p.penalty_invoice_id
+		WHERE p.invoice_id = $1 AND i.destroyed_at IS NULL`
+
+	var until *time.Time
+
+	err := db.QueryRow(ctx, query, invoiceID).Scan(&until)
+	if err != nil {
+		return nil, err
+	}
+
+	return until, nil
+}
+
+// Invoice creates the penalty invoice with its items and records the days it charges,
+// in one transaction. It returns ErrPenaltyCharged if another penalty invoice has
+// charged days of the invoice since the penalty was calculated.
+func (m PenaltyModel) Invoice(penalty *Penalty, userID int64, invoice *Invoice, items []*InvoiceItem) error {
+	if len(penalty.Periods) == 0 {
+		return errors.New("the penalty has no periods to charge")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('invoice_penalties'), $1::integer)", penalty.InvoiceID)
+	if err != nil {
+		return err
+	}
+
+	until, err := chargedUntil(ctx, tx, penalty.InvoiceID)
+	if err != nil {
+		return err
+	}
+
+	if until != nil && (penalty.ChargedUntil == nil || !until.Equal(*penalty.ChargedUntil)) {
+		return ErrPenaltyCharged
+	}
+
+	err = InvoiceModel{DB: m.DB}.insert(ctx, tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		item.InvoiceID = invoice.ID
+	}
+
+	err = insertInvoiceItems(ctx, tx, items)
+	if err != nil {
+		return err
+	}
+
+	_, err = recalculateInvoice(ctx, tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO invoice_penalties (invoice_id, penalty_invoice_id, basis, period_start, period_end, amount, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []interface{}{
+		penalty.InvoiceID,
+		invoice.ID,
+		penalty.Basis,
+		penalty.Periods[0].Start,
+		penalty.Periods[len(penalty.Periods)-1].End,
+		penalty.Amount,
+		userID,
+	}
+
+	_, err = tx.Exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,153 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrUnknownRole is returned when a role which isn't defined is granted.
+var ErrUnknownRole = errors.New("unknown role")
+
+// RoleAdmin gets all permissions, whichever are added later.
+const RoleAdmin = "admin"
+
+// RolePermissions are the permissions of the other roles: an "accountant" may write off
+// invoices and goods and a "viewer" gets none. A role is only a set of permissions granted at
+// once, users don't keep it.
+var RolePermissions = map[string][]string{
+	"accountant": {"invoices:write_off", "stock:write_off"},
+	"viewer":     {},
+}
+
+// Define a Permissions slice, which we will use to hold the permission codes (like
+// "invoices:write_off") for a single user.
+type Permissions []string
+
+// Add a helper method to check whether the Permissions slice contains a specific
+// permission code.
+func (p Permissions) Include(code string) bool {
+	for i := range p {
+		if code == p[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Define the PermissionModel type.
+type PermissionModel struct {
+	DB *pgxpool.Pool
+}
+
+// The GetAllForUser() method returns all permission codes for a specific user in a
+// Permissions slice.
+func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		INNER JOIN users ON users_permissions.user_id = users.id
+		WHERE users.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// The GetAll() method returns the codes of all known permissions.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// Add the provided permission codes for a specific user. Notice that we're using a
+// variadic parameter for the codes so that we can assign multiple permissions in a
+// single call.
+func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	query := `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, codes)
+	return err
+}
+
+// GrantRole adds the permissions of the role for the user and returns them. Permissions
+// the user already has are kept.
+func (m PermissionModel) GrantRole(userID int64, role string) (Permissions, error) {
+	codes, ok := RolePermissions[role]
+	if role == RoleAdmin {
+		all, err := m.GetAll()
+		if err != nil {
+			return nil, err
+		}
+		codes = all
+	} else if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownRole, role)
+	}
+
+	if len(codes) == 0 {
+		return Permissions{}, nil
+	}
+
+	return codes, m.AddForUser(userID, codes...)
+}
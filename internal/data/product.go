@@ -6,8 +6,16 @@ import (
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Product types. product_type is an integer for historical reasons.
+const (
+	ProductTypeGoods   = 1
+	ProductTypeService = 2
+	// A kit is sold as a set of other products, its components.
+	ProductTypeKit = 3
 )
 
 // Product struct
@@ -18,7 +26,7 @@ type Product struct {
 	Name        string     `json:"name"`
 	Description string     `json:"description,omitempty"`
 	SKU         string     `json:"sku,omitempty"`
-	Price       float64    `json:"price,omitempty"`
+	Price       Money      `json:"price,omitempty"`
 	VatRateID   *int64     `json:"vat_rate_id,omitempty"`
 	VatRate     *VatRate   `json:"vat_rate,omitempty"`
 	UnitID      *int64     `json:"unit_id,omitempty"`
@@ -28,26 +36,33 @@ type Product struct {
 	DestroyedAt *time.Time `json:"destroyed_at,omitempty"`
 	CreatedAt   *time.Time `json:"created_at,omitempty"`
 	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	// The components of a kit, only loaded when a single kit is shown.
+	Components []*KitComponent `json:"components,omitempty"`
 }
 
 func ValidateProduct(v *validator.Validator, product *Product) {
 	v.Check(product.Name != "", "name", "must be provided")
 }
 
+type ProductFilters struct {
+	// IncludeDeleted lists the deleted products too, with their destroyed_at.
+	IncludeDeleted bool
+}
+
 // Define a ProductModel struct type which wraps a pgx.Conn connection pool.
 type ProductModel struct {
 	DB *pgxpool.Pool
 }
 
-func (m ProductModel) GetAll() ([]*Product, error) {
+func (m ProductModel) GetAll(filters ProductFilters) ([]*Product, error) {
 	// Construct the SQL query to retrieve all movie records.
 	query := `SELECT id, is_active, product_type, name, description, sku, price, 
 			 	(SELECT row_to_json(row) FROM (SELECT id, rate, name FROM vat_rates WHERE vat_rates.id = vat_rate_id) row) AS vat_rate,
 			    (SELECT row_to_json(row) FROM (SELECT id, name FROM units WHERE units.id = unit_id) row) AS unit,
 			    (SELECT row_to_json(row) FROM (SELECT id, name FROM users WHERE users.id = user_id) row) AS user,
-				created_at, updated_at 
+				destroyed_at, created_at, updated_at 
 			  FROM products 
-			  WHERE destroyed_at IS NULL`
+			  WHERE $1 OR destroyed_at IS NULL`
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -55,7 +70,7 @@ func (m ProductModel) GetAll() ([]*Product, error) {
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
-	rows, err := m.DB.Query(ctx, query)
+	rows, err := m.DB.Query(ctx, query, filters.IncludeDeleted)
 	if err != nil {
 		return nil, err
 	}
@@ -84,6 +99,7 @@ func (m ProductModel) GetAll() ([]*Product, error) {
 			&product.VatRate,
 			&product.Unit,
 			&product.UserID,
+			&product.DestroyedAt,
 			&product.CreatedAt,
 			&product.UpdatedAt,
 		)
@@ -163,7 +179,7 @@ func (m ProductModel) Get(id int64) (*Product, error) {
 		   (SELECT row_to_json(row) FROM (SELECT id, name FROM units WHERE units.id = unit_id) row) AS unit,
 		   (SELECT row_to_json(row) FROM (SELECT id, name FROM users WHERE users.id = user_id) row) AS user,   
 		   created_at, updated_at 
-		FROM products WHERE id = $1`
+		FROM products WHERE id = $1 AND destroyed_at IS NULL`
 
 	// Declare a Product struct to hold the data returned by the query.
 	var product Product
@@ -241,7 +257,8 @@ func (m ProductModel) Update(product *Product) error {
 	)
 }
 
-// Add method for deleting a specific record from the products table.
+// Add method for deleting a specific record from the products table. The record is only
+// marked as destroyed, the documents referring to it keep it.
 func (m ProductModel) Delete(id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
@@ -250,7 +267,8 @@ func (m ProductModel) Delete(id int64) error {
 
 	// Construct the SQL query to delete the record.
 	query := `
-		DELETE FROM products WHERE id = $1`
+		UPDATE products SET destroyed_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND destroyed_at IS NULL`
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -277,3 +295,56 @@ func (m ProductModel) Delete(id int64) error {
 
 	return nil
 }
+
+// Merge moves the invoice and act items and the kit components of the duplicates to the
+// product and soft-deletes the duplicates, in one transaction. It returns how many items
+// of each table were moved, ErrRecordNotFound when the product doesn't exist and
+// ErrMergeDuplicates when one of the duplicates doesn't.
+func (m ProductModel) Merge(id int64, duplicateIDs []int64) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = lockMergedRecords(ctx, tx, "products", id, duplicateIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	moved := map[string]int64{}
+
+	for _, table := range []string{"invoice_items", "invoice_items_archive", "act_items"} {
+		result, err := tx.Exec(ctx, `UPDATE `+table+` SET product_id = $1 WHERE product_id = ANY($2)`, id, duplicateIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		moved[table] = result.RowsAffected()
+	}
+
+	// Kits which already contain the product, and the product itself if it is a kit,
+	// keep the duplicate as a component, which is hidden once it is deleted. The
+	// duplicates are moved one by one, so a kit containing two of them gets one.
+	for _, duplicateID := range duplicateIDs {
+		result, err := tx.Exec(ctx, `
+			UPDATE kit_components kc SET product_id = $1
+			WHERE kc.product_id = $2 AND kc.kit_id <> $1
+				AND NOT EXISTS (SELECT 1 FROM kit_components other WHERE other.kit_id = kc.kit_id AND other.product_id = $1)`, id, duplicateID)
+		if err != nil {
+			return nil, err
+		}
+
+		moved["kit_components"] += result.RowsAffected()
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE products SET destroyed_at = NOW(), updated_at = NOW() WHERE id = ANY($1)`, duplicateIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return moved, tx.Commit(ctx)
+}
@@ -0,0 +1,172 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+)
+
+// The fields of invoices a reassignment can change.
+const (
+	ReassignAgreement   = "agreement_id"
+	ReassignBankAccount = "bank_account_id"
+)
+
+var ReassignFields = []string{ReassignAgreement, ReassignBankAccount}
+
+// Reassignment moves the invoices which have FromID in Field to ToID, e.g. from one
+// agreement of a company to another, optionally only those of an organisation or dated
+// from Start to End. Invoices dated in a closed period are skipped, archived and
+// deleted ones aren't touched. With DryRun the same changes are made and checked but
+// rolled back, so the result is what would be changed.
+type Reassignment struct {
+	Field          string               `json:"field"`
+	FromID         int64                `json:"from_id"`
+	ToID           int64                `json:"to_id"`
+	OrganisationID int64                `json:"organisation_id,omitempty"`
+	Start          *time.Time           `json:"start,omitempty"`
+	End            *time.Time           `json:"end,omitempty"`
+	DryRun         bool                 `json:"dry_run"`
+	Amount         Money                `json:"amount"`
+	Invoices       []*ReassignedInvoice `json:"invoices"`
+	Skipped        []*ReassignedInvoice `json:"skipped"`
+}
+
+// ReassignedInvoice is an invoice a reassignment has moved or, with a Reason, skipped.
+type ReassignedInvoice struct {
+	ID             int64     `json:"id"`
+	Number         string    `json:"number"`
+	Date           time.Time `json:"date"`
+	OrganisationID int64     `json:"organisation_id"`
+	Amount         Money     `json:"amount"`
+	Reason         string    `json:"reason,omitempty"`
+	isAdvance      bool
+}
+
+func ValidateReassignment(v *validator.Validator, re *Reassignment) {
+	v.Check(validator.In(re.Field, ReassignFields...), "field", "must be agreement_id or bank_account_id")
+	v.Check(re.FromID > 0, "from_id", "must be provided")
+	v.Check(re.ToID > 0, "to_id", "must be provided")
+	v.Check(re.FromID != re.ToID, "to_id", "must differ from from_id")
+
+	if re.Start != nil && re.End != nil {
+		v.Check(!re.End.Before(*re.Start), "end", "must not be before start")
+	}
+}
+
+// Reassign runs the reassignment in one transaction, holding the locks of the invoices,
+// and fills in the moved and the skipped invoices. Moving invoices to an agreement which
+// blocks invoices over its amount returns ErrAgreementAmountExceeded if they would
+// exceed it.
+func (m InvoiceModel) Reassign(re *Reassignment) error {
+	// The field is used as a column name, so only the known ones are let through.
+	if !validator.In(re.Field, ReassignFields...) {
+		return fmt.Errorf("unknown reassignment field %q", re.Field)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed, and undoes a dry run.
+	defer tx.Rollback(ctx)
+
+	// The field is one of ReassignFields, the values are passed as query arguments.
+	f := filter{}
+	f.where(re.Field + " = " + f.arg(re.FromID))
+	f.where("destroyed_at IS NULL")
+
+	if re.OrganisationID > 0 {
+		f.where("organisation_id = " + f.arg(re.OrganisationID))
+	}
+
+	f.dateRange("date", re.Start, re.End)
+
+	query := fmt.Sprintf(`
+		SELECT id, COALESCE(number, ''), date, COALESCE(organisation_id, 0), COALESCE(amount, 0),
+			COALESCE(is_advance, false),
+			EXISTS (SELECT 1 FROM closed_periods cp
+				WHERE cp.organisation_id = invoices.organisation_id AND date::date BETWEEN cp.start_date AND cp.end_date)
+		FROM invoices
+		WHERE %s
+		ORDER BY date, id
+		FOR UPDATE`, f.and())
+
+	rows, err := tx.Query(ctx, query, f.args...)
+	if err != nil {
+		return err
+	}
+
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*ReassignedInvoice, error) {
+		var invoice ReassignedInvoice
+		var closed bool
+		err := row.Scan(
+			&invoice.ID,
+			&invoice.Number,
+			&invoice.Date,
+			&invoice.OrganisationID,
+			&invoice.Amount,
+			&invoice.isAdvance,
+			&closed,
+		)
+		if closed {
+			invoice.Reason = "dated in a closed period"
+		}
+		return &invoice, err
+	})
+	if err != nil {
+		return err
+	}
+
+	re.Amount = 0
+	re.Invoices = []*ReassignedInvoice{}
+	re.Skipped = []*ReassignedInvoice{}
+
+	ids := []int64{}
+	var increase Money
+
+	for _, invoice := range list {
+		if invoice.Reason != "" {
+			re.Skipped = append(re.Skipped, invoice)
+			continue
+		}
+
+		re.Invoices = append(re.Invoices, invoice)
+		re.Amount += invoice.Amount
+		ids = append(ids, invoice.ID)
+
+		// Advance invoices don't count against an agreement.
+		if !invoice.isAdvance {
+			increase += invoice.Amount
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE invoices SET "+re.Field+" = $1, updated_at = NOW() WHERE id = ANY($2)", re.ToID, ids)
+	if err != nil {
+		return err
+	}
+
+	if re.Field == ReassignAgreement {
+		err = checkAgreementAmount(ctx, tx, re.ToID, increase)
+		if err != nil {
+			return err
+		}
+	}
+
+	if re.DryRun {
+		return nil
+	}
+
+	return tx.Commit(ctx)
+}
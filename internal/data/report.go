@@ -0,0 +1,539 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type ReportFilters struct {
+	OrganisationID int64
+	CompanyID      int64
+	GroupID        int64
+}
+
+// ReceivablesRow holds the outstanding balance of a single counterparty. Amount is the
+// total of the invoices, VAT included, as that is what the counterparty is billed.
+type ReceivablesRow struct {
+	Company       *Company `json:"company"`
+	InvoicesCount int64    `json:"invoices_count"`
+	Amount        Money    `json:"amount"`
+	Paid          Money    `json:"paid"`
+	Outstanding   Money    `json:"outstanding"`
+}
+
+// Define a ReportModel struct type which wraps a pgx.Conn connection pool.
+type ReportModel struct {
+	DB *pgxpool.Pool
+}
+
+// Receivables returns unpaid balances grouped by company. Advance invoices are requests
+// for prepayment rather than debts, written off invoices are bad debts which are kept
+// only for history and cancelled invoices aren't owed, so none of them is included.
+func (m ReportModel) Receivables(ctx context.Context, filters ReportFilters) ([]*ReceivablesRow, error) {
+	f := filter{}
+	f.where("is_advance = false")
+	f.where("written_off_at IS NULL")
+	f.where("status <> 'cancelled'")
+	f.where("destroyed_at IS NULL")
+
+	if filters.OrganisationID > 0 {
+		f.where("organisation_id = " + f.arg(filters.OrganisationID))
+	}
+
+	if filters.CompanyID > 0 {
+		f.where("company_id = " + f.arg(filters.CompanyID))
+	}
+
+	if filters.GroupID > 0 {
+		f.where("company_id IN (SELECT id FROM companies WHERE group_id = " + f.arg(filters.GroupID) + ")")
+	}
+
+	filterQuery := f.clause()
+
+	query := fmt.Sprintf(`
+	SELECT (SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = t.company_id) row) AS company,
+		COUNT(*), SUM(t.amount), SUM(t.paid), SUM(t.amount - t.paid)
+	FROM (
+		SELECT company_id, COALESCE(amount, 0) + COALESCE(vat, 0) AS amount,
+			COALESCE((SELECT SUM(amount) FROM payment_allocations WHERE invoice_id = invoices.id), 0) AS paid
+		FROM invoices
+		%s
+	) t
+	WHERE t.amount - t.paid > 0
+	GROUP BY t.company_id
+	ORDER BY SUM(t.amount - t.paid) DESC`, filterQuery)
+
+	// Create a context with a 3-second timeout, unless the caller has a deadline.
+	ctx, cancel := queryContext(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Importantly, defer a call to rows.Close() to ensure that the resultset is closed
+	// before Receivables() returns.
+	defer rows.Close()
+
+	receivables := []*ReceivablesRow{}
+
+	for rows.Next() {
+		var row ReceivablesRow
+
+		err := rows.Scan(
+			&row.Company,
+			&row.InvoicesCount,
+			&row.Amount,
+			&row.Paid,
+			&row.Outstanding,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		receivables = append(receivables, &row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return receivables, nil
+}
+
+// OpenInvoice is an invoice of a company which isn't fully paid yet. Amount is its total,
+// VAT included.
+type OpenInvoice struct {
+	ID          int64      `json:"id"`
+	Number      string     `json:"number"`
+	Date        time.Time  `json:"date"`
+	DueDate     *time.Time `json:"due_date,omitempty"`
+	Amount      Money      `json:"amount"`
+	Paid        Money      `json:"paid"`
+	Outstanding Money      `json:"outstanding"`
+}
+
+// OpenInvoices lists the open invoices of a company with one organisation, with their
+// totals. It is what a monthly statement sent to the company contains.
+type OpenInvoices struct {
+	Invoices    []*OpenInvoice `json:"invoices"`
+	Amount      Money          `json:"amount"`
+	Paid        Money          `json:"paid"`
+	Outstanding Money          `json:"outstanding"`
+}
+
+// OpenInvoices returns the invoices the company still owes to the organisation, oldest
+// first. The same invoices as in Receivables() are taken into account.
+func (m ReportModel) OpenInvoices(organisationID, companyID int64) (*OpenInvoices, error) {
+	query := `
+		SELECT id, number, date, due_date, amount, paid, amount - paid
+		FROM (
+			SELECT id, number, date, due_date, COALESCE(amount, 0) + COALESCE(vat, 0) AS amount,
+				COALESCE((SELECT SUM(amount) FROM payment_allocations WHERE invoice_id = invoices.id), 0) AS paid
+			FROM invoices
+			WHERE organisation_id = $1 AND company_id = $2 AND is_advance = false
+				AND written_off_at IS NULL AND status <> 'cancelled' AND destroyed_at IS NULL
+		) t
+		WHERE amount - paid > 0
+		ORDER BY date, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	open := &OpenInvoices{Invoices: []*OpenInvoice{}}
+
+	for rows.Next() {
+		var invoice OpenInvoice
+
+		err := rows.Scan(
+			&invoice.ID,
+			&invoice.Number,
+			&invoice.Date,
+			&invoice.DueDate,
+			&invoice.Amount,
+			&invoice.Paid,
+			&invoice.Outstanding,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		open.Invoices = append(open.Invoices, &invoice)
+		open.Amount += invoice.Amount
+		open.Paid += invoice.Paid
+		open.Outstanding += invoice.Outstanding
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return open, nil
+}
+
+// GroupBalanceRow holds the consolidated outstanding balance of a company group. Like in
+// ReceivablesRow, Amount includes VAT.
+type GroupBalanceRow struct {
+	Group         *CompanyGroup `json:"group"`
+	InvoicesCount int64         `json:"invoices_count"`
+	Amount        Money         `json:"amount"`
+	Paid          Money         `json:"paid"`
+	Outstanding   Money         `json:"outstanding"`
+}
+
+// GroupBalances returns unpaid balances summed over all companies of each group. The
+// same invoices as in Receivables() are taken into account.
+func (m ReportModel) GroupBalances(ctx context.Context, filters ReportFilters) ([]*GroupBalanceRow, error) {
+	f := filter{}
+	f.where("i.is_advance = false")
+	f.where("i.written_off_at IS NULL")
+	f.where("i.status <> 'cancelled'")
+	f.where("i.destroyed_at IS NULL")
+	f.where("c.group_id IS NOT NULL")
+
+	if filters.OrganisationID > 0 {
+		f.where("i.organisation_id = " + f.arg(filters.OrganisationID))
+	}
+
+	if filters.GroupID > 0 {
+		f.where("c.group_id = " + f.arg(filters.GroupID))
+	}
+
+	filterQuery := f.clause()
+
+	query := fmt.Sprintf(`
+	SELECT (SELECT row_to_json(row) FROM (SELECT id, name FROM company_groups WHERE company_groups.id = t.group_id) row) AS "group",
+		COUNT(*), SUM(t.amount), SUM(t.paid), SUM(t.amount - t.paid)
+	FROM (
+		SELECT c.group_id, COALESCE(i.amount, 0) + COALESCE(i.vat, 0) AS amount,
+			COALESCE((SELECT SUM(amount) FROM payment_allocations WHERE invoice_id = i.id), 0) AS paid
+		FROM invoices i
+		JOIN companies c ON c.id = i.company_id
+		%s
+	) t
+	WHERE t.amount - t.paid > 0
+	GROUP BY t.group_id
+	ORDER BY SUM(t.amount - t.paid) DESC`, filterQuery)
+
+	// Create a context with a 3-second timeout, unless the caller has a deadline.
+	ctx, cancel := queryContext(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	balances := []*GroupBalanceRow{}
+
+	for rows.Next() {
+		var row GroupBalanceRow
+
+		err := rows.Scan(
+			&row.Group,
+			&row.InvoicesCount,
+			&row.Amount,
+			&row.Paid,
+			&row.Outstanding,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		balances = append(balances, &row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
+
+// StatementEntry is a single line of a statement: an invoice increases the debt of
+// the counterparty, a payment or the credit note of a return decreases it.
+type StatementEntry struct {
+	Date    time.Time `json:"date"`
+	Kind    string    `json:"kind"`
+	ID      int64     `json:"id"`
+	Number  string    `json:"number"`
+	Company *Company  `json:"company"`
+	Debit   Money     `json:"debit"`
+	Credit  Money     `json:"credit"`
+}
+
+// Statement is a reconciliation statement ("акт сверки") for a period.
+type Statement struct {
+	Start          time.Time         `json:"start"`
+	End            time.Time         `json:"end"`
+	OpeningBalance Money             `json:"opening_balance"`
+	Debit          Money             `json:"debit"`
+	Credit         Money             `json:"credit"`
+	ClosingBalance Money             `json:"closing_balance"`
+	Entries        []*StatementEntry `json:"entries"`
+}
+
+// The statement lines of a set of companies, including archived invoices. Advance
+// invoices are only requests for prepayment and written off and cancelled invoices are
+// no longer claimed, so they are left out.
+const statementEntriesQuery = `
+	SELECT date, 'invoice' AS kind, id, COALESCE(number, '') AS number, company_id, amount AS debit, 0 AS credit
+	FROM invoices_history
+	WHERE company_id IN (SELECT id FROM companies WHERE group_id = $1)
+		AND is_advance = false AND written_off_at IS NULL AND status <> 'cancelled' AND destroyed_at IS NULL
+	UNION ALL
+	SELECT date, 'payment' AS kind, id, COALESCE(number, '') AS number, company_id, 0 AS debit, amount AS credit
+	FROM payments
+	WHERE company_id IN (SELECT id FROM companies WHERE group_id = $1)
+		AND destroyed_at IS NULL
+	UNION ALL
+	SELECT date, 'return' AS kind, id, COALESCE(number, '') AS number, company_id, 0 AS debit, amount AS credit
+	FROM returns
+	WHERE company_id IN (SELECT id FROM companies WHERE group_id = $1)`
+
+// GroupStatement returns the consolidated statement of all companies of a group for
+// the period between start and end inclusive.
+func (m ReportModel) GroupStatement(groupID int64, start, end time.Time) (*Statement, error) {
+	if groupID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	statement := &Statement{
+		Start:   start,
+		End:     end,
+		Entries: []*StatementEntry{},
+	}
+
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+	SELECT COALESCE(SUM(debit - credit), 0)
+	FROM (%s) t
+	WHERE t.date < $2`, statementEntriesQuery)
+
+	err := m.DB.QueryRow(ctx, query, groupID, start).Scan(&statement.OpeningBalance)
+	if err != nil {
+		return nil, err
+	}
+
+	query = fmt.Sprintf(`
+	SELECT t.date, t.kind, t.id, t.number,
+		(SELECT row_to_json(row) FROM (SELECT id, name FROM companies WHERE companies.id = t.company_id) row) AS company,
+		t.debit, t.credit
+	FROM (%s) t
+	WHERE t.date BETWEEN $2 AND $3
+	ORDER BY t.date, t.kind, t.id`, statementEntriesQuery)
+
+	rows, err := m.DB.Query(ctx, query, groupID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry StatementEntry
+
+		err := rows.Scan(
+			&entry.Date,
+			&entry.Kind,
+			&entry.ID,
+			&entry.Number,
+			&entry.Company,
+			&entry.Debit,
+			&entry.Credit,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		statement.Debit += entry.Debit
+		statement.Credit += entry.Credit
+		statement.Entries = append(statement.Entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statement.ClosingBalance = statement.OpeningBalance + statement.Debit - statement.Credit
+
+	return statement, nil
+}
+
+// NumberGap is a range of invoice numbers which were never issued.
+type NumberGap struct {
+	From    int64 `json:"from"`
+	To      int64 `json:"to"`
+	Missing int64 `json:"missing"`
+}
+
+// NumberDuplicate is an invoice number issued more than once.
+type NumberDuplicate struct {
+	Number     string  `json:"number"`
+	InvoiceIDs []int64 `json:"invoice_ids"`
+}
+
+// NumberGapsReport is the result of the invoice numbering audit for a year.
+type NumberGapsReport struct {
+	OrganisationID int64              `json:"organisation_id"`
+	Year           int                `json:"year"`
+	InvoicesCount  int64              `json:"invoices_count"`
+	FirstNumber    *int64             `json:"first_number"`
+	LastNumber     *int64             `json:"last_number"`
+	Gaps           []*NumberGap       `json:"gaps"`
+	Duplicates     []*NumberDuplicate `json:"duplicates"`
+	NonNumeric     []string           `json:"non_numeric"`
+}
+
+// The invoices of an organisation issued in a period, including archived ones. Deleted
+// invoices are excluded, so their numbers are reported as gaps.
+const numberingInvoicesQuery = `
+	SELECT id, number FROM invoices_history
+	WHERE organisation_id = $1 AND date >= $2 AND date < $3 AND destroyed_at IS NULL`
+
+// NumberGaps checks the invoice numbers of an organisation issued in the given year
+// for missing and duplicate numbers.
+func (m ReportModel) NumberGaps(ctx context.Context, organisationID int64, year int) (*NumberGapsReport, error) {
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+
+	report := &NumberGapsReport{
+		OrganisationID: organisationID,
+		Year:           year,
+		Gaps:           []*NumberGap{},
+		Duplicates:     []*NumberDuplicate{},
+		NonNumeric:     []string{},
+	}
+
+	// Create a context with a 3-second timeout, unless the caller has a deadline.
+	ctx, cancel := queryContext(ctx, 3*time.Second)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+	SELECT COUNT(*),
+		MIN(number::bigint) FILTER (WHERE number ~ '^[0-9]{1,18}$'),
+		MAX(number::bigint) FILTER (WHERE number ~ '^[0-9]{1,18}$')
+	FROM (%s) t`, numberingInvoicesQuery)
+
+	err := m.DB.QueryRow(ctx, query, organisationID, start, end).Scan(
+		&report.InvoicesCount,
+		&report.FirstNumber,
+		&report.LastNumber,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare every number with the next one issued, any difference above one
+	// means that the numbers in between are missing.
+	query = fmt.Sprintf(`
+	SELECT n + 1, next_n - 1, next_n - n - 1
+	FROM (
+		SELECT n, LEAD(n) OVER (ORDER BY n) AS next_n
+		FROM (
+			SELECT DISTINCT number::bigint AS n FROM (%s) t
+			WHERE number ~ '^[0-9]{1,18}$'
+		) numbers
+	) pairs
+	WHERE next_n - n > 1
+	ORDER BY n`, numberingInvoicesQuery)
+
+	rows, err := m.DB.Query(ctx, query, organisationID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var gap NumberGap
+
+		err := rows.Scan(&gap.From, &gap.To, &gap.Missing)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		report.Gaps = append(report.Gaps, &gap)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = fmt.Sprintf(`
+	SELECT number, array_agg(id ORDER BY id)
+	FROM (
+		SELECT id, number, COUNT(*) OVER (PARTITION BY number) AS issued
+		FROM (%s) t
+		WHERE number IS NOT NULL
+	) numbers
+	WHERE issued > 1
+	GROUP BY number
+	ORDER BY number`, numberingInvoicesQuery)
+
+	rows, err = m.DB.Query(ctx, query, organisationID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var duplicate NumberDuplicate
+
+		err := rows.Scan(&duplicate.Number, &duplicate.InvoiceIDs)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		report.Duplicates = append(report.Duplicates, &duplicate)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = fmt.Sprintf(`
+	SELECT COALESCE(number, '') FROM (%s) t
+	WHERE number IS NULL OR number !~ '^[0-9]{1,18}$'
+	ORDER BY id`, numberingInvoicesQuery)
+
+	rows, err = m.DB.Query(ctx, query, organisationID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var number string
+
+		err := rows.Scan(&number)
+		if err != nil {
+			return nil, err
+		}
+
+		report.NonNumeric = append(report.NonNumeric, number)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
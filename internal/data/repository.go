@@ -0,0 +1,176 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// repository runs the queries which are the same for every table: listing, fetching,
+// inserting, updating and deleting rows by id. Every query has a 3-second timeout and
+// a missing row is reported as ErrRecordNotFound. With softDelete rows are deleted by
+// setting destroyed_at and the deleted rows are left out of every query.
+//
+// The columns are read into the fields of T with the same db tag, fields without a
+// column are left empty.
+type repository[T any] struct {
+	DB         *pgxpool.Pool
+	table      string
+	columns    []string
+	softDelete bool
+}
+
+// where adds the condition leaving out deleted rows to the given one.
+func (r repository[T]) where(condition string) string {
+	if !r.softDelete {
+		return condition
+	}
+	if condition == "" {
+		return "destroyed_at IS NULL"
+	}
+	return fmt.Sprintf("(%s) AND destroyed_at IS NULL", condition)
+}
+
+func (r repository[T]) selectFrom(condition, orderBy string) string {
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(r.columns, ", "), r.table)
+	if condition = r.where(condition); condition != "" {
+		query += " WHERE " + condition
+	}
+	if orderBy != "" {
+		query += " ORDER BY " + orderBy
+	}
+	return query
+}
+
+// all returns the rows matching the condition, every row if it's empty. The deadline of
+// ctx replaces the 3-second timeout.
+func (r repository[T]) all(ctx context.Context, condition, orderBy string, args ...interface{}) ([]*T, error) {
+	ctx, cancel := queryContext(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := r.DB.Query(ctx, r.selectFrom(condition, orderBy), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByNameLax[T])
+}
+
+func (r repository[T]) get(id int64) (*T, error) {
+	// Ids start at 1, so there's no need to ask the database for anything less.
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return r.one(ctx, r.selectFrom("id = $1", ""), id)
+}
+
+// one returns the single row of the query.
+func (r repository[T]) one(ctx context.Context, query string, args ...interface{}) (*T, error) {
+	rows, err := r.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByNameLax[T])
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return record, nil
+}
+
+// insert inserts a row with the given values of the columns and reads all columns of
+// the new row back into the record.
+func (r repository[T]) insert(record *T, columns []string, args ...interface{}) error {
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) RETURNING %s",
+		r.table, strings.Join(columns, ", "), strings.Join(placeholders, ", "), strings.Join(r.columns, ", "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	inserted, err := r.one(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	*record = *inserted
+	return nil
+}
+
+// update sets the columns of the row with the id to the given values, touches
+// updated_at and reads all columns of the row back into the record.
+func (r repository[T]) update(record *T, id int64, columns []string, args ...interface{}) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	set := make([]string, len(columns))
+	for i, column := range columns {
+		set[i] = fmt.Sprintf("%s = $%d", column, i+1)
+	}
+
+	args = append(args, id)
+
+	query := fmt.Sprintf("UPDATE %s SET %s, updated_at = NOW() WHERE %s RETURNING %s",
+		r.table, strings.Join(set, ", "), r.where(fmt.Sprintf("id = $%d", len(args))), strings.Join(r.columns, ", "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	updated, err := r.one(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	*record = *updated
+	return nil
+}
+
+// delete deletes the row with the id, or marks it as deleted with softDelete, so rows
+// referenced by documents can be deleted as well.
+func (r repository[T]) delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", r.table)
+	if r.softDelete {
+		query = fmt.Sprintf("UPDATE %s SET destroyed_at = NOW(), updated_at = NOW() WHERE %s", r.table, r.where("id = $1"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := r.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// notFound reports a query which found no row as ErrRecordNotFound.
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
+}
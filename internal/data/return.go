@@ -0,0 +1,456 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrReturnExceedsShipped is returned when more of an item would be returned than the
+// invoice shipped minus what was returned before.
+var ErrReturnExceedsShipped = errors.New("more would be returned than was shipped")
+
+// Return is goods returned by the customer against an invoice, documented by a credit
+// note with Number. Its amount is without VAT like the amount of invoices; the amount
+// and the VAT settle the invoice like a payment.
+type Return struct {
+	ID             int64         `json:"id"`
+	Date           time.Time     `json:"date"`
+	Number         string        `json:"number"`
+	OrganisationID int64         `json:"organisation_id"`
+	CompanyID      int64         `json:"company_id"`
+	InvoiceID      int64         `json:"invoice_id"`
+	Reason         string        `json:"reason,omitempty"`
+	Amount         Money         `json:"amount"`
+	Vat            Money         `json:"vat"`
+	UserID         *int64        `json:"user_id,omitempty"`
+	Items          []*ReturnItem `json:"return_items"`
+	CreatedAt      *time.Time    `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time    `json:"updated_at,omitempty"`
+}
+
+// ReturnItem is a returned quantity of an invoice item. The other values are taken
+// from the invoice item, the amount and the VAT are its share of those of the item.
+type ReturnItem struct {
+	ID            int64   `json:"id"`
+	InvoiceItemID int64   `json:"invoice_item_id"`
+	Position      int     `json:"position"`
+	ProductID     int64   `json:"product_id,omitempty"`
+	Description   string  `json:"description"`
+	UnitID        int64   `json:"unit_id,omitempty"`
+	Quantity      float64 `json:"quantity"`
+	Price         Money   `json:"price"`
+	Amount        Money   `json:"amount"`
+	VatRateID     int64   `json:"vat_rate_id,omitempty"`
+	Vat           Money   `json:"vat"`
+}
+
+// ReturnableItem is an invoice item with the quantity which can still be returned.
+type ReturnableItem struct {
+	InvoiceItemID int64   `json:"invoice_item_id"`
+	Description   string  `json:"description"`
+	Shipped       float64 `json:"shipped"`
+	Returned      float64 `json:"returned"`
+	Returnable    float64 `json:"returnable"`
+}
+
+func ValidateReturn(v *validator.Validator, ret *Return, returnable map[int64]*ReturnableItem) {
+	v.Check(len(ret.Reason) <= 1024, "reason", "must not be more than 1024 bytes long")
+	v.Check(len(ret.Items) > 0, "return_items", "must contain at least one item")
+
+	itemIDs := make([]int64, 0, len(ret.Items))
+	for _, item := range ret.Items {
+		itemIDs = append(itemIDs, item.InvoiceItemID)
+
+		available, ok := returnable[item.InvoiceItemID]
+		if !ok {
+			v.AddError("return_items", "must only contain items of the invoice")
+			continue
+		}
+
+		v.Check(item.Quantity > 0, "return_items", "must all have a positive quantity")
+		v.Check(!exceedsReturnable(item.Quantity, available.Returnable), "return_items", "must not return more than was shipped and not returned yet")
+	}
+
+	v.Check(validator.Unique(itemIDs), "return_items", "must not contain an item twice")
+}
+
+// exceedsReturnable compares quantities with three decimal places, as they are stored.
+func exceedsReturnable(quantity, returnable float64) bool {
+	return math.Round(quantity*1000) > math.Round(returnable*1000)
+}
+
+// Define a ReturnModel struct type which wraps a pgx.Conn connection pool.
+type ReturnModel struct {
+	DB *pgxpool.Pool
+}
+
+// The items of an invoice with the quantities, amounts and VAT returned so far.
+const returnableItemsQuery = `
+	SELECT ii.id, COALESCE(ii.product_id, 0), COALESCE(ii.description, ''), COALESCE(ii.unit_id, 0),
+		COALESCE(ii.quantity, 0), COALESCE(ii.price, 0), COALESCE(ii.amount, 0), COALESCE(ii.vat_rate_id, 0),
+		COALESCE(ii.vat, 0), COALESCE(SUM(ri.quantity), 0), COALESCE(SUM(ri.amount), 0), COALESCE(SUM(ri.vat), 0)
+	FROM invoice_items ii
+	LEFT JOIN return_items ri ON ri.invoice_item_id = ii.id
+	WHERE ii.invoice_id = $1
+	GROUP BY ii.id
+	ORDER BY ii.position, ii.id`
+
+// returnedItem is an invoice item with what was returned of it so far.
+type returnedItem struct {
+	item        InvoiceItem
+	quantity    float64
+	amount, vat Money
+	returnable  float64
+}
+
+func queryReturnedItems(ctx context.Context, db dbtx, invoiceID int64) ([]*returnedItem, error) {
+	rows, err := db.Query(ctx, returnableItemsQuery, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*returnedItem, error) {
+		var r returnedItem
+		err := row.Scan(
+			&r.item.ID,
+			&r.item.ProductID,
+			&r.item.Description,
+			&r.item.UnitID,
+			&r.item.Quantity,
+			&r.item.Price,
+			&r.item.Amount,
+			&r.item.VatRateID,
+			&r.item.Vat,
+			&r.quantity,
+			&r.amount,
+			&r.vat,
+		)
+		r.returnable = math.Round((r.item.Quantity-r.quantity)*1000) / 1000
+		return &r, err
+	})
+}
+
+// Returnable returns the items of the invoice with the quantities which can still be
+// returned, by invoice item.
+func (m ReturnModel) Returnable(invoiceID int64) (map[int64]*ReturnableItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	items, err := queryReturnedItems(ctx, m.DB, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	returnable := make(map[int64]*ReturnableItem, len(items))
+	for _, r := range items {
+		returnable[r.item.ID] = &ReturnableItem{
+			InvoiceItemID: r.item.ID,
+			Description:   r.item.Description,
+			Shipped:       r.item.Quantity,
+			Returned:      r.quantity,
+			Returnable:    r.returnable,
+		}
+	}
+
+	return returnable, nil
+}
+
+// Insert records the return of the items against the invoice in one transaction
+// holding the lock of the invoice: the lines take the values of the invoice items and
+// the share of their amount and VAT for the returned quantity (the rest of it once the
+// whole quantity is returned), the credit note is numbered and the amount is allocated
+// to the invoice. Returned goods of a shipped invoice are restocked. ErrReturnExceedsShipped
+// is returned if a quantity isn't returnable any more, ErrRecordNotFound if the invoice
+// doesn't exist.
+func (m ReturnModel) Insert(ret *Return) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	err = lockInvoice(ctx, tx, ret.InvoiceID)
+	if err != nil {
+		return err
+	}
+
+	var mode string
+	query := `
+		SELECT COALESCE(o.rounding_mode, $2)
+		FROM invoices i
+		LEFT JOIN organisations o ON o.id = i.organisation_id
+		WHERE i.id = $1`
+
+	err = tx.QueryRow(ctx, query, ret.InvoiceID, DefaultRoundingPolicy.Mode).Scan(&mode)
+	if err != nil {
+		return err
+	}
+
+	returned, err := queryReturnedItems(ctx, tx, ret.InvoiceID)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int64]*returnedItem, len(returned))
+	for _, r := range returned {
+		byID[r.item.ID] = r
+	}
+
+	ret.Amount, ret.Vat = 0, 0
+	for i, line := range ret.Items {
+		r, ok := byID[line.InvoiceItemID]
+		if !ok || exceedsReturnable(line.Quantity, r.returnable) {
+			return ErrReturnExceedsShipped
+		}
+
+		item := r.item
+		line.Position = i + 1
+		line.ProductID = item.ProductID
+		line.Description = item.Description
+		line.UnitID = item.UnitID
+		line.Price = item.Price
+		line.VatRateID = item.VatRateID
+
+		if math.Round(line.Quantity*1000) == math.Round(r.returnable*1000) {
+			line.Amount = item.Amount - r.amount
+			line.Vat = item.Vat - r.vat
+		} else {
+			quantity, shipped := int64(math.Round(line.Quantity*1000)), int64(math.Round(item.Quantity*1000))
+			line.Amount = item.Amount.mulDiv(quantity, shipped, mode)
+			line.Vat = item.Vat.mulDiv(quantity, shipped, mode)
+		}
+
+		ret.Amount += line.Amount
+		ret.Vat += line.Vat
+	}
+
+	ret.Number, err = nextDocumentNumber(ctx, tx, ret.OrganisationID, DocumentCreditNote, ret.Date)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO returns (date, number, organisation_id, company_id, invoice_id, reason, amount, vat, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at, updated_at`
+
+	args := []interface{}{
+		ret.Date,
+		ret.Number,
+		ret.OrganisationID,
+		ret.CompanyID,
+		ret.InvoiceID,
+		ret.Reason,
+		ret.Amount,
+		ret.Vat,
+		ret.UserID,
+	}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&ret.ID, &ret.CreatedAt, &ret.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO return_items (return_id, invoice_item_id, position, product_id, description, unit_id,
+			quantity, price, amount, vat_rate_id, vat)
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5, NULLIF($6, 0), $7, $8, $9, NULLIF($10, 0), $11)
+		RETURNING id`
+
+	for _, line := range ret.Items {
+		args := []interface{}{
+			ret.ID,
+			line.InvoiceItemID,
+			line.Position,
+			line.ProductID,
+			line.Description,
+			line.UnitID,
+			line.Quantity,
+			line.Price,
+			line.Amount,
+			line.VatRateID,
+			line.Vat,
+		}
+
+		err = tx.QueryRow(ctx, query, args...).Scan(&line.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The invoice is billed with VAT, so the return settles its amount and VAT.
+	if ret.Amount+ret.Vat > 0 {
+		query = `
+			INSERT INTO payment_allocations (return_id, invoice_id, amount)
+			VALUES ($1, $2, $3)`
+
+		_, err = tx.Exec(ctx, query, ret.ID, ret.InvoiceID, ret.Amount+ret.Vat)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = restockReturn(ctx, tx, ret)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// restockReturn puts the returned goods of a shipped invoice back into the warehouse
+// they were shipped from, or the default warehouse of the organisation if that one has
+// been deleted since. Returned kits bring back their component goods. Goods which
+// weren't shipped aren't restocked, nor are any if the organisation has no warehouse
+// left.
+func restockReturn(ctx context.Context, tx pgx.Tx, ret *Return) error {
+	var warehouseID int64
+
+	query := `
+		SELECT COALESCE(
+			(SELECT w.id FROM stock_movements s INNER JOIN warehouses w ON w.id = s.warehouse_id
+			 WHERE s.invoice_id = $1 AND s.kind = $2 AND w.destroyed_at IS NULL LIMIT 1),
+			(SELECT id FROM warehouses WHERE organisation_id = $3 AND is_default AND destroyed_at IS NULL),
+			0)
+		WHERE EXISTS (SELECT 1 FROM stock_movements WHERE invoice_id = $1 AND kind = $2)`
+
+	err := tx.QueryRow(ctx, query, ret.InvoiceID, StockShipment, ret.OrganisationID).Scan(&warehouseID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	if warehouseID == 0 {
+		return nil
+	}
+
+	query = `
+		INSERT INTO stock_movements (warehouse_id, product_id, kind, date, quantity, invoice_id, return_id, user_id)
+		SELECT $1, line.product_id, $2, $3, SUM(line.quantity), $4, $6, $5
+		FROM (
+			SELECT ri.product_id, ri.quantity
+			FROM return_items ri
+			WHERE ri.return_id = $6
+			UNION ALL
+			SELECT kc.product_id, ROUND(ri.quantity * kc.quantity, 3)
+			FROM return_items ri
+			INNER JOIN products kit ON kit.id = ri.product_id
+			INNER JOIN kit_components kc ON kc.kit_id = kit.id
+			WHERE ri.return_id = $6 AND kit.product_type = $8
+		) AS line
+		WHERE line.product_id IN (SELECT product_id FROM stock_movements WHERE invoice_id = $4 AND kind = $7)
+		GROUP BY line.product_id
+		RETURNING ` + stockMovementColumns
+
+	_, err = moveStock(ctx, tx, warehouseID, query, warehouseID, StockReturn, ret.Date, ret.InvoiceID, ret.UserID, ret.ID, StockShipment, ProductTypeKit)
+
+	return err
+}
+
+// GetAll returns the returns of the invoice with their items, oldest first.
+func (m ReturnModel) GetAll(invoiceID int64) ([]*Return, error) {
+	query := `
+		SELECT id, date, COALESCE(number, ''), COALESCE(organisation_id, 0), COALESCE(company_id, 0),
+			invoice_id, COALESCE(reason, ''), amount, vat, user_id, created_at, updated_at
+		FROM returns
+		WHERE invoice_id = $1
+		ORDER BY date, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	returns, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Return, error) {
+		ret := Return{Items: []*ReturnItem{}}
+		err := row.Scan(
+			&ret.ID,
+			&ret.Date,
+			&ret.Number,
+			&ret.OrganisationID,
+			&ret.CompanyID,
+			&ret.InvoiceID,
+			&ret.Reason,
+			&ret.Amount,
+			&ret.Vat,
+			&ret.UserID,
+			&ret.CreatedAt,
+			&ret.UpdatedAt,
+		)
+		return &ret, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(returns) == 0 {
+		return returns, nil
+	}
+
+	byID := make(map[int64]*Return, len(returns))
+	ids := make([]int64, 0, len(returns))
+	for _, ret := range returns {
+		byID[ret.ID] = ret
+		ids = append(ids, ret.ID)
+	}
+
+	query = `
+		SELECT return_id, id, invoice_item_id, position, COALESCE(product_id, 0), COALESCE(description, ''),
+			COALESCE(unit_id, 0), quantity, price, amount, COALESCE(vat_rate_id, 0), vat
+		FROM return_items
+		WHERE return_id = ANY($1)
+		ORDER BY return_id, position, id`
+
+	rows, err = m.DB.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var returnID int64
+		var item ReturnItem
+
+		err := rows.Scan(
+			&returnID,
+			&item.ID,
+			&item.InvoiceItemID,
+			&item.Position,
+			&item.ProductID,
+			&item.Description,
+			&item.UnitID,
+			&item.Quantity,
+			&item.Price,
+			&item.Amount,
+			&item.VatRateID,
+			&item.Vat,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		byID[returnID].Items = append(byID[returnID].Items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return returns, nil
+}
@@ -0,0 +1,37 @@
+package data
+
+import (
+	"github.com/ElOtro/stockup-api/internal/validator"
+)
+
+// VAT rounding schemes. Per line the VAT of every line is rounded on its own, per
+// document the VAT is rounded once for each rate and the kopecks are spread over the
+// lines.
+const (
+	VatRoundingLine     = "line"
+	VatRoundingDocument = "document"
+)
+
+// Rounding modes of kopecks. half_up rounds halves away from zero, half_even to the
+// even kopeck and down cuts the fraction off.
+const (
+	RoundingHalfUp   = "half_up"
+	RoundingHalfEven = "half_even"
+	RoundingDown     = "down"
+)
+
+// RoundingPolicy holds the rounding rules of an organisation applied by the totals
+// calculator.
+type RoundingPolicy struct {
+	VatRounding string
+	Mode        string
+}
+
+// DefaultRoundingPolicy rounds VAT per line and halves up, as invoices were calculated
+// before the policy could be configured.
+var DefaultRoundingPolicy = RoundingPolicy{VatRounding: VatRoundingLine, Mode: RoundingHalfUp}
+
+func ValidateRoundingPolicy(v *validator.Validator, policy RoundingPolicy) {
+	v.Check(validator.In(policy.VatRounding, VatRoundingLine, VatRoundingDocument), "vat_rounding", "must be line or document")
+	v.Check(validator.In(policy.Mode, RoundingHalfUp, RoundingHalfEven, RoundingDown), "rounding_mode", "must be half_up, half_even or down")
+}
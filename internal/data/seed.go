@@ -1,47 +1,121 @@
 package data
 
 import (
+	"context"
 	"errors"
-	"math/rand"
-	"strconv"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/faker"
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog"
 )
 
-// Define a Seed struct type which wraps a pgx.Conn connection pool.
-type Seed struct {
-	DB     *pgxpool.Pool
-	Logger *zerolog.Logger
-	Models
+// SeedProfile defines how many records are generated by Seed().
+type SeedProfile struct {
+	Organisations int
+	Companies     int
+	Contacts      int
+	Agreements    int
+	Invoices      int
+	InvoiceItems  int
+}
+
+// SeedProfiles holds the available profiles for the -seed-profile flag. The "demo"
+// profile matches the dataset which was always generated by -seed.
+var SeedProfiles = map[string]SeedProfile{
+	"minimal": {
+		Organisations: 1,
+		Companies:     2,
+		Contacts:      1,
+		Agreements:    1,
+		Invoices:      2,
+		InvoiceItems:  1,
+	},
+	"demo": {
+		Organisations: 3,
+		Companies:     10,
+		Contacts:      2,
+		Agreements:    5,
+		Invoices:      5,
+		InvoiceItems:  3,
+	},
+	"load-test": {
+		Organisations: 5,
+		Companies:     500,
+		Contacts:      2,
+		Agreements:    3,
+		Invoices:      40,
+		InvoiceItems:  8,
+	},
 }
 
-func randomInt(i int) int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(i)
+// Scale multiplies the number of organisations, companies and invoices by the factor.
+// The per-company numbers of contacts and agreements and the number of invoice items
+// are kept, so the shape of the data doesn't change. Every count stays at least 1.
+func (p SeedProfile) Scale(factor float64) SeedProfile {
+	scale := func(n int) int {
+		scaled := int(math.Round(float64(n) * factor))
+		if scaled < 1 {
+			return 1
+		}
+		return scaled
+	}
+
+	p.Organisations = scale(p.Organisations)
+	p.Companies = scale(p.Companies)
+	p.Invoices = scale(p.Invoices)
+
+	return p
+}
+
+// SeedUser is a user created by Seed(). The role selects the permissions, see
+// RolePermissions. An empty password is generated and written to the log.
+type SeedUser struct {
+	Role     string
+	Name     string
+	Email    string
+	Password string
+}
+
+// Define a Seed struct type which wraps a pgx.Conn connection pool. Seed() generates
+// the same dataset for the same RandomSeed, a zero RandomSeed picks a random one.
+type Seed struct {
+	DB         *pgxpool.Pool
+	Logger     *zerolog.Logger
+	Profile    SeedProfile
+	RandomSeed int64
+	SeedUsers  []SeedUser
+	Faker      *faker.Faker
+	Models
 }
 
 // Create fake organisation.
 func (s Seed) CreateOrganisations() error {
 
-	for i := 0; i < 3; i++ {
-		input := faker.NewCompany()
+	for i := 0; i < s.Profile.Organisations; i++ {
+		input := s.Faker.NewCompany()
 
 		organisation := Organisation{
-			Name:       input.Name,
-			FullName:   input.FullName,
-			CEO:        input.CEO,
-			CEOTitle:   "CEO",
-			CFO:        input.CFO,
-			CFOTitle:   "CFO",
-			IsVatPayer: i%2 == 0,
+			Name:                 input.Name,
+			FullName:             input.FullName,
+			CEO:                  input.CEO,
+			CEOTitle:             "CEO",
+			CFO:                  input.CFO,
+			CFOTitle:             "CFO",
+			IsVatPayer:           i%2 == 0,
+			VatRounding:          DefaultRoundingPolicy.VatRounding,
+			RoundingMode:         DefaultRoundingPolicy.Mode,
+			FiscalYearStart:      1,
+			DraftWatermark:       DefaultDraftWatermark,
+			DraftHidesRequisites: true,
 			Details: &OrganisationDetails{
 				INN:     input.INN,
-				KPP:     input.INN,
-				OGRN:    input.INN,
+				KPP:     input.KPP,
+				OGRN:    input.OGRN,
 				Address: input.Address,
 			},
 		}
@@ -65,14 +139,15 @@ func (s Seed) CreateOrganisations() error {
 		bankAccount := BankAccount{}
 		if organisation.ID > 0 {
 
+			account := s.Faker.NewBankAccount()
 			bankAccount = BankAccount{
-				Name: "Test",
+				Name: account.Name,
 				Details: &BankAccountDetails{
-					BIK:         "1234567890",
-					Account:     "1234567890",
-					INN:         "1234567890",
-					KPP:         "1234567890",
-					CorrAccount: "1234567890",
+					BIK:         account.BIK,
+					Account:     account.Account,
+					INN:         input.INN,
+					KPP:         input.KPP,
+					CorrAccount: account.CorrAccount,
 				},
 			}
 			if ValidateBankAccount(v, &bankAccount); !v.Valid() {
@@ -93,6 +168,74 @@ func (s Seed) CreateOrganisations() error {
 
 }
 
+// Create the users, give them the permissions of their role and add them to all
+// organisations. Users which already exist keep their password.
+func (s Seed) CreateUsers() error {
+	organisationIDs, err := s.Helper.pluckIDs("organisations")
+	if err != nil {
+		return err
+	}
+
+	for _, input := range s.SeedUsers {
+		plaintext := input.Password
+		if plaintext == "" {
+			plaintext = s.Faker.NewPassword(12)
+		}
+
+		user := &User{
+			IsActive: true,
+			Name:     input.Name,
+			Email:    input.Email,
+		}
+
+		err := user.Password.Set(plaintext)
+		if err != nil {
+			return err
+		}
+
+		v := validator.New()
+
+		if ValidateUser(v, user); !v.Valid() {
+			for key, err := range v.Errors {
+				s.Logger.Info().Str("email", input.Email).Msgf("%s %s", key, err)
+			}
+			return errors.New("user is not valid")
+		}
+
+		err = s.Users.Insert(user)
+		switch {
+		case errors.Is(err, ErrDuplicateEmail):
+			user, err = s.Users.GetByEmail(input.Email)
+			if err != nil {
+				return err
+			}
+			plaintext = "(unchanged)"
+		case err != nil:
+			return err
+		}
+
+		_, err = s.Permissions.GrantRole(user.ID, input.Role)
+		if err != nil {
+			return err
+		}
+
+		for _, organisationID := range organisationIDs {
+			err = s.Organisations.AddUser(organisationID, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		s.Logger.Info().
+			Str("role", input.Role).
+			Str("email", user.Email).
+			Str("password", plaintext).
+			Msg("seeded user")
+	}
+
+	return nil
+}
+
 // Create fake vat_rates.
 func (s Seed) CreateVats() error {
 
@@ -154,17 +297,17 @@ func (s Seed) CreateUnits() error {
 // Create fake company.
 func (s Seed) CreateCompanies() error {
 
-	for i := 0; i < 10; i++ {
+	for i := 0; i < s.Profile.Companies; i++ {
 
-		input := faker.NewCompany()
+		input := s.Faker.NewCompany()
 		company := Company{
 			Name:        input.Name,
 			FullName:    input.FullName,
-			CompanyType: 1,
+			CompanyType: CompanyTypeLegalEntity,
 			Details: &CompanyDetails{
 				INN:     input.INN,
-				KPP:     input.INN,
-				OGRN:    input.INN,
+				KPP:     input.KPP,
+				OGRN:    input.OGRN,
 				Address: input.Address,
 			},
 		}
@@ -206,8 +349,8 @@ func (s Seed) CreateContacts(companyID int64) error {
 	// Initialize a new Validator instance.
 	v := validator.New()
 
-	for i := 0; i < 2; i++ {
-		input := faker.NewPerson(i%2 == 0)
+	for i := 0; i < s.Profile.Contacts; i++ {
+		input := s.Faker.NewPerson(i%2 == 0)
 		var role int
 		var title string
 		start := time.Now()
@@ -248,12 +391,14 @@ func (s Seed) CreateContacts(companyID int64) error {
 // Create fake contacts.
 func (s Seed) CreateAgreements(companyID int64) error {
 
-	for i := 0; i < 5; i++ {
-		input := faker.NewAgreement()
+	for i := 0; i < s.Profile.Agreements; i++ {
+		input := s.Faker.NewAgreement()
 		agreement := Agreement{
-			CompanyID: companyID,
-			Name:      input.Name,
-			StartAt:   &input.StartAt,
+			CompanyID:      companyID,
+			Name:           input.Name,
+			StartAt:        &input.StartAt,
+			EndAt:          input.EndAt,
+			WarningPercent: DefaultAgreementWarningPercent,
 		}
 
 		// Initialize a new Validator instance.
@@ -278,7 +423,7 @@ func (s Seed) CreateAgreements(companyID int64) error {
 
 // Create fake product.
 func (s Seed) CreateProducts() error {
-	fproducts := faker.ProductList()
+	fproducts := s.Faker.ProductList()
 	vatRateIDs, err := s.Helper.pluckIDs("vat_rates")
 	if err != nil {
 		return err
@@ -292,13 +437,13 @@ func (s Seed) CreateProducts() error {
 	for _, p := range fproducts {
 		product := Product{
 			IsActive:    true,
-			ProductType: 1,
+			ProductType: ProductTypeGoods,
 			Name:        p.Name,
 			Description: p.Description,
 			SKU:         p.SKU,
-			Price:       p.Price,
-			VatRateID:   &vatRateIDs[randomInt(len(vatRateIDs))],
-			UnitID:      &unitIDs[randomInt(len(unitIDs))],
+			Price:       NewMoney(p.Price),
+			VatRateID:   &vatRateIDs[s.Faker.Intn(len(vatRateIDs))],
+			UnitID:      &unitIDs[s.Faker.Intn(len(unitIDs))],
 		}
 
 		// Initialize a new Validator instance.
@@ -329,17 +474,31 @@ func (s Seed) CreateInvoices() error {
 		return err
 	}
 
+	// The products and bank accounts don't change while the invoices are created, so
+	// they are only read once.
+	products, err := s.Products.GetAll(ProductFilters{})
+	if err != nil {
+		return err
+	}
+
 	for _, organisationID := range organisationIDs {
-		invoiceNumber := 0
-		filters := CompanyFilters{Name: ""}
-		pagination := Pagination{Page: 1, Limit: 1000, Sort: "id", SortSafelist: []string{"id"}}
-		companies, _, err := s.Companies.GetAll(filters, pagination)
+		// Larger profiles create more companies than fit on a page, so take the ids.
+		companyIDs, err := s.Helper.pluckIDs("companies")
 		if err != nil {
 			return err
 		}
 
-		for _, v := range companies {
-			agreementFilters := AgreementFilters{CompanyID: v.ID}
+		bankAccounts, err := s.BankAccounts.GetAll(organisationID)
+		if err != nil {
+			return err
+		}
+		var bankAccountID int64
+		if len(bankAccounts) > 0 {
+			bankAccountID = bankAccounts[0].ID
+		}
+
+		for _, companyID := range companyIDs {
+			agreementFilters := AgreementFilters{CompanyID: companyID}
 			pagination := Pagination{Page: 1, Limit: 1000, Sort: "id", SortSafelist: []string{"id"}}
 			agreements, _, err := s.Agreements.GetAll(agreementFilters, pagination)
 			if err != nil {
@@ -347,29 +506,18 @@ func (s Seed) CreateInvoices() error {
 			}
 			var agreement *Agreement
 			if len(agreements) > 0 {
-				agreement = agreements[randomInt(len(agreements))]
+				agreement = agreements[s.Faker.Intn(len(agreements))]
 			}
-			for i := 0; i < 5; i++ {
-				invoiceNumber += 1
-				// get bank_accounts
-				bankAccounts, err := s.BankAccounts.GetAll(organisationID)
-				if err != nil {
-					return err
-				}
-				var bankAccount *BankAccount
-				var bankAccountID int64
-				if len(bankAccounts) > 0 {
-					bankAccount = bankAccounts[0]
-					bankAccountID = bankAccount.ID
-				}
-
+			for i := 0; i < s.Profile.Invoices; i++ {
+				input := s.Faker.NewInvoice()
 				invoice := Invoice{
 					IsActive:       true,
-					Date:           time.Now(),
-					Number:         strconv.Itoa(invoiceNumber),
+					Date:           input.Date,
+					DueDate:        &input.DueDate,
 					OrganisationID: organisationID,
-					CompanyID:      v.ID,
+					CompanyID:      companyID,
 					AgreementID:    agreement.ID,
+					VatMode:        VatOnTop,
 				}
 
 				if bankAccountID > 0 {
@@ -388,24 +536,22 @@ func (s Seed) CreateInvoices() error {
 					return errors.New("invoice is not valid")
 				}
 
-				// insert to base new Invoice
-				err = s.Invoices.Insert(&invoice)
+				items, err := s.NewInvoiceItems(products)
 				if err != nil {
 					return err
 				}
 
-				if invoice.ID > 0 {
-					err = s.CreateInvoiceItems(invoice.ID)
-					if err != nil {
-						return err
-					}
-
-					err = s.Invoices.UpdateTotals(invoice.ID)
-					if err != nil {
-						return err
-					}
+				// The items are inserted in one batch with the invoice, which calculates
+				// the totals once instead of after every item.
+				err = s.Invoices.InsertWithItems(&invoice, items)
+				if err != nil {
+					return err
 				}
 
+				err = s.CreatePayments(invoice.ID, input)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -413,35 +559,71 @@ func (s Seed) CreateInvoices() error {
 	return nil
 }
 
-// Create fake invoice.
-func (s Seed) CreateInvoiceItems(invoiceID int64) error {
-	products, err := s.Products.GetAll()
+// Create fake payments for the invoice and apply them to it. Unpaid invoices which are
+// past their due date show up as overdue in the reports.
+func (s Seed) CreatePayments(invoiceID int64, input *faker.Invoice) error {
+	invoice, err := s.Invoices.Get(invoiceID)
 	if err != nil {
 		return err
 	}
 
-	for i := 1; i < 4; i++ {
+	for i, p := range s.Faker.NewPaymentHistory(input, invoice.Amount.Float64()) {
+		payment := Payment{
+			Date:           p.Date,
+			Number:         fmt.Sprintf("%s/%d", invoice.Number, i+1),
+			OrganisationID: invoice.OrganisationID,
+			CompanyID:      invoice.CompanyID,
+			Amount:         NewMoney(p.Amount),
+			Description:    fmt.Sprintf("Оплата по счету № %s", invoice.Number),
+		}
+
+		if invoice.BankAccountID > 0 {
+			payment.BankAccountID = &invoice.BankAccountID
+		}
+
+		v := validator.New()
+
+		if ValidatePayment(v, &payment); !v.Valid() {
+			for _, err := range v.Errors {
+				s.Logger.Info().Msg(err)
+			}
+			return errors.New("payment is not valid")
+		}
+
+		err = s.Payments.Insert(&payment)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.Payments.Apply(invoice, []int64{payment.ID})
+		if err != nil && !errors.Is(err, ErrInvoiceSettled) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create fake items of an invoice from the products.
+func (s Seed) NewInvoiceItems(products []*Product) ([]*InvoiceItem, error) {
+	items := []*InvoiceItem{}
+
+	for i := 1; i <= s.Profile.InvoiceItems; i++ {
 		var product *Product
 		if len(products) > 0 {
-			product = products[randomInt(len(products))]
+			product = products[s.Faker.Intn(len(products))]
 		}
 		if product != nil {
-			quantity := float64(randomInt(10))
-			amount := float64(quantity) * product.Price
-			vat := 0.0
-			if product.VatRate.Rate > 0 {
-				vat = amount * (product.VatRate.Rate / 100)
-			}
+			// The amount and VAT are calculated when the item is inserted.
 			invoiceItem := InvoiceItem{
-				Position:    i,
-				ProductID:   product.ID,
-				Description: product.Description,
-				UnitID:      product.Unit.ID,
-				Quantity:    quantity,
-				Price:       product.Price,
-				Amount:      amount,
-				VatRateID:   product.VatRate.ID,
-				Vat:         vat,
+				Position:     i,
+				ProductID:    product.ID,
+				Description:  product.Description,
+				UnitID:       product.Unit.ID,
+				Quantity:     float64(s.Faker.Intn(10)),
+				Price:        product.Price,
+				DiscountType: DiscountPercent,
+				VatRateID:    product.VatRate.ID,
 			}
 
 			v := validator.New()
@@ -452,27 +634,110 @@ func (s Seed) CreateInvoiceItems(invoiceID int64) error {
 				for _, err := range v.Errors {
 					s.Logger.Info().Msg(err)
 				}
-				return errors.New("invoiceItem is not valid")
+				return nil, errors.New("invoiceItem is not valid")
 			}
 
-			// insert to base new Invoice
-			err = s.InvoiceItems.Insert(invoiceID, &invoiceItem)
-			if err != nil {
-				return err
-			}
+			items = append(items, &invoiceItem)
 		}
 	}
 
+	return items, nil
+}
+
+// seedTables lists the business tables, children before the tables they reference.
+// Users, their permissions and tokens are kept, so the developer can still log in;
+// their preferences point at the seeded organisations and are removed.
+var seedTables = []string{
+	"organisation_deletions",
+	"invoice_links",
+	"attachments",
+	"attachment_files",
+	"generated_documents",
+	"user_preferences",
+	"payment_reminder_rules",
+	"sms_settings",
+	"integration_tokens",
+	"accounting_syncs",
+	"accounting_connectors",
+	"closed_periods",
+	"invoice_sendings",
+	"send_batches",
+	"communications",
+	"description_snippets",
+	"document_sequences",
+	"stock_balances",
+	"stock_movements",
+	"warehouses",
+	"return_items",
+	"returns",
+	"totals_mismatches",
+	"billing_plan_usages",
+	"billing_plan_periods",
+	"billing_plans",
+	"feature_flags",
+	"organisation_requisites",
+	"kit_components",
+	"invoice_penalties",
+	"payment_allocations",
+	"payments",
+	"act_items",
+	"acts",
+	"invoice_items_archive",
+	"invoices_archive",
+	"invoice_items",
+	"invoices",
+	"projects",
+	"products",
+	"agreements",
+	"contacts",
+	"company_branches",
+	"companies",
+	"company_groups",
+	"bank_accounts",
+	"users_organisations",
+	"organisation_taxation",
+	"organisations",
+	"units",
+	"vat_rates",
+	"audit_events",
+}
+
+// Reset removes all business data and restarts the id sequences. PostgreSQL refuses to
+// truncate a referenced table on its own, so all tables go in a single statement.
+func (s Seed) Reset() error {
+	query := fmt.Sprintf("TRUNCATE TABLE %s RESTART IDENTITY", strings.Join(seedTables, ", "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := s.DB.Exec(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Info().Strs("tables", seedTables).Msg("database reset")
+
 	return nil
 }
 
 func (s Seed) Seed() {
+	// All random values come from one generator, which makes the whole run reproducible.
+	if s.RandomSeed == 0 {
+		s.RandomSeed = time.Now().UnixNano()
+	}
+	s.Faker = faker.New(s.RandomSeed)
+	s.Logger.Info().Int64("random_seed", s.RandomSeed).Msg("seeding database")
 
 	// create organisations
 	err := s.CreateOrganisations()
 	if err != nil {
 		s.Logger.Err(err)
 	}
+	// create users
+	err = s.CreateUsers()
+	if err != nil {
+		s.Logger.Err(err)
+	}
 	// create vat_rates
 	err = s.CreateVats()
 	if err != nil {
@@ -0,0 +1,283 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The states of an invoice of a send batch. Failed invoices are not retried, they are
+// queued again with a new batch.
+const (
+	SendingPending = "pending"
+	SendingSent    = "sent"
+	SendingFailed  = "failed"
+)
+
+// The number of invoices a batch may queue.
+const maxSendBatchInvoices = 500
+
+// SendBatch is a set of invoices queued for emailing at ScheduledAt.
+type SendBatch struct {
+	ID             int64             `json:"id"`
+	OrganisationID int64             `json:"organisation_id"`
+	UserID         *int64            `json:"user_id,omitempty"`
+	ScheduledAt    time.Time         `json:"scheduled_at"`
+	Progress       SendProgress      `json:"progress"`
+	Sendings       []*InvoiceSending `json:"sendings,omitempty"`
+	CreatedAt      *time.Time        `json:"created_at,omitempty"`
+}
+
+// SendProgress counts the invoices of a batch by their state. The batch is finished
+// when none are pending.
+type SendProgress struct {
+	Total    int  `json:"total"`
+	Pending  int  `json:"pending"`
+	Sent     int  `json:"sent"`
+	Failed   int  `json:"failed"`
+	Finished bool `json:"finished"`
+}
+
+// InvoiceSending is the result of emailing an invoice of a batch.
+type InvoiceSending struct {
+	ID             int64      `json:"id"`
+	SendBatchID    int64      `json:"-"`
+	OrganisationID int64      `json:"-"`
+	InvoiceID      int64      `json:"invoice_id"`
+	Number         string     `json:"number"`
+	ContactID      *int64     `json:"contact_id,omitempty"`
+	Status         string     `json:"status"`
+	Subject        *string    `json:"subject,omitempty"`
+	Error          *string    `json:"error,omitempty"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+}
+
+func ValidateSendBatch(v *validator.Validator, batch *SendBatch, invoiceIDs []int64) {
+	v.Check(batch.OrganisationID != 0, "organisation_id", "must be provided")
+	v.Check(len(invoiceIDs) > 0, "invoice_ids", "must contain at least one invoice")
+	v.Check(len(invoiceIDs) <= maxSendBatchInvoices, "invoice_ids", "must not contain more than 500 invoices")
+	v.Check(validator.Unique(invoiceIDs), "invoice_ids", "must not contain duplicate values")
+}
+
+// Define a SendBatchModel struct type which wraps a pgx.Conn connection pool.
+type SendBatchModel struct {
+	DB *pgxpool.Pool
+}
+
+// MissingInvoices returns the invoices which are not invoices of the organisation,
+// because they don't exist, are deleted or archived, or belong to another one.
+func (m SendBatchModel) MissingInvoices(organisationID int64, invoiceIDs []int64) ([]int64, error) {
+	query := `
+		SELECT ids.id FROM unnest($1::bigint[]) AS ids (id)
+		WHERE NOT EXISTS (
+			SELECT 1 FROM invoices i
+			WHERE i.id = ids.id AND i.organisation_id = $2 AND i.destroyed_at IS NULL)
+		ORDER BY ids.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, invoiceIDs, organisationID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[int64])
+}
+
+// Insert queues the invoices with a new batch.
+func (m SendBatchModel) Insert(batch *SendBatch, invoiceIDs []int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO send_batches (organisation_id, user_id, scheduled_at)
+		VALUES ($1, $2, $3)
+		RETURNING id, scheduled_at, created_at`
+
+	err = tx.QueryRow(ctx, query, batch.OrganisationID, batch.UserID, batch.ScheduledAt).
+		Scan(&batch.ID, &batch.ScheduledAt, &batch.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO invoice_sendings (send_batch_id, invoice_id)
+		SELECT $1, unnest($2::bigint[])`, batch.ID, invoiceIDs)
+	if err != nil {
+		return err
+	}
+
+	batch.Progress = SendProgress{Total: len(invoiceIDs), Pending: len(invoiceIDs)}
+
+	return tx.Commit(ctx)
+}
+
+// Get returns the batch with the results of its invoices.
+func (m SendBatchModel) Get(id int64) (*SendBatch, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, organisation_id, user_id, scheduled_at, created_at
+		FROM send_batches
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var batch SendBatch
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&batch.ID,
+		&batch.OrganisationID,
+		&batch.UserID,
+		&batch.ScheduledAt,
+		&batch.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	query = `
+		SELECT s.id, s.invoice_id, COALESCE(i.number, ''), s.contact_id, s.status, s.subject, s.error, s.sent_at
+		FROM invoice_sendings s
+		LEFT JOIN invoices_history i ON i.id = s.invoice_id
+		WHERE s.send_batch_id = $1
+		ORDER BY s.id`
+
+	rows, err := m.DB.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch.Sendings = []*InvoiceSending{}
+
+	for rows.Next() {
+		sending := InvoiceSending{SendBatchID: batch.ID, OrganisationID: batch.OrganisationID}
+
+		err := rows.Scan(
+			&sending.ID,
+			&sending.InvoiceID,
+			&sending.Number,
+			&sending.ContactID,
+			&sending.Status,
+			&sending.Subject,
+			&sending.Error,
+			&sending.SentAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		batch.Progress.Total++
+		switch sending.Status {
+		case SendingPending:
+			batch.Progress.Pending++
+		case SendingSent:
+			batch.Progress.Sent++
+		case SendingFailed:
+			batch.Progress.Failed++
+		}
+
+		batch.Sendings = append(batch.Sendings, &sending)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	batch.Progress.Finished = batch.Progress.Pending == 0
+
+	return &batch, nil
+}
+
+// Due returns up to limit pending invoices of the batches which are scheduled by now,
+// the batches scheduled first first.
+func (m SendBatchModel) Due(limit int) ([]*InvoiceSending, error) {
+	query := `
+		SELECT s.id, s.send_batch_id, b.organisation_id, s.invoice_id, s.status
+		FROM invoice_sendings s
+		JOIN send_batches b ON b.id = s.send_batch_id
+		WHERE s.status = $1 AND b.scheduled_at <= NOW()
+		ORDER BY b.scheduled_at, s.id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, SendingPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sendings := []*InvoiceSending{}
+
+	for rows.Next() {
+		var sending InvoiceSending
+
+		err := rows.Scan(&sending.ID, &sending.SendBatchID, &sending.OrganisationID, &sending.InvoiceID, &sending.Status)
+		if err != nil {
+			return nil, err
+		}
+
+		sendings = append(sendings, &sending)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sendings, nil
+}
+
+// SetResult records the outcome of sending the invoice. An invoice which has been sent
+// is no longer a draft.
+func (m SendBatchModel) SetResult(sending *InvoiceSending) error {
+	query := `
+		WITH sending AS (
+			UPDATE invoice_sendings
+			SET status = $1, contact_id = $2, subject = $3, error = $4, sent_at = NOW()
+			WHERE id = $5
+			RETURNING invoice_id, status, sent_at
+		), sent AS (
+			` + markInvoiceSent("SELECT invoice_id FROM sending WHERE status = 'sent'") + `
+		)
+		SELECT sent_at FROM sending`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, sending.Status, sending.ContactID, sending.Subject, sending.Error, sending.ID).
+		Scan(&sending.SentAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/encryption"
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The SMS providers an organisation can send text messages through.
+const (
+	SMSProviderSMSC   = "smsc"
+	SMSProviderTwilio = "twilio"
+)
+
+var SMSProviders = []string{SMSProviderSMSC, SMSProviderTwilio}
+
+// SMSSettings are the SMS provider of an organisation and its credentials. For Twilio
+// the login is the account SID, the password the auth token and the sender the phone
+// number messages are sent from. The password is never returned, HasPassword tells
+// whether it's set.
+type SMSSettings struct {
+	OrganisationID int64      `json:"organisation_id"`
+	Provider       string     `json:"provider"`
+	Login          string     `json:"login"`
+	Password       string     `json:"-"`
+	HasPassword    bool       `json:"has_password"`
+	Sender         string     `json:"sender,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+func ValidateSMSSettings(v *validator.Validator, settings *SMSSettings) {
+	v.Check(validator.In(settings.Provider, SMSProviders...), "provider", "must be smsc or twilio")
+	v.Check(settings.Login != "", "login", "must be provided")
+	v.Check(len(settings.Login) <= 100, "login", "must not be more than 100 bytes long")
+	v.Check(settings.Password != "", "password", "must be provided")
+	v.Check(len(settings.Sender) <= 20, "sender", "must not be more than 20 bytes long")
+	v.Check(settings.Provider != SMSProviderTwilio || settings.Sender != "", "sender", "must be provided for twilio")
+}
+
+// Define a SMSSettingsModel struct type which wraps a pgx.Conn connection pool.
+// Passwords are stored encrypted with the Keyring.
+type SMSSettingsModel struct {
+	DB      *pgxpool.Pool
+	Keyring *encryption.Keyring
+}
+
+// Get returns the SMS settings of the organisation.
+func (m SMSSettingsModel) Get(organisationID int64) (*SMSSettings, error) {
+	query := `
+		SELECT organisation_id, provider, login, COALESCE(password, ''), COALESCE(sender, ''), created_at, updated_at
+		FROM sms_settings
+		WHERE organisation_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var settings SMSSettings
+
+	err := m.DB.QueryRow(ctx, query, organisationID).Scan(
+		&settings.OrganisationID,
+		&settings.Provider,
+		&settings.Login,
+		&settings.Password,
+		&settings.Sender,
+		&settings.CreatedAt,
+		&settings.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	settings.Password, err = m.Keyring.Decrypt(settings.Password)
+	if err != nil {
+		return nil, err
+	}
+	settings.HasPassword = settings.Password != ""
+
+	return &settings, nil
+}
+
+// Save stores the SMS settings of the organisation, replacing the previous ones.
+func (m SMSSettingsModel) Save(settings *SMSSettings) error {
+	password, err := m.Keyring.Encrypt(settings.Password)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO sms_settings (organisation_id, provider, login, password, sender)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))
+		ON CONFLICT (organisation_id) DO UPDATE
+		SET provider = EXCLUDED.provider, login = EXCLUDED.login, password = EXCLUDED.password,
+			sender = EXCLUDED.sender, updated_at = NOW()
+		RETURNING created_at, updated_at`
+
+	args := []interface{}{
+		settings.OrganisationID,
+		settings.Provider,
+		settings.Login,
+		password,
+		settings.Sender,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRow(ctx, query, args...).Scan(&settings.CreatedAt, &settings.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	settings.HasPassword = settings.Password != ""
+
+	return nil
+}
+
+// Delete removes the SMS settings of the organisation.
+func (m SMSSettingsModel) Delete(organisationID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, "DELETE FROM sms_settings WHERE organisation_id = $1", organisationID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RotateKeys re-encrypts the passwords with the current key and returns the number of
+// settings updated.
+func (m SMSSettingsModel) RotateKeys() (int64, error) {
+	type row struct {
+		organisationID int64
+		password       *string
+	}
+
+	rows, err := m.DB.Query(context.Background(), "SELECT organisation_id, password FROM sms_settings WHERE password IS NOT NULL ORDER BY organisation_id")
+	if err != nil {
+		return 0, err
+	}
+
+	// Read all rows first, the connection can't be used for updates while the
+	// resultset is open.
+	settings := []*row{}
+	for rows.Next() {
+		var r row
+
+		err := rows.Scan(&r.organisationID, &r.password)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		settings = append(settings, &r)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var updated int64
+	for _, r := range settings {
+		changed, err := rotateFields(m.Keyring, []*string{r.password})
+		if err != nil {
+			return updated, fmt.Errorf("sms settings of organisation %d: %w", r.organisationID, err)
+		}
+
+		if !changed {
+			continue
+		}
+
+		_, err = m.DB.Exec(context.Background(), "UPDATE sms_settings SET password = $1 WHERE organisation_id = $2", r.password, r.organisationID)
+		if err != nil {
+			return updated, err
+		}
+
+		updated++
+	}
+
+	return updated, nil
+}
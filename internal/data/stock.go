@@ -0,0 +1,401 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrInsufficientStock is returned when a movement would take more goods from a
+// warehouse than it holds. The names of the goods short follow in the message.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// ErrNotGoods is returned when a movement moves a product which isn't goods, e.g. a
+// service or a kit, or which has been deleted.
+var ErrNotGoods = errors.New("only goods are stocked")
+
+// The kinds of stock movements. Receipts and write-offs are recorded for a warehouse,
+// shipments when an invoice is shipped and returns when goods of a shipped invoice are
+// returned.
+const (
+	StockReceipt  = "receipt"
+	StockWriteOff = "write_off"
+	StockShipment = "shipment"
+	StockReturn   = "return"
+)
+
+// StockMovement is a change of the quantity of goods in a warehouse, positive when
+// goods come in and negative when they go out.
+type StockMovement struct {
+	ID          int64      `json:"id"`
+	WarehouseID int64      `json:"warehouse_id"`
+	ProductID   int64      `json:"product_id"`
+	Product     *Product   `json:"product,omitempty"`
+	Kind        string     `json:"kind"`
+	Date        time.Time  `json:"date"`
+	Quantity    float64    `json:"quantity"`
+	InvoiceID   *int64     `json:"invoice_id,omitempty"`
+	ReturnID    *int64     `json:"return_id,omitempty"`
+	Description *string    `json:"description,omitempty"`
+	UserID      *int64     `json:"user_id,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
+
+// StockLevel is the quantity on hand of a product over the warehouses which hold it,
+// and per warehouse.
+type StockLevel struct {
+	Product    *Product          `json:"product"`
+	Quantity   float64           `json:"quantity"`
+	Warehouses []*WarehouseStock `json:"warehouses"`
+}
+
+// WarehouseStock is the quantity of a product in a warehouse.
+type WarehouseStock struct {
+	ID       int64   `json:"id"`
+	Name     string  `json:"name"`
+	Quantity float64 `json:"quantity"`
+}
+
+// ValidateStockItems checks the goods of a receipt or write-off: every product once,
+// in a positive quantity with at most three decimal places, as they are stored.
+func ValidateStockItems(v *validator.Validator, items []*StockMovement) {
+	v.Check(len(items) > 0, "items", "must contain at least one product")
+	v.Check(len(items) <= 500, "items", "must not contain more than 500 products")
+
+	productIDs := make([]int64, 0, len(items))
+
+	for _, item := range items {
+		v.Check(item.ProductID > 0, "items", "must all have a product_id")
+		v.Check(item.Quantity > 0, "items", "must all have a positive quantity")
+		v.Check(item.Quantity == math.Round(item.Quantity*1000)/1000, "items", "must have quantities with at most three decimal places")
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	v.Check(validator.Unique(productIDs), "items", "must not contain a product twice")
+}
+
+type StockMovementFilters struct {
+	WarehouseID int64
+	ProductID   int64
+	Kind        string
+	Start       *time.Time
+	End         *time.Time
+}
+
+type StockFilters struct {
+	OrganisationID int64
+	WarehouseID    int64
+	ProductID      int64
+}
+
+// Define a StockModel struct type which wraps a pgx.Conn connection pool.
+type StockModel struct {
+	DB *pgxpool.Pool
+}
+
+// Record receives the goods of the items into the warehouse or writes them off, by
+// the kind, in one transaction. The items get the values of the movement: the date,
+// the description and the user. It returns ErrNotGoods if a product isn't goods,
+// ErrInsufficientStock if more would be written off than the warehouse holds and
+// ErrRecordNotFound if the warehouse doesn't exist.
+func (m StockModel) Record(kind string, movement *StockMovement, items []*StockMovement) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	productIDs := make([]int64, len(items))
+	quantities := make([]float64, len(items))
+
+	sign := 1.0
+	if kind == StockWriteOff {
+		sign = -1
+	}
+
+	for i, item := range items {
+		productIDs[i] = item.ProductID
+		quantities[i] = sign * item.Quantity
+	}
+
+	var goods int
+
+	err = tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM products
+		WHERE id = ANY($1) AND product_type = $2 AND destroyed_at IS NULL`, productIDs, ProductTypeGoods).Scan(&goods)
+	if err != nil {
+		return err
+	}
+
+	if goods < len(productIDs) {
+		return ErrNotGoods
+	}
+
+	query := `
+		INSERT INTO stock_movements (warehouse_id, product_id, kind, date, quantity, description, user_id)
+		SELECT $1, item.product_id, $2, $3, item.quantity, $4, $5
+		FROM unnest($6::bigint[], $7::numeric[]) AS item (product_id, quantity)
+		RETURNING ` + stockMovementColumns
+
+	args := []interface{}{movement.WarehouseID, kind, movement.Date, movement.Description, movement.UserID, productIDs, quantities}
+
+	movements, err := moveStock(ctx, tx, movement.WarehouseID, query, args...)
+	if err != nil {
+		return err
+	}
+
+	// The products of the items are unique, so the movements are matched by them.
+	for _, moved := range movements {
+		for _, item := range items {
+			if item.ProductID == moved.ProductID {
+				*item = *moved
+			}
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// moveStock runs the query inserting the movements of goods into the warehouse, which
+// has to return the columns of stockMovementColumns, and adds them to the balances.
+// The warehouse is locked against its deletion meanwhile, ErrRecordNotFound is returned
+// if it doesn't exist. ErrInsufficientStock is returned if a balance would be negative,
+// the transaction has to be rolled back then.
+func moveStock(ctx context.Context, tx pgx.Tx, warehouseID int64, query string, args ...interface{}) ([]*StockMovement, error) {
+	err := tx.QueryRow(ctx, `
+		SELECT id FROM warehouses WHERE id = $1 AND destroyed_at IS NULL FOR SHARE`, warehouseID).Scan(new(int64))
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	movements, err := pgx.CollectRows(rows, scanStockMovement)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(movements) == 0 {
+		return movements, nil
+	}
+
+	productIDs := make([]int64, len(movements))
+	quantities := make([]float64, len(movements))
+
+	for i, movement := range movements {
+		productIDs[i] = movement.ProductID
+		quantities[i] = movement.Quantity
+	}
+
+	// The rows of the balances are locked by the update, in the order of the products,
+	// so concurrent movements of the same goods wait for each other and see the balance
+	// the other one left. The names of the goods whose balance went negative are
+	// returned.
+	query = `
+		WITH balances AS (
+			INSERT INTO stock_balances AS b (warehouse_id, product_id, quantity)
+			SELECT $1, item.product_id, SUM(item.quantity)
+			FROM unnest($2::bigint[], $3::numeric[]) AS item (product_id, quantity)
+			GROUP BY item.product_id
+			ORDER BY item.product_id
+			ON CONFLICT (warehouse_id, product_id) DO UPDATE
+			SET quantity = b.quantity + EXCLUDED.quantity, updated_at = NOW()
+			RETURNING product_id, quantity
+		)
+		SELECT COALESCE(array_agg(p.name ORDER BY p.id), '{}')
+		FROM balances INNER JOIN products p ON p.id = balances.product_id
+		WHERE balances.quantity < 0`
+
+	var short []string
+
+	err = tx.QueryRow(ctx, query, warehouseID, productIDs, quantities).Scan(&short)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(short) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInsufficientStock, strings.Join(short, ", "))
+	}
+
+	return movements, nil
+}
+
+const stockMovementColumns = `id, warehouse_id, product_id, kind, date, quantity, invoice_id, return_id,
+	description, user_id, created_at`
+
+func scanStockMovement(row pgx.CollectableRow) (*StockMovement, error) {
+	var movement StockMovement
+
+	err := row.Scan(
+		&movement.ID,
+		&movement.WarehouseID,
+		&movement.ProductID,
+		&movement.Kind,
+		&movement.Date,
+		&movement.Quantity,
+		&movement.InvoiceID,
+		&movement.ReturnID,
+		&movement.Description,
+		&movement.UserID,
+		&movement.CreatedAt,
+	)
+
+	return &movement, err
+}
+
+// GetAll returns the movements of goods in the warehouse, with the product and the
+// invoice or return which moved them.
+func (m StockModel) GetAll(filters StockMovementFilters, pagination Pagination) ([]*StockMovement, Metadata, error) {
+	f := filter{}
+
+	f.where("warehouse_id = " + f.arg(filters.WarehouseID))
+
+	if filters.ProductID > 0 {
+		f.where("product_id = " + f.arg(filters.ProductID))
+	}
+
+	if filters.Kind != "" {
+		f.where("kind = " + f.arg(filters.Kind))
+	}
+
+	f.dateRange("date", filters.Start, filters.End)
+
+	// The count takes the arguments of the filter only, without the limit and offset.
+	filterQuery, args := f.clause(), f.args
+
+	query := fmt.Sprintf(`
+	SELECT id, warehouse_id, product_id,
+		(SELECT row_to_json(row) FROM (SELECT id, name, sku FROM products WHERE products.id = product_id) row) AS product,
+		kind, date, quantity, invoice_id, return_id, description, user_id, created_at
+	FROM stock_movements
+	%s
+	ORDER BY %s %s, id
+	LIMIT %s OFFSET %s`, filterQuery, pagination.sortColumn(), pagination.sortDirection(),
+		f.arg(pagination.limit()), f.arg(pagination.offset()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	movements := []*StockMovement{}
+
+	for rows.Next() {
+		var movement StockMovement
+
+		err := rows.Scan(
+			&movement.ID,
+			&movement.WarehouseID,
+			&movement.ProductID,
+			&movement.Product,
+			&movement.Kind,
+			&movement.Date,
+			&movement.Quantity,
+			&movement.InvoiceID,
+			&movement.ReturnID,
+			&movement.Description,
+			&movement.UserID,
+			&movement.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movements = append(movements, &movement)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	var totalRecords int64
+
+	err = m.DB.QueryRow(ctx, "SELECT COUNT(*) FROM stock_movements"+filterQuery, args...).Scan(&totalRecords)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return movements, calculateMetadata(totalRecords, pagination.Page, pagination.Limit), nil
+}
+
+// OnHand returns the quantities on hand of the goods in the warehouses of the
+// organisation, by product and by warehouse. Goods which aren't held any more are left
+// out, deleted products too unless they are still held.
+func (m StockModel) OnHand(filters StockFilters) ([]*StockLevel, error) {
+	f := filter{}
+
+	f.where("w.destroyed_at IS NULL")
+	f.where("b.quantity <> 0")
+
+	if filters.OrganisationID > 0 {
+		f.where("w.organisation_id = " + f.arg(filters.OrganisationID))
+	}
+
+	if filters.WarehouseID > 0 {
+		f.where("w.id = " + f.arg(filters.WarehouseID))
+	}
+
+	if filters.ProductID > 0 {
+		f.where("b.product_id = " + f.arg(filters.ProductID))
+	}
+
+	query := `
+		SELECT
+			(SELECT row_to_json(row) FROM (
+				SELECT p.id, p.name, p.sku,
+					(SELECT row_to_json(unit) FROM (SELECT id, name FROM units WHERE units.id = p.unit_id) unit) AS unit
+				FROM products p WHERE p.id = b.product_id) row) AS product,
+			SUM(b.quantity),
+			json_agg(json_build_object('id', w.id, 'name', w.name, 'quantity', b.quantity) ORDER BY w.id)
+		FROM stock_balances b
+		INNER JOIN warehouses w ON w.id = b.warehouse_id` + f.clause() + `
+		GROUP BY b.product_id
+		ORDER BY b.product_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := []*StockLevel{}
+
+	for rows.Next() {
+		var level StockLevel
+
+		err := rows.Scan(&level.Product, &level.Quantity, &level.Warehouses)
+		if err != nil {
+			return nil, err
+		}
+
+		levels = append(levels, &level)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return levels, nil
+}
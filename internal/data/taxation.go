@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Taxation systems of an organisation. VAT is only charged under the general system,
+// documents of an organisation on the simplified system have no VAT columns.
+const (
+	TaxationOSNO = "osno"
+	TaxationUSN  = "usn"
+)
+
+// TaxationPeriod is a record of the taxation history of an organisation. It applies
+// from ValidFrom until the next record, a nil ValidFrom means since the beginning.
+type TaxationPeriod struct {
+	ID             int64      `json:"id" db:"id"`
+	OrganisationID int64      `json:"organisation_id" db:"organisation_id"`
+	TaxationSystem string     `json:"taxation_system" db:"taxation_system"`
+	ValidFrom      *time.Time `json:"valid_from" db:"valid_from"`
+	UserID         *int64     `json:"user_id,omitempty" db:"user_id"`
+	CreatedAt      *time.Time `json:"created_at,omitempty" db:"created_at"`
+}
+
+func ValidateTaxationPeriod(v *validator.Validator, period *TaxationPeriod) {
+	v.Check(validator.In(period.TaxationSystem, TaxationOSNO, TaxationUSN), "taxation_system", "must be osno or usn")
+	v.Check(period.ValidFrom != nil, "valid_from", "must be provided")
+}
+
+// Define a TaxationModel struct type which wraps a pgx.Conn connection pool.
+type TaxationModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetAll returns the taxation history of the organisation, oldest first.
+func (m TaxationModel) GetAll(organisationID int64) ([]*TaxationPeriod, error) {
+	query := `
+		SELECT id, organisation_id, taxation_system, valid_from, user_id, created_at
+		FROM organisation_taxation
+		WHERE organisation_id = $1
+		ORDER BY valid_from NULLS FIRST`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organisationID)
+	if err != nil {
+		return nil, err
+	}
+
+	periods, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[TaxationPeriod])
+	if err != nil {
+		return nil, err
+	}
+
+	return periods, nil
+}
+
+// Insert records a change of the taxation system from the given date. A change on a
+// date which already has a record replaces it. The first change of an organisation
+// without any history also records the system used so far, so earlier documents keep
+// it. is_vat_payer of the organisation is updated to the system in force today.
+func (m TaxationModel) Insert(period *TaxationPeriod) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO organisation_taxation (organisation_id, taxation_system)
+		SELECT id, CASE WHEN is_vat_payer THEN 'osno' ELSE 'usn' END FROM organisations
+		WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM organisation_taxation WHERE organisation_id = $1)`
+
+	_, err = tx.Exec(ctx, query, period.OrganisationID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO organisation_taxation (organisation_id, taxation_system, valid_from, user_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (organisation_id, valid_from) DO UPDATE
+		SET taxation_system = EXCLUDED.taxation_system, user_id = EXCLUDED.user_id, created_at = NOW()
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		period.OrganisationID,
+		period.TaxationSystem,
+		period.ValidFrom,
+		period.UserID,
+	}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&period.ID, &period.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE organisations
+		SET is_vat_payer = organisation_taxation_system(id, CURRENT_DATE) = 'osno', updated_at = NOW()
+		WHERE id = $1`
+
+	_, err = tx.Exec(ctx, query, period.OrganisationID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,327 @@
+package data
+
+import (
+	"context"
+	"math"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+)
+
+// Discount types of invoice lines and of whole invoices.
+const (
+	DiscountPercent  = "percent"
+	DiscountAbsolute = "absolute"
+)
+
+var DiscountTypes = []string{DiscountPercent, DiscountAbsolute}
+
+// VAT modes of invoices and their lines: the VAT is added on top of the prices or the
+// prices include it.
+const (
+	VatOnTop    = "on_top"
+	VatIncluded = "included"
+)
+
+var VatModes = []string{VatOnTop, VatIncluded}
+
+// ValidateDiscount checks a discount. A percentage is stored with two decimal places
+// like money, so 12.5% is Money(1250).
+func ValidateDiscount(v *validator.Validator, key string, discountType string, value Money) {
+	v.Check(validator.In(discountType, DiscountTypes...), key+"_type", "must be percent or absolute")
+	v.Check(value >= 0, key, "must not be negative")
+	if discountType == DiscountPercent {
+		v.Check(value <= 100*100, key, "must not be more than 100 percent")
+	}
+}
+
+// totalsLine holds the values of an invoice line the totals are calculated from and
+// the calculated results.
+type totalsLine struct {
+	ID           int64
+	Quantity     float64
+	Price        Money
+	DiscountType string
+	DiscountRate int
+	Discount     Money
+	VatRate      float64
+	VatIncluded  bool
+
+	Amount          Money
+	InvoiceDiscount Money
+	Vat             Money
+}
+
+// calculateTotals applies the discounts and calculates the VAT of the lines in this
+// order:
+//
+//  1. the line discount, a percentage of quantity × price or an absolute amount which
+//     can't exceed the line;
+//  2. the invoice discount, a percentage of the discounted lines or an absolute amount
+//     which can't exceed them, spread over the lines in proportion to their amounts
+//     (the rounding difference goes to the last line);
+//  3. the VAT on top of the remaining amount or, for lines with VAT included in the
+//     price, the VAT contained in it (amount × rate / (100 + rate)), which is then
+//     taken out of the amount. No VAT is calculated if the organisation doesn't charge
+//     it. The VAT is rounded per line or per document and rate as the policy says.
+//
+// Either way the amount of a line ends up without VAT, so amount + VAT is what the
+// line costs.
+//
+// The calculation is done in whole kopecks, every step is rounded in the mode of the
+// policy. Quantities (numeric(8,3)) and rates (numeric(8,2)) are converted to whole
+// thousandths and hundredths first.
+func calculateTotals(lines []*totalsLine, discountType string, discountValue Money, chargesVat bool, policy RoundingPolicy) {
+	var base Money
+
+	for _, line := range lines {
+		gross := line.Price.mulDiv(int64(math.Round(line.Quantity*1000)), 1000, policy.Mode)
+
+		switch line.DiscountType {
+		case DiscountPercent:
+			line.Discount = gross.mulDiv(int64(line.DiscountRate), 100, policy.Mode)
+		default:
+			if line.Discount < 0 {
+				line.Discount = 0
+			}
+			if line.Discount > gross {
+				line.Discount = gross
+			}
+		}
+
+		line.Amount = gross - line.Discount
+		line.InvoiceDiscount = 0
+		base += line.Amount
+	}
+
+	var invoiceDiscount Money
+	switch discountType {
+	case DiscountPercent:
+		invoiceDiscount = base.mulDiv(int64(discountValue), 100*100, policy.Mode)
+	case DiscountAbsolute:
+		invoiceDiscount = discountValue
+		if invoiceDiscount > base {
+			invoiceDiscount = base
+		}
+	}
+
+	if invoiceDiscount > 0 && base > 0 {
+		var allocated Money
+		last := -1
+
+		for i, line := range lines {
+			if line.Amount > 0 {
+				last = i
+			}
+		}
+
+		for i, line := range lines {
+			if line.Amount <= 0 {
+				continue
+			}
+
+			share := invoiceDiscount.mulDiv(int64(line.Amount), int64(base), policy.Mode)
+			if i == last {
+				share = invoiceDiscount - allocated
+			}
+
+			allocated += share
+			line.InvoiceDiscount = share
+			line.Amount -= share
+		}
+	}
+
+	for _, line := range lines {
+		line.Vat = 0
+		if !chargesVat {
+			continue
+		}
+
+		rate := vatRateHundredths(line.VatRate)
+		if line.VatIncluded {
+			line.Vat = line.Amount.mulDiv(rate, 100*100+rate, policy.Mode)
+			line.Amount -= line.Vat
+		} else {
+			line.Vat = line.Amount.mulDiv(rate, 100*100, policy.Mode)
+		}
+	}
+
+	if chargesVat && policy.VatRounding == VatRoundingDocument {
+		roundVatPerDocument(lines, policy)
+	}
+}
+
+// vatGroup is the lines of a rate with the VAT on top or included, whose VAT is rounded
+// together.
+type vatGroup struct {
+	rate     int64
+	included bool
+}
+
+// roundVatPerDocument replaces the VAT of the lines with the VAT of the sum of the lines
+// of each rate and mode, rounded once. The difference to the rounded VAT of the lines
+// is added to the last line of the group; if its VAT is included, it is taken out of
+// its amount as well.
+func roundVatPerDocument(lines []*totalsLine, policy RoundingPolicy) {
+	amounts := map[vatGroup]Money{}
+	vats := map[vatGroup]Money{}
+	last := map[vatGroup]*totalsLine{}
+
+	for _, line := range lines {
+		group := vatGroup{rate: vatRateHundredths(line.VatRate), included: line.VatIncluded}
+		amounts[group] += line.Amount
+		vats[group] += line.Vat
+		last[group] = line
+	}
+
+	for group, line := range last {
+		var total Money
+		if group.included {
+			total = (amounts[group] + vats[group]).mulDiv(group.rate, 100*100+group.rate, policy.Mode)
+		} else {
+			total = amounts[group].mulDiv(group.rate, 100*100, policy.Mode)
+		}
+
+		difference := total - vats[group]
+		line.Vat += difference
+		if group.included {
+			line.Amount -= difference
+		}
+	}
+}
+
+// vatRateHundredths converts a VAT rate in percent to whole hundredths of a percent.
+func vatRateHundredths(rate float64) int64 {
+	return int64(math.Round(rate * 100))
+}
+
+// recalculateInvoice applies the discounts of the invoice and its lines, stores the
+// amounts and the VAT of the lines and updates the totals of the invoice. It has to
+// run in the transaction holding the lock of the invoice. A higher amount is checked
+// against the agreement of the invoice. The calculated lines are returned by id.
+func recalculateInvoice(ctx context.Context, tx pgx.Tx, invoice *Invoice) (map[int64]*totalsLine, error) {
+	query := `
+		SELECT COALESCE(i.discount_type, ''), COALESCE(i.discount_value, 0),
+			COALESCE(organisation_taxation_system(i.organisation_id, i.date::date), 'osno'),
+			COALESCE(o.vat_rounding, $2), COALESCE(o.rounding_mode, $3),
+			COALESCE(i.amount, 0), COALESCE(i.agreement_id, 0), COALESCE(i.is_advance, false)
+		FROM invoices i
+		LEFT JOIN organisations o ON o.id = i.organisation_id
+		WHERE i.id = $1`
+
+	var discountType, taxationSystem string
+	var discountValue, previousAmount Money
+	var policy RoundingPolicy
+	var agreementID int64
+	var isAdvance bool
+
+	err := tx.QueryRow(ctx, query, invoice.ID, DefaultRoundingPolicy.VatRounding, DefaultRoundingPolicy.Mode).Scan(
+		&discountType,
+		&discountValue,
+		&taxationSystem,
+		&policy.VatRounding,
+		&policy.Mode,
+		&previousAmount,
+		&agreementID,
+		&isAdvance,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT ii.id, COALESCE(ii.quantity, 0), COALESCE(ii.price, 0), ii.discount_type,
+			COALESCE(ii.discount_rate, 0), COALESCE(ii.discount, 0), COALESCE(vr.rate, 0),
+			COALESCE(ii.vat_mode, i.vat_mode) = 'included'
+		FROM invoice_items ii
+		INNER JOIN invoices i ON i.id = ii.invoice_id
+		LEFT JOIN vat_rates vr ON vr.id = ii.vat_rate_id
+		WHERE ii.invoice_id = $1
+		ORDER BY ii.position, ii.id`
+
+	rows, err := tx.Query(ctx, query, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []*totalsLine{}
+	for rows.Next() {
+		var line totalsLine
+
+		err := rows.Scan(
+			&line.ID,
+			&line.Quantity,
+			&line.Price,
+			&line.DiscountType,
+			&line.DiscountRate,
+			&line.Discount,
+			&line.VatRate,
+			&line.VatIncluded,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		lines = append(lines, &line)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	calculateTotals(lines, discountType, discountValue, taxationSystem != TaxationUSN, policy)
+
+	byID := make(map[int64]*totalsLine, len(lines))
+	ids := make([]int64, len(lines))
+	amounts := make([]Money, len(lines))
+	discounts := make([]Money, len(lines))
+	invoiceDiscounts := make([]Money, len(lines))
+	vats := make([]Money, len(lines))
+
+	for i, line := range lines {
+		byID[line.ID] = line
+		ids[i] = line.ID
+		amounts[i] = line.Amount
+		discounts[i] = line.Discount
+		invoiceDiscounts[i] = line.InvoiceDiscount
+		vats[i] = line.Vat
+	}
+
+	// All lines are updated in one statement, however many the invoice has.
+	query = `
+		UPDATE invoice_items ii
+		SET amount = line.amount, discount = line.discount, invoice_discount = line.invoice_discount, vat = line.vat
+		FROM unnest($1::bigint[], $2::numeric[], $3::numeric[], $4::numeric[], $5::numeric[])
+			AS line (id, amount, discount, invoice_discount, vat)
+		WHERE ii.id = line.id`
+
+	_, err = tx.Exec(ctx, query, ids, amounts, discounts, invoiceDiscounts, vats)
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateInvoiceTotals(ctx, tx, invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	// Advance invoices don't count against the agreement.
+	if !isAdvance {
+		err = checkAgreementAmount(ctx, tx, agreementID, invoice.Amount-previousAmount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return byID, nil
+}
+
+// apply copies the calculated values to the item.
+func (line *totalsLine) apply(item *InvoiceItem) {
+	item.Amount = line.Amount
+	item.Discount = line.Discount
+	item.InvoiceDiscount = line.InvoiceDiscount
+	item.Vat = line.Vat
+}
@@ -0,0 +1,191 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ClientTotals are the amount, discount and VAT of a line as calculated by the client.
+// They are replaced by the values calculated by the server, in shadow mode the two are
+// compared. A nil value wasn't sent.
+type ClientTotals struct {
+	Amount   *Money
+	Discount *Money
+	Vat      *Money
+}
+
+// TotalsMismatch is a value of a line which the client calculated differently than the
+// server.
+type TotalsMismatch struct {
+	ID             int64      `json:"id"`
+	OrganisationID int64      `json:"organisation_id"`
+	InvoiceID      int64      `json:"invoice_id"`
+	InvoiceItemID  int64      `json:"invoice_item_id"`
+	Field          string     `json:"field"`
+	ClientValue    Money      `json:"client_value"`
+	ServerValue    Money      `json:"server_value"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
+
+// Mismatches compares the values sent by the client with those the server calculated
+// for the stored item.
+func (client ClientTotals) Mismatches(invoice *Invoice, item *InvoiceItem) []*TotalsMismatch {
+	mismatches := []*TotalsMismatch{}
+
+	compare := func(field string, clientValue *Money, serverValue Money) {
+		if clientValue == nil || *clientValue == serverValue {
+			return
+		}
+
+		mismatches = append(mismatches, &TotalsMismatch{
+			OrganisationID: invoice.OrganisationID,
+			InvoiceID:      invoice.ID,
+			InvoiceItemID:  item.ID,
+			Field:          field,
+			ClientValue:    *clientValue,
+			ServerValue:    serverValue,
+		})
+	}
+
+	compare("amount", client.Amount, item.Amount)
+	compare("discount", client.Discount, item.Discount)
+	compare("vat", client.Vat, item.Vat)
+
+	return mismatches
+}
+
+// TotalsMismatchSummary counts the mismatches of a field.
+type TotalsMismatchSummary struct {
+	Field         string `json:"field"`
+	Count         int64  `json:"count"`
+	Invoices      int64  `json:"invoices"`
+	MaxDifference Money  `json:"max_difference"`
+}
+
+// TotalsMismatchReport summarizes the mismatches recorded from Start to End and lists
+// the latest of them.
+type TotalsMismatchReport struct {
+	Start   *time.Time               `json:"start,omitempty"`
+	End     *time.Time               `json:"end,omitempty"`
+	Summary []*TotalsMismatchSummary `json:"summary"`
+	Latest  []*TotalsMismatch        `json:"latest"`
+}
+
+// How many mismatches the report lists.
+const totalsMismatchReportSize = 100
+
+// Define a TotalsMismatchModel struct type which wraps a pgx.Conn connection pool.
+type TotalsMismatchModel struct {
+	DB *pgxpool.Pool
+}
+
+// Insert records the mismatches.
+func (m TotalsMismatchModel) Insert(mismatches []*TotalsMismatch) error {
+	query := `
+		INSERT INTO totals_mismatches (organisation_id, invoice_id, invoice_item_id, field, client_value, server_value)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for _, mismatch := range mismatches {
+		args := []interface{}{
+			mismatch.OrganisationID,
+			mismatch.InvoiceID,
+			mismatch.InvoiceItemID,
+			mismatch.Field,
+			mismatch.ClientValue,
+			mismatch.ServerValue,
+		}
+
+		err := m.DB.QueryRow(ctx, query, args...).Scan(&mismatch.ID, &mismatch.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Report returns the mismatches recorded between start and end, which may be nil, of
+// all organisations or, unless organisationID is 0, of one.
+func (m TotalsMismatchModel) Report(organisationID int64, start, end *time.Time) (*TotalsMismatchReport, error) {
+	where := `
+		WHERE ($1::bigint = 0 OR organisation_id = $1)
+			AND ($2::timestamptz IS NULL OR created_at >= $2)
+			AND ($3::timestamptz IS NULL OR created_at <= $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	report := &TotalsMismatchReport{
+		Start:   start,
+		End:     end,
+		Summary: []*TotalsMismatchSummary{},
+		Latest:  []*TotalsMismatch{},
+	}
+
+	rows, err := m.DB.Query(ctx, `
+		SELECT field, COUNT(*), COUNT(DISTINCT invoice_id), MAX(ABS(client_value - server_value))
+		FROM totals_mismatches`+where+`
+		GROUP BY field
+		ORDER BY field`, organisationID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var summary TotalsMismatchSummary
+
+		err := rows.Scan(&summary.Field, &summary.Count, &summary.Invoices, &summary.MaxDifference)
+		if err != nil {
+			return nil, err
+		}
+
+		report.Summary = append(report.Summary, &summary)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.Query(ctx, `
+		SELECT id, COALESCE(organisation_id, 0), invoice_id, invoice_item_id, field, client_value, server_value, created_at
+		FROM totals_mismatches`+where+`
+		ORDER BY id DESC
+		LIMIT $4`, organisationID, start, end, totalsMismatchReportSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mismatch TotalsMismatch
+
+		err := rows.Scan(
+			&mismatch.ID,
+			&mismatch.OrganisationID,
+			&mismatch.InvoiceID,
+			&mismatch.InvoiceItemID,
+			&mismatch.Field,
+			&mismatch.ClientValue,
+			&mismatch.ServerValue,
+			&mismatch.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		report.Latest = append(report.Latest, &mismatch)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
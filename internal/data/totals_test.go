@@ -0,0 +1,220 @@
+package data
+
+import "testing"
+
+func TestCalculateTotalsRoundingModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		price    Money
+		quantity float64
+		vatRate  float64
+		amount   Money
+		vat      Money
+	}{
+		// 0.05 × 0.5 = 2.5 kopecks, VAT 20% of the rounded amount.
+		{name: "half up of an even half", mode: RoundingHalfUp, price: 5, quantity: 0.5, vatRate: 20, amount: 3, vat: 1},
+		{name: "half even of an even half", mode: RoundingHalfEven, price: 5, quantity: 0.5, vatRate: 20, amount: 2, vat: 0},
+		{name: "down of an even half", mode: RoundingDown, price: 5, quantity: 0.5, vatRate: 20, amount: 2, vat: 0},
+		// 0.15 × 0.5 = 7.5 kopecks, VAT 20% of 8 is 1.6 kopecks.
+		{name: "half up of an odd half", mode: RoundingHalfUp, price: 15, quantity: 0.5, vatRate: 20, amount: 8, vat: 2},
+		{name: "half even of an odd half", mode: RoundingHalfEven, price: 15, quantity: 0.5, vatRate: 20, amount: 8, vat: 2},
+		{name: "down of an odd half", mode: RoundingDown, price: 15, quantity: 0.5, vatRate: 20, amount: 7, vat: 1},
+		// 10.00 × 1.333 = 13.33, VAT 10% is 1.333.
+		{name: "half up below half", mode: RoundingHalfUp, price: 1000, quantity: 1.333, vatRate: 10, amount: 1333, vat: 133},
+		{name: "half even below half", mode: RoundingHalfEven, price: 1000, quantity: 1.333, vatRate: 10, amount: 1333, vat: 133},
+		{name: "down below half", mode: RoundingDown, price: 1000, quantity: 1.333, vatRate: 10, amount: 1333, vat: 133},
+		// 0.99 × 0.7 = 69.3 kopecks, VAT 20% of 69 is 13.8.
+		{name: "half up above half", mode: RoundingHalfUp, price: 99, quantity: 0.7, vatRate: 20, amount: 69, vat: 14},
+		{name: "half even above half", mode: RoundingHalfEven, price: 99, quantity: 0.7, vatRate: 20, amount: 69, vat: 14},
+		{name: "down above half", mode: RoundingDown, price: 99, quantity: 0.7, vatRate: 20, amount: 69, vat: 13},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := &totalsLine{Quantity: tt.quantity, Price: tt.price, VatRate: tt.vatRate}
+			policy := RoundingPolicy{VatRounding: VatRoundingLine, Mode: tt.mode}
+
+			calculateTotals([]*totalsLine{line}, "", 0, true, policy)
+
+			if line.Amount != tt.amount || line.Vat != tt.vat {
+				t.Errorf("got amount %d and VAT %d, want %d and %d", line.Amount, line.Vat, tt.amount, tt.vat)
+			}
+		})
+	}
+}
+
+func TestCalculateTotalsVatRounding(t *testing.T) {
+	// Three lines of 0.03 at 20%: the VAT of every line is 0.6 kopecks, of the
+	// document 1.8 kopecks.
+	tests := []struct {
+		name        string
+		vatRounding string
+		mode        string
+		vats        []Money
+	}{
+		{name: "per line half up", vatRounding: VatRoundingLine, mode: RoundingHalfUp, vats: []Money{1, 1, 1}},
+		{name: "per line down", vatRounding: VatRoundingLine, mode: RoundingDown, vats: []Money{0, 0, 0}},
+		{name: "per document half up", vatRounding: VatRoundingDocument, mode: RoundingHalfUp, vats: []Money{1, 1, 0}},
+		{name: "per document half even", vatRounding: VatRoundingDocument, mode: RoundingHalfEven, vats: []Money{1, 1, 0}},
+		{name: "per document down", vatRounding: VatRoundingDocument, mode: RoundingDown, vats: []Money{0, 0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := []*totalsLine{
+				{Quantity: 1, Price: 3, VatRate: 20},
+				{Quantity: 1, Price: 3, VatRate: 20},
+				{Quantity: 1, Price: 3, VatRate: 20},
+			}
+
+			calculateTotals(lines, "", 0, true, RoundingPolicy{VatRounding: tt.vatRounding, Mode: tt.mode})
+
+			for i, line := range lines {
+				if line.Vat != tt.vats[i] {
+					t.Errorf("line %d: got VAT %d, want %d", i, line.Vat, tt.vats[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateTotalsDiscounts(t *testing.T) {
+	// An invoice discount of 10% of 3 × 0.33 is 9.9 kopecks, spread over the lines in
+	// proportion to their amounts with the difference on the last line.
+	tests := []struct {
+		name      string
+		mode      string
+		discounts []Money
+	}{
+		{name: "half up", mode: RoundingHalfUp, discounts: []Money{3, 3, 4}},
+		{name: "half even", mode: RoundingHalfEven, discounts: []Money{3, 3, 4}},
+		{name: "down", mode: RoundingDown, discounts: []Money{3, 3, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := []*totalsLine{
+				{Quantity: 1, Price: 33},
+				{Quantity: 1, Price: 33},
+				{Quantity: 1, Price: 33},
+			}
+
+			calculateTotals(lines, DiscountPercent, 1000, false, RoundingPolicy{VatRounding: VatRoundingLine, Mode: tt.mode})
+
+			for i, line := range lines {
+				if line.InvoiceDiscount != tt.discounts[i] || line.Amount != 33-tt.discounts[i] || line.Vat != 0 {
+					t.Errorf("line %d: got discount %d, amount %d and VAT %d, want discount %d", i, line.InvoiceDiscount, line.Amount, line.Vat, tt.discounts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateTotalsLineDiscount(t *testing.T) {
+	line := &totalsLine{Quantity: 2, Price: 1000, DiscountType: DiscountAbsolute, Discount: 5000}
+
+	calculateTotals([]*totalsLine{line}, DiscountAbsolute, 100, false, DefaultRoundingPolicy)
+
+	if line.Discount != 2000 || line.Amount != 0 || line.InvoiceDiscount != 0 {
+		t.Errorf("got discount %d, amount %d and invoice discount %d, want the line discounted to zero", line.Discount, line.Amount, line.InvoiceDiscount)
+	}
+}
+
+func TestCalculateTotalsVatIncluded(t *testing.T) {
+	tests := []struct {
+		name        string
+		vatRounding string
+		mode        string
+		chargesVat  bool
+		lines       []*totalsLine
+		amounts     []Money
+		vats        []Money
+	}{
+		{
+			name: "included without a remainder", vatRounding: VatRoundingLine, mode: RoundingHalfUp, chargesVat: true,
+			lines:   []*totalsLine{{Quantity: 1, Price: 12000, VatRate: 20, VatIncluded: true}},
+			amounts: []Money{10000}, vats: []Money{2000},
+		},
+		{
+			// 100.00 contains 16.666… of VAT.
+			name: "included half up", vatRounding: VatRoundingLine, mode: RoundingHalfUp, chargesVat: true,
+			lines:   []*totalsLine{{Quantity: 1, Price: 10000, VatRate: 20, VatIncluded: true}},
+			amounts: []Money{8333}, vats: []Money{1667},
+		},
+		{
+			name: "included down", vatRounding: VatRoundingLine, mode: RoundingDown, chargesVat: true,
+			lines:   []*totalsLine{{Quantity: 1, Price: 10000, VatRate: 20, VatIncluded: true}},
+			amounts: []Money{8334}, vats: []Money{1666},
+		},
+		{
+			// Every 1.00 contains 16.67 kopecks of VAT, the three of them 50.
+			name: "included per document", vatRounding: VatRoundingDocument, mode: RoundingHalfUp, chargesVat: true,
+			lines: []*totalsLine{
+				{Quantity: 1, Price: 100, VatRate: 20, VatIncluded: true},
+				{Quantity: 1, Price: 100, VatRate: 20, VatIncluded: true},
+				{Quantity: 1, Price: 100, VatRate: 20, VatIncluded: true},
+			},
+			amounts: []Money{83, 83, 84}, vats: []Money{17, 17, 16},
+		},
+		{
+			name: "on top and included per document", vatRounding: VatRoundingDocument, mode: RoundingHalfUp, chargesVat: true,
+			lines: []*totalsLine{
+				{Quantity: 1, Price: 10000, VatRate: 20},
+				{Quantity: 1, Price: 12000, VatRate: 20, VatIncluded: true},
+			},
+			amounts: []Money{10000, 10000}, vats: []Money{2000, 2000},
+		},
+		{
+			name: "included without VAT charged", vatRounding: VatRoundingLine, mode: RoundingHalfUp, chargesVat: false,
+			lines:   []*totalsLine{{Quantity: 1, Price: 12000, VatRate: 20, VatIncluded: true}},
+			amounts: []Money{12000}, vats: []Money{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calculateTotals(tt.lines, "", 0, tt.chargesVat, RoundingPolicy{VatRounding: tt.vatRounding, Mode: tt.mode})
+
+			for i, line := range tt.lines {
+				if line.Amount != tt.amounts[i] || line.Vat != tt.vats[i] {
+					t.Errorf("line %d: got amount %d and VAT %d, want %d and %d", i, line.Amount, line.Vat, tt.amounts[i], tt.vats[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClientTotalsMismatches(t *testing.T) {
+	money := func(m Money) *Money { return &m }
+
+	invoice := &Invoice{ID: 1, OrganisationID: 2}
+	item := &InvoiceItem{ID: 3, Amount: 10000, Discount: 500, Vat: 2000}
+
+	tests := []struct {
+		name   string
+		client ClientTotals
+		fields []string
+	}{
+		{name: "nothing sent", client: ClientTotals{}},
+		{name: "same values", client: ClientTotals{Amount: money(10000), Discount: money(500), Vat: money(2000)}},
+		{name: "VAT rounded differently", client: ClientTotals{Amount: money(10000), Vat: money(2001)}, fields: []string{"vat"}},
+		{name: "all different", client: ClientTotals{Amount: money(9999), Discount: money(0), Vat: money(0)}, fields: []string{"amount", "discount", "vat"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatches := tt.client.Mismatches(invoice, item)
+
+			if len(mismatches) != len(tt.fields) {
+				t.Fatalf("got %d mismatches, want %d", len(mismatches), len(tt.fields))
+			}
+
+			for i, mismatch := range mismatches {
+				if mismatch.Field != tt.fields[i] || mismatch.InvoiceID != 1 || mismatch.OrganisationID != 2 || mismatch.InvoiceItemID != 3 {
+					t.Errorf("mismatch %d: got %+v, want the %s of item 3 of invoice 1", i, mismatch, tt.fields[i])
+				}
+			}
+		})
+	}
+}
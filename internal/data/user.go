@@ -5,11 +5,15 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -20,14 +24,19 @@ var (
 
 // User type
 type User struct {
-	ID          int64      `json:"id"`
-	IsActive    bool       `json:"is_active"`
-	Name        string     `json:"name"`
-	Email       string     `json:"email"`
-	Password    password   `json:"-"`
-	DestroyedAt *time.Time `json:"destroyed_at,omitempty"`
-	CreatedAt   *time.Time `json:"created_at,omitempty"`
-	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	ID           int64            `json:"id"`
+	IsActive     bool             `json:"is_active"`
+	Name         string           `json:"name"`
+	Email        string           `json:"email"`
+	Phone        string           `json:"phone,omitempty"`
+	Avatar       string           `json:"-"`
+	AvatarURL    string           `json:"avatar_url,omitempty"`
+	Password     password         `json:"-"`
+	TokenVersion int              `json:"-"`
+	DestroyedAt  *time.Time       `json:"destroyed_at,omitempty"`
+	CreatedAt    *time.Time       `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time       `json:"updated_at,omitempty"`
+	Preferences  *UserPreferences `json:"preferences,omitempty"`
 }
 
 // Create a custom password type
@@ -75,6 +84,51 @@ func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
 
+// PhoneRX matches phone numbers written with digits, spaces, dashes and brackets and
+// an optional leading +.
+var PhoneRX = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{4,18}[0-9]$`)
+
+// AvatarPath is the path avatars are served under, followed by their key.
+const AvatarPath = "/v1/"
+
+func (u *User) setAvatarURL() {
+	u.AvatarURL = ""
+	if u.Avatar != "" {
+		u.AvatarURL = AvatarPath + u.Avatar
+	}
+}
+
+// ValidateProfile checks the fields a user may change of their own.
+func ValidateProfile(v *validator.Validator, user *User) {
+	v.Check(user.Name != "", "name", "must be provided")
+	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(user.Phone == "" || validator.Matches(user.Phone, PhoneRX), "phone", "must be a valid phone number")
+}
+
+// PasswordPolicy holds the rules new passwords have to follow: a minimum length in
+// characters and the number of character classes (lower case and upper case letters,
+// digits and other characters) they have to mix. Passwords are only checked against it
+// when they are set, existing ones keep working.
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int
+}
+
+// The policy used when none is configured.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8, MinClasses: 1}
+
+// ValidatePasswordPolicy checks a new password against the policy. The password must
+// not contain the email of the user either.
+func ValidatePasswordPolicy(v *validator.Validator, key, password, email string, policy PasswordPolicy) {
+	v.Check(utf8.RuneCountInString(password) >= policy.MinLength, key, fmt.Sprintf("must be at least %d characters long", policy.MinLength))
+	v.Check(len(password) <= 72, key, "must not be more than 72 bytes long")
+	v.Check(validator.CharClasses(password) >= policy.MinClasses, key, fmt.Sprintf("must mix at least %d of lower case letters, upper case letters, digits and other characters", policy.MinClasses))
+
+	if email != "" {
+		v.Check(!strings.Contains(strings.ToLower(password), strings.ToLower(email)), key, "must not contain the email")
+	}
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
@@ -109,7 +163,7 @@ type UserModel struct {
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (m UserModel) Get(userID int64) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, is_active, updated_at FROM users
+		SELECT id, created_at, name, email, COALESCE(phone, ''), COALESCE(avatar, ''), password_hash, token_version, is_active, updated_at FROM users
 		WHERE id = $1`
 
 	var user User
@@ -122,7 +176,10 @@ func (m UserModel) Get(userID int64) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.Phone,
+		&user.Avatar,
 		&user.Password.hash,
+		&user.TokenVersion,
 		&user.IsActive,
 		&user.UpdatedAt,
 	)
@@ -136,6 +193,8 @@ func (m UserModel) Get(userID int64) (*User, error) {
 		}
 	}
 
+	user.setAvatarURL()
+
 	return &user, nil
 
 }
@@ -176,7 +235,7 @@ func (m UserModel) Insert(user *User) error {
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, is_active, updated_at FROM users
+		SELECT id, created_at, name, email, COALESCE(phone, ''), COALESCE(avatar, ''), password_hash, token_version, is_active, updated_at FROM users
 		WHERE email = $1`
 
 	var user User
@@ -189,7 +248,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.Phone,
+		&user.Avatar,
 		&user.Password.hash,
+		&user.TokenVersion,
 		&user.IsActive,
 		&user.UpdatedAt,
 	)
@@ -203,6 +265,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		}
 	}
 
+	user.setAvatarURL()
+
 	return &user, nil
 
 }
@@ -253,7 +317,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	// Set up the SQL query.
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.is_active, users.updated_at 
+		SELECT users.id, users.created_at, users.name, users.email, COALESCE(users.phone, ''), COALESCE(users.avatar, ''), users.password_hash, users.token_version, users.is_active, users.updated_at 
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -279,7 +343,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.Phone,
+		&user.Avatar,
 		&user.Password.hash,
+		&user.TokenVersion,
 		&user.IsActive,
 		&user.UpdatedAt,
 	)
@@ -293,5 +360,147 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	}
 
 	// Return the matching user.
+	user.setAvatarURL()
+
 	return &user, nil
 }
+
+// UpdateProfile saves the name and the phone of the user.
+func (m UserModel) UpdateProfile(user *User) error {
+	query := `
+		UPDATE users
+		SET name = $1, phone = NULLIF($2, ''), updated_at = NOW()
+		WHERE id = $3
+		RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, user.Name, user.Phone, user.ID).Scan(&user.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetAvatar sets the storage key of the avatar of the user, empty removes it. It
+// returns the key of the previous avatar, so its file can be deleted.
+func (m UserModel) SetAvatar(user *User, key string) (string, error) {
+	query := `
+		UPDATE users u
+		SET avatar = NULLIF($1, ''), updated_at = NOW()
+		FROM (SELECT id, avatar FROM users WHERE id = $2 FOR UPDATE) old
+		WHERE u.id = old.id
+		RETURNING COALESCE(old.avatar, ''), u.updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var previous string
+
+	err := m.DB.QueryRow(ctx, query, key, user.ID).Scan(&previous, &user.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	user.Avatar = key
+	user.setAvatarURL()
+
+	return previous, nil
+}
+
+// AvatarExists reports whether a user has the avatar, so only the files of current
+// avatars are served.
+func (m UserModel) AvatarExists(key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE avatar = $1)", key).Scan(&exists)
+
+	return exists, err
+}
+
+// ChangePassword saves the new password hash of the user and raises the token version,
+// so the tokens issued before are no longer accepted.
+func (m UserModel) ChangePassword(user *User) error {
+	query := `
+		UPDATE users
+		SET password_hash = $1, token_version = token_version + 1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING token_version, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, user.Password.hash, user.ID).Scan(&user.TokenVersion, &user.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAll returns the users ordered by email, those whose email or name contain the
+// search if it isn't empty.
+func (m UserModel) GetAll(search string) ([]*User, error) {
+	query := `
+		SELECT id, created_at, name, email, COALESCE(phone, ''), COALESCE(avatar, ''), is_active, updated_at FROM users
+		WHERE $1 = '' OR email ILIKE '%' || $1 || '%' OR name ILIKE '%' || $1 || '%'
+		ORDER BY email`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, search)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Phone,
+			&user.Avatar,
+			&user.IsActive,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		user.setAvatarURL()
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	// The timezones are embedded, so they can be validated on hosts without tzdata.
+	_ "time/tzdata"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// LocaleRX matches the language tags of locales, e.g. "ru" or "en-US".
+var LocaleRX = regexp.MustCompile("^[a-z]{2}(-[A-Z]{2})?$")
+
+// The most notification settings a user can store.
+const maxNotificationSettings = 50
+
+// UserPreferences personalize the frontend for the user. Notifications are on/off
+// settings the frontend defines, PageSizes the default page size per list endpoint.
+// DefaultOrganisationID is dropped when the user is no longer a member of it.
+type UserPreferences struct {
+	Locale                string          `json:"locale"`
+	Timezone              string          `json:"timezone"`
+	DefaultOrganisationID *int64          `json:"default_organisation_id"`
+	Notifications         map[string]bool `json:"notifications"`
+	PageSizes             map[string]int  `json:"page_sizes"`
+	UpdatedAt             *time.Time      `json:"updated_at,omitempty"`
+}
+
+// DefaultUserPreferences returns the preferences of users who haven't saved any.
+func DefaultUserPreferences() *UserPreferences {
+	return &UserPreferences{
+		Locale:        "ru",
+		Timezone:      "Europe/Moscow",
+		Notifications: map[string]bool{},
+		PageSizes:     map[string]int{},
+	}
+}
+
+// ValidateUserPreferences checks the preferences; page sizes may be set for the list
+// endpoints of pageLimits up to their maximum.
+func ValidateUserPreferences(v *validator.Validator, preferences *UserPreferences, pageLimits map[string]PageLimits) {
+	v.Check(validator.Matches(preferences.Locale, LocaleRX), "locale", "must be a language tag like ru or en-US")
+
+	_, err := time.LoadLocation(preferences.Timezone)
+	v.Check(preferences.Timezone != "" && err == nil, "timezone", "must be an IANA timezone like Europe/Moscow")
+
+	v.Check(len(preferences.Notifications) <= maxNotificationSettings, "notifications", fmt.Sprintf("must not contain more than %d settings", maxNotificationSettings))
+	for name := range preferences.Notifications {
+		v.Check(name != "" && len(name) <= 50, "notifications", "must have names of 1 to 50 bytes")
+	}
+
+	for endpoint, size := range preferences.PageSizes {
+		limits, ok := pageLimits[endpoint]
+		if !ok {
+			v.AddError("page_sizes", fmt.Sprintf("%s is not a list endpoint", endpoint))
+			continue
+		}
+		v.Check(size > 0 && size <= limits.Max, "page_sizes", fmt.Sprintf("%s must be between 1 and %d", endpoint, limits.Max))
+	}
+}
+
+// Define a UserPreferencesModel struct type which wraps a pgx.Conn connection pool.
+type UserPreferencesModel struct {
+	DB *pgxpool.Pool
+}
+
+// Get returns the preferences of the user, the defaults if none were saved.
+func (m UserPreferencesModel) Get(userID int64) (*UserPreferences, error) {
+	query := `
+		SELECT p.locale, p.timezone,
+			CASE WHEN EXISTS (
+				SELECT 1 FROM users_organisations uo
+				WHERE uo.user_id = p.user_id AND uo.organisation_id = p.default_organisation_id)
+			THEN p.default_organisation_id END,
+			p.notifications, p.page_sizes, p.updated_at
+		FROM user_preferences p
+		WHERE p.user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	preferences := DefaultUserPreferences()
+
+	if rows.Next() {
+		err = rows.Scan(
+			&preferences.Locale,
+			&preferences.Timezone,
+			&preferences.DefaultOrganisationID,
+			&preferences.Notifications,
+			&preferences.PageSizes,
+			&preferences.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return preferences, nil
+}
+
+// Save stores the preferences of the user.
+func (m UserPreferencesModel) Save(userID int64, preferences *UserPreferences) error {
+	query := `
+		INSERT INTO user_preferences (user_id, locale, timezone, default_organisation_id, notifications, page_sizes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE
+		SET locale = EXCLUDED.locale, timezone = EXCLUDED.timezone,
+			default_organisation_id = EXCLUDED.default_organisation_id,
+			notifications = EXCLUDED.notifications, page_sizes = EXCLUDED.page_sizes, updated_at = NOW()
+		RETURNING updated_at`
+
+	args := []interface{}{
+		userID,
+		preferences.Locale,
+		preferences.Timezone,
+		preferences.DefaultOrganisationID,
+		preferences.Notifications,
+		preferences.PageSizes,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&preferences.UpdatedAt)
+}
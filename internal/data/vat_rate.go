@@ -6,25 +6,55 @@ import (
 	"time"
 
 	"github.com/ElOtro/stockup-api/internal/validator"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var ErrVatRateNotValid = errors.New("vat rate is not valid on the date")
+
 // VatRate struct
 type VatRate struct {
-	ID          int64      `json:"id"`
-	IsActive    bool       `json:"is_active,omitempty"`
-	IsDefault   bool       `json:"is_default,omitempty"`
-	Rate        float64    `json:"rate"`
-	Name        string     `json:"name"`
-	DestroyedAt *time.Time `json:"destroyed_at,omitempty"`
-	CreatedAt   *time.Time `json:"created_at,omitempty"`
-	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	ID           int64      `json:"id"`
+	IsActive     bool       `json:"is_active,omitempty"`
+	IsDefault    bool       `json:"is_default,omitempty"`
+	Rate         float64    `json:"rate"`
+	Name         string     `json:"name"`
+	ValidFrom    *time.Time `json:"valid_from,omitempty"`
+	ValidTo      *time.Time `json:"valid_to,omitempty"`
+	ReplacedByID *int64     `json:"replaced_by_id,omitempty"`
+	DestroyedAt  *time.Time `json:"destroyed_at,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
 }
 
 func ValidateVatRate(v *validator.Validator, vatRate *VatRate) {
 	v.Check(vatRate.Rate >= 0, "rate", "must be provided")
 	v.Check(vatRate.Name != "", "name", "must be provided")
+
+	if vatRate.ValidFrom != nil && vatRate.ValidTo != nil {
+		v.Check(!vatRate.ValidTo.Before(*vatRate.ValidFrom), "valid_to", "must not be before valid_from")
+	}
+
+	if vatRate.ReplacedByID != nil {
+		v.Check(*vatRate.ReplacedByID != vatRate.ID, "replaced_by_id", "must not be the rate itself")
+		v.Check(vatRate.ValidTo != nil, "valid_to", "must be provided for a replaced rate")
+	}
+}
+
+// ValidOn reports whether the rate may be used on a document of the given date. The
+// bounds are whole days, the time of the date is ignored.
+func (r *VatRate) ValidOn(date time.Time) bool {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+
+	if r.ValidFrom != nil && day.Before(*r.ValidFrom) {
+		return false
+	}
+
+	if r.ValidTo != nil && day.After(*r.ValidTo) {
+		return false
+	}
+
+	return true
 }
 
 // Define a VatRateModel struct type which wraps a pgx.Conn connection pool.
@@ -32,12 +62,13 @@ type VatRateModel struct {
 	DB *pgxpool.Pool
 }
 
-func (m VatRateModel) GetAll() ([]*VatRate, error) {
+func (m VatRateModel) GetAll(ctx context.Context) ([]*VatRate, error) {
 	// Construct the SQL query to retrieve all movie records.
-	query := "SELECT id, is_active, is_default, rate, name, created_at, updated_at FROM vat_rates"
+	query := `SELECT id, is_active, is_default, rate, name, valid_from, valid_to, replaced_by_id, created_at, updated_at
+		FROM vat_rates ORDER BY id`
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Create a context with a 3-second timeout, unless the caller has a deadline.
+	ctx, cancel := queryContext(ctx, 3*time.Second)
 	defer cancel()
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
@@ -66,6 +97,9 @@ func (m VatRateModel) GetAll() ([]*VatRate, error) {
 			&vatRate.IsDefault,
 			&vatRate.Rate,
 			&vatRate.Name,
+			&vatRate.ValidFrom,
+			&vatRate.ValidTo,
+			&vatRate.ReplacedByID,
 			&vatRate.CreatedAt,
 			&vatRate.UpdatedAt,
 		)
@@ -86,18 +120,67 @@ func (m VatRateModel) GetAll() ([]*VatRate, error) {
 	return vatRates, nil
 }
 
+// ResolveOn returns the rate which takes the place of the given one on the date. If the
+// rate isn't valid on the date, the chain of replacements is followed forwards (for a
+// later date) or backwards (for an earlier date), so a company default of 20% turns
+// into 18% on an invoice of 2018 and the other way round. ErrVatRateNotValid is
+// returned if no rate of the chain is valid on the date.
+func (m VatRateModel) ResolveOn(id int64, date time.Time) (*VatRate, error) {
+	vatRates, err := m.GetAll(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int64]*VatRate, len(vatRates))
+	replaces := make(map[int64]*VatRate, len(vatRates))
+	for _, vatRate := range vatRates {
+		byID[vatRate.ID] = vatRate
+		if vatRate.ReplacedByID != nil {
+			replaces[*vatRate.ReplacedByID] = vatRate
+		}
+	}
+
+	vatRate, ok := byID[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	// The number of steps is limited by the number of rates, which guards against a
+	// chain closed into a loop.
+	for i := 0; i < len(vatRates) && vatRate != nil; i++ {
+		if vatRate.ValidOn(date) {
+			return vatRate, nil
+		}
+
+		if vatRate.ValidTo != nil && date.After(*vatRate.ValidTo) {
+			if vatRate.ReplacedByID == nil {
+				break
+			}
+			vatRate = byID[*vatRate.ReplacedByID]
+		} else {
+			vatRate = replaces[vatRate.ID]
+		}
+	}
+
+	return nil, ErrVatRateNotValid
+}
+
 // Add method for inserting a new record in the VatRates table.
 func (m VatRateModel) Insert(vatRate *VatRate) error {
 	// Define the SQL query for inserting a new record
 	query := `
-		INSERT INTO vat_rates (is_active, is_default, rate, name) VALUES ($1, $2, $3, $4)
-		RETURNING id, is_active, is_default, rate, name, created_at, updated_at`
+		INSERT INTO vat_rates (is_active, is_default, rate, name, valid_from, valid_to, replaced_by_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, is_active, is_default, rate, name, valid_from, valid_to, replaced_by_id, created_at, updated_at`
 
 	args := []interface{}{
 		vatRate.IsActive,
 		vatRate.IsDefault,
 		vatRate.Rate,
 		vatRate.Name,
+		vatRate.ValidFrom,
+		vatRate.ValidTo,
+		vatRate.ReplacedByID,
 	}
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool
@@ -107,6 +190,9 @@ func (m VatRateModel) Insert(vatRate *VatRate) error {
 		&vatRate.IsDefault,
 		&vatRate.Rate,
 		&vatRate.Name,
+		&vatRate.ValidFrom,
+		&vatRate.ValidTo,
+		&vatRate.ReplacedByID,
 		&vatRate.CreatedAt,
 		&vatRate.UpdatedAt,
 	)
@@ -123,7 +209,7 @@ func (m VatRateModel) Get(id int64) (*VatRate, error) {
 	}
 
 	// Define the SQL query for retrieving data.
-	query := `SELECT id, is_active, is_default, rate, name, created_at, updated_at 
+	query := `SELECT id, is_active, is_default, rate, name, valid_from, valid_to, replaced_by_id, created_at, updated_at 
 	          FROM vat_rates WHERE id = $1`
 
 	// Declare a VatRate struct to hold the data returned by the query.
@@ -142,6 +228,9 @@ func (m VatRateModel) Get(id int64) (*VatRate, error) {
 		&vatRate.IsDefault,
 		&vatRate.Rate,
 		&vatRate.Name,
+		&vatRate.ValidFrom,
+		&vatRate.ValidTo,
+		&vatRate.ReplacedByID,
 		&vatRate.CreatedAt,
 		&vatRate.UpdatedAt,
 	)
@@ -165,8 +254,9 @@ func (m VatRateModel) Get(id int64) (*VatRate, error) {
 func (m VatRateModel) Update(vatRate *VatRate) error {
 	query := `
 		UPDATE vat_rates
-		SET is_active = $1, is_default = $2, rate = $3, name = $4, updated_at = NOW() 
-		WHERE id = $5
+		SET is_active = $1, is_default = $2, rate = $3, name = $4, valid_from = $5, valid_to = $6,
+			replaced_by_id = $7, updated_at = NOW() 
+		WHERE id = $8
 		RETURNING updated_at`
 
 	// Create an args slice containing the values for the placeholder parameters.
@@ -175,6 +265,9 @@ func (m VatRateModel) Update(vatRate *VatRate) error {
 		vatRate.IsDefault,
 		vatRate.Rate,
 		vatRate.Name,
+		vatRate.ValidFrom,
+		vatRate.ValidTo,
+		vatRate.ReplacedByID,
 		vatRate.ID,
 	}
 
@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrWarehouseNotEmpty is returned when a warehouse which still holds goods is deleted.
+var ErrWarehouseNotEmpty = errors.New("the warehouse holds goods")
+
+// Warehouse holds the goods of an organisation, see StockModel. Invoices are shipped
+// from the default warehouse unless another one is chosen.
+type Warehouse struct {
+	ID             int64      `json:"id" db:"id"`
+	OrganisationID int64      `json:"organisation_id" db:"organisation_id"`
+	Name           string     `json:"name" db:"name"`
+	Address        *string    `json:"address,omitempty" db:"address"`
+	IsDefault      bool       `json:"is_default" db:"is_default"`
+	DestroyedAt    *time.Time `json:"destroyed_at,omitempty" db:"destroyed_at"`
+	CreatedAt      *time.Time `json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func ValidateWarehouse(v *validator.Validator, warehouse *Warehouse) {
+	v.Check(warehouse.OrganisationID != 0, "organisation_id", "must be provided")
+	v.Check(warehouse.Name != "", "name", "must be provided")
+	v.Check(len(warehouse.Name) <= 255, "name", "must not be more than 255 bytes long")
+}
+
+// Define a WarehouseModel struct type which wraps a pgx.Conn connection pool.
+type WarehouseModel struct {
+	DB *pgxpool.Pool
+}
+
+// The movements of a warehouse refer to it, so it is only marked as deleted.
+func (m WarehouseModel) repository() repository[Warehouse] {
+	return repository[Warehouse]{
+		DB:         m.DB,
+		table:      "warehouses",
+		columns:    []string{"id", "organisation_id", "name", "address", "is_default", "created_at", "updated_at"},
+		softDelete: true,
+	}
+}
+
+// GetAll returns the warehouses of the organisation, of all organisations if it is 0,
+// the default ones first.
+func (m WarehouseModel) GetAll(organisationID int64) ([]*Warehouse, error) {
+	return m.repository().all(context.Background(), "$1 = 0 OR organisation_id = $1", "organisation_id, is_default DESC, id", organisationID)
+}
+
+// Add method for fetching a specific record from the warehouses table.
+func (m WarehouseModel) Get(id int64) (*Warehouse, error) {
+	return m.repository().get(id)
+}
+
+// GetDefault returns the default warehouse of the organisation, ErrRecordNotFound if it
+// has none.
+func (m WarehouseModel) GetDefault(organisationID int64) (*Warehouse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	r := m.repository()
+
+	return r.one(ctx, r.selectFrom("organisation_id = $1 AND is_default", ""), organisationID)
+}
+
+// Insert adds the warehouse. A new default warehouse replaces the previous default of
+// the organisation.
+func (m WarehouseModel) Insert(warehouse *Warehouse) error {
+	query := `
+		INSERT INTO warehouses (organisation_id, name, address, is_default)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at`
+
+	args := []interface{}{warehouse.OrganisationID, warehouse.Name, warehouse.Address, warehouse.IsDefault}
+
+	return m.save(warehouse, query, args, &warehouse.ID, &warehouse.CreatedAt, &warehouse.UpdatedAt)
+}
+
+// Update changes the name, the address and whether the warehouse is the default one.
+// Like Insert() it replaces the previous default.
+func (m WarehouseModel) Update(warehouse *Warehouse) error {
+	query := `
+		UPDATE warehouses SET name = $1, address = $2, is_default = $3, updated_at = NOW()
+		WHERE id = $4 AND destroyed_at IS NULL
+		RETURNING updated_at`
+
+	args := []interface{}{warehouse.Name, warehouse.Address, warehouse.IsDefault, warehouse.ID}
+
+	return m.save(warehouse, query, args, &warehouse.UpdatedAt)
+}
+
+// save runs the insert or update of the warehouse in a transaction which first takes
+// the default from the other warehouses of the organisation if the warehouse becomes
+// the default.
+func (m WarehouseModel) save(warehouse *Warehouse, query string, args []interface{}, dest ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	if warehouse.IsDefault {
+		_, err = tx.Exec(ctx, `
+			UPDATE warehouses SET is_default = false, updated_at = NOW()
+			WHERE organisation_id = $1 AND id <> $2 AND is_default AND destroyed_at IS NULL`,
+			warehouse.OrganisationID, warehouse.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(dest...)
+	if err != nil {
+		return notFound(err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Delete marks the warehouse as deleted. It has to be empty, the goods left are to be
+// written off first, otherwise ErrWarehouseNotEmpty is returned.
+func (m WarehouseModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	// The lock keeps goods from being received into the warehouse meanwhile.
+	var empty bool
+
+	query := `
+		SELECT NOT EXISTS (SELECT 1 FROM stock_balances WHERE warehouse_id = warehouses.id AND quantity <> 0)
+		FROM warehouses WHERE id = $1 AND destroyed_at IS NULL
+		FOR UPDATE`
+
+	err = tx.QueryRow(ctx, query, id).Scan(&empty)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	if !empty {
+		return ErrWarehouseNotEmpty
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE warehouses SET destroyed_at = NOW(), is_default = false, updated_at = NOW() WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
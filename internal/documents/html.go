@@ -0,0 +1,83 @@
+package documents
+
+import (
+	"embed"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+)
+
+// The layouts are embedded in the binary.
+//
+//go:embed "templates"
+var templateFS embed.FS
+
+var functions = template.FuncMap{
+	"money":    formatMoney,
+	"quantity": formatQuantity,
+	"date":     formatDate,
+	"image":    imageURL,
+}
+
+// RenderInvoiceHTML writes the invoice as a standalone HTML page, styled for printing
+// on A4.
+func RenderInvoiceHTML(w io.Writer, invoice *Invoice) error {
+	tmpl, err := template.New("invoice.html").Funcs(functions).ParseFS(templateFS, "templates/invoice.html")
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(w, invoice)
+}
+
+// formatMoney prints an amount the Russian way, with spaces between the thousands and
+// a decimal comma: 1 234,50.
+func formatMoney(m data.Money) string {
+	s := m.String()
+
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+
+	whole, fraction := s[:len(s)-3], s[len(s)-2:]
+
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteRune(' ')
+		}
+		b.WriteRune(c)
+	}
+
+	return sign + b.String() + "," + fraction
+}
+
+// formatQuantity prints a quantity without trailing zeros and with a decimal comma.
+func formatQuantity(q float64) string {
+	return strings.Replace(strconv.FormatFloat(q, 'f', -1, 64), ".", ",", 1)
+}
+
+func formatDate(t time.Time) string {
+	return t.Format("02.01.2006")
+}
+
+// imageURL passes the stamp or a signature of the organisation on to an <img> tag if
+// it is an image URL or an embedded image, anything else isn't printed.
+func imageURL(s *string) template.URL {
+	if s == nil {
+		return ""
+	}
+
+	for _, prefix := range []string{"https://", "http://", "data:image/"} {
+		if strings.HasPrefix(*s, prefix) {
+			return template.URL(*s)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,263 @@
+// Package documents prepares the data printed on the documents of an organisation.
+// The data is resolved once and shared by every layout a document is rendered in.
+package documents
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+)
+
+// Party is the seller or the buyer of a document with its requisites.
+type Party struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	INN      string `json:"inn"`
+	KPP      string `json:"kpp"`
+	OGRN     string `json:"ogrn"`
+	Address  string `json:"address"`
+	// Branch is the name of the branch of the company the document is issued to, whose
+	// KPP and address the party has then.
+	Branch string `json:"branch,omitempty"`
+}
+
+// BankRequisites is the bank account the invoice is paid to.
+type BankRequisites struct {
+	Name        string `json:"name"`
+	BIK         string `json:"bik"`
+	Account     string `json:"account"`
+	CorrAccount string `json:"corr_account"`
+	INN         string `json:"inn"`
+	KPP         string `json:"kpp"`
+}
+
+// Signer signs a document for the seller or the buyer. Sign is the image of the
+// signature as stored with the organisation or the contact.
+type Signer struct {
+	Name  string  `json:"name"`
+	Title string  `json:"title"`
+	Sign  *string `json:"sign,omitempty"`
+}
+
+// InvoiceLine is an item of the invoice. Discount is the line's own discount plus its
+// share of the invoice discount, Amount is without VAT and Total with it. The Price of
+// a line with VatIncluded contains the VAT.
+type InvoiceLine struct {
+	Number      int        `json:"number"`
+	Description string     `json:"description"`
+	Unit        string     `json:"unit"`
+	Quantity    float64    `json:"quantity"`
+	Price       data.Money `json:"price"`
+	Discount    data.Money `json:"discount"`
+	Amount      data.Money `json:"amount"`
+	VatRate     string     `json:"vat_rate"`
+	Vat         data.Money `json:"vat"`
+	Total       data.Money `json:"total"`
+	VatIncluded bool       `json:"vat_included"`
+}
+
+// InvoiceTotals sums up the lines. Total is the amount to pay, VAT included.
+type InvoiceTotals struct {
+	Discount data.Money `json:"discount"`
+	Amount   data.Money `json:"amount"`
+	Vat      data.Money `json:"vat"`
+	Total    data.Money `json:"total"`
+}
+
+// Invoice is everything the invoice templates are rendered with. Values which are
+// missing, e.g. an invoice without a bank account, are left empty, so a layout can
+// always reach every field.
+type Invoice struct {
+	ID            int64           `json:"id"`
+	Title         string          `json:"title"`
+	Number        string          `json:"number"`
+	Date          time.Time       `json:"date"`
+	DueDate       *time.Time      `json:"due_date"`
+	IsAdvance     bool            `json:"is_advance"`
+	ChargesVat    bool            `json:"charges_vat"`
+	Seller        Party           `json:"seller"`
+	Buyer         Party           `json:"buyer"`
+	BankAccount   *BankRequisites `json:"bank_account"`
+	Agreement     string          `json:"agreement"`
+	Lines         []InvoiceLine   `json:"lines"`
+	Totals        InvoiceTotals   `json:"totals"`
+	AmountInWords string          `json:"amount_in_words"`
+	CEO           Signer          `json:"ceo"`
+	CFO           Signer          `json:"cfo"`
+	BuyerSigner   *Signer         `json:"buyer_signer"`
+	Stamp         *string         `json:"stamp,omitempty"`
+	// VatIncluded is set when the VAT of every line is included in its price, the
+	// invoice is then printed with the amounts including VAT.
+	VatIncluded bool `json:"vat_included"`
+	// Draft is set until the invoice is sent, Watermark is printed across it then.
+	Draft     bool   `json:"draft"`
+	Watermark string `json:"watermark,omitempty"`
+}
+
+// MarkDraft marks the invoice as not sent yet and applies the draft settings of the
+// organisation: the watermark and, if they are hidden, no bank requisites.
+func (doc *Invoice) MarkDraft(organisation *data.Organisation) {
+	doc.Draft = true
+	doc.Watermark = organisation.DraftWatermark
+
+	if organisation.DraftHidesRequisites {
+		doc.BankAccount = nil
+	}
+}
+
+// OrganisationParty returns the organisation as the party of a document.
+func OrganisationParty(organisation *data.Organisation) Party {
+	party := Party{
+		ID:       organisation.ID,
+		Name:     organisation.Name,
+		FullName: organisation.FullName,
+	}
+
+	if d := organisation.Details; d != nil {
+		party.INN, party.KPP, party.OGRN, party.Address = d.INN, d.KPP, d.OGRN, d.Address
+	}
+
+	return party
+}
+
+// CompanyParty returns the company as the party of a document.
+func CompanyParty(company *data.Company) Party {
+	party := Party{
+		ID:       company.ID,
+		Name:     company.Name,
+		FullName: company.FullName,
+	}
+
+	if d := company.Details; d != nil {
+		party.INN, party.KPP, party.OGRN, party.Address = d.INN, d.KPP, d.OGRN, d.Address
+	}
+
+	return party
+}
+
+// BranchParty returns the branch of the company as the party of a document, with the
+// KPP and the address of the branch.
+func BranchParty(company *data.Company, branch *data.CompanyBranch) Party {
+	withBranch := *company
+	withBranch.Details = branch.ApplyTo(company.Details)
+
+	party := CompanyParty(&withBranch)
+	party.Branch = branch.Name
+
+	return party
+}
+
+// NewBankRequisites returns the requisites of the bank account.
+func NewBankRequisites(bankAccount *data.BankAccount) *BankRequisites {
+	requisites := &BankRequisites{Name: bankAccount.Name}
+
+	if d := bankAccount.Details; d != nil {
+		requisites.BIK = d.BIK
+		requisites.Account = d.Account
+		requisites.CorrAccount = d.CorrAccount
+		requisites.INN = d.INN
+		requisites.KPP = d.KPP
+	}
+
+	return requisites
+}
+
+// NewInvoice resolves the data of the invoice with its items and the records it
+// refers to. The branch, the bank account, the agreement and the signer contact may be
+// nil.
+func NewInvoice(invoice *data.Invoice, items []*data.InvoiceItem, organisation *data.Organisation, company *data.Company,
+	branch *data.CompanyBranch, bankAccount *data.BankAccount, agreement *data.Agreement, signer *data.Contact) *Invoice {
+	doc := &Invoice{
+		ID:         invoice.ID,
+		Title:      fmt.Sprintf("Счет на оплату № %s от %s", invoice.Number, invoice.Date.Format("02.01.2006")),
+		Number:     invoice.Number,
+		Date:       invoice.Date,
+		DueDate:    invoice.DueDate,
+		IsAdvance:  invoice.IsAdvance,
+		ChargesVat: invoice.TaxationSystem != data.TaxationUSN,
+		Lines:      []InvoiceLine{},
+		Seller:     OrganisationParty(organisation),
+		Buyer:      CompanyParty(company),
+		CEO:        Signer{Name: organisation.CEO, Title: organisation.CEOTitle, Sign: organisation.CEOSign},
+		CFO:        Signer{Name: organisation.CFO, Title: organisation.CFOTitle, Sign: organisation.CFOSign},
+		Stamp:      organisation.Stamp,
+	}
+
+	if branch != nil {
+		doc.Buyer = BranchParty(company, branch)
+	}
+
+	if signer != nil {
+		doc.BuyerSigner = &Signer{Name: signer.Name, Title: signer.Title, Sign: signer.Sign}
+	}
+
+	if bankAccount != nil {
+		doc.BankAccount = NewBankRequisites(bankAccount)
+	}
+
+	if agreement != nil {
+		doc.Agreement = agreement.Name
+	}
+
+	// The items are printed in the order of their positions.
+	items = append([]*data.InvoiceItem(nil), items...)
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Position != items[j].Position {
+			return items[i].Position < items[j].Position
+		}
+		return items[i].ID < items[j].ID
+	})
+
+	for i, item := range items {
+		line := InvoiceLine{
+			Number:      i + 1,
+			Description: item.Description,
+			Quantity:    item.Quantity,
+			Price:       item.Price,
+			Discount:    item.Discount + item.InvoiceDiscount,
+			Amount:      item.Amount,
+			Vat:         item.Vat,
+			Total:       item.Amount + item.Vat,
+		}
+
+		if item.Unit != nil {
+			line.Unit = item.Unit.Name
+		}
+		if item.VatRate != nil {
+			line.VatRate = item.VatRate.Name
+		}
+		if line.Description == "" && item.Product != nil {
+			line.Description = item.Product.Name
+		}
+
+		vatMode := invoice.VatMode
+		if item.VatMode != nil {
+			vatMode = *item.VatMode
+		}
+		line.VatIncluded = vatMode == data.VatIncluded
+
+		doc.Lines = append(doc.Lines, line)
+	}
+
+	doc.VatIncluded = invoice.VatMode == data.VatIncluded
+	for _, line := range doc.Lines {
+		doc.VatIncluded = line.VatIncluded
+		if !line.VatIncluded {
+			break
+		}
+	}
+
+	doc.Totals = InvoiceTotals{
+		Discount: invoice.Discount,
+		Amount:   invoice.Amount,
+		Vat:      invoice.Vat,
+		Total:    invoice.Amount + invoice.Vat,
+	}
+
+	doc.AmountInWords = AmountInWords(doc.Totals.Total)
+
+	return doc
+}
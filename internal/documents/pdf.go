@@ -0,0 +1,547 @@
+package documents
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ElOtro/stockup-api/internal/pdf"
+)
+
+// PDFFonts are the fonts invoices are printed with as PDF. Bold is used for the
+// title, the parties and the totals; without it they are printed in Regular.
+type PDFFonts struct {
+	Regular *pdf.Font
+	Bold    *pdf.Font
+}
+
+// ImageLoader returns the content of the image an http or https URL of the stamp or
+// a signature points to.
+type ImageLoader func(url string) ([]byte, error)
+
+// The PDF is laid out like the HTML page: A4 with margins of 15 mm, 10 pt text and
+// smaller muted captions.
+var (
+	pdfMargin = pdf.MM(15)
+	pdfWidth  = pdf.A4Width - 2*pdfMargin
+	pdfBottom = pdf.A4Height - pdfMargin
+)
+
+const (
+	pdfFontSize   = 10.0
+	pdfLineHeight = 12.0
+	pdfSmallSize  = 8.0
+	pdfCellSize   = 9.0
+	pdfPadding    = 3.0
+)
+
+// pdfLayout draws the invoice from the top of the first page down, y is where the
+// next block starts. Blocks which don't fit on the page go to the next one.
+type pdfLayout struct {
+	doc     *pdf.Document
+	page    *pdf.Page
+	y       float64
+	fonts   PDFFonts
+	invoice *Invoice
+}
+
+// RenderInvoicePDF writes the invoice as an A4 PDF document with the same content as
+// the HTML page. The stamp and the signatures are printed when they are images, given
+// inline as data:image URLs or loaded by load from http and https URLs; images which
+// can't be loaded are left out.
+func RenderInvoicePDF(w io.Writer, invoice *Invoice, fonts PDFFonts, load ImageLoader) error {
+	if fonts.Regular == nil {
+		return fmt.Errorf("documents: no font to print the PDF with")
+	}
+	if fonts.Bold == nil {
+		fonts.Bold = fonts.Regular
+	}
+
+	l := &pdfLayout{doc: pdf.New(invoice.Title), fonts: fonts, invoice: invoice}
+
+	l.newPage()
+	l.bankAccount()
+	l.title()
+	l.parties()
+	l.items()
+	l.totals()
+	l.words()
+	l.signatures(load)
+
+	return l.doc.Write(w)
+}
+
+// newPage starts a page, with the watermark of a draft behind the content.
+func (l *pdfLayout) newPage() {
+	l.page = l.doc.AddPage(pdf.A4Width, pdf.A4Height)
+	l.y = pdfMargin
+
+	if !l.invoice.Draft || l.invoice.Watermark == "" {
+		return
+	}
+
+	// The watermark runs up at 30 degrees through the middle of the page.
+	const size, sin, cos = 72.0, 0.5, 0.866
+	half := l.fonts.Bold.TextWidth(l.invoice.Watermark, size) / 2
+
+	l.page.SetColor(0.96, 0.82, 0.82)
+	l.page.RotatedText(pdf.A4Width/2-half*cos, pdf.A4Height*0.45+half*sin, 30, l.fonts.Bold, size, l.invoice.Watermark)
+	l.page.SetColor(0, 0, 0)
+}
+
+// ensure moves on to the next page unless a block of the height fits on this one.
+func (l *pdfLayout) ensure(height float64) bool {
+	if l.y+height <= pdfBottom {
+		return false
+	}
+
+	l.newPage()
+	return true
+}
+
+// muted prints a caption in small grey letters.
+func (l *pdfLayout) muted(x, y float64, s string) {
+	l.page.SetColor(0.33, 0.33, 0.33)
+	l.page.Text(x, y, l.fonts.Regular, pdfSmallSize, s)
+	l.page.SetColor(0, 0, 0)
+}
+
+// right prints the text aligned to the right at x.
+func (l *pdfLayout) right(x, y float64, font *pdf.Font, size float64, s string) {
+	l.page.Text(x-font.TextWidth(s, size), y, font, size, s)
+}
+
+// wrap breaks the text into lines which fit into the width. Words longer than a line
+// are broken wherever the line is full.
+func wrap(font *pdf.Font, size float64, s string, width float64) []string {
+	var lines []string
+	line := ""
+
+	for _, word := range strings.Fields(s) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+
+		if font.TextWidth(candidate, size) <= width {
+			line = candidate
+			continue
+		}
+
+		if line != "" {
+			lines = append(lines, line)
+		}
+
+		line = ""
+		for _, r := range word {
+			if line != "" && font.TextWidth(line+string(r), size) > width {
+				lines = append(lines, line)
+				line = ""
+			}
+			line += string(r)
+		}
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// limit keeps the first n lines.
+func limit(lines []string, n int) []string {
+	if len(lines) > n {
+		return lines[:n]
+	}
+	return lines
+}
+
+// bankAccount prints the table with the requisites the invoice is paid to.
+func (l *pdfLayout) bankAccount() {
+	bank := l.invoice.BankAccount
+	if bank == nil {
+		return
+	}
+
+	x0 := pdfMargin
+	w1, w2, w3 := pdf.MM(50), pdf.MM(50), pdf.MM(20)
+	w4 := pdfWidth - w1 - w2 - w3
+	x1, x2, x3 := x0+w1, x0+w1+w2, x0+w1+w2+w3
+	row, last := pdf.MM(6), pdf.MM(10)
+	y := l.y
+
+	cells := []struct {
+		x, y, w, h float64
+		text       string
+	}{
+		{x2, y, w3, row, "БИК"},
+		{x3, y, w4, row, bank.BIK},
+		{x2, y + row, w3, row, "Сч. №"},
+		{x3, y + row, w4, row, bank.CorrAccount},
+		{x0, y + 2*row, w1, row, "ИНН " + bank.INN},
+		{x1, y + 2*row, w2, row, "КПП " + bank.KPP},
+		{x2, y + 2*row, w3, row + last, "Сч. №"},
+		{x3, y + 2*row, w4, row + last, bank.Account},
+	}
+
+	for _, c := range cells {
+		l.page.Rect(c.x, c.y, c.w, c.h, 0.5)
+		l.page.Text(c.x+pdfPadding, c.y+pdfPadding+pdfFontSize*0.8, l.fonts.Regular, pdfFontSize, c.text)
+	}
+
+	// The bank and the recipient have their captions at the bottom of the cell.
+	l.page.Rect(x0, y, w1+w2, 2*row, 0.5)
+	for i, line := range limit(wrap(l.fonts.Regular, pdfFontSize, bank.Name, w1+w2-2*pdfPadding), 1) {
+		l.page.Text(x0+pdfPadding, y+pdfPadding+pdfFontSize*0.8+float64(i)*pdfLineHeight, l.fonts.Regular, pdfFontSize, line)
+	}
+	l.muted(x0+pdfPadding, y+2*row-pdfPadding, "Банк получателя")
+
+	y += 3 * row
+	l.page.Rect(x0, y, w1+w2, last, 0.5)
+	for _, line := range limit(wrap(l.fonts.Regular, pdfFontSize, l.invoice.Seller.FullName, w1+w2-2*pdfPadding), 1) {
+		l.page.Text(x0+pdfPadding, y+pdfPadding+pdfFontSize*0.8, l.fonts.Regular, pdfFontSize, line)
+	}
+	l.muted(x0+pdfPadding, y+last-pdfPadding, "Получатель")
+
+	l.y = y + last + pdf.MM(4)
+}
+
+// title prints the title underlined with a bold rule.
+func (l *pdfLayout) title() {
+	const size = 14.0
+
+	lines := wrap(l.fonts.Bold, size, l.invoice.Title, pdfWidth)
+	for _, line := range lines {
+		l.y += size * 1.2
+		l.page.Text(pdfMargin, l.y, l.fonts.Bold, size, line)
+	}
+
+	l.y += 6
+	l.page.Line(pdfMargin, l.y, pdfMargin+pdfWidth, l.y, 2)
+	l.y += pdf.MM(4)
+}
+
+// partyText joins the name and the requisites of a party the way they are printed.
+func partyText(party Party) string {
+	s := party.FullName
+	if s == "" {
+		s = party.Name
+	}
+
+	if party.INN != "" {
+		s += ", ИНН " + party.INN
+	}
+	if party.KPP != "" {
+		s += ", КПП " + party.KPP
+	}
+	if party.Address != "" {
+		s += ", " + party.Address
+	}
+
+	return s
+}
+
+// parties prints the seller, the buyer and the agreement.
+func (l *pdfLayout) parties() {
+	labelWidth := pdf.MM(25)
+
+	rows := [][2]string{
+		{"Поставщик:", partyText(l.invoice.Seller)},
+		{"Покупатель:", partyText(l.invoice.Buyer)},
+	}
+	if l.invoice.Agreement != "" {
+		rows = append(rows, [2]string{"Основание:", l.invoice.Agreement})
+	}
+
+	for _, row := range rows {
+		lines := wrap(l.fonts.Bold, pdfFontSize, row[1], pdfWidth-labelWidth)
+		l.ensure(float64(len(lines))*pdfLineHeight + 4)
+
+		l.page.Text(pdfMargin, l.y+pdfLineHeight, l.fonts.Regular, pdfFontSize, row[0])
+		for i, line := range lines {
+			l.page.Text(pdfMargin+labelWidth, l.y+float64(i+1)*pdfLineHeight, l.fonts.Bold, pdfFontSize, line)
+		}
+
+		l.y += float64(len(lines))*pdfLineHeight + 4
+	}
+
+	l.y += pdf.MM(3)
+}
+
+// pdfColumn is a column of the items table, the description takes the width left.
+type pdfColumn struct {
+	title string
+	width float64
+	right bool
+}
+
+func (l *pdfLayout) columns() []pdfColumn {
+	columns := []pdfColumn{
+		{"№", pdf.MM(8), true},
+		{"Товары (работы, услуги)", 0, false},
+		{"Кол-во", pdf.MM(16), true},
+		{"Ед.", pdf.MM(12), false},
+		{"Цена", pdf.MM(22), true},
+		{"Скидка", pdf.MM(20), true},
+		{"Сумма", pdf.MM(24), true},
+	}
+	if l.invoice.ChargesVat {
+		columns = append(columns, pdfColumn{"НДС", pdf.MM(22), true})
+	}
+
+	rest := pdfWidth
+	for _, column := range columns {
+		rest -= column.width
+	}
+	columns[1].width = rest
+
+	return columns
+}
+
+// header prints the head of the items table on a grey background.
+func (l *pdfLayout) header(columns []pdfColumn) {
+	height := pdf.MM(7)
+
+	l.page.SetColor(0.94, 0.94, 0.94)
+	l.page.FillRect(pdfMargin, l.y, pdfWidth, height)
+	l.page.SetColor(0, 0, 0)
+
+	x := pdfMargin
+	for _, column := range columns {
+		l.page.Rect(x, l.y, column.width, height, 0.5)
+		title := column.title
+		offset := (column.width - l.fonts.Bold.TextWidth(title, pdfCellSize)) / 2
+		l.page.Text(x+offset, l.y+height/2+pdfCellSize*0.35, l.fonts.Bold, pdfCellSize, title)
+		x += column.width
+	}
+
+	l.y += height
+}
+
+// items prints the lines of the invoice, repeating the head of the table on every
+// page it runs over.
+func (l *pdfLayout) items() {
+	columns := l.columns()
+	lineHeight := pdfCellSize * 1.25
+
+	l.ensure(pdf.MM(7) + 2*lineHeight)
+	l.header(columns)
+
+	for _, line := range l.invoice.Lines {
+		amount := line.Amount
+		if l.invoice.VatIncluded {
+			amount = line.Total
+		}
+
+		cells := [][]string{
+			{fmt.Sprint(line.Number)},
+			wrap(l.fonts.Regular, pdfCellSize, line.Description, columns[1].width-2*pdfPadding),
+			{formatQuantity(line.Quantity)},
+			{line.Unit},
+			{formatMoney(line.Price)},
+			{formatMoney(line.Discount)},
+			{formatMoney(amount)},
+		}
+		if l.invoice.ChargesVat {
+			cells = append(cells, []string{formatMoney(line.Vat)})
+		}
+
+		lines := 1
+		for _, cell := range cells {
+			if len(cell) > lines {
+				lines = len(cell)
+			}
+		}
+		if l.invoice.ChargesVat && line.VatRate != "" && lines < 2 {
+			lines = 2
+		}
+		height := float64(lines)*lineHeight + 2*pdfPadding
+
+		if l.ensure(height) {
+			l.header(columns)
+		}
+
+		x := pdfMargin
+		for i, column := range columns {
+			l.page.Rect(x, l.y, column.width, height, 0.5)
+
+			for j, text := range cells[i] {
+				baseline := l.y + pdfPadding + float64(j)*lineHeight + pdfCellSize
+				if column.right {
+					l.right(x+column.width-pdfPadding, baseline, l.fonts.Regular, pdfCellSize, text)
+				} else {
+					l.page.Text(x+pdfPadding, baseline, l.fonts.Regular, pdfCellSize, text)
+				}
+			}
+
+			x += column.width
+		}
+
+		// The VAT rate is printed under the VAT of the line.
+		if l.invoice.ChargesVat && line.VatRate != "" {
+			l.page.SetColor(0.33, 0.33, 0.33)
+			l.right(pdfMargin+pdfWidth-pdfPadding, l.y+pdfPadding+lineHeight+pdfCellSize, l.fonts.Regular, pdfSmallSize, line.VatRate)
+			l.page.SetColor(0, 0, 0)
+		}
+
+		l.y += height
+	}
+
+	l.y += 4
+}
+
+// totals prints the totals under the amounts of the table.
+func (l *pdfLayout) totals() {
+	doc := l.invoice
+
+	var rows [][2]string
+	switch {
+	case doc.ChargesVat && doc.VatIncluded:
+		rows = append(rows, [2]string{"Итого:", formatMoney(doc.Totals.Total)}, [2]string{"В том числе НДС:", formatMoney(doc.Totals.Vat)})
+	case doc.ChargesVat:
+		rows = append(rows, [2]string{"Итого:", formatMoney(doc.Totals.Amount)}, [2]string{"НДС:", formatMoney(doc.Totals.Vat)})
+	default:
+		rows = append(rows, [2]string{"Итого:", formatMoney(doc.Totals.Amount)}, [2]string{"Без налога (НДС)", "-"})
+	}
+	rows = append(rows, [2]string{"Всего к оплате:", formatMoney(doc.Totals.Total)})
+
+	l.ensure(float64(len(rows)) * pdfLineHeight)
+
+	edge := pdfMargin + pdfWidth - pdfPadding
+	for _, row := range rows {
+		l.y += pdfLineHeight
+		l.right(edge-pdf.MM(30), l.y, l.fonts.Bold, pdfFontSize, row[0])
+		l.right(edge, l.y, l.fonts.Bold, pdfFontSize, row[1])
+	}
+
+	l.y += pdf.MM(4)
+}
+
+// words prints the count of the lines, the total in words and the due date.
+func (l *pdfLayout) words() {
+	doc := l.invoice
+
+	summary := fmt.Sprintf("Всего наименований %d, на сумму %s руб.", len(doc.Lines), formatMoney(doc.Totals.Total))
+	words := wrap(l.fonts.Bold, pdfFontSize, doc.AmountInWords, pdfWidth)
+
+	lines := 1 + len(words)
+	if doc.DueDate != nil {
+		lines++
+	}
+	l.ensure(float64(lines)*pdfLineHeight + pdf.MM(4))
+
+	l.y += pdfLineHeight
+	l.page.Text(pdfMargin, l.y, l.fonts.Regular, pdfFontSize, summary)
+
+	for _, line := range words {
+		l.y += pdfLineHeight
+		l.page.Text(pdfMargin, l.y, l.fonts.Bold, pdfFontSize, line)
+	}
+
+	if doc.DueDate != nil {
+		l.y += pdfLineHeight
+		l.page.Text(pdfMargin, l.y, l.fonts.Regular, pdfFontSize, "Оплатить не позднее "+formatDate(*doc.DueDate))
+	}
+
+	l.y += pdf.MM(3)
+	l.page.Line(pdfMargin, l.y, pdfMargin+pdfWidth, l.y, 2)
+	l.y += pdf.MM(4)
+}
+
+// signatures prints the signers of the seller and the buyer with their signatures and
+// the stamp of the seller over them.
+func (l *pdfLayout) signatures(load ImageLoader) {
+	doc := l.invoice
+
+	l.ensure(pdf.MM(45))
+	top := l.y
+
+	half := pdfWidth / 2
+	l.y += pdf.MM(14)
+	l.signer(pdfMargin, half, doc.CEO, "Руководитель", load)
+	l.signer(pdfMargin+half, half, doc.CFO, "Бухгалтер", load)
+
+	if doc.BuyerSigner != nil {
+		l.y += pdf.MM(16)
+		l.page.Text(pdfMargin, l.y, l.fonts.Regular, pdfFontSize, "Покупатель:")
+		l.signer(pdfMargin+pdf.MM(25), pdfWidth-pdf.MM(25), *doc.BuyerSigner, "Представитель", load)
+	}
+
+	if stamp := loadImage(doc.Stamp, load); stamp != nil {
+		height := pdf.MM(40)
+		width := height * float64(stamp.Width()) / float64(stamp.Height())
+		l.page.Image(stamp, pdfMargin+pdf.MM(35), top, width, height)
+	}
+
+	l.y += pdf.MM(4)
+}
+
+// signer prints the title of the signer, the signature over a line and the name on
+// the baseline l.y.
+func (l *pdfLayout) signer(x, width float64, signer Signer, title string, load ImageLoader) {
+	if signer.Title != "" {
+		title = signer.Title
+	}
+
+	titleWidth := l.fonts.Regular.TextWidth(title, pdfFontSize)
+	lineWidth := pdf.MM(25)
+	if titleWidth+lineWidth+8 > width {
+		title = limit(wrap(l.fonts.Regular, pdfFontSize, title, width-lineWidth-8), 1)[0]
+		titleWidth = l.fonts.Regular.TextWidth(title, pdfFontSize)
+	}
+
+	l.page.Text(x, l.y, l.fonts.Regular, pdfFontSize, title)
+
+	lineX := x + titleWidth + 4
+	l.page.Line(lineX, l.y+1, lineX+lineWidth, l.y+1, 0.5)
+
+	if sign := loadImage(signer.Sign, load); sign != nil {
+		height := pdf.MM(12)
+		signWidth := height * float64(sign.Width()) / float64(sign.Height())
+		if signWidth > lineWidth {
+			signWidth, height = lineWidth, lineWidth*float64(sign.Height())/float64(sign.Width())
+		}
+		l.page.Image(sign, lineX+(lineWidth-signWidth)/2, l.y+2-height, signWidth, height)
+	}
+
+	name := limit(wrap(l.fonts.Regular, pdfFontSize, signer.Name, x+width-lineX-lineWidth-8), 1)
+	if len(name) > 0 {
+		l.page.Text(lineX+lineWidth+4, l.y, l.fonts.Regular, pdfFontSize, name[0])
+	}
+}
+
+// loadImage returns the stamp or a signature as an image, or nil if it isn't one or
+// can't be loaded.
+func loadImage(s *string, load ImageLoader) *pdf.Image {
+	if s == nil {
+		return nil
+	}
+
+	var content []byte
+	var err error
+
+	switch {
+	case strings.HasPrefix(*s, "data:image/"):
+		meta, encoded, ok := strings.Cut(strings.TrimPrefix(*s, "data:"), ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil
+		}
+		content, err = base64.StdEncoding.DecodeString(encoded)
+	case (strings.HasPrefix(*s, "https://") || strings.HasPrefix(*s, "http://")) && load != nil:
+		content, err = load(*s)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+
+	img, err := pdf.DecodeImage(content)
+	if err != nil {
+		return nil
+	}
+
+	return img
+}
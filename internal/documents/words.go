@@ -0,0 +1,127 @@
+package documents
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+)
+
+var (
+	onesMasculine = [...]string{"", "один", "два", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять",
+		"десять", "одиннадцать", "двенадцать", "тринадцать", "четырнадцать", "пятнадцать", "шестнадцать",
+		"семнадцать", "восемнадцать", "девятнадцать"}
+	tensWords     = [...]string{"", "", "двадцать", "тридцать", "сорок", "пятьдесят", "шестьдесят", "семьдесят", "восемьдесят", "девяносто"}
+	hundredsWords = [...]string{"", "сто", "двести", "триста", "четыреста", "пятьсот", "шестьсот", "семьсот", "восемьсот", "девятьсот"}
+)
+
+// The forms of a noun after numbers ending in 1, in 2-4 and in anything else, e.g.
+// "один рубль", "два рубля", "пять рублей".
+type nounForms [3]string
+
+var (
+	roubleForms = nounForms{"рубль", "рубля", "рублей"}
+	kopeckForms = nounForms{"копейка", "копейки", "копеек"}
+)
+
+// The groups of three digits from the thousands on. Thousands are feminine, so they
+// are counted as "одна тысяча", "две тысячи".
+var scales = []struct {
+	forms    nounForms
+	feminine bool
+}{
+	{nounForms{"тысяча", "тысячи", "тысяч"}, true},
+	{nounForms{"миллион", "миллиона", "миллионов"}, false},
+	{nounForms{"миллиард", "миллиарда", "миллиардов"}, false},
+	{nounForms{"триллион", "триллиона", "триллионов"}, false},
+	{nounForms{"квадриллион", "квадриллиона", "квадриллионов"}, false},
+}
+
+// form returns the form of the noun after the number n.
+func (f nounForms) form(n int64) string {
+	switch {
+	case n%100 >= 11 && n%100 <= 19:
+		return f[2]
+	case n%10 == 1:
+		return f[0]
+	case n%10 >= 2 && n%10 <= 4:
+		return f[1]
+	default:
+		return f[2]
+	}
+}
+
+// hundredsInWords spells a number below 1000.
+func hundredsInWords(n int64, feminine bool) []string {
+	words := []string{}
+
+	if n >= 100 {
+		words = append(words, hundredsWords[n/100])
+		n %= 100
+	}
+	if n >= 20 {
+		words = append(words, tensWords[n/10])
+		n %= 10
+	}
+
+	switch {
+	case n == 1 && feminine:
+		words = append(words, "одна")
+	case n == 2 && feminine:
+		words = append(words, "две")
+	case n > 0:
+		words = append(words, onesMasculine[n])
+	}
+
+	return words
+}
+
+// AmountInWords spells the amount the way it is printed on Russian documents: the
+// roubles in words and the kopecks in digits, e.g. "Одна тысяча двести рублей 50
+// копеек".
+func AmountInWords(amount data.Money) string {
+	kopecks := int64(amount)
+
+	words := []string{}
+	if kopecks < 0 {
+		words = append(words, "минус")
+		kopecks = -kopecks
+	}
+
+	roubles := kopecks / 100
+	kopecks %= 100
+
+	if roubles == 0 {
+		words = append(words, "ноль")
+	}
+
+	// Split the roubles into groups of three digits, the lowest first.
+	groups := []int64{}
+	for n := roubles; n > 0; n /= 1000 {
+		groups = append(groups, n%1000)
+	}
+
+	for i := len(groups) - 1; i >= 0; i-- {
+		if groups[i] == 0 {
+			continue
+		}
+
+		if i == 0 {
+			words = append(words, hundredsInWords(groups[i], false)...)
+			continue
+		}
+
+		scale := scales[i-1]
+		words = append(words, hundredsInWords(groups[i], scale.feminine)...)
+		words = append(words, scale.forms.form(groups[i]))
+	}
+
+	words = append(words, roubleForms.form(roubles), fmt.Sprintf("%02d", kopecks), kopeckForms.form(kopecks))
+
+	s := strings.Join(words, " ")
+	r, size := utf8.DecodeRuneInString(s)
+
+	return string(unicode.ToUpper(r)) + s[size:]
+}
@@ -0,0 +1,252 @@
+// Package encryption implements envelope encryption of sensitive field values. Every
+// value is encrypted with its own random data key using AES-GCM, and the data key is
+// encrypted ("wrapped") with a master key from the keyring. Rotating the master key
+// only requires re-wrapping the data keys, the values themselves are left untouched.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encrypted values are stored as "enc:v1:<key id>:<wrapped data key>:<ciphertext>".
+const prefix = "enc:v1:"
+
+var (
+	ErrInvalidKey   = errors.New("encryption key must be 32 bytes long")
+	ErrUnknownKey   = errors.New("unknown encryption key")
+	ErrNoKeyring    = errors.New("encryption keys are not configured")
+	ErrInvalidValue = errors.New("invalid encrypted value")
+)
+
+// Keyring holds the master keys. New values are always encrypted with the current
+// key, the others are only kept to decrypt values which haven't been rotated yet.
+type Keyring struct {
+	keys    map[string][]byte
+	current string
+}
+
+// New parses the keys given as a comma separated list of "id:base64 key" pairs and
+// returns a keyring using the key with the given id for encryption. If current is
+// empty the first key of the list is used.
+func New(keys string, current string) (*Keyring, error) {
+	k := &Keyring{
+		keys:    make(map[string][]byte),
+		current: current,
+	}
+
+	for _, pair := range strings.Split(keys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("encryption key %q must be in the id:key format", pair)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", parts[0], err)
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q: %w", parts[0], ErrInvalidKey)
+		}
+
+		k.keys[parts[0]] = key
+
+		if k.current == "" {
+			k.current = parts[0]
+		}
+	}
+
+	if len(k.keys) == 0 {
+		return nil, ErrNoKeyring
+	}
+
+	if _, ok := k.keys[k.current]; !ok {
+		return nil, fmt.Errorf("encryption key %q: %w", k.current, ErrUnknownKey)
+	}
+
+	return k, nil
+}
+
+// IsEncrypted reports whether the value was produced by Encrypt().
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt returns the encrypted form of the value. Empty values are kept empty, and a
+// nil keyring returns the value unchanged, so encryption can be switched on later.
+func (k *Keyring) Encrypt(value string) (string, error) {
+	if k == nil || value == "" || IsEncrypted(value) {
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dataKey, []byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := seal(k.keys[k.current], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return format(k.current, wrappedKey, ciphertext), nil
+}
+
+// Decrypt returns the plain value. Values which aren't encrypted are returned as they
+// are, so data written before encryption was enabled can still be read.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	if k == nil {
+		return "", ErrNoKeyring
+	}
+
+	keyID, wrappedKey, ciphertext, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := k.unwrap(keyID, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// Rotate re-wraps the data key of the value with the current master key. Plain values
+// are encrypted. The second result reports whether the value has changed and has to
+// be written back.
+func (k *Keyring) Rotate(value string) (string, bool, error) {
+	if k == nil {
+		return value, false, ErrNoKeyring
+	}
+
+	if value == "" {
+		return value, false, nil
+	}
+
+	if !IsEncrypted(value) {
+		encrypted, err := k.Encrypt(value)
+		return encrypted, err == nil, err
+	}
+
+	keyID, wrappedKey, ciphertext, err := parse(value)
+	if err != nil {
+		return value, false, err
+	}
+
+	if keyID == k.current {
+		return value, false, nil
+	}
+
+	dataKey, err := k.unwrap(keyID, wrappedKey)
+	if err != nil {
+		return value, false, err
+	}
+
+	wrappedKey, err = seal(k.keys[k.current], dataKey)
+	if err != nil {
+		return value, false, err
+	}
+
+	return format(k.current, wrappedKey, ciphertext), true, nil
+}
+
+func (k *Keyring) unwrap(keyID string, wrappedKey []byte) ([]byte, error) {
+	masterKey, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q: %w", keyID, ErrUnknownKey)
+	}
+
+	return open(masterKey, wrappedKey)
+}
+
+// seal encrypts the plaintext with AES-GCM and prepends the random nonce.
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open reverses seal.
+func open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrInvalidValue
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func format(keyID string, wrappedKey, ciphertext []byte) string {
+	return prefix + keyID + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext)
+}
+
+func parse(value string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, ErrInvalidValue
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrInvalidValue
+	}
+
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, ErrInvalidValue
+	}
+
+	return parts[0], wrappedKey, ciphertext, nil
+}
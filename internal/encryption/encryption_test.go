@@ -0,0 +1,178 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	oldKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	newKey = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+)
+
+func mustNew(t *testing.T, keys, current string) *Keyring {
+	t.Helper()
+
+	k, err := New(keys, current)
+	if err != nil {
+		t.Fatalf("New(%q, %q): %v", keys, current, err)
+	}
+
+	return k
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    string
+		current string
+		wantErr error
+	}{
+		{name: "one key", keys: "a:" + oldKey},
+		{name: "current key", keys: "a:" + oldKey + ", b:" + newKey, current: "b"},
+		{name: "no keys", keys: " , ", wantErr: ErrNoKeyring},
+		{name: "short key", keys: "a:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: ErrInvalidKey},
+		{name: "unknown current key", keys: "a:" + oldKey, current: "b", wantErr: ErrUnknownKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.keys, tt.current)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k := mustNew(t, "a:"+oldKey, "")
+
+	tests := []struct {
+		name  string
+		value string
+		plain bool
+	}{
+		{name: "text", value: "40702810900000000001"},
+		{name: "unicode", value: "Иванов Иван, +7 900 000-00-00"},
+		{name: "colons", value: "enc:v2:not:ours"},
+		{name: "empty", value: "", plain: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, err := k.Encrypt(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.plain {
+				if encrypted != tt.value {
+					t.Errorf("got %q, want the value unchanged", encrypted)
+				}
+				return
+			}
+
+			if !strings.HasPrefix(encrypted, "enc:v1:a:") || strings.Contains(encrypted, tt.value) {
+				t.Errorf("got %q, want an enc:v1 value of key a", encrypted)
+			}
+
+			decrypted, err := k.Decrypt(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if decrypted != tt.value {
+				t.Errorf("got %q, want %q", decrypted, tt.value)
+			}
+
+			again, err := k.Encrypt(encrypted)
+			if err != nil || again != encrypted {
+				t.Errorf("encrypting twice: got %q, %v, want the value unchanged", again, err)
+			}
+		})
+	}
+}
+
+func TestDecryptPlainAndInvalid(t *testing.T) {
+	k := mustNew(t, "a:"+oldKey, "")
+
+	plain, err := k.Decrypt("not encrypted")
+	if err != nil || plain != "not encrypted" {
+		t.Errorf("plain value: got %q, %v", plain, err)
+	}
+
+	encrypted, err := k.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nilKeyring *Keyring
+	if _, err := nilKeyring.Decrypt(encrypted); !errors.Is(err, ErrNoKeyring) {
+		t.Errorf("nil keyring: got error %v, want %v", err, ErrNoKeyring)
+	}
+
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "BB"
+	}
+
+	for _, value := range []string{"enc:v1:a:only-two", "enc:v1:a:!!:!!", tampered} {
+		if _, err := k.Decrypt(value); err == nil {
+			t.Errorf("Decrypt(%q): got no error", value)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	old := mustNew(t, "a:"+oldKey, "")
+
+	encrypted, err := old.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotating := mustNew(t, "a:"+oldKey+",b:"+newKey, "b")
+
+	decrypted, err := rotating.Decrypt(encrypted)
+	if err != nil || decrypted != "secret" {
+		t.Fatalf("decrypting a value of the previous key: got %q, %v", decrypted, err)
+	}
+
+	rotated, changed, err := rotating.Rotate(encrypted)
+	if err != nil || !changed {
+		t.Fatalf("Rotate: got changed %v, %v", changed, err)
+	}
+
+	if !strings.HasPrefix(rotated, "enc:v1:b:") {
+		t.Errorf("got %q, want a value of key b", rotated)
+	}
+
+	// The ciphertext stays, only the data key is wrapped again.
+	if encrypted[strings.LastIndex(encrypted, ":"):] != rotated[strings.LastIndex(rotated, ":"):] {
+		t.Errorf("the ciphertext changed")
+	}
+
+	_, changed, err = rotating.Rotate(rotated)
+	if err != nil || changed {
+		t.Errorf("rotating twice: got changed %v, %v", changed, err)
+	}
+
+	current := mustNew(t, "b:"+newKey, "")
+
+	if _, err := current.Decrypt(encrypted); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("removed key: got error %v, want %v", err, ErrUnknownKey)
+	}
+
+	decrypted, err = current.Decrypt(rotated)
+	if err != nil || decrypted != "secret" {
+		t.Errorf("decrypting the rotated value: got %q, %v", decrypted, err)
+	}
+
+	plain, changed, err := current.Rotate("plain")
+	if err != nil || !changed || !IsEncrypted(plain) {
+		t.Errorf("rotating a plain value: got %q, %v, %v", plain, changed, err)
+	}
+}
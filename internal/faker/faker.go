@@ -1,7 +1,11 @@
+// Package faker generates random but realistic looking data for seeding the database.
+// All values come from the generator of a Faker, so a Faker created with the same
+// seed always produces the same data.
 package faker
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -22,11 +26,11 @@ var companyPostfix = []string{
 	"майнинг", "дизайн", "креатив",
 }
 
-func getCompanyName() (string, string) {
+func (f *Faker) getCompanyName() (string, string) {
 
-	cp := companyPrefix[randomInt(len(companyPrefix))]
-	cs := companySuffix[randomInt(len(companySuffix))]
-	cpx := companyPostfix[randomInt(len(companyPostfix))]
+	cp := companyPrefix[f.Intn(len(companyPrefix))]
+	cs := companySuffix[f.Intn(len(companySuffix))]
+	cpx := companyPostfix[f.Intn(len(companyPostfix))]
 
 	name := fmt.Sprintf("%s%s", cs, cpx)
 	fullName := fmt.Sprintf("%s \"%s%s\"", cp, cs, cpx)
@@ -140,9 +144,25 @@ var titleList = []string{"менеджер", "наладчик", "помошни
 var nounList = []string{"Замена", "Неисправность", "Сбой", "Возгорание", "Тест", "Проверка работоспособности", "Обновление микропрошивки"}
 var productList = []string{"Diode", "LED", "Rectifier", "Transistor", "JFET", "MOSFET", "Integrated Circuit", "LCD", "Cathode Ray Tube", "Vacuum Tube", "Battery", "Fuel Cell", "Power Supply"}
 
-func randomInt(i int) int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(i)
+// Faker wraps its own random generator instead of the global one of math/rand, so
+// several fakers can be used at the same time without affecting each other.
+type Faker struct {
+	rand *rand.Rand
+}
+
+// New returns a Faker seeded with the given value.
+func New(seed int64) *Faker {
+	return NewWithSource(rand.NewSource(seed))
+}
+
+// NewWithSource returns a Faker using the given source of random numbers.
+func NewWithSource(src rand.Source) *Faker {
+	return &Faker{rand: rand.New(src)}
+}
+
+// Intn returns a random number in [0, n).
+func (f *Faker) Intn(n int) int {
+	return f.rand.Intn(n)
 }
 
 // RandomInt Get three parameters , only first mandatory and the rest are optional
@@ -150,17 +170,17 @@ func randomInt(i int) int {
 // 		If only set one parameter :  An integer greater than minimum_int will be returned
 // 		If only set two parameters : All integers between minimum_int and maximum_int will be returned, in a random order.
 // 		If three parameters: `count` integers between minimum_int and maximum_int will be returned.
-func RandomInt(parameters ...int) (p []int, err error) {
+func (f *Faker) RandomInt(parameters ...int) (p []int, err error) {
 	switch len(parameters) {
 	case 1:
 		minInt := parameters[0]
-		p = rand.Perm(minInt)
+		p = f.rand.Perm(minInt)
 		for i := range p {
 			p[i] += minInt
 		}
 	case 2:
 		minInt, maxInt := parameters[0], parameters[1]
-		p = rand.Perm(maxInt - minInt + 1)
+		p = f.rand.Perm(maxInt - minInt + 1)
 
 		for i := range p {
 			p[i] += minInt
@@ -168,14 +188,14 @@ func RandomInt(parameters ...int) (p []int, err error) {
 	case 3:
 		minInt, maxInt := parameters[0], parameters[1]
 		count := parameters[2]
-		p = rand.Perm(maxInt - minInt + 1)
+		p = f.rand.Perm(maxInt - minInt + 1)
 
 		for i := range p {
 			p[i] += minInt
 		}
 		p = p[0:count]
 	default:
-		err = fmt.Errorf("error", len(parameters))
+		err = fmt.Errorf("expected 1 to 3 parameters, got %d", len(parameters))
 	}
 	return p, err
 }
@@ -197,47 +217,59 @@ type Address struct {
 	Building string
 }
 
-func (a *Address) getAddress() string {
-	country := countryList[randomInt(len(countryList))]
-	index := indexList[randomInt(len(indexList))]
-	city := cityList[randomInt(len(cityList))]
-	srteetPrefix := srteetPrefixList[randomInt(len(srteetPrefixList))]
-	srteet := srteetList[randomInt(len(srteetList))]
-	return fmt.Sprintf("%s, %s, г. %s, %s %s, д. %d", country, index, city, srteetPrefix, srteet, randomInt(20))
+func (f *Faker) getAddress() string {
+	country := countryList[f.Intn(len(countryList))]
+	index := indexList[f.Intn(len(indexList))]
+	city := cityList[f.Intn(len(cityList))]
+	srteetPrefix := srteetPrefixList[f.Intn(len(srteetPrefixList))]
+	srteet := srteetList[f.Intn(len(srteetList))]
+	return fmt.Sprintf("%s, %s, г. %s, %s %s, д. %d", country, index, city, srteetPrefix, srteet, f.Intn(20))
 }
 
-func getMaleName() string {
-	firstName := maleFirstNameList[randomInt(len(maleFirstNameList))]
-	lastName := maleLastNameList[randomInt(len(maleLastNameList))]
+func (f *Faker) getMaleName() string {
+	firstName := maleFirstNameList[f.Intn(len(maleFirstNameList))]
+	lastName := maleLastNameList[f.Intn(len(maleLastNameList))]
 	return fmt.Sprintf("%s %s", firstName, lastName)
 }
 
-func getFeMaleName() string {
-	firstName := femaleFirstNameList[randomInt(len(femaleFirstNameList))]
-	lastName := femaleLastNameList[randomInt(len(femaleLastNameList))]
+func (f *Faker) getFeMaleName() string {
+	firstName := femaleFirstNameList[f.Intn(len(femaleFirstNameList))]
+	lastName := femaleLastNameList[f.Intn(len(femaleLastNameList))]
 	return fmt.Sprintf("%s %s", firstName, lastName)
 }
 
-func getEmail(name string) string {
+func (f *Faker) getEmail(name string) string {
 	localPart := translit.EncodeToICAO(strings.ToLower(name))
-	domainName := freeEmailList[randomInt(len(freeEmailList))]
+	domainName := freeEmailList[f.Intn(len(freeEmailList))]
 	return fmt.Sprintf("%s@%s", strings.Join(strings.Fields(localPart), "."), domainName)
 }
 
-func getPhone(prefix string) string {
-	randInt, _ := RandomInt(1, 10)
+func (f *Faker) getPhone(prefix string) string {
+	randInt, _ := f.RandomInt(1, 10)
 	str := strings.Join(IntToString(randInt), "")
 	return fmt.Sprintf("%s (%s) %s-%s-%s", prefix, str[:3], str[3:6], str[6:8], str[8:10])
 }
 
-func getNumber() string {
-	randInt, _ := RandomInt(1, 9)
+func (f *Faker) getNumber() string {
+	randInt, _ := f.RandomInt(1, 9)
 	str := strings.Join(IntToString(randInt), "")
 	return fmt.Sprintf("%s-%s/%s/%s", "IM", str[:3], str[3:6], str[6:9])
 }
 
-func getTitle() string {
-	return titleList[randomInt(len(titleList))]
+func (f *Faker) getTitle() string {
+	return titleList[f.Intn(len(titleList))]
+}
+
+const passwordChars = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// NewPassword returns a random password of n letters and digits. Characters which are
+// easily confused, like 0 and O, are left out.
+func (f *Faker) NewPassword(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = passwordChars[f.Intn(len(passwordChars))]
+	}
+	return string(b)
 }
 
 type Person struct {
@@ -247,17 +279,17 @@ type Person struct {
 	Title string
 }
 
-func NewPerson(sex bool) *Person {
+func (f *Faker) NewPerson(sex bool) *Person {
 	var name string
 	if sex {
-		name = getMaleName()
+		name = f.getMaleName()
 	} else {
-		name = getFeMaleName()
+		name = f.getFeMaleName()
 	}
 
-	email := getEmail(name)
-	title := getTitle()
-	phone := getPhone("+7")
+	email := f.getEmail(name)
+	title := f.getTitle()
+	phone := f.getPhone("+7")
 	return &Person{
 		Name:  name,
 		Email: email,
@@ -270,39 +302,123 @@ type Company struct {
 	Name     string
 	FullName string
 	INN      string
+	KPP      string
+	OGRN     string
 	CEO      string
 	CFO      string
 	Address  string
 }
 
-func NewCompany() *Company {
-	name, fullName := getCompanyName()
-	ceo := getMaleName()
-	cfo := getFeMaleName()
-	a := Address{}
-	a.getAddress()
+func (f *Faker) NewCompany() *Company {
+	name, fullName := f.getCompanyName()
+	ceo := f.getMaleName()
+	cfo := f.getFeMaleName()
+	region := regionList[f.Intn(len(regionList))]
+	inn := f.getINN(region)
 
 	return &Company{
 		Name:     name,
 		FullName: fullName,
-		INN:      "12345678901",
+		INN:      inn,
+		KPP:      f.getKPP(inn),
+		OGRN:     f.getOGRN(region),
 		CEO:      ceo,
 		CFO:      cfo,
-		Address:  a.getAddress(),
+		Address:  f.getAddress(),
 	}
 }
 
 type Agreement struct {
 	Name    string
 	StartAt time.Time
+	EndAt   *time.Time
 }
 
-func NewAgreement() *Agreement {
-	start := time.Now()
-	return &Agreement{
-		Name:    getNumber(),
-		StartAt: start.AddDate(0, -1*randomInt(10), 0),
+// NewAgreement returns an agreement signed within the last two years. About a third of
+// the agreements are open-ended, the others end within a year of signing, so some of
+// them have already expired.
+func (f *Faker) NewAgreement() *Agreement {
+	start := time.Now().AddDate(0, -1*f.Intn(24), -1*f.Intn(28))
+	agreement := &Agreement{
+		Name:    f.getNumber(),
+		StartAt: start,
+	}
+
+	if f.Intn(3) > 0 {
+		end := start.AddDate(0, 6+f.Intn(7), 0)
+		agreement.EndAt = &end
+	}
+
+	return agreement
+}
+
+// Invoice holds the dates of a fake invoice and which part of it has been paid.
+type Invoice struct {
+	Date     time.Time
+	DueDate  time.Time
+	PaidPart float64
+}
+
+// NewInvoice returns an invoice issued within the last year with a 14 or 30 days
+// payment term. Half of the invoices are paid in full, a fifth partly and the rest not
+// at all, so the invoices which are past their due date are overdue.
+func (f *Faker) NewInvoice() *Invoice {
+	date := time.Now().AddDate(0, 0, -1*f.Intn(365))
+	terms := []int{14, 30}
+
+	invoice := &Invoice{
+		Date:    date,
+		DueDate: date.AddDate(0, 0, terms[f.Intn(len(terms))]),
 	}
+
+	switch n := f.Intn(10); {
+	case n < 5:
+		invoice.PaidPart = 1
+	case n < 7:
+		invoice.PaidPart = float64(2+f.Intn(7)) / 10
+	}
+
+	return invoice
+}
+
+type Payment struct {
+	Date   time.Time
+	Amount float64
+}
+
+// NewPaymentHistory splits the paid part of the invoice amount into one to three
+// payments. The payments are made between the invoice date and a month after the due
+// date, some of them late, but never in the future.
+func (f *Faker) NewPaymentHistory(invoice *Invoice, amount float64) []Payment {
+	payments := []Payment{}
+
+	paid := math.Round(amount*invoice.PaidPart*100) / 100
+	if paid <= 0 {
+		return payments
+	}
+
+	days := int(invoice.DueDate.Sub(invoice.Date).Hours()/24) + 30
+	if elapsed := int(time.Since(invoice.Date).Hours() / 24); days > elapsed {
+		days = elapsed
+	}
+
+	count := 1 + f.Intn(3)
+	date := invoice.Date
+	for i := 0; i < count && paid > 0; i++ {
+		part := paid
+		if i < count-1 {
+			part = math.Round(paid*float64(3+f.Intn(5))/10*100) / 100
+		}
+
+		if days > 0 {
+			date = date.AddDate(0, 0, f.Intn(days/count+1))
+		}
+
+		payments = append(payments, Payment{Date: date, Amount: part})
+		paid = math.Round((paid-part)*100) / 100
+	}
+
+	return payments
 }
 
 type Product struct {
@@ -312,20 +428,20 @@ type Product struct {
 	Price       float64
 }
 
-func getSKU(prefix string) string {
-	randInt, _ := RandomInt(1, 4)
+func (f *Faker) getSKU(prefix string) string {
+	randInt, _ := f.RandomInt(1, 4)
 	str := strings.Join(IntToString(randInt), "")
 	return fmt.Sprintf("%s-%s-%s", prefix, str[:2], str[2:4])
 }
 
-func ProductList() []Product {
+func (f *Faker) ProductList() []Product {
 	products := []Product{}
-	price := randomInt(100) * 100
+	price := f.Intn(100) * 100
 	for _, v := range productList {
 		product := Product{
 			Name:        v,
-			Description: fmt.Sprintf("%s %s", nounList[randomInt(len(nounList))], v),
-			SKU:         getSKU("AR"),
+			Description: fmt.Sprintf("%s %s", nounList[f.Intn(len(nounList))], v),
+			SKU:         f.getSKU("AR"),
 			Price:       float64(price),
 		}
 		products = append(products, product)
@@ -0,0 +1,144 @@
+package faker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Regions are the first two digits of INN, OGRN and the tax office code.
+var regionList = []string{"77", "78", "50", "47", "66", "16", "54", "23"}
+
+var bankNameList = []string{"ПАО Сбербанк", "Банк ВТБ (ПАО)", "АО \"Альфа-Банк\"", "АО \"Тинькофф Банк\"", "ПАО \"Промсвязьбанк\""}
+
+// digits returns a string of n random digits.
+func (f *Faker) digits(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteByte(byte('0' + f.Intn(10)))
+	}
+	return b.String()
+}
+
+// getINN returns a 10 digits INN of a legal entity. The last digit is the check digit:
+// the weighted sum of the first nine digits modulo 11, modulo 10.
+func (f *Faker) getINN(region string) string {
+	inn := region + f.digits(7)
+	weights := []int{2, 4, 10, 3, 5, 9, 4, 6, 8}
+
+	sum := 0
+	for i, w := range weights {
+		sum += int(inn[i]-'0') * w
+	}
+
+	return fmt.Sprintf("%s%d", inn, sum%11%10)
+}
+
+// getPersonalINN returns a 12 digits INN of a person. The last two digits are check
+// digits, each the weighted sum of the digits before it modulo 11, modulo 10.
+func (f *Faker) getPersonalINN(region string) string {
+	inn := region + f.digits(8)
+
+	for _, weights := range [][]int{{7, 2, 4, 10, 3, 5, 9, 4, 6, 8}, {3, 7, 2, 4, 10, 3, 5, 9, 4, 6, 8}} {
+		sum := 0
+		for i, w := range weights {
+			sum += int(inn[i]-'0') * w
+		}
+		inn += fmt.Sprintf("%d", sum%11%10)
+	}
+
+	return inn
+}
+
+// getOGRNIP returns a 15 digits OGRNIP of an individual entrepreneur. The last digit is
+// the remainder of the first 14 digits divided by 13, modulo 10.
+func (f *Faker) getOGRNIP(region string) string {
+	ogrnip := fmt.Sprintf("3%02d%s%s", 4+f.Intn(20), region, f.digits(9))
+
+	rest := 0
+	for _, d := range ogrnip {
+		rest = (rest*10 + int(d-'0')) % 13
+	}
+
+	return fmt.Sprintf("%s%d", ogrnip, rest%10)
+}
+
+// getKPP returns a KPP of the head office registered at the tax office of the INN.
+func (f *Faker) getKPP(inn string) string {
+	return inn[:4] + "01001"
+}
+
+// getOGRN returns a 13 digits OGRN. The last digit is the remainder of the first 12
+// digits divided by 11, modulo 10.
+func (f *Faker) getOGRN(region string) string {
+	ogrn := fmt.Sprintf("1%02d%s%s", 2+f.Intn(20), region, f.digits(7))
+
+	rest := 0
+	for _, d := range ogrn {
+		rest = (rest*10 + int(d-'0')) % 11
+	}
+
+	return fmt.Sprintf("%s%d", ogrn, rest%10)
+}
+
+// getBIK returns a BIK of a bank in the region. Only the numbers from 050 up are used
+// by credit institutions.
+func (f *Faker) getBIK(region string) string {
+	return fmt.Sprintf("04%s%s%03d", region, f.digits(2), 50+f.Intn(950))
+}
+
+// withAccountKey sets the check digit (the 9th one) of the account. The account is
+// checked together with three digits of the BIK: the last three for a settlement
+// account, "0" and the 5th and 6th digits for a correspondent account. The weights
+// 7, 1, 3 repeat over the 23 digits and the weighted sum has to be divisible by 10.
+func withAccountKey(bikPart, account string) string {
+	account = account[:8] + "0" + account[9:]
+	weights := []int{7, 1, 3}
+
+	sum := 0
+	for i, d := range bikPart + account {
+		sum += int(d-'0') * weights[i%3]
+	}
+
+	return fmt.Sprintf("%s%d%s", account[:8], sum%10*3%10, account[9:])
+}
+
+type BankAccount struct {
+	Name        string
+	BIK         string
+	Account     string
+	CorrAccount string
+}
+
+// NewBankAccount returns a rouble settlement account of a legal entity with a matching
+// BIK and correspondent account.
+func (f *Faker) NewBankAccount() *BankAccount {
+	bik := f.getBIK(regionList[f.Intn(len(regionList))])
+
+	return &BankAccount{
+		Name:        bankNameList[f.Intn(len(bankNameList))],
+		BIK:         bik,
+		Account:     withAccountKey(bik[6:], "40702810"+"0"+f.digits(11)),
+		CorrAccount: withAccountKey("0"+bik[4:6], "30101810"+"0"+"00000000"+bik[6:]),
+	}
+}
+
+// NewEntrepreneur returns an individual entrepreneur with a personal INN and an OGRNIP.
+// Entrepreneurs have no KPP; the entrepreneur is the CEO.
+func (f *Faker) NewEntrepreneur() *Company {
+	name := f.getMaleName()
+	region := regionList[f.Intn(len(regionList))]
+
+	return &Company{
+		Name:     "ИП " + name,
+		FullName: "Индивидуальный предприниматель " + name,
+		INN:      f.getPersonalINN(region),
+		OGRN:     f.getOGRNIP(region),
+		CEO:      name,
+		Address:  f.getAddress(),
+	}
+}
+
+// NewAddress returns a postal address.
+func (f *Faker) NewAddress() string {
+	return f.getAddress()
+}
@@ -0,0 +1,160 @@
+// Package locale formats the numbers and dates of exported files the way a locale
+// writes them, e.g. 1234,50 and 31.12.2024 in Russian. Numbers are written without
+// thousands separators, so spreadsheets read them back as numbers.
+package locale
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Locale describes how numbers and dates are written. DateLayout and MonthLayout are
+// time layouts for text, DateFormat and MonthFormat the number formats of spreadsheet
+// cells. Locales with a decimal comma separate the fields of CSV files with a
+// semicolon, as spreadsheets there expect.
+type Locale struct {
+	Tag         string
+	Decimal     string
+	Separator   rune
+	DateLayout  string
+	MonthLayout string
+	DateFormat  string
+	MonthFormat string
+}
+
+var (
+	russian = Locale{
+		Tag:         "ru",
+		Decimal:     ",",
+		Separator:   ';',
+		DateLayout:  "02.01.2006",
+		MonthLayout: "01.2006",
+		DateFormat:  "dd.mm.yyyy",
+		MonthFormat: "mm.yyyy",
+	}
+	english = Locale{
+		Tag:         "en",
+		Decimal:     ".",
+		Separator:   ',',
+		DateLayout:  "2006-01-02",
+		MonthLayout: "2006-01",
+		DateFormat:  "yyyy-mm-dd",
+		MonthFormat: "yyyy-mm",
+	}
+)
+
+// The supported locales by their language tags. English without a region writes ISO
+// dates, which is how the files were exported before locales were supported.
+var locales = map[string]Locale{
+	"ru": russian,
+	"uk": withTag(russian, "uk"),
+	"be": withTag(russian, "be"),
+	"kk": withTag(russian, "kk"),
+	"de": withTag(russian, "de"),
+	"en": english,
+	"en-US": {
+		Tag:         "en-US",
+		Decimal:     ".",
+		Separator:   ',',
+		DateLayout:  "01/02/2006",
+		MonthLayout: "01/2006",
+		DateFormat:  "mm/dd/yyyy",
+		MonthFormat: "mm/yyyy",
+	},
+	"en-GB": {
+		Tag:         "en-GB",
+		Decimal:     ".",
+		Separator:   ',',
+		DateLayout:  "02/01/2006",
+		MonthLayout: "01/2006",
+		DateFormat:  "dd/mm/yyyy",
+		MonthFormat: "mm/yyyy",
+	},
+}
+
+// Default is the locale of users who haven't chosen a supported one, the default of
+// the user preferences.
+var Default = russian
+
+func withTag(l Locale, tag string) Locale {
+	l.Tag = tag
+	return l
+}
+
+// Lookup returns the locale of a language tag like ru or en-US. A tag with an unknown
+// region falls back to its language, e.g. ru-KZ to ru.
+func Lookup(tag string) (Locale, bool) {
+	if l, ok := locales[tag]; ok {
+		return l, true
+	}
+
+	if language, _, found := strings.Cut(tag, "-"); found {
+		if l, ok := locales[language]; ok {
+			return l, true
+		}
+	}
+
+	return Locale{}, false
+}
+
+// Tags returns the tags of the supported locales in alphabetical order.
+func Tags() []string {
+	tags := make([]string, 0, len(locales))
+	for tag := range locales {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Number writes a number formatted by strconv, e.g. "1234.50", with the decimal
+// separator of the locale.
+func (l Locale) Number(s string) string {
+	return strings.Replace(s, ".", l.Decimal, 1)
+}
+
+// Date writes the day of t.
+func (l Locale) Date(t time.Time) string {
+	return t.Format(l.DateLayout)
+}
+
+// Month writes the month of t.
+func (l Locale) Month(t time.Time) string {
+	return t.Format(l.MonthLayout)
+}
+
+// Format writes a value of an exported file: nil is empty, times are dates, and ints,
+// floats and anything with a String() method returning a number are numbers. Other
+// values are written as fmt.Sprint() does.
+func (l Locale) Format(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case int:
+		return strconv.Itoa(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return l.Number(strconv.FormatFloat(value, 'f', -1, 64))
+	case time.Time:
+		return l.Date(value)
+	case *time.Time:
+		if value == nil {
+			return ""
+		}
+		return l.Date(*value)
+	case fmt.Stringer:
+		s := value.String()
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return l.Number(s)
+		}
+		return s
+	}
+
+	return fmt.Sprint(value)
+}
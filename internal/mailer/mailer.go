@@ -0,0 +1,173 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+
+	htmltemplate "html/template"
+)
+
+// The templates are embedded in the binary. Each of them defines a "subject", a
+// "plainBody" and an "htmlBody" template.
+//
+//go:embed "templates"
+var templateFS embed.FS
+
+// Sender sends the emails of the application: a Mailer, or a fake which only records
+// them.
+type Sender interface {
+	Send(recipient, templateFile string, data interface{}) (string, error)
+	Ping(timeout time.Duration) error
+}
+
+// Message is an email rendered from a template.
+type Message struct {
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+}
+
+// Render renders the subject and the text and HTML bodies of the template with the
+// data.
+func Render(templateFile string, data interface{}) (*Message, error) {
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	plainBody := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlTmpl, err := htmltemplate.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody := new(bytes.Buffer)
+	err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Subject:   strings.TrimSpace(subject.String()),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	}, nil
+}
+
+// Mailer sends emails through an SMTP server. Authentication is only used when a
+// username is given.
+type Mailer struct {
+	addr   string
+	auth   smtp.Auth
+	sender string
+}
+
+func New(host string, port int, username, password, sender string) Mailer {
+	m := Mailer{
+		addr:   fmt.Sprintf("%s:%d", host, port),
+		sender: sender,
+	}
+
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m
+}
+
+// Send renders the template with the data and sends it to the recipient as a text and
+// HTML message. The rendered subject is returned, so it can be logged.
+func (m Mailer) Send(recipient, templateFile string, data interface{}) (string, error) {
+	message, err := Render(templateFile, data)
+	if err != nil {
+		return "", err
+	}
+
+	msg := new(bytes.Buffer)
+	body := multipart.NewWriter(msg)
+
+	fmt.Fprintf(msg, "From: %s\r\n", m.sender)
+	fmt.Fprintf(msg, "To: %s\r\n", recipient)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", body.Boundary())
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain", message.PlainBody},
+		{"text/html", message.HTMLBody},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return "", err
+		}
+
+		_, err = w.Write([]byte(strings.ReplaceAll(part.content, "\n", "\r\n")))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = body.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = smtp.SendMail(m.addr, m.auth, m.sender, []string{recipient}, msg.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	return message.Subject, nil
+}
+
+// Ping connects to the SMTP server and says hello, without authenticating or sending
+// anything, to check that the server is reachable.
+func (m Mailer) Ping(timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", m.addr, timeout)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	return c.Quit()
+}
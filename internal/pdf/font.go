@@ -0,0 +1,273 @@
+package pdf
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+// Font is a TrueType font embedded into the documents it's used in. Text is written
+// by the glyph ids of the font, so every character the font has can be printed,
+// Cyrillic included. A Font isn't changed once parsed and can be shared by documents
+// written at the same time.
+type Font struct {
+	name        string
+	data        []byte
+	unitsPerEm  int
+	ascent      int
+	descent     int
+	capHeight   int
+	italicAngle float64
+	bbox        [4]int
+	widths      []int
+	glyphs      map[rune]uint16
+}
+
+// table is a table of the font file. Reads past its end return zero, the tables are
+// checked for their minimum length when the font is parsed.
+type table []byte
+
+func (t table) u16(off int) int {
+	if off < 0 || off+2 > len(t) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(t[off:]))
+}
+
+func (t table) i16(off int) int {
+	return int(int16(t.u16(off)))
+}
+
+func (t table) u32(off int) int {
+	if off < 0 || off+4 > len(t) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(t[off:]))
+}
+
+// ParseFont reads a TrueType font file. Fonts with PostScript (CFF) outlines aren't
+// supported.
+func ParseFont(data []byte) (*Font, error) {
+	file := table(data)
+	if len(file) < 12 {
+		return nil, errors.New("pdf: not a font file")
+	}
+
+	switch file.u32(0) {
+	case 0x00010000, 0x74727565: // 1.0 and "true"
+	case 0x4f54544f: // "OTTO"
+		return nil, errors.New("pdf: fonts with PostScript outlines aren't supported, use a TrueType font")
+	default:
+		return nil, errors.New("pdf: not a TrueType font file")
+	}
+
+	tables := map[string]table{}
+	for i, n := 0, file.u16(4); i < n; i++ {
+		record := 12 + 16*i
+		if record+16 > len(file) {
+			return nil, errors.New("pdf: truncated font file")
+		}
+		offset, length := file.u32(record+8), file.u32(record+12)
+		if offset+length > len(file) {
+			return nil, errors.New("pdf: truncated font file")
+		}
+		tables[string(file[record:record+4])] = file[offset : offset+length]
+	}
+
+	for tag, size := range map[string]int{"head": 54, "hhea": 36, "maxp": 6, "hmtx": 4, "cmap": 4, "glyf": 0} {
+		if t, ok := tables[tag]; !ok || len(t) < size {
+			return nil, errors.New("pdf: the font has no valid " + tag + " table")
+		}
+	}
+
+	head, hhea := tables["head"], tables["hhea"]
+
+	f := &Font{
+		name:       fontName(tables["name"]),
+		data:       data,
+		unitsPerEm: head.u16(18),
+		ascent:     hhea.i16(4),
+		descent:    hhea.i16(6),
+		bbox:       [4]int{head.i16(36), head.i16(38), head.i16(40), head.i16(42)},
+	}
+
+	if f.unitsPerEm == 0 {
+		return nil, errors.New("pdf: the font has no units per em")
+	}
+
+	f.capHeight = f.ascent
+	if os2 := tables["OS/2"]; len(os2) >= 90 && os2.u16(0) >= 2 {
+		f.capHeight = os2.i16(88)
+	}
+
+	if post := tables["post"]; len(post) >= 8 {
+		f.italicAngle = float64(int32(post.u32(4))) / 65536
+	}
+
+	// Glyphs after the last horizontal metric have the width of the last one.
+	numGlyphs, numMetrics := tables["maxp"].u16(4), hhea.u16(34)
+	if numMetrics == 0 || numMetrics > numGlyphs {
+		return nil, errors.New("pdf: the font has invalid horizontal metrics")
+	}
+	hmtx := tables["hmtx"]
+	f.widths = make([]int, numGlyphs)
+	for i := range f.widths {
+		if i < numMetrics {
+			f.widths[i] = hmtx.u16(4 * i)
+		} else {
+			f.widths[i] = f.widths[numMetrics-1]
+		}
+	}
+
+	var err error
+	f.glyphs, err = parseCmap(tables["cmap"], numGlyphs)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// parseCmap maps the characters to glyphs by the Unicode subtable of the cmap, the
+// full repertoire (format 12) if the font has it, else the basic plane (format 4).
+func parseCmap(cmap table, numGlyphs int) (map[rune]uint16, error) {
+	var bmp, full table
+
+	for i, n := 0, cmap.u16(2); i < n; i++ {
+		record := 4 + 8*i
+		platform, encoding, offset := cmap.u16(record), cmap.u16(record+2), cmap.u32(record+4)
+		if offset >= len(cmap) {
+			continue
+		}
+		sub := cmap[offset:]
+
+		switch {
+		case sub.u16(0) == 12 && (platform == 3 && encoding == 10 || platform == 0):
+			full = sub
+		case sub.u16(0) == 4 && (platform == 3 && encoding == 1 || platform == 0):
+			bmp = sub
+		}
+	}
+
+	glyphs := map[rune]uint16{}
+	add := func(c, g int) {
+		if g > 0 && g < numGlyphs {
+			glyphs[rune(c)] = uint16(g)
+		}
+	}
+
+	switch {
+	case full != nil:
+		for i, n := 0, full.u32(12); i < n; i++ {
+			group := 16 + 12*i
+			start, end, glyph := full.u32(group), full.u32(group+4), full.u32(group+8)
+			if end < start || end > 0x10ffff {
+				continue
+			}
+			for c := start; c <= end; c++ {
+				add(c, glyph+c-start)
+			}
+		}
+
+	case bmp != nil:
+		segments := bmp.u16(6) / 2
+		ends, starts, deltas, ranges := 14, 16+2*segments, 16+4*segments, 16+6*segments
+
+		for i := 0; i < segments; i++ {
+			start, end := bmp.u16(starts+2*i), bmp.u16(ends+2*i)
+			delta, rangeOffset := bmp.u16(deltas+2*i), bmp.u16(ranges+2*i)
+
+			for c := start; c <= end && c != 0xffff; c++ {
+				if rangeOffset == 0 {
+					add(c, (c+delta)&0xffff)
+					continue
+				}
+
+				g := bmp.u16(ranges + 2*i + rangeOffset + 2*(c-start))
+				if g != 0 {
+					add(c, (g+delta)&0xffff)
+				}
+			}
+		}
+
+	default:
+		return nil, errors.New("pdf: the font has no Unicode character map")
+	}
+
+	return glyphs, nil
+}
+
+// fontName returns the PostScript name of the font, which names it in the documents.
+func fontName(name table) string {
+	var found string
+
+	count, storage := name.u16(2), name.u16(4)
+	for i := 0; i < count && found == ""; i++ {
+		record := 6 + 12*i
+		if name.u16(record+6) != 6 {
+			continue
+		}
+
+		platform, length, offset := name.u16(record), name.u16(record+8), storage+name.u16(record+10)
+		if offset+length > len(name) {
+			continue
+		}
+		raw := name[offset : offset+length]
+
+		switch platform {
+		case 1:
+			found = string(raw)
+		case 0, 3:
+			units := make([]uint16, len(raw)/2)
+			for j := range units {
+				units[j] = uint16(raw.u16(2 * j))
+			}
+			found = string(utf16.Decode(units))
+		}
+	}
+
+	return sanitizeName(found)
+}
+
+// sanitizeName keeps the characters a PDF name can have without escapes.
+func sanitizeName(s string) string {
+	clean := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return -1
+	}, s)
+
+	if clean == "" {
+		return "Font"
+	}
+	return clean
+}
+
+// glyph returns the glyph of the character, the missing glyph 0 if the font has none.
+func (f *Font) glyph(r rune) uint16 {
+	return f.glyphs[r]
+}
+
+// width returns the advance of the glyph in thousandths of the font size.
+func (f *Font) width(g uint16) float64 {
+	if int(g) >= len(f.widths) {
+		return 0
+	}
+	return float64(f.widths[g]) * 1000 / float64(f.unitsPerEm)
+}
+
+// scale converts font units to thousandths of the font size.
+func (f *Font) scale(v int) int {
+	return v * 1000 / f.unitsPerEm
+}
+
+// TextWidth returns the width of the text in points when printed at the size.
+func (f *Font) TextWidth(s string, size float64) float64 {
+	var w float64
+	for _, r := range s {
+		w += f.width(f.glyph(r))
+	}
+	return w * size / 1000
+}
@@ -0,0 +1,105 @@
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	// PNG and GIF images are decoded and embedded as pixels.
+	_ "image/gif"
+	_ "image/png"
+)
+
+// Image is a picture placed on the pages, e.g. a stamp or a signature. JPEG images are
+// embedded as they are, others as compressed pixels with their transparency. An Image
+// can be placed any number of times and into several documents.
+type Image struct {
+	width      int
+	height     int
+	colorSpace string
+	filter     string
+	decode     string
+	data       []byte
+	// mask is the compressed alpha channel, nil for opaque images.
+	mask []byte
+}
+
+// DecodeImage reads a JPEG, PNG or GIF image.
+func DecodeImage(data []byte) (*Image, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("pdf: the image is not a JPEG, PNG or GIF")
+	}
+
+	if config.Width == 0 || config.Height == 0 {
+		return nil, errors.New("pdf: the image is empty")
+	}
+
+	if format == "jpeg" {
+		img := &Image{width: config.Width, height: config.Height, filter: "DCTDecode", data: data}
+
+		switch config.ColorModel {
+		case color.GrayModel:
+			img.colorSpace = "DeviceGray"
+		case color.CMYKModel:
+			// CMYK JPEGs are written inverted by Photoshop, which most of them come from.
+			img.colorSpace = "DeviceCMYK"
+			img.decode = "[1 0 1 0 1 0 1 0]"
+		default:
+			img.colorSpace = "DeviceRGB"
+		}
+
+		// Make sure the data decodes, DecodeConfig only reads the header.
+		_, err = jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.New("pdf: the JPEG image is damaged")
+		}
+
+		return img, nil
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("pdf: the image is damaged")
+	}
+
+	bounds := decoded.Bounds()
+	pixels := make([]byte, 0, 3*bounds.Dx()*bounds.Dy())
+	alpha := make([]byte, 0, bounds.Dx()*bounds.Dy())
+	opaque := true
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			pixels = append(pixels, c.R, c.G, c.B)
+			alpha = append(alpha, c.A)
+			opaque = opaque && c.A == 0xff
+		}
+	}
+
+	img := &Image{
+		width:      bounds.Dx(),
+		height:     bounds.Dy(),
+		colorSpace: "DeviceRGB",
+		filter:     "FlateDecode",
+		data:       compress(pixels),
+	}
+
+	if !opaque {
+		img.mask = compress(alpha)
+	}
+
+	return img, nil
+}
+
+// Width returns the width of the image in pixels.
+func (img *Image) Width() int {
+	return img.width
+}
+
+// Height returns the height of the image in pixels.
+func (img *Image) Height() int {
+	return img.height
+}
@@ -0,0 +1,351 @@
+// Package pdf writes simple PDF documents: pages with text in embedded TrueType fonts,
+// lines, rectangles and images. Positions are given in points from the top left corner
+// of the page, the way documents are laid out, and converted to the bottom left origin
+// of PDF when the page is drawn.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// ContentType is the media type of the documents.
+const ContentType = "application/pdf"
+
+// The size of an A4 page in points.
+const (
+	A4Width  = 595.28
+	A4Height = 841.89
+)
+
+// MM converts millimetres to points.
+func MM(v float64) float64 {
+	return v * 72 / 25.4
+}
+
+// Document is a PDF document being drawn. The fonts and images placed on its pages are
+// embedded once when it's written.
+type Document struct {
+	title  string
+	pages  []*Page
+	fonts  []*fontUse
+	images []*Image
+}
+
+// fontUse collects the glyphs of a font used in a document with the characters they
+// print, for the widths and the text extraction.
+type fontUse struct {
+	font   *Font
+	glyphs map[uint16]rune
+}
+
+// New returns an empty document with the title shown by viewers.
+func New(title string) *Document {
+	return &Document{title: title}
+}
+
+// Page is a page of a document.
+type Page struct {
+	doc     *Document
+	width   float64
+	height  float64
+	content bytes.Buffer
+}
+
+// AddPage adds a page of the size in points, e.g. A4Width and A4Height.
+func (doc *Document) AddPage(width, height float64) *Page {
+	page := &Page{doc: doc, width: width, height: height}
+	doc.pages = append(doc.pages, page)
+	return page
+}
+
+// fontResource returns the name of the font in the resources of the pages.
+func (doc *Document) fontResource(font *Font) (string, *fontUse) {
+	for i, use := range doc.fonts {
+		if use.font == font {
+			return fmt.Sprintf("F%d", i+1), use
+		}
+	}
+
+	use := &fontUse{font: font, glyphs: map[uint16]rune{}}
+	doc.fonts = append(doc.fonts, use)
+	return fmt.Sprintf("F%d", len(doc.fonts)), use
+}
+
+// imageResource returns the name of the image in the resources of the pages.
+func (doc *Document) imageResource(img *Image) string {
+	for i, placed := range doc.images {
+		if placed == img {
+			return fmt.Sprintf("Im%d", i+1)
+		}
+	}
+
+	doc.images = append(doc.images, img)
+	return fmt.Sprintf("Im%d", len(doc.images))
+}
+
+// num formats a coordinate or a size with up to two decimals.
+func num(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// SetColor sets the colour of the text, lines and fills drawn next, with the red,
+// green and blue components from 0 to 1.
+func (p *Page) SetColor(r, g, b float64) {
+	fmt.Fprintf(&p.content, "%s %s %s rg %s %s %s RG\n", num(r), num(g), num(b), num(r), num(g), num(b))
+}
+
+// Text prints the text with its baseline at y.
+func (p *Page) Text(x, y float64, font *Font, size float64, s string) {
+	p.RotatedText(x, y, 0, font, size, s)
+}
+
+// RotatedText prints the text turned counterclockwise by the angle in degrees around
+// the start of its baseline.
+func (p *Page) RotatedText(x, y, angle float64, font *Font, size float64, s string) {
+	if s == "" {
+		return
+	}
+
+	name, use := p.doc.fontResource(font)
+
+	var hex strings.Builder
+	for _, r := range s {
+		g := font.glyph(r)
+		use.glyphs[g] = r
+		fmt.Fprintf(&hex, "%04X", g)
+	}
+
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	fmt.Fprintf(&p.content, "BT /%s %s Tf %s %s %s %s %s %s Tm <%s> Tj ET\n", name, num(size),
+		strconv.FormatFloat(cos, 'f', 4, 64), strconv.FormatFloat(sin, 'f', 4, 64),
+		strconv.FormatFloat(-sin, 'f', 4, 64), strconv.FormatFloat(cos, 'f', 4, 64),
+		num(x), num(p.height-y), hex.String())
+}
+
+// Line draws a line of the width from (x1, y1) to (x2, y2).
+func (p *Page) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n", num(width), num(x1), num(p.height-y1), num(x2), num(p.height-y2))
+}
+
+// Rect draws the outline of a rectangle with its top left corner at (x, y).
+func (p *Page) Rect(x, y, w, h, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s %s %s re S\n", num(width), num(x), num(p.height-y-h), num(w), num(h))
+}
+
+// FillRect fills a rectangle with its top left corner at (x, y).
+func (p *Page) FillRect(x, y, w, h float64) {
+	fmt.Fprintf(&p.content, "%s %s %s %s re f\n", num(x), num(p.height-y-h), num(w), num(h))
+}
+
+// Image places the image with its top left corner at (x, y), stretched to w by h.
+func (p *Page) Image(img *Image, x, y, w, h float64) {
+	name := p.doc.imageResource(img)
+	fmt.Fprintf(&p.content, "q %s 0 0 %s %s %s cm /%s Do Q\n", num(w), num(h), num(x), num(p.height-y-h), name)
+}
+
+// compress deflates the data of a stream.
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// writer numbers the objects of the document and remembers where they start for the
+// cross-reference table.
+type writer struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+// reserve returns the number of a new object, written later with begin().
+func (w *writer) reserve() int {
+	w.offsets = append(w.offsets, 0)
+	return len(w.offsets)
+}
+
+func (w *writer) begin(n int) {
+	w.offsets[n-1] = w.buf.Len()
+	fmt.Fprintf(&w.buf, "%d 0 obj\n", n)
+}
+
+func (w *writer) object(n int, dict string) {
+	w.begin(n)
+	fmt.Fprintf(&w.buf, "%s\nendobj\n", dict)
+}
+
+// stream writes a stream object, the dictionary gets the length of the data.
+func (w *writer) stream(n int, dict string, data []byte) {
+	w.begin(n)
+	fmt.Fprintf(&w.buf, "<< %s /Length %d >>\nstream\n", dict, len(data))
+	w.buf.Write(data)
+	w.buf.WriteString("\nendstream\nendobj\n")
+}
+
+// Write writes the document to out.
+func (doc *Document) Write(out io.Writer) error {
+	if len(doc.pages) == 0 {
+		return fmt.Errorf("pdf: a document needs at least one page")
+	}
+
+	var w writer
+	w.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	catalog, pages, info := w.reserve(), w.reserve(), w.reserve()
+
+	// The fonts and images are written first, the resources of the pages refer to them.
+	var resources strings.Builder
+
+	resources.WriteString("<< /Font <<")
+	for i, use := range doc.fonts {
+		fmt.Fprintf(&resources, " /F%d %d 0 R", i+1, w.writeFont(use))
+	}
+	resources.WriteString(" >> /XObject <<")
+	for i, img := range doc.images {
+		fmt.Fprintf(&resources, " /Im%d %d 0 R", i+1, w.writeImage(img))
+	}
+	resources.WriteString(" >> >>")
+
+	var kids []string
+	for _, page := range doc.pages {
+		n, content := w.reserve(), w.reserve()
+		w.stream(content, "/Filter /FlateDecode", compress(page.content.Bytes()))
+		w.object(n, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources %s /Contents %d 0 R >>",
+			pages, num(page.width), num(page.height), resources.String(), content))
+		kids = append(kids, fmt.Sprintf("%d 0 R", n))
+	}
+
+	w.object(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	w.object(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	w.object(info, fmt.Sprintf("<< /Title %s /Producer (stockup) >>", textString(doc.title)))
+
+	xref := w.buf.Len()
+	fmt.Fprintf(&w.buf, "xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)+1)
+	for _, offset := range w.offsets {
+		fmt.Fprintf(&w.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(w.offsets)+1, catalog, info, xref)
+
+	_, err := out.Write(w.buf.Bytes())
+	return err
+}
+
+// writeFont embeds the font as a composite font addressing the glyphs by their ids,
+// with the widths of the glyphs used and a map back to the characters, so the text
+// can be searched and copied. It returns the number of the font object.
+func (w *writer) writeFont(use *fontUse) int {
+	f := use.font
+	font, descendant, descriptor, file, toUnicode := w.reserve(), w.reserve(), w.reserve(), w.reserve(), w.reserve()
+
+	w.stream(file, fmt.Sprintf("/Filter /FlateDecode /Length1 %d", len(f.data)), compress(f.data))
+
+	flags := 32 // nonsymbolic
+	if f.italicAngle != 0 {
+		flags |= 64
+	}
+	w.object(descriptor, fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags %d /FontBBox [%d %d %d %d] "+
+		"/ItalicAngle %s /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 %d 0 R >>",
+		f.name, flags, f.scale(f.bbox[0]), f.scale(f.bbox[1]), f.scale(f.bbox[2]), f.scale(f.bbox[3]),
+		num(f.italicAngle), f.scale(f.ascent), f.scale(f.descent), f.scale(f.capHeight), file))
+
+	glyphs := make([]int, 0, len(use.glyphs))
+	for g := range use.glyphs {
+		glyphs = append(glyphs, int(g))
+	}
+	sort.Ints(glyphs)
+
+	var widths strings.Builder
+	for _, g := range glyphs {
+		fmt.Fprintf(&widths, "%d [%s] ", g, num(f.width(uint16(g))))
+	}
+
+	w.object(descendant, fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s "+
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> "+
+		"/FontDescriptor %d 0 R /DW %s /W [%s] /CIDToGIDMap /Identity >>",
+		f.name, descriptor, num(f.width(0)), widths.String()))
+
+	w.stream(toUnicode, "/Filter /FlateDecode", compress(toUnicodeCMap(glyphs, use.glyphs)))
+
+	w.object(font, fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H "+
+		"/DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>", f.name, descendant, toUnicode))
+
+	return font
+}
+
+// toUnicodeCMap maps the glyphs back to the characters they print.
+func toUnicodeCMap(glyphs []int, chars map[uint16]rune) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+
+	// A block maps at most 100 glyphs.
+	for start := 0; start < len(glyphs); start += 100 {
+		end := start + 100
+		if end > len(glyphs) {
+			end = len(glyphs)
+		}
+
+		fmt.Fprintf(&b, "%d beginbfchar\n", end-start)
+		for _, g := range glyphs[start:end] {
+			fmt.Fprintf(&b, "<%04X> <", g)
+			for _, unit := range utf16.Encode([]rune{chars[uint16(g)]}) {
+				fmt.Fprintf(&b, "%04X", unit)
+			}
+			b.WriteString(">\n")
+		}
+		b.WriteString("endbfchar\n")
+	}
+
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+
+	return b.Bytes()
+}
+
+// writeImage embeds the image with its transparency as a soft mask and returns the
+// number of the image object.
+func (w *writer) writeImage(img *Image) int {
+	n := w.reserve()
+
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s",
+		img.width, img.height, img.colorSpace, img.filter)
+
+	if img.decode != "" {
+		dict += " /Decode " + img.decode
+	}
+
+	if img.mask != nil {
+		mask := w.reserve()
+		w.stream(mask, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray "+
+			"/BitsPerComponent 8 /Filter /FlateDecode", img.width, img.height), img.mask)
+		dict += fmt.Sprintf(" /SMask %d 0 R", mask)
+	}
+
+	w.stream(n, dict, img.data)
+
+	return n
+}
+
+// textString encodes a text for the document information as UTF-16 with a byte order
+// mark, so that titles in Russian are shown correctly.
+func textString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", unit)
+	}
+	b.WriteString(">")
+	return b.String()
+}
@@ -0,0 +1,226 @@
+// Package sandbox replaces the external services of the application with fakes for
+// the sandbox environment: emails, text messages and accounting pushes are recorded
+// in memory instead of being sent, so integrators can run whole flows without real
+// credentials and look at what would have gone out.
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/accounting"
+	"github.com/ElOtro/stockup-api/internal/data"
+	"github.com/ElOtro/stockup-api/internal/mailer"
+	"github.com/ElOtro/stockup-api/internal/sms"
+)
+
+// The number of records of each kind kept, older ones are dropped.
+const maxRecords = 1000
+
+// Email is an email the application would have sent.
+type Email struct {
+	ID        int64     `json:"id"`
+	SentAt    time.Time `json:"sent_at"`
+	Recipient string    `json:"recipient"`
+	Template  string    `json:"template"`
+	Subject   string    `json:"subject"`
+	PlainBody string    `json:"plain_body"`
+	HTMLBody  string    `json:"html_body"`
+}
+
+// TextMessage is a text message the SMS provider of an organisation would have sent.
+type TextMessage struct {
+	ID             int64     `json:"id"`
+	SentAt         time.Time `json:"sent_at"`
+	OrganisationID int64     `json:"organisation_id"`
+	Phone          string    `json:"phone"`
+	Text           string    `json:"text"`
+}
+
+// Push is a document an accounting connector would have pushed.
+type Push struct {
+	ID             int64                `json:"id"`
+	SentAt         time.Time            `json:"sent_at"`
+	OrganisationID int64                `json:"organisation_id"`
+	ConnectorID    int64                `json:"connector_id"`
+	Kind           string               `json:"kind"`
+	ExternalID     string               `json:"external_id"`
+	Document       *accounting.Document `json:"document"`
+}
+
+// Recorder keeps what the fakes have sent, oldest first. It is safe for concurrent
+// use by the jobs and the requests.
+type Recorder struct {
+	mu       sync.Mutex
+	nextID   int64
+	emails   []*Email
+	messages []*TextMessage
+	pushes   []*Push
+}
+
+// New returns an empty Recorder.
+func New() *Recorder {
+	return &Recorder{}
+}
+
+// id returns the id of the next record, ids are unique across all kinds.
+func (rec *Recorder) id() int64 {
+	rec.nextID++
+	return rec.nextID
+}
+
+// keep appends the record and drops the oldest ones beyond the limit.
+func keep[T any](records []T, record T) []T {
+	records = append(records, record)
+	if len(records) > maxRecords {
+		records = append(records[:0:0], records[len(records)-maxRecords:]...)
+	}
+	return records
+}
+
+// Emails returns the recorded emails, to the recipient if it isn't empty.
+func (rec *Recorder) Emails(recipient string) []*Email {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	emails := []*Email{}
+	for _, email := range rec.emails {
+		if recipient == "" || email.Recipient == recipient {
+			emails = append(emails, email)
+		}
+	}
+
+	return emails
+}
+
+// TextMessages returns the recorded text messages, of the organisation if it isn't 0.
+func (rec *Recorder) TextMessages(organisationID int64) []*TextMessage {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	messages := []*TextMessage{}
+	for _, message := range rec.messages {
+		if organisationID == 0 || message.OrganisationID == organisationID {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// Pushes returns the recorded accounting pushes, of the organisation if it isn't 0.
+func (rec *Recorder) Pushes(organisationID int64) []*Push {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	pushes := []*Push{}
+	for _, push := range rec.pushes {
+		if organisationID == 0 || push.OrganisationID == organisationID {
+			pushes = append(pushes, push)
+		}
+	}
+
+	return pushes
+}
+
+// Reset forgets everything recorded so far.
+func (rec *Recorder) Reset() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.emails, rec.messages, rec.pushes = nil, nil, nil
+}
+
+// Mailer returns a fake mailer which renders the emails like the real one and records
+// them.
+func (rec *Recorder) Mailer() mailer.Sender {
+	return fakeMailer{rec: rec}
+}
+
+type fakeMailer struct {
+	rec *Recorder
+}
+
+func (m fakeMailer) Send(recipient, templateFile string, data interface{}) (string, error) {
+	message, err := mailer.Render(templateFile, data)
+	if err != nil {
+		return "", err
+	}
+
+	m.rec.mu.Lock()
+	defer m.rec.mu.Unlock()
+
+	m.rec.emails = keep(m.rec.emails, &Email{
+		ID:        m.rec.id(),
+		SentAt:    time.Now(),
+		Recipient: recipient,
+		Template:  templateFile,
+		Subject:   message.Subject,
+		PlainBody: message.PlainBody,
+		HTMLBody:  message.HTMLBody,
+	})
+
+	return message.Subject, nil
+}
+
+func (m fakeMailer) Ping(timeout time.Duration) error {
+	return nil
+}
+
+// SMSProvider returns a fake SMS provider of the organisation which records the
+// messages, whatever the SMS settings of the organisation are.
+func (rec *Recorder) SMSProvider(organisationID int64) sms.Provider {
+	return fakeSMSProvider{rec: rec, organisationID: organisationID}
+}
+
+type fakeSMSProvider struct {
+	rec            *Recorder
+	organisationID int64
+}
+
+func (p fakeSMSProvider) Send(ctx context.Context, phone, text string) (string, error) {
+	p.rec.mu.Lock()
+	defer p.rec.mu.Unlock()
+
+	message := &TextMessage{
+		ID:             p.rec.id(),
+		SentAt:         time.Now(),
+		OrganisationID: p.organisationID,
+		Phone:          phone,
+		Text:           text,
+	}
+	p.rec.messages = keep(p.rec.messages, message)
+
+	return fmt.Sprintf("sandbox-%d", message.ID), nil
+}
+
+// Connector returns a fake accounting connector which records the documents instead
+// of writing exchange files or posting them.
+func (rec *Recorder) Connector(connector *data.AccountingConnector) accounting.Connector {
+	return fakeConnector{rec: rec, connector: connector}
+}
+
+type fakeConnector struct {
+	rec       *Recorder
+	connector *data.AccountingConnector
+}
+
+func (c fakeConnector) Push(ctx context.Context, document *accounting.Document) (string, error) {
+	c.rec.mu.Lock()
+	defer c.rec.mu.Unlock()
+
+	push := &Push{
+		ID:             c.rec.id(),
+		SentAt:         time.Now(),
+		OrganisationID: c.connector.OrganisationID,
+		ConnectorID:    c.connector.ID,
+		Kind:           c.connector.Kind,
+		Document:       document,
+	}
+	push.ExternalID = fmt.Sprintf("sandbox-%d", push.ID)
+	c.rec.pushes = keep(c.rec.pushes, push)
+
+	return push.ExternalID, nil
+}
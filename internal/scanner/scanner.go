@@ -0,0 +1,160 @@
+// Package scanner checks uploaded files for viruses. Scanner is the hook the API calls
+// after an upload; Clamd implements it with the clamd daemon of ClamAV, another engine
+// only has to implement Scanner.
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Result is the verdict on a file. Signature names the virus found in an infected file.
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner scans the content of a file.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+	Ping(ctx context.Context) error
+}
+
+// The size of the chunks the content is streamed to clamd in. clamd refuses streams
+// longer than its StreamMaxLength, 25MB by default.
+const clamdChunkSize = 64 << 10
+
+// Clamd scans files with clamd over TCP or a Unix socket.
+type Clamd struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// NewClamd returns the scanner of the clamd at the address, "tcp://host:port",
+// "unix:///path/to/clamd.ctl" or "host:port".
+func NewClamd(address string, timeout time.Duration) (*Clamd, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok {
+		network, addr = "tcp", address
+	}
+
+	if network != "tcp" && network != "unix" || addr == "" {
+		return nil, fmt.Errorf("invalid clamd address %q", address)
+	}
+
+	return &Clamd{Network: network, Address: addr, Timeout: timeout}, nil
+}
+
+// dial connects to clamd. The connection has to be done within the timeout, and
+// before the deadline of ctx if that's earlier.
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: c.Timeout}
+
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	return conn, nil
+}
+
+// Ping checks that clamd answers.
+func (c *Clamd) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "PING", nil)
+	if err != nil {
+		return err
+	}
+
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected answer %q", reply)
+	}
+
+	return nil
+}
+
+// Scan streams the content to clamd with the INSTREAM command.
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	reply, err := c.command(ctx, "INSTREAM", r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// The answer is "stream: OK", "stream: <signature> FOUND" or "<message> ERROR".
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// command sends the command and, if r isn't nil, streams its content in chunks, each
+// preceded by its length. It returns the answer, which clamd ends with a null byte.
+func (c *Clamd) command(ctx context.Context, command string, r io.Reader) (string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+
+	_, err = w.WriteString("z" + command + "\x00")
+	if err != nil {
+		return "", err
+	}
+
+	if r != nil {
+		chunk := make([]byte, clamdChunkSize)
+		size := make([]byte, 4)
+
+		for {
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				binary.BigEndian.PutUint32(size, uint32(n))
+				w.Write(size)
+				w.Write(chunk[:n])
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+
+		// A chunk of length zero ends the stream.
+		w.Write([]byte{0, 0, 0, 0})
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadBytes(0)
+	if err != nil && !(errors.Is(err, io.EOF) && len(reply) > 0) {
+		return "", err
+	}
+
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
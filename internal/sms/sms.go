@@ -0,0 +1,223 @@
+// Package sms sends text messages through the SMS provider of an organisation: SMSC
+// (smsc.ru) or Twilio. Both are called over their HTTP APIs with the credentials from
+// the SMS settings of the organisation.
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ElOtro/stockup-api/internal/data"
+)
+
+// ErrInvalidPhone is returned for a phone number which isn't a full international or
+// Russian number.
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// The URLs of the provider APIs. They are variables so a proxy can be put in front.
+var (
+	SMSCURL   = "https://smsc.ru/sys/send.php"
+	TwilioURL = "https://api.twilio.com/2010-04-01"
+)
+
+// The longest part of a response body which is kept in an error.
+const maxErrorBody = 500
+
+// Provider sends a text message to a phone number in the E.164 format (+79161234567)
+// and returns the ID the provider gave the message.
+type Provider interface {
+	Send(ctx context.Context, phone, text string) (string, error)
+}
+
+// New returns the provider of the SMS settings of an organisation.
+func New(settings *data.SMSSettings, client *http.Client) (Provider, error) {
+	switch settings.Provider {
+	case data.SMSProviderSMSC:
+		return smsc{login: settings.Login, password: settings.Password, sender: settings.Sender, client: client}, nil
+	case data.SMSProviderTwilio:
+		return twilio{sid: settings.Login, token: settings.Password, from: settings.Sender, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q", settings.Provider)
+	}
+}
+
+// NormalizePhone returns the phone number in the E.164 format. Spaces, dashes and
+// brackets are dropped; Russian numbers may start with 8 or have no country code.
+func NormalizePhone(phone string) (string, error) {
+	var digits strings.Builder
+
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+
+	number := digits.String()
+	international := strings.HasPrefix(strings.TrimSpace(phone), "+")
+
+	switch {
+	case !international && len(number) == 11 && number[0] == '8':
+		number = "7" + number[1:]
+	case !international && len(number) == 10:
+		number = "7" + number
+	}
+
+	if len(number) < 11 || len(number) > 15 {
+		return "", ErrInvalidPhone
+	}
+
+	return "+" + number, nil
+}
+
+// smsc sends messages with the HTTP API of SMSC. The sender must be registered with
+// SMSC, without one the default sender of the account is used.
+type smsc struct {
+	login    string
+	password string
+	sender   string
+	client   *http.Client
+}
+
+func (p smsc) Send(ctx context.Context, phone, text string) (string, error) {
+	form := url.Values{}
+	form.Set("login", p.login)
+	form.Set("psw", p.password)
+	form.Set("phones", strings.TrimPrefix(phone, "+"))
+	form.Set("mes", text)
+	form.Set("charset", "utf-8")
+	form.Set("fmt", "3")
+	if p.sender != "" {
+		form.Set("sender", p.sender)
+	}
+
+	body, err := post(ctx, p.client, SMSCURL, form, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// SMSC answers 200 OK to errors as well, with error and error_code in the body.
+	var result struct {
+		ID        json.Number `json:"id"`
+		Error     string      `json:"error"`
+		ErrorCode int         `json:"error_code"`
+	}
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return "", fmt.Errorf("smsc: unexpected answer: %s", truncate(string(body), maxErrorBody))
+	}
+
+	if result.Error != "" {
+		return "", fmt.Errorf("smsc: %s (code %d)", result.Error, result.ErrorCode)
+	}
+
+	return result.ID.String(), nil
+}
+
+// twilio sends messages with the Messages resource of the Twilio API from the number
+// of the account.
+type twilio struct {
+	sid    string
+	token  string
+	from   string
+	client *http.Client
+}
+
+func (p twilio) Send(ctx context.Context, phone, text string) (string, error) {
+	form := url.Values{}
+	form.Set("To", phone)
+	form.Set("From", p.from)
+	form.Set("Body", text)
+
+	endpoint := fmt.Sprintf("%s/Accounts/%s/Messages.json", TwilioURL, url.PathEscape(p.sid))
+
+	body, err := post(ctx, p.client, endpoint, form, func(req *http.Request) {
+		req.SetBasicAuth(p.sid, p.token)
+	})
+	if err != nil {
+		var answer *statusError
+		if errors.As(err, &answer) {
+			var result struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+
+			if json.Unmarshal(answer.body, &result) == nil && result.Message != "" {
+				return "", fmt.Errorf("twilio: %s (code %d)", result.Message, result.Code)
+			}
+		}
+		return "", err
+	}
+
+	var result struct {
+		SID string `json:"sid"`
+	}
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return "", fmt.Errorf("twilio: unexpected answer: %s", truncate(string(body), maxErrorBody))
+	}
+
+	return result.SID, nil
+}
+
+// statusError is the answer of a provider with a status other than 2xx.
+type statusError struct {
+	status string
+	body   []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("the server answered %s: %s", e.status, truncate(string(e.body), maxErrorBody))
+}
+
+// post posts the form and returns the body of the answer. The request can be changed
+// before it's sent, e.g. to add credentials.
+func post(ctx context.Context, client *http.Client, endpoint string, form url.Values, prepare func(*http.Request)) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if prepare != nil {
+		prepare(req)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &statusError{status: resp.Status, body: body}
+	}
+
+	return body, nil
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n] + "…"
+}
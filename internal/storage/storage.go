@@ -0,0 +1,107 @@
+// Package storage keeps the files uploaded to the API, e.g. the avatars of the users.
+// Files are addressed by keys like "avatars/3f9c2a.png" which the storage doesn't
+// interpret; Dir keeps them in a local directory, which may be a mounted volume shared
+// by all instances. Another backend, e.g. an S3 bucket, only has to implement Storage.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned for a key with no file.
+var ErrNotFound = errors.New("file not found")
+
+// ErrInvalidKey is returned for a key which is empty, absolute or leaves the storage.
+var ErrInvalidKey = errors.New("invalid file key")
+
+// Storage saves, opens and deletes files by their keys.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Dir stores the files in the directory, the slashes of the keys separate
+// subdirectories.
+type Dir struct {
+	Path string
+}
+
+func (d Dir) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "..") {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(d.Path, filepath.FromSlash(key)), nil
+}
+
+// Put writes the file under another name first and renames it, so the file of a key
+// is never read half-written.
+func (d Dir) Put(ctx context.Context, key string, r io.Reader) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0o750)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+func (d Dir) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Delete removes the file; a key without a file is not an error.
+func (d Dir) Delete(ctx context.Context, key string) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,413 @@
+// Package xlsx writes simple formatted workbooks: a table per sheet with a bold header
+// row, number formats per column and an optional totals row. Strings are stored
+// inline, so a workbook is written in one pass without a shared strings table.
+//
+// Numbers are stored as numbers, which spreadsheets show with the separators of the
+// computer they are opened on, dates are formatted the way the locale of the workbook
+// writes them.
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ElOtro/stockup-api/internal/locale"
+)
+
+// ContentType is the media type of the workbooks.
+const ContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// Kind is the type of the values of a column, which decides how they are formatted.
+type Kind int
+
+const (
+	// Text is written as it is.
+	Text Kind = iota
+	// Integer is a whole number with thousands separators.
+	Integer
+	// Money is a number with thousands separators and two decimal places.
+	Money
+	// Date is the day of a time.Time or *time.Time.
+	Date
+	// Month is the month of a time.Time or *time.Time.
+	Month
+)
+
+// Column is a column of a sheet. Width is in characters, 0 picks one from the title.
+type Column struct {
+	Title string
+	Kind  Kind
+	Width float64
+}
+
+// Sheet is a table. The values of a row are taken in the order of the columns: nil is
+// an empty cell, strings are text, int, int64, float64 or anything with a String()
+// method returning a number are numbers in Integer and Money columns and times are
+// dates in Date and Month columns. The totals row is printed in bold below the rows
+// unless it's nil.
+type Sheet struct {
+	Name    string
+	Columns []Column
+	Rows    [][]interface{}
+	Totals  []interface{}
+}
+
+// The cell styles defined in styles.xml, by their index in cellXfs.
+const (
+	styleDefault = iota
+	styleHeader
+	styleInteger
+	styleMoney
+	styleTotalText
+	styleTotalInteger
+	styleTotalMoney
+	styleDate
+	styleMonth
+)
+
+// Write writes the workbook with the sheets to w, with the dates in the format of the
+// locale.
+func Write(w io.Writer, loc locale.Locale, sheets ...Sheet) error {
+	if len(sheets) == 0 {
+		return fmt.Errorf("xlsx: a workbook needs at least one sheet")
+	}
+
+	zw := zip.NewWriter(w)
+
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"[Content_Types].xml", contentTypes(len(sheets))},
+		{"_rels/.rels", []byte(rootRels)},
+		{"xl/workbook.xml", workbook(sheets)},
+		{"xl/_rels/workbook.xml.rels", workbookRels(len(sheets))},
+		{"xl/styles.xml", styles(loc)},
+	}
+
+	for i, sheet := range sheets {
+		content, err := worksheet(sheet)
+		if err != nil {
+			return fmt.Errorf("xlsx: sheet %q: %w", sheet.Name, err)
+		}
+		files = append(files, struct {
+			name    string
+			content []byte
+		}{fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), content})
+	}
+
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+
+		_, err = fw.Write(file.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// worksheet renders the sheet with the header in the first row, which is frozen and
+// carries the autofilter.
+func worksheet(sheet Sheet) ([]byte, error) {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	b.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+
+	if len(sheet.Columns) > 0 {
+		b.WriteString(`<cols>`)
+		for i, column := range sheet.Columns {
+			width := column.Width
+			if width == 0 {
+				width = float64(len([]rune(column.Title))) + 4
+				if width < 12 {
+					width = 12
+				}
+			}
+			fmt.Fprintf(&b, `<col min="%d" max="%d" width="%s" customWidth="1"/>`, i+1, i+1, strconv.FormatFloat(width, 'f', -1, 64))
+		}
+		b.WriteString(`</cols>`)
+	}
+
+	b.WriteString(`<sheetData>`)
+
+	header := make([]interface{}, len(sheet.Columns))
+	for i, column := range sheet.Columns {
+		header[i] = column.Title
+	}
+
+	err := writeRow(&b, 1, sheet.Columns, header, true, styleHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, row := range sheet.Rows {
+		err = writeRow(&b, i+2, sheet.Columns, row, false, styleDefault)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sheet.Totals != nil {
+		err = writeRow(&b, len(sheet.Rows)+2, sheet.Columns, sheet.Totals, false, styleTotalText)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.WriteString(`</sheetData>`)
+
+	if len(sheet.Columns) > 0 {
+		fmt.Fprintf(&b, `<autoFilter ref="A1:%s%d"/>`, columnName(len(sheet.Columns)-1), len(sheet.Rows)+1)
+	}
+
+	b.WriteString(`</worksheet>`)
+
+	return b.Bytes(), nil
+}
+
+// writeRow writes the values of a row. Header cells are all text, the other cells are
+// formatted by the kind of their column, in bold in the totals row except for dates.
+func writeRow(b *bytes.Buffer, rowNumber int, columns []Column, values []interface{}, header bool, textStyle int) error {
+	fmt.Fprintf(b, `<row r="%d">`, rowNumber)
+
+	for i, value := range values {
+		if i >= len(columns) || value == nil {
+			continue
+		}
+
+		ref := fmt.Sprintf("%s%d", columnName(i), rowNumber)
+		kind := columns[i].Kind
+		if header {
+			kind = Text
+		}
+
+		if kind == Text {
+			fmt.Fprintf(b, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">`, ref, textStyle)
+			if err := xml.EscapeText(b, []byte(fmt.Sprint(value))); err != nil {
+				return err
+			}
+			b.WriteString(`</t></is></c>`)
+			continue
+		}
+
+		if kind == Date || kind == Month {
+			n, ok, err := serial(value)
+			if err != nil {
+				return fmt.Errorf("row %d, column %q: %w", rowNumber, columns[i].Title, err)
+			}
+			if !ok {
+				continue
+			}
+
+			style := styleDate
+			if kind == Month {
+				style = styleMonth
+			}
+
+			fmt.Fprintf(b, `<c r="%s" s="%d"><v>%d</v></c>`, ref, style, n)
+			continue
+		}
+
+		n, err := number(value)
+		if err != nil {
+			return fmt.Errorf("row %d, column %q: %w", rowNumber, columns[i].Title, err)
+		}
+
+		style := styleInteger
+		if kind == Money {
+			style = styleMoney
+		}
+		if textStyle == styleTotalText {
+			style += styleTotalInteger - styleInteger
+		}
+
+		fmt.Fprintf(b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style, n)
+	}
+
+	b.WriteString(`</row>`)
+
+	return nil
+}
+
+// number returns the value of a numeric cell as it is written to the sheet.
+func number(value interface{}) (string, error) {
+	var s string
+
+	switch value := value.(type) {
+	case int:
+		s = strconv.Itoa(value)
+	case int64:
+		s = strconv.FormatInt(value, 10)
+	case float64:
+		s = strconv.FormatFloat(value, 'f', -1, 64)
+	case fmt.Stringer:
+		s = value.String()
+	default:
+		return "", fmt.Errorf("%T is not a number", value)
+	}
+
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return "", fmt.Errorf("%q is not a number", s)
+	}
+
+	return s, nil
+}
+
+// The day spreadsheets count dates from, as the 1900 date system has it.
+var epoch = time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+
+// serial returns the day of a date cell as the number of days since the epoch. A nil
+// *time.Time is an empty cell.
+func serial(value interface{}) (int64, bool, error) {
+	var t time.Time
+
+	switch value := value.(type) {
+	case time.Time:
+		t = value
+	case *time.Time:
+		if value == nil {
+			return 0, false, nil
+		}
+		t = *value
+	default:
+		return 0, false, fmt.Errorf("%T is not a date", value)
+	}
+
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	return int64(day.Sub(epoch).Hours()) / 24, true, nil
+}
+
+// columnName returns the letters of the column with the zero based index, A to Z,
+// then AA and so on.
+func columnName(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
+}
+
+// sheetName makes the name of a sheet acceptable to Excel: at most 31 characters and
+// none of []:*?/\.
+func sheetName(name string, index int) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	if runes := []rune(name); len(runes) > 31 {
+		name = string(runes[:31])
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("Sheet%d", index+1)
+	}
+
+	return name
+}
+
+func contentTypes(sheets int) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	b.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	b.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	b.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	b.WriteString(`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	for i := 1; i <= sheets; i++ {
+		fmt.Fprintf(&b, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i)
+	}
+	b.WriteString(`</Types>`)
+
+	return b.Bytes()
+}
+
+func workbook(sheets []Sheet) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	for i, sheet := range sheets {
+		b.WriteString(`<sheet name="`)
+		xml.EscapeText(&b, []byte(sheetName(sheet.Name, i)))
+		fmt.Fprintf(&b, `" sheetId="%d" r:id="rId%d"/>`, i+1, i+1)
+	}
+	b.WriteString(`</sheets></workbook>`)
+
+	return b.Bytes()
+}
+
+// The styles are referenced by the workbook relationship after the sheets.
+func workbookRels(sheets int) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := 1; i <= sheets; i++ {
+		fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i, i)
+	}
+	fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, sheets+1)
+	b.WriteString(`</Relationships>`)
+
+	return b.Bytes()
+}
+
+const rootRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+// The cellXfs follow the order of the style constants. Number format 3 is the built-in
+// "#,##0", 164 adds two decimal places, 165 and 166 are the date and month formats of
+// the locale.
+func styles(loc locale.Locale) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	b.WriteString(`<numFmts count="3"><numFmt numFmtId="164" formatCode="#,##0.00"/>`)
+	for i, format := range []string{loc.DateFormat, loc.MonthFormat} {
+		fmt.Fprintf(&b, `<numFmt numFmtId="%d" formatCode="`, 165+i)
+		xml.EscapeText(&b, []byte(format))
+		b.WriteString(`"/>`)
+	}
+	b.WriteString(`</numFmts>`)
+	b.WriteString(`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>`)
+	b.WriteString(`<fills count="3"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill>`)
+	b.WriteString(`<fill><patternFill patternType="solid"><fgColor rgb="FFD9D9D9"/><bgColor indexed="64"/></patternFill></fill></fills>`)
+	b.WriteString(`<borders count="2"><border><left/><right/><top/><bottom/><diagonal/></border>`)
+	b.WriteString(`<border><left/><right/><top/><bottom style="thin"><color auto="1"/></bottom><diagonal/></border></borders>`)
+	b.WriteString(`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>`)
+	b.WriteString(`<cellXfs count="9">`)
+	b.WriteString(`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>`)
+	b.WriteString(`<xf numFmtId="0" fontId="1" fillId="2" borderId="1" xfId="0" applyFont="1" applyFill="1" applyBorder="1"/>`)
+	b.WriteString(`<xf numFmtId="3" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`)
+	b.WriteString(`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`)
+	b.WriteString(`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>`)
+	b.WriteString(`<xf numFmtId="3" fontId="1" fillId="0" borderId="0" xfId="0" applyNumberFormat="1" applyFont="1"/>`)
+	b.WriteString(`<xf numFmtId="164" fontId="1" fillId="0" borderId="0" xfId="0" applyNumberFormat="1" applyFont="1"/>`)
+	b.WriteString(`<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`)
+	b.WriteString(`<xf numFmtId="166" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`)
+	b.WriteString(`</cellXfs>`)
+	b.WriteString(`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>`)
+	b.WriteString(`</styleSheet>`)
+
+	return b.Bytes()
+}
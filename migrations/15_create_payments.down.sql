@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS payment_allocations CASCADE;
+DROP TABLE IF EXISTS payments CASCADE;
+ALTER TABLE invoices DROP COLUMN IF EXISTS is_advance;
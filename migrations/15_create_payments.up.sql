@@ -0,0 +1,32 @@
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS is_advance boolean DEFAULT false;
+
+CREATE TABLE payments (
+  id BIGSERIAL PRIMARY KEY,
+  date timestamp without time zone,
+  number character varying(20),
+  organisation_id bigint REFERENCES organisations (id) ON DELETE CASCADE,
+  bank_account_id bigint REFERENCES bank_accounts (id),
+  company_id bigint REFERENCES companies (id) ON DELETE CASCADE,
+  amount numeric(15,2) DEFAULT 0.0,
+  description character varying(1024),
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  destroyed_at timestamp(0) without time zone,
+  created_at timestamp(0) without time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) without time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS payments_date_index ON payments USING btree (date);
+CREATE INDEX IF NOT EXISTS payments_organisation_id_index ON payments USING btree (organisation_id);
+CREATE INDEX IF NOT EXISTS payments_company_id_index ON payments USING btree (company_id);
+CREATE INDEX IF NOT EXISTS payments_destroyed_at_index ON payments USING btree (destroyed_at);
+
+CREATE TABLE payment_allocations (
+  id BIGSERIAL PRIMARY KEY,
+  payment_id bigint REFERENCES payments (id) ON DELETE CASCADE,
+  invoice_id bigint REFERENCES invoices (id) ON DELETE CASCADE,
+  amount numeric(15,2) DEFAULT 0.0,
+  created_at timestamp(0) without time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS payment_allocations_payment_id_index ON payment_allocations USING btree (payment_id);
+CREATE INDEX IF NOT EXISTS payment_allocations_invoice_id_index ON payment_allocations USING btree (invoice_id);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS permissions (
+  id BIGSERIAL PRIMARY KEY,
+  code text NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS permissions_code_index ON permissions USING btree (code);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+  user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  permission_id bigint NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+  PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code) VALUES ('invoices:write_off');
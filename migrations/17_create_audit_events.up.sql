@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+  id BIGSERIAL PRIMARY KEY,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  action character varying(50) NOT NULL,
+  entity character varying(50) NOT NULL,
+  entity_id bigint,
+  details jsonb DEFAULT '{}'::jsonb,
+  created_at timestamp(0) without time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS audit_events_user_id_index ON audit_events USING btree (user_id);
+CREATE INDEX IF NOT EXISTS audit_events_entity_index ON audit_events USING btree (entity, entity_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS invoices_written_off_at_index;
+ALTER TABLE invoices DROP COLUMN IF EXISTS write_off_reason;
+ALTER TABLE invoices DROP COLUMN IF EXISTS written_off_at;
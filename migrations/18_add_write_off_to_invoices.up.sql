@@ -0,0 +1,3 @@
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS written_off_at timestamp(0) without time zone;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS write_off_reason character varying(1024);
+CREATE INDEX IF NOT EXISTS invoices_written_off_at_index ON invoices USING btree (written_off_at);
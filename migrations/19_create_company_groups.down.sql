@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS companies_group_id_index;
+ALTER TABLE companies DROP COLUMN IF EXISTS group_id;
+DROP TABLE IF EXISTS company_groups;
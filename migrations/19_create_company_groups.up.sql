@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS company_groups (
+  id BIGSERIAL PRIMARY KEY,
+  name character varying(100),
+  destroyed_at timestamp(0) without time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) without time zone NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS group_id bigint REFERENCES company_groups (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS companies_group_id_index ON companies USING btree (group_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS invoices_due_date_index;
+ALTER TABLE invoices DROP COLUMN IF EXISTS due_date;
+ALTER TABLE companies DROP COLUMN IF EXISTS defaults;
@@ -0,0 +1,4 @@
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS defaults jsonb;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS due_date timestamp without time zone;
+
+CREATE INDEX IF NOT EXISTS invoices_due_date_index ON invoices USING btree (due_date);
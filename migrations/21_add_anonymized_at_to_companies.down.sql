@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'companies:anonymize';
+ALTER TABLE companies DROP COLUMN IF EXISTS anonymized_at;
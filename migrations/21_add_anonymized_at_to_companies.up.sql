@@ -0,0 +1,3 @@
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS anonymized_at timestamp(0) without time zone;
+
+INSERT INTO permissions (code) VALUES ('companies:anonymize') ON CONFLICT DO NOTHING;
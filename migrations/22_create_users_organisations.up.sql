@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users_organisations (
+  user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  created_at timestamp(0) without time zone NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (user_id, organisation_id)
+);
+CREATE INDEX IF NOT EXISTS users_organisations_organisation_id_index ON users_organisations USING btree (organisation_id);
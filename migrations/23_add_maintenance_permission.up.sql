@@ -0,0 +1 @@
+INSERT INTO permissions (code) VALUES ('admin:maintenance') ON CONFLICT DO NOTHING;
@@ -0,0 +1,16 @@
+DROP VIEW IF EXISTS invoice_items_history;
+DROP VIEW IF EXISTS invoices_history;
+
+-- Move the archived invoices back before the archive is dropped.
+INSERT INTO invoices SELECT * FROM invoices_archive ON CONFLICT DO NOTHING;
+INSERT INTO invoice_items SELECT * FROM invoice_items_archive ON CONFLICT DO NOTHING;
+
+DROP TRIGGER IF EXISTS invoice_allocations ON invoices;
+DROP FUNCTION IF EXISTS delete_invoice_allocations();
+
+DELETE FROM payment_allocations WHERE invoice_id NOT IN (SELECT id FROM invoices);
+ALTER TABLE payment_allocations ADD CONSTRAINT payment_allocations_invoice_id_fkey
+  FOREIGN KEY (invoice_id) REFERENCES invoices (id) ON DELETE CASCADE;
+
+DROP TABLE IF EXISTS invoice_items_archive;
+DROP TABLE IF EXISTS invoices_archive;
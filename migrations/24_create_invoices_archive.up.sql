@@ -0,0 +1,33 @@
+-- Settled invoices older than the archive period are moved here by the archiver. The
+-- archive tables have the same columns as the live ones, so a column added to invoices
+-- or invoice_items later has to be added to the archive table as well.
+CREATE TABLE IF NOT EXISTS invoices_archive (LIKE invoices INCLUDING DEFAULTS INCLUDING INDEXES);
+CREATE TABLE IF NOT EXISTS invoice_items_archive (LIKE invoice_items INCLUDING DEFAULTS INCLUDING INDEXES);
+
+-- Allocations stay where they are when their invoice is archived, so they can't
+-- reference the invoices table any more. The trigger takes over the cascade delete.
+ALTER TABLE payment_allocations DROP CONSTRAINT IF EXISTS payment_allocations_invoice_id_fkey;
+
+CREATE OR REPLACE FUNCTION delete_invoice_allocations() RETURNS trigger AS $$
+begin
+  if not exists (select 1 from invoices_archive where id = old.id) then
+    delete from payment_allocations where invoice_id = old.id;
+  end if;
+  return old;
+end
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER invoice_allocations AFTER DELETE
+ON invoices
+FOR EACH ROW EXECUTE PROCEDURE delete_invoice_allocations();
+
+-- History queries read the live and the archived invoices through these views.
+CREATE OR REPLACE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+CREATE OR REPLACE VIEW invoice_items_history AS
+  SELECT * FROM invoice_items
+  UNION ALL
+  SELECT * FROM invoice_items_archive;
@@ -0,0 +1,4 @@
+ALTER TABLE vat_rates DROP CONSTRAINT IF EXISTS vat_rates_validity_check;
+ALTER TABLE vat_rates DROP COLUMN IF EXISTS replaced_by_id;
+ALTER TABLE vat_rates DROP COLUMN IF EXISTS valid_to;
+ALTER TABLE vat_rates DROP COLUMN IF EXISTS valid_from;
@@ -0,0 +1,8 @@
+-- A rate is valid from valid_from to valid_to inclusive, an empty bound is open. When a
+-- rate is changed by law (18% became 20% on 2019-01-01) the old rate is closed and
+-- points to the new one, so defaults referencing either rate can be resolved by date.
+ALTER TABLE vat_rates ADD COLUMN IF NOT EXISTS valid_from date;
+ALTER TABLE vat_rates ADD COLUMN IF NOT EXISTS valid_to date;
+ALTER TABLE vat_rates ADD COLUMN IF NOT EXISTS replaced_by_id bigint REFERENCES vat_rates (id) ON DELETE SET NULL;
+
+ALTER TABLE vat_rates ADD CONSTRAINT vat_rates_validity_check CHECK (valid_to IS NULL OR valid_from IS NULL OR valid_to >= valid_from);
@@ -0,0 +1,4 @@
+UPDATE organisations SET is_vat_payer = organisation_taxation_system(id, CURRENT_DATE) = 'osno';
+
+DROP FUNCTION IF EXISTS organisation_taxation_system(bigint, date);
+DROP TABLE IF EXISTS organisation_taxation;
@@ -0,0 +1,24 @@
+-- The history of the taxation system of an organisation: "osno" (general system, VAT
+-- is charged) or "usn" (simplified system, no VAT). A record applies from valid_from
+-- until the next one, the first record of an organisation has no valid_from.
+CREATE TABLE IF NOT EXISTS organisation_taxation (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  taxation_system character varying(10) NOT NULL CHECK (taxation_system IN ('osno', 'usn')),
+  valid_from date,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (organisation_id, valid_from)
+);
+
+INSERT INTO organisation_taxation (organisation_id, taxation_system)
+SELECT id, CASE WHEN is_vat_payer THEN 'osno' ELSE 'usn' END FROM organisations;
+
+-- Organisations without any history (e.g. created later) fall back to is_vat_payer.
+CREATE OR REPLACE FUNCTION organisation_taxation_system(org_id bigint, on_date date) RETURNS varchar AS $$
+  SELECT COALESCE(
+    (SELECT taxation_system FROM organisation_taxation
+     WHERE organisation_id = org_id AND (valid_from IS NULL OR valid_from <= on_date)
+     ORDER BY valid_from DESC NULLS LAST LIMIT 1),
+    (SELECT CASE WHEN is_vat_payer THEN 'osno' ELSE 'usn' END FROM organisations WHERE id = org_id))
+$$ LANGUAGE sql STABLE;
@@ -0,0 +1,30 @@
+-- A line discount is either a percentage of the line (discount_rate) or an absolute
+-- amount (discount). Existing lines keep their stored discount as an absolute one.
+ALTER TABLE invoice_items ADD COLUMN IF NOT EXISTS discount_type character varying(10) NOT NULL DEFAULT 'absolute';
+ALTER TABLE invoice_items ALTER COLUMN discount_type SET DEFAULT 'percent';
+-- The part of the invoice discount allocated to the line.
+ALTER TABLE invoice_items ADD COLUMN IF NOT EXISTS invoice_discount numeric(15,2) DEFAULT 0.0;
+
+-- The discount of the whole invoice, applied after the line discounts.
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS discount_type character varying(10);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS discount_value numeric(15,2) DEFAULT 0.0;
+
+ALTER TABLE invoice_items_archive ADD COLUMN IF NOT EXISTS discount_type character varying(10) NOT NULL DEFAULT 'absolute';
+ALTER TABLE invoice_items_archive ALTER COLUMN discount_type SET DEFAULT 'percent';
+ALTER TABLE invoice_items_archive ADD COLUMN IF NOT EXISTS invoice_discount numeric(15,2) DEFAULT 0.0;
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS discount_type character varying(10);
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS discount_value numeric(15,2) DEFAULT 0.0;
+
+-- The column lists of the history views are fixed when they are created.
+DROP VIEW IF EXISTS invoices_history;
+DROP VIEW IF EXISTS invoice_items_history;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+CREATE VIEW invoice_items_history AS
+  SELECT * FROM invoice_items
+  UNION ALL
+  SELECT * FROM invoice_items_archive;
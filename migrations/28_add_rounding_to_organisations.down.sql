@@ -0,0 +1,2 @@
+ALTER TABLE organisations DROP COLUMN IF EXISTS rounding_mode;
+ALTER TABLE organisations DROP COLUMN IF EXISTS vat_rounding;
@@ -0,0 +1,6 @@
+-- How the totals of the documents of an organisation are rounded: VAT per line or once
+-- per document and rate, and the rounding of kopecks.
+ALTER TABLE organisations ADD COLUMN IF NOT EXISTS vat_rounding character varying(10) NOT NULL DEFAULT 'line'
+  CHECK (vat_rounding IN ('line', 'document'));
+ALTER TABLE organisations ADD COLUMN IF NOT EXISTS rounding_mode character varying(10) NOT NULL DEFAULT 'half_up'
+  CHECK (rounding_mode IN ('half_up', 'half_even', 'down'));
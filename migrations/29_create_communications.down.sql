@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS communications;
+ALTER TABLE companies DROP COLUMN IF EXISTS statement_contact_id;
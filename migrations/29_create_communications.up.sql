@@ -0,0 +1,19 @@
+-- A company opts in to monthly statement emails by naming the contact they are sent to.
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS statement_contact_id bigint REFERENCES contacts (id) ON DELETE SET NULL;
+
+-- The log of the messages sent to companies. Failed attempts are kept as well, the
+-- address itself isn't stored as it is personal data kept encrypted in contacts.
+CREATE TABLE IF NOT EXISTS communications (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint REFERENCES organisations (id) ON DELETE CASCADE,
+  company_id bigint NOT NULL REFERENCES companies (id) ON DELETE CASCADE,
+  contact_id bigint REFERENCES contacts (id) ON DELETE SET NULL,
+  kind character varying(20) NOT NULL,
+  channel character varying(20) NOT NULL,
+  subject text NOT NULL,
+  period_start date,
+  status character varying(10) NOT NULL CHECK (status IN ('sent', 'failed')),
+  error text,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS communications_company_id_index ON communications USING btree (company_id, created_at);
@@ -0,0 +1,8 @@
+DELETE FROM communications WHERE status = 'viewed';
+ALTER TABLE communications DROP CONSTRAINT IF EXISTS communications_status_check;
+ALTER TABLE communications ADD CONSTRAINT communications_status_check CHECK (status IN ('sent', 'failed'));
+
+DROP INDEX IF EXISTS communications_invoice_id_index;
+ALTER TABLE communications DROP COLUMN IF EXISTS details;
+ALTER TABLE communications DROP COLUMN IF EXISTS user_id;
+ALTER TABLE communications DROP COLUMN IF EXISTS invoice_id;
@@ -0,0 +1,11 @@
+-- Communications may concern a single invoice, be recorded by a user (e.g. an email
+-- sent from a mail client) and carry channel specific details like the webhook URL.
+-- invoice_id has no foreign key, invoices are moved to the archive tables.
+ALTER TABLE communications ADD COLUMN IF NOT EXISTS invoice_id bigint;
+ALTER TABLE communications ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE communications ADD COLUMN IF NOT EXISTS details jsonb DEFAULT '{}'::jsonb;
+CREATE INDEX IF NOT EXISTS communications_invoice_id_index ON communications USING btree (invoice_id);
+
+-- Portal views are recorded as "viewed".
+ALTER TABLE communications DROP CONSTRAINT IF EXISTS communications_status_check;
+ALTER TABLE communications ADD CONSTRAINT communications_status_check CHECK (status IN ('sent', 'failed', 'viewed'));
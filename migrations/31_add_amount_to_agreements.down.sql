@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS invoices_archive_agreement_id_index;
+ALTER TABLE agreements DROP COLUMN IF EXISTS block_over_amount;
+ALTER TABLE agreements DROP COLUMN IF EXISTS warning_percent;
+ALTER TABLE agreements DROP COLUMN IF EXISTS amount;
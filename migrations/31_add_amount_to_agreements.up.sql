@@ -0,0 +1,9 @@
+-- The contract amount of an agreement. Invoices are counted against it; a warning is
+-- given from warning_percent of the amount on, and with block_over_amount set invoices
+-- which would exceed it are rejected. No amount means no limit.
+ALTER TABLE agreements ADD COLUMN IF NOT EXISTS amount numeric(15,2) CHECK (amount >= 0);
+ALTER TABLE agreements ADD COLUMN IF NOT EXISTS warning_percent smallint NOT NULL DEFAULT 80
+  CHECK (warning_percent BETWEEN 1 AND 100);
+ALTER TABLE agreements ADD COLUMN IF NOT EXISTS block_over_amount boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS invoices_archive_agreement_id_index ON invoices_archive USING btree (agreement_id);
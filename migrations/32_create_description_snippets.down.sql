@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS description_snippets_usage_index;
+DROP TABLE IF EXISTS description_snippets;
@@ -0,0 +1,16 @@
+-- Reusable descriptions of invoice items per organisation. usage_count and last_used_at
+-- rank the suggestions.
+CREATE TABLE IF NOT EXISTS description_snippets (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  name character varying(100),
+  text character varying(1024) NOT NULL,
+  usage_count integer NOT NULL DEFAULT 0,
+  last_used_at timestamp(0) with time zone,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) without time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (organisation_id, text)
+);
+CREATE INDEX IF NOT EXISTS description_snippets_usage_index
+  ON description_snippets USING btree (organisation_id, usage_count DESC, last_used_at DESC);
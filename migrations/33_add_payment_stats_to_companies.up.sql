@@ -0,0 +1,2 @@
+-- The payment discipline of a company, recalculated by a background job.
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS payment_stats jsonb;
@@ -0,0 +1,12 @@
+DROP VIEW IF EXISTS invoices_history;
+
+ALTER TABLE acts ALTER COLUMN number TYPE character varying(11) USING left(number, 11);
+ALTER TABLE invoices_archive ALTER COLUMN number TYPE character varying(11) USING left(number, 11);
+ALTER TABLE invoices ALTER COLUMN number TYPE character varying(11) USING left(number, 11);
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+DROP TABLE IF EXISTS document_sequences;
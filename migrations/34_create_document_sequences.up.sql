@@ -0,0 +1,39 @@
+-- The numbering of every document type of an organisation. next_number is the number
+-- the next document gets, template shows how it is printed, e.g. "СЧ-{year}-{number}".
+-- With reset_yearly the numbering starts at 1 again with the first document of a
+-- new year, year is the year of the last document numbered.
+CREATE TABLE IF NOT EXISTS document_sequences (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  document_type character varying(20) NOT NULL
+    CHECK (document_type IN ('invoice', 'act', 'quote', 'delivery_note', 'credit_note')),
+  template character varying(50) NOT NULL DEFAULT '{number}',
+  padding smallint NOT NULL DEFAULT 0 CHECK (padding BETWEEN 0 AND 10),
+  next_number bigint NOT NULL DEFAULT 1 CHECK (next_number > 0),
+  reset_yearly boolean NOT NULL DEFAULT false,
+  year integer,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (organisation_id, document_type)
+);
+
+-- Invoices continue after the highest number issued so far.
+INSERT INTO document_sequences (organisation_id, document_type, next_number)
+SELECT organisation_id, 'invoice', COALESCE(MAX(number::bigint) FILTER (WHERE number ~ '^[0-9]{1,18}$'), 0) + 1
+FROM invoices_history
+WHERE organisation_id IS NOT NULL
+GROUP BY organisation_id
+ON CONFLICT (organisation_id, document_type) DO NOTHING;
+
+-- Numbers made from a template don't fit into 11 characters.
+DROP VIEW IF EXISTS invoices_history;
+
+ALTER TABLE invoices ALTER COLUMN number TYPE character varying(50);
+ALTER TABLE invoices_archive ALTER COLUMN number TYPE character varying(50);
+ALTER TABLE acts ALTER COLUMN number TYPE character varying(50);
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
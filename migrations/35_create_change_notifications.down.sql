@@ -0,0 +1,11 @@
+DROP TRIGGER IF EXISTS payments_changes ON payments;
+DROP TRIGGER IF EXISTS acts_changes ON acts;
+DROP TRIGGER IF EXISTS invoices_changes ON invoices;
+DROP TRIGGER IF EXISTS agreements_changes ON agreements;
+DROP TRIGGER IF EXISTS companies_changes ON companies;
+DROP TRIGGER IF EXISTS products_changes ON products;
+DROP TRIGGER IF EXISTS vat_rates_changes ON vat_rates;
+DROP TRIGGER IF EXISTS units_changes ON units;
+DROP TRIGGER IF EXISTS organisations_changes ON organisations;
+
+DROP FUNCTION IF EXISTS notify_change();
@@ -0,0 +1,61 @@
+-- Changes of the core tables are announced on the table_changes channel once their
+-- transaction commits, so every API instance can invalidate its caches and pass the
+-- change on to its event streams. The optional argument of the trigger names the
+-- column holding the organisation of the row; rows without one are shared by all
+-- organisations.
+CREATE OR REPLACE FUNCTION notify_change() RETURNS trigger AS $$
+declare
+  r record;
+begin
+  if tg_op = 'DELETE' then
+    r := old;
+  else
+    r := new;
+  end if;
+
+  perform pg_notify('table_changes', json_build_object(
+    'table', tg_table_name,
+    'operation', lower(tg_op),
+    'id', r.id,
+    'organisation_id', case when tg_nargs > 0 then (to_jsonb(r) ->> tg_argv[0])::bigint end
+  )::text);
+
+  return null;
+end
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER organisations_changes AFTER INSERT OR UPDATE OR DELETE
+ON organisations
+FOR EACH ROW EXECUTE PROCEDURE notify_change('id');
+
+CREATE TRIGGER units_changes AFTER INSERT OR UPDATE OR DELETE
+ON units
+FOR EACH ROW EXECUTE PROCEDURE notify_change();
+
+CREATE TRIGGER vat_rates_changes AFTER INSERT OR UPDATE OR DELETE
+ON vat_rates
+FOR EACH ROW EXECUTE PROCEDURE notify_change();
+
+CREATE TRIGGER products_changes AFTER INSERT OR UPDATE OR DELETE
+ON products
+FOR EACH ROW EXECUTE PROCEDURE notify_change();
+
+CREATE TRIGGER companies_changes AFTER INSERT OR UPDATE OR DELETE
+ON companies
+FOR EACH ROW EXECUTE PROCEDURE notify_change();
+
+CREATE TRIGGER agreements_changes AFTER INSERT OR UPDATE OR DELETE
+ON agreements
+FOR EACH ROW EXECUTE PROCEDURE notify_change();
+
+CREATE TRIGGER invoices_changes AFTER INSERT OR UPDATE OR DELETE
+ON invoices
+FOR EACH ROW EXECUTE PROCEDURE notify_change('organisation_id');
+
+CREATE TRIGGER acts_changes AFTER INSERT OR UPDATE OR DELETE
+ON acts
+FOR EACH ROW EXECUTE PROCEDURE notify_change('organisation_id');
+
+CREATE TRIGGER payments_changes AFTER INSERT OR UPDATE OR DELETE
+ON payments
+FOR EACH ROW EXECUTE PROCEDURE notify_change('organisation_id');
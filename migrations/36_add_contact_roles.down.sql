@@ -0,0 +1,11 @@
+DROP VIEW IF EXISTS invoices_history;
+
+ALTER TABLE invoices_archive DROP COLUMN IF EXISTS signer_contact_id;
+ALTER TABLE invoices DROP COLUMN IF EXISTS signer_contact_id;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+ALTER TABLE contacts DROP COLUMN IF EXISTS roles;
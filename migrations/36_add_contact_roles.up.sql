@@ -0,0 +1,16 @@
+-- The roles a contact has in the paperwork of its company: the signer signs documents
+-- for it, the accountant reconciles them and the recipient receives them. A contact
+-- may have any number of roles.
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS roles text[] NOT NULL DEFAULT '{}'
+  CHECK (roles <@ ARRAY['signer', 'accountant', 'recipient']);
+
+-- The contact who signs the invoice for the customer.
+DROP VIEW IF EXISTS invoices_history;
+
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS signer_contact_id bigint REFERENCES contacts (id) ON DELETE SET NULL;
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS signer_contact_id bigint;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
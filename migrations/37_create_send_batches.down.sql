@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS invoice_sendings;
+DROP TABLE IF EXISTS send_batches;
@@ -0,0 +1,24 @@
+-- Invoices queued for emailing at a scheduled time. Every invoice of a batch is sent
+-- to a recipient contact of its company and keeps the result of the attempt, so a
+-- batch reports its progress. invoice_id has no foreign key, invoices are moved to the
+-- archive tables.
+CREATE TABLE IF NOT EXISTS send_batches (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  scheduled_at timestamp(0) with time zone NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS invoice_sendings (
+  id BIGSERIAL PRIMARY KEY,
+  send_batch_id bigint NOT NULL REFERENCES send_batches (id) ON DELETE CASCADE,
+  invoice_id bigint NOT NULL,
+  contact_id bigint REFERENCES contacts (id) ON DELETE SET NULL,
+  status character varying(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'failed')),
+  subject text,
+  error text,
+  sent_at timestamp(0) with time zone,
+  UNIQUE (send_batch_id, invoice_id)
+);
+CREATE INDEX IF NOT EXISTS invoice_sendings_pending_index ON invoice_sendings USING btree (send_batch_id) WHERE status = 'pending';
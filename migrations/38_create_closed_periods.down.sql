@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code IN ('periods:close', 'periods:override');
+
+DROP TABLE IF EXISTS closed_periods;
+
+ALTER TABLE organisations DROP COLUMN IF EXISTS fiscal_year_start;
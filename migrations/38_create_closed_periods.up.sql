@@ -0,0 +1,21 @@
+-- The month the fiscal year of an organisation starts with. Quarters and years are
+-- closed by it.
+ALTER TABLE organisations ADD COLUMN IF NOT EXISTS fiscal_year_start smallint NOT NULL DEFAULT 1
+  CHECK (fiscal_year_start BETWEEN 1 AND 12);
+
+-- Periods of an organisation closed for the books. Documents dated within a closed
+-- period can't be created, changed or deleted unless the user may override it.
+CREATE TABLE IF NOT EXISTS closed_periods (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  kind character varying(10) NOT NULL CHECK (kind IN ('month', 'quarter', 'year')),
+  start_date date NOT NULL,
+  end_date date NOT NULL,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  CHECK (start_date <= end_date),
+  UNIQUE (organisation_id, start_date, end_date)
+);
+
+INSERT INTO permissions (code) VALUES ('periods:close') ON CONFLICT DO NOTHING;
+INSERT INTO permissions (code) VALUES ('periods:override') ON CONFLICT DO NOTHING;
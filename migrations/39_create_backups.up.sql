@@ -0,0 +1,15 @@
+-- Database backups made by the API, triggered by an admin or the scheduler. file is
+-- the name of the dump in the backup directory; removed_at is set when the retention
+-- policy has deleted it.
+CREATE TABLE IF NOT EXISTS backups (
+  id BIGSERIAL PRIMARY KEY,
+  status character varying(10) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed')),
+  file text NOT NULL,
+  size bigint,
+  error text,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  started_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  finished_at timestamp(0) with time zone,
+  removed_at timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS backups_started_at_index ON backups USING btree (started_at);
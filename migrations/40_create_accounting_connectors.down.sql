@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'accounting:manage';
+DROP TABLE IF EXISTS accounting_syncs;
+DROP TABLE IF EXISTS accounting_connectors;
@@ -0,0 +1,35 @@
+-- Connectors push the posted invoices and the payments of an organisation into an
+-- accounting system. Every document is synced once per connector; the sync keeps the
+-- result of the latest attempt and when to try again. token is encrypted like the
+-- other sensitive fields. document_id has no foreign key, invoices are moved to the
+-- archive tables.
+CREATE TABLE IF NOT EXISTS accounting_connectors (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  kind character varying(10) NOT NULL CHECK (kind IN ('1c', 'http')),
+  is_active boolean NOT NULL DEFAULT true,
+  url text,
+  token text,
+  start_date date,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (organisation_id, kind)
+);
+
+CREATE TABLE IF NOT EXISTS accounting_syncs (
+  id BIGSERIAL PRIMARY KEY,
+  connector_id bigint NOT NULL REFERENCES accounting_connectors (id) ON DELETE CASCADE,
+  document_type character varying(10) NOT NULL CHECK (document_type IN ('invoice', 'payment')),
+  document_id bigint NOT NULL,
+  status character varying(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'synced', 'failed')),
+  attempts integer NOT NULL DEFAULT 0,
+  error text,
+  external_id text,
+  next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  synced_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (connector_id, document_type, document_id)
+);
+CREATE INDEX IF NOT EXISTS accounting_syncs_pending_index ON accounting_syncs USING btree (connector_id, next_attempt_at) WHERE status = 'pending';
+
+INSERT INTO permissions (code) VALUES ('accounting:manage') ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'integrations:manage';
+DROP TABLE IF EXISTS integration_tokens;
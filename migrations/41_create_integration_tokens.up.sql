@@ -0,0 +1,21 @@
+-- Integration tokens let no-code platforms (Zapier, Make) call the /v1/integrations
+-- endpoints for a user, restricted to one organisation and to the scopes of the token.
+-- Only the SHA-256 hash of the token is stored; prefix is the start of the plaintext,
+-- shown so the user can tell the tokens apart.
+CREATE TABLE IF NOT EXISTS integration_tokens (
+  id BIGSERIAL PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  name text NOT NULL,
+  hash bytea NOT NULL UNIQUE,
+  prefix character varying(12) NOT NULL,
+  scopes text[] NOT NULL,
+  expires_at timestamp(0) with time zone,
+  last_used_at timestamp(0) with time zone,
+  revoked_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS integration_tokens_user_id_index ON integration_tokens USING btree (user_id);
+CREATE INDEX IF NOT EXISTS integration_tokens_organisation_id_index ON integration_tokens USING btree (organisation_id);
+
+INSERT INTO permissions (code) VALUES ('integrations:manage') ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'reminders:manage';
+DROP TABLE IF EXISTS payment_reminder_rules;
+DROP TABLE IF EXISTS sms_settings;
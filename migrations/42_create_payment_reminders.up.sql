@@ -0,0 +1,27 @@
+-- The SMS provider of an organisation and its credentials: the login (the account SID
+-- for Twilio), the password (the auth token) and the sender name or number. password
+-- is encrypted like the other sensitive fields.
+CREATE TABLE IF NOT EXISTS sms_settings (
+  organisation_id bigint PRIMARY KEY REFERENCES organisations (id) ON DELETE CASCADE,
+  provider character varying(10) NOT NULL CHECK (provider IN ('smsc', 'twilio')),
+  login text NOT NULL,
+  password text,
+  sender character varying(20),
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- Reminder rules remind the companies of unpaid invoices the given number of days
+-- after the due date (before it when negative), by email or SMS.
+CREATE TABLE IF NOT EXISTS payment_reminder_rules (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  days integer NOT NULL CHECK (days BETWEEN -30 AND 365),
+  channel character varying(10) NOT NULL CHECK (channel IN ('email', 'sms')),
+  is_active boolean NOT NULL DEFAULT true,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (organisation_id, days, channel)
+);
+
+INSERT INTO permissions (code) VALUES ('reminders:manage') ON CONFLICT DO NOTHING;
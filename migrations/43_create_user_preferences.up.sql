@@ -0,0 +1,11 @@
+-- The preferences of a user for the frontend. notifications and page_sizes are maps
+-- of a setting or list endpoint to its value.
+CREATE TABLE IF NOT EXISTS user_preferences (
+  user_id bigint PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+  locale character varying(10) NOT NULL DEFAULT 'ru',
+  timezone text NOT NULL DEFAULT 'Europe/Moscow',
+  default_organisation_id bigint REFERENCES organisations (id) ON DELETE SET NULL,
+  notifications jsonb NOT NULL DEFAULT '{}',
+  page_sizes jsonb NOT NULL DEFAULT '{}',
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
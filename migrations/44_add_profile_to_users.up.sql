@@ -0,0 +1,3 @@
+-- The phone of a user and the storage key of the avatar.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone character varying(20);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar text;
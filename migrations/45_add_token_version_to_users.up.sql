@@ -0,0 +1,3 @@
+-- The version of the tokens of a user. Tokens carry the version they were issued with
+-- and are no longer accepted once it's raised, e.g. when the password is changed.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version integer NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+DROP TRIGGER IF EXISTS users_changes ON users;
@@ -0,0 +1,5 @@
+-- Changes of users are announced as well, so every API instance drops the user from
+-- its cache of authenticated users. They are not passed on to the event streams.
+CREATE TRIGGER users_changes AFTER INSERT OR UPDATE OR DELETE
+ON users
+FOR EACH ROW EXECUTE PROCEDURE notify_change();
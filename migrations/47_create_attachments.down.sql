@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS invoice_attachments ON invoices;
+DROP FUNCTION IF EXISTS delete_invoice_attachments();
+DROP TABLE IF EXISTS attachments;
+DROP FUNCTION IF EXISTS count_attachment_refs();
+DROP TABLE IF EXISTS attachment_files;
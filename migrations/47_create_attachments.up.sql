@@ -0,0 +1,56 @@
+-- Attached files are stored once by the SHA-256 of their content, however many
+-- attachments refer to them. ref_count is kept by the trigger below; files which no
+-- attachment refers to any more are removed from the storage by the attachment_files
+-- job.
+CREATE TABLE IF NOT EXISTS attachment_files (
+  id BIGSERIAL PRIMARY KEY,
+  sha256 character(64) NOT NULL UNIQUE,
+  size bigint NOT NULL,
+  content_type character varying(100) NOT NULL,
+  ref_count integer NOT NULL DEFAULT 0 CHECK (ref_count >= 0),
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- Attachments stay with their invoice when it's archived, so like the allocations
+-- they don't reference the invoices table; the trigger takes over the cascade delete.
+CREATE TABLE IF NOT EXISTS attachments (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  invoice_id bigint NOT NULL,
+  file_id bigint NOT NULL REFERENCES attachment_files (id),
+  name character varying(255) NOT NULL,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS attachments_invoice_id_index ON attachments USING btree (invoice_id);
+CREATE INDEX IF NOT EXISTS attachments_file_id_index ON attachments USING btree (file_id);
+
+CREATE OR REPLACE FUNCTION count_attachment_refs() RETURNS trigger AS $$
+begin
+  if tg_op = 'INSERT' then
+    update attachment_files set ref_count = ref_count + 1, updated_at = now() where id = new.file_id;
+  else
+    update attachment_files set ref_count = ref_count - 1, updated_at = now() where id = old.file_id;
+  end if;
+  return null;
+end
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER attachments_ref_count AFTER INSERT OR DELETE
+ON attachments
+FOR EACH ROW EXECUTE PROCEDURE count_attachment_refs();
+
+CREATE OR REPLACE FUNCTION delete_invoice_attachments() RETURNS trigger AS $$
+begin
+  if not exists (select 1 from invoices_archive where id = old.id) then
+    delete from attachments where invoice_id = old.id;
+  end if;
+  return old;
+end
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER invoice_attachments AFTER DELETE
+ON invoices
+FOR EACH ROW EXECUTE PROCEDURE delete_invoice_attachments();
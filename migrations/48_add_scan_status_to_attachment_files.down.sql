@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS attachment_files_pending_index;
+ALTER TABLE attachment_files
+  DROP COLUMN IF EXISTS scanned_at,
+  DROP COLUMN IF EXISTS scan_attempts,
+  DROP COLUMN IF EXISTS scan_signature,
+  DROP COLUMN IF EXISTS scan_status;
@@ -0,0 +1,11 @@
+-- Attached files are scanned for viruses after the upload when a scanner is configured.
+-- Files uploaded without one are unscanned; infected files are moved to the quarantine
+-- of the storage and can't be downloaded.
+ALTER TABLE attachment_files
+  ADD COLUMN IF NOT EXISTS scan_status character varying(10) NOT NULL DEFAULT 'unscanned'
+    CHECK (scan_status IN ('unscanned', 'pending', 'clean', 'infected', 'failed')),
+  ADD COLUMN IF NOT EXISTS scan_signature text,
+  ADD COLUMN IF NOT EXISTS scan_attempts integer NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS scanned_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS attachment_files_pending_index ON attachment_files USING btree (id) WHERE scan_status = 'pending';
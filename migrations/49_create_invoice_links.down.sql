@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS invoice_links ON invoices;
+DROP FUNCTION IF EXISTS delete_invoice_links();
+DROP TABLE IF EXISTS invoice_links;
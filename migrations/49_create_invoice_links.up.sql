@@ -0,0 +1,30 @@
+-- Public links show an invoice to anyone who has the link, e.g. the customer, without
+-- exposing its id or uuid. The slug is short but random; links expire and can be
+-- revoked. Like attachments they stay with archived invoices.
+CREATE TABLE IF NOT EXISTS invoice_links (
+  id BIGSERIAL PRIMARY KEY,
+  slug character varying(16) NOT NULL UNIQUE,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  invoice_id bigint NOT NULL,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  expires_at timestamp(0) with time zone NOT NULL,
+  revoked_at timestamp(0) with time zone,
+  views integer NOT NULL DEFAULT 0,
+  last_viewed_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS invoice_links_invoice_id_index ON invoice_links USING btree (invoice_id);
+
+CREATE OR REPLACE FUNCTION delete_invoice_links() RETURNS trigger AS $$
+begin
+  if not exists (select 1 from invoices_archive where id = old.id) then
+    delete from invoice_links where invoice_id = old.id;
+  end if;
+  return old;
+end
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER invoice_links AFTER DELETE
+ON invoices
+FOR EACH ROW EXECUTE PROCEDURE delete_invoice_links();
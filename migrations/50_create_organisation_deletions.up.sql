@@ -0,0 +1,22 @@
+-- Deleting an organisation soft-deletes its records in the background, a batch at a
+-- time, and the organisation itself at the end. A deletion keeps its progress: the
+-- step it is at and how many of the total records are done. updated_at tells a stuck
+-- deletion, e.g. of an instance which was stopped, from a running one.
+CREATE TABLE IF NOT EXISTS organisation_deletions (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  status character varying(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+  step character varying(20),
+  total integer NOT NULL DEFAULT 0,
+  done integer NOT NULL DEFAULT 0,
+  error text,
+  started_at timestamp(0) with time zone,
+  finished_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- An organisation is deleted once at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS organisation_deletions_active_index
+  ON organisation_deletions USING btree (organisation_id) WHERE status IN ('pending', 'running');
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code IN ('companies:merge', 'products:merge');
+DROP TABLE IF EXISTS duplicate_reports;
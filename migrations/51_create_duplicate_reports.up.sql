@@ -0,0 +1,14 @@
+-- Reports of likely duplicate companies and products, made in the background on the
+-- request of an admin. groups holds the duplicates found, the API adds the links to
+-- the merge endpoints when it shows them.
+CREATE TABLE IF NOT EXISTS duplicate_reports (
+  id BIGSERIAL PRIMARY KEY,
+  status character varying(10) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed')),
+  groups jsonb NOT NULL DEFAULT '[]'::jsonb,
+  error text,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  started_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  finished_at timestamp(0) with time zone
+);
+
+INSERT INTO permissions (code) VALUES ('companies:merge'), ('products:merge') ON CONFLICT DO NOTHING;
@@ -0,0 +1 @@
+INSERT INTO permissions (code) VALUES ('organisations:delete') ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+ALTER TABLE organisations DROP COLUMN IF EXISTS draft_hides_requisites;
+ALTER TABLE organisations DROP COLUMN IF EXISTS draft_watermark;
@@ -0,0 +1,4 @@
+-- How invoices which haven't been sent yet are printed: the watermark across the page,
+-- none when empty, and whether the bank requisites are left out so a draft can't be paid.
+ALTER TABLE organisations ADD COLUMN IF NOT EXISTS draft_watermark character varying(50) NOT NULL DEFAULT 'ЧЕРНОВИК';
+ALTER TABLE organisations ADD COLUMN IF NOT EXISTS draft_hides_requisites boolean NOT NULL DEFAULT true;
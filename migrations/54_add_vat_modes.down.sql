@@ -0,0 +1,17 @@
+DROP VIEW IF EXISTS invoices_history;
+DROP VIEW IF EXISTS invoice_items_history;
+
+ALTER TABLE invoice_items_archive DROP COLUMN IF EXISTS vat_mode;
+ALTER TABLE invoices_archive DROP COLUMN IF EXISTS vat_mode;
+ALTER TABLE invoice_items DROP COLUMN IF EXISTS vat_mode;
+ALTER TABLE invoices DROP COLUMN IF EXISTS vat_mode;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+CREATE VIEW invoice_items_history AS
+  SELECT * FROM invoice_items
+  UNION ALL
+  SELECT * FROM invoice_items_archive;
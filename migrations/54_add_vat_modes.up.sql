@@ -0,0 +1,23 @@
+-- Whether the prices of an invoice include VAT or the VAT is added on top of them. A
+-- line may differ from its invoice, NULL follows the invoice.
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS vat_mode character varying(10) NOT NULL DEFAULT 'on_top'
+  CHECK (vat_mode IN ('on_top', 'included'));
+ALTER TABLE invoice_items ADD COLUMN IF NOT EXISTS vat_mode character varying(10)
+  CHECK (vat_mode IN ('on_top', 'included'));
+
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS vat_mode character varying(10) NOT NULL DEFAULT 'on_top';
+ALTER TABLE invoice_items_archive ADD COLUMN IF NOT EXISTS vat_mode character varying(10);
+
+-- The column lists of the history views are fixed when they are created.
+DROP VIEW IF EXISTS invoices_history;
+DROP VIEW IF EXISTS invoice_items_history;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+CREATE VIEW invoice_items_history AS
+  SELECT * FROM invoice_items
+  UNION ALL
+  SELECT * FROM invoice_items_archive;
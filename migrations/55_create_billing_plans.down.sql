@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code = 'billing_plans:manage';
+DROP TABLE IF EXISTS billing_plan_periods;
+DROP TABLE IF EXISTS billing_plan_usages;
+DROP TABLE IF EXISTS billing_plans;
@@ -0,0 +1,47 @@
+-- Retainer and subscription plans of companies: a fixed amount every calendar month
+-- with a quantity (hours, items) included in it. The units used above the included
+-- quantity are charged at overage_price with the invoice of the next month. Invoices
+-- are created on invoice_day of every month from the month of starts_on until ends_on.
+CREATE TABLE IF NOT EXISTS billing_plans (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  company_id bigint NOT NULL REFERENCES companies (id) ON DELETE CASCADE,
+  name character varying(255) NOT NULL,
+  product_id bigint NOT NULL REFERENCES products (id),
+  unit_id bigint REFERENCES units (id),
+  vat_rate_id bigint REFERENCES vat_rates (id),
+  amount numeric(15,2) NOT NULL CHECK (amount >= 0),
+  included_quantity numeric(10,3) NOT NULL DEFAULT 0 CHECK (included_quantity >= 0),
+  overage_price numeric(15,2) NOT NULL DEFAULT 0 CHECK (overage_price >= 0),
+  invoice_day smallint NOT NULL DEFAULT 1 CHECK (invoice_day BETWEEN 1 AND 28),
+  starts_on date NOT NULL,
+  ends_on date,
+  is_active boolean NOT NULL DEFAULT true,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS billing_plans_company_id_index ON billing_plans USING btree (company_id);
+
+-- The hours or items used under a plan, counted in the month of their date.
+CREATE TABLE IF NOT EXISTS billing_plan_usages (
+  id BIGSERIAL PRIMARY KEY,
+  billing_plan_id bigint NOT NULL REFERENCES billing_plans (id) ON DELETE CASCADE,
+  date date NOT NULL,
+  quantity numeric(10,3) NOT NULL CHECK (quantity > 0),
+  description text NOT NULL DEFAULT '',
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS billing_plan_usages_plan_date_index ON billing_plan_usages USING btree (billing_plan_id, date);
+
+-- The months a plan has been invoiced for, so no month is invoiced twice. The invoice
+-- may have been archived or deleted since.
+CREATE TABLE IF NOT EXISTS billing_plan_periods (
+  billing_plan_id bigint NOT NULL REFERENCES billing_plans (id) ON DELETE CASCADE,
+  period_start date NOT NULL,
+  invoice_id bigint,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (billing_plan_id, period_start)
+);
+
+INSERT INTO permissions (code) VALUES ('billing_plans:manage') ON CONFLICT DO NOTHING;
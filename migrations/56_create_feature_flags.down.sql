@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'admin:features';
+DROP TABLE IF EXISTS feature_flags;
@@ -0,0 +1,15 @@
+-- A flag without organisation is the global setting of the feature, the flags of
+-- organisations take precedence over it.
+CREATE TABLE IF NOT EXISTS feature_flags (
+  id bigserial PRIMARY KEY,
+  feature varchar(50) NOT NULL,
+  organisation_id bigint REFERENCES organisations (id) ON DELETE CASCADE,
+  enabled boolean NOT NULL,
+  user_id bigint,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS feature_flags_feature_organisation_id_idx ON feature_flags (feature, COALESCE(organisation_id, 0));
+
+INSERT INTO permissions (code) VALUES ('admin:features') ON CONFLICT DO NOTHING;
@@ -0,0 +1,14 @@
+-- The values of invoice lines which clients calculated differently than the server,
+-- recorded in the totals shadow mode.
+CREATE TABLE IF NOT EXISTS totals_mismatches (
+  id bigserial PRIMARY KEY,
+  organisation_id bigint,
+  invoice_id bigint NOT NULL,
+  invoice_item_id bigint NOT NULL,
+  field varchar(20) NOT NULL,
+  client_value numeric(15,2) NOT NULL,
+  server_value numeric(15,2) NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS totals_mismatches_created_at_idx ON totals_mismatches (created_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS acts_agreement_id_period_start_idx;
+ALTER TABLE acts DROP COLUMN IF EXISTS period_end;
+ALTER TABLE acts DROP COLUMN IF EXISTS period_start;
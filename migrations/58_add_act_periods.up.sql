@@ -0,0 +1,7 @@
+-- Acts generated for an agreement cover the invoices of a period, an agreement has one
+-- act per period.
+ALTER TABLE acts ADD COLUMN IF NOT EXISTS period_start date;
+ALTER TABLE acts ADD COLUMN IF NOT EXISTS period_end date;
+
+CREATE UNIQUE INDEX IF NOT EXISTS acts_agreement_id_period_start_idx ON acts (agreement_id, period_start)
+  WHERE destroyed_at IS NULL AND period_start IS NOT NULL;
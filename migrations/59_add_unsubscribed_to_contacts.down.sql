@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'contacts:export';
+ALTER TABLE contacts DROP COLUMN IF EXISTS unsubscribed;
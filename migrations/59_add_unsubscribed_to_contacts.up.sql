@@ -0,0 +1,4 @@
+-- Unsubscribed contacts are left out of the mail-merge exports.
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS unsubscribed boolean NOT NULL DEFAULT false;
+
+INSERT INTO permissions (code) VALUES ('contacts:export') ON CONFLICT DO NOTHING;
@@ -0,0 +1,18 @@
+-- The history of the requisites of an organisation which are printed on its documents.
+-- A record applies from valid_from until the next one, the first record of an
+-- organisation has no valid_from. The columns of organisations hold the requisites in
+-- force today; organisations without any history print them on all documents.
+CREATE TABLE IF NOT EXISTS organisation_requisites (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  valid_from date,
+  full_name character varying(255) NOT NULL DEFAULT '',
+  ceo character varying(150) NOT NULL DEFAULT '',
+  ceo_title character varying(40) NOT NULL DEFAULT '',
+  cfo character varying(150) NOT NULL DEFAULT '',
+  cfo_title character varying(40) NOT NULL DEFAULT '',
+  details jsonb NOT NULL DEFAULT '{}'::jsonb,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (organisation_id, valid_from)
+);
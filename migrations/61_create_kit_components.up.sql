@@ -0,0 +1,13 @@
+-- The components of kits, products of product_type 3 which are sold as a set of other
+-- products. A component can't be a kit itself.
+CREATE TABLE IF NOT EXISTS kit_components (
+  id BIGSERIAL PRIMARY KEY,
+  kit_id bigint NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+  product_id bigint NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+  quantity numeric(8,3) NOT NULL CHECK (quantity > 0),
+  position integer NOT NULL DEFAULT 0,
+  UNIQUE (kit_id, product_id),
+  CHECK (kit_id <> product_id)
+);
+
+CREATE INDEX IF NOT EXISTS kit_components_product_id_index ON kit_components USING btree (product_id);
@@ -0,0 +1,4 @@
+DELETE FROM payment_allocations WHERE return_id IS NOT NULL;
+ALTER TABLE payment_allocations DROP COLUMN IF EXISTS return_id;
+DROP TABLE IF EXISTS return_items;
+DROP TABLE IF EXISTS returns;
@@ -0,0 +1,41 @@
+-- Goods returned by a customer against an invoice. Every return is a credit note
+-- numbered in the credit_note sequence, its amount settles the invoice like a payment
+-- through an allocation with return_id instead of payment_id. Returns and their items
+-- don't reference invoices and invoice items, which may be moved to the archive.
+CREATE TABLE IF NOT EXISTS returns (
+  id BIGSERIAL PRIMARY KEY,
+  date timestamp without time zone NOT NULL,
+  number character varying(50),
+  organisation_id bigint REFERENCES organisations (id) ON DELETE CASCADE,
+  company_id bigint REFERENCES companies (id) ON DELETE CASCADE,
+  invoice_id bigint NOT NULL,
+  reason character varying(1024),
+  amount numeric(15,2) NOT NULL DEFAULT 0.0,
+  vat numeric(15,2) NOT NULL DEFAULT 0.0,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS returns_invoice_id_index ON returns USING btree (invoice_id);
+CREATE INDEX IF NOT EXISTS returns_company_id_index ON returns USING btree (company_id);
+
+CREATE TABLE IF NOT EXISTS return_items (
+  id BIGSERIAL PRIMARY KEY,
+  return_id bigint NOT NULL REFERENCES returns (id) ON DELETE CASCADE,
+  invoice_item_id bigint NOT NULL,
+  position integer NOT NULL DEFAULT 0,
+  product_id bigint REFERENCES products (id),
+  description character varying,
+  unit_id bigint REFERENCES units (id),
+  quantity numeric(8,3) NOT NULL CHECK (quantity > 0),
+  price numeric(15,2) NOT NULL DEFAULT 0.0,
+  amount numeric(15,2) NOT NULL DEFAULT 0.0,
+  vat_rate_id bigint REFERENCES vat_rates (id),
+  vat numeric(15,2) NOT NULL DEFAULT 0.0
+);
+
+CREATE INDEX IF NOT EXISTS return_items_return_id_index ON return_items USING btree (return_id);
+CREATE INDEX IF NOT EXISTS return_items_invoice_item_id_index ON return_items USING btree (invoice_item_id);
+
+ALTER TABLE payment_allocations ADD COLUMN IF NOT EXISTS return_id bigint REFERENCES returns (id) ON DELETE CASCADE;
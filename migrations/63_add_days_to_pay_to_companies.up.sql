@@ -0,0 +1,4 @@
+-- The weighted days to pay of the payment stats, kept as a column so that companies can
+-- be sorted by it.
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS days_to_pay numeric
+  GENERATED ALWAYS AS ((payment_stats->>'weighted_days_to_pay')::numeric) STORED;
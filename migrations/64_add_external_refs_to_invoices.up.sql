@@ -0,0 +1,13 @@
+-- The references of an invoice in external systems, by system: {"crm": "123", "1c": "..."}.
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS external_refs jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS external_refs jsonb NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS invoices_external_refs_index ON invoices USING gin (external_refs jsonb_path_ops);
+
+-- The column lists of the history views are fixed when they are created.
+DROP VIEW IF EXISTS invoices_history;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
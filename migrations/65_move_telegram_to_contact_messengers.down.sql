@@ -0,0 +1,7 @@
+ALTER TABLE contacts ALTER COLUMN details DROP NOT NULL;
+
+UPDATE contacts
+SET details = jsonb_build_object('telegram', details->'messengers'->>'telegram')
+WHERE details->'messengers' ? 'telegram';
+
+UPDATE contacts SET details = '{}' WHERE NOT details ? 'telegram';
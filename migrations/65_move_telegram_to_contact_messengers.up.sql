@@ -0,0 +1,10 @@
+UPDATE contacts SET details = '{}' WHERE details IS NULL;
+
+UPDATE contacts
+SET details = (details - 'telegram') || jsonb_build_object('messengers', jsonb_build_object('telegram', details->>'telegram'))
+WHERE COALESCE(details->>'telegram', '') <> '';
+
+UPDATE contacts SET details = details - 'telegram' WHERE details ? 'telegram';
+
+ALTER TABLE contacts ALTER COLUMN details SET DEFAULT '{}';
+ALTER TABLE contacts ALTER COLUMN details SET NOT NULL;
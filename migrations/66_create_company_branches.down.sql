@@ -0,0 +1,12 @@
+DROP VIEW IF EXISTS invoices_history;
+
+DROP INDEX IF EXISTS invoices_branch_id_index;
+ALTER TABLE invoices_archive DROP COLUMN IF EXISTS branch_id;
+ALTER TABLE invoices DROP COLUMN IF EXISTS branch_id;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+DROP TABLE IF EXISTS company_branches;
@@ -0,0 +1,29 @@
+-- The branches of a company, divisions with their own KPP and address which are
+-- invoiced separately. The INN and OGRN are those of the company. At most one branch of
+-- a company is its default, which new invoices to the company get.
+CREATE TABLE IF NOT EXISTS company_branches (
+  id BIGSERIAL PRIMARY KEY,
+  company_id bigint NOT NULL REFERENCES companies (id) ON DELETE CASCADE,
+  name character varying NOT NULL,
+  kpp character varying NOT NULL DEFAULT '',
+  address text NOT NULL DEFAULT '',
+  is_default boolean NOT NULL DEFAULT false,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS company_branches_company_id_index ON company_branches USING btree (company_id);
+CREATE UNIQUE INDEX IF NOT EXISTS company_branches_default_index ON company_branches (company_id) WHERE is_default;
+
+-- The branch the invoice is issued to. A branch used by invoices can't be deleted.
+DROP VIEW IF EXISTS invoices_history;
+
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS branch_id bigint REFERENCES company_branches (id);
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS branch_id bigint;
+
+CREATE INDEX IF NOT EXISTS invoices_branch_id_index ON invoices USING btree (branch_id);
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
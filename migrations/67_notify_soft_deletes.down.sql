@@ -0,0 +1,20 @@
+CREATE OR REPLACE FUNCTION notify_change() RETURNS trigger AS $$
+declare
+  r record;
+begin
+  if tg_op = 'DELETE' then
+    r := old;
+  else
+    r := new;
+  end if;
+
+  perform pg_notify('table_changes', json_build_object(
+    'table', tg_table_name,
+    'operation', lower(tg_op),
+    'id', r.id,
+    'organisation_id', case when tg_nargs > 0 then (to_jsonb(r) ->> tg_argv[0])::bigint end
+  )::text);
+
+  return null;
+end
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,32 @@
+-- Invoices, companies and products are deleted by setting destroyed_at, so an update
+-- which sets it is announced as a deletion and one which clears it, restoring the row,
+-- as an insertion. Event streams see them like the rows were deleted and inserted.
+CREATE OR REPLACE FUNCTION notify_change() RETURNS trigger AS $$
+declare
+  r record;
+  operation text := lower(tg_op);
+begin
+  if tg_op = 'DELETE' then
+    r := old;
+  else
+    r := new;
+  end if;
+
+  if tg_op = 'UPDATE' then
+    if to_jsonb(old) ->> 'destroyed_at' is null and to_jsonb(new) ->> 'destroyed_at' is not null then
+      operation := 'delete';
+    elsif to_jsonb(old) ->> 'destroyed_at' is not null and to_jsonb(new) ->> 'destroyed_at' is null then
+      operation := 'insert';
+    end if;
+  end if;
+
+  perform pg_notify('table_changes', json_build_object(
+    'table', tg_table_name,
+    'operation', operation,
+    'id', r.id,
+    'organisation_id', case when tg_nargs > 0 then (to_jsonb(r) ->> tg_argv[0])::bigint end
+  )::text);
+
+  return null;
+end
+$$ LANGUAGE plpgsql;
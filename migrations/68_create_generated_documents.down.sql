@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS generated_documents;
+DROP FUNCTION IF EXISTS generated_documents_immutable();
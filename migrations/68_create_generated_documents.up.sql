@@ -0,0 +1,35 @@
+-- Copies of the documents as they were issued: the printed invoices and the exchange
+-- files pushed to 1C. Every document and format has numbered versions, a new one is
+-- only kept when the content changed. The content is in the storage, by organisation
+-- and SHA-256. Versions are never changed; once retain_until has passed they are
+-- removed by the generated_documents job, without it they are kept for good.
+CREATE TABLE IF NOT EXISTS generated_documents (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  document_type character varying(20) NOT NULL,
+  document_id bigint NOT NULL,
+  format character varying(20) NOT NULL,
+  version integer NOT NULL,
+  name character varying(255) NOT NULL,
+  content_type character varying(100) NOT NULL,
+  size bigint NOT NULL,
+  sha256 character(64) NOT NULL,
+  retain_until date,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (document_type, document_id, format, version)
+);
+
+CREATE INDEX IF NOT EXISTS generated_documents_retain_until_index ON generated_documents USING btree (retain_until)
+  WHERE retain_until IS NOT NULL;
+CREATE INDEX IF NOT EXISTS generated_documents_sha256_index ON generated_documents USING btree (organisation_id, sha256);
+
+CREATE OR REPLACE FUNCTION generated_documents_immutable() RETURNS trigger AS $$
+begin
+  raise exception 'generated documents can''t be changed';
+end
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER generated_documents_immutable BEFORE UPDATE
+ON generated_documents
+FOR EACH ROW EXECUTE PROCEDURE generated_documents_immutable();
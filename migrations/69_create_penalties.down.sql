@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS invoice_penalties;
+ALTER TABLE agreements DROP COLUMN IF EXISTS penalty_rate;
+DROP TABLE IF EXISTS key_rates;
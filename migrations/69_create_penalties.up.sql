@@ -0,0 +1,28 @@
+-- The key rate of the Bank of Russia, which the statutory penalty for late payment
+-- (article 395 of the Civil Code) is calculated with, from the day it took effect.
+CREATE TABLE IF NOT EXISTS key_rates (
+  effective_from date PRIMARY KEY,
+  rate numeric(5,2) NOT NULL CHECK (rate >= 0),
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- The contractual penalty in percent of the debt per day.
+ALTER TABLE agreements ADD COLUMN IF NOT EXISTS penalty_rate numeric(7,4) CHECK (penalty_rate > 0);
+
+-- The penalties charged by penalty invoices, so the days of an overdue invoice are
+-- charged once. Like the allocations they refer to invoices which may be archived.
+CREATE TABLE IF NOT EXISTS invoice_penalties (
+  id BIGSERIAL PRIMARY KEY,
+  invoice_id bigint NOT NULL,
+  penalty_invoice_id bigint NOT NULL,
+  basis character varying(20) NOT NULL,
+  period_start date NOT NULL,
+  period_end date NOT NULL,
+  amount numeric(15,2) NOT NULL,
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS invoice_penalties_invoice_id_index ON invoice_penalties USING btree (invoice_id);
+CREATE INDEX IF NOT EXISTS invoice_penalties_penalty_invoice_id_index ON invoice_penalties USING btree (penalty_invoice_id);
@@ -0,0 +1,10 @@
+DROP VIEW IF EXISTS invoices_history;
+
+DROP INDEX IF EXISTS invoices_status_index;
+ALTER TABLE invoices_archive DROP COLUMN IF EXISTS status;
+ALTER TABLE invoices DROP COLUMN IF EXISTS status;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
@@ -0,0 +1,25 @@
+-- The workflow status of an invoice: a draft until it's sent to the company, then paid
+-- or cancelled. Paid and cancelled invoices stay so.
+DROP VIEW IF EXISTS invoices_history;
+
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS status character varying NOT NULL DEFAULT 'draft'
+  CHECK (status IN ('draft', 'sent', 'paid', 'cancelled'));
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS status character varying NOT NULL DEFAULT 'draft';
+
+-- Invoices which have been sent or viewed are sent, those paid in full are paid.
+UPDATE invoices SET status = 'sent'
+WHERE EXISTS (SELECT 1 FROM invoice_sendings WHERE invoice_id = invoices.id AND status = 'sent')
+  OR EXISTS (SELECT 1 FROM communications WHERE invoice_id = invoices.id AND status IN ('sent', 'viewed'));
+
+UPDATE invoices SET status = 'paid'
+WHERE amount > 0
+  AND amount + COALESCE(vat, 0) <= (SELECT COALESCE(SUM(amount), 0) FROM payment_allocations WHERE invoice_id = invoices.id);
+
+UPDATE invoices_archive SET status = 'paid' WHERE written_off_at IS NULL AND destroyed_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS invoices_status_index ON invoices USING btree (status);
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
@@ -0,0 +1,22 @@
+DELETE FROM permissions WHERE code = 'stock:write_off';
+
+DROP VIEW IF EXISTS invoices_history;
+
+UPDATE invoices SET status = 'sent' WHERE status = 'shipped';
+UPDATE invoices_archive SET status = 'sent' WHERE status = 'shipped';
+
+ALTER TABLE invoices DROP CONSTRAINT IF EXISTS invoices_status_check;
+ALTER TABLE invoices ADD CONSTRAINT invoices_status_check
+  CHECK (status IN ('draft', 'sent', 'paid', 'cancelled'));
+
+ALTER TABLE invoices_archive DROP COLUMN IF EXISTS shipped_at;
+ALTER TABLE invoices DROP COLUMN IF EXISTS shipped_at;
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+DROP TABLE IF EXISTS stock_balances;
+DROP TABLE IF EXISTS stock_movements;
+DROP TABLE IF EXISTS warehouses;
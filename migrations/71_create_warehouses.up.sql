@@ -0,0 +1,67 @@
+-- The warehouses of an organisation. Invoices are shipped from the default warehouse
+-- unless another one is chosen, an organisation has at most one.
+CREATE TABLE IF NOT EXISTS warehouses (
+  id BIGSERIAL PRIMARY KEY,
+  organisation_id bigint NOT NULL REFERENCES organisations (id) ON DELETE CASCADE,
+  name character varying NOT NULL,
+  address character varying,
+  is_default boolean NOT NULL DEFAULT false,
+  destroyed_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS warehouses_organisation_id_index ON warehouses USING btree (organisation_id);
+CREATE UNIQUE INDEX IF NOT EXISTS warehouses_default_index ON warehouses USING btree (organisation_id)
+  WHERE is_default AND destroyed_at IS NULL;
+
+-- Every change of the stock of goods in a warehouse. Receipts and returns add to it,
+-- write-offs and shipments of invoices take from it, so the quantity is signed.
+-- Shipments and returns don't reference invoices, which may be moved to the archive.
+CREATE TABLE IF NOT EXISTS stock_movements (
+  id BIGSERIAL PRIMARY KEY,
+  warehouse_id bigint NOT NULL REFERENCES warehouses (id) ON DELETE CASCADE,
+  product_id bigint NOT NULL REFERENCES products (id),
+  kind character varying NOT NULL CHECK (kind IN ('receipt', 'write_off', 'shipment', 'return')),
+  date timestamp without time zone NOT NULL,
+  quantity numeric(12,3) NOT NULL CHECK (quantity <> 0),
+  invoice_id bigint,
+  return_id bigint REFERENCES returns (id) ON DELETE CASCADE,
+  description character varying(1024),
+  user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS stock_movements_warehouse_id_product_id_index ON stock_movements USING btree (warehouse_id, product_id);
+CREATE INDEX IF NOT EXISTS stock_movements_product_id_index ON stock_movements USING btree (product_id);
+CREATE INDEX IF NOT EXISTS stock_movements_invoice_id_index ON stock_movements USING btree (invoice_id);
+
+-- The quantity on hand of the goods in each warehouse, the sum of their movements. It
+-- is kept with the movements, which lock the rows of the goods they move.
+CREATE TABLE IF NOT EXISTS stock_balances (
+  warehouse_id bigint NOT NULL REFERENCES warehouses (id) ON DELETE CASCADE,
+  product_id bigint NOT NULL REFERENCES products (id),
+  quantity numeric(12,3) NOT NULL DEFAULT 0,
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (warehouse_id, product_id)
+);
+
+CREATE INDEX IF NOT EXISTS stock_balances_product_id_index ON stock_balances USING btree (product_id);
+
+-- Invoices are shipped once: from draft or sent they move to shipped, paid invoices
+-- stay paid.
+DROP VIEW IF EXISTS invoices_history;
+
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS shipped_at timestamp(0) with time zone;
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS shipped_at timestamp(0) with time zone;
+
+ALTER TABLE invoices DROP CONSTRAINT IF EXISTS invoices_status_check;
+ALTER TABLE invoices ADD CONSTRAINT invoices_status_check
+  CHECK (status IN ('draft', 'sent', 'shipped', 'paid', 'cancelled'));
+
+CREATE VIEW invoices_history AS
+  SELECT invoices.*, false AS archived FROM invoices
+  UNION ALL
+  SELECT invoices_archive.*, true AS archived FROM invoices_archive;
+
+INSERT INTO permissions (code) VALUES ('stock:write_off') ON CONFLICT DO NOTHING;
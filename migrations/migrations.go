@@ -0,0 +1,8 @@
+// Package migrations embeds the SQL migrations, so the server can tell at startup
+// whether the database schema is up to date. migrate ignores this file.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS